@@ -0,0 +1,215 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// The module aux section of V2.5 follows the module headers section. For
+// each module with auxiliary data, in archive order, it holds the
+// specifier, the number of blobs and then each name and blob, sorted by
+// name. Names and blobs are prefixed with their length as a big-endian
+// u32. Like headers, blobs are neither compressed nor encrypted.
+
+// auxStore is implemented by the module inners of archives that can hold
+// auxiliary data.
+type auxStore interface {
+	getAux(specifier, name string) ([]byte, bool)
+	auxNames(specifier string) []string
+	setAux(specifier, name string, data []byte) error
+}
+
+// GetAux returns the auxiliary blob stored with the module under name.
+// The returned slice must not be modified. V1 archives and archives before
+// v2.5 have none.
+func (m *Module) GetAux(name string) ([]byte, bool) {
+	if store, ok := m.inner.(auxStore); ok {
+		return store.getAux(m.Specifier, name)
+	}
+	return nil, false
+}
+
+// AuxNames returns the names of the module's auxiliary blobs, sorted.
+func (m *Module) AuxNames() []string {
+	if store, ok := m.inner.(auxStore); ok {
+		return store.auxNames(m.Specifier)
+	}
+	return nil
+}
+
+// SetAux stores data with the module under name, such as a compiled code
+// cache a runtime can load instead of compiling the source, replacing any
+// blob of that name; nil data removes it. See EszipV2.SetModuleAux. It
+// fails for V1 archives.
+func (m *Module) SetAux(name string, data []byte) error {
+	if store, ok := m.inner.(auxStore); ok {
+		return store.setAux(m.Specifier, name, data)
+	}
+	return errors.New("eszip: V1 archives have no auxiliary data")
+}
+
+// SetModuleAux stores data with the module at specifier under name,
+// replacing any blob of that name; nil data removes it. The data is
+// copied. Auxiliary data is stored in the module aux section of format
+// v2.5, which Deno cannot read, so an archive at an earlier version is
+// moved to v2.5. It fails with ErrSpecifierNotFound if specifier is missing
+// or is not a module.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) SetModuleAux(specifier, name string, data []byte) error {
+	if name == "" {
+		return errors.New("eszip: auxiliary data needs a name")
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	existing, _ := e.modules.Get(specifier)
+	current, ok := existing.(*ModuleData)
+	if !ok {
+		return fmt.Errorf("%w: %s is not a module", ErrSpecifierNotFound, specifier)
+	}
+	aux := maps.Clone(current.Aux)
+	if data == nil {
+		delete(aux, name)
+	} else {
+		if aux == nil {
+			aux = make(map[string][]byte, 1)
+		}
+		aux[name] = slices.Clone(data)
+		e.version = max(e.version, VersionV2_5)
+	}
+	if len(aux) == 0 {
+		aux = nil
+	}
+	// The entry is replaced rather than modified, so writers holding the
+	// old one are unaffected; it keeps its slots and place.
+	updated := *current
+	updated.Aux = aux
+	e.modules.Insert(specifier, &updated)
+	return nil
+}
+
+func (v *v2ModuleInner) getAux(specifier, name string) ([]byte, bool) {
+	if data := v.moduleData(specifier); data != nil {
+		blob, ok := data.Aux[name]
+		return blob, ok
+	}
+	return nil, false
+}
+
+func (v *v2ModuleInner) auxNames(specifier string) []string {
+	if data := v.moduleData(specifier); data != nil && len(data.Aux) > 0 {
+		return slices.Sorted(maps.Keys(data.Aux))
+	}
+	return nil
+}
+
+func (v *v2ModuleInner) setAux(specifier, name string, data []byte) error {
+	return v.eszip.SetModuleAux(specifier, name, data)
+}
+
+// appendModuleAux returns the content of the module aux section for
+// entries.
+func appendModuleAux(buf []byte, keys []string, entries []EszipV2Module) []byte {
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok || len(data.Aux) == 0 {
+			continue
+		}
+		appendString(&buf, specifier)
+		buf = appendU32BE(buf, uint32(len(data.Aux)))
+		for _, name := range slices.Sorted(maps.Keys(data.Aux)) {
+			appendString(&buf, name)
+			buf = appendU32BE(buf, uint32(len(data.Aux[name])))
+			buf = append(buf, data.Aux[name]...)
+		}
+	}
+	return buf
+}
+
+// moduleAuxLen returns the bytes data's auxiliary blobs add to the module
+// aux section.
+func moduleAuxLen(specifier string, data *ModuleData) int64 {
+	if len(data.Aux) == 0 {
+		return 0
+	}
+	n := 4 + int64(len(specifier)) + 4
+	for name, blob := range data.Aux {
+		n += 4 + int64(len(name)) + 4 + int64(len(blob))
+	}
+	return n
+}
+
+// parseModuleAuxSection reads the module aux section and attaches the
+// blobs to the modules of modules.
+func parseModuleAuxSection(br *archiveReader, options Options, modules *ModuleMap) error {
+	start := br.offset
+	section, err := readSection(br, options)
+	if err != nil {
+		return err
+	}
+	br.reportSection("module_aux", start)
+
+	if !br.checksumValid(section) {
+		return errInvalidV25ModuleAuxHash(section)
+	}
+
+	content := section.Content()
+	read := 0
+	readBytes := func(what string) ([]byte, error) {
+		if read+4 > len(content) {
+			return nil, errInvalidV25ModuleAux(what+" len", section.offset+read)
+		}
+		n := int(binary.BigEndian.Uint32(content[read : read+4]))
+		read += 4
+		if n > len(content)-read {
+			return nil, errInvalidV25ModuleAux(what, section.offset+read)
+		}
+		b := content[read : read+n]
+		read += n
+		return b, nil
+	}
+
+	for read < len(content) {
+		offset := section.offset + read
+		specifier, err := readBytes("specifier")
+		if err != nil {
+			return err
+		}
+		entry, _ := modules.Get(string(specifier))
+		data, ok := entry.(*ModuleData)
+		if !ok {
+			return errInvalidV25ModuleAux("aux data for "+string(specifier)+", which is not a module", offset)
+		}
+		if data.Aux != nil {
+			return errInvalidV25ModuleAux("duplicate aux data for "+string(specifier), offset)
+		}
+
+		if read+4 > len(content) {
+			return errInvalidV25ModuleAux("blob count", section.offset+read)
+		}
+		count := int(binary.BigEndian.Uint32(content[read : read+4]))
+		read += 4
+		// Each blob takes at least its two length prefixes.
+		if count > (len(content)-read)/8 {
+			return errInvalidV25ModuleAux("blob count", section.offset+read-4)
+		}
+		aux := make(map[string][]byte, count)
+		for range count {
+			name, err := readBytes("blob name")
+			if err != nil {
+				return err
+			}
+			blob, err := readBytes("blob")
+			if err != nil {
+				return err
+			}
+			aux[string(name)] = slices.Clone(blob)
+		}
+		data.Aux = aux
+	}
+	return nil
+}
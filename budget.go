@@ -0,0 +1,134 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WriteError is returned by IntoBytes when the archive would exceed the
+// size given to WithMaxArchiveSize, or when a source is still pending after
+// the time given to WithSlotWaitTimeout. In the latter case only Pending and
+// Waited are set.
+type WriteError struct {
+	// Size is the archive size reached when the limit was found to be
+	// exceeded: the estimate if it failed before serializing, otherwise
+	// the bytes produced so far.
+	Size  int64
+	Limit int64
+	// Largest lists up to five of the largest modules by source plus
+	// source map size, largest first, to help decide what to trim.
+	Largest []ModuleSize
+
+	// Pending is the specifier whose source or source map was still
+	// streaming in when the wait gave up, after Waited.
+	Pending string
+	Waited  time.Duration
+}
+
+func (e *WriteError) Error() string {
+	if e.Pending != "" {
+		return fmt.Sprintf("eszip: source of %s still pending after %s", e.Pending, e.Waited.Round(time.Millisecond))
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "eszip: archive size %d bytes exceeds the limit of %d bytes", e.Size, e.Limit)
+	if len(e.Largest) > 0 {
+		b.WriteString("; largest modules:")
+		for _, m := range e.Largest {
+			fmt.Fprintf(&b, " %s (%d bytes)", m.Specifier, m.Source+m.SourceMap)
+		}
+	}
+	return b.String()
+}
+
+func (e *EszipV2) errTooLarge(size, limit int64) *WriteError {
+	return newSizeLimitError(size, limit, e.ModuleSizes())
+}
+
+func newSizeLimitError(size, limit int64, sizes []ModuleSize) *WriteError {
+	sort.SliceStable(sizes, func(i, j int) bool {
+		return sizes[i].Source+sizes[i].SourceMap > sizes[j].Source+sizes[j].SourceMap
+	})
+	return &WriteError{Size: size, Limit: limit, Largest: sizes[:min(len(sizes), 5)]}
+}
+
+// EstimatedSize returns the number of bytes IntoBytes would produce now,
+// without loading or waiting for any source. Sources still streaming in
+// count at the length the archive header declared for them, so the
+// estimate is exact once every source is loaded and the content matches
+// the header.
+func (e *EszipV2) EstimatedSize() int64 {
+	e.mu.RLock()
+	checksumSize := int64(e.options.GetChecksumSize())
+	unknownOptions := int64(len(e.options.unknown))
+	version := e.version
+	npmSnapshot := e.npmSnapshot
+	trailing := int64(len(e.trailing))
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	// Each hashed section is a length prefix, its content and a hash.
+	section := func(content int64) int64 { return 4 + content + checksumSize }
+
+	var header, sources, sourceMaps int64
+	for i, specifier := range keys {
+		h, src, srcMap := entrySize(specifier, entries[i], checksumSize)
+		header += h
+		sources += src
+		sourceMaps += srcMap
+	}
+	npmHeader, npmBytes := appendNpmSnapshot(nil, npmSnapshot)
+	header += int64(len(npmHeader))
+
+	size := 8 + section(header) + 4 + sources + 4 + sourceMaps + trailing
+	if version.SupportsOptions() {
+		size += section(int64(len(optionsHeaderContent(Options{}))) + unknownOptions)
+	}
+	if version.SupportsNpm() {
+		size += section(int64(len(npmBytes)))
+	}
+	if version.SupportsHeaders() {
+		size += section(0)
+	}
+	if version.SupportsAux() {
+		size += section(0)
+	}
+	if version.SupportsNpmIntegrity() {
+		size += section(int64(len(appendNpmIntegrity(nil, npmSnapshot))))
+	}
+	return size
+}
+
+// entrySize returns the bytes an entry adds to the modules header, the
+// sources section and the source maps section when written.
+func entrySize(specifier string, entry EszipV2Module, checksumSize int64) (header, source, sourceMap int64) {
+	header = 4 + int64(len(specifier)) + 1
+	switch m := entry.(type) {
+	case *ModuleData:
+		header += 17
+		if n := m.Source.declaredLen(); n > 0 {
+			source = n + checksumSize
+		}
+		if n := m.SourceMap.declaredLen(); n > 0 {
+			sourceMap = n + checksumSize
+		}
+		if len(m.Headers) > 0 {
+			// Counted with the header, though written to the module
+			// headers section.
+			header += 4 + int64(len(specifier)) + 4
+			for key, value := range m.Headers {
+				header += 4 + int64(len(key)) + 4 + int64(len(value))
+			}
+		}
+		// Auxiliary data is counted with the header too.
+		header += moduleAuxLen(specifier, m)
+	case *ModuleRedirect:
+		header += 4 + int64(len(m.Target))
+	case *NpmSpecifierEntry:
+		header += 4
+	}
+	return header, source, sourceMap
+}
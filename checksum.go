@@ -5,7 +5,9 @@ package eszip
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/binary"
 
+	"github.com/zeebo/blake3"
 	"github.com/zeebo/xxh3"
 )
 
@@ -16,8 +18,24 @@ const (
 	ChecksumNone   ChecksumType = 0
 	ChecksumSha256 ChecksumType = 1
 	ChecksumXxh3   ChecksumType = 2
+	ChecksumBlake3 ChecksumType = 3
 )
 
+func (c ChecksumType) String() string {
+	switch c {
+	case ChecksumNone:
+		return "none"
+	case ChecksumSha256:
+		return "sha256"
+	case ChecksumXxh3:
+		return "xxhash3"
+	case ChecksumBlake3:
+		return "blake3"
+	default:
+		return "unknown"
+	}
+}
+
 // DigestSize returns the size in bytes of the hash digest
 func (c ChecksumType) DigestSize() uint8 {
 	switch c {
@@ -27,6 +45,8 @@ func (c ChecksumType) DigestSize() uint8 {
 		return 32
 	case ChecksumXxh3:
 		return 8
+	case ChecksumBlake3:
+		return 32
 	default:
 		return 0
 	}
@@ -34,28 +54,28 @@ func (c ChecksumType) DigestSize() uint8 {
 
 // Hash computes the checksum of the given data
 func (c ChecksumType) Hash(data []byte) []byte {
+	return c.appendHash(nil, data, int(c.DigestSize()))
+}
+
+// appendHash appends the first size bytes of the checksum of data to buf,
+// so writers can hash each entry without allocating a digest for it.
+// Archives whose ChecksumSize is smaller than the digest store truncated
+// checksums.
+func (c ChecksumType) appendHash(buf, data []byte, size int) []byte {
+	var sum [32]byte
+	var h []byte
 	switch c {
-	case ChecksumNone:
-		return nil
 	case ChecksumSha256:
-		h := sha256.Sum256(data)
-		return h[:]
+		sum = sha256.Sum256(data)
+		h = sum[:]
 	case ChecksumXxh3:
-		h := xxh3.Hash(data)
-		// Convert to big-endian bytes
-		return []byte{
-			byte(h >> 56),
-			byte(h >> 48),
-			byte(h >> 40),
-			byte(h >> 32),
-			byte(h >> 24),
-			byte(h >> 16),
-			byte(h >> 8),
-			byte(h),
-		}
-	default:
-		return nil
+		binary.BigEndian.PutUint64(sum[:], xxh3.Hash(data))
+		h = sum[:8]
+	case ChecksumBlake3:
+		sum = blake3.Sum256(data)
+		h = sum[:]
 	}
+	return append(buf, h[:min(size, len(h))]...)
 }
 
 // Verify checks if the given hash matches the data
@@ -67,6 +87,17 @@ func (c ChecksumType) Verify(data, hash []byte) bool {
 	return bytes.Equal(computed, hash)
 }
 
+// verifyTruncated is Verify for a hash that may be cut short of the digest,
+// as in archives whose ChecksumSize is smaller than it. An empty hash does
+// not verify.
+func (c ChecksumType) verifyTruncated(data, hash []byte) bool {
+	if c == ChecksumNone {
+		return true
+	}
+	computed := c.Hash(data)
+	return len(hash) > 0 && len(hash) <= len(computed) && bytes.Equal(computed[:len(hash)], hash)
+}
+
 // FromU8 creates a ChecksumType from a byte value
 func ChecksumFromU8(b uint8) (ChecksumType, bool) {
 	switch b {
@@ -76,6 +107,8 @@ func ChecksumFromU8(b uint8) (ChecksumType, bool) {
 		return ChecksumSha256, true
 	case 2:
 		return ChecksumXxh3, true
+	case 3:
+		return ChecksumBlake3, true
 	default:
 		return ChecksumNone, false
 	}
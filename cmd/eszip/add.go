@@ -0,0 +1,166 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+func (a *app) addCmd() *cobra.Command {
+	var outputPath string
+	var inputOpts inputOptions
+	var root, baseURL string
+	var transpilerCommand string
+	var replace bool
+	var strictMediaTypes bool
+	var noRemote bool
+
+	cmd := &cobra.Command{
+		Use:   "add <archive> <files...>",
+		Short: "Add modules to an existing eszip archive",
+		Long: `Add files, directories or URLs to an existing V2 archive without
+reassembling its inputs. The archive keeps its format version, checksum,
+compression, encryption, import map, npm snapshot and metadata; its
+modules keep their order and the new ones follow them. The archive is
+replaced unless --output is given.
+
+Inputs are collected and given specifiers as by create, whose --root,
+--base-url, --include, --exclude and --transpiler flags work the same way
+here. Adding a specifier the archive already holds is an error unless
+--replace is given, in which case the module is replaced where it stands.`,
+		Example: `  eszip add app.eszip2 worker.js
+  eszip add --root . app.eszip2 src/routes
+  eszip add --replace -o patched.eszip2 app.eszip2 main.js`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			archivePath, args := args[0], args[1:]
+			if outputPath == "" {
+				outputPath = archivePath
+			}
+			archive, err := a.loadArchive(ctx, archivePath)
+			if err != nil {
+				return err
+			}
+			v2, ok := archive.V2()
+			if !ok {
+				return fmt.Errorf("%s: only V2 archives can be added to; convert it with eszip convert --to v2", archivePath)
+			}
+
+			var transpiler eszip.Transpiler
+			if transpilerCommand != "" {
+				if transpiler, err = newCommandTranspiler(ctx, transpilerCommand); err != nil {
+					return err
+				}
+			}
+			specifiers, err := newSpecifierMapper(root, baseURL)
+			if err != nil {
+				return err
+			}
+
+			existing := make(map[string]bool)
+			for _, spec := range v2.Specifiers() {
+				existing[spec] = true
+			}
+			checkNew := func(specifier string) error {
+				if existing[specifier] && !replace {
+					return fmt.Errorf("%s is already in %s; pass --replace to overwrite it", specifier, archivePath)
+				}
+				existing[specifier] = true
+				return nil
+			}
+
+			var localArgs, remoteArgs []string
+			for _, arg := range args {
+				if isRemoteInput(arg) {
+					remoteArgs = append(remoteArgs, arg)
+				} else {
+					localArgs = append(localArgs, arg)
+				}
+			}
+			inputs, err := collectInputs(localArgs, inputOpts)
+			if err != nil {
+				return err
+			}
+			if len(inputs.skipped) > 0 {
+				fmt.Fprintf(a.stderr, "Warning: skipped %d input(s):\n", len(inputs.skipped))
+				for _, s := range inputs.skipped {
+					fmt.Fprintf(a.stderr, "  %s: %s\n", s.path, s.reason)
+				}
+			}
+
+			added := 0
+			for _, input := range inputs.files {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				specifier, err := specifiers.specifier(input.path)
+				if err != nil {
+					return err
+				}
+				if err := checkNew(specifier); err != nil {
+					return err
+				}
+				if err := addModuleFromFile(v2, input.real, specifier, transpiler); err != nil {
+					return err
+				}
+				fmt.Fprintf(a.stdout, "Added: %s\n", specifier)
+				added++
+			}
+
+			if noRemote && len(remoteArgs) > 0 {
+				return fmt.Errorf("cannot fetch %s: remote inputs are disabled by --no-remote", remoteArgs[0])
+			}
+			for _, arg := range remoteArgs {
+				m, err := fetchRemote(ctx, arg, strictMediaTypes)
+				if err != nil {
+					return err
+				}
+				if m.warning != "" {
+					fmt.Fprintf(a.stderr, "Warning: %s: %s\n", m.specifier, m.warning)
+				}
+				for _, spec := range slices.Compact([]string{m.requested, m.specifier}) {
+					if err := checkNew(spec); err != nil {
+						return err
+					}
+				}
+				m.addTo(v2)
+				fmt.Fprintf(a.stdout, "Added: %s (%s)\n", m.specifier, m.kind)
+				added++
+			}
+
+			data, err := v2.IntoBytes(append(a.writeOptions(), eszip.WithRedirectValidation())...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(ctx, outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			fmt.Fprintf(a.stdout, "Wrote: %s (%d module(s) added, %d bytes)\n", outputPath, added, len(data))
+			if len(inputs.excluded) > 0 {
+				fmt.Fprintf(a.stdout, "Excluded: %d path(s)\n", len(inputs.excluded))
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "", "Output file path (default: replace the archive)")
+	cmd.Flags().BoolVar(&replace, "replace", false, "Replace modules the archive already holds")
+	cmd.Flags().BoolVar(&inputOpts.symlinks.follow, "follow-symlinks", false, "Follow symbolic links to files and directories")
+	cmd.Flags().BoolVar(&inputOpts.symlinks.allowExternal, "allow-external-symlinks", false, "Follow symbolic links that point outside the inputs")
+	cmd.Flags().StringArrayVar((*[]string)(&inputOpts.include), "include", nil, "Add only files matching a glob pattern (repeatable)")
+	cmd.Flags().StringArrayVar((*[]string)(&inputOpts.exclude), "exclude", nil, "Skip inputs matching a glob pattern (repeatable)")
+	cmd.Flags().StringVar(&root, "root", "", "Directory whose files get specifiers relative to --base-url")
+	cmd.Flags().StringVar(&baseURL, "base-url", "", "URL that --root maps to (default file:///)")
+	cmd.Flags().StringVar(&transpilerCommand, "transpiler", "", "Command that turns TypeScript, TSX and JSX on stdin into JavaScript")
+	cmd.Flags().BoolVar(&strictMediaTypes, "strict-media-types", false, "Fail when a fetched module's Content-Type and extension disagree")
+	cmd.Flags().BoolVar(&noRemote, "no-remote", false, "Fail instead of fetching http and https inputs")
+
+	return cmd
+}
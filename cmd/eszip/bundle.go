@@ -0,0 +1,423 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+func (a *app) bundleCmd() *cobra.Command {
+	var outputPath string
+	var checksum string
+	var checksumSize uint8
+	var noRemote bool
+	var strictMediaTypes bool
+	var importMapPath string
+	var transpilerCommand string
+	var minifierCommand string
+	var cacheDir string
+	var watch bool
+
+	cmd := &cobra.Command{
+		Use:   "bundle <entrypoints...>",
+		Short: "Create an eszip archive from the module graph of entry files",
+		Long: `Create an eszip archive from the module graph of entry files. Starting from
+each entrypoint, the static imports, re-exports and string-literal dynamic
+imports of JavaScript and TypeScript modules are followed, and every module
+reached is added. The entrypoints are recorded in the archive, for
+runtimes and for prune. Relative and file: specifiers are resolved as
+written, without guessing extensions; a missing file fails the bundle.
+
+http and https imports are fetched and followed in turn, as for create, so
+the archive is self-contained; --no-remote leaves them to the runtime
+instead. Imports that are not followed are listed as skipped.
+
+--import-map resolves imports through an import map, or the "imports" and
+"scopes" of a deno.json, as Deno does, and embeds it at the front of the
+archive for the runtime. Bare specifiers the map does not cover, and all
+bare specifiers without one, are left to the runtime.
+
+--transpiler turns TypeScript, TSX and JSX modules into JavaScript as for
+create, after their imports have been followed, and --minifier then
+minifies every JavaScript module as for create.
+
+--cache-dir keeps the imports found in each local file, and the
+transpiler's and minifier's output for each source, in a directory between
+runs. A later bundle rescans only the files whose size or modification
+time changed and transpiles and minifies only sources it has not seen,
+which keeps rebuilds in a watch loop fast. The cache can be deleted at any
+time.
+
+--watch keeps running after the first bundle and bundles again whenever a
+local file it read, or an import it could not find, changes, once the
+changes have settled for a moment. Each rebuild prints one summary line,
+and a failed one its error; either way watching goes on until interrupted.
+Remote modules are fetched again on each rebuild but not watched.`,
+		Example: `  eszip bundle -o app.eszip2 src/main.ts
+  eszip bundle --no-remote -o app.eszip2 src/main.ts src/worker.ts
+  eszip bundle --import-map import_map.json -o app.eszip2 src/main.ts
+  eszip bundle --transpiler 'esbuild --loader=ts' --cache-dir .eszip-cache -o app.eszip2 src/main.ts
+  eszip bundle --watch --cache-dir .eszip-cache -o app.eszip2 src/main.ts`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			checksumType, err := parseChecksum(checksum)
+			if err != nil {
+				return err
+			}
+			var transpiler eszip.Transpiler
+			if transpilerCommand != "" {
+				if transpiler, err = newCommandTranspiler(ctx, transpilerCommand); err != nil {
+					return err
+				}
+			}
+			var cache *buildCache
+			if cacheDir != "" {
+				if cache, err = openBuildCache(cacheDir); err != nil {
+					return fmt.Errorf("opening cache: %w", err)
+				}
+				if transpiler != nil {
+					transpiler = cache.transpiler(transpiler, transpilerCommand)
+				}
+			}
+			var minifier eszip.Minifier
+			if minifierCommand != "" {
+				if minifier, err = newCommandMinifier(ctx, minifierCommand); err != nil {
+					return err
+				}
+				if cache != nil {
+					minifier = cache.minifier(minifier, minifierCommand)
+				}
+			}
+
+			// build writes the archive and returns the local files it
+			// read or looked for, which --watch watches. A rebuild prints
+			// one summary line instead of every module.
+			build := func(rebuild bool) ([]string, error) {
+				start := time.Now()
+				w := &graphWalker{ctx: ctx, remote: !noRemote, strict: strictMediaTypes, transpiler: transpiler, cache: cache}
+				var importMap *importMapFile
+				if importMapPath != "" {
+					if path, err := filepath.Abs(importMapPath); err == nil {
+						w.files = append(w.files, path)
+					}
+					if importMap, err = loadImportMap(importMapPath, nil); err != nil {
+						return w.files, err
+					}
+					w.imports = importMap.parsed
+				}
+				if err := w.walk(args); err != nil {
+					return w.files, err
+				}
+
+				archive := eszip.NewV2()
+				archive.SetChecksum(checksumType)
+				if err := archive.SetChecksumSize(checksumSize); err != nil {
+					return w.files, err
+				}
+				if importMap != nil {
+					importMap.addTo(archive)
+					if !rebuild {
+						fmt.Fprintf(a.stdout, "Import map: %s\n", importMap.specifier)
+					}
+				}
+				for _, m := range w.modules {
+					m.addTo(archive)
+					if !rebuild {
+						fmt.Fprintf(a.stdout, "Added: %s\n", m.specifier)
+					}
+				}
+				archive.SetEntrypoints(w.entrypoints)
+				for _, warning := range w.warnings {
+					fmt.Fprintf(a.stderr, "Warning: %s\n", warning)
+				}
+				if len(w.skipped) > 0 {
+					fmt.Fprintf(a.stderr, "Skipped %d import(s):\n", len(w.skipped))
+					for _, s := range w.skipped {
+						fmt.Fprintf(a.stderr, "  %s (from %s)\n", s.specifier, s.referrer)
+					}
+				}
+
+				if minifier != nil {
+					if _, err := archive.MinifySources(ctx, minifier); err != nil {
+						return w.files, err
+					}
+				}
+				var report eszip.WriteReport
+				data, err := archive.IntoBytes(append(a.writeOptions(), eszip.WithRedirectValidation(), eszip.WithWriteReport(&report))...)
+				if err != nil {
+					return w.files, fmt.Errorf("serializing archive: %w", err)
+				}
+				if err := writeOutput(ctx, outputPath, data); err != nil {
+					return w.files, fmt.Errorf("writing output: %w", err)
+				}
+
+				if !rebuild {
+					fmt.Fprintf(a.stdout, "Created: %s (%d bytes, %d modules)\n", outputPath, len(data), len(w.modules))
+					a.printMinified(archive, &report)
+					if cache != nil {
+						hits, misses := a.saveCache(cache)
+						fmt.Fprintf(a.stdout, "Cache: %d reused, %d rebuilt\n", hits, misses)
+					}
+					return w.files, nil
+				}
+				summary := fmt.Sprintf("Rebuilt: %s (%d bytes, %d modules) in %s", outputPath, len(data), len(w.modules), time.Since(start).Round(time.Millisecond))
+				if cache != nil {
+					hits, misses := a.saveCache(cache)
+					summary += fmt.Sprintf(", cache %d reused, %d rebuilt", hits, misses)
+				}
+				fmt.Fprintln(a.stdout, summary)
+				return w.files, nil
+			}
+
+			if watch {
+				return a.watch(ctx, build)
+			}
+			_, err = build(false)
+			return err
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringVar(&checksum, "checksum", "sha256", "Checksum algorithm (none, sha256, xxhash3, blake3)")
+	cmd.Flags().Uint8Var(&checksumSize, "checksum-size", 0, "Truncate checksums to this many bytes (default: the full digest)")
+	cmd.Flags().BoolVar(&noRemote, "no-remote", false, "Do not fetch http and https imports")
+	cmd.Flags().BoolVar(&strictMediaTypes, "strict-media-types", false, "Fail when a fetched module's Content-Type and extension disagree")
+	cmd.Flags().StringVar(&importMapPath, "import-map", "", "Resolve imports through this import map and embed it")
+	cmd.Flags().StringVar(&transpilerCommand, "transpiler", "", "Command that turns TypeScript, TSX and JSX on stdin into JavaScript")
+	cmd.Flags().StringVar(&minifierCommand, "minifier", "", "Command that minifies JavaScript on stdin")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Reuse scanned imports, transpiler and minifier output from earlier runs kept in this directory")
+	cmd.Flags().BoolVarP(&watch, "watch", "w", false, "Bundle again whenever a local input changes")
+
+	return cmd
+}
+
+// importMapFile is an import map given with --import-map.
+type importMapFile struct {
+	specifier string
+	source    []byte
+	parsed    *eszip.ImportMap
+}
+
+// loadImportMap reads and parses the import map at path. Its specifier
+// comes from specifiers, or is the file URL of its absolute path if
+// specifiers is nil.
+func loadImportMap(path string, specifiers *specifierMapper) (*importMapFile, error) {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("resolving path %s: %w", path, err)
+	}
+	if specifiers == nil {
+		specifiers = &specifierMapper{}
+	}
+	specifier, err := specifiers.specifier(absPath)
+	if err != nil {
+		return nil, err
+	}
+	source, err := os.ReadFile(absPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading import map: %w", err)
+	}
+	parsed, err := eszip.ParseImportMap(specifier, source)
+	if err != nil {
+		return nil, err
+	}
+	return &importMapFile{specifier: specifier, source: source, parsed: parsed}, nil
+}
+
+// addTo embeds the import map at the front of archive. It is stored as
+// JSONC, which is how parsed archives recognise it.
+func (m *importMapFile) addTo(archive *eszip.EszipV2) {
+	archive.AddImportMap(eszip.ModuleKindJsonc, m.specifier, m.source)
+}
+
+// skippedImport is an import the graph walker did not follow.
+type skippedImport struct {
+	specifier string
+	referrer  string
+}
+
+// graphWalker reads entrypoints and every module they import, directly or
+// not. Only JavaScript modules are scanned for imports.
+type graphWalker struct {
+	ctx    context.Context
+	remote bool // fetch http and https imports
+	strict bool // see fetchRemote
+	// imports resolves bare specifiers; nil leaves them unresolved.
+	imports *eszip.ImportMap
+	// transpiler, if set, transpiles modules once they have been scanned.
+	transpiler eszip.Transpiler
+	// cache, if set, holds the imports of local files from earlier runs.
+	cache *buildCache
+	// files lists the local files read or looked for, in order.
+	files []string
+	// cachedImports holds the imports of the local files cache knew or
+	// has just scanned, by specifier.
+	cachedImports map[string][]eszip.ImportRef
+	// entrypoints holds the specifiers of the entrypoints, in order.
+	entrypoints []string
+	seen        map[string]bool
+	queue       []string
+	// modules lists the modules in the order they were reached,
+	// entrypoints first.
+	modules  []*remoteModule
+	skipped  []skippedImport
+	warnings []string
+}
+
+func (w *graphWalker) walk(entrypoints []string) error {
+	w.seen = make(map[string]bool)
+	w.cachedImports = make(map[string][]eszip.ImportRef)
+	for _, entry := range entrypoints {
+		specifier := entry
+		if !isRemoteInput(entry) {
+			path, err := filepath.Abs(entry)
+			if err != nil {
+				return fmt.Errorf("resolving path %s: %w", entry, err)
+			}
+			specifier = pathToSpecifier(path)
+		} else if !w.remote {
+			return fmt.Errorf("cannot fetch %s: remote modules are disabled by --no-remote", entry)
+		}
+		w.entrypoints = append(w.entrypoints, specifier)
+		w.enqueue(specifier)
+	}
+
+	for len(w.queue) > 0 {
+		specifier := w.queue[0]
+		w.queue = w.queue[1:]
+		m, err := w.load(specifier)
+		if err != nil {
+			return err
+		}
+		w.modules = append(w.modules, m)
+		// A redirect target may be reached under its own URL too.
+		w.seen[m.specifier] = true
+		if m.kind != eszip.ModuleKindJavaScript {
+			continue
+		}
+
+		refs, ok := w.cachedImports[m.specifier]
+		if !ok {
+			refs = eszip.ScanImports(m.content)
+		}
+		if m.content, m.sourceMap, err = eszip.Transpile(w.transpiler, m.specifier, m.content); err != nil {
+			return err
+		}
+		for _, ref := range refs {
+			target, ok := w.resolve(m.specifier, ref.Specifier)
+			if !ok {
+				w.skipped = append(w.skipped, skippedImport{specifier: ref.Specifier, referrer: m.specifier})
+				continue
+			}
+			if w.seen[target] {
+				continue
+			}
+			if path, local := fileSpecifierPath(target); local {
+				if _, err := os.Stat(path); err != nil {
+					w.files = append(w.files, path)
+					return fmt.Errorf("%s imports %q: %w", m.specifier, ref.Specifier, err)
+				}
+			}
+			w.enqueue(target)
+		}
+	}
+	return nil
+}
+
+func (w *graphWalker) enqueue(specifier string) {
+	if !w.seen[specifier] {
+		w.seen[specifier] = true
+		w.queue = append(w.queue, specifier)
+	}
+}
+
+// load reads a local module or fetches a remote one.
+func (w *graphWalker) load(specifier string) (*remoteModule, error) {
+	path, local := fileSpecifierPath(specifier)
+	if !local {
+		m, err := fetchRemote(w.ctx, specifier, w.strict)
+		if err != nil {
+			return nil, err
+		}
+		if m.warning != "" {
+			w.warnings = append(w.warnings, m.specifier+": "+m.warning)
+		}
+		return m, nil
+	}
+	w.files = append(w.files, path)
+	// The file is stat'ed before it is read, so that a change made in
+	// between makes the cache entry stale rather than wrong.
+	var info fs.FileInfo
+	if w.cache != nil {
+		var err error
+		if info, err = os.Stat(path); err != nil {
+			return nil, fmt.Errorf("reading module %s: %w", path, err)
+		}
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading module %s: %w", path, err)
+	}
+	kind, ok := eszip.DetectModuleKind(filepath.ToSlash(path), content)
+	if !ok {
+		kind = eszip.ModuleKindJavaScript
+	}
+	if w.cache != nil && kind == eszip.ModuleKindJavaScript {
+		w.cachedImports[specifier] = w.cache.imports(path, info, content)
+	}
+	return &remoteModule{specifier: specifier, requested: specifier, kind: kind, content: content}, nil
+}
+
+// resolve returns the specifier an import names, relative to referrer and
+// through the import map, if any. It reports false for imports that are
+// not followed: bare specifiers the import map does not map, schemes other
+// than file, http and https, remote ones when fetching is disabled, and
+// local files imported by remote modules.
+func (w *graphWalker) resolve(referrer, specifier string) (string, bool) {
+	base, err := url.Parse(referrer)
+	if err != nil {
+		return "", false
+	}
+	resolved, ok := w.imports.Resolve(referrer, specifier)
+	if !ok {
+		return "", false
+	}
+	target, err := url.Parse(resolved)
+	if err != nil {
+		return "", false
+	}
+	target.Fragment = ""
+	switch target.Scheme {
+	case "file":
+		if base.Scheme != "file" {
+			return "", false
+		}
+		target.RawQuery = ""
+	case "http", "https":
+		if !w.remote {
+			return "", false
+		}
+	default:
+		return "", false
+	}
+	return target.String(), true
+}
+
+// fileSpecifierPath returns the local path of a file: specifier.
+func fileSpecifierPath(specifier string) (string, bool) {
+	u, err := url.Parse(specifier)
+	if err != nil || u.Scheme != "file" {
+		return "", false
+	}
+	return filepath.FromSlash(u.Path), true
+}
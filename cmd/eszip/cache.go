@@ -0,0 +1,185 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// cacheIndexName is the file in a cache directory that records what is
+// known about each local module read.
+const cacheIndexName = "files.json"
+
+// buildCache keeps the results of per-module work between runs of create
+// and bundle in a directory given with --cache-dir, so that a rebuild
+// after a small change redoes that work only for the files that changed.
+// Transpiler and minifier output is stored under a hash of the command,
+// the specifier and the input, and the imports bundle scans a file for
+// under its path, valid while the file keeps its size and modification
+// time.
+//
+// The cache only ever saves work: an entry that is missing or cannot be
+// read is rebuilt, and a cache that cannot be written is reported and
+// otherwise ignored.
+type buildCache struct {
+	dir string
+
+	mu     sync.Mutex
+	files  map[string]cachedFile
+	dirty  bool
+	hits   int
+	misses int
+}
+
+// cachedFile is what the cache index records about a local module.
+type cachedFile struct {
+	Size    int64             `json:"size"`
+	ModTime int64             `json:"mod_time"`
+	Imports []eszip.ImportRef `json:"imports"`
+}
+
+// openBuildCache opens the cache in dir, creating the directory if needed.
+func openBuildCache(dir string) (*buildCache, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "output"), 0o755); err != nil {
+		return nil, err
+	}
+	c := &buildCache{dir: dir, files: make(map[string]cachedFile)}
+	data, err := os.ReadFile(filepath.Join(dir, cacheIndexName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil && json.Unmarshal(data, &c.files) != nil {
+		// A damaged index is started afresh.
+		c.files = make(map[string]cachedFile)
+	}
+	return c, nil
+}
+
+// imports returns the imports of the local module at path, with content
+// as read now and info as it was stat'ed before reading, scanning content
+// only if the file changed since it was last scanned.
+func (c *buildCache) imports(path string, info fs.FileInfo, content []byte) []eszip.ImportRef {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if f, ok := c.files[path]; ok && f.Size == info.Size() && f.ModTime == info.ModTime().UnixNano() {
+		c.hits++
+		return f.Imports
+	}
+	c.misses++
+	imports := eszip.ScanImports(content)
+	c.files[path] = cachedFile{Size: info.Size(), ModTime: info.ModTime().UnixNano(), Imports: imports}
+	c.dirty = true
+	return imports
+}
+
+// transpiler wraps t, invoked as command, so that its output is reused
+// for sources it has seen before.
+func (c *buildCache) transpiler(t eszip.Transpiler, command string) eszip.Transpiler {
+	return eszip.TranspilerFunc(func(specifier string, source []byte) ([]byte, []byte, error) {
+		return c.cached([][]byte{[]byte("transpile"), []byte(command), []byte(specifier), source}, func() ([]byte, []byte, error) {
+			return t.Transpile(specifier, source)
+		})
+	})
+}
+
+// minifier wraps m, invoked as command, so that its output is reused for
+// code and source maps it has seen before.
+func (c *buildCache) minifier(m eszip.Minifier, command string) eszip.Minifier {
+	return eszip.MinifierFunc(func(specifier string, code, sourceMap []byte) ([]byte, []byte, error) {
+		return c.cached([][]byte{[]byte("minify"), []byte(command), []byte(specifier), code, sourceMap}, func() ([]byte, []byte, error) {
+			return m.Minify(specifier, code, sourceMap)
+		})
+	})
+}
+
+// cached returns the code and source map stored under a hash of parts, or
+// calls produce and stores what it returns.
+func (c *buildCache) cached(parts [][]byte, produce func() ([]byte, []byte, error)) ([]byte, []byte, error) {
+	h := sha256.New()
+	for _, part := range parts {
+		h.Write(part)
+		h.Write([]byte{0})
+	}
+	base := filepath.Join(c.dir, "output", hex.EncodeToString(h.Sum(nil)))
+
+	if code, err := os.ReadFile(base + ".js"); err == nil {
+		sourceMap, err := os.ReadFile(base + ".map")
+		if err == nil || errors.Is(err, fs.ErrNotExist) {
+			c.count(true)
+			return code, sourceMap, nil
+		}
+	}
+	c.count(false)
+	code, sourceMap, err := produce()
+	if err != nil {
+		return nil, nil, err
+	}
+	// The source map is written first, so a code file is never found
+	// without the map that belongs to it.
+	if sourceMap != nil {
+		if writeOutput(context.Background(), base+".map", sourceMap) != nil {
+			return code, sourceMap, nil
+		}
+	}
+	writeOutput(context.Background(), base+".js", code)
+	return code, sourceMap, nil
+}
+
+func (c *buildCache) count(hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if hit {
+		c.hits++
+	} else {
+		c.misses++
+	}
+}
+
+// save writes the index if anything was added to it.
+func (c *buildCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.dirty {
+		return nil
+	}
+	data, err := json.Marshal(c.files)
+	if err != nil {
+		return err
+	}
+	if err := writeOutput(context.Background(), filepath.Join(c.dir, cacheIndexName), data); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// takeStats returns how many results were reused and how many were
+// rebuilt since it was last called.
+func (c *buildCache) takeStats() (hits, misses int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hits, misses = c.hits, c.misses
+	c.hits, c.misses = 0, 0
+	return hits, misses
+}
+
+// saveCache saves c and returns how much work it saved in this build. A
+// cache that cannot be saved costs the next build time, not this one its
+// result, so that is only a warning.
+func (a *app) saveCache(c *buildCache) (hits, misses int) {
+	if err := c.save(); err != nil {
+		fmt.Fprintf(a.stderr, "Warning: saving cache: %v\n", err)
+	}
+	return c.takeStats()
+}
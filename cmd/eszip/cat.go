@@ -0,0 +1,75 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func (a *app) catCmd() *cobra.Command {
+	var sourceMap bool
+
+	cmd := &cobra.Command{
+		Use:   "cat <archive> <specifier>",
+		Short: "Write a module's source to stdout",
+		Long: `Write exactly the bytes of a module's source to stdout, with nothing added,
+so it can be piped into a runtime or a diff tool. Redirects are followed.
+--source-map writes the module's source map instead. Only the requested
+module is read from the archive.
+
+A module that is not in the archive, or that has no source map when
+--source-map is given, is an error.`,
+		Example: `  eszip cat app.eszip2 file:///main.ts | deno run -
+  eszip cat --source-map app.eszip2 file:///main.ts > main.ts.map
+  diff <(eszip cat old.eszip2 file:///lib.js) <(eszip cat new.eszip2 file:///lib.js)`,
+		Args: cobra.ExactArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			switch len(args) {
+			case 0:
+				return nil, cobra.ShellCompDirectiveDefault
+			case 1:
+				return a.completeSpecifiers(cmd, args[0], toComplete)
+			}
+			return nil, cobra.ShellCompDirectiveNoFileComp
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			specifier := args[1]
+
+			archive, err := a.openArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer archive.Close()
+
+			module := archive.GetModule(specifier)
+			if module == nil {
+				return fmt.Errorf("module not found: %s", specifier)
+			}
+			var content []byte
+			if sourceMap {
+				if content, err = module.SourceMap(ctx); err != nil {
+					return err
+				}
+				if len(content) == 0 {
+					return fmt.Errorf("%s has no source map", specifier)
+				}
+			} else {
+				if content, err = module.Source(ctx); err != nil {
+					return err
+				}
+				if content == nil {
+					return fmt.Errorf("the source of %s has been taken", specifier)
+				}
+			}
+			_, err = a.stdout.Write(content)
+			return err
+		},
+	}
+
+	cmd.Flags().BoolVarP(&sourceMap, "source-map", "m", false, "Write the source map instead of the source")
+
+	return cmd
+}
@@ -0,0 +1,38 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// completeSpecifierFlag completes a flag naming a module of the archive
+// given as the command's first argument.
+func (a *app) completeSpecifierFlag(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) == 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+	return a.completeSpecifiers(cmd, args[0], toComplete)
+}
+
+// completeSpecifiers proposes the specifiers of the archive at path that
+// start with toComplete. Only the archive headers are read, so completing
+// against a large archive stays quick.
+func (a *app) completeSpecifiers(cmd *cobra.Command, path, toComplete string) ([]string, cobra.ShellCompDirective) {
+	archive, err := a.openArchive(cmd.Context(), path)
+	if err != nil {
+		cobra.CompErrorln(err.Error())
+		return nil, cobra.ShellCompDirectiveError
+	}
+	defer archive.Close()
+
+	var specifiers []string
+	for _, spec := range archive.Specifiers() {
+		if strings.HasPrefix(spec, toComplete) {
+			specifiers = append(specifiers, spec)
+		}
+	}
+	return specifiers, cobra.ShellCompDirectiveNoFileComp
+}
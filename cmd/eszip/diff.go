@@ -0,0 +1,375 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+// errArchivesDiffer makes diff exit with status 1, as cmp does.
+var errArchivesDiffer = errors.New("archives differ")
+
+// diffContext is the number of unchanged lines around each hunk of
+// diff --content output.
+const diffContext = 3
+
+// diffReport is the result of comparing two archives.
+type diffReport struct {
+	SizeA   int64          `json:"size_a"`
+	SizeB   int64          `json:"size_b"`
+	Modules []moduleChange `json:"modules"`
+	// Npm describes each npm snapshot difference.
+	Npm []string `json:"npm"`
+}
+
+// moduleChange is a specifier added, removed or changed between archives.
+// Bytes count the source and source map; redirects have none.
+type moduleChange struct {
+	Specifier string   `json:"specifier"`
+	Change    string   `json:"change"` // "added", "removed" or "changed"
+	Details   []string `json:"details,omitempty"`
+	BytesA    int64    `json:"bytes_a"`
+	BytesB    int64    `json:"bytes_b"`
+	Delta     int64    `json:"delta"`
+}
+
+func (a *app) diffCmd() *cobra.Command {
+	var showContent bool
+
+	cmd := &cobra.Command{
+		Use:   "diff <a> <b>",
+		Short: "Compare two eszip archives",
+		Long: `Compare two eszip archives and list the specifiers added, removed or
+changed from a to b with their size in bytes, followed by differences in
+the npm snapshot. Entry order, checksum algorithm and format version are
+ignored. With --content, a unified diff of each added, removed or changed
+source follows.
+
+The exit status is 0 if the archives hold the same content and 1 if they
+differ or cannot be read.`,
+		Example: `  eszip diff release-1.eszip2 release-2.eszip2
+  eszip diff --content old.eszip2 new.eszip2
+  eszip diff --json old.eszip2 new.eszip2 | jq '.modules[].specifier'`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			var archives [2]*eszip.EszipUnion
+			var sizes [2]int64
+			for i, path := range args {
+				stat, err := os.Stat(path)
+				if err != nil {
+					return err
+				}
+				sizes[i] = stat.Size()
+				if archives[i], err = a.loadArchive(ctx, path); err != nil {
+					return err
+				}
+			}
+
+			equal, difference, err := eszip.Equal(ctx, archives[0], archives[1], eszip.EqualOptions{All: true})
+			if err != nil {
+				return err
+			}
+			report := newDiffReport(archives[0], archives[1], difference)
+			report.SizeA, report.SizeB = sizes[0], sizes[1]
+
+			if a.json {
+				if err := a.writeJSON(report); err != nil {
+					return err
+				}
+			} else {
+				writeDiffReport(a.stdout, report)
+				if showContent {
+					for _, change := range report.Modules {
+						if err := writeContentDiff(ctx, a.stdout, archives[0], archives[1], change); err != nil {
+							return err
+						}
+					}
+				}
+			}
+			if !equal {
+				return errArchivesDiffer
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&showContent, "content", false, "Show a unified diff of each changed source")
+
+	return cmd
+}
+
+// newDiffReport groups the divergences Equal found by specifier.
+func newDiffReport(x, y *eszip.EszipUnion, difference *eszip.Difference) *diffReport {
+	report := &diffReport{Modules: []moduleChange{}, Npm: []string{}}
+	if difference == nil {
+		return report
+	}
+	bytesA, bytesB := contentBytes(x), contentBytes(y)
+	for _, div := range difference.Divergences {
+		if div.Kind == eszip.DiffNpmSnapshot {
+			report.Npm = append(report.Npm, div.Detail)
+			continue
+		}
+		n := len(report.Modules)
+		if n == 0 || report.Modules[n-1].Specifier != div.Specifier {
+			change := moduleChange{
+				Specifier: div.Specifier,
+				Change:    "changed",
+				BytesA:    bytesA[div.Specifier],
+				BytesB:    bytesB[div.Specifier],
+			}
+			change.Delta = change.BytesB - change.BytesA
+			report.Modules = append(report.Modules, change)
+			n++
+		}
+		change := &report.Modules[n-1]
+		switch {
+		case div.Kind == eszip.DiffMissing && div.Detail == "only in a":
+			change.Change = "removed"
+		case div.Kind == eszip.DiffMissing:
+			change.Change = "added"
+		default:
+			change.Details = append(change.Details, div.Detail)
+		}
+	}
+	return report
+}
+
+// contentBytes maps the specifier of each module to its source and source
+// map size.
+func contentBytes(archive *eszip.EszipUnion) map[string]int64 {
+	sizes := make(map[string]int64)
+	for _, size := range archive.ModuleSizes() {
+		sizes[size.Specifier] = size.Source + size.SourceMap
+	}
+	return sizes
+}
+
+func writeDiffReport(w io.Writer, report *diffReport) {
+	if len(report.Modules) == 0 && len(report.Npm) == 0 {
+		fmt.Fprintln(w, "No differences")
+	}
+	for _, change := range report.Modules {
+		switch change.Change {
+		case "added":
+			fmt.Fprintf(w, "Added:   %s (%+d bytes)\n", change.Specifier, change.Delta)
+		case "removed":
+			fmt.Fprintf(w, "Removed: %s (%+d bytes)\n", change.Specifier, change.Delta)
+		default:
+			fmt.Fprintf(w, "Changed: %s (%d -> %d bytes, %+d): %s\n", change.Specifier, change.BytesA, change.BytesB, change.Delta, strings.Join(change.Details, "; "))
+		}
+	}
+	for _, detail := range report.Npm {
+		fmt.Fprintf(w, "npm:     %s\n", detail)
+	}
+	fmt.Fprintf(w, "Size: %d -> %d bytes (%+d)\n", report.SizeA, report.SizeB, report.SizeB-report.SizeA)
+}
+
+// writeContentDiff prints a unified diff of the module's source in the two
+// archives. Redirects and modules whose sources are equal print nothing.
+func writeContentDiff(ctx context.Context, w io.Writer, x, y *eszip.EszipUnion, change moduleChange) error {
+	a, aOK, err := moduleSource(ctx, x, change.Specifier)
+	if err != nil {
+		return err
+	}
+	b, bOK, err := moduleSource(ctx, y, change.Specifier)
+	if err != nil {
+		return err
+	}
+	if (!aOK && !bOK) || bytes.Equal(a, b) {
+		return nil
+	}
+
+	nameA, nameB := "a/"+change.Specifier, "b/"+change.Specifier
+	if !aOK {
+		nameA = "/dev/null"
+	}
+	if !bOK {
+		nameB = "/dev/null"
+	}
+	if isBinary(a) || isBinary(b) {
+		fmt.Fprintf(w, "Binary sources %s and %s differ\n", nameA, nameB)
+		return nil
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", nameA, nameB)
+	writeHunks(w, splitLines(string(a)), splitLines(string(b)))
+	return nil
+}
+
+// moduleSource returns the source of the module stored under specifier,
+// and false if the specifier is missing or is a redirect.
+func moduleSource(ctx context.Context, archive *eszip.EszipUnion, specifier string) ([]byte, bool, error) {
+	// GetImportMap also finds JSONC modules, which GetModule hides.
+	module := archive.GetImportMap(specifier)
+	if module == nil || module.Specifier != specifier {
+		return nil, false, nil
+	}
+	source, err := module.Source(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("reading %s: %w", specifier, err)
+	}
+	return source, true, nil
+}
+
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content, 0) >= 0 || !utf8.Valid(content)
+}
+
+// splitLines splits text after each newline; the last line lacks one if
+// the text does not end with a newline.
+func splitLines(text string) []string {
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineEdit is one line of a diff: ' ' kept, '-' removed or '+' added.
+type lineEdit struct {
+	op   byte
+	line string
+}
+
+// diffLines returns a shortest edit script turning a into b, using Myers'
+// O(ND) algorithm.
+func diffLines(a, b []string) []lineEdit {
+	n, m := len(a), len(b)
+	offset := n + m
+	v := make([]int, 2*offset+2)
+	var trace [][]int
+search:
+	for d := 0; d <= n+m; d++ {
+		trace = append(trace, slices.Clone(v))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				break search
+			}
+		}
+	}
+
+	// Walk back through the trace from the end of both inputs.
+	var edits []lineEdit
+	x, y := n, m
+	for d := len(trace) - 1; d > 0; d-- {
+		v := trace[d]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+			prevK = k + 1
+		}
+		prevX := v[offset+prevK]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			edits = append(edits, lineEdit{' ', a[x-1]})
+			x--
+			y--
+		}
+		if x == prevX {
+			edits = append(edits, lineEdit{'+', b[y-1]})
+			y--
+		} else {
+			edits = append(edits, lineEdit{'-', a[x-1]})
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		edits = append(edits, lineEdit{' ', a[x-1]})
+		x--
+		y--
+	}
+	slices.Reverse(edits)
+	return edits
+}
+
+// writeHunks prints the differences between a and b as unified diff hunks
+// with diffContext lines of context.
+func writeHunks(w io.Writer, a, b []string) {
+	edits := diffLines(a, b)
+	// lineA[i] and lineB[i] count the lines of a and b before edits[i].
+	lineA := make([]int, len(edits)+1)
+	lineB := make([]int, len(edits)+1)
+	for i, e := range edits {
+		lineA[i+1], lineB[i+1] = lineA[i], lineB[i]
+		if e.op != '+' {
+			lineA[i+1]++
+		}
+		if e.op != '-' {
+			lineB[i+1]++
+		}
+	}
+
+	for i := 0; i < len(edits); {
+		for i < len(edits) && edits[i].op == ' ' {
+			i++
+		}
+		if i == len(edits) {
+			break
+		}
+		start := max(i-diffContext, 0)
+		// Extend the hunk over unchanged runs too short to separate it
+		// from the next change.
+		end := i
+		for {
+			for end < len(edits) && edits[end].op != ' ' {
+				end++
+			}
+			next := end
+			for next < len(edits) && edits[next].op == ' ' {
+				next++
+			}
+			if next == len(edits) || next-end > 2*diffContext {
+				break
+			}
+			end = next
+		}
+		stop := min(end+diffContext, len(edits))
+
+		fmt.Fprintf(w, "@@ -%s +%s @@\n", hunkRange(lineA[start], lineA[stop]), hunkRange(lineB[start], lineB[stop]))
+		for _, e := range edits[start:stop] {
+			fmt.Fprintf(w, "%c%s", e.op, e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				fmt.Fprint(w, "\n\\ No newline at end of file\n")
+			}
+		}
+		i = stop
+	}
+}
+
+// hunkRange formats the lines from, to of one side of a hunk as a unified
+// diff range: 1-based, with the count left out when it is 1.
+func hunkRange(from, to int) string {
+	switch to - from {
+	case 0:
+		return fmt.Sprintf("%d,0", from)
+	case 1:
+		return fmt.Sprintf("%d", from+1)
+	default:
+		return fmt.Sprintf("%d,%d", from+1, to-from)
+	}
+}
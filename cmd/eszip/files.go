@@ -0,0 +1,44 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build !js
+
+package main
+
+import (
+	"context"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// archiveFile is an archive opened without loading its sources. It must be
+// closed once it is no longer used.
+type archiveFile = eszip.ArchiveFile
+
+// parseFile parses the archive at path; see eszip.ParseFile.
+func parseFile(ctx context.Context, path string, opts ...eszip.ParseOption) (*eszip.EszipUnion, error) {
+	return eszip.ParseFile(ctx, path, opts...)
+}
+
+func (a *app) loadArchive(ctx context.Context, path string) (*eszip.EszipUnion, error) {
+	archive, err := parseFile(ctx, path, a.parseOptions()...)
+	return archive, describeParseError(path, err)
+}
+
+// openArchive opens the archive at path without loading its sources; see
+// eszip.OpenFile. The caller closes it.
+func (a *app) openArchive(ctx context.Context, path string) (*archiveFile, error) {
+	archive, err := eszip.OpenFile(ctx, path, a.parseOptions()...)
+	return archive, describeParseError(path, err)
+}
+
+// addModuleFromFile adds the file at path as specifier; see
+// eszip.EszipV2.AddModuleFromFile.
+func addModuleFromFile(archive *eszip.EszipV2, path, specifier string, t eszip.Transpiler) error {
+	return archive.AddModuleFromFile(path, specifier, t)
+}
+
+// addNpmPackageDir adds the files under dir to the npm package id; see
+// eszip.EszipV2.AddNpmPackageDir.
+func addNpmPackageDir(archive *eszip.EszipV2, id *eszip.NpmPackageID, dir string) error {
+	return archive.AddNpmPackageDir(id, dir)
+}
@@ -0,0 +1,89 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build js
+
+package main
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// The library leaves file access out of js/wasm builds, so there the CLI
+// reads files itself and parses them in memory.
+
+// archiveFile is an archive read whole into memory. Close does nothing;
+// it is there so that callers can treat it as eszip.ArchiveFile.
+type archiveFile struct {
+	*eszip.EszipUnion
+}
+
+// Close does nothing.
+func (f *archiveFile) Close() error {
+	return nil
+}
+
+// parseFile reads the archive at path and parses it.
+func parseFile(ctx context.Context, path string, opts ...eszip.ParseOption) (*eszip.EszipUnion, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// data is not used again, so the archive may keep slices of it.
+	return eszip.ParseBytes(ctx, data, append(opts[:len(opts):len(opts)], eszip.WithZeroCopy())...)
+}
+
+func (a *app) loadArchive(ctx context.Context, path string) (*eszip.EszipUnion, error) {
+	archive, err := parseFile(ctx, path, a.parseOptions()...)
+	return archive, describeParseError(path, err)
+}
+
+// openArchive reads the archive at path and parses it.
+func (a *app) openArchive(ctx context.Context, path string) (*archiveFile, error) {
+	archive, err := a.loadArchive(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	return &archiveFile{archive}, nil
+}
+
+// addModuleFromFile adds the file at path as specifier, as
+// eszip.EszipV2.AddModuleFromFile does.
+func addModuleFromFile(archive *eszip.EszipV2, path, specifier string, t eszip.Transpiler) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	kind, ok := eszip.DetectModuleKind(specifier, source)
+	if !ok {
+		if kind, ok = eszip.DetectModuleKind(filepath.ToSlash(path), source); !ok {
+			kind = eszip.ModuleKindJavaScript
+		}
+	}
+	code, sourceMap, err := eszip.Transpile(t, specifier, source)
+	if err != nil {
+		return err
+	}
+	archive.AddModule(specifier, kind, code, sourceMap)
+	return nil
+}
+
+// addNpmPackageDir adds the regular files under dir to the npm package
+// id, as eszip.EszipV2.AddNpmPackageDir does.
+func addNpmPackageDir(archive *eszip.EszipV2, id *eszip.NpmPackageID, dir string) error {
+	fsys := os.DirFS(dir)
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return archive.AddNpmPackageFile(id, path, content)
+	})
+}
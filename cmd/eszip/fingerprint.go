@@ -0,0 +1,58 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+// archiveFingerprint is one entry of fingerprint --json output.
+type archiveFingerprint struct {
+	Archive     string `json:"archive"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+func (a *app) fingerprintCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "fingerprint <archive>...",
+		Short: "Print a digest of each archive's content",
+		Long: `Print a SHA-256 digest of each archive's content, followed by its path,
+for use as a cache key.
+
+The digest covers specifiers, module kinds, headers, auxiliary data,
+sources, source maps, redirects and the npm snapshot, and nothing about how
+they are encoded: archives that differ only in entry order, format version,
+checksum, compression or encryption have the same fingerprint, as do a V1
+archive and its conversion to V2.`,
+		Example: `  eszip fingerprint app.eszip2
+  eszip --json fingerprint old.eszip2 new.eszip2`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			results := make([]archiveFingerprint, 0, len(args))
+			for _, path := range args {
+				archive, err := a.openArchive(ctx, path)
+				if err != nil {
+					return err
+				}
+				sum, err := archive.Fingerprint(ctx)
+				archive.Close()
+				if err != nil {
+					return fmt.Errorf("%s: %w", path, err)
+				}
+				if a.json {
+					results = append(results, archiveFingerprint{Archive: path, Fingerprint: hex.EncodeToString(sum[:])})
+					continue
+				}
+				fmt.Fprintf(a.stdout, "%x  %s\n", sum, path)
+			}
+			if a.json {
+				return a.writeJSON(results)
+			}
+			return nil
+		},
+	}
+}
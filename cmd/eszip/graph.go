@@ -0,0 +1,168 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+// graphOutput is the JSON form of an eszip.ModuleGraph.
+type graphOutput struct {
+	Modules     []string    `json:"modules"`
+	Edges       []graphEdge `json:"edges"`
+	EntryPoints []string    `json:"entry_points"`
+	Unreachable []string    `json:"unreachable"`
+	Cycles      [][]string  `json:"cycles"`
+	Unresolved  []graphEdge `json:"unresolved"`
+}
+
+type graphEdge struct {
+	From      string `json:"from"`
+	To        string `json:"to,omitempty"`
+	Specifier string `json:"specifier"`
+	Dynamic   bool   `json:"dynamic,omitempty"`
+}
+
+func (a *app) graphCmd() *cobra.Command {
+	var dot bool
+	var entrypoints []string
+
+	cmd := &cobra.Command{
+		Use:   "graph <archive>",
+		Short: "Show the import graph of an eszip archive",
+		Long: `Scan the JavaScript and TypeScript modules of an archive for imports,
+re-exports and dynamic imports, and report the entry points (modules no
+other module imports), modules unreachable from them, groups of modules
+that import each other, and imports of modules missing from the archive.
+Bare specifiers are resolved through the archive's import map.
+
+--entrypoint names the modules reachability is measured from instead of
+the entry points. --dot prints the graph in Graphviz format, with dynamic
+imports dashed and entry points boxed.`,
+		Example: `  eszip graph app.eszip2
+  eszip graph -e file:///src/main.ts app.eszip2
+  eszip graph --dot app.eszip2 | dot -Tsvg > graph.svg`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			archive, err := a.loadArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			graph, err := eszip.BuildModuleGraph(ctx, archive)
+			if err != nil {
+				return err
+			}
+			for _, spec := range entrypoints {
+				if archive.GetModule(spec) == nil {
+					return fmt.Errorf("entrypoint %s is not a module in the archive", spec)
+				}
+			}
+
+			switch {
+			case dot:
+				writeGraphDot(a.stdout, graph)
+			case a.json:
+				out := graphOutput{
+					Modules:     nonNil(graph.Modules()),
+					Edges:       graphEdges(graph.Edges()),
+					EntryPoints: nonNil(graph.EntryPoints()),
+					Unreachable: nonNil(graph.Unreachable(entrypoints...)),
+					Cycles:      graph.Cycles(),
+					Unresolved:  graphEdges(graph.Unresolved()),
+				}
+				if out.Cycles == nil {
+					out.Cycles = [][]string{}
+				}
+				return a.writeJSON(out)
+			default:
+				writeGraphReport(a.stdout, graph, entrypoints)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&dot, "dot", false, "Print the graph in Graphviz DOT format")
+	cmd.Flags().StringSliceVarP(&entrypoints, "entrypoint", "e", nil, "Measure reachability from these modules (repeatable)")
+	cmd.RegisterFlagCompletionFunc("entrypoint", a.completeSpecifierFlag)
+
+	return cmd
+}
+
+func graphEdges(edges []eszip.GraphEdge) []graphEdge {
+	out := make([]graphEdge, len(edges))
+	for i, edge := range edges {
+		out[i] = graphEdge{From: edge.From, To: edge.To, Specifier: edge.Specifier, Dynamic: edge.Dynamic}
+	}
+	return out
+}
+
+func nonNil(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+func writeGraphReport(w io.Writer, graph *eszip.ModuleGraph, entrypoints []string) {
+	fmt.Fprintf(w, "%d module(s), %d import(s)\n", len(graph.Modules()), len(graph.Edges()))
+
+	writeList := func(title string, specs []string) {
+		if len(specs) == 0 {
+			return
+		}
+		fmt.Fprintf(w, "\n%s:\n", title)
+		for _, spec := range specs {
+			fmt.Fprintf(w, "  %s\n", spec)
+		}
+	}
+	writeList("Entry points", graph.EntryPoints())
+	writeList("Unreachable", graph.Unreachable(entrypoints...))
+
+	if cycles := graph.Cycles(); len(cycles) > 0 {
+		fmt.Fprintf(w, "\nCycles:\n")
+		for _, cycle := range cycles {
+			fmt.Fprintf(w, "  %s\n", strings.Join(cycle, ", "))
+		}
+	}
+	if unresolved := graph.Unresolved(); len(unresolved) > 0 {
+		fmt.Fprintf(w, "\nUnresolved imports:\n")
+		for _, edge := range unresolved {
+			fmt.Fprintf(w, "  %s: %s\n", edge.From, strconv.Quote(edge.Specifier))
+		}
+	}
+}
+
+// writeGraphDot prints the graph as a Graphviz digraph. Every module is a
+// node, so modules without imports still appear.
+func writeGraphDot(w io.Writer, graph *eszip.ModuleGraph) {
+	entries := make(map[string]bool)
+	for _, spec := range graph.EntryPoints() {
+		entries[spec] = true
+	}
+
+	fmt.Fprintln(w, "digraph eszip {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	for _, spec := range graph.Modules() {
+		if entries[spec] {
+			fmt.Fprintf(w, "  %s [shape=box];\n", strconv.Quote(spec))
+		} else {
+			fmt.Fprintf(w, "  %s;\n", strconv.Quote(spec))
+		}
+	}
+	for _, edge := range graph.Edges() {
+		if edge.Dynamic {
+			fmt.Fprintf(w, "  %s -> %s [style=dashed];\n", strconv.Quote(edge.From), strconv.Quote(edge.To))
+		} else {
+			fmt.Fprintf(w, "  %s -> %s;\n", strconv.Quote(edge.From), strconv.Quote(edge.To))
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
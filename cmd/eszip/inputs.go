@@ -0,0 +1,347 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// symlinkPolicy controls how create treats symbolic links among its inputs.
+type symlinkPolicy struct {
+	// follow resolves symlinks to their targets. When false, symlinks are
+	// skipped and reported.
+	follow bool
+	// allowExternal permits following symlinks whose target lies outside
+	// every input root.
+	allowExternal bool
+}
+
+// inputOptions controls how create arguments are expanded into files.
+type inputOptions struct {
+	symlinks symlinkPolicy
+	// include, if not empty, keeps only the files matching one of its
+	// patterns. Directories are always walked.
+	include globPatterns
+	// exclude holds glob patterns matched against paths relative to each
+	// input root. See globPatterns.
+	exclude globPatterns
+}
+
+// globPatterns holds --include or --exclude patterns. A pattern containing a
+// slash is matched against the whole slash-separated path relative to the
+// input root, with "**" matching any number of directories; one without is
+// matched against the final path element, so "*_test.ts" matches test files
+// at any depth. A trailing slash restricts a pattern to directories, whose
+// contents are then skipped entirely.
+type globPatterns []string
+
+func (m globPatterns) validate(flag string) error {
+	for _, pattern := range m {
+		if err := validateGlob(strings.TrimSuffix(pattern, "/")); err != nil {
+			return fmt.Errorf("invalid %s pattern %q: %w", flag, pattern, err)
+		}
+	}
+	return nil
+}
+
+func (m globPatterns) match(rel string, isDir bool) bool {
+	rel = filepath.ToSlash(rel)
+	for _, pattern := range m {
+		p, dirOnly := strings.CutSuffix(pattern, "/")
+		if dirOnly && !isDir {
+			continue
+		}
+		target := rel
+		if !strings.Contains(p, "/") {
+			target = path.Base(rel)
+		}
+		if matchGlob(p, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSpecifier reports whether a module specifier matches one of the
+// patterns. Specifiers are matched like slash-separated paths, except that
+// a pattern ending in a slash matches everything under it.
+func (m globPatterns) matchSpecifier(specifier string) bool {
+	for _, pattern := range m {
+		if p, ok := strings.CutSuffix(pattern, "/"); ok {
+			pattern = p + "/**"
+		}
+		target := specifier
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(specifier)
+		}
+		if matchGlob(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateGlob checks each path element of pattern.
+func validateGlob(pattern string) error {
+	for _, elem := range strings.Split(pattern, "/") {
+		if _, err := path.Match(elem, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether the slash-separated name matches pattern, which
+// is matched element by element with path.Match except that a "**" element
+// matches zero or more elements.
+func matchGlob(pattern, name string) bool {
+	return matchGlobElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := range len(name) + 1 {
+				if matchGlobElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// hasGlobMeta reports whether s contains glob metacharacters.
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// splitGlob splits an absolute glob pattern into the longest leading
+// directory without metacharacters and the pattern relative to it.
+func splitGlob(absPattern string) (dir, pattern string) {
+	elems := strings.Split(filepath.ToSlash(absPattern), "/")
+	i := 0
+	for i < len(elems)-1 && !hasGlobMeta(elems[i]) {
+		i++
+	}
+	dir = filepath.FromSlash(strings.Join(elems[:i], "/"))
+	if dir == "" || strings.HasSuffix(dir, ":") {
+		// The pattern starts at the filesystem or drive root.
+		dir += string(filepath.Separator)
+	}
+	return dir, strings.Join(elems[i:], "/")
+}
+
+// inputFile is a regular file selected for inclusion in an archive.
+type inputFile struct {
+	// path is the absolute path as it was reached, which may run through
+	// symlinks. The module specifier is derived from it.
+	path string
+	// real is the fully resolved path the content is read from.
+	real string
+}
+
+// skippedInput records an input that was left out and why.
+type skippedInput struct {
+	path   string
+	reason string
+}
+
+// collectedInputs is the result of expanding the create arguments.
+type collectedInputs struct {
+	files    []inputFile
+	skipped  []skippedInput
+	excluded []string
+}
+
+type inputCollector struct {
+	opts    inputOptions
+	roots   []string
+	visited []os.FileInfo
+	collectedInputs
+}
+
+// collectInputs expands the create arguments into a list of files, walking
+// directories recursively and applying the symlink policy and the include
+// and exclude patterns. Excluded paths are dropped before any file is read.
+// Symlinked directories are tracked by identity so that link loops
+// terminate.
+//
+// An argument that does not exist but contains glob metacharacters, as when
+// the pattern was quoted, is expanded here with the same "**" support as
+// --include; its root is the directory before the first metacharacter.
+// "dir/..." stands for dir.
+func collectInputs(args []string, opts inputOptions) (*collectedInputs, error) {
+	if err := opts.include.validate("include"); err != nil {
+		return nil, err
+	}
+	if err := opts.exclude.validate("exclude"); err != nil {
+		return nil, err
+	}
+	c := &inputCollector{opts: opts}
+
+	type input struct {
+		arg, root, path string
+		glob            string // the pattern path must match, relative to root
+	}
+	inputs := make([]input, 0, len(args))
+	for _, arg := range args {
+		if dir, ok := strings.CutSuffix(filepath.ToSlash(arg), "/..."); ok {
+			arg = filepath.FromSlash(dir)
+		} else if arg == "..." {
+			arg = "."
+		}
+		absPath, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, fmt.Errorf("resolving path %s: %w", arg, err)
+		}
+		in := input{arg: arg, path: absPath}
+
+		info, err := os.Lstat(absPath)
+		switch {
+		case err == nil:
+			in.root = absPath
+			if !info.IsDir() {
+				in.root = filepath.Dir(absPath)
+			}
+		case os.IsNotExist(err) && hasGlobMeta(arg):
+			if err := validateGlob(filepath.ToSlash(absPath)); err != nil {
+				return nil, fmt.Errorf("invalid pattern %s: %w", arg, err)
+			}
+			in.root, in.glob = splitGlob(absPath)
+			in.path = in.root
+		default:
+			return nil, fmt.Errorf("reading file %s: %w", arg, err)
+		}
+		inputs = append(inputs, in)
+
+		root := in.root
+		if real, err := filepath.EvalSymlinks(root); err == nil {
+			root = real
+		}
+		c.roots = append(c.roots, root)
+	}
+
+	for _, in := range inputs {
+		n := len(c.files)
+		if err := c.visit(in.root, in.path, in.glob); err != nil {
+			return nil, err
+		}
+		if in.glob != "" && len(c.files) == n {
+			return nil, fmt.Errorf("no files match %s", in.arg)
+		}
+	}
+	return &c.collectedInputs, nil
+}
+
+// visit handles path, found under the input root. Unless glob is empty, only
+// paths matching it, or within a directory that does, are kept.
+func (c *inputCollector) visit(root, path, glob string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return fmt.Errorf("reading file %s: %w", path, err)
+	}
+
+	real := path
+	if info.Mode()&os.ModeSymlink != 0 {
+		if !c.opts.symlinks.follow {
+			c.skip(path, "symlink (use --follow-symlinks)")
+			return nil
+		}
+		real, err = filepath.EvalSymlinks(path)
+		if err != nil {
+			c.skip(path, "broken symlink")
+			return nil
+		}
+		if !c.opts.symlinks.allowExternal && !c.withinRoots(real) {
+			c.skip(path, "symlink target outside inputs (use --allow-external-symlinks)")
+			return nil
+		}
+		info, err = os.Stat(real)
+		if err != nil {
+			c.skip(path, "broken symlink")
+			return nil
+		}
+	}
+
+	rel, err := filepath.Rel(root, path)
+	if err == nil && rel != "." {
+		if c.opts.exclude.match(rel, info.IsDir()) {
+			c.excluded = append(c.excluded, path)
+			return nil
+		}
+		if glob != "" {
+			rel := filepath.ToSlash(rel)
+			switch {
+			case matchGlob(glob, rel):
+				glob = ""
+			case !strings.Contains(glob, "**") && strings.Count(rel, "/") >= strings.Count(glob, "/"):
+				// Nothing below path can match a pattern this deep.
+				return nil
+			}
+		}
+	}
+
+	switch {
+	case info.IsDir():
+		return c.walkDir(root, path, info, glob)
+	case info.Mode().IsRegular():
+		if glob != "" || (len(c.opts.include) > 0 && !c.opts.include.match(rel, false)) {
+			return nil
+		}
+		c.files = append(c.files, inputFile{path: path, real: real})
+	default:
+		c.skip(path, "not a regular file")
+	}
+	return nil
+}
+
+func (c *inputCollector) walkDir(root, path string, info os.FileInfo, glob string) error {
+	for _, seen := range c.visited {
+		if os.SameFile(seen, info) {
+			c.skip(path, "directory already visited (symlink loop)")
+			return nil
+		}
+	}
+	c.visited = append(c.visited, info)
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return fmt.Errorf("reading directory %s: %w", path, err)
+	}
+	for _, entry := range entries {
+		if err := c.visit(root, filepath.Join(path, entry.Name()), glob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *inputCollector) withinRoots(real string) bool {
+	for _, root := range c.roots {
+		rel, err := filepath.Rel(root, real)
+		if err != nil {
+			continue
+		}
+		if rel == "." || (rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *inputCollector) skip(path, reason string) {
+	c.skipped = append(c.skipped, skippedInput{path: path, reason: reason})
+}
@@ -0,0 +1,154 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+func (a *app) listCmd() *cobra.Command {
+	var sortBy string
+	var filter string
+
+	cmd := &cobra.Command{
+		Use:     "list <archive>",
+		Aliases: []string{"ls"},
+		Short:   "List the modules of an eszip archive with their sizes",
+		Long: `List every module of an archive with its kind, source size and source map
+size, and, for V2 archives, where its source and source map start within
+the sources and source maps sections. Only the archive headers are read;
+sources are never loaded.
+
+--sort size lists the largest modules, by source and source map bytes
+together, first; --sort name sorts by specifier. By default modules are
+listed in archive order.
+
+--filter keeps the modules whose specifier matches a glob pattern. A
+pattern without a slash is matched against the last path element, so
+"*.ts" lists TypeScript modules anywhere; one with a slash is matched
+against the whole specifier.`,
+		Example: `  eszip list app.eszip2
+  eszip list --sort size app.eszip2 | head
+  eszip list --filter '*.map.js' --json app.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := path.Match(filter, ""); err != nil {
+				return fmt.Errorf("invalid filter %q: %w", filter, err)
+			}
+			sizes, err := a.moduleSizes(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			if filter != "" {
+				sizes = slices.DeleteFunc(sizes, func(m eszip.ModuleSize) bool {
+					return !matchSpecifier(filter, m.Specifier)
+				})
+			}
+			switch sortBy {
+			case "", "archive":
+			case "name":
+				slices.SortStableFunc(sizes, func(x, y eszip.ModuleSize) int {
+					return strings.Compare(x.Specifier, y.Specifier)
+				})
+			case "size":
+				slices.SortStableFunc(sizes, func(x, y eszip.ModuleSize) int {
+					return cmp.Compare(y.Source+y.SourceMap, x.Source+x.SourceMap)
+				})
+			default:
+				return fmt.Errorf("unknown sort order: %s (want archive, name or size)", sortBy)
+			}
+
+			if a.json {
+				listings := make([]moduleListing, len(sizes))
+				for i, m := range sizes {
+					listings[i] = moduleListing{
+						Specifier:       m.Specifier,
+						Kind:            m.Kind.String(),
+						SourceBytes:     m.Source,
+						SourceMapBytes:  m.SourceMap,
+						SourceOffset:    recordedOffset(m.SourceOffset),
+						SourceMapOffset: recordedOffset(m.SourceMapOffset),
+					}
+				}
+				return a.writeJSON(listings)
+			}
+			writeModuleTable(a.stdout, sizes)
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&sortBy, "sort", "archive", "Order of the listing (archive, name, size)")
+	cmd.Flags().StringVar(&filter, "filter", "", "List only specifiers matching this glob pattern")
+
+	return cmd
+}
+
+// moduleSizes parses only the headers of the archive at path.
+func (a *app) moduleSizes(ctx context.Context, path string) ([]eszip.ModuleSize, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	archive, _, err := eszip.Parse(ctx, f, append(a.parseOptions(), eszip.WithInputSize(stat.Size()))...)
+	if err != nil {
+		return nil, describeParseError(path, err)
+	}
+	return archive.ModuleSizes(), nil
+}
+
+// matchSpecifier reports whether specifier matches a --filter pattern.
+func matchSpecifier(pattern, specifier string) bool {
+	target := specifier
+	if !strings.Contains(pattern, "/") {
+		target = path.Base(specifier)
+	}
+	ok, _ := path.Match(pattern, target)
+	return ok
+}
+
+// recordedOffset returns nil for the -1 of an offset the archive does not
+// record.
+func recordedOffset(n int64) *int64 {
+	if n < 0 {
+		return nil
+	}
+	return &n
+}
+
+func writeModuleTable(w io.Writer, sizes []eszip.ModuleSize) {
+	offset := func(n int64) string {
+		if n < 0 {
+			return "-"
+		}
+		return strconv.FormatInt(n, 10)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SPECIFIER\tKIND\tSOURCE\tSOURCE MAP\tSOURCE OFFSET\tMAP OFFSET")
+	var sources, sourceMaps int64
+	for _, m := range sizes {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\n", m.Specifier, m.Kind, m.Source, m.SourceMap, offset(m.SourceOffset), offset(m.SourceMapOffset))
+		sources += m.Source
+		sourceMaps += m.SourceMap
+	}
+	tw.Flush()
+	fmt.Fprintf(w, "%d module(s), %d source bytes, %d source map bytes\n", len(sizes), sources, sourceMaps)
+}
@@ -5,13 +5,24 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 
 	"github.com/JakeChampion/eszip"
+	"github.com/JakeChampion/eszip/wasm"
 	"github.com/spf13/cobra"
 )
 
@@ -19,17 +30,57 @@ type app struct {
 	stdout io.Writer
 	stderr io.Writer
 	stdin  io.Reader
+
+	// stats collects byte counts when --stats is given.
+	stats *eszip.Counters
+	// json is set by --json: commands print JSON instead of text.
+	json bool
+	// keys holds the key read from --key-file, for encrypted archives.
+	keys eszip.KeyProvider
+	// progress draws progress bars on stderr when --progress is given.
+	progress *progressBar
 }
 
 func main() {
-	a := &app{stdout: os.Stdout, stderr: os.Stderr, stdin: os.Stdin}
-	if err := a.rootCmd().Execute(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	// The first SIGINT or SIGTERM cancels the running command, which stops
+	// and removes what it has partially written; a second one kills the
+	// process.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	code := RunContext(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	stop()
+	os.Exit(code)
+}
+
+// Run executes the CLI with args, which exclude the program name, and
+// returns the process exit code: 0 on success, or 1 after printing the
+// error to stderr. It uses only the streams it is given and never exits,
+// so tests can run whole commands in process.
+func Run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	return RunContext(context.Background(), args, stdin, stdout, stderr)
+}
+
+// RunContext is Run with a context for the commands' parsing, loading and
+// fetching; cancelling it stops them.
+func RunContext(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	a := &app{stdout: stdout, stderr: stderr, stdin: stdin}
+	cmd := a.rootCmd()
+	// Cobra reads os.Args when given nil.
+	cmd.SetArgs(append([]string{}, args...))
+	if err := cmd.ExecuteContext(ctx); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
 	}
+	return 0
 }
 
 func (a *app) rootCmd() *cobra.Command {
+	var showStats, showProgress bool
+	var keyFile string
+
 	cmd := &cobra.Command{
 		Use:   "eszip",
 		Short: "A tool for working with eszip archives",
@@ -38,28 +89,77 @@ func (a *app) rootCmd() *cobra.Command {
 Examples:
   eszip view archive.eszip2
   eszip view -s file:///main.ts archive.eszip2
+  eszip cat archive.eszip2 file:///main.ts
   eszip extract -o ./output archive.eszip2
   cat archive.eszip2 | eszip extract -o ./output
   eszip create -o archive.eszip2 file1.js file2.js
-  eszip info archive.eszip2`,
+  eszip bundle -o archive.eszip2 main.js
+  eszip info archive.eszip2
+  eszip stats archive.eszip2
+  eszip diff old.eszip2 new.eszip2`,
 		SilenceErrors: true,
 		// Show usage for flag/arg errors but not for runtime errors.
 		// PersistentPreRun fires after flag parsing succeeds, so any
 		// error returned by RunE will not print usage.
-		PersistentPreRun: func(cmd *cobra.Command, _ []string) {
+		PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
 			cmd.SilenceUsage = true
+			if showStats {
+				a.stats = &eszip.Counters{}
+			}
+			if showProgress {
+				a.progress = newProgressBar(a.stderr)
+			}
+			if keyFile != "" {
+				key, err := readKeyFile(keyFile)
+				if err != nil {
+					return err
+				}
+				a.keys = key
+			}
+			return nil
+		},
+		PersistentPostRun: func(_ *cobra.Command, _ []string) {
+			if a.progress != nil {
+				a.progress.end()
+			}
+			if a.stats != nil {
+				a.printStats()
+			}
 		},
 	}
 
+	cmd.PersistentFlags().BoolVar(&showStats, "stats", false, "Print bytes read, verified, and written to stderr")
+	cmd.PersistentFlags().BoolVar(&showProgress, "progress", false, "Draw progress bars for reading and writing archives on stderr")
+	cmd.PersistentFlags().BoolVar(&a.json, "json", false, "Print output as JSON (info, stats, view, diff, verify)")
+	cmd.PersistentFlags().StringVar(&keyFile, "key-file", "", "AES key for encrypted archives: 16, 24 or 32 bytes, raw or hex-encoded")
+
 	cmd.SetOut(a.stdout)
 	cmd.SetErr(a.stderr)
 	cmd.SetIn(a.stdin)
 
 	cmd.AddCommand(
 		a.viewCmd(),
+		a.catCmd(),
+		a.resolvePosCmd(),
+		a.listCmd(),
 		a.extractCmd(),
 		a.createCmd(),
+		a.addCmd(),
+		a.bundleCmd(),
 		a.infoCmd(),
+		a.statsCmd(),
+		a.graphCmd(),
+		a.repackCmd(),
+		a.convertCmd(),
+		a.mergeCmd(),
+		a.transformCmd(),
+		a.pruneCmd(),
+		a.recoverCmd(),
+		a.diffCmd(),
+		a.fingerprintCmd(),
+		a.npmCmd(),
+		a.verifyCmd(),
+		a.serveCmd(),
 	)
 
 	return cmd
@@ -75,13 +175,17 @@ func (a *app) viewCmd() *cobra.Command {
 		Aliases: []string{"v"},
 		Short:   "View contents of an eszip archive",
 		Args:    cobra.ExactArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
-			ctx := context.Background()
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
 
-			archive, err := loadArchive(ctx, args[0])
+			archive, err := a.openArchive(ctx, args[0])
 			if err != nil {
 				return err
 			}
+			defer archive.Close()
+			if a.json {
+				return a.viewJSON(ctx, archive.EszipUnion, specifier, showSourceMap, listOnly)
+			}
 
 			for _, spec := range archive.Specifiers() {
 				if specifier != "" && spec != specifier {
@@ -99,11 +203,28 @@ func (a *app) viewCmd() *cobra.Command {
 				}
 
 				fmt.Fprintf(a.stdout, "Specifier: %s\n", spec)
+				if module.Specifier != spec {
+					// The target is shown under its own specifier.
+					fmt.Fprintf(a.stdout, "Redirect: %s\n", module.Specifier)
+					fmt.Fprintln(a.stdout, "============")
+					continue
+				}
 				fmt.Fprintf(a.stdout, "Kind: %s\n", module.Kind)
+				headers := module.Headers()
+				for _, key := range slices.Sorted(maps.Keys(headers)) {
+					fmt.Fprintf(a.stdout, "Header: %s: %s\n", key, headers[key])
+				}
+				for _, name := range module.AuxNames() {
+					blob, _ := module.GetAux(name)
+					fmt.Fprintf(a.stdout, "Aux: %s (%d bytes)\n", name, len(blob))
+				}
 				fmt.Fprintln(a.stdout, "---")
 
 				source, err := module.Source(ctx)
 				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
 					fmt.Fprintf(a.stderr, "Error getting source: %v\n", err)
 					continue
 				}
@@ -129,37 +250,213 @@ func (a *app) viewCmd() *cobra.Command {
 	}
 
 	cmd.Flags().StringVarP(&specifier, "specifier", "s", "", "Show only this specifier")
+	cmd.RegisterFlagCompletionFunc("specifier", a.completeSpecifierFlag)
 	cmd.Flags().BoolVarP(&showSourceMap, "source-map", "m", false, "Show source maps")
 	cmd.Flags().BoolVarP(&listOnly, "list", "l", false, "List specifiers only")
 
 	return cmd
 }
 
+// moduleListing is one entry of view --list --json output. Offsets are
+// omitted when the archive records none.
+type moduleListing struct {
+	Specifier       string `json:"specifier"`
+	Kind            string `json:"kind"`
+	RedirectTo      string `json:"redirect_to,omitempty"`
+	SourceBytes     int64  `json:"source_bytes"`
+	SourceMapBytes  int64  `json:"source_map_bytes"`
+	SourceOffset    *int64 `json:"source_offset,omitempty"`
+	SourceMapOffset *int64 `json:"source_map_offset,omitempty"`
+}
+
+// moduleContent is one entry of view --json output. Source is null for
+// redirects, whose target has its own entry, and once the source has been
+// taken.
+type moduleContent struct {
+	Specifier  string            `json:"specifier"`
+	Kind       string            `json:"kind"`
+	RedirectTo string            `json:"redirect_to,omitempty"`
+	Headers    map[string]string `json:"headers,omitempty"`
+	Source     *string           `json:"source"`
+	SourceMap  string            `json:"source_map,omitempty"`
+}
+
+// viewJSON prints the modules view would show as a JSON array: their sizes
+// and offsets when listOnly is set, otherwise their contents.
+func (a *app) viewJSON(ctx context.Context, archive *eszip.EszipUnion, specifier string, showSourceMap, listOnly bool) error {
+	sizes := make(map[string]eszip.ModuleSize)
+	for _, size := range archive.ModuleSizes() {
+		sizes[size.Specifier] = size
+	}
+	listings := []moduleListing{}
+	contents := []moduleContent{}
+	for _, spec := range archive.Specifiers() {
+		if specifier != "" && spec != specifier {
+			continue
+		}
+		module := archive.GetModule(spec)
+		if module == nil {
+			continue
+		}
+		var redirectTo string
+		if module.Specifier != spec {
+			redirectTo = module.Specifier
+		}
+
+		if listOnly {
+			size := sizes[module.Specifier]
+			listings = append(listings, moduleListing{
+				Specifier:       spec,
+				Kind:            module.Kind.String(),
+				RedirectTo:      redirectTo,
+				SourceBytes:     size.Source,
+				SourceMapBytes:  size.SourceMap,
+				SourceOffset:    recordedOffset(size.SourceOffset),
+				SourceMapOffset: recordedOffset(size.SourceMapOffset),
+			})
+			continue
+		}
+
+		if redirectTo != "" {
+			contents = append(contents, moduleContent{Specifier: spec, Kind: module.Kind.String(), RedirectTo: redirectTo})
+			continue
+		}
+		source, err := module.Source(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			fmt.Fprintf(a.stderr, "Error getting source of %s: %v\n", spec, err)
+			continue
+		}
+		entry := moduleContent{Specifier: spec, Kind: module.Kind.String(), Headers: module.Headers()}
+		if source != nil {
+			text := string(source)
+			entry.Source = &text
+		}
+		if showSourceMap {
+			if sourceMap, err := module.SourceMap(ctx); err == nil {
+				entry.SourceMap = string(sourceMap)
+			}
+		}
+		contents = append(contents, entry)
+	}
+
+	if listOnly {
+		return a.writeJSON(listings)
+	}
+	return a.writeJSON(contents)
+}
+
 func (a *app) extractCmd() *cobra.Command {
 	var outputDir string
+	var noDecode bool
+	var rewriteImports bool
+	var linkSourceMaps bool
+	var npmDir string
+	var include, exclude globPatterns
+	var kindNames []string
+	var layout string
+	var transformNames []string
 
 	cmd := &cobra.Command{
 		Use:     "extract [<archive>]",
 		Aliases: []string{"x"},
 		Short:   "Extract files from an eszip archive",
 		Long: `Extract files from an eszip archive.
-If no archive path is given (or "-" is specified), reads from stdin.`,
+If no archive path is given (or "-" is specified), reads from stdin.
+
+--rewrite-imports points static imports between extracted JavaScript
+modules at the extracted files, so the tree runs locally. Bare specifiers
+are resolved through the archive's import map. Imports that cannot be
+rewritten go into a generated import_map.json in the output directory
+(import_map.generated.json if an extracted module has that name), and
+the source maps of rewritten modules are not extracted, since they no
+longer match.
+
+--link-source-maps ends each JavaScript file whose source map is extracted
+with a //# sourceMappingURL comment naming the .map file beside it, so
+debuggers pick the maps up.
+
+--transform reshapes JavaScript and JSON modules as they are extracted,
+for tools with other expectations. It is repeatable, and transforms run
+in the order given, before imports are rewritten:
+
+  cjs-to-esm         wrap CommonJS modules as ES modules whose default
+                     export is module.exports
+  strip-source-maps  drop source maps and sourceMappingURL comments
+  pretty-print       indent JSON and break minified JavaScript into
+                     lines; the source maps of reformatted modules are
+                     dropped
+
+Embedded npm package files are written to <npm-dir>/<name>@<version>/,
+one directory per package as it was unpacked; --npm-dir defaults to the
+npm directory of the output directory.
+
+--include and --exclude select modules by specifier with glob patterns. A
+pattern with a slash is matched against the whole specifier, "**" matching
+any number of path elements, and one without against its last path
+element; a pattern ending in a slash matches everything under it. --kind
+keeps only modules of the given kinds (javascript, json, jsonc, wasm,
+opaque_data).
+
+--layout chooses where modules go. host-prefixed, the default, mirrors
+specifiers as directories: remote modules under their host, local ones
+under their path. flat writes every module into the output directory
+under its file name, and hashed under a hash of its specifier, listing
+which is which in specifiers.json. A query string becomes a short hash in
+the file name, so versions of a module extracted side by side do not
+collide; specifiers that still map to the same file are an error.
+
+If the command is interrupted, the files it has extracted so far are
+removed.`,
 		Args: cobra.MaximumNArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
-			ctx := context.Background()
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
 
 			var archive *eszip.EszipUnion
 			var err error
 
 			if len(args) == 0 || args[0] == "-" {
-				archive, err = loadArchiveFromReader(ctx, a.stdin)
+				archive, err = a.loadArchiveFromReader(ctx, a.stdin)
 			} else {
-				archive, err = loadArchive(ctx, args[0])
+				archive, err = a.loadArchive(ctx, args[0])
+			}
+			if err != nil {
+				return err
 			}
+
+			type extractEntry struct {
+				specifier string
+				module    *eszip.Module
+				source    []byte
+				path      string
+			}
+			if npmDir == "" {
+				npmDir = filepath.Join(outputDir, "npm")
+			}
+			mapper, err := parseLayout(layout, !noDecode)
+			if err != nil {
+				return err
+			}
+			kinds, err := parseModuleKinds(kindNames)
+			if err != nil {
+				return err
+			}
+			transformer, err := parseTransforms(transformNames)
 			if err != nil {
 				return err
 			}
+			if err := include.validate("include"); err != nil {
+				return err
+			}
+			if err := exclude.validate("exclude"); err != nil {
+				return err
+			}
 
+			var entries []extractEntry
+			paths := make(map[string]string)
+			owners := make(map[string]string) // extracted path to specifier
 			for _, spec := range archive.Specifiers() {
 				module := archive.GetModule(spec)
 				if module == nil {
@@ -169,45 +466,183 @@ If no archive path is given (or "-" is specified), reads from stdin.`,
 				if strings.HasPrefix(spec, "data:") {
 					continue
 				}
+				if len(kinds) > 0 && !kinds[module.Kind] {
+					continue
+				}
+				if (len(include) > 0 && !include.matchSpecifier(spec)) || exclude.matchSpecifier(spec) {
+					continue
+				}
 
 				source, err := module.Source(ctx)
 				if err != nil {
+					if ctx.Err() != nil {
+						return ctx.Err()
+					}
 					fmt.Fprintf(a.stderr, "Error getting source for %s: %v\n", spec, err)
 					continue
 				}
 
+				// Package files are written even if empty.
+				if id, path, ok := eszip.ParseNpmFileSpecifier(spec); ok {
+					fullPath := filepath.Join(npmDir, filepath.FromSlash(id.String()), filepath.FromSlash(path))
+					entries = append(entries, extractEntry{spec, module, source, fullPath})
+					continue
+				}
+
 				if source == nil {
 					continue
 				}
 
-				filePath := specifierToPath(spec)
-				fullPath := filepath.Join(outputDir, filePath)
+				fullPath := filepath.Join(outputDir, filepath.FromSlash(mapper.Path(spec)))
+				if other, ok := owners[fullPath]; ok {
+					return fmt.Errorf("%s and %s both extract to %s; try --layout hashed", other, spec, fullPath)
+				}
+				owners[fullPath] = spec
+				entries = append(entries, extractEntry{spec, module, source, fullPath})
+				paths[spec] = fullPath
+			}
+
+			var rewriter *importRewriter
+			if rewriteImports {
+				var archiveImportMap []byte
+				if spec := archive.Summary().ImportMap; spec != "" {
+					if m := archive.GetImportMap(spec); m != nil {
+						archiveImportMap, _ = m.Source(ctx)
+					}
+				}
+				rewriter = newImportRewriter(outputDir, paths, archiveImportMap)
+			}
+
+			// Files created so far are removed if the command is cancelled,
+			// rather than leaving a partial extraction behind. Files that
+			// were already there are left alone.
+			var created []string
+			writeFile := func(path string, data []byte) error {
+				_, statErr := os.Lstat(path)
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					return err
+				}
+				if errors.Is(statErr, fs.ErrNotExist) {
+					created = append(created, path)
+				}
+				return nil
+			}
+			cancelled := func() error {
+				for _, path := range slices.Backward(created) {
+					os.Remove(path)
+				}
+				if len(created) > 0 {
+					fmt.Fprintf(a.stderr, "Removed %d partially extracted file(s)\n", len(created))
+				}
+				return ctx.Err()
+			}
+
+			droppedMaps := 0
+			for _, entry := range entries {
+				if ctx.Err() != nil {
+					return cancelled()
+				}
+				fullPath := entry.path
+				source := entry.source
+				sourceMap, err := entry.module.SourceMap(ctx)
+				if err != nil {
+					sourceMap = nil
+				}
+				if transformer != nil {
+					if source, sourceMap, err = transformer.Transform(entry.specifier, entry.module.Kind, source, sourceMap); err != nil {
+						fmt.Fprintf(a.stderr, "Error transforming %s: %v\n", entry.specifier, err)
+						continue
+					}
+				}
+				rewritten := false
+				if rewriter != nil && entry.module.Kind == eszip.ModuleKindJavaScript {
+					source, rewritten = rewriter.rewrite(entry.specifier, fullPath, source)
+				}
+				if rewritten && len(sourceMap) > 0 {
+					droppedMaps++
+					sourceMap = nil
+				}
+				mapPath := fullPath + ".map"
+				if linkSourceMaps && len(sourceMap) > 0 && entry.module.Kind == eszip.ModuleKindJavaScript {
+					source = eszip.LinkSourceMap(source, filepath.Base(mapPath))
+				}
 
 				if err := os.MkdirAll(filepath.Dir(fullPath), 0755); err != nil {
 					fmt.Fprintf(a.stderr, "Error creating directory: %v\n", err)
 					continue
 				}
 
-				if err := os.WriteFile(fullPath, source, 0644); err != nil {
+				if err := writeFile(fullPath, source); err != nil {
 					fmt.Fprintf(a.stderr, "Error writing file: %v\n", err)
 					continue
 				}
 
 				fmt.Fprintf(a.stdout, "Extracted: %s\n", fullPath)
 
-				sourceMap, err := module.SourceMap(ctx)
-				if err == nil && len(sourceMap) > 0 {
-					mapPath := fullPath + ".map"
-					if err := os.WriteFile(mapPath, sourceMap, 0644); err == nil {
+				if len(sourceMap) > 0 {
+					if err := writeFile(mapPath, sourceMap); err == nil {
 						fmt.Fprintf(a.stdout, "Extracted: %s\n", mapPath)
 					}
 				}
 			}
+
+			if ctx.Err() != nil {
+				return cancelled()
+			}
+			if layout == "hashed" && len(paths) > 0 {
+				// Hashed names say nothing of the module they hold.
+				manifest := make(map[string]string, len(paths))
+				for spec, fullPath := range paths {
+					rel, err := filepath.Rel(outputDir, fullPath)
+					if err != nil {
+						return err
+					}
+					manifest[filepath.ToSlash(rel)] = spec
+				}
+				data, err := json.MarshalIndent(manifest, "", "  ")
+				if err != nil {
+					return err
+				}
+				manifestPath := filepath.Join(outputDir, "specifiers.json")
+				if err := os.WriteFile(manifestPath, append(data, '\n'), 0644); err != nil {
+					return fmt.Errorf("writing manifest: %w", err)
+				}
+				fmt.Fprintf(a.stdout, "Wrote: %s\n", manifestPath)
+			}
+			if rewriter != nil {
+				data, err := rewriter.importMapJSON()
+				if err != nil {
+					return err
+				}
+				importMapPath := filepath.Join(outputDir, "import_map.json")
+				if slices.Contains(slices.Collect(maps.Values(paths)), importMapPath) {
+					// Don't overwrite an extracted module, typically the
+					// archive's own import map.
+					importMapPath = filepath.Join(outputDir, "import_map.generated.json")
+				}
+				if err := os.MkdirAll(outputDir, 0755); err != nil {
+					return err
+				}
+				if err := os.WriteFile(importMapPath, data, 0644); err != nil {
+					return fmt.Errorf("writing import map: %w", err)
+				}
+				fmt.Fprintf(a.stdout, "Wrote: %s\n", importMapPath)
+				rewriter.writeSummary(a.stdout, droppedMaps)
+			}
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVarP(&outputDir, "output", "o", ".", "Output directory")
+	cmd.Flags().BoolVar(&noDecode, "no-decode", false, "Keep percent-encoded specifier characters in file names")
+	cmd.Flags().BoolVar(&rewriteImports, "rewrite-imports", false, "Point imports between extracted modules at the extracted files")
+	cmd.Flags().BoolVar(&linkSourceMaps, "link-source-maps", false, "Append a sourceMappingURL comment naming each extracted source map")
+	cmd.Flags().StringVar(&npmDir, "npm-dir", "", "Directory for embedded npm package files (default <output>/npm)")
+	cmd.Flags().StringArrayVar((*[]string)(&include), "include", nil, "Extract only specifiers matching a glob pattern (repeatable)")
+	cmd.Flags().StringArrayVar((*[]string)(&exclude), "exclude", nil, "Skip specifiers matching a glob pattern (repeatable)")
+	cmd.Flags().StringVar(&layout, "layout", "host-prefixed", "Where modules are written (host-prefixed, flat, hashed)")
+	cmd.Flags().StringSliceVar(&kindNames, "kind", nil, "Extract only modules of these kinds (javascript, json, jsonc, wasm, opaque_data)")
+	cmd.Flags().StringSliceVar(&transformNames, "transform", nil, "Transform modules as they are extracted (cjs-to-esm, strip-source-maps, pretty-print; repeatable)")
 
 	return cmd
 }
@@ -215,92 +650,770 @@ If no archive path is given (or "-" is specified), reads from stdin.`,
 func (a *app) createCmd() *cobra.Command {
 	var outputPath string
 	var checksum string
+	var checksumSize uint8
+	var compression string
+	var format string
+	var inputOpts inputOptions
+	var meta []string
+	var allowedOrigins []string
+	var maxSize string
+	var strictMediaTypes bool
+	var recordMediaTypes bool
+	var noRemote bool
+	var reproducible bool
+	var dedup bool
+	var encrypt bool
+	var transpilerCommand string
+	var minifierCommand string
+	var cacheDir string
+	var root, baseURL string
+	var importMapPath string
+	var npmPackages []string
+	var entrypoints []string
+	var kindFlags []string
 
 	cmd := &cobra.Command{
 		Use:     "create <files...>",
 		Aliases: []string{"c"},
 		Short:   "Create a new eszip archive from files",
+		Long: `Create a new eszip archive from files.
+Directory arguments, and "dir/...", are walked recursively. Arguments
+may also be glob patterns, quoted so that the shell leaves them alone, such
+as 'src/**/*.ts'; "**" matches any number of directories. Symbolic links are
+skipped unless --follow-symlinks is given, and links that point outside
+every input are skipped unless --allow-external-symlinks is also given.
+
+--include and --exclude patterns are matched against paths relative to each
+directory argument (or the file name, for file arguments). A pattern
+without a slash matches the final path element at any depth, and "**"
+matches any number of directories; a trailing slash makes an --exclude
+pattern match directories only. With --include, only files matching one
+of its patterns are added.
+
+Local files are added under the file: URL of their absolute path unless
+--root is given, in which case their path relative to --root is resolved
+against --base-url, file:/// by default. Files outside --root are an error.
+--base-url alone maps the current directory.
+
+--import-map embeds an import map, or a deno.json, at the front of the
+archive, where Deno looks for it; its specifier is chosen like those of
+other local files. It is not otherwise added as a module.
+
+--entrypoint records the modules a runtime should evaluate first, in the
+order given, in the archive. Each is a specifier or the path of a local
+input, and must be one of the archive's modules. prune uses them when
+given no --entrypoint.
+
+--npm-package name@version=dir embeds the files of an unpacked npm package
+as opaque data under npm:///name@version/, so the archive runs offline;
+extract writes them back out.
+
+--allowed-origins makes the build fail if any http or https specifier comes
+from a host not in the list; "*.example.com" allows every subdomain.
+
+--format writes another format version, such as an older one for older
+Deno consumers. Versions before v2.2 always use sha256 checksums and cannot
+compress, v2 cannot hold npm packages, only v2.3 and later hold Wasm
+modules, only v2.4 and later, which Deno cannot read, hold module headers,
+only v2.5 and later hold module auxiliary data and only v2.6 keeps the
+integrity digests and tarball URLs of npm packages.
+
+--checksum-size truncates each checksum to that many bytes, saving space in
+archives of many small modules at the cost of weaker corruption checks.
+
+--max-size fails the build, writing nothing, if the archive would be larger
+than the given size, such as 128MB or 64MiB, and lists the largest modules.
+
+--reproducible writes modules sorted by specifier rather than in argument
+order, so the same inputs give byte-identical archives however the shell
+expands globs.
+
+--dedup stores sources and source maps that several modules carry byte for
+byte, such as vendored copies of one library, once. Deno cannot read
+archives written this way.
+
+--encrypt encrypts sources and source maps with AES-GCM under the key in
+--key-file. Specifiers stay readable. Only this tool and the library can
+read the result, given the same key.
+
+TypeScript, TSX and JSX files are stored as written unless --transpiler
+names a command to turn them into JavaScript. The command gets each source
+on stdin, with any "{}" argument replaced by the module's specifier, and
+writes JavaScript to stdout; a source map it inlines as a data: URL is
+stored as the module's source map. Modules keep their specifiers.
+--minifier names a command that minifies each JavaScript module, after
+transpiling, the same way: code on stdin, with its source map inlined as
+a data: URL if it has one, and minified code on stdout, with an inlined
+map that becomes the module's source map. The sizes saved are reported.
+--cache-dir keeps the transpiler's and minifier's output in a directory
+between runs, so that a later create only runs them on sources it has not
+seen before.
+
+http and https URLs are fetched and added under their URL. Their module kind
+comes from the response's Content-Type, falling back to the URL's extension;
+a disagreement between the two is a warning, or an error with
+--strict-media-types. --record-media-types stores each response's
+Content-Type as the module's content-type header, which needs format v2.4
+or later. A URL that redirects is stored under the final URL,
+with a redirect from the one given. --no-remote rejects URL arguments.
+
+Local files are stored as Wasm if they start with the WebAssembly magic and
+otherwise by extension: .js, .mjs, .cjs, .jsx, .ts, .mts, .cts and .tsx as
+javascript, .json as json, .jsonc (such as deno.jsonc) as jsonc and .wasm
+as wasm; anything else is javascript. --kind spec=kind overrides the kind
+of one input, named by specifier or path, and must match an input.`,
 		Example: `  eszip create -o app.eszip2 main.js utils.js
-  eszip create --checksum none -o app.eszip2 *.js`,
+  eszip create --checksum none -o app.eszip2 *.js
+  eszip create --compression gzip -o app.eszip2 src
+  eszip create --format v2.1 -o app.eszip2 src
+  eszip create -o app.eszip2 --exclude '*_test.ts' --exclude node_modules/ src
+  eszip create -o app.eszip2 --include '**/*.ts' --exclude '**/*.test.ts' src/...
+  eszip create -o app.eszip2 'src/**/*.ts'
+  eszip create -o app.eszip2 --root . src
+  eszip create -o app.eszip2 --root src --base-url https://example.com/app/ src
+  eszip create -o app.eszip2 --root . --import-map import_map.json src
+  eszip create -o app.eszip2 --npm-package chalk@5.3.0=vendor/chalk src
+  eszip create -o app.eszip2 --meta build=1234 --meta git=abc123 main.js
+  eszip create -o app.eszip2 --entrypoint main.js main.js utils.js
+  eszip create -o app.eszip2 main.js https://esm.sh/react
+  eszip create -o app.eszip2 --kind data/config=json src
+  eszip create --transpiler 'esbuild --loader=ts --sourcemap=inline' -o app.eszip2 src
+  eszip create --minifier 'esbuild --minify --sourcemap=inline' -o app.eszip2 src`,
 		Args: cobra.MinimumNArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			archive := eszip.NewV2()
 
-			switch checksum {
-			case "none":
-				archive.SetChecksum(eszip.ChecksumNone)
-			case "sha256":
-				archive.SetChecksum(eszip.ChecksumSha256)
-			case "xxhash3":
-				archive.SetChecksum(eszip.ChecksumXxh3)
-			default:
-				return fmt.Errorf("unknown checksum: %s", checksum)
+			checksumType, err := parseChecksum(checksum)
+			if err != nil {
+				return err
+			}
+			archive.SetChecksum(checksumType)
+			if err := archive.SetChecksumSize(checksumSize); err != nil {
+				return err
+			}
+			compressionType, err := parseCompression(compression)
+			if err != nil {
+				return err
+			}
+			archive.SetCompression(compressionType)
+			if encrypt {
+				if a.keys == nil {
+					return fmt.Errorf("--encrypt requires --key-file")
+				}
+				archive.SetEncryption(eszip.EncryptionAESGCM, a.keys)
+			}
+			version, err := parseVersion(format)
+			if err != nil {
+				return err
+			}
+			if err := archive.SetVersion(version); err != nil {
+				return err
+			}
+			if recordMediaTypes && cmd.Flags().Changed("format") && !version.SupportsHeaders() {
+				return fmt.Errorf("--record-media-types needs --format v2.4 or later")
 			}
 
-			for _, filePath := range args {
-				absPath, err := filepath.Abs(filePath)
-				if err != nil {
-					return fmt.Errorf("resolving path %s: %w", filePath, err)
+			metadata, err := parseMetadataFlags(meta)
+			if err != nil {
+				return err
+			}
+			archive.SetArchiveMetadata(metadata)
+
+			var transpiler eszip.Transpiler
+			if transpilerCommand != "" {
+				if transpiler, err = newCommandTranspiler(cmd.Context(), transpilerCommand); err != nil {
+					return err
 				}
+			}
+			var cache *buildCache
+			if cacheDir != "" {
+				if cache, err = openBuildCache(cacheDir); err != nil {
+					return fmt.Errorf("opening cache: %w", err)
+				}
+				if transpiler != nil {
+					transpiler = cache.transpiler(transpiler, transpilerCommand)
+				}
+			}
+			var minifier eszip.Minifier
+			if minifierCommand != "" {
+				if minifier, err = newCommandMinifier(cmd.Context(), minifierCommand); err != nil {
+					return err
+				}
+				if cache != nil {
+					minifier = cache.minifier(minifier, minifierCommand)
+				}
+			}
 
-				content, err := os.ReadFile(absPath)
+			specifiers, err := newSpecifierMapper(root, baseURL)
+			if err != nil {
+				return err
+			}
+			overrides, err := parseKindOverrides(kindFlags, specifiers)
+			if err != nil {
+				return err
+			}
+			var importMapSpecifier string
+			if importMapPath != "" {
+				importMap, err := loadImportMap(importMapPath, specifiers)
 				if err != nil {
-					return fmt.Errorf("reading file %s: %w", filePath, err)
+					return err
+				}
+				importMap.addTo(archive)
+				importMapSpecifier = importMap.specifier
+				fmt.Fprintf(a.stdout, "Import map: %s\n", importMapSpecifier)
+			}
+
+			var limit int64
+			if maxSize != "" {
+				if limit, err = parseSize(maxSize); err != nil {
+					return err
+				}
+			}
+
+			var localArgs, remoteArgs []string
+			for _, arg := range args {
+				if isRemoteInput(arg) {
+					remoteArgs = append(remoteArgs, arg)
+				} else {
+					localArgs = append(localArgs, arg)
 				}
+			}
 
-				kind := eszip.ModuleKindJavaScript
-				ext := strings.ToLower(filepath.Ext(filePath))
-				switch ext {
-				case ".json":
-					kind = eszip.ModuleKindJson
-				case ".wasm":
-					kind = eszip.ModuleKindWasm
+			inputs, err := collectInputs(localArgs, inputOpts)
+			if err != nil {
+				return err
+			}
+			if len(inputs.skipped) > 0 {
+				fmt.Fprintf(a.stderr, "Warning: skipped %d input(s):\n", len(inputs.skipped))
+				for _, s := range inputs.skipped {
+					fmt.Fprintf(a.stderr, "  %s: %s\n", s.path, s.reason)
 				}
+			}
 
-				specifier := "file://" + absPath
-				archive.AddModule(specifier, kind, content, nil)
+			for _, input := range inputs.files {
+				if err := cmd.Context().Err(); err != nil {
+					return err
+				}
+				specifier, err := specifiers.specifier(input.path)
+				if err != nil {
+					return err
+				}
+				if specifier == importMapSpecifier {
+					continue
+				}
+				if kind, ok := overrides.kind(specifier, input.path); ok {
+					if err := addFileAs(archive, input.real, specifier, kind, transpiler); err != nil {
+						return err
+					}
+				} else if err := addModuleFromFile(archive, input.real, specifier, transpiler); err != nil {
+					return err
+				}
 				fmt.Fprintf(a.stdout, "Added: %s\n", specifier)
 			}
+			for _, pkg := range npmPackages {
+				spec, dir, ok := strings.Cut(pkg, "=")
+				if !ok || dir == "" {
+					return fmt.Errorf("invalid --npm-package %q: want name@version=dir", pkg)
+				}
+				id, err := eszip.ParseNpmPackageID(spec)
+				if err != nil || id.Version == "" {
+					return fmt.Errorf("invalid --npm-package %q: want name@version=dir", pkg)
+				}
+				before := len(archive.Specifiers())
+				if err := addNpmPackageDir(archive, id, dir); err != nil {
+					return fmt.Errorf("adding npm package %s: %w", id, err)
+				}
+				fmt.Fprintf(a.stdout, "Added: npm package %s (%d files)\n", id, len(archive.Specifiers())-before)
+			}
+			if len(remoteArgs) > 0 && noRemote {
+				return fmt.Errorf("cannot fetch %s: remote inputs are disabled by --no-remote", remoteArgs[0])
+			}
+			for _, arg := range remoteArgs {
+				m, err := fetchRemote(cmd.Context(), arg, strictMediaTypes)
+				if err != nil {
+					return err
+				}
+				if kind, ok := overrides.kind(m.specifier, m.requested, arg); ok {
+					m.kind, m.warning = kind, ""
+				}
+				if m.warning != "" {
+					fmt.Fprintf(a.stderr, "Warning: %s: %s\n", m.specifier, m.warning)
+				}
+				if recordMediaTypes && m.mediaType != "" {
+					m.headers = map[string]string{"content-type": m.mediaType}
+				}
+				m.addTo(archive)
+				fmt.Fprintf(a.stdout, "Added: %s (%s)\n", m.specifier, m.kind)
+			}
+			if err := overrides.unused(); err != nil {
+				return err
+			}
+			if len(entrypoints) > 0 {
+				resolved, err := resolveEntrypoints(archive, specifiers, entrypoints)
+				if err != nil {
+					return err
+				}
+				archive.SetEntrypoints(resolved)
+			}
 
-			data, err := archive.IntoBytes()
+			writeOpts := append(a.writeOptions(), eszip.WithRedirectValidation())
+			if cmd.Flags().Changed("allowed-origins") {
+				writeOpts = append(writeOpts, eszip.WithWriteAllowedOrigins(allowedOrigins...))
+			}
+			if limit > 0 {
+				writeOpts = append(writeOpts, eszip.WithMaxArchiveSize(limit))
+			}
+			if reproducible {
+				writeOpts = append(writeOpts, eszip.WithDeterministicWrite())
+			}
+			if minifier != nil {
+				if _, err := archive.MinifySources(cmd.Context(), minifier); err != nil {
+					return err
+				}
+			}
+			var report eszip.WriteReport
+			writeOpts = append(writeOpts, eszip.WithWriteReport(&report))
+			if dedup {
+				writeOpts = append(writeOpts, eszip.WithDeduplication())
+			}
+			data, err := archive.IntoBytes(writeOpts...)
 			if err != nil {
 				return fmt.Errorf("serializing archive: %w", err)
 			}
 
-			if err := os.WriteFile(outputPath, data, 0644); err != nil {
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
 				return fmt.Errorf("writing output: %w", err)
 			}
 
 			fmt.Fprintf(a.stdout, "Created: %s (%d bytes)\n", outputPath, len(data))
+			a.printMinified(archive, &report)
+			if shared := report.SharedSources + report.SharedSourceMaps; shared > 0 {
+				fmt.Fprintf(a.stdout, "Deduplicated: %d source(s) and source map(s), saving %d bytes\n", shared, report.SavedBytes)
+			}
+			if len(inputs.excluded) > 0 {
+				fmt.Fprintf(a.stdout, "Excluded: %d path(s)\n", len(inputs.excluded))
+			}
+			if cache != nil {
+				hits, misses := a.saveCache(cache)
+				fmt.Fprintf(a.stdout, "Cache: %d reused, %d rebuilt\n", hits, misses)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringVar(&checksum, "checksum", "sha256", "Checksum algorithm (none, sha256, xxhash3, blake3)")
+	cmd.Flags().Uint8Var(&checksumSize, "checksum-size", 0, "Truncate checksums to this many bytes (default: the full digest)")
+	cmd.Flags().StringVar(&compression, "compression", "none", "Compress sources and source maps (none, gzip, zstd)")
+	cmd.Flags().StringVar(&format, "format", "v2.3", "Format version (v2, v2.1, v2.2, v2.3, v2.4, v2.5, v2.6)")
+	cmd.Flags().BoolVar(&inputOpts.symlinks.follow, "follow-symlinks", false, "Follow symbolic links to files and directories")
+	cmd.Flags().BoolVar(&inputOpts.symlinks.allowExternal, "allow-external-symlinks", false, "Follow symbolic links that point outside the inputs")
+	cmd.Flags().StringArrayVar((*[]string)(&inputOpts.include), "include", nil, "Add only files matching a glob pattern (repeatable)")
+	cmd.Flags().StringArrayVar((*[]string)(&inputOpts.exclude), "exclude", nil, "Skip inputs matching a glob pattern (repeatable)")
+	cmd.Flags().StringArrayVar(&meta, "meta", nil, "Archive metadata as key=value (repeatable)")
+	cmd.Flags().StringArrayVarP(&entrypoints, "entrypoint", "e", nil, "Record a module, by specifier or input path, as an entrypoint (repeatable)")
+	cmd.Flags().StringArrayVar(&kindFlags, "kind", nil, "Store an input, by specifier or path, as this kind: spec=javascript|json|jsonc|wasm|opaque_data (repeatable)")
+	cmd.Flags().StringSliceVar(&allowedOrigins, "allowed-origins", nil, "Fail unless every remote specifier's host is in this comma-separated list")
+	cmd.Flags().StringVar(&maxSize, "max-size", "", "Fail if the archive would exceed this size (e.g. 128MB, 64MiB)")
+	cmd.Flags().BoolVar(&strictMediaTypes, "strict-media-types", false, "Fail when a fetched module's Content-Type and extension disagree")
+	cmd.Flags().BoolVar(&recordMediaTypes, "record-media-types", false, "Store each fetched module's Content-Type as its content-type header (format v2.4+)")
+	cmd.Flags().BoolVar(&noRemote, "no-remote", false, "Fail instead of fetching http and https inputs")
+	cmd.Flags().BoolVar(&reproducible, "reproducible", false, "Sort entries so identical inputs give identical archives")
+	cmd.Flags().BoolVar(&dedup, "dedup", false, "Store identical sources and source maps once (not readable by Deno)")
+	cmd.Flags().BoolVar(&encrypt, "encrypt", false, "Encrypt sources and source maps with the key from --key-file")
+	cmd.Flags().StringVar(&root, "root", "", "Directory whose files get specifiers relative to --base-url")
+	cmd.Flags().StringVar(&baseURL, "base-url", "", "URL that --root maps to (default file:///)")
+	cmd.Flags().StringVar(&importMapPath, "import-map", "", "Embed this import map at the front of the archive")
+	cmd.Flags().StringArrayVar(&npmPackages, "npm-package", nil, "Embed the files of an npm package as name@version=dir (repeatable)")
+	cmd.Flags().StringVar(&transpilerCommand, "transpiler", "", "Command that turns TypeScript, TSX and JSX on stdin into JavaScript")
+	cmd.Flags().StringVar(&minifierCommand, "minifier", "", "Command that minifies JavaScript on stdin")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "", "Reuse transpiler and minifier output from earlier runs kept in this directory")
+
+	return cmd
+}
+
+func (a *app) repackCmd() *cobra.Command {
+	var outputPath string
+	var checksum string
+	var checksumSize uint8
+	var stripSourceMaps bool
+
+	cmd := &cobra.Command{
+		Use:   "repack <archive>",
+		Short: "Rewrite an eszip archive in canonical form",
+		Long: `Rewrite an eszip archive in canonical form: latest format version, modules
+and redirects sorted by specifier, npm packages sorted by ID. Archives with
+the same content repack to identical bytes.`,
+		Example: `  eszip repack -o canonical.eszip2 archive.eszip2
+  eszip repack --checksum xxhash3 --strip-source-maps -o small.eszip2 archive.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			checksumType, err := parseChecksum(checksum)
+			if err != nil {
+				return err
+			}
+			archive, err := a.loadArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			normalized, err := eszip.Normalize(ctx, archive, eszip.NormalizeOptions{
+				Checksum:        checksumType,
+				ChecksumSize:    checksumSize,
+				StripSourceMaps: stripSourceMaps,
+			})
+			if err != nil {
+				return err
+			}
+
+			data, err := normalized.IntoBytes(a.writeOptions()...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			fmt.Fprintf(a.stdout, "Repacked: %s (%d bytes)\n", outputPath, len(data))
 			return nil
 		},
 	}
 
 	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
-	cmd.Flags().StringVar(&checksum, "checksum", "sha256", "Checksum algorithm (none, sha256, xxhash3)")
+	cmd.Flags().StringVar(&checksum, "checksum", "sha256", "Checksum algorithm (none, sha256, xxhash3, blake3)")
+	cmd.Flags().Uint8Var(&checksumSize, "checksum-size", 0, "Truncate checksums to this many bytes (default: the full digest)")
+	cmd.Flags().BoolVar(&stripSourceMaps, "strip-source-maps", false, "Drop all source maps")
 
 	return cmd
 }
 
+func (a *app) convertCmd() *cobra.Command {
+	var outputPath string
+	var to string
+	var checksum string
+	var checksumSize uint8
+
+	cmd := &cobra.Command{
+		Use:   "convert <archive>",
+		Short: "Convert an eszip archive between V1 and V2",
+		Long: `Convert a V1 (JSON) archive to the V2 binary format, or a V2 archive to V1
+for consumers that only read JSON. V1 holds JavaScript modules and
+redirects alone, so V2 archives with other module kinds, source maps or an
+npm snapshot cannot be converted to it; repack --strip-source-maps drops
+source maps first.`,
+		Example: `  eszip convert --to v2 -o new.eszip2 old.json
+  eszip convert --to v1 -o legacy.json app.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			checksumType, err := parseChecksum(checksum)
+			if err != nil {
+				return err
+			}
+			archive, err := a.loadArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+
+			var data []byte
+			switch to {
+			case "v2":
+				v1, ok := archive.V1()
+				if !ok {
+					return fmt.Errorf("%s is already a V2 archive", args[0])
+				}
+				v2, err := eszip.ConvertV1ToV2(v1)
+				if err != nil {
+					return err
+				}
+				v2.SetChecksum(checksumType)
+				if err := v2.SetChecksumSize(checksumSize); err != nil {
+					return err
+				}
+				if data, err = v2.IntoBytes(a.writeOptions()...); err != nil {
+					return fmt.Errorf("serializing archive: %w", err)
+				}
+			case "v1":
+				v2, ok := archive.V2()
+				if !ok {
+					return fmt.Errorf("%s is already a V1 archive", args[0])
+				}
+				v1, err := eszip.ConvertV2ToV1(ctx, v2)
+				if err != nil {
+					return err
+				}
+				if data, err = v1.IntoBytes(); err != nil {
+					return fmt.Errorf("serializing archive: %w", err)
+				}
+			default:
+				return fmt.Errorf("unknown format %q (want v1 or v2)", to)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			fmt.Fprintf(a.stdout, "Converted: %s (%d bytes)\n", outputPath, len(data))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringVar(&to, "to", "v2", "Target format (v1, v2)")
+	cmd.Flags().StringVar(&checksum, "checksum", "sha256", "Checksum algorithm of V2 output (none, sha256, xxhash3, blake3)")
+	cmd.Flags().Uint8Var(&checksumSize, "checksum-size", 0, "Truncate checksums to this many bytes (default: the full digest)")
+
+	return cmd
+}
+
+func (a *app) mergeCmd() *cobra.Command {
+	var outputPath string
+	var onConflict string
+
+	cmd := &cobra.Command{
+		Use:   "merge <archives...>",
+		Short: "Combine eszip archives into one",
+		Long: `Combine V2 eszip archives into one holding the union of their modules,
+redirects and npm snapshots. Entries are taken in argument order and the
+output keeps the first archive's checksum algorithm and import map, or the
+first import map found if it has none.
+
+A specifier held by several archives with different content is a conflict,
+as is an npm requirement resolving to different packages. --on-conflict
+chooses whether to fail (error), keep the earliest archive's entry
+(keep-first) or the latest's (keep-last).`,
+		Example: `  eszip merge -o app.eszip2 core.eszip2 plugins.eszip2
+  eszip merge --on-conflict keep-last -o app.eszip2 base.eszip2 overrides.eszip2`,
+		Args: cobra.MinimumNArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			policy, err := parseConflictPolicy(onConflict)
+			if err != nil {
+				return err
+			}
+			var merged *eszip.EszipV2
+			for _, path := range args {
+				archive, err := a.loadArchive(ctx, path)
+				if err != nil {
+					return err
+				}
+				v2, ok := archive.V2()
+				if !ok {
+					return fmt.Errorf("%s: only V2 archives can be merged", path)
+				}
+				if merged == nil {
+					merged = v2
+					continue
+				}
+				if err := eszip.MergeContext(ctx, merged, v2, eszip.MergeOptions{OnConflict: policy}); err != nil {
+					return fmt.Errorf("merging %s: %w", path, err)
+				}
+			}
+
+			data, err := merged.IntoBytes(a.writeOptions()...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			fmt.Fprintf(a.stdout, "Merged: %s (%d bytes, %d entries from %d archives)\n", outputPath, len(data), len(merged.Specifiers()), len(args))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringVar(&onConflict, "on-conflict", "error", "How to resolve conflicting entries (error, keep-first, keep-last)")
+
+	return cmd
+}
+
+// parseConflictPolicy maps an --on-conflict flag value to a policy.
+func parseConflictPolicy(name string) (eszip.ConflictPolicy, error) {
+	for _, policy := range []eszip.ConflictPolicy{eszip.ConflictFail, eszip.ConflictKeepFirst, eszip.ConflictKeepLast} {
+		if policy.String() == name {
+			return policy, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown conflict policy: %s", name)
+}
+
+func (a *app) transformCmd() *cobra.Command {
+	var outputPath string
+	var banner string
+	var keepSourceMaps bool
+
+	cmd := &cobra.Command{
+		Use:   "transform <archive>",
+		Short: "Rewrite the JavaScript modules of an eszip archive",
+		Long: `Rewrite the JavaScript modules of an eszip archive in place, keeping
+every other entry, the entry order and the checksum algorithm. Source maps
+of changed modules are dropped unless --keep-source-maps is given.`,
+		Example: `  eszip transform --banner '/* (c) Example Inc. */' -o out.eszip2 archive.eszip2`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			archive, err := a.loadArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			v2, ok := archive.V2()
+			if !ok {
+				return fmt.Errorf("%s: transform requires a V2 archive", args[0])
+			}
+
+			var opts []eszip.TransformOption
+			if keepSourceMaps {
+				opts = append(opts, eszip.WithPreservedSourceMaps())
+			}
+			changed, err := v2.TransformSources(ctx, func(_ string, kind eszip.ModuleKind, source []byte) ([]byte, bool, error) {
+				if kind != eszip.ModuleKindJavaScript || banner == "" {
+					return nil, false, nil
+				}
+				return append([]byte(banner+"\n"), source...), true, nil
+			}, opts...)
+			if err != nil {
+				return err
+			}
+
+			data, err := v2.IntoBytes(a.writeOptions()...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			fmt.Fprintf(a.stdout, "Transformed: %s (%d module(s) changed, %d bytes)\n", outputPath, changed, len(data))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringVar(&banner, "banner", "", "Prepend this line to every JavaScript module")
+	cmd.Flags().BoolVar(&keepSourceMaps, "keep-source-maps", false, "Keep the source maps of changed modules")
+
+	return cmd
+}
+
+func (a *app) recoverCmd() *cobra.Command {
+	var outputPath string
+
+	cmd := &cobra.Command{
+		Use:   "recover <archive>",
+		Short: "Salvage the intact modules of a truncated eszip archive",
+		Long: `Salvage the intact modules of an eszip archive whose sources were cut off,
+as by a full disk, and write them to a new valid archive. Modules whose
+source was lost are left out, along with redirects to them; modules whose
+source map alone was lost are kept without it. The archive headers must be
+intact.`,
+		Example: `  eszip recover -o fixed.eszip2 broken.eszip2`,
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			var report eszip.RecoveryReport
+			opts := append(a.parseOptions(), eszip.WithRecovery(&report))
+			archive, err := parseFile(ctx, args[0], opts...)
+			if err != nil {
+				return describeParseError(args[0], err)
+			}
+			v2, ok := archive.V2()
+			if !ok {
+				return fmt.Errorf("recover supports V2 archives only")
+			}
+			salvaged, err := eszip.Salvage(ctx, v2)
+			if err != nil {
+				return err
+			}
+
+			data, err := salvaged.IntoBytes(a.writeOptions()...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			writeRecoveryReport(a.stdout, &report)
+			fmt.Fprintf(a.stdout, "Recovered: %s (%d bytes)\n", outputPath, len(data))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "recovered.eszip2", "Output file path")
+
+	return cmd
+}
+
+// writeRecoveryReport lists what recover salvaged and lost.
+func writeRecoveryReport(w io.Writer, report *eszip.RecoveryReport) {
+	if !report.Truncated {
+		fmt.Fprintln(w, "Archive is not truncated")
+	} else {
+		fmt.Fprintf(w, "Truncated at byte %d\n", report.TruncatedAt)
+	}
+	var salvaged, lost int64
+	for _, m := range report.Salvaged {
+		salvaged += m.Bytes
+	}
+	for _, m := range report.Lost {
+		lost += m.Bytes
+	}
+	fmt.Fprintf(w, "Salvaged: %d module(s), %d bytes\n", len(report.Salvaged), salvaged)
+	for _, m := range report.Salvaged {
+		if m.SourceMapLost {
+			fmt.Fprintf(w, "  %s (%d bytes, source map lost)\n", m.Specifier, m.Bytes)
+		}
+	}
+	fmt.Fprintf(w, "Lost: %d module(s), %d bytes\n", len(report.Lost), lost)
+	for _, m := range report.Lost {
+		fmt.Fprintf(w, "  %s (%d bytes)\n", m.Specifier, m.Bytes)
+	}
+}
+
 func (a *app) infoCmd() *cobra.Command {
-	return &cobra.Command{
+	var showOrigins bool
+
+	cmd := &cobra.Command{
 		Use:     "info <archive>",
 		Aliases: []string{"i"},
 		Short:   "Show information about an eszip archive",
 		Args:    cobra.ExactArgs(1),
-		RunE: func(_ *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			archivePath := args[0]
-			ctx := context.Background()
+			ctx := cmd.Context()
 
 			stat, err := os.Stat(archivePath)
 			if err != nil {
 				return err
 			}
 
-			archive, err := loadArchive(ctx, archivePath)
+			archive, err := a.openArchive(ctx, archivePath)
 			if err != nil {
 				return err
 			}
+			defer archive.Close()
+
+			if showOrigins {
+				return a.writeOrigins(archive.Origins())
+			}
+
+			entrypoints, err := archive.Entrypoints(ctx)
+			if err != nil {
+				return err
+			}
+			wasmModules, err := wasmInfos(ctx, archive.EszipUnion)
+			if err != nil {
+				return err
+			}
+			if a.json {
+				return a.writeJSON(archiveInfo{Summary: archive.Summary(), Entrypoints: entrypoints, Wasm: wasmModules})
+			}
 
 			specifiers := archive.Specifiers()
 
@@ -314,10 +1427,17 @@ func (a *app) infoCmd() *cobra.Command {
 			}
 
 			fmt.Fprintf(a.stdout, "Modules: %d\n", len(specifiers))
+			if len(entrypoints) > 0 {
+				fmt.Fprintf(a.stdout, "Entrypoints: %s\n", strings.Join(entrypoints, ", "))
+			}
 
+			sizes := make(map[string]int64)
+			for _, size := range archive.ModuleSizes() {
+				sizes[size.Specifier] = size.Source
+			}
 			kindCounts := make(map[eszip.ModuleKind]int)
 			redirectCount := 0
-			totalSourceSize := 0
+			var totalSourceSize int64
 
 			for _, spec := range specifiers {
 				module := archive.GetModule(spec)
@@ -326,14 +1446,12 @@ func (a *app) infoCmd() *cobra.Command {
 					continue
 				}
 				kindCounts[module.Kind]++
-
-				source, _ := module.Source(ctx)
-				totalSourceSize += len(source)
+				totalSourceSize += sizes[module.Specifier]
 			}
 
 			fmt.Fprintln(a.stdout, "\nModule types:")
-			for kind, count := range kindCounts {
-				fmt.Fprintf(a.stdout, "  %s: %d\n", kind, count)
+			for _, kind := range slices.Sorted(maps.Keys(kindCounts)) {
+				fmt.Fprintf(a.stdout, "  %s: %d\n", kind, kindCounts[kind])
 			}
 			if redirectCount > 0 {
 				fmt.Fprintf(a.stdout, "  redirects: %d\n", redirectCount)
@@ -341,6 +1459,24 @@ func (a *app) infoCmd() *cobra.Command {
 
 			fmt.Fprintf(a.stdout, "\nTotal source size: %d bytes\n", totalSourceSize)
 
+			if len(wasmModules) > 0 {
+				fmt.Fprintln(a.stdout, "\nWasm modules:")
+				for _, m := range wasmModules {
+					a.printWasmInfo(m)
+				}
+			}
+
+			metadata, err := archive.ArchiveMetadata(ctx)
+			if err != nil {
+				return err
+			}
+			if len(metadata) > 0 {
+				fmt.Fprintln(a.stdout, "\nMetadata:")
+				for _, key := range slices.Sorted(maps.Keys(metadata)) {
+					fmt.Fprintf(a.stdout, "  %s: %s\n", key, metadata[key])
+				}
+			}
+
 			if v2, ok := archive.V2(); ok {
 				snapshot := v2.TakeNpmSnapshot()
 				if snapshot != nil {
@@ -351,37 +1487,517 @@ func (a *app) infoCmd() *cobra.Command {
 			return nil
 		},
 	}
+
+	cmd.Flags().BoolVar(&showOrigins, "origins", false, "List the network origins modules came from instead")
+
+	return cmd
+}
+
+// archiveInfo is the info --json output: the archive's Summary, its
+// entrypoints and what its Wasm modules import and export.
+type archiveInfo struct {
+	eszip.Summary
+	Entrypoints []string         `json:"entrypoints,omitempty"`
+	Wasm        []wasmModuleInfo `json:"wasm,omitempty"`
+}
+
+// wasmModuleInfo describes one Wasm module, or why it could not be read.
+type wasmModuleInfo struct {
+	Specifier string `json:"specifier"`
+	*wasm.Info
+	Error string `json:"error,omitempty"`
+}
+
+// wasmInfos decodes the Wasm modules of archive in order. A module that is
+// not a well-formed WebAssembly binary is reported with its error.
+func wasmInfos(ctx context.Context, archive *eszip.EszipUnion) ([]wasmModuleInfo, error) {
+	var infos []wasmModuleInfo
+	for _, spec := range archive.Specifiers() {
+		module := archive.GetModule(spec)
+		if module == nil || module.Kind != eszip.ModuleKindWasm {
+			continue
+		}
+		info, err := module.WasmInfo(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			infos = append(infos, wasmModuleInfo{Specifier: spec, Error: err.Error()})
+			continue
+		}
+		infos = append(infos, wasmModuleInfo{Specifier: spec, Info: info})
+	}
+	return infos, nil
+}
+
+// printWasmInfo prints a Wasm module's exports grouped by kind, its import
+// count and the memory it starts with.
+func (a *app) printWasmInfo(m wasmModuleInfo) {
+	fmt.Fprintf(a.stdout, "  %s\n", m.Specifier)
+	if m.Info == nil {
+		fmt.Fprintf(a.stdout, "    Invalid: %s\n", m.Error)
+		return
+	}
+	var groups []string
+	for _, kind := range []wasm.ExternalKind{wasm.KindFunction, wasm.KindMemory, wasm.KindTable, wasm.KindGlobal, wasm.KindTag} {
+		if names := m.Exported(kind); len(names) > 0 {
+			groups = append(groups, fmt.Sprintf("%s %s", kind, strings.Join(names, ", ")))
+		}
+	}
+	if len(groups) == 0 {
+		groups = []string{"none"}
+	}
+	fmt.Fprintf(a.stdout, "    Exports: %s\n", strings.Join(groups, "; "))
+	fmt.Fprintf(a.stdout, "    Imports: %d\n", len(m.Imports))
+	for _, mem := range m.Memories {
+		limit := "no maximum"
+		if mem.HasMax {
+			limit = fmt.Sprintf("maximum %d", mem.Max)
+		}
+		origin := "defined"
+		if mem.Imported {
+			origin = "imported"
+		}
+		fmt.Fprintf(a.stdout, "    Memory: %d page(s) (%s), %s, %s\n", mem.Min, formatBytes(int64(mem.MinBytes())), limit, origin)
+	}
+}
+
+// originInfo is one line of info --origins output.
+type originInfo struct {
+	Host    string   `json:"host"`
+	Modules int      `json:"modules"`
+	Bytes   int64    `json:"bytes"`
+	Kinds   []string `json:"kinds"`
+}
+
+// writeOrigins prints origins sorted by host.
+func (a *app) writeOrigins(origins map[string]eszip.OriginStats) error {
+	list := make([]originInfo, 0, len(origins))
+	for _, host := range slices.Sorted(maps.Keys(origins)) {
+		o := origins[host]
+		kinds := make([]string, len(o.Kinds))
+		for i, kind := range o.Kinds {
+			kinds[i] = kind.String()
+		}
+		list = append(list, originInfo{Host: host, Modules: o.Modules, Bytes: o.Bytes, Kinds: kinds})
+	}
+
+	if a.json {
+		return a.writeJSON(list)
+	}
+	if len(list) == 0 {
+		fmt.Fprintln(a.stdout, "No remote origins")
+		return nil
+	}
+	for _, o := range list {
+		fmt.Fprintf(a.stdout, "%-30s %5d modules %12d bytes  %s\n", o.Host, o.Modules, o.Bytes, strings.Join(o.Kinds, ", "))
+	}
+	return nil
 }
 
-func loadArchive(ctx context.Context, path string) (_ *eszip.EszipUnion, retErr error) {
-	f, err := os.Open(path)
+// writeOutput writes data to path by way of a temporary file in the same
+// directory, so that a failed or cancelled command never leaves a partial
+// archive behind or clobbers the previous one.
+func writeOutput(ctx context.Context, path string, data []byte) (err error) {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer func() {
-		if err := f.Close(); err != nil && retErr == nil {
-			retErr = err
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
 		}
 	}()
-	return loadArchiveFromReader(ctx, f)
+	if _, err := f.Write(data); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeJSON prints v to stdout as indented JSON.
+func (a *app) writeJSON(v any) error {
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseLayout maps an extract --layout flag value to a specifier mapper.
+func parseLayout(name string, decode bool) (eszip.SpecifierMapper, error) {
+	switch name {
+	case "host-prefixed":
+		return eszip.HostPrefixedLayout(decode), nil
+	case "flat":
+		return eszip.FlatLayout(decode), nil
+	case "hashed":
+		return eszip.HashedLayout(), nil
+	default:
+		return nil, fmt.Errorf("unknown layout: %s (want host-prefixed, flat or hashed)", name)
+	}
+}
+
+// parseTransforms maps extract --transform flag values to a transformer
+// applying them in order, or nil if there are none.
+func parseTransforms(names []string) (eszip.Transformer, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	transformers := make([]eszip.Transformer, len(names))
+	for i, name := range names {
+		switch name {
+		case "cjs-to-esm":
+			transformers[i] = eszip.CommonJSToESM()
+		case "strip-source-maps":
+			transformers[i] = eszip.StripSourceMaps()
+		case "pretty-print":
+			transformers[i] = eszip.PrettyPrint()
+		default:
+			return nil, fmt.Errorf("unknown transform: %s (want cjs-to-esm, strip-source-maps or pretty-print)", name)
+		}
+	}
+	return eszip.ChainTransformers(transformers...), nil
+}
+
+// parseModuleKinds maps --kind flag values to the set of kinds they name.
+func parseModuleKinds(names []string) (map[eszip.ModuleKind]bool, error) {
+	kinds := make(map[eszip.ModuleKind]bool, len(names))
+	for _, name := range names {
+		kind, err := parseModuleKind(name)
+		if err != nil {
+			return nil, err
+		}
+		kinds[kind] = true
+	}
+	return kinds, nil
+}
+
+// parseModuleKind maps a module kind name to the kind.
+func parseModuleKind(name string) (eszip.ModuleKind, error) {
+	known := []eszip.ModuleKind{eszip.ModuleKindJavaScript, eszip.ModuleKindJson, eszip.ModuleKindJsonc, eszip.ModuleKindWasm, eszip.ModuleKindOpaqueData}
+	i := slices.IndexFunc(known, func(k eszip.ModuleKind) bool { return k.String() == name })
+	if i < 0 {
+		return 0, fmt.Errorf("unknown module kind: %s (want javascript, json, jsonc, wasm or opaque_data)", name)
+	}
+	return known[i], nil
+}
+
+// kindOverrides holds create's --kind flags: the kind for each input,
+// named by specifier or input path.
+type kindOverrides struct {
+	kinds map[string]eszip.ModuleKind
+	// names maps each key of kinds to the flag value it came from, and
+	// used records the flags that matched an input.
+	names map[string]string
+	used  map[string]bool
+}
+
+func parseKindOverrides(values []string, specifiers *specifierMapper) (*kindOverrides, error) {
+	o := &kindOverrides{kinds: make(map[string]eszip.ModuleKind), names: make(map[string]string), used: make(map[string]bool)}
+	for _, value := range values {
+		i := strings.LastIndex(value, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid --kind %q: want specifier=kind", value)
+		}
+		name := value[:i]
+		kind, err := parseModuleKind(value[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid --kind %q: %w", value, err)
+		}
+		o.kinds[name], o.names[name] = kind, name
+		if abs, err := filepath.Abs(name); err == nil && !isRemoteInput(name) {
+			if spec, err := specifiers.specifier(abs); err == nil {
+				o.kinds[spec], o.names[spec] = kind, name
+			}
+		}
+	}
+	return o, nil
+}
+
+// kind returns the override for the first of specifiers that has one.
+func (o *kindOverrides) kind(specifiers ...string) (eszip.ModuleKind, bool) {
+	for _, specifier := range specifiers {
+		if kind, ok := o.kinds[specifier]; ok {
+			o.used[o.names[specifier]] = true
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// unused returns an error naming the first --kind that matched no input.
+func (o *kindOverrides) unused() error {
+	for _, name := range slices.Sorted(maps.Values(o.names)) {
+		if !o.used[name] {
+			return fmt.Errorf("--kind %s matches no input", name)
+		}
+	}
+	return nil
+}
+
+// parseChecksum maps a --checksum flag value to a checksum type.
+func parseChecksum(name string) (eszip.ChecksumType, error) {
+	switch name {
+	case "none":
+		return eszip.ChecksumNone, nil
+	case "sha256":
+		return eszip.ChecksumSha256, nil
+	case "xxhash3":
+		return eszip.ChecksumXxh3, nil
+	case "blake3":
+		return eszip.ChecksumBlake3, nil
+	default:
+		return 0, fmt.Errorf("unknown checksum: %s", name)
+	}
 }
 
-func loadArchiveFromReader(ctx context.Context, r io.Reader) (*eszip.EszipUnion, error) {
+// parseCompression maps a --compression flag value to a compression type.
+func parseCompression(name string) (eszip.CompressionType, error) {
+	switch name {
+	case "none":
+		return eszip.CompressionNone, nil
+	case "gzip":
+		return eszip.CompressionGzip, nil
+	case "zstd":
+		return eszip.CompressionZstd, nil
+	default:
+		return 0, fmt.Errorf("unknown compression: %s", name)
+	}
+}
+
+func parseVersion(name string) (eszip.EszipVersion, error) {
+	switch name {
+	case "v2":
+		return eszip.VersionV2, nil
+	case "v2.1":
+		return eszip.VersionV2_1, nil
+	case "v2.2":
+		return eszip.VersionV2_2, nil
+	case "v2.3":
+		return eszip.VersionV2_3, nil
+	case "v2.4":
+		return eszip.VersionV2_4, nil
+	case "v2.5":
+		return eszip.VersionV2_5, nil
+	case "v2.6":
+		return eszip.VersionV2_6, nil
+	default:
+		return 0, fmt.Errorf("unknown format: %s", name)
+	}
+}
+
+// sizeUnits maps the suffixes accepted by parseSize to their multipliers.
+var sizeUnits = map[string]int64{
+	"":    1,
+	"b":   1,
+	"kb":  1000,
+	"mb":  1000 * 1000,
+	"gb":  1000 * 1000 * 1000,
+	"kib": 1 << 10,
+	"mib": 1 << 20,
+	"gib": 1 << 30,
+}
+
+// parseSize parses a human-readable size such as "128MB", "1.5GiB" or
+// "4096". KB, MB and GB are decimal; KiB, MiB and GiB are binary.
+func parseSize(value string) (int64, error) {
+	s := strings.TrimSpace(value)
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToLower(strings.TrimSpace(s[i:]))]
+	if err != nil || !ok || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q: expected a number with an optional unit such as 128MB or 64MiB", value)
+	}
+	return int64(n * float64(unit)), nil
+}
+
+// parseMetadataFlags turns repeated --meta key=value flags into a map. A
+// later value for the same key wins.
+func parseMetadataFlags(flags []string) (map[string]string, error) {
+	if len(flags) == 0 {
+		return nil, nil
+	}
+	metadata := make(map[string]string, len(flags))
+	for _, flag := range flags {
+		key, value, ok := strings.Cut(flag, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid --meta %q: expected key=value", flag)
+		}
+		metadata[key] = value
+	}
+	return metadata, nil
+}
+
+func (a *app) loadArchiveFromReader(ctx context.Context, r io.Reader) (*eszip.EszipUnion, error) {
 	data, err := io.ReadAll(r)
 	if err != nil {
 		return nil, fmt.Errorf("reading archive: %w", err)
 	}
-	return eszip.ParseBytes(ctx, data)
+	// data is not used again, so the archive may keep slices of it.
+	archive, err := eszip.ParseBytes(ctx, data, append(a.parseOptions(), eszip.WithZeroCopy())...)
+	return archive, describeParseError("stdin", err)
+}
+
+func (a *app) parseOptions() []eszip.ParseOption {
+	var opts []eszip.ParseOption
+	if a.stats != nil {
+		opts = append(opts, eszip.WithInstrumentation(a.stats))
+	}
+	if a.keys != nil {
+		opts = append(opts, eszip.WithDecryptionKey(a.keys))
+	}
+	if a.progress != nil {
+		opts = append(opts, eszip.WithProgress(a.progress.parseProgress()))
+	}
+	return opts
+}
+
+// writeOptions returns the write options implied by the global flags.
+func (a *app) writeOptions() []eszip.WriteOption {
+	var opts []eszip.WriteOption
+	if a.stats != nil {
+		opts = append(opts, eszip.WithWriteInstrumentation(a.stats))
+	}
+	if a.progress != nil {
+		opts = append(opts, eszip.WithWriteProgress(a.progress.writeProgress()))
+	}
+	return opts
+}
+
+// readKeyFile reads an AES key stored as raw bytes or as hex digits.
+func readKeyFile(path string) (eszip.StaticKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+	key := data
+	if decoded, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+		key = decoded
+	}
+	switch len(key) {
+	case 16, 24, 32:
+		return eszip.StaticKey(key), nil
+	}
+	return nil, fmt.Errorf("key file %s holds %d bytes; want 16, 24 or 32, raw or hex-encoded", path, len(key))
 }
 
-func specifierToPath(specifier string) string {
-	path := specifier
-	for _, prefix := range []string{"file:///", "file://", "https://", "http://"} {
-		if after, found := strings.CutPrefix(path, prefix); found {
-			path = after
-			break
+func (a *app) printStats() {
+	fmt.Fprintf(a.stderr, "Bytes read: %d (%d sections)\n", a.stats.BytesRead.Load(), a.stats.Sections.Load())
+	fmt.Fprintf(a.stderr, "Sources loaded: %d (%d bytes, %d verified)\n", a.stats.SourcesLoaded.Load(), a.stats.SourceBytes.Load(), a.stats.BytesVerified.Load())
+	fmt.Fprintf(a.stderr, "Bytes written: %d\n", a.stats.BytesWritten.Load())
+}
+
+// describeParseError names the input when it is not recognisable as an
+// archive at all, so the message is not mistaken for a corrupt archive.
+func describeParseError(name string, err error) error {
+	var pe *eszip.ParseError
+	if errors.As(err, &pe) && pe.Type == eszip.ErrUnknownFormat {
+		return fmt.Errorf("%s is not an eszip archive: %w", name, err)
+	}
+	return err
+}
+
+// resolveEntrypoints turns --entrypoint values, each a specifier or the
+// path of a local input, into the specifiers of modules in archive.
+// addFileAs adds the file at path as a module of the given kind, passing
+// JavaScript through the transpiler as AddModuleFromFile does.
+func addFileAs(archive *eszip.EszipV2, path, specifier string, kind eszip.ModuleKind, t eszip.Transpiler) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var sourceMap []byte
+	if kind == eszip.ModuleKindJavaScript {
+		if source, sourceMap, err = eszip.Transpile(t, specifier, source); err != nil {
+			return err
+		}
+	}
+	archive.AddModule(specifier, kind, source, sourceMap)
+	return nil
+}
+
+func resolveEntrypoints(archive *eszip.EszipV2, specifiers *specifierMapper, values []string) ([]string, error) {
+	resolved := make([]string, 0, len(values))
+	for _, value := range values {
+		if archive.GetModule(value) != nil {
+			resolved = append(resolved, value)
+			continue
+		}
+		if abs, err := filepath.Abs(value); err == nil {
+			if spec, err := specifiers.specifier(abs); err == nil && archive.GetModule(spec) != nil {
+				resolved = append(resolved, spec)
+				continue
+			}
 		}
+		return nil, fmt.Errorf("--entrypoint %s is not one of the archive's modules", value)
+	}
+	return resolved, nil
+}
+
+// specifierMapper turns the paths of create inputs into specifiers.
+type specifierMapper struct {
+	root string // absolute; empty to use pathToSpecifier
+	base *url.URL
+}
+
+func newSpecifierMapper(root, baseURL string) (*specifierMapper, error) {
+	if root == "" && baseURL == "" {
+		return &specifierMapper{}, nil
+	}
+	if root == "" {
+		root = "."
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("resolving --root %s: %w", root, err)
+	}
+	if baseURL == "" {
+		baseURL = "file:///"
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil || !base.IsAbs() {
+		return nil, fmt.Errorf("invalid --base-url %q: want an absolute URL", baseURL)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base = base.JoinPath("/")
+	}
+	return &specifierMapper{root: absRoot, base: base}, nil
+}
+
+func (m *specifierMapper) specifier(absPath string) (string, error) {
+	if m.root == "" {
+		return pathToSpecifier(absPath), nil
+	}
+	rel, err := filepath.Rel(m.root, absPath)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside --root %s", absPath, m.root)
+	}
+	return m.base.ResolveReference(&url.URL{Path: filepath.ToSlash(rel)}).String(), nil
+}
+
+// pathToSpecifier is the inverse of eszip.HostPrefixedLayout for local
+// files: it turns an absolute path into a file:// specifier,
+// percent-encoding characters that are not valid in a URL path.
+func pathToSpecifier(absPath string) string {
+	p := filepath.ToSlash(absPath)
+	if !strings.HasPrefix(p, "/") {
+		// Windows drive paths (C:/...) need a leading slash in file URLs.
+		p = "/" + p
 	}
-	path = strings.TrimPrefix(path, "/")
-	return path
+	u := url.URL{Scheme: "file", Path: p}
+	return u.String()
 }
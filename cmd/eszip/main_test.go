@@ -2,10 +2,28 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/JakeChampion/eszip"
 )
 
 func projectRoot(t *testing.T) string {
@@ -159,16 +177,194 @@ func TestExtractErrors(t *testing.T) {
 	})
 }
 
+func TestExtractFilters(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///src/main.js", eszip.ModuleKindJavaScript, []byte("main"), nil)
+	archive.AddModule("file:///src/lib/util.js", eszip.ModuleKindJavaScript, []byte("util"), nil)
+	archive.AddModule("file:///src/config.json", eszip.ModuleKindJson, []byte("{}"), nil)
+	archive.AddModule("file:///src/add.wasm", eszip.ModuleKindWasm, []byte("\x00asm"), nil)
+	chalk := &eszip.NpmPackageID{Name: "chalk", Version: "5.3.0"}
+	if err := archive.AddNpmPackageFile(chalk, "index.js", []byte("chalk")); err != nil {
+		t.Fatal(err)
+	}
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--kind", "wasm"}, []string{"src/add.wasm"}},
+		{[]string{"--kind", "json,wasm"}, []string{"src/add.wasm", "src/config.json"}},
+		{[]string{"--include", "file:///src/**", "--exclude", "*.json", "--exclude", "*.wasm"}, []string{"src/lib/util.js", "src/main.js"}},
+		{[]string{"--include", "file:///src/lib/"}, []string{"src/lib/util.js"}},
+		{[]string{"--include", "npm:///chalk@*/"}, []string{"npm/chalk@5.3.0/index.js"}},
+		{[]string{"--include", "*.js", "--kind", "javascript"}, []string{"src/lib/util.js", "src/main.js"}},
+	} {
+		outDir := t.TempDir()
+		a, _ := newTestApp()
+		if err := a.run(append(append([]string{"extract", "-o", outDir}, tt.args...), archivePath)); err != nil {
+			t.Fatalf("extract %v failed: %v", tt.args, err)
+		}
+		var got []string
+		for _, path := range listFilesRecursive(t, outDir) {
+			rel, _ := filepath.Rel(outDir, path)
+			got = append(got, filepath.ToSlash(rel))
+		}
+		slices.Sort(got)
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("extract %v: extracted %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	for _, args := range [][]string{{"--kind", "typescript"}, {"--include", "["}} {
+		a, _ := newTestApp()
+		if err := a.run(append(append([]string{"extract", "-o", t.TempDir()}, args...), archivePath)); err == nil {
+			t.Errorf("extract %v: expected an error", args)
+		}
+	}
+}
+
+func TestExtractLayout(t *testing.T) {
+	archive := eszip.NewV2()
+	specifiers := []string{"file:///src/main.ts", "file:///lib/main.ts", "https://esm.sh/mod.ts?v=1", "https://esm.sh/mod.ts?v=2"}
+	for _, spec := range specifiers {
+		archive.AddModule(spec, eszip.ModuleKindJavaScript, []byte(spec), nil)
+	}
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	extract := func(args ...string) (string, error) {
+		outDir := t.TempDir()
+		a, _ := newTestApp()
+		return outDir, a.run(append(append([]string{"extract", "-o", outDir}, args...), archivePath))
+	}
+	// contents maps each extracted file to what it holds.
+	contents := func(outDir string) map[string]string {
+		files := map[string]string{}
+		for _, path := range listFilesRecursive(t, outDir) {
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rel, _ := filepath.Rel(outDir, path)
+			files[filepath.ToSlash(rel)] = string(data)
+		}
+		return files
+	}
+
+	outDir, err := extract()
+	if err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	files := contents(outDir)
+	if len(files) != 4 || files["src/main.ts"] != "file:///src/main.ts" || files["lib/main.ts"] != "file:///lib/main.ts" {
+		t.Errorf("host-prefixed layout extracted %v", files)
+	}
+	for path := range files {
+		if strings.HasPrefix(path, "esm.sh/") && (strings.Contains(path, "?") || !strings.HasSuffix(path, ".ts")) {
+			t.Errorf("query string not folded into the name: %s", path)
+		}
+	}
+
+	if _, err := extract("--layout", "flat"); err == nil || !strings.Contains(err.Error(), "both extract to") {
+		t.Errorf("flat layout with clashing names = %v, want a collision error", err)
+	}
+
+	outDir, err = extract("--layout", "hashed")
+	if err != nil {
+		t.Fatalf("extract --layout hashed failed: %v", err)
+	}
+	files = contents(outDir)
+	var manifest map[string]string
+	if err := json.Unmarshal([]byte(files["specifiers.json"]), &manifest); err != nil {
+		t.Fatalf("reading specifiers.json: %v", err)
+	}
+	if len(manifest) != len(specifiers) || len(files) != len(specifiers)+1 {
+		t.Fatalf("hashed layout extracted %v with manifest %v", files, manifest)
+	}
+	for path, spec := range manifest {
+		if files[path] != spec {
+			t.Errorf("%s holds %q, manifest says %s", path, files[path], spec)
+		}
+	}
+
+	if _, err := extract("--layout", "tree"); err == nil {
+		t.Error("unknown layout: expected an error")
+	}
+}
+
+func TestExtractTransform(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///src/lib.cjs", eszip.ModuleKindJavaScript, []byte("module.exports = function(){return 1};\n//# sourceMappingURL=lib.cjs.map\n"), []byte(`{"version":3,"mappings":"AAAA"}`))
+	archive.AddModule("file:///src/main.js", eszip.ModuleKindJavaScript, []byte("import lib from \"./lib.cjs\";if(lib()){console.log(1)}\n"), []byte(`{"version":3,"mappings":""}`))
+	archive.AddModule("file:///src/config.json", eszip.ModuleKindJson, []byte(`{"a":1}`), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	outDir := t.TempDir()
+	a, _ := newTestApp()
+	if err := a.run([]string{"extract", "-o", outDir, "--transform", "cjs-to-esm", "--transform", "pretty-print,strip-source-maps", archivePath}); err != nil {
+		t.Fatalf("extract --transform failed: %v", err)
+	}
+	files := map[string]string{}
+	for _, path := range listFilesRecursive(t, outDir) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rel, _ := filepath.Rel(outDir, path)
+		files[filepath.ToSlash(rel)] = string(data)
+	}
+	if len(files) != 3 {
+		t.Fatalf("extracted %v, want three modules and no source maps", slices.Collect(maps.Keys(files)))
+	}
+	if lib := files["src/lib.cjs"]; !strings.Contains(lib, `from "node:module";`) || !strings.Contains(lib, "\nexport default __eszipModule.exports;") || strings.Contains(lib, "sourceMappingURL") {
+		t.Errorf("lib.cjs = %q, want it wrapped as an ES module", lib)
+	}
+	if main := files["src/main.js"]; main != "import lib from \"./lib.cjs\";\nif(lib()){\n  console.log(1)\n}\n" {
+		t.Errorf("main.js = %q, want it pretty-printed", main)
+	}
+	if config := files["src/config.json"]; config != "{\n  \"a\": 1\n}\n" {
+		t.Errorf("config.json = %q, want it indented", config)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"extract", "-o", t.TempDir(), "--transform", "minify", archivePath}); err == nil || !strings.Contains(err.Error(), "unknown transform") {
+		t.Errorf("extract --transform minify = %v, want an unknown transform error", err)
+	}
+}
+
 func TestView(t *testing.T) {
 	a, stdout := newTestApp()
 	if err := a.run([]string{"view", testdataPath(t, "redirect.eszip2")}); err != nil {
 		t.Fatalf("view failed: %v", err)
 	}
-	for _, want := range []string{"Specifier:", "Kind:"} {
+	for _, want := range []string{"Specifier:", "Kind:", "Specifier: file:///a.ts\nRedirect: file:///b.ts\n"} {
 		if !strings.Contains(stdout.String(), want) {
 			t.Errorf("expected %q in view output", want)
 		}
 	}
+	// The redirect does not repeat its target's source.
+	if n := strings.Count(stdout.String(), `export const b = "b";`); n != 1 {
+		t.Errorf("b.ts source shown %d times, want 1:\n%s", n, stdout.String())
+	}
 }
 
 func TestViewWithSpecifier(t *testing.T) {
@@ -192,6 +388,35 @@ func TestViewWithSourceMap(t *testing.T) {
 	}
 }
 
+func TestViewHeaders(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModuleWithHeaders("https://example.com/mod.ts", eszip.ModuleKindJavaScript, []byte("export {};"), nil, map[string]string{"content-type": "application/typescript"})
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "headers.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"view", path}); err != nil {
+		t.Fatalf("view failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Header: content-type: application/typescript\n") {
+		t.Errorf("expected header in view output, got %s", stdout)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "view", path}); err != nil {
+		t.Fatalf("view --json failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), `"content-type": "application/typescript"`) {
+		t.Errorf("expected headers in JSON output, got %s", stdout)
+	}
+}
+
 func TestViewListOnly(t *testing.T) {
 	a, stdout := newTestApp()
 	if err := a.run([]string{"view", "-l", testdataPath(t, "redirect.eszip2")}); err != nil {
@@ -212,6 +437,191 @@ func TestViewListOnly(t *testing.T) {
 	}
 }
 
+func TestCat(t *testing.T) {
+	archivePath := testdataPath(t, "redirect.eszip2")
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"cat", archivePath, "file:///main.ts"}, "export * as a from \"./a.ts\";\n"},
+		{[]string{"cat", archivePath, "file:///a.ts"}, "export const b = \"b\";\n"},
+		{[]string{"cat", "-m", archivePath, "file:///main.ts"}, `{"version":3,"sources":["file:///main.ts"],"sourcesContent":["export * as a from \"./a.ts\";\n"],"names":[],"mappings":"AAAA,MAAM,MAAM,CAAC,MAAM,CAAQ"}`},
+	} {
+		a, stdout := newTestApp()
+		if err := a.run(tc.args); err != nil {
+			t.Fatalf("%v failed: %v", tc.args, err)
+		}
+		if stdout.String() != tc.want {
+			t.Errorf("%v wrote %q, want %q", tc.args, stdout.String(), tc.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "app.eszip2")
+	archive := eszip.NewV2()
+	archive.AddModule("file:///a.js", eszip.ModuleKindJavaScript, []byte("a"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{
+		{"cat", path, "file:///missing.js"},
+		{"cat", "--source-map", path, "file:///a.js"},
+	} {
+		a, stdout := newTestApp()
+		if err := a.run(args); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+		if stdout.Len() != 0 {
+			t.Errorf("%v wrote %q", args, stdout.String())
+		}
+	}
+}
+
+func TestResolvePos(t *testing.T) {
+	archivePath := testdataPath(t, "redirect.eszip2")
+	a, stdout := newTestApp()
+	if err := a.run([]string{"resolve-pos", archivePath, "file:///main.ts:1:8", "file:///main.ts:2:1"}); err != nil {
+		t.Fatalf("resolve-pos failed: %v", err)
+	}
+	want := "file:///main.ts:1:8 -> file:///main.ts:1:7\nfile:///main.ts:2:1 -> unmapped\n"
+	if stdout.String() != want {
+		t.Errorf("resolve-pos wrote %q, want %q", stdout.String(), want)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"resolve-pos", "--json", archivePath, "file:///main.ts:1:21"}); err != nil {
+		t.Fatalf("resolve-pos --json failed: %v", err)
+	}
+	var positions []resolvedPosition
+	if err := json.Unmarshal(stdout.Bytes(), &positions); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout.String())
+	}
+	if len(positions) != 1 || positions[0].Original == nil || positions[0].Original.Column != 28 {
+		t.Errorf("resolve-pos --json = %s", stdout.String())
+	}
+
+	for _, args := range [][]string{
+		{"resolve-pos", archivePath, "file:///main.ts:1"},
+		{"resolve-pos", archivePath, "file:///main.ts:0:1"},
+		{"resolve-pos", archivePath, "file:///missing.ts:1:1"},
+	} {
+		a, _ := newTestApp()
+		if err := a.run(args); err == nil {
+			t.Errorf("%v: expected error", args)
+		}
+	}
+}
+
+func TestCompletion(t *testing.T) {
+	archivePath := testdataPath(t, "redirect.eszip2")
+	for _, tc := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"__complete", "view", archivePath, "--specifier", "file:///m"}, []string{"file:///main.ts"}},
+		{[]string{"__complete", "cat", archivePath, ""}, []string{"file:///main.ts", "file:///b.ts", "file:///a.ts"}},
+		{[]string{"__complete", "prune", archivePath, "-e", "file:///a"}, []string{"file:///a.ts"}},
+		{[]string{"__complete", "graph", archivePath, "--entrypoint", "https:"}, nil},
+	} {
+		a, stdout := newTestApp()
+		if err := a.run(tc.args); err != nil {
+			t.Fatalf("%v failed: %v", tc.args, err)
+		}
+		lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+		got, directive := lines[:len(lines)-1], lines[len(lines)-1]
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("%v completed %q, want %q", tc.args, got, tc.want)
+		}
+		if directive != ":4" {
+			t.Errorf("%v directive = %s, want :4 (no file completion)", tc.args, directive)
+		}
+	}
+
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		a, stdout := newTestApp()
+		if err := a.run([]string{"completion", shell}); err != nil {
+			t.Fatalf("completion %s failed: %v", shell, err)
+		}
+		if !strings.Contains(stdout.String(), "eszip") {
+			t.Errorf("completion %s wrote no script", shell)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///src/small.ts", eszip.ModuleKindJavaScript, []byte("export {};"), nil)
+	archive.AddModule("file:///src/big.js", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("x"), 100), []byte("{}"))
+	archive.AddModule("file:///data.json", eszip.ModuleKindJson, []byte("{}"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	specifiers := func(out string) []string {
+		var specs []string
+		for _, line := range strings.Split(out, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 && strings.HasPrefix(fields[0], "file:") {
+				specs = append(specs, fields[0])
+			}
+		}
+		return specs
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{nil, []string{"file:///src/small.ts", "file:///src/big.js", "file:///data.json"}},
+		{[]string{"--sort", "size"}, []string{"file:///src/big.js", "file:///src/small.ts", "file:///data.json"}},
+		{[]string{"--sort", "name"}, []string{"file:///data.json", "file:///src/big.js", "file:///src/small.ts"}},
+		{[]string{"--filter", "*.ts"}, []string{"file:///src/small.ts"}},
+		{[]string{"--filter", "file:///src/*", "--sort", "name"}, []string{"file:///src/big.js", "file:///src/small.ts"}},
+	} {
+		a, stdout := newTestApp()
+		if err := a.run(append(append([]string{"list"}, tt.args...), path)); err != nil {
+			t.Fatalf("list %v failed: %v", tt.args, err)
+		}
+		if got := specifiers(stdout.String()); !slices.Equal(got, tt.want) {
+			t.Errorf("list %v = %v, want %v", tt.args, got, tt.want)
+		}
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"list", path}); err != nil {
+		t.Fatalf("list failed: %v", err)
+	}
+	if !regexp.MustCompile(`file:///src/big\.js\s+javascript\s+100\s+2\s+10\s+0\n`).MatchString(stdout.String()) {
+		t.Errorf("unexpected table:\n%s", stdout)
+	}
+	if !strings.Contains(stdout.String(), "3 module(s), 112 source bytes, 2 source map bytes") {
+		t.Errorf("unexpected totals:\n%s", stdout)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "list", "--sort", "size", path}); err != nil {
+		t.Fatalf("list --json failed: %v", err)
+	}
+	var listings []moduleListing
+	if err := json.Unmarshal(stdout.Bytes(), &listings); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if len(listings) != 3 || listings[0].SourceBytes != 100 || listings[0].SourceOffset == nil || *listings[0].SourceOffset != 10 {
+		t.Errorf("listings = %+v", listings)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"list", "--sort", "kind", path}); err == nil {
+		t.Error("expected an error for an unknown sort order")
+	}
+}
+
 func TestInfo(t *testing.T) {
 	a, stdout := newTestApp()
 	if err := a.run([]string{"info", testdataPath(t, "redirect.eszip2")}); err != nil {
@@ -224,6 +634,39 @@ func TestInfo(t *testing.T) {
 	}
 }
 
+func TestInfoWasm(t *testing.T) {
+	a, stdout := newTestApp()
+	if err := a.run([]string{"info", testdataPath(t, "wasm.eszip2_3")}); err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	for _, want := range []string{"Wasm modules:", "file:///math.wasm", "Exports: function add, subtract; memory memory", "Memory: 16 page(s) (1 MiB)"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("expected %q in info output:\n%s", want, stdout)
+		}
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"info", "--json", testdataPath(t, "wasm.eszip2_3")}); err != nil {
+		t.Fatalf("info --json failed: %v", err)
+	}
+	var got struct {
+		Format string `json:"format"`
+		Wasm   []struct {
+			Specifier string `json:"specifier"`
+			Exports   []struct {
+				Name string `json:"name"`
+				Kind string `json:"kind"`
+			} `json:"exports"`
+		} `json:"wasm"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &got); err != nil {
+		t.Fatalf("invalid JSON: %v", err)
+	}
+	if got.Format != "v2.3" || len(got.Wasm) != 1 || got.Wasm[0].Specifier != "file:///math.wasm" || len(got.Wasm[0].Exports) != 5 || got.Wasm[0].Exports[1].Kind != "function" {
+		t.Errorf("info --json = %+v", got)
+	}
+}
+
 func TestInfoV1(t *testing.T) {
 	a, stdout := newTestApp()
 	if err := a.run([]string{"info", testdataPath(t, "basic.json")}); err != nil {
@@ -260,8 +703,62 @@ func TestCreate(t *testing.T) {
 	}
 }
 
+func TestCreateKinds(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	files := map[string]string{
+		"app.mjs":     "export {};",
+		"lib.cjs":     "module.exports = {};",
+		"view.tsx":    "export const v = <div />;",
+		"deno.jsonc":  "{ // comment\n}",
+		"blob":        "\x00asm\x01\x00\x00\x00",
+		"config":      `{"a": 1}`,
+		"notes.txt":   "hello",
+		"mislabel.js": "\x00asm\x01\x00\x00\x00",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputPath := filepath.Join(t.TempDir(), "app.eszip2")
+	a, _ := newTestApp()
+	args := []string{"create", "-o", outputPath, "--root", dir, "--kind", "file:///config=json", "--kind", filepath.Join(dir, "notes.txt") + "=opaque_data", dir}
+	if err := a.run(args); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	archive, err := parseFile(ctx, outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for specifier, want := range map[string]eszip.ModuleKind{
+		"file:///app.mjs":     eszip.ModuleKindJavaScript,
+		"file:///lib.cjs":     eszip.ModuleKindJavaScript,
+		"file:///view.tsx":    eszip.ModuleKindJavaScript,
+		"file:///blob":        eszip.ModuleKindWasm,
+		"file:///mislabel.js": eszip.ModuleKindWasm,
+		"file:///config":      eszip.ModuleKindJson,
+		"file:///notes.txt":   eszip.ModuleKindOpaqueData,
+	} {
+		if m := archive.GetModule(specifier); m == nil || m.Kind != want {
+			t.Errorf("%s = %+v, want kind %s", specifier, m, want)
+		}
+	}
+	if m := archive.GetImportMap("file:///deno.jsonc"); m == nil || m.Kind != eszip.ModuleKindJsonc {
+		t.Errorf("deno.jsonc = %+v, want kind jsonc", m)
+	}
+
+	for _, kind := range []string{"file:///missing.js=json", "file:///config=yaml", "=json"} {
+		a, _ := newTestApp()
+		if err := a.run([]string{"create", "-o", outputPath, "--root", dir, "--kind", kind, dir}); err == nil {
+			t.Errorf("--kind %s: expected error", kind)
+		}
+	}
+}
+
 func TestCreateChecksumOptions(t *testing.T) {
-	for _, cs := range []string{"none", "sha256", "xxhash3"} {
+	for _, cs := range []string{"none", "sha256", "xxhash3", "blake3"} {
 		t.Run(cs, func(t *testing.T) {
 			outDir := t.TempDir()
 			outputPath := filepath.Join(outDir, "test.eszip2")
@@ -287,74 +784,353 @@ func TestCreateChecksumOptions(t *testing.T) {
 	}
 }
 
-func TestHelp(t *testing.T) {
-	a, stdout := newTestApp()
-	if err := a.run([]string{"help"}); err != nil {
-		t.Fatalf("help failed: %v", err)
+func TestCreateChecksumSize(t *testing.T) {
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "test.eszip2")
+	jsFile := filepath.Join(outDir, "hello.js")
+	if err := os.WriteFile(jsFile, []byte("test"), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
 	}
-	if !strings.Contains(stdout.String(), "eszip") {
-		t.Error("expected 'eszip' in help output")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "--checksum", "blake3", "--checksum-size", "4", "-o", outputPath, jsFile}); err != nil {
+		t.Fatalf("create --checksum-size 4 failed: %v", err)
+	}
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	if summary := archive.Summary(); summary.Checksum != "blake3" || summary.ChecksumSize != 4 {
+		t.Errorf("checksum = %s/%d, want blake3/4", summary.Checksum, summary.ChecksumSize)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"create", "--checksum", "xxhash3", "--checksum-size", "9", "-o", outputPath, jsFile}); err == nil {
+		t.Error("expected error for a checksum size larger than the digest")
 	}
 }
 
-func TestRunErrors(t *testing.T) {
-	t.Run("unknown_command", func(t *testing.T) {
-		a, _ := newTestApp()
-		if err := a.run([]string{"bogus"}); err == nil {
-			t.Fatal("expected error for unknown command")
-		}
-	})
+func TestCreateCompression(t *testing.T) {
+	source := strings.Repeat("export const value = 'compressible';\n", 100)
+	for _, compression := range []string{"gzip", "zstd"} {
+		t.Run(compression, func(t *testing.T) {
+			outDir := t.TempDir()
+			outputPath := filepath.Join(outDir, "test.eszip2")
+			jsFile := filepath.Join(outDir, "hello.js")
+			if err := os.WriteFile(jsFile, []byte(source), 0644); err != nil {
+				t.Fatalf("failed to write test file: %v", err)
+			}
+
+			a, _ := newTestApp()
+			if err := a.run([]string{"create", "--compression", compression, "-o", outputPath, jsFile}); err != nil {
+				t.Fatalf("create --compression %s failed: %v", compression, err)
+			}
+			archive, err := parseFile(context.Background(), outputPath)
+			if err != nil {
+				t.Fatalf("failed to parse output: %v", err)
+			}
+			if got := archive.Summary().Compression; got != compression {
+				t.Errorf("compression = %s, want %s", got, compression)
+			}
+			module := archive.GetModule(archive.Specifiers()[0])
+			if got, err := module.Source(context.Background()); err != nil || string(got) != source {
+				t.Errorf("source = %d bytes, %v", len(got), err)
+			}
+		})
+	}
 }
 
-func TestCreateJsonFile(t *testing.T) {
+func TestCreateFormat(t *testing.T) {
 	outDir := t.TempDir()
 	outputPath := filepath.Join(outDir, "test.eszip2")
-
-	jsonFile := filepath.Join(outDir, "config.json")
-	if err := os.WriteFile(jsonFile, []byte(`{"key":"value"}`), 0644); err != nil {
+	jsFile := filepath.Join(outDir, "hello.js")
+	if err := os.WriteFile(jsFile, []byte("test"), 0644); err != nil {
 		t.Fatalf("failed to write test file: %v", err)
 	}
 
-	a, stdout := newTestApp()
-	if err := a.run([]string{"create", "-o", outputPath, jsonFile}); err != nil {
-		t.Fatalf("create failed: %v", err)
-	}
-	if !strings.Contains(stdout.String(), "Added:") {
-		t.Error("expected 'Added:' in output")
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "--format", "v2.1", "-o", outputPath, jsFile}); err != nil {
+		t.Fatalf("create --format v2.1 failed: %v", err)
 	}
-
-	info, err := os.Stat(outputPath)
+	archive, err := parseFile(context.Background(), outputPath)
 	if err != nil {
-		t.Fatalf("output file not found: %v", err)
+		t.Fatalf("failed to parse output: %v", err)
 	}
-	if info.Size() == 0 {
-		t.Error("output file is empty")
+	if got := archive.Summary().Format; got != "v2.1" {
+		t.Errorf("format = %s, want v2.1", got)
 	}
-}
 
-func TestCreateWasmFile(t *testing.T) {
-	outDir := t.TempDir()
-	outputPath := filepath.Join(outDir, "test.eszip2")
+	a, _ = newTestApp()
+	err = a.run([]string{"create", "--format", "v2", "--checksum", "xxhash3", "-o", outputPath, jsFile})
+	if !errors.Is(err, eszip.ErrVersionTooOld) {
+		t.Errorf("create --format v2 --checksum xxhash3 error = %v, want ErrVersionTooOld", err)
+	}
+}
 
-	wasmFile := filepath.Join(outDir, "module.wasm")
-	// Minimal wasm magic bytes
-	if err := os.WriteFile(wasmFile, []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, 0644); err != nil {
-		t.Fatalf("failed to write test file: %v", err)
+func TestCreateReproducible(t *testing.T) {
+	dir := t.TempDir()
+	var files []string
+	for _, name := range []string{"b.js", "a.js", "c.js"} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+		files = append(files, path)
 	}
 
-	a, stdout := newTestApp()
-	if err := a.run([]string{"create", "-o", outputPath, wasmFile}); err != nil {
-		t.Fatalf("create failed: %v", err)
+	create := func(name string, files ...string) []byte {
+		t.Helper()
+		out := filepath.Join(dir, name)
+		a, _ := newTestApp()
+		if err := a.run(append([]string{"create", "--reproducible", "-o", out}, files...)); err != nil {
+			t.Fatalf("create --reproducible failed: %v", err)
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
 	}
-	if !strings.Contains(stdout.String(), "Added:") {
-		t.Error("expected 'Added:' in output")
+	x := create("x.eszip2", files...)
+	y := create("y.eszip2", files[2], files[0], files[1])
+	if !bytes.Equal(x, y) {
+		t.Error("create --reproducible output depends on argument order")
 	}
 }
 
-func TestCreateMultipleFiles(t *testing.T) {
-	outDir := t.TempDir()
-	outputPath := filepath.Join(outDir, "test.eszip2")
-
+func TestCreateDedup(t *testing.T) {
+	dir, outDir := t.TempDir(), t.TempDir()
+	for _, name := range []string{"a/lib.js", "b/lib.js", "main.js"} {
+		content := "export const lib = 1;"
+		if name == "main.js" {
+			content = "import './a/lib.js';"
+		}
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write test file: %v", err)
+		}
+	}
+
+	create := func(name string, flags ...string) []byte {
+		t.Helper()
+		out := filepath.Join(outDir, name)
+		a, stdout := newTestApp()
+		if err := a.run(append(append([]string{"create"}, flags...), "-o", out, dir)); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		if deduped := strings.Contains(stdout.String(), "Deduplicated: 1 "); deduped != (len(flags) > 0) {
+			t.Errorf("create %v output:\n%s", flags, stdout.String())
+		}
+		data, err := os.ReadFile(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	plain := create("plain.eszip2")
+	deduped := create("dedup.eszip2", "--dedup")
+	if want := len(plain) - len("export const lib = 1;") - 32; len(deduped) != want {
+		t.Errorf("deduplicated archive is %d bytes, want %d", len(deduped), want)
+	}
+
+	archive, err := eszip.ParseBytes(context.Background(), deduped)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	for _, spec := range archive.Specifiers() {
+		if !strings.HasSuffix(spec, "/lib.js") {
+			continue
+		}
+		source, err := archive.GetModule(spec).Source(context.Background())
+		if err != nil || string(source) != "export const lib = 1;" {
+			t.Errorf("%s source = %q (err %v)", spec, source, err)
+		}
+	}
+}
+
+func TestCreateTranspiler(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the fake transpiler")
+	}
+	dir := t.TempDir()
+	// The fake transpiler records its argument and prints fixed JavaScript
+	// with an inline source map.
+	script := filepath.Join(dir, "transpile.sh")
+	body := "#!/bin/sh\ncat >/dev/null\necho \"$1\" >> " + filepath.Join(dir, "calls") + "\n" +
+		"printf 'export const x = 1;\\n//# sourceMappingURL=data:application/json;base64,eyJ2ZXJzaW9uIjozfQ==\\n'\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	ts := filepath.Join(dir, "main.ts")
+	js := filepath.Join(dir, "util.js")
+	if err := os.WriteFile(ts, []byte("export const x: number = 1;"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(js, []byte("export {};"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "app.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "--transpiler", "sh " + script + " {}", "-o", out, ts, js}); err != nil {
+		t.Fatalf("create --transpiler failed: %v", err)
+	}
+	archive, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	ctx := context.Background()
+	module := archive.GetModule(pathToSpecifier(ts))
+	if module == nil {
+		t.Fatalf("main.ts missing from %v", archive.Specifiers())
+	}
+	if source, _ := module.Source(ctx); string(source) != "export const x = 1;\n" {
+		t.Errorf("source = %q", source)
+	}
+	if sourceMap, _ := module.SourceMap(ctx); string(sourceMap) != `{"version":3}` {
+		t.Errorf("source map = %q", sourceMap)
+	}
+	if source, _ := archive.GetModule(pathToSpecifier(js)).Source(ctx); string(source) != "export {};" {
+		t.Errorf("JavaScript source = %q, want it unchanged", source)
+	}
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	if err != nil || string(calls) != pathToSpecifier(ts)+"\n" {
+		t.Errorf("transpiler calls = %q, %v", calls, err)
+	}
+
+	a, _ = newTestApp()
+	err = a.run([]string{"create", "--transpiler", "false", "-o", out, ts})
+	if err == nil || !strings.Contains(err.Error(), "transpiling "+pathToSpecifier(ts)) {
+		t.Errorf("failing transpiler error = %v", err)
+	}
+}
+
+func TestCreateEncrypted(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "app.key")
+	if err := os.WriteFile(keyFile, []byte(strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	jsFile := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(jsFile, []byte("const secret = 'proprietary';"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "app.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "--encrypt", "-o", out, jsFile}); err == nil {
+		t.Error("create --encrypt without --key-file succeeded")
+	}
+	a, _ = newTestApp()
+	if err := a.run([]string{"--key-file", keyFile, "create", "--encrypt", "-o", out, jsFile}); err != nil {
+		t.Fatalf("create --encrypt failed: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("proprietary")) {
+		t.Error("archive contains plaintext")
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"info", out}); !errors.Is(err, eszip.ErrMissingKey) {
+		t.Errorf("info without key error = %v, want ErrMissingKey", err)
+	}
+	a, stdout := newTestApp()
+	if err := a.run([]string{"--key-file", keyFile, "--json", "info", out}); err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	var summary eszip.Summary
+	if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil || summary.Encryption != "aes-gcm" {
+		t.Errorf("summary = %+v, %v", summary, err)
+	}
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--key-file", keyFile, "verify", out}); err != nil {
+		t.Errorf("verify failed: %v\n%s", err, stdout)
+	}
+
+	badKey := filepath.Join(dir, "bad.key")
+	if err := os.WriteFile(badKey, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = newTestApp()
+	if err := a.run([]string{"--key-file", badKey, "info", out}); err == nil || !strings.Contains(err.Error(), "holds 5 bytes") {
+		t.Errorf("bad key file error = %v", err)
+	}
+}
+
+func TestHelp(t *testing.T) {
+	a, stdout := newTestApp()
+	if err := a.run([]string{"help"}); err != nil {
+		t.Fatalf("help failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "eszip") {
+		t.Error("expected 'eszip' in help output")
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	t.Run("unknown_command", func(t *testing.T) {
+		a, _ := newTestApp()
+		if err := a.run([]string{"bogus"}); err == nil {
+			t.Fatal("expected error for unknown command")
+		}
+	})
+}
+
+func TestCreateJsonFile(t *testing.T) {
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "test.eszip2")
+
+	jsonFile := filepath.Join(outDir, "config.json")
+	if err := os.WriteFile(jsonFile, []byte(`{"key":"value"}`), 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, jsonFile}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Added:") {
+		t.Error("expected 'Added:' in output")
+	}
+
+	info, err := os.Stat(outputPath)
+	if err != nil {
+		t.Fatalf("output file not found: %v", err)
+	}
+	if info.Size() == 0 {
+		t.Error("output file is empty")
+	}
+}
+
+func TestCreateWasmFile(t *testing.T) {
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "test.eszip2")
+
+	wasmFile := filepath.Join(outDir, "module.wasm")
+	// Minimal wasm magic bytes
+	if err := os.WriteFile(wasmFile, []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}, 0644); err != nil {
+		t.Fatalf("failed to write test file: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, wasmFile}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Added:") {
+		t.Error("expected 'Added:' in output")
+	}
+}
+
+func TestCreateMultipleFiles(t *testing.T) {
+	outDir := t.TempDir()
+	outputPath := filepath.Join(outDir, "test.eszip2")
+
 	jsFile := filepath.Join(outDir, "main.js")
 	jsonFile := filepath.Join(outDir, "data.json")
 	wasmFile := filepath.Join(outDir, "mod.wasm")
@@ -478,23 +1254,2517 @@ func TestCreateThenExtractRoundtrip(t *testing.T) {
 	}
 }
 
-func TestSpecifierToPath(t *testing.T) {
+func TestPathToSpecifierRoundtrip(t *testing.T) {
+	for _, p := range []string{"/tmp/main.ts", "/tmp/my module.ts", "/tmp/\u00e9.ts", "/tmp/100%.ts"} {
+		t.Run(p, func(t *testing.T) {
+			spec := pathToSpecifier(p)
+			if !strings.HasPrefix(spec, "file:///") {
+				t.Fatalf("pathToSpecifier(%q) = %q, want file:/// prefix", p, spec)
+			}
+			if strings.Contains(spec, " ") {
+				t.Errorf("pathToSpecifier(%q) = %q, expected spaces to be encoded", p, spec)
+			}
+			if got := "/" + eszip.HostPrefixedLayout(true).Path(spec); got != p {
+				t.Errorf("roundtrip of %q via %q = %q", p, spec, got)
+			}
+		})
+	}
+}
+
+func TestCreateThenExtractEncodedName(t *testing.T) {
+	outDir := t.TempDir()
+	srcDir := filepath.Join(outDir, "src")
+	if err := os.MkdirAll(srcDir, 0755); err != nil {
+		t.Fatalf("failed to create dir: %v", err)
+	}
+	jsFile := filepath.Join(srcDir, "my module.js")
+	if err := os.WriteFile(jsFile, []byte("export {};\n"), 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	archivePath := filepath.Join(outDir, "out.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "-o", archivePath, jsFile}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "my%20module.js") {
+		t.Errorf("expected encoded specifier in output, got %q", stdout.String())
+	}
+
+	for _, tt := range []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"decode", nil, "my module.js"},
+		{"no_decode", []string{"--no-decode"}, "my%20module.js"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			extractDir := t.TempDir()
+			args := append([]string{"extract", "-o", extractDir}, tt.args...)
+			a, _ := newTestApp()
+			if err := a.run(append(args, archivePath)); err != nil {
+				t.Fatalf("extract failed: %v", err)
+			}
+			found := false
+			for _, f := range listFilesRecursive(t, extractDir) {
+				if filepath.Base(f) == tt.want {
+					found = true
+				}
+			}
+			if !found {
+				t.Errorf("expected extracted file named %q", tt.want)
+			}
+		})
+	}
+}
+
+// symlinkTree builds:
+//
+//	root/a.js
+//	root/sub/b.js
+//	root/link.js -> a.js
+//	root/sublink -> sub
+//	root/sub/loop -> ..
+//	root/broken.js -> missing.js
+//	root/external.js -> <outside>/c.js
+func symlinkTree(t *testing.T) string {
+	t.Helper()
+	base := t.TempDir()
+	root := filepath.Join(base, "root")
+	outside := filepath.Join(base, "outside")
+	for _, dir := range []string{filepath.Join(root, "sub"), outside} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("failed to create dir: %v", err)
+		}
+	}
+	for path, content := range map[string]string{
+		filepath.Join(root, "a.js"):        "a",
+		filepath.Join(root, "sub", "b.js"): "b",
+		filepath.Join(outside, "c.js"):     "c",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write: %v", err)
+		}
+	}
+	for link, target := range map[string]string{
+		filepath.Join(root, "link.js"):     "a.js",
+		filepath.Join(root, "sublink"):     "sub",
+		filepath.Join(root, "sub", "loop"): "..",
+		filepath.Join(root, "broken.js"):   "missing.js",
+		filepath.Join(root, "external.js"): filepath.Join(outside, "c.js"),
+	} {
+		if err := os.Symlink(target, link); err != nil {
+			t.Skipf("symlinks not supported: %v", err)
+		}
+	}
+	return root
+}
+
+func TestCollectInputsSymlinks(t *testing.T) {
+	root := symlinkTree(t)
+
+	rel := func(files []inputFile) []string {
+		var out []string
+		for _, f := range files {
+			r, _ := filepath.Rel(root, f.path)
+			out = append(out, filepath.ToSlash(r))
+		}
+		return out
+	}
+
+	tests := []struct {
+		name   string
+		policy symlinkPolicy
+		want   []string
+	}{
+		{"default", symlinkPolicy{}, []string{"a.js", "sub/b.js"}},
+		{"follow", symlinkPolicy{follow: true}, []string{"a.js", "link.js", "sub/b.js"}},
+		{"follow_external", symlinkPolicy{follow: true, allowExternal: true}, []string{"a.js", "external.js", "link.js", "sub/b.js"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, err := collectInputs([]string{root}, inputOptions{symlinks: tt.policy})
+			if err != nil {
+				t.Fatalf("collectInputs failed: %v", err)
+			}
+			got := rel(inputs.files)
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+			if len(inputs.skipped) == 0 {
+				t.Error("expected skipped inputs to be reported")
+			}
+		})
+	}
+
+	t.Run("broken_and_loop_reasons", func(t *testing.T) {
+		inputs, err := collectInputs([]string{root}, inputOptions{symlinks: symlinkPolicy{follow: true}})
+		if err != nil {
+			t.Fatalf("collectInputs failed: %v", err)
+		}
+		reasons := make(map[string]string)
+		for _, s := range inputs.skipped {
+			r, _ := filepath.Rel(root, s.path)
+			reasons[filepath.ToSlash(r)] = s.reason
+		}
+		for path, want := range map[string]string{
+			"broken.js":   "broken",
+			"external.js": "outside",
+			"sub/loop":    "loop",
+			"sublink":     "loop",
+		} {
+			if !strings.Contains(reasons[path], want) {
+				t.Errorf("skip reason for %s = %q, want it to mention %q", path, reasons[path], want)
+			}
+		}
+	})
+}
+
+func TestCreateSkipsSymlinksWithWarning(t *testing.T) {
+	root := symlinkTree(t)
+	outputPath := filepath.Join(t.TempDir(), "out.eszip2")
+
+	var stdout, stderr bytes.Buffer
+	a := &app{stdout: &stdout, stderr: &stderr, stdin: strings.NewReader("")}
+	if err := a.run([]string{"create", "-o", outputPath, root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if !strings.Contains(stderr.String(), "link.js") || !strings.Contains(stderr.String(), "Warning") {
+		t.Errorf("expected warning listing skipped symlinks, got %q", stderr.String())
+	}
+	if strings.Contains(stdout.String(), "link.js") {
+		t.Error("expected symlinked file not to be added by default")
+	}
+}
+
+func TestCollectInputsExclude(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"main.ts",
+		"main_test.ts",
+		"lib/util.ts",
+		"lib/util_test.ts",
+		"node_modules/dep/index.js",
+		"fixtures/data.json",
+		"lib/fixtures/more.json",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
 	tests := []struct {
-		input string
-		want  string
+		name     string
+		args     []string
+		exclude  []string
+		want     []string
+		excluded int
 	}{
-		{"file:///main.ts", "main.ts"},
-		{"file://localhost/main.ts", "localhost/main.ts"},
-		{"https://example.com/mod.ts", "example.com/mod.ts"},
-		{"http://example.com/mod.ts", "example.com/mod.ts"},
-		{"plain/path.ts", "plain/path.ts"},
+		{"none", []string{root}, nil, []string{"fixtures/data.json", "lib/fixtures/more.json", "lib/util.ts", "lib/util_test.ts", "main.ts", "main_test.ts", "node_modules/dep/index.js"}, 0},
+		{"basename_any_depth", []string{root}, []string{"*_test.ts"}, []string{"fixtures/data.json", "lib/fixtures/more.json", "lib/util.ts", "main.ts", "node_modules/dep/index.js"}, 2},
+		{"directory_only", []string{root}, []string{"node_modules/", "fixtures/"}, []string{"lib/util.ts", "lib/util_test.ts", "main.ts", "main_test.ts"}, 3},
+		{"anchored_path", []string{root}, []string{"lib/*_test.ts", "fixtures/*"}, []string{"lib/fixtures/more.json", "lib/util.ts", "main.ts", "main_test.ts", "node_modules/dep/index.js"}, 2},
+		{"file_args_use_base_name", []string{filepath.Join(root, "main.ts"), filepath.Join(root, "main_test.ts")}, []string{"*_test.ts"}, []string{"main.ts"}, 1},
+		{"multiple_roots", []string{filepath.Join(root, "lib"), filepath.Join(root, "fixtures")}, []string{"fixtures/"}, []string{"lib/util.ts", "lib/util_test.ts", "fixtures/data.json"}, 1},
 	}
 	for _, tt := range tests {
-		t.Run(tt.input, func(t *testing.T) {
-			got := specifierToPath(tt.input)
-			if got != tt.want {
-				t.Errorf("specifierToPath(%q) = %q, want %q", tt.input, got, tt.want)
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, err := collectInputs(tt.args, inputOptions{exclude: tt.exclude})
+			if err != nil {
+				t.Fatalf("collectInputs failed: %v", err)
+			}
+			var got []string
+			for _, f := range inputs.files {
+				r, _ := filepath.Rel(root, f.path)
+				got = append(got, filepath.ToSlash(r))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+			if len(inputs.excluded) != tt.excluded {
+				t.Errorf("excluded = %v, want %d paths", inputs.excluded, tt.excluded)
 			}
 		})
 	}
+
+	t.Run("invalid_pattern", func(t *testing.T) {
+		if _, err := collectInputs([]string{root}, inputOptions{exclude: []string{"[a-"}}); err == nil {
+			t.Error("expected error for malformed pattern")
+		}
+	})
+}
+
+func TestCreateRoot(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"src/main.js", "src/lib/a b.json"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte("{}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	src := filepath.Join(dir, "src")
+	outputPath := filepath.Join(t.TempDir(), "out.eszip2")
+
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"--root", dir}, []string{"file:///src/lib/a%20b.json", "file:///src/main.js"}},
+		{[]string{"--root", src, "--base-url", "https://example.com/app"}, []string{"https://example.com/app/lib/a%20b.json", "https://example.com/app/main.js"}},
+		{[]string{"--root", src, "--base-url", "file:///app/"}, []string{"file:///app/lib/a%20b.json", "file:///app/main.js"}},
+	} {
+		a, _ := newTestApp()
+		if err := a.run(append(append([]string{"create", "-o", outputPath}, tt.args...), src)); err != nil {
+			t.Fatalf("create %v failed: %v", tt.args, err)
+		}
+		archive, err := parseFile(context.Background(), outputPath)
+		if err != nil {
+			t.Fatalf("ParseFile failed: %v", err)
+		}
+		if got := archive.Specifiers(); !slices.Equal(got, tt.want) {
+			t.Errorf("create %v: specifiers = %v, want %v", tt.args, got, tt.want)
+		}
+		if m := archive.GetModule(tt.want[0]); m == nil || m.Kind != eszip.ModuleKindJson {
+			t.Errorf("create %v: %s should be a JSON module", tt.args, tt.want[0])
+		}
+	}
+
+	for _, args := range [][]string{
+		{"--root", filepath.Join(src, "lib"), src},
+		{"--root", dir, "--base-url", "not a url", src},
+	} {
+		a, _ := newTestApp()
+		if err := a.run(append([]string{"create", "-o", outputPath}, args...)); err == nil {
+			t.Errorf("create %v: expected an error", args)
+		}
+	}
+}
+
+func TestAdd(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	id := &eszip.NpmPackageID{Name: "chalk", Version: "5.3.0"}
+	archive := eszip.NewV2()
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte("import 'chalk';"), []byte("{}"))
+	archive.SetNpmSnapshot(&eszip.NpmResolutionSnapshot{
+		Packages:     []*eszip.NpmPackage{{ID: id, Dependencies: map[string]*eszip.NpmPackageID{}}},
+		RootPackages: map[string]*eszip.NpmPackageID{"chalk": id},
+	})
+	archive.SetArchiveMetadata(map[string]string{"build": "42"})
+	archive.SetChecksum(eszip.ChecksumXxh3)
+	archive.SetCompression(eszip.CompressionGzip)
+	if err := archive.SetVersion(eszip.VersionV2_2); err != nil {
+		t.Fatal(err)
+	}
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	archivePath := filepath.Join(dir, "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	worker := filepath.Join(dir, "worker.js")
+	if err := os.WriteFile(worker, []byte("postMessage(1);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before, err := parseFile(ctx, archivePath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"add", "--root", dir, archivePath, worker}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Added: file:///worker.js") {
+		t.Errorf("stdout = %q, want the added module", stdout.String())
+	}
+	after, err := parseFile(ctx, archivePath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	want := before.Summary()
+	want.Modules++
+	want.SourceBytes += int64(len("postMessage(1);"))
+	if got := after.Summary(); got != want {
+		t.Errorf("summary = %+v, want %+v", got, want)
+	}
+	if got, want := after.Specifiers(), []string{"file:///main.js", "file:///worker.js"}; !slices.Equal(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	v2, _ := after.V2()
+	if metadata, err := v2.ArchiveMetadata(ctx); err != nil || metadata["build"] != "42" {
+		t.Errorf("metadata = %v, %v; want build=42", metadata, err)
+	}
+	if sourceMap, _ := after.GetModule("file:///main.js").SourceMap(ctx); string(sourceMap) != "{}" {
+		t.Errorf("main.js source map = %q, want {}", sourceMap)
+	}
+
+	// Adding it again needs --replace.
+	if err := os.WriteFile(worker, []byte("postMessage(2);"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = newTestApp()
+	if err := a.run([]string{"add", "--root", dir, archivePath, worker}); err == nil || !strings.Contains(err.Error(), "--replace") {
+		t.Fatalf("add of an existing specifier = %v, want an error naming --replace", err)
+	}
+	outputPath := filepath.Join(dir, "patched.eszip2")
+	a, _ = newTestApp()
+	if err := a.run([]string{"add", "--replace", "--root", dir, "-o", outputPath, archivePath, worker}); err != nil {
+		t.Fatalf("add --replace failed: %v", err)
+	}
+	patched, err := parseFile(ctx, outputPath)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	if source, _ := patched.GetModule("file:///worker.js").Source(ctx); string(source) != "postMessage(2);" {
+		t.Errorf("replaced source = %q", source)
+	}
+	if source, _ := after.GetModule("file:///worker.js").Source(ctx); string(source) != "postMessage(1);" {
+		t.Errorf("-o changed the original archive: %q", source)
+	}
+
+	v1Path := filepath.Join(dir, "basic.json")
+	v1Data, err := os.ReadFile(testdataPath(t, "basic.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(v1Path, v1Data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, _ = newTestApp()
+	if err := a.run([]string{"add", v1Path, worker}); err == nil {
+		t.Error("add to a V1 archive: expected an error")
+	}
+}
+
+func TestCreateExclude(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{"main.js", "main_test.js"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("x"), 0644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	outputPath := filepath.Join(t.TempDir(), "out.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, "--exclude", "*_test.js", root}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	out := stdout.String()
+	if strings.Contains(out, "main_test.js") {
+		t.Errorf("expected excluded file not to be added, got %q", out)
+	}
+	if !strings.Contains(out, "Excluded: 1 path(s)") {
+		t.Errorf("expected excluded count in summary, got %q", out)
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"*.ts", "main.ts", true},
+		{"lib/*.ts", "lib/util.ts", true},
+		{"lib/*.ts", "lib/sub/util.ts", false},
+		{"**/*.ts", "main.ts", true},
+		{"**/*.ts", "a/b/c.ts", true},
+		{"**/*.test.ts", "a/b/c.ts", false},
+		{"lib/**", "lib/a/b.js", true},
+		{"lib/**", "src/a/b.js", false},
+		{"a/**/b/*.js", "a/b/x.js", true},
+		{"a/**/b/*.js", "a/x/y/b/x.js", true},
+		{"a/**/b/*.js", "a/x/y/c/x.js", false},
+	} {
+		if got := matchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCollectInputsGlobs(t *testing.T) {
+	root := t.TempDir()
+	for _, name := range []string{
+		"main.ts",
+		"main.test.ts",
+		"lib/util.ts",
+		"lib/util.test.ts",
+		"lib/deep/more.ts",
+		"lib/data.json",
+	} {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if err := os.WriteFile(path, []byte("x"), 0644); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+	in := func(name string) string { return filepath.Join(root, filepath.FromSlash(name)) }
+
+	tests := []struct {
+		name             string
+		args             []string
+		include, exclude []string
+		want             []string
+	}{
+		{"include", []string{root}, []string{"**/*.ts"}, []string{"**/*.test.ts"}, []string{"lib/deep/more.ts", "lib/util.ts", "main.ts"}},
+		{"include_anchored", []string{root}, []string{"lib/*.ts"}, nil, []string{"lib/util.test.ts", "lib/util.ts"}},
+		{"exclude_double_star", []string{root}, nil, []string{"lib/**/*.ts"}, []string{"lib/data.json", "main.test.ts", "main.ts"}},
+		{"dots", []string{in("lib") + "/..."}, nil, nil, []string{"lib/data.json", "lib/deep/more.ts", "lib/util.test.ts", "lib/util.ts"}},
+		{"glob_arg", []string{in("*.ts")}, nil, nil, []string{"main.test.ts", "main.ts"}},
+		{"glob_arg_double_star", []string{in("**/*.ts")}, nil, []string{"*.test.ts"}, []string{"lib/deep/more.ts", "lib/util.ts", "main.ts"}},
+		{"glob_arg_matches_directory", []string{in("lib/d*")}, nil, nil, []string{"lib/data.json", "lib/deep/more.ts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inputs, err := collectInputs(tt.args, inputOptions{include: tt.include, exclude: tt.exclude})
+			if err != nil {
+				t.Fatalf("collectInputs failed: %v", err)
+			}
+			var got []string
+			for _, f := range inputs.files {
+				r, _ := filepath.Rel(root, f.path)
+				got = append(got, filepath.ToSlash(r))
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("files = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	for _, args := range [][]string{{in("*.js")}, {in("missing.ts")}, {in("[a-.ts")}} {
+		if _, err := collectInputs(args, inputOptions{}); err == nil {
+			t.Errorf("collectInputs(%v): expected an error", args)
+		}
+	}
+	if _, err := collectInputs([]string{root}, inputOptions{include: []string{"a/[b-"}}); err == nil {
+		t.Error("expected error for malformed include pattern")
+	}
+}
+
+func TestViewUnknownFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garbage.bin")
+	if err := os.WriteFile(path, []byte{0xde, 0xad, 0xbe, 0xef, 0, 1, 2, 3}, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	a, _ := newTestApp()
+	err := a.run([]string{"view", path})
+	if err == nil {
+		t.Fatal("expected error for unknown format")
+	}
+	for _, want := range []string{"is not an eszip archive", "deadbeef00010203"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q in %q", want, err.Error())
+		}
+	}
+}
+
+func TestInfoJSON(t *testing.T) {
+	a, stdout := newTestApp()
+	if err := a.run([]string{"info", "--json", testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("info --json failed: %v", err)
+	}
+	var summary eszip.Summary
+	if err := json.Unmarshal(stdout.Bytes(), &summary); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if summary.Format != "v2" || summary.Modules != 2 || summary.Redirects != 1 {
+		t.Errorf("unexpected summary: %+v", summary)
+	}
+}
+
+func TestViewJSON(t *testing.T) {
+	a, stdout := newTestApp()
+	if err := a.run([]string{"--json", "view", "-l", testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("--json view -l failed: %v", err)
+	}
+	var listings []moduleListing
+	if err := json.Unmarshal(stdout.Bytes(), &listings); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(listings) != 3 {
+		t.Fatalf("got %d listings, want 3: %+v", len(listings), listings)
+	}
+	b, redirect := listings[1], listings[2]
+	if b.Specifier != "file:///b.ts" || b.Kind != "javascript" || b.SourceBytes != 22 || b.SourceOffset == nil || *b.SourceOffset == 0 {
+		t.Errorf("unexpected listing for b.ts: %+v", b)
+	}
+	if redirect.Specifier != "file:///a.ts" || redirect.RedirectTo != "file:///b.ts" || *redirect.SourceOffset != *b.SourceOffset {
+		t.Errorf("unexpected listing for redirect: %+v", redirect)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"view", "--json", "-s", "file:///b.ts", testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("view --json failed: %v", err)
+	}
+	var contents []moduleContent
+	if err := json.Unmarshal(stdout.Bytes(), &contents); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(contents) != 1 || contents[0].Source == nil || *contents[0].Source != "export const b = \"b\";\n" || contents[0].SourceMap != "" {
+		t.Errorf("unexpected contents: %+v", contents)
+	}
+}
+
+func TestStatsFlag(t *testing.T) {
+	archivePath := testdataPath(t, "redirect.eszip2")
+	stat, err := os.Stat(archivePath)
+	if err != nil {
+		t.Fatalf("failed to stat: %v", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	a := &app{stdout: &stdout, stderr: &stderr, stdin: strings.NewReader("")}
+	if err := a.run([]string{"extract", "--stats", "-o", t.TempDir(), archivePath}); err != nil {
+		t.Fatalf("extract --stats failed: %v", err)
+	}
+	want := fmt.Sprintf("Bytes read: %d", stat.Size())
+	if !strings.Contains(stderr.String(), want) {
+		t.Errorf("expected %q in stderr, got %q", want, stderr.String())
+	}
+
+	// info reads only the headers.
+	stderr.Reset()
+	a = &app{stdout: &stdout, stderr: &stderr, stdin: strings.NewReader("")}
+	if err := a.run([]string{"info", "--stats", archivePath}); err != nil {
+		t.Fatalf("info --stats failed: %v", err)
+	}
+	if strings.Contains(stderr.String(), want) || !strings.Contains(stderr.String(), "Sources loaded: 0 ") {
+		t.Errorf("info read more than the headers: %q", stderr.String())
+	}
+}
+
+func TestProgressFlag(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(input, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(dir, "app.eszip2")
+
+	var stdout, stderr bytes.Buffer
+	a := &app{stdout: &stdout, stderr: &stderr, stdin: strings.NewReader("")}
+	if err := a.run([]string{"create", "--progress", "-o", archivePath, input}); err != nil {
+		t.Fatalf("create --progress failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if last := lines[len(lines)-1]; !strings.Contains(last, "writing") || !strings.Contains(last, "100%") {
+		t.Errorf("expected a finished writing bar, got %q", stderr.String())
+	}
+
+	stderr.Reset()
+	if err := a.run([]string{"extract", "--progress", "-o", filepath.Join(dir, "out"), archivePath}); err != nil {
+		t.Fatalf("extract --progress failed: %v", err)
+	}
+	if got := stderr.String(); !strings.Contains(got, "reading") || !strings.Contains(got, "100%") || !strings.HasSuffix(got, "\n") {
+		t.Errorf("expected a finished reading bar, got %q", got)
+	}
+
+	stderr.Reset()
+	a = &app{stdout: &stdout, stderr: &stderr, stdin: strings.NewReader("")}
+	if err := a.run([]string{"info", archivePath}); err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("expected no progress without --progress, got %q", stderr.String())
+	}
+}
+
+func TestStats(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.SetChecksum(eszip.ChecksumSha256)
+	archive.AddModule("https://deno.land/x/a.ts", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("a"), 10), bytes.Repeat([]byte("m"), 20))
+	archive.AddModule("https://deno.land/x/b.ts", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("b"), 100), nil)
+	archive.AddModule("https://esm.sh/c.js", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("c"), 1000), bytes.Repeat([]byte("m"), 3000))
+	archive.AddModule("file:///main.ts", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("d"), 5000), nil)
+	archive.AddModule("file:///empty.js", eszip.ModuleKindJavaScript, nil, nil)
+	archive.AddRedirect("file:///alias.ts", "file:///main.ts")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "stats.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"stats", "--json", "--top", "2", path}); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	var stats archiveStats
+	if err := json.Unmarshal(stdout.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout.String())
+	}
+
+	var total int64
+	sections := make(map[string]int64)
+	for _, s := range stats.Sections {
+		sections[s.Name] = s.Bytes
+		total += s.Bytes
+	}
+	if total != int64(len(data)) || stats.Size != int64(len(data)) {
+		t.Errorf("sections sum to %d, size %d, want %d", total, stats.Size, len(data))
+	}
+	// Length prefix plus content and a SHA-256 hash per non-empty entry.
+	if want := int64(4 + 4*32 + 10 + 100 + 1000 + 5000); sections["sources"] != want {
+		t.Errorf("sources = %d, want %d", sections["sources"], want)
+	}
+	if want := int64(4 + 2*32 + 20 + 3000); sections["source_maps"] != want {
+		t.Errorf("source_maps = %d, want %d", sections["source_maps"], want)
+	}
+
+	counts := make(map[int64]int)
+	for _, b := range stats.Histogram {
+		counts[b.Min] = b.Count
+	}
+	if len(stats.Histogram) != 14 {
+		t.Errorf("histogram has %d buckets, want 14 (0 to 8 KiB)", len(stats.Histogram))
+	}
+	for min, want := range map[int64]int{0: 1, 8: 1, 64: 1, 512: 1, 4096: 1, 16: 0} {
+		if counts[min] != want {
+			t.Errorf("bucket from %d has %d, want %d", min, counts[min], want)
+		}
+	}
+
+	if got := stats.LargestModules; len(got) != 2 || got[0].Specifier != "file:///main.ts" || got[1].Specifier != "https://esm.sh/c.js" {
+		t.Errorf("largest modules = %v", got)
+	}
+	if got := stats.LargestSourceMaps; len(got) != 2 || got[0].Bytes != 3000 || got[1].Bytes != 20 {
+		t.Errorf("largest source maps = %v", got)
+	}
+
+	wantHosts := []hostSize{
+		{Host: "esm.sh", Modules: 1, SourceBytes: 1000, SourceMapBytes: 3000},
+		{Host: "deno.land", Modules: 2, SourceBytes: 110, SourceMapBytes: 20},
+	}
+	if fmt.Sprint(stats.Hosts) != fmt.Sprint(wantHosts) {
+		t.Errorf("hosts = %v, want %v", stats.Hosts, wantHosts)
+	}
+
+	if want := 3020.0 / 6110.0; stats.SourceMapRatio != want {
+		t.Errorf("ratio = %v, want %v", stats.SourceMapRatio, want)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"stats", path}); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	for _, want := range []string{"Sections:", "source_maps", "4 KiB - 8 KiB", "esm.sh", "(0.49)"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestStatsAttribution(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.SetChecksum(eszip.ChecksumSha256)
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("a"), 100), bytes.Repeat([]byte("m"), 50))
+	archive.AddModule("file:///data.json", eszip.ModuleKindJson, bytes.Repeat([]byte("1"), 10), nil)
+	id, err := eszip.ParseNpmPackageID("chalk@5.3.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{"index.js", "package.json"} {
+		if err := archive.AddNpmPackageFile(id, file, bytes.Repeat([]byte("c"), 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "stats.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"stats", "--json", path}); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	var stats archiveStats
+	if err := json.Unmarshal(stdout.Bytes(), &stats); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout.String())
+	}
+
+	wantKinds := []kindSize{
+		{Kind: "javascript", Modules: 1, SourceBytes: 100, SourceMapBytes: 50},
+		{Kind: "opaque_data", Modules: 2, SourceBytes: 40},
+		{Kind: "json", Modules: 1, SourceBytes: 10},
+	}
+	if fmt.Sprint(stats.Kinds) != fmt.Sprint(wantKinds) {
+		t.Errorf("kinds = %v, want %v", stats.Kinds, wantKinds)
+	}
+	if want := []packageSize{{Package: "chalk@5.3.0", Files: 2, Bytes: 40}}; fmt.Sprint(stats.NpmPackages) != fmt.Sprint(want) {
+		t.Errorf("npm packages = %v, want %v", stats.NpmPackages, want)
+	}
+	// The options, modules and npm sections, four sources and a source map.
+	if want := int64(8 * 32); stats.ChecksumBytes != want {
+		t.Errorf("checksum bytes = %d, want %d", stats.ChecksumBytes, want)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"stats", path}); err != nil {
+		t.Fatalf("stats failed: %v", err)
+	}
+	for _, want := range []string{"Module kinds:", "npm packages:", "chalk@5.3.0", "Checksums: 256 bytes"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, stdout.String())
+		}
+	}
+}
+
+func TestCreateMetadata(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(input, []byte("x"), 0644); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	outputPath := filepath.Join(dir, "out.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, "--meta", "build=42", "--meta", "sha=abc=def", input}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"info", outputPath}); err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	for _, want := range []string{"Modules: 1\n", "Metadata:\n  build: 42\n  sha: abc=def\n"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("expected %q in output:\n%s", want, stdout.String())
+		}
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, "--meta", "novalue", input}); err == nil {
+		t.Error("expected error for --meta without '='")
+	}
+}
+
+func TestCreateEntrypoint(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(main, []byte(`import "./a.js";`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a.js", "unused.js"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("export {};"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	outputPath := filepath.Join(dir, "out.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, "--root", dir, "--entrypoint", main, dir}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"info", outputPath}); err != nil {
+		t.Fatalf("info failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Entrypoints: file:///main.js\n") {
+		t.Errorf("expected entrypoints in output:\n%s", stdout)
+	}
+
+	slim := filepath.Join(dir, "slim.eszip2")
+	a, stdout = newTestApp()
+	if err := a.run([]string{"prune", "-v", "-o", slim, outputPath}); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Removed: file:///unused.js\n") {
+		t.Errorf("unexpected prune output: %s", stdout)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"create", "-o", outputPath, "--entrypoint", "file:///missing.js", main}); err == nil {
+		t.Error("expected error for an entrypoint that is not in the archive")
+	}
+}
+
+func TestRepack(t *testing.T) {
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"repack", "--checksum", "xxhash3", "--strip-source-maps", "-o", outputPath, testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("repack failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Repacked: "+outputPath) {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	repacked, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatalf("failed to parse repacked archive: %v", err)
+	}
+	summary := repacked.Summary()
+	if summary.Checksum != "xxhash3" || summary.SourceMapBytes != 0 || summary.Modules != 2 || summary.Redirects != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+
+	// Repacking is idempotent.
+	again := filepath.Join(dir, "again.eszip2")
+	a, _ = newTestApp()
+	if err := a.run([]string{"repack", "--checksum", "xxhash3", "-o", again, outputPath}); err != nil {
+		t.Fatalf("repack failed: %v", err)
+	}
+	first, _ := os.ReadFile(outputPath)
+	second, _ := os.ReadFile(again)
+	if !bytes.Equal(first, second) {
+		t.Error("repacking a repacked archive changed it")
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	original := testdataPath(t, "redirect.eszip2")
+	repacked := filepath.Join(t.TempDir(), "repacked.eszip2")
+	a, _ := newTestApp()
+	if err := a.run([]string{"repack", "--checksum", "xxhash3", "-o", repacked, original}); err != nil {
+		t.Fatalf("repack failed: %v", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"fingerprint", original, repacked}); err != nil {
+		t.Fatalf("fingerprint failed: %v", err)
+	}
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "  "+original) || !strings.HasSuffix(lines[1], "  "+repacked) {
+		t.Fatalf("unexpected output %q", stdout.String())
+	}
+	if sum := strings.Fields(lines[0])[0]; len(sum) != 64 || sum != strings.Fields(lines[1])[0] {
+		t.Errorf("repacking changed the fingerprint: %q", stdout.String())
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "fingerprint", original}); err != nil {
+		t.Fatalf("--json fingerprint failed: %v", err)
+	}
+	var results []archiveFingerprint
+	if err := json.Unmarshal(stdout.Bytes(), &results); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(results) != 1 || results[0].Archive != original || !strings.HasPrefix(lines[0], results[0].Fingerprint) {
+		t.Errorf("unexpected results %+v", results)
+	}
+}
+
+func TestInfoOrigins(t *testing.T) {
+	dir := t.TempDir()
+	archive := eszip.NewV2()
+	archive.AddModule("https://deno.land/std/mod.ts", eszip.ModuleKindJavaScript, []byte("export {}"), nil)
+	archive.AddModule("https://deno.land/std/data.json", eszip.ModuleKindJson, []byte("{}"), nil)
+	archive.AddModule("file:///main.ts", eszip.ModuleKindJavaScript, []byte("main"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	path := filepath.Join(dir, "remote.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"info", "--origins", "--json", path}); err != nil {
+		t.Fatalf("info --origins failed: %v", err)
+	}
+	var origins []originInfo
+	if err := json.Unmarshal(stdout.Bytes(), &origins); err != nil {
+		t.Fatalf("invalid JSON %q: %v", stdout.String(), err)
+	}
+	want := []originInfo{{Host: "deno.land", Modules: 2, Bytes: 11, Kinds: []string{"javascript", "json"}}}
+	if !reflect.DeepEqual(origins, want) {
+		t.Errorf("origins = %+v, want %+v", origins, want)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"info", "--origins", testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("info --origins failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "No remote origins") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+}
+
+func TestCreateAllowedOrigins(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(input, []byte("main"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Local inputs pass even an empty allowlist.
+	a, _ := newTestApp()
+	if err := a.run([]string{"create", "--allowed-origins", "", "-o", filepath.Join(dir, "out.eszip2"), input}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+}
+
+func TestTransform(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "out.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"transform", "--banner", "/* banner */", "-o", outputPath, testdataPath(t, "redirect.eszip2")}); err != nil {
+		t.Fatalf("transform failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Transformed: "+outputPath+" (2 module(s) changed") {
+		t.Errorf("unexpected output %q", stdout.String())
+	}
+
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	source, err := archive.GetModule("file:///main.ts").Source(context.Background())
+	if err != nil || !strings.HasPrefix(string(source), "/* banner */\n") {
+		t.Errorf("source = %q, %v", source, err)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"transform", "--banner", "x", "-o", outputPath, testdataPath(t, "basic.json")}); err == nil {
+		t.Error("expected error for V1 archive")
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for value, want := range map[string]int64{
+		"4096":   4096,
+		"128MB":  128_000_000,
+		"128mb":  128_000_000,
+		"64MiB":  64 << 20,
+		"1.5GiB": 3 << 29,
+		"10 KB":  10_000,
+		"2kib":   2048,
+	} {
+		if got, err := parseSize(value); err != nil || got != want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"", "MB", "12XB", "-1MB", "0", "1.2.3MB"} {
+		if _, err := parseSize(value); err == nil {
+			t.Errorf("parseSize(%q) succeeded, want error", value)
+		}
+	}
+}
+
+func TestCreateMaxSize(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "big.js")
+	if err := os.WriteFile(input, bytes.Repeat([]byte("x"), 4096), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "out.eszip2")
+
+	a, _ := newTestApp()
+	err := a.run([]string{"create", "--max-size", "4KiB", "-o", outputPath, input})
+	var werr *eszip.WriteError
+	if !errors.As(err, &werr) || werr.Limit != 4096 {
+		t.Fatalf("create error = %v, want *WriteError with limit 4096", err)
+	}
+	if _, err := os.Stat(outputPath); !os.IsNotExist(err) {
+		t.Error("create wrote an archive over the limit")
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"create", "--max-size", "8KiB", "-o", outputPath, input}); err != nil {
+		t.Fatalf("create under the limit failed: %v", err)
+	}
+}
+
+// assertImportsResolve checks that every relative import in the JavaScript
+// files under dir names a file that exists.
+func assertImportsResolve(t *testing.T, dir string) {
+	t.Helper()
+	for _, path := range listFilesRecursive(t, dir) {
+		if ext := filepath.Ext(path); ext != ".ts" && ext != ".js" {
+			continue
+		}
+		source, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, ref := range eszip.ScanImports(source) {
+			if !strings.HasPrefix(ref.Specifier, ".") {
+				continue
+			}
+			rel, err := url.PathUnescape(ref.Specifier)
+			if err != nil {
+				t.Errorf("%s: bad import %q: %v", path, ref.Specifier, err)
+				continue
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(path), rel)); err != nil {
+				t.Errorf("%s: import %q does not resolve: %v", path, ref.Specifier, err)
+			}
+		}
+	}
+}
+
+func TestNpmPackageRoundTrip(t *testing.T) {
+	pkg := t.TempDir()
+	for name, content := range map[string]string{
+		"package.json":   `{"name":"@scope/pkg"}`,
+		"dist/index.js":  `export default 1;`,
+		"dist/empty.cjs": ``,
+	} {
+		path := filepath.Join(pkg, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.js")
+	if err := os.WriteFile(main, []byte(`import pkg from "npm:@scope/pkg";`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(dir, "app.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "-o", archivePath, "--npm-package", "@scope/pkg@1.2.3=" + pkg, main}); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "npm package @scope/pkg@1.2.3 (3 files)") {
+		t.Errorf("create output:\n%s", stdout)
+	}
+
+	check := func(root string) {
+		t.Helper()
+		for name, want := range map[string]string{
+			"package.json":   `{"name":"@scope/pkg"}`,
+			"dist/index.js":  `export default 1;`,
+			"dist/empty.cjs": ``,
+		} {
+			got, err := os.ReadFile(filepath.Join(root, "@scope", "pkg@1.2.3", filepath.FromSlash(name)))
+			if err != nil || string(got) != want {
+				t.Errorf("%s = %q, %v, want %q", name, got, err, want)
+			}
+		}
+	}
+	out := t.TempDir()
+	a, _ = newTestApp()
+	if err := a.run([]string{"extract", "-o", out, archivePath}); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	check(filepath.Join(out, "npm"))
+	npmDir := t.TempDir()
+	a, _ = newTestApp()
+	if err := a.run([]string{"extract", "-o", t.TempDir(), "--npm-dir", npmDir, archivePath}); err != nil {
+		t.Fatalf("extract --npm-dir failed: %v", err)
+	}
+	check(npmDir)
+
+	for _, arg := range []string{"pkg", "pkg@1.0.0", "pkg=" + pkg, "pkg@1.0.0=" + filepath.Join(dir, "missing")} {
+		a, _ := newTestApp()
+		if err := a.run([]string{"create", "-o", archivePath, "--npm-package", arg, main}); err == nil {
+			t.Errorf("create --npm-package %s: expected an error", arg)
+		}
+	}
+}
+
+func TestExtractLinkSourceMaps(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///src/main.js", eszip.ModuleKindJavaScript, []byte("main();\n//# sourceMappingURL=data:,old\n"), []byte(`{"version":3}`))
+	archive.AddModule("file:///src/plain.js", eszip.ModuleKindJavaScript, []byte("plain();"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	archivePath := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	a, _ := newTestApp()
+	if err := a.run([]string{"extract", "--link-source-maps", "-o", dir, archivePath}); err != nil {
+		t.Fatalf("extract failed: %v", err)
+	}
+	main, err := os.ReadFile(filepath.Join(dir, "src", "main.js"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "main();\n//# sourceMappingURL=main.js.map\n"; string(main) != want {
+		t.Errorf("main.js = %q, want %q", main, want)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "src", "main.js.map")); err != nil {
+		t.Errorf("source map not extracted: %v", err)
+	}
+	if plain, _ := os.ReadFile(filepath.Join(dir, "src", "plain.js")); string(plain) != "plain();" {
+		t.Errorf("plain.js = %q, want it unchanged", plain)
+	}
+}
+
+func TestExtractRewriteImports(t *testing.T) {
+	t.Run("redirect_fixture", func(t *testing.T) {
+		dir := t.TempDir()
+		a, _ := newTestApp()
+		if err := a.run([]string{"extract", "--rewrite-imports", "-o", dir, testdataPath(t, "redirect.eszip2")}); err != nil {
+			t.Fatalf("extract failed: %v", err)
+		}
+		assertImportsResolve(t, dir)
+	})
+
+	t.Run("multi_module", func(t *testing.T) {
+		archive := eszip.NewV2()
+		archive.AddImportMap(eszip.ModuleKindJsonc, "file:///import_map.json", []byte(`{"imports":{"lib/":"file:///src/lib/","ext":"https://esm.sh/ext"}}`))
+		main := `import { join } from "https://deno.land/std/path/mod.ts";
+import util from "lib/my util.ts";
+import ext from "ext";
+const lazy = await import("https://deno.land/std/path/posix.ts");
+`
+		archive.AddModule("file:///src/main.ts", eszip.ModuleKindJavaScript, []byte(main), []byte("{}"))
+		archive.AddModule("file:///src/lib/my%20util.ts", eszip.ModuleKindJavaScript, []byte("export default 1;"), nil)
+		archive.AddModule("https://deno.land/std/path/mod.ts", eszip.ModuleKindJavaScript, []byte(`export * from "./posix.ts";
+import "https://esm.sh/preact";`), nil)
+		archive.AddModule("https://deno.land/std/path/posix.ts", eszip.ModuleKindJavaScript, []byte("export const sep = '/';"), nil)
+		data, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		archivePath := filepath.Join(t.TempDir(), "app.eszip2")
+		if err := os.WriteFile(archivePath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		dir := t.TempDir()
+		a, stdout := newTestApp()
+		if err := a.run([]string{"extract", "--rewrite-imports", "-o", dir, archivePath}); err != nil {
+			t.Fatalf("extract failed: %v", err)
+		}
+		assertImportsResolve(t, dir)
+
+		mainPath := filepath.Join(dir, "src", "main.ts")
+		rewritten, err := os.ReadFile(mainPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{`"../deno.land/std/path/mod.ts"`, `"./lib/my%20util.ts"`, `from "ext"`, `import("https://deno.land/std/path/posix.ts")`} {
+			if !strings.Contains(string(rewritten), want) {
+				t.Errorf("main.ts does not contain %s:\n%s", want, rewritten)
+			}
+		}
+		if _, err := os.Stat(mainPath + ".map"); !os.IsNotExist(err) {
+			t.Error("stale source map of a rewritten module was extracted")
+		}
+
+		var importMap struct {
+			Imports map[string]string `json:"imports"`
+		}
+		importMapData, err := os.ReadFile(filepath.Join(dir, "import_map.json"))
+		if err != nil {
+			t.Fatalf("import map not written: %v", err)
+		}
+		if err := json.Unmarshal(importMapData, &importMap); err != nil {
+			t.Fatalf("invalid import map: %v", err)
+		}
+		wantMap := map[string]string{
+			"ext":                                 "https://esm.sh/ext",
+			"https://deno.land/std/path/posix.ts": "./deno.land/std/path/posix.ts",
+		}
+		if !reflect.DeepEqual(importMap.Imports, wantMap) {
+			t.Errorf("import map = %v, want %v", importMap.Imports, wantMap)
+		}
+
+		// Offsets in the summary point at the original specifiers.
+		wantSummary := fmt.Sprintf("%s: %d, %d", mainPath, strings.Index(main, "https://deno.land/std/path/mod.ts"), strings.Index(main, "lib/my util.ts"))
+		for _, want := range []string{"Rewrote 3 import(s) in 2 module(s)", wantSummary, "Skipped 1 stale source map(s)"} {
+			if !strings.Contains(stdout.String(), want) {
+				t.Errorf("summary does not contain %q:\n%s", want, stdout.String())
+			}
+		}
+	})
+}
+
+func TestCreateRemote(t *testing.T) {
+	serve := func(contentType, body string) http.HandlerFunc {
+		return func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			fmt.Fprint(w, body)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/react", serve("application/javascript; charset=utf-8", "export default 1;"))
+	mux.Handle("/data", serve("application/json", `{"a":1}`))
+	mux.Handle("/mod.wasm", serve("application/wasm", "\x00asm"))
+	mux.Handle("/types", serve("application/typescript", "export type T = 1;"))
+	mux.Handle("/broken.wasm", serve("text/html; charset=utf-8", "<h1>Not here</h1>"))
+	mux.Handle("/gone.js", http.NotFoundHandler())
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir := t.TempDir()
+	outputPath := filepath.Join(dir, "out.eszip2")
+	want := map[string]eszip.ModuleKind{
+		server.URL + "/react":    eszip.ModuleKindJavaScript,
+		server.URL + "/data":     eszip.ModuleKindJson,
+		server.URL + "/mod.wasm": eszip.ModuleKindWasm,
+		server.URL + "/types":    eszip.ModuleKindJavaScript,
+	}
+	args := []string{"create", "-o", outputPath}
+	for specifier := range want {
+		args = append(args, specifier)
+	}
+	a, _ := newTestApp()
+	if err := a.run(args); err != nil {
+		t.Fatalf("create failed: %v", err)
+	}
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for specifier, kind := range want {
+		if m := archive.GetModule(specifier); m == nil || m.Kind != kind {
+			t.Errorf("%s: got %v, want kind %v", specifier, m, kind)
+		}
+	}
+
+	t.Run("mismatch", func(t *testing.T) {
+		a, _ := newTestApp()
+		if err := a.run([]string{"create", "-o", outputPath, server.URL + "/broken.wasm"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		if stderr := a.stderr.(*bytes.Buffer).String(); !strings.Contains(stderr, "text/html") {
+			t.Errorf("no warning about the mismatch; stderr:\n%s", stderr)
+		}
+
+		a, _ = newTestApp()
+		err := a.run([]string{"create", "--strict-media-types", "-o", outputPath, server.URL + "/broken.wasm"})
+		if err == nil || !strings.Contains(err.Error(), "text/html") {
+			t.Errorf("strict create error = %v, want a media type mismatch", err)
+		}
+	})
+
+	t.Run("record_media_types", func(t *testing.T) {
+		a, _ := newTestApp()
+		if err := a.run([]string{"create", "--record-media-types", "-o", outputPath, server.URL + "/react", server.URL + "/data"}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		archive, err := parseFile(context.Background(), outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for specifier, want := range map[string]string{
+			server.URL + "/react": "application/javascript; charset=utf-8",
+			server.URL + "/data":  "application/json",
+		} {
+			if m := archive.GetModule(specifier); m == nil || m.Headers()["content-type"] != want {
+				t.Errorf("%s: got %v, want content-type %q", specifier, m, want)
+			}
+		}
+
+		a, _ = newTestApp()
+		err = a.run([]string{"create", "--record-media-types", "--format", "v2.3", "-o", outputPath, server.URL + "/react"})
+		if err == nil || !strings.Contains(err.Error(), "v2.4") {
+			t.Errorf("create error = %v, want one about the format", err)
+		}
+	})
+
+	t.Run("not_found", func(t *testing.T) {
+		a, _ := newTestApp()
+		if err := a.run([]string{"create", "-o", outputPath, server.URL + "/gone.js"}); err == nil || !strings.Contains(err.Error(), "404") {
+			t.Errorf("create error = %v, want a 404", err)
+		}
+	})
+}
+
+func TestRecover(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.SetChecksum(eszip.ChecksumSha256)
+	archive.AddModule("file:///kept.js", eszip.ModuleKindJavaScript, []byte("export const kept = 1;"), nil)
+	archive.AddModule("file:///lost.js", eszip.ModuleKindJavaScript, bytes.Repeat([]byte("x"), 200), nil)
+	archive.AddRedirect("file:///alias.js", "file:///lost.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	broken := filepath.Join(dir, "broken.eszip2")
+	if err := os.WriteFile(broken, data[:bytes.Index(data, []byte("xxxx"))+100], 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A truncated archive cannot be parsed normally.
+	if _, err := parseFile(context.Background(), broken); err == nil {
+		t.Fatal("truncated fixture parsed without recovery")
+	}
+
+	fixed := filepath.Join(dir, "fixed.eszip2")
+	a, stdout := newTestApp()
+	if err := a.run([]string{"recover", "-o", fixed, broken}); err != nil {
+		t.Fatalf("recover failed: %v", err)
+	}
+	for _, want := range []string{"Salvaged: 1 module(s), 22 bytes", "Lost: 1 module(s), 200 bytes", "file:///lost.js (200 bytes)"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, stdout)
+		}
+	}
+
+	recovered, err := parseFile(context.Background(), fixed)
+	if err != nil {
+		t.Fatalf("recovered archive does not parse: %v", err)
+	}
+	if got := recovered.Specifiers(); !reflect.DeepEqual(got, []string{"file:///kept.js"}) {
+		t.Errorf("recovered specifiers = %v", got)
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+// byteCounts matches sizes that vary with the temporary directory's path,
+// which is part of every file: specifier.
+var byteCounts = regexp.MustCompile(`\d+ bytes`)
+
+// TestRunPipelines runs whole command sequences through Run and compares
+// each step's stdout, stderr and exit code with a golden file. "$TMP" in
+// arguments is the test's temporary directory, which holds a src directory
+// of sample modules.
+func TestRunPipelines(t *testing.T) {
+	type step struct {
+		args []string
+		// stdin names a file under $TMP to feed to the command.
+		stdin string
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"create_info_extract", []step{
+			{args: []string{"create", "-o", "$TMP/app.eszip2", "$TMP/src"}},
+			{args: []string{"info", "$TMP/app.eszip2"}},
+			{args: []string{"extract", "-o", "$TMP/out", "$TMP/app.eszip2"}},
+			{args: []string{"verify", "$TMP/app.eszip2"}},
+			{args: []string{"view", "-l", "$TMP/app.eszip2"}},
+		}},
+		{"stdin", []step{
+			{args: []string{"create", "--checksum", "xxhash3", "-o", "$TMP/app.eszip2", "$TMP/src/main.js"}},
+			{args: []string{"extract", "-o", "$TMP/piped"}, stdin: "app.eszip2"},
+			{args: []string{"view", "-s", "file://$TMP/src/main.js", "$TMP/app.eszip2"}},
+		}},
+		{"errors", []step{
+			{args: []string{"info", "$TMP/missing.eszip2"}},
+			{args: []string{"view", "$TMP/src/main.js"}},
+			{args: []string{"bogus"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			files := map[string]string{
+				"src/main.js":   "import { x } from \"./util.js\";\nconsole.log(x);\n",
+				"src/util.js":   "export const x = 1;\n",
+				"src/data.json": "{\"a\":1}\n",
+			}
+			for name, content := range files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			normalize := func(s string) string {
+				return byteCounts.ReplaceAllString(strings.ReplaceAll(s, dir, "$TMP"), "N bytes")
+			}
+
+			var got bytes.Buffer
+			for _, s := range tt.steps {
+				args := make([]string, len(s.args))
+				for i, arg := range s.args {
+					args[i] = strings.ReplaceAll(arg, "$TMP", dir)
+				}
+				stdin := io.Reader(strings.NewReader(""))
+				if s.stdin != "" {
+					data, err := os.ReadFile(filepath.Join(dir, s.stdin))
+					if err != nil {
+						t.Fatal(err)
+					}
+					stdin = bytes.NewReader(data)
+				}
+				var stdout, stderr bytes.Buffer
+				code := RunContext(context.Background(), args, stdin, &stdout, &stderr)
+				fmt.Fprintf(&got, "$ eszip %s\n", strings.Join(s.args, " "))
+				fmt.Fprintf(&got, "--- stdout\n%s", normalize(stdout.String()))
+				fmt.Fprintf(&got, "--- stderr\n%s", normalize(stderr.String()))
+				fmt.Fprintf(&got, "--- exit %d\n\n", code)
+			}
+
+			golden := filepath.Join("testdata", "golden", tt.name+".txt")
+			if *updateGolden {
+				if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(golden, got.Bytes(), 0644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file: %v", err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("output mismatch\ngot:\n%s\nwant:\n%s", got.Bytes(), want)
+			}
+		})
+	}
+}
+
+func TestRunContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var stdout, stderr bytes.Buffer
+	if code := RunContext(ctx, []string{"info", testdataPath(t, "redirect.eszip2")}, strings.NewReader(""), &stdout, &stderr); code != 1 {
+		t.Errorf("exit code = %d, want 1", code)
+	}
+	if !strings.Contains(stderr.String(), context.Canceled.Error()) {
+		t.Errorf("stderr = %q, want the cancellation", stderr.String())
+	}
+
+	if code := Run([]string{"--help"}, strings.NewReader(""), &stdout, &stderr); code != 0 {
+		t.Errorf("--help exit code = %d, want 0", code)
+	}
+}
+
+// cancelWriter cancels a context once something containing trigger is
+// written to it.
+type cancelWriter struct {
+	bytes.Buffer
+	trigger string
+	cancel  context.CancelFunc
+}
+
+func (w *cancelWriter) Write(p []byte) (int, error) {
+	if bytes.Contains(p, []byte(w.trigger)) {
+		w.cancel()
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestCancellationRemovesOutputs(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///a.js", eszip.ModuleKindJavaScript, []byte("a"), []byte("{}"))
+	archive.AddModule("file:///b.js", eszip.ModuleKindJavaScript, []byte("b"), nil)
+	archive.AddModule("file:///c.js", eszip.ModuleKindJavaScript, []byte("c"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	dir := t.TempDir()
+	archivePath := filepath.Join(dir, "app.eszip2")
+	if err := os.WriteFile(archivePath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("extract", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stdout := &cancelWriter{trigger: "Extracted:", cancel: cancel}
+		var stderr bytes.Buffer
+		outDir := filepath.Join(dir, "out")
+		if code := RunContext(ctx, []string{"extract", "-o", outDir, archivePath}, strings.NewReader(""), stdout, &stderr); code != 1 {
+			t.Fatalf("exit code = %d, want 1", code)
+		}
+		if !strings.Contains(stderr.String(), "Removed 2 partially extracted file(s)") {
+			t.Errorf("stderr = %q, want the removed files", stderr.String())
+		}
+		if files := listFilesRecursive(t, outDir); len(files) != 0 {
+			t.Errorf("files left behind: %v", files)
+		}
+	})
+
+	t.Run("extract_existing", func(t *testing.T) {
+		// A file the extraction overwrote was not created by it, so it is
+		// not removed.
+		outDir := filepath.Join(dir, "existing")
+		if err := os.MkdirAll(outDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		existing := filepath.Join(outDir, "a.js")
+		if err := os.WriteFile(existing, []byte("mine"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stdout := &cancelWriter{trigger: "Extracted:", cancel: cancel}
+		var stderr bytes.Buffer
+		if code := RunContext(ctx, []string{"extract", "-o", outDir, archivePath}, strings.NewReader(""), stdout, &stderr); code != 1 {
+			t.Fatalf("exit code = %d, want 1", code)
+		}
+		if !strings.Contains(stderr.String(), "Removed 1 partially extracted file(s)") {
+			t.Errorf("stderr = %q, want the removed source map", stderr.String())
+		}
+		if files := listFilesRecursive(t, outDir); !slices.Equal(files, []string{existing}) {
+			t.Errorf("files = %v, want only %s", files, existing)
+		}
+	})
+
+	t.Run("writeOutput", func(t *testing.T) {
+		outputPath := filepath.Join(dir, "out.eszip2")
+		if err := os.WriteFile(outputPath, []byte("previous"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if err := writeOutput(ctx, outputPath, data); !errors.Is(err, context.Canceled) {
+			t.Fatalf("writeOutput = %v, want context.Canceled", err)
+		}
+		if got, _ := os.ReadFile(outputPath); string(got) != "previous" {
+			t.Errorf("cancelled write replaced the output with %q", got)
+		}
+
+		if err := writeOutput(context.Background(), outputPath, data); err != nil {
+			t.Fatalf("writeOutput failed: %v", err)
+		}
+		if got, _ := os.ReadFile(outputPath); !bytes.Equal(got, data) {
+			t.Errorf("output holds %d bytes, want %d", len(got), len(data))
+		}
+		matches, _ := filepath.Glob(filepath.Join(dir, ".*.tmp"))
+		if len(matches) != 0 {
+			t.Errorf("temporary files left behind: %v", matches)
+		}
+	})
+}
+
+func TestCreateMinifier(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the fake minifier")
+	}
+	dir := t.TempDir()
+	// The fake minifier records its input and prints fixed JavaScript.
+	script := filepath.Join(dir, "minify.sh")
+	body := "#!/bin/sh\ncat >> " + filepath.Join(dir, "input") + "\nprintf 'export const x=1;'\n"
+	if err := os.WriteFile(script, []byte(body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	js := filepath.Join(dir, "main.js")
+	data := filepath.Join(dir, "data.json")
+	if err := os.WriteFile(js, []byte("export const x = 1; // the answer\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(data, []byte(`{ "x": 1 }`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "app.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"create", "--minifier", "sh " + script, "-o", out, js, data}); err != nil {
+		t.Fatalf("create --minifier failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Minified: 1 module(s), 34 -> 17 bytes") {
+		t.Errorf("output does not report the minified sizes:\n%s", stdout)
+	}
+	archive, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	if source, _ := archive.GetModule(pathToSpecifier(js)).Source(ctx); string(source) != "export const x=1;" {
+		t.Errorf("minified source = %q", source)
+	}
+	if source, _ := archive.GetModule(pathToSpecifier(data)).Source(ctx); string(source) != `{ "x": 1 }` {
+		t.Errorf("JSON source = %q, want it unchanged", source)
+	}
+	if input, err := os.ReadFile(filepath.Join(dir, "input")); err != nil || string(input) != "export const x = 1; // the answer\n" {
+		t.Errorf("minifier input = %q, %v", input, err)
+	}
+}
+
+func TestBundle(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"main.js": `import { a } from "./lib/a.js";
+export * from './b.js';
+import data from "./data.json" with { type: "json" };
+import React from "react";
+import { serve } from "https://deno.land/std/http/server.ts";
+const lazy = await import("./lazy.js");
+// import "./commented.js";
+`,
+		"lib/a.js":     `import { shared } from "../shared.js"; export const a = shared;`,
+		"b.js":         `export const b = 2;`,
+		"shared.js":    `import { a } from "./lib/a.js"; export const shared = 1;`,
+		"lazy.js":      `export default "lazy";`,
+		"data.json":    `{"x":1}`,
+		"unreached.js": `export {};`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	outputPath := filepath.Join(dir, "app.eszip2")
+	a, stdout := newTestApp()
+	if err := a.run([]string{"bundle", "--no-remote", "-o", outputPath, filepath.Join(dir, "main.js")}); err != nil {
+		t.Fatalf("bundle failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "6 modules") {
+		t.Errorf("output:\n%s", stdout)
+	}
+	stderr := a.stderr.(*bytes.Buffer).String()
+	for _, want := range []string{"react", "https://deno.land/std/http/server.ts"} {
+		if !strings.Contains(stderr, want) {
+			t.Errorf("skipped imports do not list %s:\n%s", want, stderr)
+		}
+	}
+
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, name := range []string{"main.js", "lib/a.js", "b.js", "data.json", "lazy.js", "shared.js"} {
+		want = append(want, pathToSpecifier(filepath.Join(dir, filepath.FromSlash(name))))
+	}
+	if got := archive.Specifiers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	if m := archive.GetModule(want[3]); m == nil || m.Kind != eszip.ModuleKindJson {
+		t.Errorf("data.json module = %v", m)
+	}
+	if got, err := archive.Entrypoints(context.Background()); err != nil || !slices.Equal(got, want[:1]) {
+		t.Errorf("Entrypoints = %v, %v; want %v", got, err, want[:1])
+	}
+
+	t.Run("missing_import", func(t *testing.T) {
+		broken := filepath.Join(dir, "broken.js")
+		if err := os.WriteFile(broken, []byte(`import "./nope.js";`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := newTestApp()
+		err := a.run([]string{"bundle", "-o", outputPath, broken})
+		if err == nil || !strings.Contains(err.Error(), "./nope.js") {
+			t.Errorf("bundle error = %v, want one naming ./nope.js", err)
+		}
+	})
+}
+
+func TestBundleImportMap(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"import_map.json": `{
+  // Comments are allowed, as in deno.json.
+  "imports": { "lib": "./vendor/lib.js", "utils/": "./src/utils/" },
+  "scopes": { "./vendor/": { "dep": "./vendor/dep.js" } }
+}`,
+		"main.js":          `import "lib"; import { x } from "utils/x.js"; import "react";`,
+		"vendor/lib.js":    `import "dep";`,
+		"vendor/dep.js":    `export {};`,
+		"src/utils/x.js":   `export const x = 1;`,
+		"src/utils/y.js":   `export const y = 1;`,
+		"src/unreached.js": `import "dep";`,
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	importMap := filepath.Join(dir, "import_map.json")
+	outputPath := filepath.Join(t.TempDir(), "app.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"bundle", "--import-map", importMap, "-o", outputPath, filepath.Join(dir, "main.js")}); err != nil {
+		t.Fatalf("bundle failed: %v", err)
+	}
+	if stderr := a.stderr.(*bytes.Buffer).String(); !strings.Contains(stderr, "Skipped 1 import(s)") || !strings.Contains(stderr, "react") {
+		t.Errorf("expected only react to be skipped:\n%s", stderr)
+	}
+
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	for _, name := range []string{"import_map.json", "main.js", "vendor/lib.js", "src/utils/x.js", "vendor/dep.js"} {
+		want = append(want, pathToSpecifier(filepath.Join(dir, filepath.FromSlash(name))))
+	}
+	if got := archive.Specifiers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	if got := archive.Summary().ImportMap; got != want[0] {
+		t.Errorf("import map = %q, want %q", got, want[0])
+	}
+	// The embedded map resolves the archive's own imports.
+	graph, err := eszip.BuildModuleGraph(context.Background(), archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unresolved := graph.Unresolved(); len(unresolved) != 1 || unresolved[0].Specifier != "react" {
+		t.Errorf("unresolved = %v, want only react", unresolved)
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		broken := filepath.Join(t.TempDir(), "broken.json")
+		if err := os.WriteFile(broken, []byte(`{"imports": []}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		a, _ := newTestApp()
+		if err := a.run([]string{"bundle", "--import-map", broken, "-o", outputPath, filepath.Join(dir, "main.js")}); err == nil {
+			t.Error("expected an error for an invalid import map")
+		}
+	})
+
+	t.Run("create", func(t *testing.T) {
+		a, stdout := newTestApp()
+		if err := a.run([]string{"create", "--root", dir, "--import-map", importMap, "-o", outputPath, dir}); err != nil {
+			t.Fatalf("create failed: %v", err)
+		}
+		if strings.Contains(stdout.String(), "Added: file:///import_map.json") {
+			t.Errorf("import map added as a module too:\n%s", stdout)
+		}
+		archive, err := parseFile(context.Background(), outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := archive.Specifiers(); len(got) != len(files) || got[0] != "file:///import_map.json" {
+			t.Errorf("specifiers = %v", got)
+		}
+		if got := archive.Summary().ImportMap; got != "file:///import_map.json" {
+			t.Errorf("import map = %q", got)
+		}
+	})
+}
+
+func TestBundleCache(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("no sh to run the fake transpiler")
+	}
+	dir := t.TempDir()
+	// The fake transpiler records its argument and passes the source
+	// through.
+	calls := filepath.Join(dir, "calls")
+	script := filepath.Join(dir, "transpile.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat\necho \"$1\" >> "+calls+"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	main := filepath.Join(dir, "main.ts")
+	lib := filepath.Join(dir, "lib.ts")
+	if err := os.WriteFile(main, []byte(`import { x } from "./lib.ts"; console.log(x);`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib, []byte(`export const x: number = 1;`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cacheDir := filepath.Join(dir, "cache")
+	out := filepath.Join(dir, "app.eszip2")
+
+	bundle := func(t *testing.T, wantCache string) {
+		t.Helper()
+		a, stdout := newTestApp()
+		if err := a.run([]string{"bundle", "--transpiler", "sh " + script + " {}", "--cache-dir", cacheDir, "-o", out, main}); err != nil {
+			t.Fatalf("bundle failed: %v", err)
+		}
+		if !strings.Contains(stdout.String(), wantCache) {
+			t.Errorf("output does not report %q:\n%s", wantCache, stdout)
+		}
+	}
+	transpiled := func(t *testing.T) int {
+		t.Helper()
+		data, err := os.ReadFile(calls)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Count(string(data), "\n")
+	}
+
+	bundle(t, "Cache: 0 reused, 4 rebuilt")
+	if n := transpiled(t); n != 2 {
+		t.Fatalf("first bundle transpiled %d modules, want 2", n)
+	}
+	bundle(t, "Cache: 4 reused, 0 rebuilt")
+	if n := transpiled(t); n != 2 {
+		t.Errorf("unchanged bundle transpiled %d more modules", n-2)
+	}
+
+	if err := os.WriteFile(lib, []byte(`export const x: number = 42;`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bundle(t, "Cache: 2 reused, 2 rebuilt")
+	if n := transpiled(t); n != 3 {
+		t.Errorf("bundle after editing lib.ts transpiled %d modules, want 1", n-2)
+	}
+	archive, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source, _ := archive.GetModule(pathToSpecifier(lib)).Source(context.Background()); string(source) != `export const x: number = 42;` {
+		t.Errorf("lib.ts source = %q, want the edited source", source)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that a command running in another
+// goroutine can write to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// waitForOutput waits until b holds n occurrences of s.
+func waitForOutput(t *testing.T, b *syncBuffer, s string, n int) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for strings.Count(b.String(), s) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d of %q in:\n%s", n, s, b.String())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBundleWatch(t *testing.T) {
+	dir := t.TempDir()
+	main := filepath.Join(dir, "main.js")
+	lib := filepath.Join(dir, "lib.js")
+	write := func(path, content string) {
+		t.Helper()
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	source := func(path string) string {
+		t.Helper()
+		archive, err := parseFile(context.Background(), filepath.Join(dir, "app.eszip2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := archive.GetModule(pathToSpecifier(path))
+		if m == nil {
+			t.Fatalf("%s missing from %v", path, archive.Specifiers())
+		}
+		src, _ := m.Source(context.Background())
+		return string(src)
+	}
+	write(main, `import "./lib.js";`)
+	write(lib, `export const v = 1;`)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var stdout, stderr syncBuffer
+	done := make(chan int)
+	go func() {
+		done <- RunContext(ctx, []string{"bundle", "--watch", "-o", filepath.Join(dir, "app.eszip2"), main}, strings.NewReader(""), &stdout, &stderr)
+	}()
+	waitForOutput(t, &stdout, "Watching 2 file(s)", 1)
+
+	write(lib, `export const v = 2;`)
+	waitForOutput(t, &stdout, "Rebuilt:", 1)
+	if got := source(lib); got != `export const v = 2;` {
+		t.Errorf("lib.js after rebuild = %q", got)
+	}
+
+	// A missing import fails the rebuild; creating it fixes it.
+	write(main, `import "./lib.js"; import "./extra.js";`)
+	waitForOutput(t, &stderr, "Build failed:", 1)
+	write(filepath.Join(dir, "extra.js"), `export {};`)
+	waitForOutput(t, &stdout, "Rebuilt:", 2)
+	if got := source(main); !strings.Contains(got, "extra.js") {
+		t.Errorf("main.js after rebuild = %q", got)
+	}
+
+	cancel()
+	if code := <-done; code != 0 {
+		t.Errorf("exit code = %d, want 0; stderr:\n%s", code, stderr.String())
+	}
+}
+
+func TestBundleRemote(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/std/mod.ts", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/typescript")
+		fmt.Fprint(w, `export * from "./util.ts"; import "../config";`)
+	})
+	mux.HandleFunc("/std/util.ts", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/typescript")
+		fmt.Fprint(w, `import "file:///etc/passwd"; export const util = 1;`)
+	})
+	mux.HandleFunc("/config", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{}`)
+	})
+	mux.Handle("/latest/mod.ts", http.RedirectHandler("/std/mod.ts", http.StatusFound))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	dir := t.TempDir()
+	entry := filepath.Join(dir, "main.js")
+	source := fmt.Sprintf("import { util } from %q;\nimport %q;\n", server.URL+"/latest/mod.ts", server.URL+"/std/util.ts")
+	if err := os.WriteFile(entry, []byte(source), 0644); err != nil {
+		t.Fatal(err)
+	}
+	outputPath := filepath.Join(dir, "app.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"bundle", "-o", outputPath, entry}); err != nil {
+		t.Fatalf("bundle failed: %v", err)
+	}
+	archive, err := parseFile(context.Background(), outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		pathToSpecifier(entry),
+		server.URL + "/std/mod.ts",
+		server.URL + "/latest/mod.ts",
+		server.URL + "/std/util.ts",
+		server.URL + "/config",
+	}
+	if got := archive.Specifiers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	if m := archive.GetModule(server.URL + "/latest/mod.ts"); m == nil || m.Specifier != server.URL+"/std/mod.ts" {
+		t.Errorf("redirected module = %v", m)
+	}
+	if m := archive.GetModule(server.URL + "/config"); m == nil || m.Kind != eszip.ModuleKindJson {
+		t.Errorf("config module = %v", m)
+	}
+	if stderr := a.stderr.(*bytes.Buffer).String(); !strings.Contains(stderr, "file:///etc/passwd") {
+		t.Errorf("a remote module's file: import was not skipped:\n%s", stderr)
+	}
+
+	t.Run("no_remote", func(t *testing.T) {
+		a, _ := newTestApp()
+		if err := a.run([]string{"bundle", "--no-remote", "-o", outputPath, entry}); err != nil {
+			t.Fatalf("bundle failed: %v", err)
+		}
+		archive, err := parseFile(context.Background(), outputPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := archive.Specifiers(); !reflect.DeepEqual(got, want[:1]) {
+			t.Errorf("specifiers = %v, want only the entrypoint", got)
+		}
+
+		a, _ = newTestApp()
+		if err := a.run([]string{"create", "--no-remote", "-o", outputPath, server.URL + "/config"}); err == nil {
+			t.Error("create fetched a URL with --no-remote")
+		}
+	})
+}
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, build func(*eszip.EszipV2)) string {
+		archive := eszip.NewV2()
+		build(archive)
+		data, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	old := write("old.eszip2", func(e *eszip.EszipV2) {
+		e.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\n"), nil)
+		e.AddModule("file:///old.js", eszip.ModuleKindJavaScript, []byte("old\n"), nil)
+		e.AddRedirect("file:///alias.js", "file:///main.js")
+	})
+	updated := write("new.eszip2", func(e *eszip.EszipV2) {
+		e.SetChecksum(eszip.ChecksumXxh3)
+		e.AddModule("file:///new.js", eszip.ModuleKindJavaScript, []byte("new"), nil)
+		e.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte("a\nB\nc\nd\ne\nf\ng\nh\ni\nj\n"), nil)
+		e.AddRedirect("file:///alias.js", "file:///main.js")
+	})
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"diff", old, old}); err != nil {
+		t.Fatalf("diff of identical archives failed: %v", err)
+	}
+	if !strings.HasPrefix(stdout.String(), "No differences\n") {
+		t.Errorf("unexpected output:\n%s", stdout)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"diff", "--content", old, updated}); !errors.Is(err, errArchivesDiffer) {
+		t.Fatalf("diff error = %v, want errArchivesDiffer", err)
+	}
+	out := stdout.String()
+	for _, want := range []string{
+		"Changed: file:///main.js (18 -> 20 bytes, +2): source differs\n",
+		"Added:   file:///new.js (+3 bytes)\n",
+		"Removed: file:///old.js (-4 bytes)\n",
+		"--- a/file:///main.js\n+++ b/file:///main.js\n@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n@@ -7,3 +7,4 @@\n g\n h\n i\n+j\n",
+		"--- /dev/null\n+++ b/file:///new.js\n@@ -0,0 +1 @@\n+new\n\\ No newline at end of file\n",
+		"--- a/file:///old.js\n+++ /dev/null\n@@ -1 +0,0 @@\n-old\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected %q in output:\n%s", want, out)
+		}
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"diff", "--json", old, updated}); !errors.Is(err, errArchivesDiffer) {
+		t.Fatalf("diff --json error = %v, want errArchivesDiffer", err)
+	}
+	var report diffReport
+	if err := json.Unmarshal(stdout.Bytes(), &report); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(report.Modules) != 3 || report.Modules[0].Change != "changed" || report.Modules[1].Change != "added" || report.Modules[2].Change != "removed" {
+		t.Errorf("unexpected report: %+v", report)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, modules map[string]string) string {
+		archive := eszip.NewV2()
+		for _, specifier := range slices.Sorted(maps.Keys(modules)) {
+			archive.AddModule(specifier, eszip.ModuleKindJavaScript, []byte(modules[specifier]), nil)
+		}
+		data, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	base := write("base.eszip2", map[string]string{"file:///main.js": "main", "file:///config.js": "base"})
+	extra := write("extra.eszip2", map[string]string{"file:///main.js": "main", "file:///config.js": "extra", "file:///worker.js": "worker"})
+	out := filepath.Join(dir, "out.eszip2")
+
+	a, _ := newTestApp()
+	if err := a.run([]string{"merge", "-o", out, base, extra}); !errors.Is(err, eszip.ErrMergeConflict) {
+		t.Fatalf("merge error = %v, want ErrMergeConflict", err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"merge", "--on-conflict", "keep-last", "-o", out, base, extra}); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "3 entries from 2 archives") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	merged, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	source, _ := merged.GetModule("file:///config.js").Source(context.Background())
+	if string(source) != "extra" || merged.GetModule("file:///worker.js") == nil {
+		t.Errorf("unexpected merged archive: config.js = %q, specifiers %v", source, merged.Specifiers())
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"merge", "--on-conflict", "newest", "-o", out, base, extra}); err == nil || !strings.Contains(err.Error(), "unknown conflict policy") {
+		t.Errorf("merge with a bad policy error = %v", err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.SetChecksum(eszip.ChecksumSha256)
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte("console.log('main');"), nil)
+	archive.AddRedirect("file:///alias.js", "file:///main.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.eszip2")
+	if err := os.WriteFile(good, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	data[bytes.Index(data, []byte("console"))] ^= 0xff
+	bad := filepath.Join(dir, "bad.eszip2")
+	if err := os.WriteFile(bad, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"verify", good}); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "ok: 1 modules, 1 redirects") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"verify", bad}); !errors.Is(err, errVerifyFailed) {
+		t.Fatalf("verify error = %v, want errVerifyFailed", err)
+	}
+	if !strings.HasPrefix(stdout.String(), "checksum file:///main.js: ") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "verify", bad}); !errors.Is(err, errVerifyFailed) {
+		t.Fatalf("verify --json error = %v, want errVerifyFailed", err)
+	}
+	var out verifyOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout)
+	}
+	if out.OK || len(out.Problems) != 1 || out.Problems[0].Kind != "checksum" {
+		t.Errorf("unexpected report: %+v", out)
+	}
+}
+
+func TestVerifyAllowedOrigins(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("https://deno.land/std/mod.ts", eszip.ModuleKindJavaScript, []byte("export {};"), nil)
+	archive.AddModule("https://cdn.evil.example/x.js", eszip.ModuleKindJavaScript, []byte("export {};"), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "remote.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"verify", "--allowed-origins", "deno.land", path}); !errors.Is(err, errVerifyFailed) {
+		t.Fatalf("verify error = %v, want errVerifyFailed", err)
+	}
+	if got := stdout.String(); got != "origin https://cdn.evil.example/x.js: origin is not allowed\n" {
+		t.Errorf("unexpected output: %q", got)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"verify", "--allowed-origins", "deno.land,*.evil.example", path}); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "ok: 2 modules") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	dir := t.TempDir()
+	out := filepath.Join(dir, "basic.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"convert", "--to", "v2", "-o", out, "../../testdata/basic.json"}); err != nil {
+		t.Fatalf("convert failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Converted: "+out) {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	converted, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	if !converted.IsV2() || len(converted.Specifiers()) != 1 {
+		t.Errorf("unexpected archive: V2 %v, specifiers %v", converted.IsV2(), converted.Specifiers())
+	}
+
+	back := filepath.Join(dir, "basic.json")
+	a, _ = newTestApp()
+	if err := a.run([]string{"convert", "--to", "v1", "-o", back, out}); err != nil {
+		t.Fatalf("convert --to v1 failed: %v", err)
+	}
+	roundTripped, err := parseFile(context.Background(), back)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	if !roundTripped.IsV1() || !slices.Equal(roundTripped.Specifiers(), converted.Specifiers()) {
+		t.Errorf("unexpected round trip: V1 %v, specifiers %v", roundTripped.IsV1(), roundTripped.Specifiers())
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"convert", "--to", "v2", "-o", back, out}); err == nil || !strings.Contains(err.Error(), "already a V2 archive") {
+		t.Errorf("convert of a V2 archive to v2 error = %v", err)
+	}
+}
+
+func TestServe(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///src/main.js", eszip.ModuleKindJavaScript, []byte("main();"), []byte(`{"version":3}`))
+	archive.AddModule("https://deno.land/std/data.json", eszip.ModuleKindJson, []byte(`{}`), nil)
+	archive.AddModule("https://esm.sh/preact?target=es2022", eszip.ModuleKindJavaScript, []byte("preact();"), nil)
+	archive.AddRedirect("https://deno.land/std/alias.json", "https://deno.land/std/data.json")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := eszip.ParseBytes(context.Background(), data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	server := httptest.NewServer(newModuleServer(parsed, true, io.Discard))
+	defer server.Close()
+	client := server.Client()
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+
+	tests := []struct {
+		path, status, contentType, body, header string
+	}{
+		{"/src/main.js", "200 OK", "text/javascript; charset=utf-8", "main();", "/src/main.js.map"},
+		{"/src/main.js.map", "200 OK", "application/json", `{"version":3}`, ""},
+		{"/deno.land/std/data.json", "200 OK", "application/json", "{}", ""},
+		{"/deno.land/std/data.json.map", "404 Not Found", "", "", ""},
+		{"/esm.sh/preact?target=es2022", "200 OK", "text/javascript; charset=utf-8", "preact();", ""},
+		{"/deno.land/std/alias.json", "302 Found", "", "", ""},
+		{"/missing.js", "404 Not Found", "", "", ""},
+	}
+	for _, tt := range tests {
+		resp, err := client.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.Status != tt.status {
+			t.Errorf("GET %s: status %s, want %s", tt.path, resp.Status, tt.status)
+			continue
+		}
+		if tt.contentType != "" && resp.Header.Get("Content-Type") != tt.contentType {
+			t.Errorf("GET %s: Content-Type %q, want %q", tt.path, resp.Header.Get("Content-Type"), tt.contentType)
+		}
+		if tt.body != "" && string(body) != tt.body {
+			t.Errorf("GET %s: body %q, want %q", tt.path, body, tt.body)
+		}
+		if got := resp.Header.Get("SourceMap"); got != tt.header {
+			t.Errorf("GET %s: SourceMap header %q, want %q", tt.path, got, tt.header)
+		}
+		if resp.StatusCode == http.StatusFound && resp.Header.Get("Location") != "/deno.land/std/data.json" {
+			t.Errorf("GET %s: Location %q", tt.path, resp.Header.Get("Location"))
+		}
+	}
+}
+
+func TestGraph(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte(`import "./a.js"; import("./lazy.js"); import "./gone.js";`), nil)
+	archive.AddModule("file:///a.js", eszip.ModuleKindJavaScript, []byte(`import "./b.js";`), nil)
+	archive.AddModule("file:///b.js", eszip.ModuleKindJavaScript, []byte(`import "./a.js";`), nil)
+	archive.AddModule("file:///lazy.js", eszip.ModuleKindJavaScript, []byte(`export {};`), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"graph", "-e", "file:///a.js", path}); err != nil {
+		t.Fatalf("graph failed: %v", err)
+	}
+	for _, want := range []string{
+		"4 module(s), 4 import(s)",
+		"Entry points:\n  file:///main.js\n",
+		"Unreachable:\n  file:///main.js\n  file:///lazy.js\n",
+		"Cycles:\n  file:///a.js, file:///b.js\n",
+		"Unresolved imports:\n  file:///main.js: \"./gone.js\"\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, stdout)
+		}
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"graph", "--dot", path}); err != nil {
+		t.Fatalf("graph --dot failed: %v", err)
+	}
+	for _, want := range []string{
+		"digraph eszip {\n",
+		"  \"file:///main.js\" [shape=box];\n",
+		"  \"file:///main.js\" -> \"file:///lazy.js\" [style=dashed];\n",
+		"  \"file:///a.js\" -> \"file:///b.js\";\n",
+	} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("DOT output missing %q:\n%s", want, stdout)
+		}
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "graph", path}); err != nil {
+		t.Fatalf("graph --json failed: %v", err)
+	}
+	var out graphOutput
+	if err := json.Unmarshal(stdout.Bytes(), &out); err != nil {
+		t.Fatalf("invalid JSON: %v\n%s", err, stdout)
+	}
+	if len(out.Edges) != 4 || len(out.Unreachable) != 0 || len(out.Cycles) != 1 || len(out.Unresolved) != 1 {
+		t.Errorf("unexpected graph: %+v", out)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"graph", "-e", "file:///nope.js", path}); err == nil {
+		t.Error("graph with an unknown entrypoint succeeded")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	archive := eszip.NewV2()
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte(`import "./a.js";`), nil)
+	archive.AddModule("file:///a.js", eszip.ModuleKindJavaScript, []byte(`export {};`), nil)
+	archive.AddModule("file:///unused.js", eszip.ModuleKindJavaScript, []byte(`export {};`), nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	dir := t.TempDir()
+	in := filepath.Join(dir, "app.eszip2")
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "slim.eszip2")
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"prune", "-v", "-e", "file:///main.js", "-o", out, in}); err != nil {
+		t.Fatalf("prune failed: %v", err)
+	}
+	if !strings.Contains(stdout.String(), "Removed: file:///unused.js\n") || !strings.Contains(stdout.String(), "1 specifier(s) removed") {
+		t.Errorf("unexpected output: %s", stdout)
+	}
+	pruned, err := parseFile(context.Background(), out)
+	if err != nil {
+		t.Fatalf("failed to parse output: %v", err)
+	}
+	if got := pruned.Specifiers(); !slices.Equal(got, []string{"file:///main.js", "file:///a.js"}) {
+		t.Errorf("Specifiers = %v", got)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"prune", "-o", out, in}); err == nil {
+		t.Error("prune without entrypoints succeeded")
+	}
+}
+
+func TestNpm(t *testing.T) {
+	express := &eszip.NpmPackageID{Name: "express", Version: "4.18.2"}
+	debug := &eszip.NpmPackageID{Name: "debug", Version: "2.6.9"}
+	ms := &eszip.NpmPackageID{Name: "ms", Version: "2.0.0"}
+	msNew := &eszip.NpmPackageID{Name: "ms", Version: "2.1.3"}
+	archive := eszip.NewV2()
+	archive.AddModule("file:///main.js", eszip.ModuleKindJavaScript, []byte("import 'npm:express@4';"), nil)
+	archive.SetNpmSnapshot(&eszip.NpmResolutionSnapshot{
+		Packages: []*eszip.NpmPackage{
+			{ID: msNew, Dependencies: map[string]*eszip.NpmPackageID{}},
+			{ID: express, Dependencies: map[string]*eszip.NpmPackageID{"debug": debug, "ms": ms}},
+			{ID: debug, Dependencies: map[string]*eszip.NpmPackageID{"ms": ms, "express": express}},
+			{ID: ms, Dependencies: map[string]*eszip.NpmPackageID{}},
+		},
+		RootPackages: map[string]*eszip.NpmPackageID{"express@4": express, "ms@^2.1": msNew},
+	})
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "app.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"npm", "list", path}, `PACKAGE         DEPENDENCIES  REQUIRED AS
+debug@2.6.9     2             -
+express@4.18.2  2             express@4
+ms@2.0.0        0             -
+ms@2.1.3        0             ms@^2.1
+4 package(s), 2 root requirement(s)
+`},
+		{[]string{"npm", "tree", path}, `express@4 -> express@4.18.2
+├── debug -> debug@2.6.9
+│   ├── express -> express@4.18.2 (cycle)
+│   └── ms -> ms@2.0.0
+└── ms -> ms@2.0.0
+ms@^2.1 -> ms@2.1.3
+`},
+		{[]string{"npm", "tree", path, "debug"}, `debug@2.6.9
+├── express -> express@4.18.2
+│   ├── debug -> debug@2.6.9 (cycle)
+│   └── ms -> ms@2.0.0
+└── ms -> ms@2.0.0
+`},
+		{[]string{"npm", "why", path, "ms"}, `ms@2.0.0
+  ms from debug@2.6.9
+    debug from express@4.18.2
+      root requirement express@4
+      express from debug@2.6.9 (cycle)
+  ms from express@4.18.2
+    root requirement express@4
+    express from debug@2.6.9
+      debug from express@4.18.2 (cycle)
+ms@2.1.3
+  root requirement ms@^2.1
+`},
+	} {
+		a, stdout := newTestApp()
+		if err := a.run(tc.args); err != nil {
+			t.Fatalf("%v failed: %v", tc.args, err)
+		}
+		if stdout.String() != tc.want {
+			t.Errorf("%v output:\n%s\nwant:\n%s", tc.args, stdout.String(), tc.want)
+		}
+	}
+
+	a, stdout := newTestApp()
+	if err := a.run([]string{"--json", "npm", "why", path, "ms@2.1.3"}); err != nil {
+		t.Fatalf("--json npm why failed: %v", err)
+	}
+	var why []npmWhy
+	if err := json.Unmarshal(stdout.Bytes(), &why); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(why) != 1 || why[0].Package != "ms@2.1.3" || !slices.Equal(why[0].Roots, []string{"ms@^2.1"}) || len(why[0].Dependents) != 0 {
+		t.Errorf("unexpected why %+v", why)
+	}
+
+	a, stdout = newTestApp()
+	if err := a.run([]string{"--json", "npm", "list", path}); err != nil {
+		t.Fatalf("--json npm list failed: %v", err)
+	}
+	var listings []npmPackageListing
+	if err := json.Unmarshal(stdout.Bytes(), &listings); err != nil {
+		t.Fatalf("invalid JSON output: %v\n%s", err, stdout.String())
+	}
+	if len(listings) != 4 || listings[1].Package != "express@4.18.2" || listings[1].Dependencies["debug"] != "debug@2.6.9" {
+		t.Errorf("unexpected listings %+v", listings)
+	}
+
+	a, _ = newTestApp()
+	if err := a.run([]string{"npm", "why", path, "left-pad"}); err == nil || !strings.Contains(err.Error(), "left-pad is not in the archive") {
+		t.Errorf("npm why left-pad error = %v", err)
+	}
 }
@@ -0,0 +1,366 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+// npmPackageListing is one entry of npm list --json output.
+type npmPackageListing struct {
+	Package      string            `json:"package"`
+	Dependencies map[string]string `json:"dependencies"`
+	Roots        []string          `json:"roots"`
+	Integrity    string            `json:"integrity,omitempty"`
+	Tarball      string            `json:"tarball,omitempty"`
+}
+
+// npmTreeNode is the JSON form of an eszip.NpmDependencyNode.
+type npmTreeNode struct {
+	Requirement  string         `json:"requirement,omitempty"`
+	Package      string         `json:"package"`
+	Dependencies []*npmTreeNode `json:"dependencies"`
+	Cycle        bool           `json:"cycle,omitempty"`
+}
+
+// npmWhy explains why a package is in the snapshot: the root requirements
+// that resolve to it and the packages that depend on it, each explained
+// in turn.
+type npmWhy struct {
+	Package string `json:"package"`
+	// Requirement is what the package below this one in the explanation
+	// requires it as; it is empty at the top.
+	Requirement string    `json:"requirement,omitempty"`
+	Roots       []string  `json:"roots"`
+	Dependents  []*npmWhy `json:"dependents"`
+	// Cycle is set when the package already appears above, so it is not
+	// explained again.
+	Cycle bool `json:"cycle,omitempty"`
+}
+
+func (a *app) npmCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "npm",
+		Short: "Inspect the npm resolution snapshot of an eszip archive",
+		Long: `Inspect the npm packages an archive was resolved against: list them,
+print the tree of what each root requirement pulls in, or explain why a
+package is there.`,
+	}
+	cmd.AddCommand(a.npmListCmd(), a.npmTreeCmd(), a.npmWhyCmd())
+	return cmd
+}
+
+func (a *app) npmListCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:     "list <archive>",
+		Aliases: []string{"ls"},
+		Short:   "List the npm packages of an archive",
+		Long: `List every package of an archive's npm snapshot, sorted by name and
+version, with the number of packages it depends on and the root
+requirements that resolve to it. --json adds each package's dependencies
+and, when the archive records them, its integrity digest and tarball URL.`,
+		Example: `  eszip npm list app.eszip2
+  eszip --json npm list app.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshot, err := a.npmSnapshot(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			packages := sortedNpmPackages(snapshot)
+			roots := npmRootsByPackage(snapshot)
+
+			if a.json {
+				listings := make([]npmPackageListing, len(packages))
+				for i, pkg := range packages {
+					deps := make(map[string]string, len(pkg.Dependencies))
+					for req, id := range pkg.Dependencies {
+						deps[req] = id.String()
+					}
+					listings[i] = npmPackageListing{
+						Package:      pkg.ID.String(),
+						Dependencies: deps,
+						Roots:        nonNil(roots[pkg.ID.String()]),
+						Integrity:    pkg.Integrity,
+						Tarball:      pkg.Tarball,
+					}
+				}
+				return a.writeJSON(listings)
+			}
+
+			tw := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(tw, "PACKAGE\tDEPENDENCIES\tREQUIRED AS")
+			for _, pkg := range packages {
+				required := "-"
+				if r := roots[pkg.ID.String()]; len(r) > 0 {
+					required = strings.Join(r, ", ")
+				}
+				fmt.Fprintf(tw, "%s\t%d\t%s\n", pkg.ID, len(pkg.Dependencies), required)
+			}
+			tw.Flush()
+			fmt.Fprintf(a.stdout, "%d package(s), %d root requirement(s)\n", len(packages), len(snapshot.RootPackages))
+			return nil
+		},
+	}
+}
+
+func (a *app) npmTreeCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "tree <archive> [<package>]",
+		Short: "Print the npm dependency tree of an archive",
+		Long: `Print, for each root requirement of an archive's npm snapshot, the package
+it resolves to and, recursively, the packages that one depends on. Given a
+package, as a root requirement, a name or name@version, print the tree
+below it instead.
+
+A package that depends on one of the packages above it is marked (cycle),
+and one whose dependencies were already printed is marked (deduped); their
+dependencies are not repeated. --json prints every tree in full, cutting
+only cycles.`,
+		Example: `  eszip npm tree app.eszip2
+  eszip npm tree app.eszip2 express`,
+		Args: cobra.RangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshot, err := a.npmSnapshot(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+
+			type root struct {
+				req string
+				id  *eszip.NpmPackageID
+			}
+			var roots []root
+			if len(args) == 2 {
+				packages, err := findNpmPackages(snapshot, args[1])
+				if err != nil {
+					return err
+				}
+				for _, pkg := range packages {
+					roots = append(roots, root{id: pkg.ID})
+				}
+			} else {
+				for _, req := range slices.Sorted(maps.Keys(snapshot.RootPackages)) {
+					roots = append(roots, root{req, snapshot.RootPackages[req]})
+				}
+			}
+
+			trees := make([]*eszip.NpmDependencyNode, len(roots))
+			for i, r := range roots {
+				if trees[i], err = snapshot.DependencyTree(r.id); err != nil {
+					return err
+				}
+				trees[i].Req = r.req
+			}
+
+			if a.json {
+				out := make([]*npmTreeNode, len(trees))
+				for i, tree := range trees {
+					out[i] = npmTreeJSON(tree)
+				}
+				return a.writeJSON(out)
+			}
+			expanded := make(map[string]bool)
+			for _, tree := range trees {
+				writeNpmTree(a.stdout, tree, "", "", expanded)
+			}
+			return nil
+		},
+	}
+}
+
+func (a *app) npmWhyCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "why <archive> <package>",
+		Short: "Explain why an npm package is in an archive",
+		Long: `Explain why a package, given as a name or name@version, is in an
+archive's npm snapshot: the root requirements that resolve to it and the
+packages that depend on it, each explained in turn up to the root
+requirements. A name explains every version of the package.`,
+		Example: `  eszip npm why app.eszip2 ms
+  eszip --json npm why app.eszip2 ms@2.1.3`,
+		Args: cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			snapshot, err := a.npmSnapshot(cmd.Context(), args[0])
+			if err != nil {
+				return err
+			}
+			packages, err := findNpmPackages(snapshot, args[1])
+			if err != nil {
+				return err
+			}
+
+			roots := npmRootsByPackage(snapshot)
+			// dependents maps each package to the packages that depend on
+			// it and what they require it as.
+			type dependent struct {
+				req string
+				pkg *eszip.NpmPackage
+			}
+			dependents := make(map[string][]dependent)
+			for _, pkg := range snapshot.Packages {
+				for req, id := range pkg.Dependencies {
+					dependents[id.String()] = append(dependents[id.String()], dependent{req, pkg})
+				}
+			}
+			for _, deps := range dependents {
+				slices.SortFunc(deps, func(x, y dependent) int {
+					if c := strings.Compare(x.pkg.ID.String(), y.pkg.ID.String()); c != 0 {
+						return c
+					}
+					return strings.Compare(x.req, y.req)
+				})
+			}
+
+			var explain func(id *eszip.NpmPackageID, req string, above map[string]bool) *npmWhy
+			explain = func(id *eszip.NpmPackageID, req string, above map[string]bool) *npmWhy {
+				key := id.String()
+				why := &npmWhy{Package: key, Requirement: req, Roots: nonNil(roots[key]), Dependents: []*npmWhy{}}
+				if above[key] {
+					why.Cycle = true
+					return why
+				}
+				above[key] = true
+				defer delete(above, key)
+				for _, d := range dependents[key] {
+					why.Dependents = append(why.Dependents, explain(d.pkg.ID, d.req, above))
+				}
+				return why
+			}
+			explanations := make([]*npmWhy, len(packages))
+			for i, pkg := range packages {
+				explanations[i] = explain(pkg.ID, "", make(map[string]bool))
+			}
+
+			if a.json {
+				return a.writeJSON(explanations)
+			}
+			for _, why := range explanations {
+				fmt.Fprintln(a.stdout, why.Package)
+				writeNpmWhy(a.stdout, why, "  ")
+			}
+			return nil
+		},
+	}
+}
+
+// npmSnapshot returns the npm snapshot of the archive at path, or an empty
+// one if it has none.
+func (a *app) npmSnapshot(ctx context.Context, path string) (*eszip.NpmResolutionSnapshot, error) {
+	archive, err := a.openArchive(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	defer archive.Close()
+	if snapshot := archive.TakeNpmSnapshot(); snapshot != nil {
+		return snapshot, nil
+	}
+	return &eszip.NpmResolutionSnapshot{}, nil
+}
+
+// findNpmPackages returns the packages query names: the package a root
+// requirement or exact id resolves to, or else every version of a name.
+func findNpmPackages(snapshot *eszip.NpmResolutionSnapshot, query string) ([]*eszip.NpmPackage, error) {
+	if pkg, err := snapshot.ResolvePackage(query); err == nil {
+		return []*eszip.NpmPackage{pkg}, nil
+	}
+	if versions := snapshot.AllVersionsOf(query); len(versions) > 0 {
+		return versions, nil
+	}
+	return nil, fmt.Errorf("npm package %s is not in the archive", query)
+}
+
+// npmRootsByPackage maps each package id to the root requirements that
+// resolve to it, sorted.
+func npmRootsByPackage(snapshot *eszip.NpmResolutionSnapshot) map[string][]string {
+	roots := make(map[string][]string)
+	for _, req := range slices.Sorted(maps.Keys(snapshot.RootPackages)) {
+		id := snapshot.RootPackages[req].String()
+		roots[id] = append(roots[id], req)
+	}
+	return roots
+}
+
+// sortedNpmPackages returns the packages of snapshot sorted by name and
+// then, oldest first, by version.
+func sortedNpmPackages(snapshot *eszip.NpmResolutionSnapshot) []*eszip.NpmPackage {
+	names := make(map[string]bool)
+	for _, pkg := range snapshot.Packages {
+		names[pkg.ID.Name] = true
+	}
+	packages := make([]*eszip.NpmPackage, 0, len(snapshot.Packages))
+	for _, name := range slices.Sorted(maps.Keys(names)) {
+		packages = append(packages, snapshot.AllVersionsOf(name)...)
+	}
+	return packages
+}
+
+func npmTreeJSON(node *eszip.NpmDependencyNode) *npmTreeNode {
+	out := &npmTreeNode{
+		Requirement:  node.Req,
+		Package:      node.Package.ID.String(),
+		Dependencies: make([]*npmTreeNode, len(node.Dependencies)),
+		Cycle:        node.Cycle,
+	}
+	for i, child := range node.Dependencies {
+		out.Dependencies[i] = npmTreeJSON(child)
+	}
+	return out
+}
+
+// writeNpmTree prints node after prefix, and its dependencies below it
+// after indent. expanded records the packages whose dependencies have been
+// printed.
+func writeNpmTree(w io.Writer, node *eszip.NpmDependencyNode, prefix, indent string, expanded map[string]bool) {
+	line := node.Package.ID.String()
+	if node.Req != "" {
+		line = node.Req + " -> " + line
+	}
+	key := node.Package.ID.String()
+	switch {
+	case node.Cycle:
+		line += " (cycle)"
+	case expanded[key] && len(node.Dependencies) > 0:
+		line += " (deduped)"
+	}
+	fmt.Fprintf(w, "%s%s\n", prefix, line)
+	if node.Cycle || expanded[key] {
+		return
+	}
+	expanded[key] = true
+	for i, child := range node.Dependencies {
+		if i == len(node.Dependencies)-1 {
+			writeNpmTree(w, child, indent+"└── ", indent+"    ", expanded)
+		} else {
+			writeNpmTree(w, child, indent+"├── ", indent+"│   ", expanded)
+		}
+	}
+}
+
+// writeNpmWhy prints the root requirements and dependents of why, indented
+// by indent.
+func writeNpmWhy(w io.Writer, why *npmWhy, indent string) {
+	if why.Cycle {
+		return
+	}
+	for _, req := range why.Roots {
+		fmt.Fprintf(w, "%sroot requirement %s\n", indent, req)
+	}
+	for _, d := range why.Dependents {
+		line := fmt.Sprintf("%s%s from %s", indent, d.Requirement, d.Package)
+		if d.Cycle {
+			line += " (cycle)"
+		}
+		fmt.Fprintln(w, line)
+		writeNpmWhy(w, d, indent+"  ")
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// progressBar draws a single-line progress bar, such as
+//
+//	reading  [#########...........]  45%  12.3 MiB / 27 MiB
+//
+// rewriting it in place with a carriage return. It is redrawn only when
+// the line would change, so it stays cheap for archives with many small
+// modules. A bar whose total is unknown shows only the byte count.
+type progressBar struct {
+	w io.Writer
+
+	mu    sync.Mutex
+	label string
+	line  string
+	open  bool // a line has been drawn and not yet ended
+}
+
+const progressWidth = 20
+
+func newProgressBar(w io.Writer) *progressBar {
+	return &progressBar{w: w}
+}
+
+// update draws the bar for label at done of total bytes, where total is
+// negative if unknown. A different label starts a new line, and the line
+// is ended once done reaches total.
+func (p *progressBar) update(label string, done, total int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.open && label != p.label {
+		p.endLocked()
+	}
+	p.label = label
+
+	var line string
+	if total >= 0 {
+		done = min(done, total)
+		percent := 100
+		if total > 0 {
+			percent = int(done * 100 / total)
+		}
+		filled := percent * progressWidth / 100
+		line = fmt.Sprintf("%-8s [%s%s] %3d%%  %s / %s", label,
+			strings.Repeat("#", filled), strings.Repeat(".", progressWidth-filled),
+			percent, formatBytes(done), formatBytes(total))
+	} else {
+		line = fmt.Sprintf("%-8s %s", label, formatBytes(done))
+	}
+	if p.open && line == p.line {
+		return
+	}
+	// Pad over the remains of a longer previous line.
+	pad := max(len(p.line)-len(line), 0)
+	fmt.Fprintf(p.w, "\r%s%s", line, strings.Repeat(" ", pad))
+	p.line, p.open = line, true
+	if total >= 0 && done == total {
+		p.endLocked()
+	}
+}
+
+// end ends the current line, if any, so that later output starts on a line
+// of its own.
+func (p *progressBar) end() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.open {
+		p.endLocked()
+	}
+}
+
+func (p *progressBar) endLocked() {
+	fmt.Fprintln(p.w)
+	p.open = false
+	p.line = ""
+}
+
+// parseProgress reports a parse as "reading".
+func (p *progressBar) parseProgress() eszip.Progress {
+	return eszip.Progress{
+		OnSectionRead: func(_ string, read, total int64) {
+			p.update("reading", read, total)
+		},
+	}
+}
+
+// writeProgress reports a serialization as "writing".
+func (p *progressBar) writeProgress() eszip.Progress {
+	return eszip.Progress{
+		OnModuleWritten: func(_ string, written, total int64) {
+			p.update("writing", written, total)
+		},
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func (a *app) pruneCmd() *cobra.Command {
+	var outputPath string
+	var entrypoints []string
+	var verbose bool
+
+	cmd := &cobra.Command{
+		Use:   "prune <archive>",
+		Short: "Remove modules unreachable from the entrypoints",
+		Long: `Remove the modules that no chain of imports leads to from the given
+entrypoints, with the redirects that led to them, to shrink deploy
+artifacts. Static imports, re-exports and dynamic imports with a string
+literal argument are followed, and bare specifiers are resolved through
+the archive's import map. The import map, archive metadata and npm
+entries are kept. Without --entrypoint, the entrypoints recorded in the
+archive by create --entrypoint are used.
+
+Modules loaded through computed specifiers cannot be seen; pass them as
+extra entrypoints to keep them. eszip graph shows what would be kept.`,
+		Example: `  eszip prune -e file:///main.ts -o slim.eszip2 app.eszip2
+  eszip prune -e file:///main.ts -e file:///worker.ts -v -o slim.eszip2 app.eszip2
+  eszip prune -o slim.eszip2 app.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			archive, err := a.loadArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			v2, ok := archive.V2()
+			if !ok {
+				return fmt.Errorf("%s: prune requires a V2 archive", args[0])
+			}
+			if len(entrypoints) == 0 {
+				recorded, err := v2.Entrypoints(ctx)
+				if err != nil {
+					return err
+				}
+				if len(recorded) == 0 {
+					return fmt.Errorf("at least one --entrypoint is required, as %s records none", args[0])
+				}
+			}
+
+			removed, err := v2.Prune(ctx, entrypoints...)
+			if err != nil {
+				return err
+			}
+
+			data, err := v2.IntoBytes(a.writeOptions()...)
+			if err != nil {
+				return fmt.Errorf("serializing archive: %w", err)
+			}
+			if err := writeOutput(cmd.Context(), outputPath, data); err != nil {
+				return fmt.Errorf("writing output: %w", err)
+			}
+
+			if verbose {
+				for _, spec := range removed {
+					fmt.Fprintf(a.stdout, "Removed: %s\n", spec)
+				}
+			}
+			fmt.Fprintf(a.stdout, "Pruned: %s (%d specifier(s) removed, %d bytes)\n", outputPath, len(removed), len(data))
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVarP(&outputPath, "output", "o", "output.eszip2", "Output file path")
+	cmd.Flags().StringSliceVarP(&entrypoints, "entrypoint", "e", nil, "Module to keep with everything it imports (repeatable; default: the archive's entrypoints)")
+	cmd.RegisterFlagCompletionFunc("entrypoint", a.completeSpecifierFlag)
+	cmd.Flags().BoolVarP(&verbose, "verbose", "v", false, "List the removed specifiers")
+
+	return cmd
+}
@@ -0,0 +1,108 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// isRemoteInput reports whether a create argument is an http or https URL
+// to fetch rather than a local path.
+func isRemoteInput(arg string) bool {
+	return strings.HasPrefix(arg, "http://") || strings.HasPrefix(arg, "https://")
+}
+
+// remoteModule is a module fetched for create or bundle.
+type remoteModule struct {
+	// specifier is the URL the module was served from, after redirects;
+	// requested is the URL asked for.
+	specifier string
+	requested string
+	kind      eszip.ModuleKind
+	content   []byte
+	sourceMap []byte
+	// mediaType is the response's Content-Type, if it had one.
+	mediaType string
+	// headers are stored with the module; create fills them in with
+	// --record-media-types.
+	headers map[string]string
+	// warning explains a disagreement between the URL's extension and the
+	// response's Content-Type, if there was one.
+	warning string
+}
+
+// fetchRemote downloads rawURL and works out its module kind. The
+// Content-Type of the response wins over the URL's extension, since
+// registries serve modules from extensionless paths; with neither, Wasm is
+// recognised by its magic. When both are known
+// and disagree, or the response is not a module type at all, as for an
+// HTML error page served for a .wasm URL, the result carries a warning, or
+// fetchRemote fails if strict is set.
+func fetchRemote(ctx context.Context, rawURL string, strict bool) (*remoteModule, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("parsing URL %s: %w", rawURL, err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", rawURL, err)
+	}
+
+	final := resp.Request.URL
+	m := &remoteModule{specifier: final.String(), requested: u.String(), kind: eszip.ModuleKindJavaScript, content: content}
+	extKind, extOK := eszip.ExtensionToModuleKind(final.Path)
+	contentType := resp.Header.Get("Content-Type")
+	m.mediaType = contentType
+	headerKind, headerOK := eszip.MediaTypeToModuleKind(contentType)
+	switch {
+	case headerOK:
+		m.kind = headerKind
+		if extOK && extKind != headerKind {
+			m.warning = fmt.Sprintf("extension says %s but Content-Type %q says %s; using %s", extKind, contentType, headerKind, headerKind)
+		}
+	case extOK:
+		m.kind = extKind
+		if contentType != "" {
+			m.warning = fmt.Sprintf("Content-Type %q is not a module type; using %s from the extension", contentType, extKind)
+		}
+	default:
+		if kind, ok := eszip.DetectModuleKind("", content); ok {
+			m.kind = kind
+		}
+		if contentType != "" {
+			m.warning = fmt.Sprintf("Content-Type %q is not a module type; using %s", contentType, m.kind)
+		}
+	}
+	if strict && m.warning != "" {
+		return nil, fmt.Errorf("%s: %s", m.specifier, m.warning)
+	}
+	return m, nil
+}
+
+// addTo adds the module to archive with its headers, with a redirect from
+// the requested URL if the server redirected.
+func (m *remoteModule) addTo(archive *eszip.EszipV2) {
+	archive.AddModuleWithHeaders(m.specifier, m.kind, m.content, m.sourceMap, m.headers)
+	if m.requested != m.specifier {
+		archive.AddRedirect(m.requested, m.specifier)
+	}
+}
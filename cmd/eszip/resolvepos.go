@@ -0,0 +1,128 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/JakeChampion/eszip/sourcemap"
+	"github.com/spf13/cobra"
+)
+
+// resolvedPosition is one position in resolve-pos --json output; Original
+// is nil when the source map does not cover the position.
+type resolvedPosition struct {
+	Specifier string              `json:"specifier"`
+	Line      int                 `json:"line"`
+	Column    int                 `json:"column"`
+	Original  *sourcemap.Position `json:"original"`
+}
+
+func (a *app) resolvePosCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "resolve-pos <archive> <specifier:line:column>...",
+		Short: "Map positions in generated code back to original sources",
+		Long: `Look up positions in modules of an archive, as a stack trace prints them
+with one-based lines and columns, in the modules' source maps, and print the
+original source, line and column each came from, with the name of the
+symbol there if the map records it. Redirects are followed, and a module
+stored without a source map falls back to one inlined in its source.
+
+A position the map does not cover prints as unmapped; a module that is not
+in the archive or has no source map is an error.`,
+		Example: `  eszip resolve-pos app.eszip2 file:///app.js:10:42
+  eszip resolve-pos --json app.eszip2 file:///app.js:10:42 file:///lib.js:3:7`,
+		Args: cobra.MinimumNArgs(2),
+		ValidArgsFunction: func(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+			if len(args) == 0 {
+				return nil, cobra.ShellCompDirectiveDefault
+			}
+			specifiers, directive := a.completeSpecifiers(cmd, args[0], toComplete)
+			return specifiers, directive | cobra.ShellCompDirectiveNoSpace
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+			positions := make([]resolvedPosition, len(args)-1)
+			for i, arg := range args[1:] {
+				p, err := parsePosition(arg)
+				if err != nil {
+					return err
+				}
+				positions[i] = p
+			}
+
+			archive, err := a.openArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer archive.Close()
+
+			maps := make(map[string]*sourcemap.Map)
+			for i, p := range positions {
+				m, ok := maps[p.Specifier]
+				if !ok {
+					module := archive.GetModule(p.Specifier)
+					if module == nil {
+						return fmt.Errorf("module not found: %s", p.Specifier)
+					}
+					if m, err = module.ParsedSourceMap(ctx); err != nil {
+						return err
+					}
+					maps[p.Specifier] = m
+				}
+				if original, ok := m.Lookup(p.Line, p.Column); ok {
+					positions[i].Original = &original
+				}
+			}
+
+			if a.json {
+				return a.writeJSON(positions)
+			}
+			for _, p := range positions {
+				generated := fmt.Sprintf("%s:%d:%d", p.Specifier, p.Line, p.Column)
+				switch {
+				case p.Original == nil:
+					fmt.Fprintf(a.stdout, "%s -> unmapped\n", generated)
+				case p.Original.Name != "":
+					fmt.Fprintf(a.stdout, "%s -> %s (%s)\n", generated, p.Original, p.Original.Name)
+				default:
+					fmt.Fprintf(a.stdout, "%s -> %s\n", generated, p.Original)
+				}
+			}
+			return nil
+		},
+	}
+
+	return cmd
+}
+
+// parsePosition splits a specifier:line:column argument at its last two
+// colons, since the specifier has colons of its own.
+func parsePosition(arg string) (resolvedPosition, error) {
+	rest, column, ok := cutLast(arg, ":")
+	var specifier, line string
+	if ok {
+		specifier, line, ok = cutLast(rest, ":")
+	}
+	if !ok || specifier == "" {
+		return resolvedPosition{}, fmt.Errorf("invalid position %q: want specifier:line:column", arg)
+	}
+	l, err := strconv.Atoi(line)
+	if err != nil || l < 1 {
+		return resolvedPosition{}, fmt.Errorf("invalid line in %q: want a number from 1", arg)
+	}
+	c, err := strconv.Atoi(column)
+	if err != nil || c < 1 {
+		return resolvedPosition{}, fmt.Errorf("invalid column in %q: want a number from 1", arg)
+	}
+	return resolvedPosition{Specifier: specifier, Line: l, Column: c}, nil
+}
+
+func cutLast(s, sep string) (before, after string, found bool) {
+	if i := strings.LastIndex(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):], true
+	}
+	return s, "", false
+}
@@ -0,0 +1,187 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// importRewriter points the static imports of extracted modules at the
+// files the imported modules were extracted to, so the extracted tree runs
+// without network access. Imports it cannot rewrite, dynamic ones and those
+// of modules left in the archive, are collected into an import map instead.
+type importRewriter struct {
+	outputDir string
+	// paths maps every extracted specifier to its file.
+	paths map[string]string
+	// archiveImports holds the "imports" of the archive's own import map,
+	// used to resolve bare specifiers.
+	archiveImports map[string]string
+	// importMap collects the generated import map entries.
+	importMap map[string]string
+	rewritten []rewrittenModule
+}
+
+// rewrittenModule records where imports were rewritten in one file, as
+// byte offsets into the module's original source.
+type rewrittenModule struct {
+	path    string
+	offsets []int
+}
+
+func newImportRewriter(outputDir string, paths map[string]string, archiveImportMap []byte) *importRewriter {
+	r := &importRewriter{
+		outputDir: outputDir,
+		paths:     paths,
+		importMap: make(map[string]string),
+	}
+	var parsed struct {
+		Imports map[string]string `json:"imports"`
+	}
+	if json.Unmarshal(archiveImportMap, &parsed) == nil {
+		r.archiveImports = parsed.Imports
+	}
+	return r
+}
+
+// rewrite returns source with each static import of an extracted module
+// replaced by a relative path from path, the file source is extracted to.
+// It reports whether anything changed.
+func (r *importRewriter) rewrite(specifier, path string, source []byte) ([]byte, bool) {
+	var out []byte
+	var offsets []int
+	last := 0
+	for _, ref := range eszip.ScanImports(source) {
+		target, ok := r.resolve(specifier, ref.Specifier)
+		if !ok {
+			continue
+		}
+		targetPath, extracted := r.paths[target]
+		if extracted && !ref.Dynamic {
+			out = append(out, source[last:ref.Start]...)
+			out = append(out, relativeImport(filepath.Dir(path), targetPath)...)
+			last = ref.End
+			offsets = append(offsets, ref.Start)
+			continue
+		}
+		// Relative imports resolve on disk as they did in the archive,
+		// since extraction keeps each origin's directory layout.
+		if isRelativeImport(ref.Specifier) {
+			continue
+		}
+		mapped := target
+		if extracted {
+			mapped = relativeImport(r.outputDir, targetPath)
+		}
+		if mapped != ref.Specifier {
+			r.importMap[ref.Specifier] = mapped
+		}
+	}
+	if len(offsets) == 0 {
+		return source, false
+	}
+	r.rewritten = append(r.rewritten, rewrittenModule{path: path, offsets: offsets})
+	return append(out, source[last:]...), true
+}
+
+// resolve turns an import specifier into the archive specifier it refers
+// to: relative specifiers against the importing module, bare ones through
+// the archive's import map.
+func (r *importRewriter) resolve(referrer, specifier string) (string, bool) {
+	if isRelativeImport(specifier) {
+		base, err := url.Parse(referrer)
+		if err != nil {
+			return "", false
+		}
+		ref, err := url.Parse(specifier)
+		if err != nil {
+			return "", false
+		}
+		return base.ResolveReference(ref).String(), true
+	}
+	if u, err := url.Parse(specifier); err == nil && u.Scheme != "" {
+		return u.String(), true
+	}
+
+	// Exact matches win, then the longest matching prefix ending in "/".
+	target, ok := r.archiveImports[specifier]
+	if !ok {
+		best := ""
+		for key := range r.archiveImports {
+			if strings.HasSuffix(key, "/") && strings.HasPrefix(specifier, key) && len(key) > len(best) {
+				best = key
+			}
+		}
+		if best == "" {
+			return "", false
+		}
+		target = r.archiveImports[best] + strings.TrimPrefix(specifier, best)
+	}
+	// Normalize the escaping to match the archive's specifiers.
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	return u.String(), true
+}
+
+func isRelativeImport(specifier string) bool {
+	return strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") || strings.HasPrefix(specifier, "/")
+}
+
+// relativeImport returns the specifier of the file at path as imported
+// from dir. Path segments are percent-encoded, since runtimes decode
+// specifiers before opening files.
+func relativeImport(dir, path string) string {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		rel = path
+	}
+	rel = (&url.URL{Path: filepath.ToSlash(rel)}).EscapedPath()
+	if !strings.HasPrefix(rel, "../") {
+		rel = "./" + rel
+	}
+	return rel
+}
+
+// writeSummary reports the rewritten modules. Offsets refer to the
+// original sources, so users can tell what was changed.
+func (r *importRewriter) writeSummary(w io.Writer, droppedMaps int) {
+	if len(r.rewritten) == 0 {
+		fmt.Fprintln(w, "Rewrote no imports")
+		return
+	}
+	total := 0
+	for _, m := range r.rewritten {
+		total += len(m.offsets)
+	}
+	fmt.Fprintf(w, "Rewrote %d import(s) in %d module(s); offsets are bytes into the original sources:\n", total, len(r.rewritten))
+	for _, m := range r.rewritten {
+		offsets := make([]string, len(m.offsets))
+		for i, offset := range m.offsets {
+			offsets[i] = fmt.Sprint(offset)
+		}
+		fmt.Fprintf(w, "  %s: %s\n", m.path, strings.Join(offsets, ", "))
+	}
+	if droppedMaps > 0 {
+		fmt.Fprintf(w, "Skipped %d stale source map(s) of rewritten modules\n", droppedMaps)
+	}
+}
+
+// importMapJSON encodes the generated import map.
+func (r *importRewriter) importMapJSON() ([]byte, error) {
+	data, err := json.MarshalIndent(struct {
+		Imports map[string]string `json:"imports"`
+	}{r.importMap}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
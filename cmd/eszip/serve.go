@@ -0,0 +1,220 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+func (a *app) serveCmd() *cobra.Command {
+	var addr string
+	var sourceMaps bool
+
+	cmd := &cobra.Command{
+		Use:   "serve <archive>",
+		Short: "Serve the modules of an eszip archive over HTTP",
+		Long: `Serve the modules of an eszip archive over HTTP, so an archive can back a
+local import origin during development. Each module is served at the path
+extract would write it to: file:///src/main.ts at /src/main.ts and
+https://deno.land/std/path/mod.ts at /deno.land/std/path/mod.ts. The
+Content-Type follows the module kind. Redirects answer with a redirect to
+their target's path.
+
+--source-maps serves each module's source map at its path plus ".map" and
+names it in a SourceMap response header.
+
+The archive is not loaded into memory; each request reads its module from
+the file. The server runs until interrupted.`,
+		Example: `  eszip serve app.eszip2
+  eszip serve --addr 127.0.0.1:9000 --source-maps app.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx := cmd.Context()
+
+			archive, err := a.openArchive(ctx, args[0])
+			if err != nil {
+				return err
+			}
+			defer archive.Close()
+			handler := newModuleServer(archive.EszipUnion, sourceMaps, a.stderr)
+
+			listener, err := net.Listen("tcp", addr)
+			if err != nil {
+				return err
+			}
+			server := &http.Server{
+				Handler:           handler,
+				ReadHeaderTimeout: 10 * time.Second,
+				BaseContext:       func(net.Listener) context.Context { return ctx },
+			}
+			go func() {
+				<-ctx.Done()
+				shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				_ = server.Shutdown(shutdownCtx)
+			}()
+
+			fmt.Fprintf(a.stdout, "Serving %d specifiers on http://%s\n", len(handler.routes), listener.Addr())
+			if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+				return err
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringVar(&addr, "addr", ":8080", "Address to listen on")
+	cmd.Flags().BoolVar(&sourceMaps, "source-maps", false, "Serve source maps and name them in a SourceMap header")
+
+	return cmd
+}
+
+// moduleServer serves the modules of an archive at the paths extract would
+// write them to.
+type moduleServer struct {
+	archive    *eszip.EszipUnion
+	sourceMaps bool
+	// routes maps a request path, with its query if any, to the specifier
+	// served there.
+	routes map[string]string
+}
+
+// newModuleServer indexes the archive's modules and redirects by path.
+// When specifiers collide on a path, the first in archive order wins and
+// the rest are reported to warn.
+func newModuleServer(archive *eszip.EszipUnion, sourceMaps bool, warn io.Writer) *moduleServer {
+	s := &moduleServer{archive: archive, sourceMaps: sourceMaps, routes: make(map[string]string)}
+	for _, spec := range archive.Specifiers() {
+		if archive.GetModule(spec) == nil {
+			continue
+		}
+		route := servePath(spec)
+		if existing, ok := s.routes[route]; ok {
+			fmt.Fprintf(warn, "Warning: %s is not served; %s is served at %s\n", spec, existing, route)
+			continue
+		}
+		s.routes[route] = spec
+	}
+	return s
+}
+
+// servePath returns the path, with any query, that serves spec: that of a
+// file specifier, or the host and path of a remote one.
+func servePath(spec string) string {
+	p := spec
+	for _, prefix := range []string{"file:///", "file://", "https://", "http://"} {
+		if after, found := strings.CutPrefix(p, prefix); found {
+			p = after
+			break
+		}
+	}
+	return "/" + strings.TrimPrefix(p, "/")
+}
+
+// contentTypes maps module kinds to the Content-Type they are served with.
+var contentTypes = map[eszip.ModuleKind]string{
+	eszip.ModuleKindJavaScript: "text/javascript; charset=utf-8",
+	eszip.ModuleKindJson:       "application/json",
+	eszip.ModuleKindWasm:       "application/wasm",
+	eszip.ModuleKindOpaqueData: "application/octet-stream",
+}
+
+func (s *moduleServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	route := r.URL.EscapedPath()
+	if r.URL.RawQuery != "" {
+		route += "?" + r.URL.RawQuery
+	}
+
+	spec, ok := s.routes[route]
+	serveMap := false
+	if !ok && s.sourceMaps {
+		if base, found := moduleForSourceMap(route); found {
+			spec, ok = s.routes[base]
+			serveMap = true
+		}
+	}
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	module := s.archive.GetModule(spec)
+	if module == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if target := servePath(module.Specifier); module.Specifier != spec && s.routes[target] == module.Specifier {
+		if serveMap {
+			target = sourceMapPath(target)
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+		return
+	}
+
+	var content []byte
+	var err error
+	if serveMap {
+		content, err = module.SourceMap(r.Context())
+	} else {
+		content, err = module.Source(r.Context())
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if serveMap && len(content) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+
+	if serveMap {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", contentTypes[module.Kind])
+		if s.sourceMaps {
+			if sourceMap, err := module.SourceMap(r.Context()); err == nil && len(sourceMap) > 0 {
+				w.Header().Set("SourceMap", sourceMapPath(servePath(module.Specifier)))
+			}
+		}
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	if r.Method == http.MethodHead {
+		return
+	}
+	_, _ = w.Write(content)
+}
+
+// sourceMapPath returns the path that serves the source map of the module
+// at route: its path plus ".map", followed by its query.
+func sourceMapPath(route string) string {
+	path, query, hasQuery := strings.Cut(route, "?")
+	if hasQuery {
+		return path + ".map?" + query
+	}
+	return path + ".map"
+}
+
+// moduleForSourceMap is the inverse of sourceMapPath.
+func moduleForSourceMap(route string) (string, bool) {
+	path, query, hasQuery := strings.Cut(route, "?")
+	base, found := strings.CutSuffix(path, ".map")
+	if hasQuery {
+		base += "?" + query
+	}
+	return base, found
+}
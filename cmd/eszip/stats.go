@@ -0,0 +1,431 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/bits"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+// archiveStats is the output of the stats command. Every figure comes from
+// section lengths and the modules header; no source is loaded.
+type archiveStats struct {
+	Size              int64             `json:"size"`
+	Sections          []sectionSize     `json:"sections"`
+	Histogram         []histogramBucket `json:"histogram"`
+	LargestModules    []moduleBytes     `json:"largest_modules"`
+	LargestSourceMaps []moduleBytes     `json:"largest_source_maps"`
+	Hosts             []hostSize        `json:"hosts"`
+	Kinds             []kindSize        `json:"kinds"`
+	NpmPackages       []packageSize     `json:"npm_packages"`
+	SourceBytes       int64             `json:"source_bytes"`
+	SourceMapBytes    int64             `json:"source_map_bytes"`
+	SourceMapRatio    float64           `json:"source_map_ratio"`
+	// ChecksumBytes is the space taken by the checksums of the sections
+	// and of every source and source map.
+	ChecksumBytes int64 `json:"checksum_bytes"`
+}
+
+type sectionSize struct {
+	Name  string `json:"name"`
+	Bytes int64  `json:"bytes"`
+}
+
+// histogramBucket counts module sources whose size lies in [Min, Max).
+type histogramBucket struct {
+	Min   int64 `json:"min"`
+	Max   int64 `json:"max"`
+	Count int   `json:"count"`
+}
+
+type moduleBytes struct {
+	Specifier string `json:"specifier"`
+	Bytes     int64  `json:"bytes"`
+}
+
+// hostSize aggregates the modules fetched from one remote origin.
+type hostSize struct {
+	Host           string `json:"host"`
+	Modules        int    `json:"modules"`
+	SourceBytes    int64  `json:"source_bytes"`
+	SourceMapBytes int64  `json:"source_map_bytes"`
+}
+
+// kindSize aggregates the modules of one kind.
+type kindSize struct {
+	Kind           string `json:"kind"`
+	Modules        int    `json:"modules"`
+	SourceBytes    int64  `json:"source_bytes"`
+	SourceMapBytes int64  `json:"source_map_bytes"`
+}
+
+// packageSize aggregates the files embedded for one npm package.
+type packageSize struct {
+	Package string `json:"package"`
+	Files   int    `json:"files"`
+	Bytes   int64  `json:"bytes"`
+}
+
+// sectionRecorder totals the size of each section read during a parse and
+// passes every report on to next, if set.
+type sectionRecorder struct {
+	sizes map[string]int64
+	next  eszip.Instrumentation
+}
+
+func (r *sectionRecorder) SectionRead(kind string, n int) {
+	r.sizes[kind] += int64(n)
+	if r.next != nil {
+		r.next.SectionRead(kind, n)
+	}
+}
+
+func (r *sectionRecorder) SourceLoaded(specifier string, n int, verified bool) {
+	if r.next != nil {
+		r.next.SourceLoaded(specifier, n, verified)
+	}
+}
+
+func (r *sectionRecorder) WriteProgress(n int) {
+	if r.next != nil {
+		r.next.WriteProgress(n)
+	}
+}
+
+func (a *app) statsCmd() *cobra.Command {
+	var top int
+
+	cmd := &cobra.Command{
+		Use:   "stats <archive>",
+		Short: "Show where the bytes of an eszip archive go",
+		Long: `Show where the bytes of an eszip archive go: size by section, a
+histogram of module source sizes, the largest modules and source maps,
+sizes per remote host, per module kind and per embedded npm package, the
+bytes spent on checksums, and the ratio of source map to source bytes.
+Only the archive headers are read; sources are never loaded.`,
+		Example: `  eszip stats archive.eszip2
+  eszip stats --top 20 --json archive.eszip2`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			stats, err := a.collectStats(cmd.Context(), args[0], top)
+			if err != nil {
+				return err
+			}
+
+			if a.json {
+				return a.writeJSON(stats)
+			}
+			writeStatsReport(a.stdout, args[0], stats)
+			return nil
+		},
+	}
+
+	cmd.Flags().IntVar(&top, "top", 10, "Number of largest modules and source maps to list")
+
+	return cmd
+}
+
+// collectStats parses only the headers of the archive at path.
+func (a *app) collectStats(ctx context.Context, path string, top int) (*archiveStats, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	recorder := &sectionRecorder{sizes: make(map[string]int64)}
+	if a.stats != nil {
+		recorder.next = a.stats
+	}
+	opts := append(a.parseOptions(), eszip.WithInputSize(stat.Size()), eszip.WithInstrumentation(recorder))
+	archive, _, err := eszip.Parse(ctx, f, opts...)
+	if err != nil {
+		return nil, describeParseError(path, err)
+	}
+
+	stats := &archiveStats{Size: stat.Size()}
+	sizes := archive.ModuleSizes()
+	if v2, ok := archive.V2(); ok {
+		sources, sourceMaps := v2.ContentSectionSizes()
+		stats.Sections = append(stats.Sections, sectionSize{
+			Name:  "headers",
+			Bytes: recorder.sizes["magic"] + recorder.sizes["options"] + recorder.sizes["modules"],
+		})
+		if n, ok := recorder.sizes["npm"]; ok {
+			stats.Sections = append(stats.Sections, sectionSize{Name: "npm", Bytes: n})
+		}
+		if n, ok := recorder.sizes["module_headers"]; ok {
+			stats.Sections = append(stats.Sections, sectionSize{Name: "module_headers", Bytes: n})
+		}
+		if n, ok := recorder.sizes["module_aux"]; ok {
+			stats.Sections = append(stats.Sections, sectionSize{Name: "module_aux", Bytes: n})
+		}
+		if n, ok := recorder.sizes["npm_integrity"]; ok {
+			stats.Sections = append(stats.Sections, sectionSize{Name: "npm_integrity", Bytes: n})
+		}
+		stats.Sections = append(stats.Sections,
+			sectionSize{Name: "sources", Bytes: sources},
+			sectionSize{Name: "source_maps", Bytes: sourceMaps},
+		)
+		stats.ChecksumBytes = checksumBytes(v2.Summary(), recorder.sizes, sizes)
+	} else {
+		stats.Sections = append(stats.Sections, sectionSize{Name: "json", Bytes: stat.Size()})
+	}
+
+	hosts := make(map[string]*hostSize)
+	kinds := make(map[eszip.ModuleKind]*kindSize)
+	packages := make(map[string]*packageSize)
+	for _, m := range sizes {
+		stats.SourceBytes += m.Source
+		stats.SourceMapBytes += m.SourceMap
+		k := kinds[m.Kind]
+		if k == nil {
+			k = &kindSize{Kind: m.Kind.String()}
+			kinds[m.Kind] = k
+		}
+		k.Modules++
+		k.SourceBytes += m.Source
+		k.SourceMapBytes += m.SourceMap
+		if id, _, ok := eszip.ParseNpmFileSpecifier(m.Specifier); ok {
+			p := packages[id.String()]
+			if p == nil {
+				p = &packageSize{Package: id.String()}
+				packages[id.String()] = p
+			}
+			p.Files++
+			p.Bytes += m.Source
+		}
+		if u, err := url.Parse(m.Specifier); err == nil && (u.Scheme == "http" || u.Scheme == "https") {
+			h := hosts[u.Host]
+			if h == nil {
+				h = &hostSize{Host: u.Host}
+				hosts[u.Host] = h
+			}
+			h.Modules++
+			h.SourceBytes += m.Source
+			h.SourceMapBytes += m.SourceMap
+		}
+	}
+	if stats.SourceBytes > 0 {
+		stats.SourceMapRatio = float64(stats.SourceMapBytes) / float64(stats.SourceBytes)
+	}
+
+	stats.Histogram = sourceHistogram(sizes)
+	stats.LargestModules = largest(sizes, top, func(m eszip.ModuleSize) int64 { return m.Source })
+	stats.LargestSourceMaps = largest(sizes, top, func(m eszip.ModuleSize) int64 { return m.SourceMap })
+
+	stats.Hosts = make([]hostSize, 0, len(hosts))
+	for _, h := range hosts {
+		stats.Hosts = append(stats.Hosts, *h)
+	}
+	sort.Slice(stats.Hosts, func(i, j int) bool {
+		ti := stats.Hosts[i].SourceBytes + stats.Hosts[i].SourceMapBytes
+		tj := stats.Hosts[j].SourceBytes + stats.Hosts[j].SourceMapBytes
+		if ti != tj {
+			return ti > tj
+		}
+		return stats.Hosts[i].Host < stats.Hosts[j].Host
+	})
+
+	stats.Kinds = make([]kindSize, 0, len(kinds))
+	for _, k := range kinds {
+		stats.Kinds = append(stats.Kinds, *k)
+	}
+	sort.Slice(stats.Kinds, func(i, j int) bool {
+		ti := stats.Kinds[i].SourceBytes + stats.Kinds[i].SourceMapBytes
+		tj := stats.Kinds[j].SourceBytes + stats.Kinds[j].SourceMapBytes
+		if ti != tj {
+			return ti > tj
+		}
+		return stats.Kinds[i].Kind < stats.Kinds[j].Kind
+	})
+
+	stats.NpmPackages = make([]packageSize, 0, len(packages))
+	for _, p := range packages {
+		stats.NpmPackages = append(stats.NpmPackages, *p)
+	}
+	sort.Slice(stats.NpmPackages, func(i, j int) bool {
+		if stats.NpmPackages[i].Bytes != stats.NpmPackages[j].Bytes {
+			return stats.NpmPackages[i].Bytes > stats.NpmPackages[j].Bytes
+		}
+		return stats.NpmPackages[i].Package < stats.NpmPackages[j].Package
+	})
+
+	return stats, nil
+}
+
+// checksumBytes counts the bytes of a V2 archive taken by checksums: one
+// for each hashed section read and one for each stored source and source
+// map. Content that modules share is stored, and hashed, once.
+func checksumBytes(summary eszip.Summary, sections map[string]int64, sizes []eszip.ModuleSize) int64 {
+	checksum, err := parseChecksum(summary.Checksum)
+	if err != nil {
+		return 0
+	}
+	size := int64(checksum.DigestSize())
+	if summary.ChecksumSize > 0 {
+		size = int64(summary.ChecksumSize)
+	}
+	hashes := 0
+	for _, name := range []string{"options", "modules", "npm", "module_headers", "module_aux", "npm_integrity"} {
+		if _, ok := sections[name]; ok {
+			hashes++
+		}
+	}
+	sources := make(map[int64]bool)
+	sourceMaps := make(map[int64]bool)
+	for _, m := range sizes {
+		if m.Source > 0 {
+			sources[m.SourceOffset] = true
+		}
+		if m.SourceMap > 0 {
+			sourceMaps[m.SourceMapOffset] = true
+		}
+	}
+	return int64(hashes+len(sources)+len(sourceMaps)) * size
+}
+
+// sourceHistogram buckets source sizes by powers of two. Empty sources get
+// a bucket of their own, [0, 1). Empty buckets between the smallest and
+// largest occupied ones are kept so the shape of the distribution shows.
+func sourceHistogram(sizes []eszip.ModuleSize) []histogramBucket {
+	if len(sizes) == 0 {
+		return nil
+	}
+	counts := make(map[int]int)
+	lo, hi := 64, -1
+	for _, m := range sizes {
+		k := bits.Len64(uint64(m.Source)) // 0 for empty, else floor(log2)+1
+		counts[k]++
+		lo = min(lo, k)
+		hi = max(hi, k)
+	}
+
+	buckets := make([]histogramBucket, 0, hi-lo+1)
+	for k := lo; k <= hi; k++ {
+		b := histogramBucket{Count: counts[k]}
+		if k > 0 {
+			b.Min = 1 << (k - 1)
+		}
+		b.Max = 1 << k
+		buckets = append(buckets, b)
+	}
+	return buckets
+}
+
+// largest returns up to n modules with the biggest non-zero size, biggest
+// first.
+func largest(sizes []eszip.ModuleSize, n int, size func(eszip.ModuleSize) int64) []moduleBytes {
+	out := make([]moduleBytes, 0, len(sizes))
+	for _, m := range sizes {
+		if s := size(m); s > 0 {
+			out = append(out, moduleBytes{Specifier: m.Specifier, Bytes: s})
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Bytes > out[j].Bytes })
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func writeStatsReport(w io.Writer, path string, stats *archiveStats) {
+	fmt.Fprintf(w, "File: %s\n", path)
+	fmt.Fprintf(w, "Size: %d bytes\n", stats.Size)
+
+	fmt.Fprintln(w, "\nSections:")
+	for _, s := range stats.Sections {
+		fmt.Fprintf(w, "  %-12s %12d bytes  %5.1f%%\n", s.Name, s.Bytes, percent(s.Bytes, stats.Size))
+	}
+
+	if len(stats.Histogram) > 0 {
+		fmt.Fprintln(w, "\nSource sizes:")
+		most := 0
+		for _, b := range stats.Histogram {
+			most = max(most, b.Count)
+		}
+		for _, b := range stats.Histogram {
+			bar := strings.Repeat("#", (b.Count*40+most-1)/most)
+			fmt.Fprintf(w, "  %9s - %-9s %6d %s\n", formatBytes(b.Min), formatBytes(b.Max), b.Count, bar)
+		}
+	}
+
+	printLargest(w, "Largest modules", stats.LargestModules)
+	printLargest(w, "Largest source maps", stats.LargestSourceMaps)
+
+	if len(stats.Hosts) > 0 {
+		fmt.Fprintln(w, "\nRemote hosts:")
+		for _, h := range stats.Hosts {
+			fmt.Fprintf(w, "  %-30s %5d modules %12d bytes\n", h.Host, h.Modules, h.SourceBytes+h.SourceMapBytes)
+		}
+	}
+
+	if len(stats.Kinds) > 0 {
+		fmt.Fprintln(w, "\nModule kinds:")
+		for _, k := range stats.Kinds {
+			fmt.Fprintf(w, "  %-30s %5d modules %12d bytes\n", k.Kind, k.Modules, k.SourceBytes+k.SourceMapBytes)
+		}
+	}
+
+	if len(stats.NpmPackages) > 0 {
+		fmt.Fprintln(w, "\nnpm packages:")
+		for _, p := range stats.NpmPackages {
+			fmt.Fprintf(w, "  %-30s %5d files   %12d bytes\n", p.Package, p.Files, p.Bytes)
+		}
+	}
+
+	if stats.ChecksumBytes > 0 {
+		fmt.Fprintf(w, "\nChecksums: %d bytes (%.1f%%)\n", stats.ChecksumBytes, percent(stats.ChecksumBytes, stats.Size))
+	}
+
+	fmt.Fprintf(w, "\nSource map / source bytes: %d / %d (%.2f)\n", stats.SourceMapBytes, stats.SourceBytes, stats.SourceMapRatio)
+}
+
+func printLargest(w io.Writer, title string, modules []moduleBytes) {
+	if len(modules) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\n%s:\n", title)
+	for _, m := range modules {
+		fmt.Fprintf(w, "  %12d  %s\n", m.Bytes, m.Specifier)
+	}
+}
+
+func percent(n, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(n) * 100 / float64(total)
+}
+
+// formatBytes renders n with a binary unit, e.g. "512 B" or "4 KiB".
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	value := float64(n) / float64(div)
+	if value == float64(int64(value)) {
+		return fmt.Sprintf("%d %ciB", int64(value), "KMGTPE"[exp])
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTPE"[exp])
+}
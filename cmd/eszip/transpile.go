@@ -0,0 +1,127 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// externalTool runs a command, such as esbuild, with a module on stdin and
+// reads the result from its stdout. Arguments equal to "{}" are replaced
+// by the specifier.
+type externalTool struct {
+	ctx  context.Context
+	argv []string
+}
+
+// newExternalTool splits command, given with flag, into arguments on
+// whitespace; no shell is involved.
+func newExternalTool(ctx context.Context, flag, command string) (*externalTool, error) {
+	argv := strings.Fields(command)
+	if len(argv) == 0 {
+		return nil, fmt.Errorf("%s: empty command", flag)
+	}
+	return &externalTool{ctx: ctx, argv: argv}, nil
+}
+
+// run runs the tool for specifier with stdin and returns its stdout.
+func (t *externalTool) run(specifier string, stdin []byte) ([]byte, error) {
+	args := make([]string, len(t.argv)-1)
+	for i, arg := range t.argv[1:] {
+		if arg == "{}" {
+			arg = specifier
+		}
+		args[i] = arg
+	}
+	cmd := exec.CommandContext(t.ctx, t.argv[0], args...)
+	cmd.Stdin = bytes.NewReader(stdin)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %w: %s", t.argv[0], err, msg)
+		}
+		return nil, fmt.Errorf("%s: %w", t.argv[0], err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// commandTranspiler is an eszip.Transpiler that runs an external tool
+// with the source on stdin and reads JavaScript from its stdout. A source
+// map the tool inlines as a data: URL becomes the module's source map.
+type commandTranspiler struct {
+	*externalTool
+}
+
+func newCommandTranspiler(ctx context.Context, command string) (*commandTranspiler, error) {
+	tool, err := newExternalTool(ctx, "--transpiler", command)
+	if err != nil {
+		return nil, err
+	}
+	return &commandTranspiler{tool}, nil
+}
+
+func (t *commandTranspiler) Transpile(specifier string, source []byte) ([]byte, []byte, error) {
+	out, err := t.run(specifier, source)
+	if err != nil {
+		return nil, nil, err
+	}
+	code, sourceMap := eszip.SplitInlineSourceMap(out)
+	return code, sourceMap, nil
+}
+
+// commandMinifier is an eszip.Minifier that runs an external tool with
+// the code on stdin and reads minified JavaScript from its stdout. A
+// module's source map is inlined into the input as a data: URL, so tools
+// that chain source maps, such as esbuild, map the output back to the
+// original source; a map the tool inlines becomes the module's source map.
+type commandMinifier struct {
+	*externalTool
+}
+
+func newCommandMinifier(ctx context.Context, command string) (*commandMinifier, error) {
+	tool, err := newExternalTool(ctx, "--minifier", command)
+	if err != nil {
+		return nil, err
+	}
+	return &commandMinifier{tool}, nil
+}
+
+func (m *commandMinifier) Minify(specifier string, code, sourceMap []byte) ([]byte, []byte, error) {
+	input := code
+	if sourceMap != nil {
+		body := bytes.TrimRight(code, "\n")
+		input = append(body[:len(body):len(body)], "\n//# sourceMappingURL=data:application/json;base64,"...)
+		input = base64.StdEncoding.AppendEncode(input, sourceMap)
+		input = append(input, '\n')
+	}
+	out, err := m.run(specifier, input)
+	if err != nil {
+		return nil, nil, err
+	}
+	minified, minifiedMap := eszip.SplitInlineSourceMap(out)
+	return minified, minifiedMap, nil
+}
+
+// printMinified reports how much minifying saved, from the original sizes
+// report records for the modules written.
+func (a *app) printMinified(archive *eszip.EszipV2, report *eszip.WriteReport) {
+	if len(report.OriginalSizes) == 0 {
+		return
+	}
+	var before, after int64
+	for _, size := range archive.ModuleSizes() {
+		if original, ok := report.OriginalSizes[size.Specifier]; ok {
+			before += original
+			after += size.Source
+		}
+	}
+	fmt.Fprintf(a.stdout, "Minified: %d module(s), %d -> %d bytes\n", len(report.OriginalSizes), before, after)
+}
@@ -0,0 +1,104 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/JakeChampion/eszip"
+	"github.com/spf13/cobra"
+)
+
+// errVerifyFailed makes verify exit with status 1 once the problems are
+// printed.
+var errVerifyFailed = errors.New("verification failed")
+
+// verifyOutput is the JSON form of an eszip.VerifyReport.
+type verifyOutput struct {
+	OK        bool            `json:"ok"`
+	Modules   int             `json:"modules"`
+	Redirects int             `json:"redirects"`
+	Bytes     int64           `json:"bytes"`
+	Problems  []verifyProblem `json:"problems"`
+}
+
+type verifyProblem struct {
+	Kind      string `json:"kind"`
+	Specifier string `json:"specifier,omitempty"`
+	SourceMap bool   `json:"source_map,omitempty"`
+	Detail    string `json:"detail"`
+}
+
+func (a *app) verifyCmd() *cobra.Command {
+	var allowedOrigins []string
+
+	cmd := &cobra.Command{
+		Use:   "verify <archive>",
+		Short: "Check an eszip archive for corruption",
+		Long: `Check every part of a V2 archive: the header checksums, the checksum of
+each source and source map, that recorded offsets lie within their section
+and do not overlap, and that every redirect reaches a module. All problems
+are listed, rather than stopping at the first.
+
+--allowed-origins also reports every http or https specifier from a host
+not in the list; "*.example.com" allows every subdomain.
+
+The exit status is 0 if the archive is sound and 1 otherwise.`,
+		Example: `  eszip verify app.eszip2
+  eszip verify --allowed-origins deno.land,*.esm.sh app.eszip2
+  eszip verify --json app.eszip2 | jq '.problems[].kind'`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			f, err := os.Open(args[0])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			stat, err := f.Stat()
+			if err != nil {
+				return err
+			}
+
+			opts := a.parseOptions()
+			if cmd.Flags().Changed("allowed-origins") {
+				opts = append(opts, eszip.WithAllowedOrigins(allowedOrigins...))
+			}
+			report, err := eszip.VerifyArchive(cmd.Context(), f, stat.Size(), opts...)
+			if err != nil {
+				return err
+			}
+
+			if a.json {
+				out := verifyOutput{
+					OK:        report.OK(),
+					Modules:   report.Modules,
+					Redirects: report.Redirects,
+					Bytes:     report.Bytes,
+					Problems:  []verifyProblem{},
+				}
+				for _, p := range report.Problems {
+					out.Problems = append(out.Problems, verifyProblem{
+						Kind:      p.Kind.String(),
+						Specifier: p.Specifier,
+						SourceMap: p.SourceMap,
+						Detail:    p.Detail,
+					})
+				}
+				if err := a.writeJSON(out); err != nil {
+					return err
+				}
+			} else {
+				fmt.Fprintln(a.stdout, report)
+			}
+			if !report.OK() {
+				return errVerifyFailed
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&allowedOrigins, "allowed-origins", nil, "Report every remote specifier whose host is not in this comma-separated list")
+	return cmd
+}
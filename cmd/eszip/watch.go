@@ -0,0 +1,87 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long the files must stay unchanged before a
+// rebuild, so that an editor saving several files, or saving one in
+// several steps, causes one rebuild.
+const watchDebounce = 100 * time.Millisecond
+
+// watch runs build, then runs it again whenever one of the files the last
+// run reported changes, until ctx is done. Their directories are watched
+// rather than the files, so that editors which save by replacing a file,
+// and files that did not exist yet, are seen. A failed build is reported
+// and watching goes on.
+func (a *app) watch(ctx context.Context, build func(rebuild bool) ([]string, error)) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("watching inputs: %w", err)
+	}
+	defer watcher.Close()
+
+	files := make(map[string]bool)
+	dirs := make(map[string]bool)
+	// update watches the directories of paths, and only those.
+	update := func(paths []string, err error) {
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintf(a.stderr, "Build failed: %v\n", err)
+		}
+		clear(files)
+		wanted := make(map[string]bool)
+		for _, path := range paths {
+			files[path] = true
+			wanted[filepath.Dir(path)] = true
+		}
+		for dir := range dirs {
+			if !wanted[dir] {
+				watcher.Remove(dir)
+				delete(dirs, dir)
+			}
+		}
+		for dir := range wanted {
+			// A directory that does not exist yet cannot be watched; a
+			// file created in it is only seen once something else
+			// triggers a rebuild.
+			if !dirs[dir] && watcher.Add(dir) == nil {
+				dirs[dir] = true
+			}
+		}
+	}
+
+	update(build(false))
+	fmt.Fprintf(a.stdout, "Watching %d file(s) for changes\n", len(files))
+
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if files[filepath.Clean(event.Name)] && event.Op != fsnotify.Chmod {
+				timer.Reset(watchDebounce)
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			fmt.Fprintf(a.stderr, "Warning: watching inputs: %v\n", err)
+		case <-timer.C:
+			update(build(true))
+		}
+	}
+}
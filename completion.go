@@ -0,0 +1,81 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// Completion loads the sources of a streamed archive under the caller's
+// control. Each call to Next reads one source or source map from the input,
+// so a caller that only needs the first few modules can stop early and
+// leave the rest of the stream unread. Sources come before source maps, in
+// the order the archive stores them.
+//
+// A Completion is safe for concurrent use; Next calls are serialized and
+// Abort waits for one in progress, so cancel its context to stop a read
+// blocked on the input.
+type Completion struct {
+	mu      sync.Mutex
+	next    func() (string, bool, error)
+	abort   func()
+	done    bool
+	aborted bool
+	err     error
+}
+
+func newCompletion(next func() (string, bool, error), abort func()) *Completion {
+	return &Completion{next: next, abort: abort}
+}
+
+// ParseIncremental parses an archive's headers like Parse and returns a
+// Completion for loading its sources step by step instead of in one call.
+func ParseIncremental(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipUnion, *Completion, error) {
+	return parse(ctx, r, opts)
+}
+
+// Next loads one source or source map and returns the specifier it belongs
+// to; when several modules share the content, the first of them. done is
+// true, with an empty specifier, once everything is loaded or after Abort.
+// An error is returned again by every later call.
+func (c *Completion) Next(ctx context.Context) (specifier string, done bool, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case c.err != nil:
+		return "", false, c.err
+	case c.done || c.aborted:
+		return "", true, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return "", false, err
+	}
+	specifier, c.done, c.err = c.next()
+	return specifier, c.done, c.err
+}
+
+// Complete calls Next until everything is loaded.
+func (c *Completion) Complete(ctx context.Context) error {
+	for {
+		_, done, err := c.Next(ctx)
+		if err != nil || done {
+			return err
+		}
+	}
+}
+
+// Abort stops loading. Sources not yet loaded enter SourceSlotNotLoaded,
+// and reading them, including from callers already waiting, fails with
+// ErrSourceNotLoaded. Loaded sources stay usable. Abort after everything is
+// loaded does nothing.
+func (c *Completion) Abort() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done || c.aborted {
+		return
+	}
+	c.aborted = true
+	c.abort()
+}
@@ -0,0 +1,133 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/JakeChampion/eszip/internal/zstd"
+)
+
+// CompressionType is the algorithm sources and source maps are compressed
+// with. It is recorded as option 2 of the V2.2+ options header, which is
+// left out for CompressionNone so uncompressed archives are unchanged.
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = 0
+	CompressionGzip CompressionType = 1
+	// CompressionZstd compresses each section as a single Zstandard frame.
+	// The writer favours a small, dependency-free encoder over ratio, so
+	// its output is somewhat larger than the reference zstd's; reading
+	// accepts any frame that does not need a dictionary.
+	CompressionZstd CompressionType = 2
+)
+
+// optionCompression is the options header key for the compression type.
+const optionCompression = 2
+
+// maxDecompressedSize bounds the decompressed size of each source and
+// source map when ParseOptions.MaxSectionSize is not set, so that a small
+// crafted archive cannot inflate to fill memory.
+const maxDecompressedSize = 1 << 30
+
+func (c CompressionType) String() string {
+	switch c {
+	case CompressionNone:
+		return "none"
+	case CompressionGzip:
+		return "gzip"
+	case CompressionZstd:
+		return "zstd"
+	default:
+		return "unknown"
+	}
+}
+
+// CompressionFromU8 converts a byte to a CompressionType.
+func CompressionFromU8(b uint8) (CompressionType, bool) {
+	switch b {
+	case 0:
+		return CompressionNone, true
+	case 1:
+		return CompressionGzip, true
+	case 2:
+		return CompressionZstd, true
+	default:
+		return 0, false
+	}
+}
+
+// compress returns data compressed with c. Empty data stays empty, so
+// empty sources keep taking no space.
+func (c CompressionType) compress(data []byte) ([]byte, error) {
+	if c == CompressionNone || len(data) == 0 {
+		return data, nil
+	}
+	switch c {
+	case CompressionGzip:
+		var buf bytes.Buffer
+		// A zero header (no name, no modification time) keeps the output
+		// deterministic.
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(data); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case CompressionZstd:
+		return zstd.Compress(data), nil
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}
+}
+
+// decompress reverses compress, failing if the result would be longer
+// than limit bytes.
+func (c CompressionType) decompress(data []byte, limit int64) ([]byte, error) {
+	if c == CompressionNone || len(data) == 0 {
+		return data, nil
+	}
+	switch c {
+	case CompressionGzip:
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		zr.Multistream(false)
+		out, err := io.ReadAll(io.LimitReader(zr, limit+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > limit {
+			return nil, fmt.Errorf("decompressed content exceeds %d bytes", limit)
+		}
+		return out, zr.Close()
+	case CompressionZstd:
+		out, err := zstd.Decompress(data, limit)
+		if errors.Is(err, zstd.ErrTooLarge) {
+			return nil, fmt.Errorf("decompressed content exceeds %d bytes", limit)
+		}
+		return out, err
+	default:
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}
+}
+
+// SetCompression sets the algorithm sources and source maps are compressed
+// with when the archive is written. Compressed archives can only be read
+// by parsers that understand the compression option; Deno's do not. The
+// lengths recorded in the header, and so the sizes that Summary and
+// ModuleSizes report for content not yet loaded, are compressed sizes.
+// It has the same concurrency guarantees as SetChecksum.
+func (e *EszipV2) SetCompression(compression CompressionType) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.options.Compression = compression
+}
@@ -0,0 +1,112 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ErrNotConvertible is returned when an archive uses features the target
+// format cannot represent.
+var ErrNotConvertible = errors.New("eszip: archive cannot be converted")
+
+// ConvertV1ToV2 returns a V2 archive with the modules and redirects of a
+// V1 archive, in specifier order and without checksums, as NewV2 creates
+// it. Each module's transpiled source is used where the V1 archive has
+// one, as Source returns; original sources, content types and dependency
+// lists have no place in V2 and are dropped. e is not changed.
+func ConvertV1ToV2(e *EszipV1) (*EszipV2, error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	out := NewV2()
+	var redirects []string
+	for _, spec := range slices.Sorted(maps.Keys(e.parsedModules)) {
+		info := e.parsedModules[spec]
+		switch {
+		case info.isRedirect:
+			redirects = append(redirects, spec)
+		case info.source != nil:
+			source := info.source.Source
+			if info.source.Transpiled != nil {
+				source = *info.source.Transpiled
+			}
+			out.AddModule(spec, ModuleKindJavaScript, []byte(source), nil)
+		default:
+			return nil, fmt.Errorf("%w: %s has neither a source nor a redirect", ErrNotConvertible, spec)
+		}
+	}
+	for _, spec := range redirects {
+		out.AddRedirect(spec, e.parsedModules[spec].redirect)
+	}
+	return out, nil
+}
+
+// ConvertV2ToV1 returns a V1 archive with the modules and redirects of a
+// V2 archive, for consumers that only read the JSON format. Each module's
+// dependencies are the imports found by ScanImports, resolved against its
+// specifier, so a V1 archive converted to V2 and back keeps the
+// dependencies that are its modules' imports. V1 holds
+// JavaScript modules and redirects alone, so an archive with other module
+// kinds (including an import map or archive metadata), source maps or an
+// npm snapshot fails with ErrNotConvertible; Normalize with
+// StripSourceMaps drops source maps first. Sources still streaming in are
+// waited for on ctx.
+func ConvertV2ToV1(ctx context.Context, e *EszipV2) (*EszipV1, error) {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	hasNpm := e.npmSnapshot != nil
+	e.mu.RUnlock()
+	if hasNpm {
+		return nil, fmt.Errorf("%w: V1 has no npm snapshot", ErrNotConvertible)
+	}
+
+	out := NewV1()
+	for i, spec := range keys {
+		switch m := entries[i].(type) {
+		case *ModuleData:
+			if m.Kind != ModuleKindJavaScript {
+				return nil, fmt.Errorf("%w: %s is a %s module; V1 holds JavaScript only", ErrNotConvertible, spec, m.Kind)
+			}
+			sourceMap, err := m.SourceMap.Get(ctx)
+			if err != nil {
+				return nil, err
+			}
+			if len(sourceMap) > 0 {
+				return nil, fmt.Errorf("%w: %s has a source map; V1 has none", ErrNotConvertible, spec)
+			}
+			if len(m.Aux) > 0 {
+				return nil, fmt.Errorf("%w: %s has auxiliary data; V1 has none", ErrNotConvertible, spec)
+			}
+			source, err := m.Source.Get(ctx)
+			if err != nil {
+				return nil, err
+			}
+			out.AddModule(spec, source, v1Dependencies(spec, source))
+		case *ModuleRedirect:
+			out.AddRedirect(spec, m.Target)
+		default:
+			return nil, fmt.Errorf("%w: %s is an npm specifier", ErrNotConvertible, spec)
+		}
+	}
+	return out, nil
+}
+
+// v1Dependencies returns the specifiers source imports, resolved against
+// specifier, in source order and without duplicates. Bare specifiers, which
+// V1 has no import map to resolve, and runtime built-ins are left out.
+func v1Dependencies(specifier string, source []byte) []string {
+	var deps []string
+	for _, ref := range ScanImports(source) {
+		target, ok := resolveImport(specifier, ref.Specifier, nil)
+		if !ok || isBuiltinImport(target) || slices.Contains(deps, target) {
+			continue
+		}
+		deps = append(deps, target)
+	}
+	return deps
+}
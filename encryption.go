@@ -0,0 +1,150 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+// EncryptionType is the cipher sources and source maps are encrypted with.
+// It is recorded as option 3 of the V2.2+ options header, which is left
+// out for EncryptionNone so unencrypted archives are unchanged. Headers,
+// specifiers and the npm snapshot stay in the clear.
+type EncryptionType uint8
+
+const (
+	EncryptionNone EncryptionType = 0
+	// EncryptionAESGCM seals each source and source map on its own with
+	// AES-GCM under a fresh random nonce, which is stored before the
+	// ciphertext. The key size (16, 24 or 32 bytes) selects AES-128,
+	// AES-192 or AES-256. The module's specifier and whether the content
+	// is a source or a source map are authenticated with it, so content
+	// moved to another module or section fails to decrypt, and modules
+	// cannot share encrypted content.
+	EncryptionAESGCM EncryptionType = 1
+)
+
+// optionEncryption is the options header key for the encryption type.
+const optionEncryption = 3
+
+// ErrMissingKey is returned when an encrypted archive is parsed without
+// WithDecryptionKey or written without a KeyProvider.
+var ErrMissingKey = errors.New("eszip: encryption key required")
+
+func (t EncryptionType) String() string {
+	switch t {
+	case EncryptionNone:
+		return "none"
+	case EncryptionAESGCM:
+		return "aes-gcm"
+	default:
+		return "unknown"
+	}
+}
+
+// EncryptionFromU8 converts a byte to an EncryptionType.
+func EncryptionFromU8(b uint8) (EncryptionType, bool) {
+	switch b {
+	case 0:
+		return EncryptionNone, true
+	case 1:
+		return EncryptionAESGCM, true
+	default:
+		return 0, false
+	}
+}
+
+// KeyProvider supplies the key content is encrypted and decrypted with. It
+// is asked once per parse or write, so implementations may fetch the key
+// from a secret store.
+type KeyProvider interface {
+	EncryptionKey(ctx context.Context) ([]byte, error)
+}
+
+// StaticKey is a KeyProvider that always returns the same key.
+type StaticKey []byte
+
+// EncryptionKey returns k.
+func (k StaticKey) EncryptionKey(context.Context) ([]byte, error) {
+	return k, nil
+}
+
+// newAEAD returns the cipher for t with the key from keys.
+func (t EncryptionType) newAEAD(ctx context.Context, keys KeyProvider) (cipher.AEAD, error) {
+	if keys == nil {
+		return nil, fmt.Errorf("%w: content is encrypted with %s", ErrMissingKey, t)
+	}
+	key, err := keys.EncryptionKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("eszip: getting encryption key: %w", err)
+	}
+	switch t {
+	case EncryptionAESGCM:
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("eszip: %w", err)
+		}
+		return cipher.NewGCM(block)
+	default:
+		return nil, fmt.Errorf("eszip: unknown encryption %d", t)
+	}
+}
+
+// encrypt returns data, the source or source map of specifier, sealed
+// under a random nonce, which is prepended. Empty data stays empty, so
+// empty sources keep taking no space.
+func (o Options) encrypt(data []byte, specifier string, sourceMap bool) ([]byte, error) {
+	if o.aead == nil || len(data) == 0 {
+		return data, nil
+	}
+	nonce := make([]byte, o.aead.NonceSize(), o.aead.NonceSize()+len(data)+o.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return o.aead.Seal(nonce, nonce, data, contentAAD(specifier, sourceMap)), nil
+}
+
+// decrypt reverses encrypt. It fails if data was sealed for another
+// module or section.
+func (o Options) decrypt(data []byte, specifier string, sourceMap bool) ([]byte, error) {
+	if o.aead == nil || len(data) == 0 {
+		return data, nil
+	}
+	if len(data) < o.aead.NonceSize() {
+		return nil, errors.New("ciphertext shorter than its nonce")
+	}
+	nonce, ciphertext := data[:o.aead.NonceSize()], data[o.aead.NonceSize():]
+	return o.aead.Open(nil, nonce, ciphertext, contentAAD(specifier, sourceMap))
+}
+
+// contentAAD returns the additional data content is sealed with: a byte
+// naming the section, 0 for sources and 1 for source maps, followed by the
+// specifier.
+func contentAAD(specifier string, sourceMap bool) []byte {
+	aad := make([]byte, 1, 1+len(specifier))
+	if sourceMap {
+		aad[0] = 1
+	}
+	return append(aad, specifier...)
+}
+
+// SetEncryption sets the cipher sources and source maps are encrypted with
+// when the archive is written, and the provider of its key. Encrypted
+// archives need format v2.2 or later and can only be read by parsers given
+// the key with WithDecryptionKey; Deno's cannot read them. Because every
+// write draws fresh nonces, encrypted output is never byte-identical
+// between writes, even with WithDeterministicWrite.
+// Archives parsed with WithDecryptionKey keep its provider, so writing
+// them encrypts with the same key.
+// It has the same concurrency guarantees as SetChecksum.
+func (e *EszipV2) SetEncryption(encryption EncryptionType, keys KeyProvider) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.options.Encryption = encryption
+	e.keys = keys
+}
@@ -0,0 +1,88 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// EntrypointsSpecifier is the reserved specifier under which the archive's
+// entrypoints are stored, as an opaque data module holding a JSON array of
+// specifiers. Like the archive metadata, readers that do not know about it
+// see ordinary opaque data.
+const EntrypointsSpecifier = "eszip:entrypoints"
+
+// SetEntrypoints records the modules a runtime should evaluate first, in
+// order, replacing any set before; duplicates after the first are dropped.
+// The specifiers are not checked against the archive's modules, which may
+// be added later. The entry is placed first, after the import map and the
+// archive metadata if there are any, so that streaming readers get it
+// before any module source. An empty or nil slice removes the entrypoints.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) SetEntrypoints(specifiers []string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(specifiers) == 0 {
+		e.modules.Remove(EntrypointsSpecifier)
+		return
+	}
+
+	var unique []string
+	for _, spec := range specifiers {
+		if !slices.Contains(unique, spec) {
+			unique = append(unique, spec)
+		}
+	}
+	content, _ := json.Marshal(unique)
+	pos := 0
+	keys, entries := e.modules.snapshot()
+	if leadingImportMap(e.importMap, keys, entries) != "" {
+		pos = 1
+	}
+	if pos < len(keys) && keys[pos] == ArchiveMetadataSpecifier {
+		pos++
+	}
+	e.modules.insertAt(pos, EntrypointsSpecifier, &ModuleData{
+		Kind:      ModuleKindOpaqueData,
+		Source:    NewReadySourceSlot(content),
+		SourceMap: NewEmptySourceSlot(),
+	})
+}
+
+// Entrypoints returns the entrypoints recorded with SetEntrypoints, or nil
+// if there are none. For a streaming parse it waits only for the
+// entrypoints entry, which precedes every module source. Content that is
+// not a JSON array of strings is reported as an ErrInvalidArchiveMetadata
+// ParseError.
+func (e *EszipV2) Entrypoints(ctx context.Context) ([]string, error) {
+	mod, ok := e.modules.Get(EntrypointsSpecifier)
+	if !ok {
+		return nil, nil
+	}
+	data, ok := mod.(*ModuleData)
+	if !ok || data.Kind != ModuleKindOpaqueData {
+		return nil, errInvalidArchiveMetadata(fmt.Errorf("%s: entry is not opaque data", EntrypointsSpecifier))
+	}
+
+	content, err := data.Source.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var entrypoints []string
+	if err := json.Unmarshal(content, &entrypoints); err != nil {
+		return nil, errInvalidArchiveMetadata(fmt.Errorf("%s: %w", EntrypointsSpecifier, err))
+	}
+	return entrypoints, nil
+}
+
+// Entrypoints returns the recorded entrypoints. V1 archives have none.
+func (e *EszipUnion) Entrypoints(ctx context.Context) ([]string, error) {
+	if e.v1 != nil {
+		return nil, nil
+	}
+	return e.v2.Entrypoints(ctx)
+}
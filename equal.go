@@ -0,0 +1,369 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// EqualOptions controls what Equal compares.
+type EqualOptions struct {
+	// IgnoreSourceMaps skips comparing source maps.
+	IgnoreSourceMaps bool
+	// IgnoreNpmSnapshot skips comparing the npm resolution snapshot.
+	IgnoreNpmSnapshot bool
+	// All collects every divergence instead of stopping at the first.
+	All bool
+}
+
+// DifferenceKind classifies a divergence found by Equal.
+type DifferenceKind int
+
+const (
+	// DiffMissing means a specifier is present in only one archive.
+	DiffMissing DifferenceKind = iota
+	// DiffEntryType means a specifier is a module in one archive and a
+	// redirect in the other.
+	DiffEntryType
+	// DiffModuleKind means a module has a different ModuleKind.
+	DiffModuleKind
+	// DiffSource means a module's source bytes differ.
+	DiffSource
+	// DiffSourceMap means a module's source map bytes differ.
+	DiffSourceMap
+	// DiffRedirect means a redirect points at a different target.
+	DiffRedirect
+	// DiffImportMap means the content of the import map differs.
+	DiffImportMap
+	// DiffNpmSnapshot means the npm resolution snapshots differ.
+	DiffNpmSnapshot
+	// DiffHeaders means a module's headers differ.
+	DiffHeaders
+	// DiffAux means a module's auxiliary data differs.
+	DiffAux
+)
+
+func (k DifferenceKind) String() string {
+	switch k {
+	case DiffMissing:
+		return "missing"
+	case DiffEntryType:
+		return "entry_type"
+	case DiffModuleKind:
+		return "module_kind"
+	case DiffSource:
+		return "source"
+	case DiffSourceMap:
+		return "source_map"
+	case DiffRedirect:
+		return "redirect"
+	case DiffImportMap:
+		return "import_map"
+	case DiffNpmSnapshot:
+		return "npm_snapshot"
+	case DiffHeaders:
+		return "headers"
+	case DiffAux:
+		return "aux"
+	default:
+		return "unknown"
+	}
+}
+
+// Divergence is one way in which two archives differ.
+type Divergence struct {
+	Kind DifferenceKind
+	// Specifier is the module concerned; it is empty for DiffNpmSnapshot.
+	Specifier string
+	// Detail describes the divergence for humans.
+	Detail string
+}
+
+func (d Divergence) String() string {
+	if d.Specifier == "" {
+		return fmt.Sprintf("%s: %s", d.Kind, d.Detail)
+	}
+	return fmt.Sprintf("%s %s: %s", d.Kind, d.Specifier, d.Detail)
+}
+
+// Difference lists the divergences found by Equal, in specifier order. It
+// holds only the first unless EqualOptions.All was set.
+type Difference struct {
+	Divergences []Divergence
+}
+
+func (d *Difference) String() string {
+	lines := make([]string, len(d.Divergences))
+	for i, div := range d.Divergences {
+		lines[i] = div.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Equal reports whether a and b hold the same content, regardless of entry
+// order, checksum algorithm or format version. It compares the set of
+// specifiers, module kinds, module headers, sources, source maps, redirect
+// targets, the import map and the npm snapshot, waiting on ctx for sources that are
+// still streaming in. When the archives differ, the Difference says how.
+//
+// V1 archives have no source maps, import map or npm snapshot, so those
+// compare as empty.
+func Equal(ctx context.Context, a, b *EszipUnion, opts EqualOptions) (bool, *Difference, error) {
+	diff := &Difference{}
+	done := func() bool { return !opts.All && len(diff.Divergences) > 0 }
+	add := func(kind DifferenceKind, specifier, format string, args ...any) {
+		diff.Divergences = append(diff.Divergences, Divergence{Kind: kind, Specifier: specifier, Detail: fmt.Sprintf(format, args...)})
+	}
+
+	ea, eb := a.equalEntries(), b.equalEntries()
+
+	// Import maps are ordinary modules; only how a difference is reported
+	// depends on whether either archive uses the module as its import map.
+	importMaps := map[string]bool{a.Summary().ImportMap: true, b.Summary().ImportMap: true}
+	delete(importMaps, "")
+
+	specifiers := slices.Collect(maps.Keys(ea))
+	for spec := range eb {
+		if _, ok := ea[spec]; !ok {
+			specifiers = append(specifiers, spec)
+		}
+	}
+	slices.Sort(specifiers)
+
+	for _, spec := range specifiers {
+		if done() {
+			break
+		}
+		x, inA := ea[spec]
+		y, inB := eb[spec]
+		switch {
+		case !inA:
+			add(DiffMissing, spec, "only in b")
+			continue
+		case !inB:
+			add(DiffMissing, spec, "only in a")
+			continue
+		case x.data != nil && y.data == nil:
+			add(DiffEntryType, spec, "module in a, redirect in b")
+			continue
+		case x.data == nil && y.data != nil:
+			add(DiffEntryType, spec, "redirect in a, module in b")
+			continue
+		case x.data == nil:
+			if x.target != y.target {
+				add(DiffRedirect, spec, "redirects to %q in a, %q in b", x.target, y.target)
+			}
+			continue
+		}
+
+		if x.data.Kind != y.data.Kind {
+			add(DiffModuleKind, spec, "%s in a, %s in b", x.data.Kind, y.data.Kind)
+			if done() {
+				break
+			}
+		}
+
+		if !maps.Equal(x.data.Headers, y.data.Headers) {
+			add(DiffHeaders, spec, "headers differ")
+			if done() {
+				break
+			}
+		}
+
+		if !maps.EqualFunc(x.data.Aux, y.data.Aux, bytes.Equal) {
+			add(DiffAux, spec, "auxiliary data differs")
+			if done() {
+				break
+			}
+		}
+
+		same, err := sameContent(ctx, x.data.Source, y.data.Source)
+		if err != nil {
+			return false, nil, err
+		}
+		if !same {
+			if importMaps[spec] {
+				add(DiffImportMap, spec, "import map content differs")
+			} else {
+				add(DiffSource, spec, "source differs")
+			}
+			if done() {
+				break
+			}
+		}
+
+		if opts.IgnoreSourceMaps {
+			continue
+		}
+		same, err = sameContent(ctx, x.data.SourceMap, y.data.SourceMap)
+		if err != nil {
+			return false, nil, err
+		}
+		if !same {
+			add(DiffSourceMap, spec, "source map differs")
+		}
+	}
+
+	if !opts.IgnoreNpmSnapshot {
+		for _, detail := range npmSnapshotDifferences(a.npmSnapshot(), b.npmSnapshot()) {
+			if done() {
+				break
+			}
+			add(DiffNpmSnapshot, "", "%s", detail)
+		}
+	}
+
+	if len(diff.Divergences) > 0 {
+		return false, diff, nil
+	}
+	return true, nil, nil
+}
+
+// equalEntry is a module or redirect reduced to what Equal compares. data
+// is nil for redirects.
+type equalEntry struct {
+	data   *ModuleData
+	target string
+}
+
+// equalEntries indexes the archive's modules and redirects by specifier.
+// npm specifier entries are covered by the npm snapshot comparison.
+func (e *EszipUnion) equalEntries() map[string]equalEntry {
+	entries := make(map[string]equalEntry)
+	if e.v1 != nil {
+		e.v1.mu.RLock()
+		defer e.v1.mu.RUnlock()
+		for spec, info := range e.v1.parsedModules {
+			switch {
+			case info.isRedirect:
+				entries[spec] = equalEntry{target: info.redirect}
+			case info.source != nil:
+				source := info.source.Source
+				if info.source.Transpiled != nil {
+					source = *info.source.Transpiled
+				}
+				entries[spec] = equalEntry{
+					data: &ModuleData{
+						Kind:      ModuleKindJavaScript,
+						Source:    NewReadySourceSlot([]byte(source)),
+						SourceMap: NewEmptySourceSlot(),
+					},
+				}
+			}
+		}
+		return entries
+	}
+
+	e.v2.mu.RLock()
+	keys, modules := e.v2.modules.snapshot()
+	e.v2.mu.RUnlock()
+	for i, mod := range modules {
+		switch m := mod.(type) {
+		case *ModuleData:
+			entries[keys[i]] = equalEntry{data: m}
+		case *ModuleRedirect:
+			entries[keys[i]] = equalEntry{target: m.Target}
+		}
+	}
+	return entries
+}
+
+func (e *EszipUnion) npmSnapshot() *NpmResolutionSnapshot {
+	if e.v2 == nil {
+		return nil
+	}
+	e.v2.mu.RLock()
+	defer e.v2.mu.RUnlock()
+	return e.v2.npmSnapshot
+}
+
+// sameContent compares two slots, waiting for either to finish loading.
+// Only loaded lengths are compared up front: the length a header records
+// for content not yet loaded is its compressed or encrypted length.
+func sameContent(ctx context.Context, a, b *SourceSlot) (bool, error) {
+	if a.State() == SourceSlotReady && b.State() == SourceSlotReady && a.declaredLen() != b.declaredLen() {
+		return false, nil
+	}
+	x, err := a.Get(ctx)
+	if err != nil {
+		return false, err
+	}
+	y, err := b.Get(ctx)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(x, y), nil
+}
+
+// npmSnapshotDifferences describes each root requirement that resolves
+// differently in the two snapshots and each package that is in only one or
+// has different dependencies or integrity, roots first and each group
+// sorted. It returns nil if the snapshots are the same. A nil snapshot
+// equals an empty one.
+func npmSnapshotDifferences(a, b *NpmResolutionSnapshot) []string {
+	roots := func(s *NpmResolutionSnapshot) map[string]string {
+		out := make(map[string]string)
+		if s != nil {
+			for req, id := range s.RootPackages {
+				out[req] = id.String()
+			}
+		}
+		return out
+	}
+	type resolved struct {
+		deps               map[string]string
+		integrity, tarball string
+	}
+	packages := func(s *NpmResolutionSnapshot) map[string]resolved {
+		out := make(map[string]resolved)
+		if s != nil {
+			for _, pkg := range s.Packages {
+				deps := make(map[string]string, len(pkg.Dependencies))
+				for req, id := range pkg.Dependencies {
+					deps[req] = id.String()
+				}
+				out[pkg.ID.String()] = resolved{deps, pkg.Integrity, pkg.Tarball}
+			}
+		}
+		return out
+	}
+
+	var diffs []string
+	ra, rb := roots(a), roots(b)
+	for _, req := range slices.Sorted(maps.Keys(ra)) {
+		if id, ok := rb[req]; !ok {
+			diffs = append(diffs, fmt.Sprintf("root %q only in a", req))
+		} else if ra[req] != id {
+			diffs = append(diffs, fmt.Sprintf("root %q resolves to %q in a, %q in b", req, ra[req], id))
+		}
+	}
+	for _, req := range slices.Sorted(maps.Keys(rb)) {
+		if _, ok := ra[req]; !ok {
+			diffs = append(diffs, fmt.Sprintf("root %q only in b", req))
+		}
+	}
+
+	pa, pb := packages(a), packages(b)
+	for _, id := range slices.Sorted(maps.Keys(pa)) {
+		other, ok := pb[id]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("package %s only in a", id))
+		case !maps.Equal(pa[id].deps, other.deps):
+			diffs = append(diffs, fmt.Sprintf("package %s has different dependencies", id))
+		case pa[id].integrity != other.integrity || pa[id].tarball != other.tarball:
+			diffs = append(diffs, fmt.Sprintf("package %s has different integrity", id))
+		}
+	}
+	for _, id := range slices.Sorted(maps.Keys(pb)) {
+		if _, ok := pa[id]; !ok {
+			diffs = append(diffs, fmt.Sprintf("package %s only in b", id))
+		}
+	}
+	return diffs
+}
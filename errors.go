@@ -2,7 +2,12 @@
 
 package eszip
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+)
 
 // ParseErrorType represents the type of parse error
 type ParseErrorType int
@@ -25,13 +30,60 @@ const (
 	ErrInvalidV22OptionsHeader
 	ErrInvalidV22OptionsHeaderHash
 	ErrIO
+	ErrInvalidV2SectionLength
+	ErrUnknownFormat
+	ErrInvalidArchiveMetadata
+	ErrSourceNotLoaded
+	ErrInvalidV2SourceCompression
+	ErrInvalidV2SourceEncryption
+	ErrLimitExceeded
+	ErrChecksumRequired
+	ErrInvalidV24ModuleHeaders
+	ErrInvalidV24ModuleHeadersHash
+	ErrInvalidV25ModuleAux
+	ErrInvalidV25ModuleAuxHash
+	ErrInvalidV26NpmIntegrity
+	ErrInvalidV26NpmIntegrityHash
 )
 
 // ParseError represents an error that occurred during parsing
 type ParseError struct {
 	Type    ParseErrorType
 	Message string
-	Offset  int
+	// Offset is the archive offset of the bytes at fault, or 0 if unknown.
+	Offset int
+	// Length is the number of bytes from Offset the error covers, or 0 if
+	// unknown.
+	Length int
+	// Section names the section being read: "options", "modules", "npm",
+	// "module_headers", "module_aux", "npm_integrity", "sources" or
+	// "source_maps". It is empty for errors outside a V2 section.
+	Section string
+	// Expected and Got are set when the error is a value that differs from
+	// the one required, such as a hash or a length.
+	Expected string
+	Got      string
+	// Mismatch is set for checksum failures and describes the stored and
+	// computed hashes.
+	Mismatch *ChecksumMismatch
+	// Err is the underlying error, such as from the reader.
+	Err error
+}
+
+// ChecksumMismatch describes a section whose stored hash does not match the
+// hash computed over its content. Comparing the two helps tell truncation
+// (short content) from bit-flips (same length, different hash) and from an
+// algorithm mismatch (hashes of different sizes).
+type ChecksumMismatch struct {
+	Algorithm ChecksumType
+	Stored    []byte
+	Computed  []byte
+	// Length is the number of content bytes the hash was computed over.
+	Length int
+}
+
+func (m *ChecksumMismatch) String() string {
+	return fmt.Sprintf("%s stored %x, computed %x over %d bytes", m.Algorithm, m.Stored, m.Computed, m.Length)
 }
 
 func (e *ParseError) Error() string {
@@ -41,68 +93,224 @@ func (e *ParseError) Error() string {
 	return fmt.Sprintf("eszip parse error: %s", e.Message)
 }
 
+// Unwrap returns the underlying error, if any.
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// inSection records that err, if a *ParseError not yet placed in a section,
+// arose in the named section.
+func inSection(err error, section string) error {
+	if pe, ok := err.(*ParseError); ok && pe.Section == "" {
+		pe.Section = section
+	}
+	return err
+}
+
 // Error constructors for common parse errors
 
 func errInvalidV1Json(err error) *ParseError {
-	return &ParseError{Type: ErrInvalidV1Json, Message: fmt.Sprintf("invalid eszip v1 json: %v", err)}
+	return &ParseError{Type: ErrInvalidV1Json, Message: fmt.Sprintf("invalid eszip v1 json: %v", err), Err: err}
 }
 
 func errInvalidV1Version(version uint32) *ParseError {
-	return &ParseError{Type: ErrInvalidV1Version, Message: fmt.Sprintf("invalid eszip v1 version: got %d, expected 1", version)}
+	return &ParseError{Type: ErrInvalidV1Version, Message: fmt.Sprintf("invalid eszip v1 version: got %d, expected 1", version), Expected: "1", Got: strconv.Itoa(int(version))}
 }
 
 func errInvalidV2() *ParseError {
 	return &ParseError{Type: ErrInvalidV2, Message: "invalid eszip v2"}
 }
 
-func errInvalidV2HeaderHash() *ParseError {
-	return &ParseError{Type: ErrInvalidV2HeaderHash, Message: "invalid eszip v2 header hash"}
+func errInvalidV2HeaderHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV2HeaderHash, "invalid eszip v2 header hash", section)
 }
 
-func errInvalidV2EntryKind(kind uint8, offset int) *ParseError {
-	return &ParseError{Type: ErrInvalidV2EntryKind, Message: fmt.Sprintf("invalid entry kind %d in eszip v2 header", kind), Offset: offset}
+func errInvalidV2EntryKind(kind uint8, expected string, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV2EntryKind, Message: fmt.Sprintf("invalid entry kind %d in eszip v2 header", kind), Offset: offset, Length: 1, Expected: expected, Got: strconv.Itoa(int(kind))}
 }
 
-func errInvalidV2ModuleKind(kind uint8, offset int) *ParseError {
-	return &ParseError{Type: ErrInvalidV2ModuleKind, Message: fmt.Sprintf("invalid module kind %d in eszip v2 header", kind), Offset: offset}
+func errInvalidV2ModuleKind(specifier string, kind uint8, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV2ModuleKind, Message: fmt.Sprintf("invalid module kind %d in eszip v2 header (specifier %s)", kind, specifier), Offset: offset, Length: 1, Expected: "0-4", Got: strconv.Itoa(int(kind))}
 }
 
-func errInvalidV2Header(msg string) *ParseError {
-	return &ParseError{Type: ErrInvalidV2Header, Message: fmt.Sprintf("invalid eszip v2 header: %s", msg)}
+func errInvalidV2Header(msg string, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV2Header, Message: fmt.Sprintf("invalid eszip v2 header: %s", msg), Offset: offset}
 }
 
-func errInvalidV2SourceOffset(offset int) *ParseError {
-	return &ParseError{Type: ErrInvalidV2SourceOffset, Message: fmt.Sprintf("invalid eszip v2 source offset (%d)", offset), Offset: offset}
+// errInvalidV2SourceOffset reports content at offset within its section
+// that no module refers to, or that does not fit. at is the archive offset
+// of the content, or 0 if unknown.
+func errInvalidV2SourceOffset(offset, at int) *ParseError {
+	return &ParseError{Type: ErrInvalidV2SourceOffset, Message: fmt.Sprintf("invalid eszip v2 source offset (%d)", offset), Offset: at}
 }
 
-func errInvalidV2SourceHash(specifier string) *ParseError {
-	return &ParseError{Type: ErrInvalidV2SourceHash, Message: fmt.Sprintf("invalid eszip v2 source hash (specifier %s)", specifier)}
+// errInvalidV2SourceRange reports content of length bytes, checksum
+// included, that the modules header places at offset within its section
+// where it cannot be. at is the archive offset of the content, or 0 if
+// unknown.
+func errInvalidV2SourceRange(specifier string, offset, length int, msg string, at int) *ParseError {
+	return &ParseError{Type: ErrInvalidV2SourceOffset, Message: fmt.Sprintf("invalid eszip v2 source range %d-%d (specifier %s): %s", offset, offset+length, specifier, msg), Offset: at, Length: length}
 }
 
-func errInvalidV2NpmSnapshotHash() *ParseError {
-	return &ParseError{Type: ErrInvalidV2NpmSnapshotHash, Message: "invalid eszip v2.1 npm snapshot hash"}
+func errInvalidV2SourceHash(specifier string, section *Section) *ParseError {
+	return errChecksum(ErrInvalidV2SourceHash, fmt.Sprintf("invalid eszip v2 source hash (specifier %s)", specifier), section)
+}
+
+func errInvalidV2NpmSnapshotHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV2NpmSnapshotHash, "invalid eszip v2.1 npm snapshot hash", section)
 }
 
 func errInvalidV2NpmPackageOffset(index int, err error) *ParseError {
-	return &ParseError{Type: ErrInvalidV2NpmPackageOffset, Message: fmt.Sprintf("invalid eszip v2.1 npm package at index %d: %v", index, err)}
+	return &ParseError{Type: ErrInvalidV2NpmPackageOffset, Message: fmt.Sprintf("invalid eszip v2.1 npm package at index %d: %v", index, err), Err: err}
 }
 
 func errInvalidV2NpmPackage(name string, err error) *ParseError {
-	return &ParseError{Type: ErrInvalidV2NpmPackage, Message: fmt.Sprintf("invalid eszip v2.1 npm package '%s': %v", name, err)}
+	return &ParseError{Type: ErrInvalidV2NpmPackage, Message: fmt.Sprintf("invalid eszip v2.1 npm package '%s': %v", name, err), Err: err}
 }
 
 func errInvalidV2NpmPackageReq(req string, err error) *ParseError {
-	return &ParseError{Type: ErrInvalidV2NpmPackageReq, Message: fmt.Sprintf("invalid eszip v2.1 npm req '%s': %v", req, err)}
+	return &ParseError{Type: ErrInvalidV2NpmPackageReq, Message: fmt.Sprintf("invalid eszip v2.1 npm req '%s': %v", req, err), Err: err}
 }
 
 func errInvalidV22OptionsHeader(msg string) *ParseError {
 	return &ParseError{Type: ErrInvalidV22OptionsHeader, Message: fmt.Sprintf("invalid eszip v2.2 options header: %s", msg)}
 }
 
-func errInvalidV22OptionsHeaderHash() *ParseError {
-	return &ParseError{Type: ErrInvalidV22OptionsHeaderHash, Message: "invalid eszip v2.2 options header hash"}
+func errInvalidV22OptionsHeaderHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV22OptionsHeaderHash, "invalid eszip v2.2 options header hash", section)
+}
+
+func errInvalidV24ModuleHeaders(msg string, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV24ModuleHeaders, Message: fmt.Sprintf("invalid eszip v2.4 module headers: %s", msg), Offset: offset}
+}
+
+func errInvalidV24ModuleHeadersHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV24ModuleHeadersHash, "invalid eszip v2.4 module headers hash", section)
+}
+
+func errInvalidV25ModuleAux(msg string, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV25ModuleAux, Message: fmt.Sprintf("invalid eszip v2.5 module aux data: %s", msg), Offset: offset}
+}
+
+func errInvalidV25ModuleAuxHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV25ModuleAuxHash, "invalid eszip v2.5 module aux data hash", section)
+}
+
+func errInvalidV26NpmIntegrity(msg string, offset int) *ParseError {
+	return &ParseError{Type: ErrInvalidV26NpmIntegrity, Message: fmt.Sprintf("invalid eszip v2.6 npm integrity data: %s", msg), Offset: offset}
+}
+
+func errInvalidV26NpmIntegrityHash(section *Section) *ParseError {
+	return errChecksum(ErrInvalidV26NpmIntegrityHash, "invalid eszip v2.6 npm integrity data hash", section)
+}
+
+// errChecksum builds a checksum failure for section, recording the stored
+// and computed hashes alongside the section's offset and length.
+func errChecksum(typ ParseErrorType, msg string, section *Section) *ParseError {
+	mismatch := section.mismatch()
+	return &ParseError{
+		Type:     typ,
+		Message:  fmt.Sprintf("%s: %s", msg, mismatch),
+		Offset:   section.offset,
+		Length:   section.TotalLen(),
+		Expected: hex.EncodeToString(mismatch.Computed),
+		Got:      hex.EncodeToString(mismatch.Stored),
+		Mismatch: mismatch,
+	}
+}
+
+// errInvalidV2ContentLength reports a sources or source maps section whose
+// declared length differs from the content the modules header lays out in
+// it.
+func errInvalidV2ContentLength(declared int64, laidOut int, offset int) *ParseError {
+	return &ParseError{
+		Type:     ErrInvalidV2SectionLength,
+		Message:  fmt.Sprintf("invalid eszip v2 section length: declares %d bytes but the modules header lays out %d", declared, laidOut),
+		Offset:   offset,
+		Length:   4,
+		Expected: strconv.Itoa(laidOut),
+		Got:      strconv.FormatInt(declared, 10),
+	}
+}
+
+func errInvalidV2SectionLength(declared, available int64, offset int) *ParseError {
+	return &ParseError{
+		Type:     ErrInvalidV2SectionLength,
+		Message:  fmt.Sprintf("invalid eszip v2 section length: declares %d bytes but only %d remain", declared, available),
+		Offset:   offset,
+		Expected: fmt.Sprintf("at most %d", available),
+		Got:      strconv.FormatInt(declared, 10),
+	}
 }
 
 func errIO(err error) *ParseError {
-	return &ParseError{Type: ErrIO, Message: fmt.Sprintf("io error: %v", err)}
+	return &ParseError{Type: ErrIO, Message: fmt.Sprintf("io error: %v", err), Err: err}
+}
+
+func errUnknownFormat(head []byte) *ParseError {
+	if len(head) == 0 {
+		return &ParseError{Type: ErrUnknownFormat, Message: "unknown eszip format: empty input"}
+	}
+	msg := fmt.Sprintf("unknown eszip format: input is neither eszip v2 nor v1 json (first bytes %x)", head)
+	if hint := magicHint(head); hint != "" {
+		msg += "; " + hint
+	}
+	return &ParseError{Type: ErrUnknownFormat, Message: msg}
+}
+
+func errInvalidArchiveMetadata(err error) *ParseError {
+	return &ParseError{Type: ErrInvalidArchiveMetadata, Message: fmt.Sprintf("invalid archive metadata: %v", err), Err: err}
+}
+
+func errInvalidV2SourceCompression(specifier string, offset int, err error) *ParseError {
+	return &ParseError{Type: ErrInvalidV2SourceCompression, Message: fmt.Sprintf("invalid eszip v2 compressed source (specifier %s): %v", specifier, err), Offset: offset, Err: err}
+}
+
+func errInvalidV2SourceEncryption(specifier string, offset int, err error) *ParseError {
+	return &ParseError{Type: ErrInvalidV2SourceEncryption, Message: fmt.Sprintf("invalid eszip v2 encrypted source (specifier %s): %v", specifier, err), Offset: offset, Err: err}
+}
+
+func errSectionTooLarge(length, limit int64, offset int) *ParseError {
+	return &ParseError{Type: ErrLimitExceeded, Message: fmt.Sprintf("section of %d bytes exceeds the limit of %d", length, limit), Offset: offset}
+}
+
+func errTooManyModules(limit int) *ParseError {
+	return &ParseError{Type: ErrLimitExceeded, Message: fmt.Sprintf("archive has more than the limit of %d entries", limit)}
+}
+
+func errChecksumRequired(msg string) *ParseError {
+	return &ParseError{Type: ErrChecksumRequired, Message: fmt.Sprintf("checksum required: %s", msg)}
+}
+
+func errSourceNotLoaded() *ParseError {
+	return &ParseError{Type: ErrSourceNotLoaded, Message: "source not loaded: completion was aborted or the input was truncated"}
+}
+
+// magicHint describes how close head comes to a known V2 magic, or returns
+// "" if it bears no resemblance to one.
+func magicHint(head []byte) string {
+	best, bestDiff := "", len(head)
+	for version := VersionV2; version <= LatestVersion; version++ {
+		magic := version.ToMagic()
+		if len(head) < len(magic) && bytes.HasPrefix(magic[:], head) {
+			return "looks like a truncated eszip v2 magic"
+		}
+		diff := 0
+		for i := range head {
+			if head[i] != magic[i] {
+				diff++
+			}
+		}
+		if diff < bestDiff {
+			best, bestDiff = string(magic[:]), diff
+		}
+	}
+	switch {
+	case bestDiff <= 2:
+		return fmt.Sprintf("differs from the %q magic in %d byte(s), the archive may be corrupt", best, bestDiff)
+	case bytes.HasPrefix(head, []byte("ESZIP")):
+		return "starts like an eszip v2 magic but names no known version"
+	default:
+		return ""
+	}
 }
@@ -5,10 +5,39 @@
 package eszip
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"io"
+	"iter"
+	"log/slog"
+)
+
+// Archive is what V1 and V2 archives have in common, for code that does
+// not care which format it holds. EszipV1, EszipV2 and EszipUnion
+// implement it.
+type Archive interface {
+	// GetModule returns the module for specifier, following redirects, or
+	// nil if there is none.
+	GetModule(specifier string) *Module
+	// GetImportMap is GetModule, except that it also returns JSONC modules.
+	GetImportMap(specifier string) *Module
+	// Specifiers returns the specifier of every entry.
+	Specifiers() []string
+	// Iterate returns every module with the specifier that leads to it.
+	Iterate() []struct {
+		Specifier string
+		Module    *Module
+	}
+	// All is Iterate as an iterator.
+	All() iter.Seq2[string, *Module]
+	// IntoBytes serializes the archive in its own format.
+	IntoBytes(opts ...WriteOption) ([]byte, error)
+}
+
+var (
+	_ Archive = (*EszipV1)(nil)
+	_ Archive = (*EszipV2)(nil)
+	_ Archive = (*EszipUnion)(nil)
 )
 
 // EszipUnion wraps either V1 or V2 eszip
@@ -37,6 +66,14 @@ func (e *EszipUnion) V2() (*EszipV2, bool) {
 	return e.v2, e.v2 != nil
 }
 
+// Archive returns the V1 or V2 archive e wraps.
+func (e *EszipUnion) Archive() Archive {
+	if e.v1 != nil {
+		return e.v1
+	}
+	return e.v2
+}
+
 // GetModule returns the module for the given specifier
 func (e *EszipUnion) GetModule(specifier string) *Module {
 	if e.v1 != nil {
@@ -61,6 +98,35 @@ func (e *EszipUnion) Specifiers() []string {
 	return e.v2.Specifiers()
 }
 
+// All returns an iterator over the modules, each paired with the specifier
+// that leads to it. See EszipV2.All.
+func (e *EszipUnion) All() iter.Seq2[string, *Module] {
+	if e.v1 != nil {
+		return e.v1.All()
+	}
+	return e.v2.All()
+}
+
+// Iterate returns all modules. See EszipV2.Iterate.
+func (e *EszipUnion) Iterate() []struct {
+	Specifier string
+	Module    *Module
+} {
+	if e.v1 != nil {
+		return e.v1.Iterate()
+	}
+	return e.v2.Iterate()
+}
+
+// IntoBytes serializes the archive in the format it was parsed from: JSON
+// for V1 and the binary format for V2.
+func (e *EszipUnion) IntoBytes(opts ...WriteOption) ([]byte, error) {
+	if e.v1 != nil {
+		return e.v1.IntoBytes(opts...)
+	}
+	return e.v2.IntoBytes(opts...)
+}
+
 // TakeNpmSnapshot removes and returns the NPM snapshot
 func (e *EszipUnion) TakeNpmSnapshot() *NpmResolutionSnapshot {
 	if e.v1 != nil {
@@ -69,52 +135,281 @@ func (e *EszipUnion) TakeNpmSnapshot() *NpmResolutionSnapshot {
 	return e.v2.TakeNpmSnapshot()
 }
 
+// ParseOption configures how an archive is parsed.
+type ParseOption func(*parseConfig)
+
+type parseConfig struct {
+	inputSize    int64
+	instr        Instrumentation
+	logger       *slog.Logger
+	showReserved bool
+	origins      *originPolicy
+	recovery     *RecoveryReport
+	faults       *faultLog
+	concurrency  int
+	keys         KeyProvider
+	policy       ParseOptions
+	progress     Progress
+	// zeroCopy and backing, the input as given to ParseBytes, serve
+	// WithZeroCopy.
+	zeroCopy bool
+	backing  []byte
+}
+
+func newParseConfig(opts []ParseOption) parseConfig {
+	cfg := parseConfig{inputSize: -1}
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+// WithInputSize tells the parser the total number of bytes the reader will
+// yield, including the magic. Section lengths that exceed the bytes remaining
+// are then rejected before any memory is allocated for them. Without it,
+// large sections are read in capped chunks so that memory use tracks the
+// bytes actually received.
+func WithInputSize(n int64) ParseOption {
+	return func(c *parseConfig) {
+		c.inputSize = n
+	}
+}
+
+// WithInstrumentation reports parse activity to instr. See Instrumentation.
+func WithInstrumentation(instr Instrumentation) ParseOption {
+	return func(c *parseConfig) {
+		c.instr = instr
+	}
+}
+
+// WithProgress reports how far the parse has got to p.OnSectionRead. See
+// Progress.
+func WithProgress(p Progress) ParseOption {
+	return func(c *parseConfig) {
+		c.progress = p
+	}
+}
+
+// WithLogger reports anomalies the parser tolerates, such as unknown options
+// or duplicate specifiers, as Warn records and phase timings as Debug
+// records. Every record carries an "event" attribute naming what happened.
+// Nothing is logged without a logger.
+func WithLogger(logger *slog.Logger) ParseOption {
+	return func(c *parseConfig) {
+		c.logger = logger
+	}
+}
+
+// WithDecryptionKey supplies the key for archives whose content is
+// encrypted; see EszipV2.SetEncryption. Parsing an encrypted archive
+// without it fails with ErrMissingKey, and content that does not decrypt
+// under the key fails with ErrInvalidV2SourceEncryption. The parsed
+// archive keeps keys for writing.
+func WithDecryptionKey(keys KeyProvider) ParseOption {
+	return func(c *parseConfig) {
+		c.keys = keys
+	}
+}
+
+// WithZeroCopy makes ParseBytes keep sources and source maps as sub-slices
+// of the data it was given rather than copies, roughly halving peak memory
+// when parsing a large archive, such as one in a memory-mapped file.
+// Content that is compressed or encrypted is still decoded into memory of
+// its own. Other parse functions ignore it.
+//
+// The archive then borrows data: data must stay valid, and must not be
+// modified, for as long as the archive or any content taken from it is in
+// use, including by archives it is merged or copied into. The archive never
+// modifies data itself. Unmapping a memory-mapped file while content is
+// still referenced crashes the program.
+func WithZeroCopy() ParseOption {
+	return func(c *parseConfig) {
+		c.zeroCopy = true
+	}
+}
+
+// withBacking records the input of ParseBytes for WithZeroCopy.
+func withBacking(data []byte) ParseOption {
+	return func(c *parseConfig) {
+		c.backing = data
+	}
+}
+
+// WithConcurrency verifies the checksums of sources and source maps, and
+// decompresses them, on n goroutines while the parser reads on, instead of
+// on the goroutine reading the input. This shortens the parse of large
+// archives with SHA-256 checksums, where verification dominates. With n of
+// 1 or less, or an archive with neither checksums nor compression, content
+// is verified as it is read.
+//
+// A checksum mismatch is then reported by a later step of the Completion
+// than the one that read the content, and input past it may have been
+// read. Instrumentation reports of loaded sources come from the worker
+// goroutines, one at a time.
+func WithConcurrency(n int) ParseOption {
+	return func(c *parseConfig) {
+		c.concurrency = n
+	}
+}
+
+// WithReservedSpecifiers makes Specifiers and Iterate of the parsed archive
+// include reserved entries such as ArchiveMetadataSpecifier, which they
+// otherwise hide.
+func WithReservedSpecifiers() ParseOption {
+	return func(c *parseConfig) {
+		c.showReserved = true
+	}
+}
+
+// WithAllowedOrigins rejects archives naming http or https specifiers
+// whose host is not in allowed, with an *OriginPolicyError listing all of
+// them. An entry is a host, optionally with a port, or "*.example.com" to
+// allow every subdomain of example.com. Local specifiers such as file:,
+// data: and npm: are always allowed, so with no entries only local
+// specifiers are.
+func WithAllowedOrigins(allowed ...string) ParseOption {
+	return func(c *parseConfig) {
+		c.origins = newOriginPolicy(allowed)
+	}
+}
+
+// ParseOptions sets limits and a checksum policy for parsing. The zero
+// value imposes no limits and verifies every checksum the archive has,
+// which is how archives are parsed without it.
+type ParseOptions struct {
+	// MaxSectionSize, if positive, rejects V2 archives with a header,
+	// npm or content section longer than this many bytes, before
+	// anything is allocated for it. Compressed sources and source maps
+	// that decompress to more than this fail to load; without it they
+	// are limited to 1 GiB.
+	MaxSectionSize int64
+	// MaxModules, if positive, rejects archives with more entries
+	// (modules, redirects and npm specifiers) than this.
+	MaxModules int
+	// RequireChecksum rejects archives without checksums: V1 archives and
+	// V2.2+ archives written with ChecksumNone.
+	RequireChecksum bool
+	// SkipChecksumVerify skips verifying checksums, for trusted inputs
+	// where hashing costs more than it protects. Content is still read
+	// and decoded; corruption goes unnoticed. Instrumentation reports
+	// content loaded this way as unverified. VerifyArchive ignores it.
+	SkipChecksumVerify bool
+	// StrictOffsets rejects V2 archives whose sources or source maps are
+	// not laid out as writers lay them out: in header order, each new
+	// piece of content starting where the one before it ends, shared
+	// content only shared whole, and each section's declared length
+	// exactly what its content covers. The error names the offending
+	// range and module. Without it, overlaps and gaps fail only when the
+	// streaming parser reaches them, and ParseV2Lazy and PatchArchive read
+	// whatever the offsets point at.
+	StrictOffsets bool
+}
+
+// decompressLimit returns the most bytes a compressed source or source map
+// may decompress to.
+func (p ParseOptions) decompressLimit() int64 {
+	if p.MaxSectionSize > 0 {
+		return p.MaxSectionSize
+	}
+	return maxDecompressedSize
+}
+
+// WithParseOptions applies opts. Limit violations fail with
+// ErrLimitExceeded and a missing required checksum with
+// ErrChecksumRequired.
+func WithParseOptions(opts ParseOptions) ParseOption {
+	return func(c *parseConfig) {
+		c.policy = opts
+	}
+}
+
+// ParseWithOptions is Parse with the limits and checksum policy of opts.
+// Further options, such as WithInputSize, may follow.
+func ParseWithOptions(ctx context.Context, r io.Reader, opts ParseOptions, more ...ParseOption) (*EszipUnion, func(context.Context) error, error) {
+	return Parse(ctx, r, append([]ParseOption{WithParseOptions(opts)}, more...)...)
+}
+
 // Parse parses an eszip archive from the given reader.
 // Returns the eszip and a function to complete parsing of source data (for streaming).
 // The completion function must be called to fully load sources.
-func Parse(ctx context.Context, r io.Reader) (*EszipUnion, func(context.Context) error, error) {
-	br := bufio.NewReader(r)
-
-	// Read magic bytes
-	magic := make([]byte, 8)
-	if _, err := io.ReadFull(br, magic); err != nil {
-		return nil, nil, errIO(err)
+func Parse(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipUnion, func(context.Context) error, error) {
+	eszip, completion, err := parse(ctx, r, opts)
+	if err != nil {
+		return nil, nil, err
 	}
+	return eszip, completion.Complete, nil
+}
+
+func parse(ctx context.Context, r io.Reader, opts []ParseOption) (*EszipUnion, *Completion, error) {
+	br := newArchiveReader(r, newParseConfig(opts))
 
 	// Check if it's V2
+	magic, err := br.peek(8)
+	if err != nil {
+		return nil, nil, errIO(err)
+	}
 	if version, ok := VersionFromMagic(magic); ok {
-		eszip, complete, err := parseV2WithVersion(ctx, version, br)
+		br.discard(len(magic))
+		br.reportSection("magic", 0)
+		eszip, completion, err := parseV2WithVersion(ctx, version, br)
 		if err != nil {
 			return nil, nil, err
 		}
-		return &EszipUnion{v2: eszip}, complete, nil
+		return &EszipUnion{v2: eszip}, completion, nil
 	}
 
-	// Otherwise, treat as V1 JSON - read the rest
-	var allData []byte
-	allData = append(allData, magic...)
-	remaining, err := io.ReadAll(br)
-	if err != nil {
-		return nil, nil, errIO(err)
+	// Otherwise it must be V1 JSON, which starts with an object
+	if !skipToJSONObject(br) {
+		return nil, nil, errUnknownFormat(magic)
 	}
-	allData = append(allData, remaining...)
-
-	eszip, err := ParseV1(allData)
+	if br.policy.RequireChecksum {
+		return nil, nil, errChecksumRequired("v1 archives have no checksums")
+	}
+	eszip, err := parseV1Reader(br)
 	if err != nil {
 		return nil, nil, err
 	}
+	if limit := br.policy.MaxModules; limit > 0 && len(eszip.Modules) > limit {
+		return nil, nil, errTooManyModules(limit)
+	}
+	br.reportSection("v1_json", 0)
+	if br.origins != nil {
+		if err := br.origins.check(eszip.Specifiers()); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// V1 has no streaming, completion is a no-op
-	complete := func(ctx context.Context) error {
-		return nil
-	}
+	completion := newCompletion(func() (string, bool, error) { return "", true, nil }, func() {})
 
-	return &EszipUnion{v1: eszip}, complete, nil
+	return &EszipUnion{v1: eszip}, completion, nil
+}
+
+// skipToJSONObject consumes a UTF-8 byte order mark and leading whitespace,
+// and reports whether the next byte opens a JSON object.
+func skipToJSONObject(br *archiveReader) bool {
+	if bom, _ := br.peek(3); bytes.Equal(bom, []byte{0xef, 0xbb, 0xbf}) {
+		br.discard(3)
+	}
+	for {
+		b, err := br.peek(1)
+		if err != nil || len(b) == 0 {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\n', '\r':
+			br.discard(1)
+		case '{':
+			return true
+		default:
+			return false
+		}
+	}
 }
 
 // ParseSync parses an eszip archive completely (blocking)
-func ParseSync(ctx context.Context, r io.Reader) (*EszipUnion, error) {
-	eszip, complete, err := Parse(ctx, r)
+func ParseSync(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipUnion, error) {
+	eszip, complete, err := Parse(ctx, r, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -126,9 +421,31 @@ func ParseSync(ctx context.Context, r io.Reader) (*EszipUnion, error) {
 	return eszip, nil
 }
 
-// ParseBytes parses an eszip from a byte slice
-func ParseBytes(ctx context.Context, data []byte) (*EszipUnion, error) {
-	return ParseSync(ctx, bytes.NewReader(data))
+// ParseBytes parses an eszip from a byte slice. Section lengths are checked
+// against len(data) before anything is allocated for them. Content is
+// copied out of data unless WithZeroCopy is given.
+func ParseBytes(ctx context.Context, data []byte, opts ...ParseOption) (*EszipUnion, error) {
+	opts = append([]ParseOption{WithInputSize(int64(len(data))), withBacking(data)}, opts...)
+	return ParseSync(ctx, bytes.NewReader(data), opts...)
+}
+
+// ParseHeaderOnly parses an archive's headers and stops where its sources
+// begin. The modules, redirects, npm snapshot and metadata are available;
+// reading a source or source map fails with ErrSourceNotLoaded, since the
+// sources and source maps sections are never read.
+//
+// It suits fuzzing and other handling of untrusted input: no allocation is
+// sized by a declared count or length alone. Counts are checked against the
+// bytes left in their section first, and a section of a stream of unknown
+// size is read in chunks as data arrives, so memory use is bounded by the
+// input actually read. ParseOptions limits apply as for Parse.
+func ParseHeaderOnly(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipUnion, error) {
+	eszip, completion, err := parse(ctx, r, opts)
+	if err != nil {
+		return nil, err
+	}
+	completion.Abort()
+	return eszip, nil
 }
 
 // NewV2 creates a new empty V2 eszip archive
@@ -5,11 +5,36 @@ package eszip
 import (
 	"bytes"
 	"context"
+	"crypto/sha512"
+	"encoding/base64"
 	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"time"
+
+	"github.com/JakeChampion/eszip/sourcemap"
+	"github.com/JakeChampion/eszip/wasm"
 )
 
 func TestParseV1(t *testing.T) {
@@ -324,6 +349,7 @@ func TestChecksumTypes(t *testing.T) {
 		{"NoChecksum", ChecksumNone},
 		{"Sha256", ChecksumSha256},
 		{"XxHash3", ChecksumXxh3},
+		{"Blake3", ChecksumBlake3},
 	}
 
 	ctx := context.Background()
@@ -422,6 +448,51 @@ func TestV2Iterator(t *testing.T) {
 	}
 }
 
+func TestAll(t *testing.T) {
+	data, err := os.ReadFile("testdata/redirect.eszip2")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	parsed, err := ParseBytes(context.Background(), data)
+	if err != nil {
+		t.Fatalf("failed to parse eszip: %v", err)
+	}
+
+	v2, _ := parsed.V2()
+	var want, got []string
+	for _, entry := range v2.Iterate() {
+		want = append(want, entry.Specifier+" -> "+entry.Module.Specifier)
+	}
+	for specifier, module := range parsed.All() {
+		got = append(got, specifier+" -> "+module.Specifier)
+	}
+	if len(got) == 0 || !slices.Equal(got, want) {
+		t.Errorf("All yielded %v, want %v", got, want)
+	}
+	for range v2.All() {
+		break
+	}
+
+	data, err = os.ReadFile("testdata/basic.json")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	v1, err := ParseV1(data)
+	if err != nil {
+		t.Fatalf("failed to parse eszip: %v", err)
+	}
+	n := 0
+	for _, module := range v1.All() {
+		if module.Kind != ModuleKindJavaScript {
+			t.Errorf("unexpected kind %v", module.Kind)
+		}
+		n++
+	}
+	if n != 1 {
+		t.Errorf("All yielded %d modules, want 1", n)
+	}
+}
+
 // --- V2 parsing error path tests ---
 
 func TestParseEmptyData(t *testing.T) {
@@ -442,7 +513,7 @@ func TestParseTruncatedMagic(t *testing.T) {
 
 func TestParseInvalidV1Json(t *testing.T) {
 	ctx := context.Background()
-	_, err := ParseBytes(ctx, []byte("not json at all!!!"))
+	_, err := ParseBytes(ctx, []byte("{not json at all!!!"))
 	if err == nil {
 		t.Fatal("expected error parsing invalid JSON")
 	}
@@ -576,6 +647,61 @@ func TestV1IntoBytes(t *testing.T) {
 	}
 }
 
+func TestNewV1(t *testing.T) {
+	ctx := context.Background()
+	v1 := NewV1()
+	v1.AddModule("file:///main.js", []byte(`import "./dep.js";`), []string{"file:///dep.js"})
+	v1.AddModule("file:///dep.js", []byte("export {};"), nil)
+	v1.AddRedirect("file:///alias.js", "file:///dep.js")
+
+	data, err := v1.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	var doc struct {
+		Version uint32
+		Modules map[string]v1ModuleInfoJSON
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		t.Fatalf("IntoBytes wrote invalid JSON: %v", err)
+	}
+	if doc.Version != 1 || len(doc.Modules) != 3 {
+		t.Fatalf("IntoBytes = %s", data)
+	}
+	if src := doc.Modules["file:///dep.js"].Source; src == nil || src.Deps == nil || len(src.Deps) != 0 {
+		t.Errorf("file:///dep.js written as %+v, want empty deps", src)
+	}
+	if got := doc.Modules["file:///main.js"].Source.Deps; !slices.Equal(got, []string{"file:///dep.js"}) {
+		t.Errorf("file:///main.js deps = %v", got)
+	}
+
+	parsed, err := ParseV1(data)
+	if err != nil {
+		t.Fatalf("ParseV1 failed: %v", err)
+	}
+	for _, archive := range []*EszipV1{v1, parsed} {
+		m := archive.GetModule("file:///alias.js")
+		if m == nil || m.Specifier != "file:///dep.js" {
+			t.Fatalf("GetModule(alias) = %+v", m)
+		}
+		if source, err := m.Source(ctx); err != nil || string(source) != "export {};" {
+			t.Errorf("alias source = %q, %v", source, err)
+		}
+		if deps := m.Dependencies(); deps == nil || len(deps) != 0 {
+			t.Errorf("alias dependencies = %#v, want empty", deps)
+		}
+		main := archive.GetModule("file:///main.js")
+		deps := main.Dependencies()
+		if !slices.Equal(deps, []string{"file:///dep.js"}) {
+			t.Errorf("main dependencies = %v, want file:///dep.js", deps)
+		}
+		deps[0] = "changed"
+		if got := main.Dependencies(); got[0] != "file:///dep.js" {
+			t.Errorf("Dependencies shares its slice: %v", got)
+		}
+	}
+}
+
 func TestV1SourceMap(t *testing.T) {
 	data, err := os.ReadFile("testdata/basic.json")
 	if err != nil {
@@ -653,6 +779,81 @@ func TestV1NonexistentModule(t *testing.T) {
 	_ = eszip.Specifiers()
 }
 
+func TestArchiveInterface(t *testing.T) {
+	ctx := context.Background()
+	v1Data, err := os.ReadFile("testdata/basic.json")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	v2 := NewV2()
+	v2.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export {};"), nil)
+	v2.AddRedirect("file:///alias.js", "file:///main.js")
+	v2Data, err := v2.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// sources reads every module the way format-agnostic code would.
+	sources := func(a Archive) map[string]string {
+		out := make(map[string]string)
+		for _, entry := range a.Iterate() {
+			source, err := entry.Module.Source(ctx)
+			if err != nil {
+				t.Fatalf("Source(%s) failed: %v", entry.Specifier, err)
+			}
+			out[entry.Specifier] = string(source)
+		}
+		return out
+	}
+
+	for _, tt := range []struct {
+		name string
+		data []byte
+		v1   bool
+	}{
+		{"v1", v1Data, true},
+		{"v2", v2Data, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			parsed, err := ParseBytes(ctx, tt.data)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			inner := parsed.Archive()
+			if _, isV1 := inner.(*EszipV1); isV1 != tt.v1 {
+				t.Fatalf("Archive() = %T", inner)
+			}
+			want := sources(parsed)
+			if len(want) == 0 {
+				t.Fatal("no modules")
+			}
+			if got := sources(inner); !maps.Equal(got, want) {
+				t.Errorf("sources via Archive() = %v, want %v", got, want)
+			}
+
+			data, err := parsed.IntoBytes()
+			if err != nil {
+				t.Fatalf("IntoBytes failed: %v", err)
+			}
+			reparsed, err := ParseBytes(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to reparse: %v", err)
+			}
+			if reparsed.IsV1() != tt.v1 {
+				t.Errorf("IntoBytes changed the format")
+			}
+			if got := sources(reparsed); !maps.Equal(got, want) {
+				t.Errorf("sources after IntoBytes = %v, want %v", got, want)
+			}
+
+			var writeErr *WriteError
+			if _, err := parsed.IntoBytes(WithMaxArchiveSize(8)); !errors.As(err, &writeErr) || len(writeErr.Largest) == 0 {
+				t.Errorf("IntoBytes over the limit = %v, want a *WriteError listing modules", err)
+			}
+		})
+	}
+}
+
 func TestEszipUnionV1(t *testing.T) {
 	data, err := os.ReadFile("testdata/basic.json")
 	if err != nil {
@@ -1028,6 +1229,8 @@ func TestVersionFromMagic(t *testing.T) {
 		{MagicV2_1, VersionV2_1, true},
 		{MagicV2_2, VersionV2_2, true},
 		{MagicV2_3, VersionV2_3, true},
+		{MagicV2_4, VersionV2_4, true},
+		{MagicV2_5, VersionV2_5, true},
 		{[8]byte{'N', 'O', 'T', 'M', 'A', 'G', 'I', 'C'}, 0, false},
 	}
 
@@ -1061,11 +1264,17 @@ func TestVersionToMagic(t *testing.T) {
 	if VersionV2_3.ToMagic() != MagicV2_3 {
 		t.Error("V2.3 magic mismatch")
 	}
+	if VersionV2_4.ToMagic() != MagicV2_4 {
+		t.Error("V2.4 magic mismatch")
+	}
+	if VersionV2_5.ToMagic() != MagicV2_5 {
+		t.Error("V2.5 magic mismatch")
+	}
 
-	// Unknown version defaults to latest
+	// Unknown version defaults to the default version
 	unknown := EszipVersion(99)
-	if unknown.ToMagic() != MagicV2_3 {
-		t.Error("unknown version should default to latest magic")
+	if unknown.ToMagic() != DefaultVersion.ToMagic() {
+		t.Error("unknown version should default to the default version's magic")
 	}
 }
 
@@ -1114,6 +1323,9 @@ func TestChecksumDigestSize(t *testing.T) {
 	if ChecksumXxh3.DigestSize() != 8 {
 		t.Error("XXH3 digest should be 8")
 	}
+	if ChecksumBlake3.DigestSize() != 32 {
+		t.Error("BLAKE3 digest should be 32")
+	}
 	if ChecksumType(99).DigestSize() != 0 {
 		t.Error("unknown checksum digest should be 0")
 	}
@@ -1139,6 +1351,12 @@ func TestChecksumHash(t *testing.T) {
 		t.Errorf("XXH3 hash should be 8 bytes, got %d", len(xxh))
 	}
 
+	// BLAKE3 returns the 32-byte digest from the specification
+	want := "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"
+	if got := hex.EncodeToString(ChecksumBlake3.Hash(nil)); got != want {
+		t.Errorf("BLAKE3 hash of empty input = %s, want %s", got, want)
+	}
+
 	// Unknown returns nil
 	if ChecksumType(99).Hash(data) != nil {
 		t.Error("unknown checksum hash should be nil")
@@ -1167,6 +1385,115 @@ func TestChecksumVerify(t *testing.T) {
 	if !ChecksumXxh3.Verify(data, xxh) {
 		t.Error("XXH3 should verify correct hash")
 	}
+
+	// BLAKE3 verify
+	b3 := ChecksumBlake3.Hash(data)
+	if !ChecksumBlake3.Verify(data, b3) {
+		t.Error("BLAKE3 should verify correct hash")
+	}
+	if ChecksumBlake3.Verify(data, sha) {
+		t.Error("BLAKE3 should not verify a SHA256 hash")
+	}
+}
+
+func TestChecksumSize(t *testing.T) {
+	ctx := context.Background()
+	build := func(size uint8) []byte {
+		t.Helper()
+		archive := NewV2()
+		archive.SetChecksum(ChecksumSha256)
+		if err := archive.SetChecksumSize(size); err != nil {
+			t.Fatalf("SetChecksumSize(%d) failed: %v", size, err)
+		}
+		archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte("export const a = 1;"), []byte(`{"version":3}`))
+		archive.AddModule("file:///b.js", ModuleKindJavaScript, []byte("export const b = 2;"), nil)
+		data, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		return data
+	}
+
+	full, truncated := build(0), build(4)
+	// The options, modules and npm sections, two sources and a source map
+	// each lose 28 bytes.
+	if saved := len(full) - len(truncated); saved != 6*28 {
+		t.Errorf("truncation saved %d bytes, want %d", saved, 6*28)
+	}
+	for name, parse := range map[string]func([]byte) (*EszipUnion, error){
+		"bytes": func(data []byte) (*EszipUnion, error) { return ParseBytes(ctx, data) },
+		"lazy": func(data []byte) (*EszipUnion, error) {
+			v2, err := ParseV2Lazy(ctx, bytes.NewReader(data))
+			return &EszipUnion{v2: v2}, err
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := parse(truncated)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			source, err := parsed.GetModule("file:///a.js").Source(ctx)
+			if err != nil || string(source) != "export const a = 1;" {
+				t.Errorf("Source = %q, %v", source, err)
+			}
+			if size := parsed.Summary().ChecksumSize; size != 4 {
+				t.Errorf("Summary().ChecksumSize = %d, want 4", size)
+			}
+
+			corrupt := bytes.Clone(truncated)
+			at := bytes.Index(corrupt, []byte("const b"))
+			corrupt[at] = 'C'
+			parsed, err = parse(corrupt)
+			if err == nil {
+				_, err = parsed.GetModule("file:///b.js").Source(ctx)
+			}
+			var perr *ParseError
+			if !errors.As(err, &perr) || perr.Type != ErrInvalidV2SourceHash {
+				t.Errorf("corrupt source error = %v, want ErrInvalidV2SourceHash", err)
+			}
+		})
+	}
+
+	t.Run("rewrite", func(t *testing.T) {
+		parsed, err := ParseBytes(ctx, truncated)
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		v2, _ := parsed.V2()
+		again, err := v2.IntoBytes()
+		if err != nil || !bytes.Equal(again, truncated) {
+			t.Errorf("rewritten archive differs: %v", err)
+		}
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		archive := NewV2()
+		archive.SetChecksum(ChecksumXxh3)
+		if err := archive.SetChecksumSize(9); err == nil {
+			t.Error("expected error for a checksum size larger than the digest")
+		}
+
+		// Patch the checksum size in the options header of a valid archive.
+		data := bytes.Clone(truncated)
+		options := bytes.Index(data, []byte{0, byte(ChecksumSha256), 1, 4})
+		data[options+3] = 33
+		_, err := ParseBytes(ctx, data)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Type != ErrInvalidV22OptionsHeader {
+			t.Errorf("parse error = %v, want ErrInvalidV22OptionsHeader", err)
+		}
+	})
+
+	t.Run("old_version", func(t *testing.T) {
+		archive := NewV2()
+		archive.SetChecksum(ChecksumSha256)
+		if err := archive.SetChecksumSize(16); err != nil {
+			t.Fatal(err)
+		}
+		if err := archive.SetVersion(VersionV2_1); !errors.Is(err, ErrVersionTooOld) {
+			t.Errorf("SetVersion(v2.1) error = %v, want ErrVersionTooOld", err)
+		}
+	})
 }
 
 func TestChecksumFromU8(t *testing.T) {
@@ -1178,7 +1505,8 @@ func TestChecksumFromU8(t *testing.T) {
 		{0, ChecksumNone, true},
 		{1, ChecksumSha256, true},
 		{2, ChecksumXxh3, true},
-		{3, ChecksumNone, false},
+		{3, ChecksumBlake3, true},
+		{4, ChecksumNone, false},
 		{255, ChecksumNone, false},
 	}
 
@@ -1307,6 +1635,131 @@ func TestNpmSnapshotRoundtrip(t *testing.T) {
 	}
 }
 
+func TestHostPrefixedLayout(t *testing.T) {
+	for _, tt := range []struct {
+		input  string
+		decode bool
+		want   string
+	}{
+		{"file:///main.ts", true, "main.ts"},
+		{"file://localhost/main.ts", true, "localhost/main.ts"},
+		{"https://example.com/mod.ts", true, "example.com/mod.ts"},
+		{"http://example.com/mod.ts", true, "example.com/mod.ts"},
+		{"http://localhost:8000/mod.ts", true, "localhost_8000/mod.ts"},
+		{"plain/path.ts", true, "plain/path.ts"},
+		{"npm:///chalk@5.3.0/index.js", true, "npm/chalk@5.3.0/index.js"},
+		{"jsr:@std/path@1.0.0/mod.ts", true, "jsr/@std/path@1.0.0/mod.ts"},
+		{"https://esm.sh/mod.ts?v=1", true, "esm.sh/mod_" + shortHash("?v=1", 8) + ".ts"},
+		{"https://esm.sh/mod?target=deno", true, "esm.sh/mod_" + shortHash("?target=deno", 8)},
+		{"file:///a/../../etc/passwd", true, "a/%2E%2E/%2E%2E/etc/passwd"},
+
+		// Percent-decoding
+		{"https://example.com/my%20module.ts", true, "example.com/my module.ts"},
+		{"https://example.com/my%20module.ts", false, "example.com/my%20module.ts"},
+		{"file:///%C3%A9.ts", true, "\u00e9.ts"},
+		{"file:///e%CC%81.ts", true, "e\u0301.ts"},
+		{"https://example.com/..%2F..%2Fetc%2Fpasswd", true, "example.com/..%2F..%2Fetc%2Fpasswd"},
+		{"https://example.com/a%5Cb.ts", true, "example.com/a%5Cb.ts"},
+		{"https://example.com/%2E%2E/x.ts", true, "example.com/%2E%2E/x.ts"},
+		{"https://example.com/a%00.ts", true, "example.com/a%00.ts"},
+		{"https://example.com/100%.ts", true, "example.com/100%.ts"},
+	} {
+		if got := HostPrefixedLayout(tt.decode).Path(tt.input); got != tt.want {
+			t.Errorf("HostPrefixedLayout(%v).Path(%q) = %q, want %q", tt.decode, tt.input, got, tt.want)
+		}
+	}
+}
+
+func TestFlatAndHashedLayouts(t *testing.T) {
+	flat := FlatLayout(true)
+	for input, want := range map[string]string{
+		"file:///src/main.ts":         "main.ts",
+		"https://esm.sh/my%20mod.js":  "my mod.js",
+		"https://esm.sh/mod.ts?v=2":   "mod_" + shortHash("?v=2", 8) + ".ts",
+		"npm:///chalk@5.3.0/index.js": "index.js",
+	} {
+		if got := flat.Path(input); got != want {
+			t.Errorf("FlatLayout.Path(%q) = %q, want %q", input, got, want)
+		}
+	}
+
+	hashed := HashedLayout()
+	seen := map[string]string{}
+	for _, input := range []string{"file:///main.ts", "https://esm.sh/mod.ts?v=1", "https://esm.sh/mod.ts?v=2", "http://esm.sh/mod.ts", "data:text/plain,x"} {
+		got := hashed.Path(input)
+		if strings.Contains(got, "/") || len(got) < 16 {
+			t.Errorf("HashedLayout.Path(%q) = %q, want a hashed file name", input, got)
+		}
+		if other, ok := seen[got]; ok {
+			t.Errorf("%q and %q both map to %q", other, input, got)
+		}
+		seen[got] = input
+		if got != hashed.Path(input) {
+			t.Errorf("HashedLayout.Path(%q) is not deterministic", input)
+		}
+	}
+	if got := hashed.Path("https://esm.sh/mod.ts?v=1"); !strings.HasSuffix(got, ".ts") {
+		t.Errorf("HashedLayout dropped the extension: %q", got)
+	}
+}
+
+func TestAddToParsedArchive(t *testing.T) {
+	ctx := context.Background()
+	id := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+
+	for _, version := range []EszipVersion{VersionV2, VersionV2_1, VersionV2_2, LatestVersion} {
+		t.Run(version.String(), func(t *testing.T) {
+			original := NewV2()
+			original.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import 'lodash'"), []byte("{}"))
+			if version.SupportsNpm() {
+				original.SetNpmSnapshot(&NpmResolutionSnapshot{
+					Packages:     []*NpmPackage{{ID: id, Dependencies: map[string]*NpmPackageID{}}},
+					RootPackages: map[string]*NpmPackageID{"lodash": id},
+				})
+			}
+			if version.SupportsOptions() {
+				original.SetChecksum(ChecksumXxh3)
+				original.SetCompression(CompressionGzip)
+			}
+			if err := original.SetVersion(version); err != nil {
+				t.Fatalf("SetVersion failed: %v", err)
+			}
+			data, err := original.IntoBytes()
+			if err != nil {
+				t.Fatalf("failed to serialize: %v", err)
+			}
+
+			parsed, err := ParseBytes(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			want := parsed.Summary()
+			v2, _ := parsed.V2()
+			v2.AddModule("file:///new.js", ModuleKindJavaScript, []byte("new"), nil)
+			data, err = v2.IntoBytes()
+			if err != nil {
+				t.Fatalf("failed to serialize: %v", err)
+			}
+
+			appended, err := ParseBytes(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to parse appended archive: %v", err)
+			}
+			want.Modules++
+			want.SourceBytes += 3
+			if got := appended.Summary(); got != want {
+				t.Errorf("summary = %+v, want %+v", got, want)
+			}
+			if got := appended.Specifiers(); !slices.Equal(got, []string{"file:///main.js", "file:///new.js"}) {
+				t.Errorf("specifiers = %v", got)
+			}
+			if sourceMap, err := appended.GetModule("file:///main.js").SourceMap(ctx); err != nil || string(sourceMap) != "{}" {
+				t.Errorf("original source map = %q, %v", sourceMap, err)
+			}
+		})
+	}
+}
+
 func TestNpmSnapshotWithDependencies(t *testing.T) {
 	ctx := context.Background()
 
@@ -1363,6 +1816,249 @@ func TestNpmSnapshotWithDependencies(t *testing.T) {
 	}
 }
 
+func TestNpmSnapshotQueries(t *testing.T) {
+	a := &NpmPackageID{Name: "a", Version: "1.0.0"}
+	b := &NpmPackageID{Name: "b", Version: "2.0.0"}
+	c := &NpmPackageID{Name: "c", Version: "1.0.0"}
+	ms1 := &NpmPackageID{Name: "ms", Version: "2.1.3"}
+	ms2 := &NpmPackageID{Name: "ms", Version: "10.0.0"}
+	msPre := &NpmPackageID{Name: "ms", Version: "10.0.0-beta.2"}
+	self := &NpmPackageID{Name: "self", Version: "1.0.0"}
+	snapshot := &NpmResolutionSnapshot{
+		Packages: []*NpmPackage{
+			{ID: a, Dependencies: map[string]*NpmPackageID{"b@2": b, "ms@^2": ms1}},
+			{ID: b, Dependencies: map[string]*NpmPackageID{"c@1": c}},
+			{ID: c, Dependencies: map[string]*NpmPackageID{"a@1": a, "ms@10": ms2}},
+			{ID: ms2, Dependencies: map[string]*NpmPackageID{}},
+			{ID: ms1, Dependencies: map[string]*NpmPackageID{}},
+			{ID: msPre, Dependencies: map[string]*NpmPackageID{}},
+			{ID: self, Dependencies: map[string]*NpmPackageID{"self@1": self}},
+		},
+		RootPackages: map[string]*NpmPackageID{"a@1": a, "ms": ms2},
+	}
+
+	for req, want := range map[string]string{"a@1": "a@1.0.0", "npm:ms": "ms@10.0.0", "c@1.0.0": "c@1.0.0"} {
+		pkg, err := snapshot.ResolvePackage(req)
+		if err != nil || pkg.ID.String() != want {
+			t.Errorf("ResolvePackage(%q) = %v, %v, want %s", req, pkg, err, want)
+		}
+	}
+	if _, err := snapshot.ResolvePackage("missing@1"); !errors.Is(err, ErrNpmPackageNotFound) {
+		t.Errorf("ResolvePackage(missing) error = %v", err)
+	}
+
+	var versions []string
+	for _, pkg := range snapshot.AllVersionsOf("ms") {
+		versions = append(versions, pkg.ID.Version)
+	}
+	if want := []string{"2.1.3", "10.0.0-beta.2", "10.0.0"}; !slices.Equal(versions, want) {
+		t.Errorf("AllVersionsOf(ms) = %q, want %q", versions, want)
+	}
+	if versions := snapshot.AllVersionsOf("missing"); len(versions) != 0 {
+		t.Errorf("AllVersionsOf(missing) = %v", versions)
+	}
+
+	tree, err := snapshot.DependencyTree(a)
+	if err != nil {
+		t.Fatalf("DependencyTree failed: %v", err)
+	}
+	var lines []string
+	var walk func(node *NpmDependencyNode, depth int)
+	walk = func(node *NpmDependencyNode, depth int) {
+		line := strings.Repeat("  ", depth) + node.Req + " " + node.Package.ID.String()
+		if node.Cycle {
+			line += " (cycle)"
+		}
+		lines = append(lines, line)
+		for _, child := range node.Dependencies {
+			walk(child, depth+1)
+		}
+	}
+	walk(tree, 0)
+	want := []string{
+		" a@1.0.0",
+		"  b@2 b@2.0.0",
+		"    c@1 c@1.0.0",
+		"      a@1 a@1.0.0 (cycle)",
+		"      ms@10 ms@10.0.0",
+		"  ms@^2 ms@2.1.3",
+	}
+	if !slices.Equal(lines, want) {
+		t.Errorf("DependencyTree =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+	if _, err := snapshot.DependencyTree(&NpmPackageID{Name: "missing", Version: "1.0.0"}); !errors.Is(err, ErrNpmPackageNotFound) {
+		t.Errorf("DependencyTree(missing) error = %v", err)
+	}
+
+	var cycles []string
+	for _, cycle := range snapshot.Cycles() {
+		var ids []string
+		for _, id := range cycle {
+			ids = append(ids, id.String())
+		}
+		cycles = append(cycles, strings.Join(ids, " "))
+	}
+	if want := []string{"a@1.0.0 b@2.0.0 c@1.0.0", "self@1.0.0"}; !slices.Equal(cycles, want) {
+		t.Errorf("Cycles = %q, want %q", cycles, want)
+	}
+}
+
+func TestNpmIntegrity(t *testing.T) {
+	ctx := context.Background()
+	tarball := []byte("package tarball")
+	sum := sha512.Sum512(tarball)
+	integrity := "sha512-" + base64.StdEncoding.EncodeToString(sum[:])
+
+	lodash := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+	ms := &NpmPackageID{Name: "ms", Version: "2.1.3"}
+	e := NewV2()
+	e.SetChecksum(ChecksumSha256)
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import 'npm:lodash';"), nil)
+	e.SetNpmSnapshot(&NpmResolutionSnapshot{
+		Packages: []*NpmPackage{
+			{ID: lodash, Dependencies: map[string]*NpmPackageID{"ms": ms}, Integrity: integrity, Tarball: "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz"},
+			{ID: ms, Dependencies: map[string]*NpmPackageID{}},
+		},
+		RootPackages: map[string]*NpmPackageID{"lodash": lodash},
+	})
+	before, err := e.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Versions before v2.6 leave the integrity data out.
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	pkg, err := parsed.npmSnapshot().ResolvePackage("lodash")
+	if err != nil || pkg.Integrity != "" || pkg.Tarball != "" {
+		t.Errorf("v2.3 package = %+v, %v; want no integrity", pkg, err)
+	}
+	if ok, diff, err := Equal(ctx, &EszipUnion{v2: e}, parsed, EqualOptions{}); err != nil || ok || !strings.Contains(fmt.Sprint(diff), "different integrity") {
+		t.Errorf("Equal = %v, %v, %v; want an integrity difference", ok, diff, err)
+	}
+
+	if err := e.SetVersion(VersionV2_6); err != nil {
+		t.Fatal(err)
+	}
+	if data, err = e.IntoBytes(); err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	check := func(name string, snapshot *NpmResolutionSnapshot) {
+		t.Helper()
+		pkg, err := snapshot.ResolvePackage("lodash")
+		if err != nil || pkg.Integrity != integrity || pkg.Tarball != "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz" {
+			t.Errorf("%s: lodash = %+v, %v", name, pkg, err)
+		}
+		if pkg, err := snapshot.Package(ms); err != nil || pkg.Integrity != "" || pkg.Tarball != "" {
+			t.Errorf("%s: ms = %+v, %v", name, pkg, err)
+		}
+	}
+	parsed, err = ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	if v2.Version() != VersionV2_6 {
+		t.Errorf("version = %s", v2.Version())
+	}
+	check("ParseBytes", parsed.npmSnapshot())
+	if size := e.EstimatedSize(); size != int64(len(data)) {
+		t.Errorf("EstimatedSize = %d, want %d", size, len(data))
+	}
+	normalized, err := Normalize(ctx, &EszipUnion{v2: e}, NormalizeOptions{})
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if normalized.Version() != VersionV2_6 {
+		t.Errorf("normalized version = %s, want v2.6", normalized.Version())
+	}
+	check("Normalize", normalized.TakeNpmSnapshot())
+	var patched bytes.Buffer
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///main.js", Source: []byte("export {};")}}
+	if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+	repatched, err := ParseV2Sync(ctx, bytes.NewReader(patched.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse patched archive: %v", err)
+	}
+	check("PatchArchive", repatched.TakeNpmSnapshot())
+
+	after, err := e.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before != after {
+		t.Error("changing the version changed the fingerprint")
+	}
+	stripped, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pkg := range stripped.npmSnapshot().Packages {
+		pkg.Integrity, pkg.Tarball = "", ""
+	}
+	if without, err := stripped.Fingerprint(ctx); err != nil || without == after {
+		t.Errorf("integrity data did not change the fingerprint: %v", err)
+	}
+
+	lodashPkg, _ := parsed.npmSnapshot().ResolvePackage("lodash")
+	if err := lodashPkg.VerifyTarball(tarball); err != nil {
+		t.Errorf("VerifyTarball failed: %v", err)
+	}
+	if err := lodashPkg.VerifyTarball([]byte("tampered")); !errors.Is(err, ErrNpmIntegrityMismatch) {
+		t.Errorf("VerifyTarball(tampered) error = %v, want ErrNpmIntegrityMismatch", err)
+	}
+	weak := &NpmPackage{ID: ms, Integrity: "sha1-" + base64.StdEncoding.EncodeToString(make([]byte, 20)) + " " + integrity}
+	if err := weak.VerifyTarball(tarball); err != nil {
+		t.Errorf("VerifyTarball with the strongest digest matching failed: %v", err)
+	}
+	for _, pkg := range []*NpmPackage{{ID: ms}, {ID: ms, Integrity: "md5-AAAA"}} {
+		if err := pkg.VerifyTarball(tarball); err == nil || errors.Is(err, ErrNpmIntegrityMismatch) {
+			t.Errorf("VerifyTarball with integrity %q error = %v", pkg.Integrity, err)
+		}
+	}
+
+	corrupt := bytes.Clone(data)
+	idx := bytes.LastIndex(corrupt, []byte("registry.npmjs.org"))
+	if idx < 0 {
+		t.Fatal("could not find tarball URL")
+	}
+	corrupt[idx] = 'R'
+	var pe *ParseError
+	if _, err := ParseBytes(ctx, corrupt); !errors.As(err, &pe) || pe.Type != ErrInvalidV26NpmIntegrityHash || pe.Section != "npm_integrity" {
+		t.Errorf("error = %v, want ErrInvalidV26NpmIntegrityHash in npm_integrity", err)
+	}
+
+	lock := []byte(`{
+		"lockfileVersion": 3,
+		"packages": {
+			"": {"dependencies": {"ms": "^2.1.3"}},
+			"node_modules/ms": {"version": "2.1.3", "resolved": "https://registry.npmjs.org/ms/-/ms-2.1.3.tgz", "integrity": "` + integrity + `"}
+		}
+	}`)
+	snapshot, err := NpmSnapshotFromLockfile(lock, LockfilePackageLock)
+	if err != nil {
+		t.Fatalf("NpmSnapshotFromLockfile failed: %v", err)
+	}
+	if pkg := snapshot.Packages[0]; pkg.Integrity != integrity || pkg.Tarball != "https://registry.npmjs.org/ms/-/ms-2.1.3.tgz" {
+		t.Errorf("package-lock.json package = %+v", pkg)
+	}
+	deno := []byte(`{"version": "4", "specifiers": {"npm:ms@2": "2.1.3"}, "npm": {"ms@2.1.3": {"integrity": "` + integrity + `"}}}`)
+	if snapshot, err = NpmSnapshotFromLockfile(deno, LockfileDeno); err != nil {
+		t.Fatalf("NpmSnapshotFromLockfile failed: %v", err)
+	}
+	if pkg := snapshot.Packages[0]; pkg.Integrity != integrity || pkg.Tarball != "" {
+		t.Errorf("deno.lock package = %+v", pkg)
+	}
+}
+
 // --- Parse existing test fixtures ---
 
 func TestParseJsonEszip(t *testing.T) {
@@ -1444,16 +2140,90 @@ func TestParseWasmEszip(t *testing.T) {
 	}
 }
 
-// --- V2 module kind roundtrip ---
-
-func TestAllModuleKindsRoundtrip(t *testing.T) {
+func TestModuleWasmInfo(t *testing.T) {
 	ctx := context.Background()
-
-	eszip := NewV2()
-	eszip.AddModule("file:///test.js", ModuleKindJavaScript, []byte("js"), nil)
-	eszip.AddModule("file:///test.json", ModuleKindJson, []byte(`{"a":1}`), nil)
-	eszip.AddModule("file:///test.wasm", ModuleKindWasm, []byte{0x00, 0x61, 0x73, 0x6d}, nil)
-	eszip.AddOpaqueData("data:///config", []byte("opaque"))
+	data, err := os.ReadFile("testdata/wasm.eszip2_3")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	archive, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse wasm.eszip2_3: %v", err)
+	}
+
+	info, err := archive.GetModule("file:///math.wasm").WasmInfo(ctx)
+	if err != nil {
+		t.Fatalf("WasmInfo failed: %v", err)
+	}
+	if got := info.Exported(wasm.KindFunction); !slices.Equal(got, []string{"add", "subtract"}) {
+		t.Errorf("exported functions = %v", got)
+	}
+	if len(info.Imports) != 0 || len(info.Memories) != 1 || info.Memories[0].Min != 16 {
+		t.Errorf("WasmInfo = %+v", info)
+	}
+
+	for _, spec := range archive.Specifiers() {
+		if m := archive.GetModule(spec); m != nil && m.Kind != ModuleKindWasm {
+			if _, err := m.WasmInfo(ctx); err == nil {
+				t.Errorf("WasmInfo of %s module %s succeeded", m.Kind, spec)
+			}
+		}
+	}
+
+	v2 := NewV2()
+	v2.AddModule("file:///bad.wasm", ModuleKindWasm, []byte("\x00asm\x01\x00\x00\x00\x07\x05"), nil)
+	var ferr *wasm.FormatError
+	if _, err := v2.GetModule("file:///bad.wasm").WasmInfo(ctx); !errors.As(err, &ferr) {
+		t.Errorf("WasmInfo of a truncated module error = %v, want *wasm.FormatError", err)
+	}
+	if err := v2.AddModuleChecked("file:///bad2.wasm", ModuleKindWasm, []byte("\x00asm\x01\x00\x00\x00\x07\x05"), nil); err == nil {
+		t.Error("AddModuleChecked accepted a truncated Wasm module")
+	}
+}
+
+func TestModuleParsedSourceMap(t *testing.T) {
+	ctx := context.Background()
+	v2 := NewV2()
+	v2.AddModule("file:///stored.js", ModuleKindJavaScript, []byte("a;b"),
+		[]byte(`{"version":3,"sources":["stored.ts"],"names":[],"mappings":"AAAA,EAAE"}`))
+	inline := base64.StdEncoding.EncodeToString([]byte(`{"version":3,"sources":["inline.ts"],"names":[],"mappings":"AACA"}`))
+	v2.AddModule("file:///inline.js", ModuleKindJavaScript, []byte("a;\n//# sourceMappingURL=data:application/json;base64,"+inline+"\n"), nil)
+	v2.AddModule("file:///plain.js", ModuleKindJavaScript, []byte("a;"), nil)
+	v2.AddModule("file:///bad.js", ModuleKindJavaScript, []byte("a;"), []byte(`{"version":3,"sources":[],"mappings":"AAAA"}`))
+
+	m, err := v2.GetModule("file:///stored.js").ParsedSourceMap(ctx)
+	if err != nil {
+		t.Fatalf("ParsedSourceMap failed: %v", err)
+	}
+	if p, ok := m.Lookup(1, 3); !ok || p != (sourcemap.Position{Source: "stored.ts", Line: 1, Column: 3}) {
+		t.Errorf("Lookup(1, 3) = %+v, %v", p, ok)
+	}
+	m, err = v2.GetModule("file:///inline.js").ParsedSourceMap(ctx)
+	if err != nil {
+		t.Fatalf("ParsedSourceMap of an inline map failed: %v", err)
+	}
+	if p, ok := m.Lookup(1, 1); !ok || p.Source != "inline.ts" || p.Line != 2 {
+		t.Errorf("inline Lookup(1, 1) = %+v, %v", p, ok)
+	}
+	if _, err := v2.GetModule("file:///plain.js").ParsedSourceMap(ctx); err == nil {
+		t.Error("ParsedSourceMap of a module without a map succeeded")
+	}
+	var ferr *sourcemap.FormatError
+	if _, err := v2.GetModule("file:///bad.js").ParsedSourceMap(ctx); !errors.As(err, &ferr) {
+		t.Errorf("ParsedSourceMap of a malformed map error = %v, want *sourcemap.FormatError", err)
+	}
+}
+
+// --- V2 module kind roundtrip ---
+
+func TestAllModuleKindsRoundtrip(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///test.js", ModuleKindJavaScript, []byte("js"), nil)
+	eszip.AddModule("file:///test.json", ModuleKindJson, []byte(`{"a":1}`), nil)
+	eszip.AddModule("file:///test.wasm", ModuleKindWasm, []byte{0x00, 0x61, 0x73, 0x6d}, nil)
+	eszip.AddOpaqueData("data:///config", []byte("opaque"))
 
 	data, err := eszip.IntoBytes()
 	if err != nil {
@@ -1509,6 +2279,133 @@ func TestV2RedirectCycle(t *testing.T) {
 	}
 }
 
+func TestResolveSpecifier(t *testing.T) {
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), nil)
+	eszip.AddRedirect("file:///alias.js", "file:///mid.js")
+	eszip.AddRedirect("file:///mid.js", "file:///main.js")
+	eszip.AddRedirect("file:///dangling.js", "file:///gone.js")
+	eszip.AddRedirect("file:///a.js", "file:///b.js")
+	eszip.AddRedirect("file:///b.js", "file:///a.js")
+	eszip.modules.Insert("npm:lodash", &NpmSpecifierEntry{PackageID: 0})
+
+	tests := []struct {
+		specifier string
+		final     string
+		chain     []string
+		err       error
+	}{
+		{"file:///main.js", "file:///main.js", []string{"file:///main.js"}, nil},
+		{"file:///alias.js", "file:///main.js", []string{"file:///alias.js", "file:///mid.js", "file:///main.js"}, nil},
+		{"npm:lodash", "npm:lodash", []string{"npm:lodash"}, nil},
+		{"file:///missing.js", "", []string{"file:///missing.js"}, ErrSpecifierNotFound},
+		{"file:///dangling.js", "", []string{"file:///dangling.js", "file:///gone.js"}, ErrSpecifierNotFound},
+		{"file:///a.js", "", []string{"file:///a.js", "file:///b.js", "file:///a.js"}, ErrRedirectCycle},
+	}
+	for _, tt := range tests {
+		final, chain, err := eszip.ResolveSpecifier(tt.specifier)
+		if !errors.Is(err, tt.err) || (tt.err == nil && err != nil) {
+			t.Errorf("%s: expected error %v, got %v", tt.specifier, tt.err, err)
+		}
+		if final != tt.final {
+			t.Errorf("%s: expected %q, got %q", tt.specifier, tt.final, final)
+		}
+		if !slices.Equal(chain, tt.chain) {
+			t.Errorf("%s: expected chain %v, got %v", tt.specifier, tt.chain, chain)
+		}
+	}
+	if !eszip.IsNpmSpecifier("npm:lodash") || eszip.IsNpmSpecifier("file:///main.js") || eszip.IsNpmSpecifier("file:///missing.js") {
+		t.Error("IsNpmSpecifier does not tell npm specifiers from other entries")
+	}
+
+	// Parsed archives keep npm specifiers in the npm snapshot rather than
+	// among the modules.
+	npm := NewV2()
+	foo := &NpmPackageID{Name: "foo", Version: "1.0.0"}
+	npm.SetNpmSnapshot(&NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: foo, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"foo@1": foo},
+	})
+	npm.AddRedirect("file:///r.js", "foo@1")
+	data, err := npm.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseBytes(context.Background(), data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	final, chain, err := v2.ResolveSpecifier("file:///r.js")
+	if err != nil || final != "foo@1" || !slices.Equal(chain, []string{"file:///r.js", "foo@1"}) {
+		t.Errorf("ResolveSpecifier = %q %v %v, want foo@1", final, chain, err)
+	}
+	if !v2.IsNpmSpecifier(final) || v2.IsNpmSpecifier("file:///r.js") {
+		t.Error("IsNpmSpecifier does not tell the npm specifier from the redirect")
+	}
+	if v2.GetModule("file:///r.js") != nil {
+		t.Error("GetModule returned a module for a redirect to an npm specifier")
+	}
+}
+
+func TestRedirectManagement(t *testing.T) {
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), nil)
+	eszip.AddRedirect("file:///alias.js", "file:///main.js")
+	eszip.AddRedirect("file:///old.js", "file:///alias.js")
+
+	want := map[string]string{"file:///alias.js": "file:///main.js", "file:///old.js": "file:///alias.js"}
+	if got := eszip.Redirects(); !maps.Equal(got, want) {
+		t.Errorf("Redirects() = %v, want %v", got, want)
+	}
+	if _, err := eszip.IntoBytes(WithRedirectValidation()); err != nil {
+		t.Errorf("valid redirects: %v", err)
+	}
+
+	if eszip.RemoveRedirect("file:///main.js") || eszip.GetModule("file:///main.js") == nil {
+		t.Error("RemoveRedirect removed a module")
+	}
+	if eszip.RemoveRedirect("file:///missing.js") {
+		t.Error("RemoveRedirect reported removing a missing specifier")
+	}
+	if !eszip.RemoveRedirect("file:///alias.js") {
+		t.Fatal("RemoveRedirect did not remove file:///alias.js")
+	}
+	if got := eszip.Redirects(); len(got) != 1 {
+		t.Errorf("Redirects() after removal = %v", got)
+	}
+
+	// file:///old.js now dangles.
+	if _, err := eszip.IntoBytes(); err != nil {
+		t.Errorf("without validation: %v", err)
+	}
+	if _, err := eszip.IntoBytes(WithRedirectValidation()); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("dangling redirect: expected ErrSpecifierNotFound, got %v", err)
+	}
+	eszip.AddRedirect("file:///alias.js", "file:///old.js")
+	if _, err := eszip.IntoBytes(WithRedirectValidation()); !errors.Is(err, ErrRedirectCycle) {
+		t.Errorf("redirect cycle: expected ErrRedirectCycle, got %v", err)
+	}
+
+	// A redirect may lead to an npm specifier, a root package of the
+	// snapshot, through other redirects too.
+	npm := NewV2()
+	foo := &NpmPackageID{Name: "foo", Version: "1.0.0"}
+	npm.SetNpmSnapshot(&NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: foo, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"foo@1": foo},
+	})
+	npm.AddRedirect("file:///r.js", "foo@1")
+	npm.AddRedirect("file:///alias.js", "file:///r.js")
+	if _, err := npm.IntoBytes(WithRedirectValidation()); err != nil {
+		t.Errorf("redirect to an npm specifier: %v", err)
+	}
+	npm.AddRedirect("file:///other.js", "bar@1")
+	if _, err := npm.IntoBytes(WithRedirectValidation()); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("redirect to a missing npm specifier: expected ErrSpecifierNotFound, got %v", err)
+	}
+}
+
 // --- V2 GetModule for npm specifier ---
 
 func TestV2GetModuleNpmSpecifier(t *testing.T) {
@@ -1620,8 +2517,254 @@ func TestParseV2Streaming(t *testing.T) {
 	}
 }
 
+func TestParseIncremental(t *testing.T) {
+	ctx := context.Background()
+	big := bytes.Repeat([]byte("x"), 64<<10)
+
+	archive := NewV2()
+	archive.AddModule("file:///a.js", ModuleKindJavaScript, big, []byte("{}"))
+	archive.AddModule("file:///b.js", ModuleKindJavaScript, big, nil)
+	archive.AddModule("file:///c.js", ModuleKindJavaScript, big, nil)
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	t.Run("order", func(t *testing.T) {
+		_, completion, err := ParseIncremental(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		var got []string
+		for {
+			specifier, done, err := completion.Next(ctx)
+			if err != nil {
+				t.Fatalf("Next failed: %v", err)
+			}
+			if done {
+				break
+			}
+			got = append(got, specifier)
+		}
+		want := []string{"file:///a.js", "file:///b.js", "file:///c.js", "file:///a.js"}
+		if !slices.Equal(got, want) {
+			t.Errorf("Next order = %v, want %v", got, want)
+		}
+		if err := completion.Complete(ctx); err != nil {
+			t.Errorf("Complete after done = %v", err)
+		}
+	})
+
+	t.Run("abort", func(t *testing.T) {
+		r := &countingReader{r: bytes.NewReader(data)}
+		eszip, completion, err := ParseIncremental(ctx, r)
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+
+		waiting := make(chan error, 1)
+		go func() {
+			_, err := eszip.GetModule("file:///c.js").Source(ctx)
+			waiting <- err
+		}()
+
+		if specifier, done, err := completion.Next(ctx); err != nil || done || specifier != "file:///a.js" {
+			t.Fatalf("Next = %q, %v, %v", specifier, done, err)
+		}
+		if r.n >= int64(len(data))/2 {
+			t.Errorf("read %d of %d bytes after one Next", r.n, len(data))
+		}
+
+		completion.Abort()
+
+		source, err := eszip.GetModule("file:///a.js").Source(ctx)
+		if err != nil || !bytes.Equal(source, big) {
+			t.Errorf("loaded source = %d bytes, %v", len(source), err)
+		}
+		var perr *ParseError
+		if _, err := eszip.GetModule("file:///b.js").Source(ctx); !errors.As(err, &perr) || perr.Type != ErrSourceNotLoaded {
+			t.Errorf("unloaded source error = %v, want ErrSourceNotLoaded", err)
+		}
+		if _, err := eszip.GetModule("file:///a.js").SourceMap(ctx); !errors.As(err, &perr) || perr.Type != ErrSourceNotLoaded {
+			t.Errorf("unloaded source map error = %v, want ErrSourceNotLoaded", err)
+		}
+		if err := <-waiting; !errors.As(err, &perr) || perr.Type != ErrSourceNotLoaded {
+			t.Errorf("waiting reader error = %v, want ErrSourceNotLoaded", err)
+		}
+		if _, done, err := completion.Next(ctx); !done || err != nil {
+			t.Errorf("Next after Abort = %v, %v; want done", done, err)
+		}
+	})
+
+	t.Run("sticky_error", func(t *testing.T) {
+		_, completion, err := ParseIncremental(ctx, bytes.NewReader(data[:len(data)-100]))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		first := completion.Complete(ctx)
+		if first == nil {
+			t.Fatal("expected error for truncated archive")
+		}
+		if _, _, err := completion.Next(ctx); err != first {
+			t.Errorf("Next after error = %v, want %v", err, first)
+		}
+	})
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
 // --- Section tests ---
 
+func TestParseURL(t *testing.T) {
+	ctx := context.Background()
+	e := NewV2()
+	e.SetChecksum(ChecksumSha256)
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import './lib.js';"), nil)
+	e.AddModule("file:///lib.js", ModuleKindJavaScript, []byte("export const later = 1;"), nil)
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cut := bytes.Index(data, []byte("export const later"))
+	if cut < 0 {
+		t.Fatal("could not find lib.js source")
+	}
+
+	release := make(chan struct{})
+	truncate := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/app.eszip2" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:cut])
+		w.(http.Flusher).Flush()
+		<-release
+		if !truncate {
+			w.Write(data[cut:])
+		}
+	}))
+	defer srv.Close()
+
+	archive, wait, err := ParseURL(ctx, srv.URL+"/app.eszip2", srv.Client())
+	if err != nil {
+		t.Fatalf("ParseURL failed: %v", err)
+	}
+	// The entry module is readable while the rest is still downloading.
+	source, err := archive.GetModule("file:///main.js").Source(ctx)
+	if err != nil || string(source) != "import './lib.js';" {
+		t.Fatalf("main.js source = %q, %v", source, err)
+	}
+	short, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	if _, err := archive.GetModule("file:///lib.js").Source(short); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("lib.js source before it arrived: error = %v, want DeadlineExceeded", err)
+	}
+	cancel()
+	release <- struct{}{}
+	if err := wait(ctx); err != nil {
+		t.Fatalf("download failed: %v", err)
+	}
+	if source, err := archive.GetModule("file:///lib.js").Source(ctx); err != nil || string(source) != "export const later = 1;" {
+		t.Errorf("lib.js source = %q, %v", source, err)
+	}
+
+	truncate = true
+	archive, wait, err = ParseURL(ctx, srv.URL+"/app.eszip2", nil)
+	if err != nil {
+		t.Fatalf("ParseURL failed: %v", err)
+	}
+	release <- struct{}{}
+	if err := wait(ctx); err == nil {
+		t.Error("a truncated download did not fail")
+	}
+	var pe *ParseError
+	if _, err := archive.GetModule("file:///lib.js").Source(ctx); !errors.As(err, &pe) || pe.Type != ErrSourceNotLoaded {
+		t.Errorf("lib.js source after a failed download: error = %v, want ErrSourceNotLoaded", err)
+	}
+
+	if _, _, err := ParseURL(ctx, srv.URL+"/missing", nil); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("ParseURL of a missing archive error = %v", err)
+	}
+}
+
+func TestParseURLLazy(t *testing.T) {
+	ctx := context.Background()
+	big := bytes.Repeat([]byte("// padding\n"), 20000)
+	e := NewV2()
+	e.SetChecksum(ChecksumSha256)
+	e.AddModule("file:///big.js", ModuleKindJavaScript, big, nil)
+	e.AddModule("file:///other.js", ModuleKindJavaScript, big, nil)
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export default 1;"), nil)
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var served atomic.Int64
+	var content atomic.Pointer[[]byte]
+	content.Store(&data)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/no-range" {
+			w.Write(data)
+			return
+		}
+		current := *content.Load()
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, len(current)))
+		cw := &countingResponseWriter{ResponseWriter: w, n: &served}
+		http.ServeContent(cw, r, "", time.Time{}, bytes.NewReader(current))
+	}))
+	defer srv.Close()
+
+	archive, err := ParseURLLazy(ctx, srv.URL+"/app.eszip2", srv.Client())
+	if err != nil {
+		t.Fatalf("ParseURLLazy failed: %v", err)
+	}
+	source, err := archive.GetModule("file:///main.js").Source(ctx)
+	if err != nil || string(source) != "export default 1;" {
+		t.Fatalf("main.js source = %q, %v", source, err)
+	}
+	if n := served.Load(); n >= int64(len(data))/2 {
+		t.Errorf("served %d of %d bytes to read one small module", n, len(data))
+	}
+	source, err = archive.GetModule("file:///big.js").Source(ctx)
+	if err != nil || !bytes.Equal(source, big) {
+		t.Errorf("big.js source: %d bytes, %v", len(source), err)
+	}
+
+	replaced := append(bytes.Clone(data), 0)
+	content.Store(&replaced)
+	if _, err := archive.GetModule("file:///other.js").Source(ctx); err == nil || !strings.Contains(err.Error(), "changed") {
+		t.Errorf("reading a replaced archive error = %v", err)
+	}
+	content.Store(&data)
+
+	if _, err := ParseURLLazy(ctx, srv.URL+"/no-range", nil); err == nil || !strings.Contains(err.Error(), "range") {
+		t.Errorf("ParseURLLazy without range support error = %v", err)
+	}
+}
+
+// countingResponseWriter counts the body bytes written through it.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n *atomic.Int64
+}
+
+func (w *countingResponseWriter) Write(p []byte) (int, error) {
+	w.n.Add(int64(len(p)))
+	return w.ResponseWriter.Write(p)
+}
+
 func TestSectionMethods(t *testing.T) {
 	s := &Section{
 		content:  []byte("hello"),
@@ -1790,3 +2933,5359 @@ func TestParseV2InvalidModuleKind(t *testing.T) {
 		}
 	}
 }
+
+func TestParseLenient(t *testing.T) {
+	ctx := context.Background()
+
+	build := func(t *testing.T, checksum ChecksumType) []byte {
+		t.Helper()
+		eszip := NewV2()
+		eszip.SetChecksum(checksum)
+		eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("aaaa"), nil)
+		eszip.AddModule("file:///b.js", ModuleKindJavaScript, []byte("bbbb"), []byte("{}"))
+		eszip.AddModule("file:///c.js", ModuleKindJavaScript, []byte("cccc"), nil)
+		data, err := eszip.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		return data
+	}
+
+	assertSource := func(t *testing.T, archive *EszipUnion, specifier, want string) {
+		t.Helper()
+		module := archive.GetModule(specifier)
+		if module == nil {
+			t.Fatalf("%s missing", specifier)
+		}
+		source, err := module.Source(ctx)
+		if err != nil || string(source) != want {
+			t.Errorf("%s source = %q, %v, want %q", specifier, source, err, want)
+		}
+	}
+
+	t.Run("module kind", func(t *testing.T) {
+		data := build(t, ChecksumNone)
+		kindOffset := bytes.Index(data, []byte("file:///b.js")) + len("file:///b.js") + 1 + 16
+		data[kindOffset] = 99
+
+		if _, err := ParseBytes(ctx, data); err == nil {
+			t.Fatal("expected strict parse to fail")
+		}
+		archive, errs, err := ParseLenient(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("ParseLenient: %v", err)
+		}
+		if len(errs) != 1 {
+			t.Fatalf("got %d errors, want 1: %v", len(errs), errs)
+		}
+		pe := errs[0]
+		if pe.Type != ErrInvalidV2ModuleKind || pe.Section != "modules" || pe.Offset != kindOffset || pe.Length != 1 || pe.Got != "99" {
+			t.Errorf("error = %+v, want module kind 99 in modules at %d", pe, kindOffset)
+		}
+		if archive.GetModule("file:///b.js") != nil {
+			t.Error("module with unknown kind was kept")
+		}
+		assertSource(t, archive, "file:///a.js", "aaaa")
+		assertSource(t, archive, "file:///c.js", "cccc")
+	})
+
+	t.Run("checksums", func(t *testing.T) {
+		data := build(t, ChecksumSha256)
+		sourceOffset := bytes.Index(data, []byte("bbbb"))
+		data[sourceOffset] = 'x'
+		mapOffset := bytes.Index(data, []byte("{}"))
+		data[mapOffset] = '['
+
+		if _, err := ParseBytes(ctx, data); err == nil {
+			t.Fatal("expected strict parse to fail")
+		}
+		archive, errs, err := ParseLenient(ctx, bytes.NewReader(data), WithConcurrency(4))
+		if err != nil {
+			t.Fatalf("ParseLenient: %v", err)
+		}
+		if len(errs) != 2 {
+			t.Fatalf("got %d errors, want 2: %v", len(errs), errs)
+		}
+		for i, want := range []struct {
+			section string
+			offset  int
+			length  int
+		}{{"sources", sourceOffset, 4 + 32}, {"source_maps", mapOffset, 2 + 32}} {
+			pe := errs[i]
+			if pe.Type != ErrInvalidV2SourceHash || pe.Section != want.section || pe.Offset != want.offset || pe.Length != want.length {
+				t.Errorf("error %d = %+v, want source hash in %s at %d", i, pe, want.section, want.offset)
+			}
+			if len(pe.Expected) != 64 || len(pe.Got) != 64 || pe.Expected == pe.Got {
+				t.Errorf("error %d hashes: expected %q, got %q", i, pe.Expected, pe.Got)
+			}
+		}
+		var perr *ParseError
+		if _, err := archive.GetModule("file:///b.js").Source(ctx); !errors.As(err, &perr) || perr.Type != ErrSourceNotLoaded {
+			t.Errorf("corrupt source error = %v, want ErrSourceNotLoaded", err)
+		}
+		assertSource(t, archive, "file:///a.js", "aaaa")
+		assertSource(t, archive, "file:///c.js", "cccc")
+	})
+
+	t.Run("structural", func(t *testing.T) {
+		data := build(t, ChecksumSha256)
+		data[bytes.Index(data, []byte("file:///a.js"))] = 'F'
+		_, _, err := ParseLenient(ctx, bytes.NewReader(data))
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Type != ErrInvalidV2HeaderHash || pe.Section != "modules" {
+			t.Errorf("error = %v, want header hash failure in modules", err)
+		}
+	})
+}
+
+func TestParseErrorUnwrap(t *testing.T) {
+	data := append(MagicV2_2[:], 0, 0)
+	_, err := ParseBytes(context.Background(), data)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("error = %v, want it to wrap the read error", err)
+	}
+}
+
+func TestConcurrentMutationAndSerialization(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte("{}"))
+
+	const writers = 4
+	const perWriter = 50
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < perWriter; i++ {
+				spec := fmt.Sprintf("file:///w%d/m%d.js", w, i)
+				eszip.AddModule(spec, ModuleKindJavaScript, []byte(spec), nil)
+				eszip.AddRedirect(spec+".alias", spec)
+				if i%10 == 0 {
+					eszip.SetChecksum(ChecksumType(i / 10 % 3))
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(done)
+		for {
+			data, err := eszip.IntoBytes()
+			if err != nil {
+				errCh <- err
+				return
+			}
+			parsed, err := ParseBytes(ctx, data)
+			if err != nil {
+				errCh <- fmt.Errorf("serialized archive does not parse: %w", err)
+				return
+			}
+			for _, spec := range parsed.Specifiers() {
+				m := parsed.GetModule(spec)
+				if m == nil || strings.HasSuffix(spec, ".json") {
+					continue
+				}
+				src, err := m.Source(ctx)
+				if err != nil || string(src) != m.Specifier {
+					errCh <- fmt.Errorf("module %s has source %q (err %v)", m.Specifier, src, err)
+					return
+				}
+			}
+			if parsed.GetImportMap("file:///import_map.json") == nil {
+				errCh <- errors.New("import map missing from snapshot")
+				return
+			}
+			if len(parsed.Specifiers()) == 1+2*writers*perWriter {
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	<-done
+	select {
+	case err := <-errCh:
+		t.Fatal(err)
+	default:
+	}
+}
+
+// TestConcurrentReadersAndWriters mixes every kind of mutation with every
+// kind of read; run it with -race.
+func TestConcurrentReadersAndWriters(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumSha256)
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import './w0/m0.js';"), nil)
+
+	const rounds = 40
+	var writers sync.WaitGroup
+	for w := 0; w < 3; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < rounds; i++ {
+				spec := fmt.Sprintf("file:///w%d/m%d.js", w, i)
+				eszip.AddModuleWithHeaders(spec, ModuleKindJavaScript, []byte(spec), []byte("{}"), map[string]string{"x-round": fmt.Sprint(i)})
+				eszip.AddRedirect(spec+".alias", spec)
+				_ = eszip.ReplaceModuleSource(spec, []byte(spec), nil)
+				if i%3 == 0 {
+					_ = eszip.RenameSpecifier(spec, spec+"x")
+					eszip.RemoveModule(spec + ".alias")
+				}
+				switch i % 10 {
+				case 1:
+					eszip.SetArchiveMetadata(map[string]string{"round": fmt.Sprint(i)})
+				case 2:
+					eszip.SetEntrypoints([]string{"file:///main.js"})
+				case 3:
+					eszip.SetChecksum(ChecksumType(i / 10 % 3))
+				case 4:
+					eszip.SetNpmSnapshot(&NpmResolutionSnapshot{})
+				case 5:
+					_, _ = eszip.TransformSources(ctx, func(specifier string, kind ModuleKind, source []byte) ([]byte, bool, error) {
+						return source, false, nil
+					})
+				}
+			}
+		}(w)
+	}
+
+	stop := make(chan struct{})
+	errCh := make(chan error, 8)
+	var readers sync.WaitGroup
+	read := func(fn func() error) {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					// Let the writers run where goroutines are not
+					// preempted, as on js/wasm.
+					runtime.Gosched()
+				}
+				if err := fn(); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	read(func() error {
+		for spec, m := range eszip.All() {
+			if _, err := m.Source(ctx); err != nil {
+				return fmt.Errorf("source of %s: %w", spec, err)
+			}
+			_ = m.Headers()
+		}
+		return nil
+	})
+	read(func() error {
+		for _, spec := range eszip.Specifiers() {
+			if m := eszip.GetModule(spec); m != nil {
+				if _, err := m.SourceMap(ctx); err != nil {
+					return err
+				}
+			}
+		}
+		_ = eszip.Iterate()
+		return nil
+	})
+	read(func() error {
+		_ = eszip.Summary()
+		_ = eszip.ModuleSizes()
+		_ = eszip.EstimatedSize()
+		_ = eszip.PendingSources()
+		_ = eszip.Version()
+		if _, err := eszip.Entrypoints(ctx); err != nil {
+			return err
+		}
+		_, err := eszip.ArchiveMetadata(ctx)
+		return err
+	})
+	read(func() error {
+		view := eszip.ReadOnly()
+		_ = view.Specifiers()
+		_, err := eszip.Verify(ctx)
+		return err
+	})
+	read(func() error {
+		data, err := eszip.IntoBytes()
+		if err != nil {
+			return err
+		}
+		if _, err := ParseBytes(ctx, data); err != nil {
+			return fmt.Errorf("serialized archive does not parse: %w", err)
+		}
+		return nil
+	})
+
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Error(err)
+	}
+}
+
+func TestGetModuleDuringRename(t *testing.T) {
+	eszip := NewV2()
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	eszip.AddRedirect("file:///alias.js", "file:///a.js")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 2000; i++ {
+			from, to := "file:///a.js", "file:///b.js"
+			if i%2 == 1 {
+				from, to = to, from
+			}
+			if err := eszip.RenameSpecifier(from, to); err != nil {
+				t.Error(err)
+				return
+			}
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			// Let the renames run where goroutines are not preempted, as
+			// on js/wasm.
+			runtime.Gosched()
+		}
+		if eszip.GetModule("file:///alias.js") == nil {
+			t.Error("redirect seen pointing at a renamed module")
+			<-done
+			return
+		}
+	}
+}
+
+func TestChecksumMismatchDetails(t *testing.T) {
+	ctx := context.Background()
+
+	build := func(t *testing.T, checksum ChecksumType) []byte {
+		t.Helper()
+		eszip := NewV2()
+		eszip.SetChecksum(checksum)
+		eszip.AddModule("file:///test.js", ModuleKindJavaScript, []byte("hello world"), nil)
+		data, err := eszip.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		return data
+	}
+
+	assertMismatch := func(t *testing.T, err error, typ ParseErrorType, offset int, content []byte, checksum ChecksumType) {
+		t.Helper()
+		var pe *ParseError
+		if !errors.As(err, &pe) {
+			t.Fatalf("expected ParseError, got %T: %v", err, err)
+		}
+		if pe.Type != typ {
+			t.Fatalf("expected error type %v, got %v (%v)", typ, pe.Type, pe)
+		}
+		if pe.Offset != offset {
+			t.Errorf("expected offset %d, got %d", offset, pe.Offset)
+		}
+		m := pe.Mismatch
+		if m == nil {
+			t.Fatal("expected checksum mismatch details")
+		}
+		if m.Algorithm != checksum || m.Length != len(content) {
+			t.Errorf("mismatch = %+v, want algorithm %v over %d bytes", m, checksum, len(content))
+		}
+		computed := hex.EncodeToString(checksum.Hash(content))
+		if hex.EncodeToString(m.Computed) != computed {
+			t.Errorf("computed hash %x, want %s", m.Computed, computed)
+		}
+		msg := pe.Error()
+		for _, want := range []string{checksum.String(), hex.EncodeToString(m.Stored), computed} {
+			if !strings.Contains(msg, want) {
+				t.Errorf("expected %q in error %q", want, msg)
+			}
+		}
+	}
+
+	for _, checksum := range []ChecksumType{ChecksumSha256, ChecksumXxh3} {
+		t.Run(checksum.String()+"/source", func(t *testing.T) {
+			data := build(t, checksum)
+			idx := bytes.Index(data, []byte("hello world"))
+			data[idx+4] ^= 0x01
+			_, err := ParseBytes(ctx, data)
+			assertMismatch(t, err, ErrInvalidV2SourceHash, idx, data[idx:idx+11], checksum)
+		})
+
+		t.Run(checksum.String()+"/modules_header", func(t *testing.T) {
+			data := build(t, checksum)
+			idx := bytes.Index(data, []byte("file:///test.js"))
+			data[idx] ^= 0x01
+			headerStart := idx - 4
+			headerLen := int(binary.BigEndian.Uint32(data[headerStart-4 : headerStart]))
+			_, err := ParseBytes(ctx, data)
+			assertMismatch(t, err, ErrInvalidV2HeaderHash, headerStart, data[headerStart:headerStart+headerLen], checksum)
+		})
+
+		t.Run(checksum.String()+"/options_header", func(t *testing.T) {
+			data := build(t, checksum)
+			// magic(8) + len(4) + options content (4) + hash
+			data[16] ^= 0x01
+			_, err := ParseBytes(ctx, data)
+			assertMismatch(t, err, ErrInvalidV22OptionsHeaderHash, 12, data[12:16], checksum)
+		})
+	}
+}
+
+// hugeSectionInput returns a short V2.3 archive whose options header claims a
+// 200 MB section.
+func hugeSectionInput() []byte {
+	data := append([]byte{}, MagicV2_3[:]...)
+	data = binary.BigEndian.AppendUint32(data, 200<<20)
+	return append(data, 0, 0, 0, 0, 0, 0, 0, 0)
+}
+
+// allocatedBytes reports the bytes allocated while running fn.
+func allocatedBytes(fn func()) uint64 {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	fn()
+	runtime.ReadMemStats(&after)
+	return after.TotalAlloc - before.TotalAlloc
+}
+
+func TestParseBoundsSectionByInputSize(t *testing.T) {
+	ctx := context.Background()
+	data := hugeSectionInput()
+
+	var err error
+	allocated := allocatedBytes(func() {
+		_, err = ParseBytes(ctx, data)
+	})
+
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected ParseError, got %T: %v", err, err)
+	}
+	if pe.Type != ErrInvalidV2SectionLength {
+		t.Errorf("expected ErrInvalidV2SectionLength, got %v (%v)", pe.Type, pe)
+	}
+	if !strings.Contains(pe.Error(), fmt.Sprintf("declares %d bytes but only 8 remain", 200<<20)) {
+		t.Errorf("expected declared-vs-available in message, got %q", pe.Error())
+	}
+	if allocated > 1<<20 {
+		t.Errorf("allocated %d bytes parsing a %d byte input", allocated, len(data))
+	}
+}
+
+func TestParseUnknownSizeAllocatesIncrementally(t *testing.T) {
+	ctx := context.Background()
+	data := hugeSectionInput()
+
+	// Hide the size by wrapping the reader.
+	r := struct{ io.Reader }{bytes.NewReader(data)}
+
+	var err error
+	allocated := allocatedBytes(func() {
+		_, _, err = Parse(ctx, r)
+	})
+
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected ParseError, got %T: %v", err, err)
+	}
+	if pe.Type != ErrIO {
+		t.Errorf("expected ErrIO, got %v (%v)", pe.Type, pe)
+	}
+	if allocated > 4<<20 {
+		t.Errorf("allocated %d bytes parsing a %d byte input", allocated, len(data))
+	}
+}
+
+// npmSectionContent extracts the npm section content from an archive
+// serialized without checksums.
+func npmSectionContent(t testing.TB, data []byte) []byte {
+	t.Helper()
+	offset := 8 + 4 + 4 // magic, options length, options content
+	headerLen := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+	offset += 4 + headerLen
+	npmLen := int(binary.BigEndian.Uint32(data[offset : offset+4]))
+	offset += 4
+	return data[offset : offset+npmLen]
+}
+
+// parseNpmContent runs parseNpmSection over content framed as an unhashed
+// section.
+func parseNpmContent(content []byte, npmSpecifiers map[string]NpmPackageIndex) (*NpmResolutionSnapshot, error) {
+	framed := binary.BigEndian.AppendUint32(nil, uint32(len(content)))
+	framed = append(framed, content...)
+	br := newArchiveReader(bytes.NewReader(framed), parseConfig{inputSize: int64(len(framed))})
+	return parseNpmSection(br, DefaultOptionsForVersion(VersionV2_3), npmSpecifiers)
+}
+
+func TestParseNpmSectionBounds(t *testing.T) {
+	str := func(s string) []byte {
+		return append(binary.BigEndian.AppendUint32(nil, uint32(len(s))), s...)
+	}
+
+	tests := []struct {
+		name    string
+		content []byte
+	}{
+		{"huge_dep_count", append(str("a@1.0.0"), 0xff, 0xff, 0xff, 0xff)},
+		{"dep_count_exceeds_remaining", append(append(str("a@1.0.0"), 0, 0, 0, 2), str("b")...)},
+		{"huge_string_length", []byte{0xff, 0xff, 0xff, 0xff, 'a'}},
+		{"string_past_end", append([]byte{0, 0, 0, 9}, "a@1"...)},
+		{"truncated_dep_index", append(append(str("a@1.0.0"), 0, 0, 0, 1), append(str("b"), 0, 0)...)},
+		{"missing_dep_index", append(append(str("a@1.0.0"), 0, 0, 0, 1), append(str("b"), 0, 0, 0, 7)...)},
+		{"invalid_id", append(str("nover"), 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseNpmContent(tt.content, nil)
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+		})
+	}
+}
+
+func FuzzParseNpmSection(f *testing.F) {
+	depID := &NpmPackageID{Name: "has-symbols", Version: "1.0.3"}
+	mainID := &NpmPackageID{Name: "@scope/lodash", Version: "4.17.21"}
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.npmSnapshot = &NpmResolutionSnapshot{
+		Packages: []*NpmPackage{
+			{ID: depID, Dependencies: map[string]*NpmPackageID{}},
+			{ID: mainID, Dependencies: map[string]*NpmPackageID{"has-symbols": depID}},
+		},
+		RootPackages: map[string]*NpmPackageID{"lodash": mainID},
+	}
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		f.Fatalf("failed to serialize: %v", err)
+	}
+	f.Add(npmSectionContent(f, data))
+	f.Add([]byte{})
+	f.Add([]byte{0, 0, 0, 1, 'a', 0xff, 0xff, 0xff, 0xff})
+
+	f.Fuzz(func(t *testing.T, content []byte) {
+		snapshot, err := parseNpmContent(content, map[string]NpmPackageIndex{"root": {Index: 0}})
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+			return
+		}
+		if snapshot != nil && len(snapshot.Packages) == 0 {
+			t.Fatal("non-nil snapshot without packages")
+		}
+	})
+}
+
+func FuzzParseBytes(f *testing.F) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		f.Fatalf("failed to read testdata: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", entry.Name()))
+		if err != nil {
+			f.Fatalf("failed to read fixture: %v", err)
+		}
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		eszip, err := ParseBytes(ctx, data)
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+			return
+		}
+		// Every reachable module must be readable once parsing completed.
+		for _, spec := range eszip.Specifiers() {
+			if m := eszip.GetImportMap(spec); m != nil {
+				if _, err := m.Source(ctx); err != nil {
+					t.Fatalf("source of %s: %v", spec, err)
+				}
+			}
+		}
+	})
+}
+
+func TestParseHeaderOnly(t *testing.T) {
+	ctx := context.Background()
+	e := NewV2()
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export {};"), []byte("{}"))
+	e.AddRedirect("file:///alias.js", "file:///main.js")
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	parsed, err := ParseHeaderOnly(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseHeaderOnly failed: %v", err)
+	}
+	if got := parsed.Specifiers(); !slices.Equal(got, []string{"file:///main.js", "file:///alias.js"}) {
+		t.Errorf("specifiers = %v", got)
+	}
+	var pe *ParseError
+	if _, err := parsed.GetModule("file:///alias.js").Source(ctx); !errors.As(err, &pe) || pe.Type != ErrSourceNotLoaded {
+		t.Errorf("source error = %v, want ErrSourceNotLoaded", err)
+	}
+
+	// A modules section declaring nearly 4 GiB on a short stream of unknown
+	// size fails without allocating anything like that.
+	plain := NewV2()
+	plain.SetChecksum(ChecksumNone)
+	header, err := plain.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	optionsEnd := 12 + int(binary.BigEndian.Uint32(header[8:12]))
+	huge := append(slices.Clone(header[:optionsEnd]), 0xff, 0xff, 0xff, 0xf0)
+	huge = append(huge, bytes.Repeat([]byte{0}, 1024)...)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err = ParseHeaderOnly(ctx, iotest.OneByteReader(bytes.NewReader(huge)))
+	runtime.ReadMemStats(&after)
+	if !errors.As(err, &pe) {
+		t.Fatalf("truncated modules section error = %v, want a ParseError", err)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 16<<20 {
+		t.Errorf("ParseHeaderOnly allocated %d bytes for a %d byte input", allocated, len(huge))
+	}
+}
+
+func FuzzParseHeaderOnly(f *testing.F) {
+	entries, err := os.ReadDir("testdata")
+	if err != nil {
+		f.Fatalf("failed to read testdata: %v", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join("testdata", entry.Name()))
+		if err != nil {
+			f.Fatalf("failed to read fixture: %v", err)
+		}
+		f.Add(data)
+	}
+	magic := VersionV2_6.ToMagic()
+	f.Add(append(magic[:], 0xff, 0xff, 0xff, 0xff))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// A reader of unknown size, as CI fuzzing a stream would see.
+		eszip, err := ParseHeaderOnly(ctx, iotest.HalfReader(bytes.NewReader(data)))
+		if err != nil {
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+			return
+		}
+		// Sources are never loaded, so reading one must fail rather than
+		// wait.
+		for _, spec := range eszip.Specifiers() {
+			if m := eszip.GetModule(spec); m != nil {
+				if _, err := m.Source(ctx); err != nil && ctx.Err() != nil {
+					t.Fatalf("source of %s blocked: %v", spec, err)
+				}
+			}
+		}
+	})
+}
+
+// fuzzModule is a module decoded from fuzz input by decodeFuzzModules.
+type fuzzModule struct {
+	specifier string
+	kind      ModuleKind
+	source    []byte
+	sourceMap []byte
+}
+
+// decodeFuzzModules turns arbitrary bytes into a module set. Each record is
+// a kind byte followed by three length-prefixed (1 byte) fields: specifier,
+// source, and source map. Later records replace earlier ones with the same
+// specifier, matching ModuleMap semantics.
+func decodeFuzzModules(data []byte) (order []string, modules map[string]fuzzModule) {
+	modules = make(map[string]fuzzModule)
+	field := func() []byte {
+		if len(data) == 0 {
+			return nil
+		}
+		n := min(int(data[0]), len(data)-1)
+		out := data[1 : 1+n]
+		data = data[1+n:]
+		return out
+	}
+	for len(data) > 0 {
+		kind := ModuleKind(data[0] % 5)
+		data = data[1:]
+		m := fuzzModule{
+			specifier: "file:///" + string(field()),
+			kind:      kind,
+			source:    field(),
+			sourceMap: field(),
+		}
+		if _, exists := modules[m.specifier]; !exists {
+			order = append(order, m.specifier)
+		}
+		modules[m.specifier] = m
+	}
+	return order, modules
+}
+
+func FuzzRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 7, 'm', 'a', 'i', 'n', '.', 'j', 's', 4, 'c', 'o', 'd', 'e', 2, '{', '}'})
+	f.Add([]byte{2, 1, 'a', 0, 0, 1, 1, 'a', 1, 'x', 0, 4, 0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx := context.Background()
+		order, modules := decodeFuzzModules(data)
+
+		for _, checksum := range []ChecksumType{ChecksumNone, ChecksumSha256, ChecksumXxh3} {
+			eszip := NewV2()
+			eszip.SetChecksum(checksum)
+			for _, spec := range order {
+				m := modules[spec]
+				eszip.AddModule(m.specifier, m.kind, m.source, m.sourceMap)
+			}
+
+			out, err := eszip.IntoBytes()
+			if err != nil {
+				t.Fatalf("%v: IntoBytes failed: %v", checksum, err)
+			}
+			parsed, err := ParseBytes(ctx, out)
+			if err != nil {
+				t.Fatalf("%v: ParseBytes failed: %v", checksum, err)
+			}
+
+			if got := parsed.Specifiers(); strings.Join(got, "\x00") != strings.Join(order, "\x00") {
+				t.Fatalf("%v: specifiers = %q, want %q", checksum, got, order)
+			}
+			for _, spec := range order {
+				want := modules[spec]
+				got := parsed.GetImportMap(spec)
+				if got == nil {
+					t.Fatalf("%v: module %q missing", checksum, spec)
+				}
+				if got.Kind != want.kind {
+					t.Errorf("%v: %q kind = %v, want %v", checksum, spec, got.Kind, want.kind)
+				}
+				source, err := got.Source(ctx)
+				if err != nil || !bytes.Equal(source, want.source) {
+					t.Errorf("%v: %q source = %q (err %v), want %q", checksum, spec, source, err, want.source)
+				}
+				sourceMap, err := got.SourceMap(ctx)
+				if err != nil || !bytes.Equal(sourceMap, want.sourceMap) {
+					t.Errorf("%v: %q source map = %q (err %v), want %q", checksum, spec, sourceMap, err, want.sourceMap)
+				}
+			}
+		}
+	})
+}
+
+func TestParseV2MissingSourceDoesNotHang(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///test.js", ModuleKindJavaScript, []byte("hello"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	// Drop the source from the sources section while the header still
+	// references it.
+	idx := bytes.Index(data, []byte("hello"))
+	binary.BigEndian.PutUint32(data[idx-4:idx], 0)
+	data = append(data[:idx:idx], data[idx+5:]...)
+
+	_, err = ParseBytes(ctx, data)
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected ParseError, got %T: %v", err, err)
+	}
+	if pe.Type != ErrInvalidV2SourceOffset {
+		t.Errorf("expected ErrInvalidV2SourceOffset, got %v (%v)", pe.Type, pe)
+	}
+}
+
+func TestParseV2ZeroLengthSourceAtOffset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	eszip.AddModule("file:///b.js", ModuleKindJavaScript, nil, nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	// Give b.js a non-zero offset with zero length.
+	idx := bytes.Index(data, []byte("file:///b.js")) + len("file:///b.js") + 1
+	binary.BigEndian.PutUint32(data[idx:idx+4], 7)
+
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	source, err := parsed.GetModule("file:///b.js").Source(ctx)
+	if err != nil || len(source) != 0 {
+		t.Errorf("expected empty source, got %q (err %v)", source, err)
+	}
+}
+
+func TestParseV2SharedSourceOffset(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("same"), nil)
+	eszip.AddModule("file:///b.js", ModuleKindJavaScript, []byte("same"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	// Point b.js at a.js's copy and drop the second copy.
+	idx := bytes.Index(data, []byte("file:///b.js")) + len("file:///b.js") + 1
+	binary.BigEndian.PutUint32(data[idx:idx+4], 0)
+	src := bytes.Index(data, []byte("samesame"))
+	binary.BigEndian.PutUint32(data[src-4:src], 4)
+	data = append(data[:src+4:src+4], data[src+8:]...)
+
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	for _, spec := range []string{"file:///a.js", "file:///b.js"} {
+		source, err := parsed.GetModule(spec).Source(ctx)
+		if err != nil || string(source) != "same" {
+			t.Errorf("%s source = %q (err %v), want %q", spec, source, err, "same")
+		}
+	}
+}
+
+func TestWriteDeduplication(t *testing.T) {
+	ctx := context.Background()
+
+	build := func(compression CompressionType) *EszipV2 {
+		eszip := NewV2()
+		eszip.SetChecksum(ChecksumSha256)
+		eszip.SetCompression(compression)
+		eszip.AddModule("file:///vendor/a/lib.js", ModuleKindJavaScript, []byte("export const lib = 1;"), []byte(`{"version":3}`))
+		eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import './vendor/a/lib.js';"), nil)
+		eszip.AddModule("file:///vendor/b/lib.js", ModuleKindJavaScript, []byte("export const lib = 1;"), []byte(`{"version":3}`))
+		eszip.AddRedirect("file:///lib.js", "file:///vendor/b/lib.js")
+		return eszip
+	}
+
+	for _, compression := range []CompressionType{CompressionNone, CompressionGzip} {
+		t.Run(compression.String(), func(t *testing.T) {
+			plain, err := build(compression).IntoBytes()
+			if err != nil {
+				t.Fatalf("IntoBytes failed: %v", err)
+			}
+
+			var report WriteReport
+			var written []string
+			data, err := build(compression).IntoBytes(WithDeduplication(), WithWriteReport(&report), WithWriteProgress(Progress{
+				OnModuleWritten: func(specifier string, _, _ int64) { written = append(written, specifier) },
+			}))
+			if err != nil {
+				t.Fatalf("IntoBytes failed: %v", err)
+			}
+			if report.Size != int64(len(data)) || report.Modules != 4 || report.SharedSources != 1 || report.SharedSourceMaps != 1 {
+				t.Errorf("report = %+v, want size %d, 4 modules, 1 shared source and source map", report, len(data))
+			}
+			if int64(len(plain)-len(data)) != report.SavedBytes {
+				t.Errorf("saved %d bytes, report says %d", len(plain)-len(data), report.SavedBytes)
+			}
+			if len(written) != 4 {
+				t.Errorf("progress reported %v, want every entry once", written)
+			}
+
+			parsed, err := ParseBytes(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			for _, spec := range []string{"file:///vendor/a/lib.js", "file:///vendor/b/lib.js", "file:///lib.js"} {
+				m := parsed.GetModule(spec)
+				source, err := m.Source(ctx)
+				if err != nil || string(source) != "export const lib = 1;" {
+					t.Errorf("%s source = %q (err %v)", spec, source, err)
+				}
+				sourceMap, err := m.SourceMap(ctx)
+				if err != nil || string(sourceMap) != `{"version":3}` {
+					t.Errorf("%s source map = %q (err %v)", spec, sourceMap, err)
+				}
+			}
+			verified, err := VerifyArchive(ctx, bytes.NewReader(data), int64(len(data)))
+			if err != nil || !verified.OK() {
+				t.Errorf("VerifyArchive = %+v, %v", verified, err)
+			}
+		})
+	}
+}
+
+func TestParseUnknownFormat(t *testing.T) {
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		data []byte
+		want []string
+	}{
+		{"empty", nil, []string{"empty input"}},
+		{"truncated_magic", []byte("ESZIP2."), []string{"45535a4950322e", "truncated eszip v2 magic"}},
+		{"corrupt_magic", []byte("ESZIP2.9\x00\x00\x00\x00"), []string{"45535a4950322e39", "differs from", "1 byte(s)"}},
+		{"corrupt_latest_magic", []byte("ESZIQ2.6\x00\x00\x00\x00"), []string{`differs from the "ESZIP2.6" magic in 1 byte(s)`}},
+		{"unknown_version", []byte("ESZIP9xx"), []string{"no known version"}},
+		{"binary_garbage", []byte{0x00, 0x01, 0x02, 0xff, 0xfe, 0xfd, 0x10, 0x20, 0x30}, []string{"000102fffefd1020"}},
+		{"text", []byte("not json at all!!!"), []string{"neither eszip v2 nor v1 json"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseBytes(ctx, tt.data)
+			var pe *ParseError
+			if !errors.As(err, &pe) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+			if pe.Type != ErrUnknownFormat {
+				t.Fatalf("expected ErrUnknownFormat, got %v (%v)", pe.Type, pe)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(pe.Error(), want) {
+					t.Errorf("expected %q in %q", want, pe.Error())
+				}
+			}
+		})
+	}
+}
+
+func TestParseV1WithBOMAndWhitespace(t *testing.T) {
+	data, err := os.ReadFile("testdata/basic.json")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+
+	for name, prefix := range map[string]string{
+		"bom":        "\xef\xbb\xbf",
+		"whitespace": " \n\t\r ",
+		"both":       "\xef\xbb\xbf\n  ",
+	} {
+		t.Run(name, func(t *testing.T) {
+			parsed, err := ParseBytes(context.Background(), append([]byte(prefix), data...))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if !parsed.IsV1() || len(parsed.Specifiers()) == 0 {
+				t.Error("expected V1 eszip with modules")
+			}
+		})
+	}
+}
+
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+func TestSummaryGolden(t *testing.T) {
+	ctx := context.Background()
+
+	for _, name := range []string{"basic.json", "json.eszip2", "redirect.eszip2", "wasm.eszip2_3"} {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatalf("failed to read test file: %v", err)
+			}
+			archive, err := ParseBytes(ctx, data)
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			got, err := json.MarshalIndent(archive, "", "  ")
+			if err != nil {
+				t.Fatalf("failed to marshal: %v", err)
+			}
+			got = append(got, '\n')
+
+			golden := filepath.Join("testdata", "golden", name+".summary.json")
+			if *updateGolden {
+				if err := os.WriteFile(golden, got, 0644); err != nil {
+					t.Fatalf("failed to update golden file: %v", err)
+				}
+			}
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file: %v", err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("summary mismatch\ngot:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestSummaryV2(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumXxh3)
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), []byte("{}"))
+	eszip.AddRedirect("file:///alias.js", "file:///main.js")
+	eszip.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte("{\"imports\":{}}"))
+	id := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+	eszip.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: id, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"lodash": id},
+	}
+
+	want := Summary{
+		Format:         "v2.3",
+		Checksum:       "xxhash3",
+		Modules:        2,
+		Redirects:      1,
+		NpmSpecifiers:  1,
+		SourceBytes:    18,
+		SourceMapBytes: 2,
+		ImportMap:      "file:///import_map.json",
+		HasImportMap:   true,
+		NpmPackages:    1,
+	}
+	if got := (&EszipUnion{v2: eszip}).Summary(); got != want {
+		t.Errorf("built summary = %+v, want %+v", got, want)
+	}
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	// Summaries of a streaming parse must not wait for sources.
+	parsed, _, err := Parse(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if got := parsed.Summary(); got != want {
+		t.Errorf("parsed summary = %+v, want %+v", got, want)
+	}
+}
+
+func TestContentSectionSizes(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumSha256)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("aaaa"), []byte("{}"))
+	eszip.AddModule("file:///b.js", ModuleKindJavaScript, []byte("bbbbbbbb"), nil)
+	eszip.AddModule("file:///empty.js", ModuleKindJavaScript, nil, nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	sections := make(map[string]int64)
+	instr := &sectionSizes{sizes: sections}
+	if _, err := ParseBytes(ctx, data, WithInstrumentation(instr)); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	parsed, _, err := Parse(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	parsedV2, _ := parsed.V2()
+	for name, e := range map[string]*EszipV2{"built": eszip, "parsed": parsedV2} {
+		sources, sourceMaps := e.ContentSectionSizes()
+		if sources != sections["sources"] || sourceMaps != sections["source_maps"] {
+			t.Errorf("%s: sizes = %d, %d, want %d, %d", name, sources, sourceMaps, sections["sources"], sections["source_maps"])
+		}
+	}
+
+	want := []ModuleSize{
+		{Specifier: "file:///a.js", Kind: ModuleKindJavaScript, Source: 4, SourceMap: 2, SourceOffset: 0, SourceMapOffset: 0},
+		{Specifier: "file:///b.js", Kind: ModuleKindJavaScript, Source: 8, SourceOffset: 4 + 32, SourceMapOffset: -1},
+		{Specifier: "file:///empty.js", Kind: ModuleKindJavaScript, SourceOffset: -1, SourceMapOffset: -1},
+	}
+	if got := parsed.ModuleSizes(); !slices.Equal(got, want) {
+		t.Errorf("module sizes = %+v, want %+v", got, want)
+	}
+	// Built archives have no layout until they are written.
+	for _, size := range eszip.ModuleSizes() {
+		if size.SourceOffset != -1 || size.SourceMapOffset != -1 {
+			t.Errorf("built %s offsets = %d, %d, want -1", size.Specifier, size.SourceOffset, size.SourceMapOffset)
+		}
+	}
+}
+
+// sectionSizes totals section sizes by kind.
+type sectionSizes struct {
+	Counters
+	sizes map[string]int64
+}
+
+func (s *sectionSizes) SectionRead(kind string, n int) {
+	s.sizes[kind] += int64(n)
+}
+
+// recordingInstrumentation captures every callback for inspection.
+type recordingInstrumentation struct {
+	Counters
+	kinds   []string
+	sources map[string]int
+}
+
+func (r *recordingInstrumentation) SectionRead(kind string, n int) {
+	r.kinds = append(r.kinds, kind)
+	r.Counters.SectionRead(kind, n)
+}
+
+func (r *recordingInstrumentation) SourceLoaded(specifier string, n int, verified bool) {
+	if r.sources == nil {
+		r.sources = make(map[string]int)
+	}
+	r.sources[specifier] += n
+	r.Counters.SourceLoaded(specifier, n, verified)
+}
+
+func TestInstrumentationTotals(t *testing.T) {
+	ctx := context.Background()
+
+	for _, checksum := range []ChecksumType{ChecksumNone, ChecksumSha256} {
+		t.Run(checksum.String(), func(t *testing.T) {
+			eszip := NewV2()
+			eszip.SetChecksum(checksum)
+			eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("alpha"), []byte("{\"version\":3}"))
+			eszip.AddModule("file:///b.js", ModuleKindJavaScript, []byte("beta!!"), nil)
+			eszip.AddRedirect("file:///c.js", "file:///a.js")
+
+			var written Counters
+			data, err := eszip.IntoBytes(WithWriteInstrumentation(&written))
+			if err != nil {
+				t.Fatalf("failed to serialize: %v", err)
+			}
+			if got := written.BytesWritten.Load(); got != int64(len(data)) {
+				t.Errorf("write progress totals %d, archive is %d bytes", got, len(data))
+			}
+
+			rec := &recordingInstrumentation{}
+			if _, err := ParseBytes(ctx, data, WithInstrumentation(rec)); err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if got := rec.BytesRead.Load(); got != int64(len(data)) {
+				t.Errorf("sections total %d bytes, archive is %d bytes", got, len(data))
+			}
+			wantKinds := "magic,options,modules,npm,sources,source_maps"
+			if got := strings.Join(rec.kinds, ","); got != wantKinds {
+				t.Errorf("section kinds = %s, want %s", got, wantKinds)
+			}
+			if rec.sources["file:///a.js"] != 5+13 || rec.sources["file:///b.js"] != 6 {
+				t.Errorf("unexpected per-source totals: %v", rec.sources)
+			}
+			wantVerified := int64(0)
+			if checksum != ChecksumNone {
+				wantVerified = 24
+			}
+			if got := rec.BytesVerified.Load(); got != wantVerified {
+				t.Errorf("verified %d bytes, want %d", got, wantVerified)
+			}
+		})
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/basic.json")
+		if err != nil {
+			t.Fatalf("failed to read test file: %v", err)
+		}
+		var c Counters
+		if _, err := ParseBytes(ctx, data, WithInstrumentation(&c)); err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		if got := c.BytesRead.Load(); got != int64(len(data)) {
+			t.Errorf("read %d bytes, file is %d bytes", got, len(data))
+		}
+	})
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("alpha"), []byte("{\"version\":3}"))
+	eszip.AddModule("file:///b.js", ModuleKindJavaScript, []byte("beta!!"), nil)
+	eszip.AddModule("file:///empty.js", ModuleKindJavaScript, nil, nil)
+	eszip.AddRedirect("file:///c.js", "file:///a.js")
+
+	var mu sync.Mutex
+	written := map[string]int{}
+	var last, total int64
+	data, err := eszip.IntoBytes(WithWriteProgress(Progress{
+		OnModuleWritten: func(specifier string, n, size int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			written[specifier]++
+			if n < last {
+				t.Errorf("%s: written went back from %d to %d", specifier, last, n)
+			}
+			last, total = n, size
+		},
+	}))
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	want := map[string]int{"file:///a.js": 1, "file:///b.js": 1, "file:///empty.js": 1, "file:///c.js": 1}
+	if !reflect.DeepEqual(written, want) {
+		t.Errorf("modules written = %v, want %v", written, want)
+	}
+	if last != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("last report was %d of %d, archive is %d bytes", last, total, len(data))
+	}
+
+	var sections []string
+	last, total = 0, 0
+	if _, err := ParseBytes(ctx, data, WithProgress(Progress{
+		OnSectionRead: func(name string, read, size int64) {
+			mu.Lock()
+			defer mu.Unlock()
+			sections = append(sections, name)
+			if read < last {
+				t.Errorf("%s: read went back from %d to %d", name, last, read)
+			}
+			last, total = read, size
+		},
+	})); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if last != int64(len(data)) || total != int64(len(data)) {
+		t.Errorf("last report was %d of %d, archive is %d bytes", last, total, len(data))
+	}
+	// One report per section, plus one per source and source map entry.
+	wantSections := "magic,options,modules,npm,sources,sources,sources,source_maps,source_maps"
+	if got := strings.Join(sections, ","); got != wantSections {
+		t.Errorf("sections = %s, want %s", got, wantSections)
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		v1Data, err := os.ReadFile("testdata/basic.json")
+		if err != nil {
+			t.Fatalf("failed to read test file: %v", err)
+		}
+		archive, err := ParseBytes(ctx, v1Data)
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		var specifiers []string
+		if _, err := archive.IntoBytes(WithWriteProgress(Progress{
+			OnModuleWritten: func(specifier string, _, _ int64) {
+				specifiers = append(specifiers, specifier)
+			},
+		})); err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		if want := slices.Sorted(slices.Values(archive.Specifiers())); !slices.Equal(specifiers, want) {
+			t.Errorf("modules written = %v, want %v", specifiers, want)
+		}
+	})
+}
+
+// captureHandler is a slog.Handler that records every record it handles.
+type captureHandler struct {
+	mu      sync.Mutex
+	records []slog.Record
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *captureHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *captureHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, r)
+	return nil
+}
+
+// events returns "level:event" for each record, with its attributes.
+func (h *captureHandler) events() map[string]map[string]string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	out := make(map[string]map[string]string)
+	for _, r := range h.records {
+		attrs := make(map[string]string)
+		r.Attrs(func(a slog.Attr) bool {
+			attrs[a.Key] = a.Value.String()
+			return true
+		})
+		out[r.Level.String()+":"+attrs["event"]] = attrs
+	}
+	return out
+}
+
+func TestParseLogsAnomalies(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	// Options header content starts at 12: [0, checksum, 1, size]. Turn the
+	// size option into an unknown option 9.
+	data[14] = 9
+
+	h := &captureHandler{}
+	if _, err := ParseBytes(ctx, data, WithLogger(slog.New(h))); err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	events := h.events()
+	warn, ok := events["WARN:unknown_option"]
+	if !ok {
+		t.Fatalf("expected unknown_option warning, got %v", events)
+	}
+	if warn["option"] != "9" || warn["offset"] != "14" {
+		t.Errorf("unexpected attributes: %v", warn)
+	}
+	for _, phase := range []string{"DEBUG:parse_header", "DEBUG:load_sources"} {
+		if _, ok := events[phase]; !ok {
+			t.Errorf("expected %s record, got %v", phase, events)
+		}
+	}
+
+	// Without a logger nothing is emitted and parsing still succeeds.
+	if _, err := ParseBytes(ctx, data); err != nil {
+		t.Fatalf("failed to parse without logger: %v", err)
+	}
+}
+
+func TestWriteLogsTakenSource(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	if _, err := eszip.GetModule("file:///a.js").TakeSource(ctx); err != nil {
+		t.Fatalf("failed to take source: %v", err)
+	}
+
+	h := &captureHandler{}
+	if _, err := eszip.IntoBytes(WithWriteLogger(slog.New(h))); err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	events := h.events()
+	if events["WARN:source_taken"]["specifier"] != "file:///a.js" {
+		t.Errorf("expected source_taken warning for file:///a.js, got %v", events)
+	}
+	if _, ok := events["DEBUG:serialize"]; !ok {
+		t.Errorf("expected serialize timing, got %v", events)
+	}
+}
+
+func TestEqual(t *testing.T) {
+	ctx := context.Background()
+
+	lodash := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+	build := func(reverse bool, checksum ChecksumType, mutate func(*EszipV2)) *EszipUnion {
+		e := NewV2()
+		e.SetChecksum(checksum)
+		e.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{"imports":{}}`))
+		add := []func(){
+			func() { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), []byte("map-a")) },
+			func() { e.AddModule("file:///b.json", ModuleKindJson, []byte("{}"), nil) },
+			func() { e.AddRedirect("file:///alias.js", "file:///a.js") },
+		}
+		if reverse {
+			slices.Reverse(add)
+		}
+		for _, f := range add {
+			f()
+		}
+		e.npmSnapshot = &NpmResolutionSnapshot{
+			Packages:     []*NpmPackage{{ID: lodash, Dependencies: map[string]*NpmPackageID{}}},
+			RootPackages: map[string]*NpmPackageID{"lodash": lodash},
+		}
+		if mutate != nil {
+			mutate(e)
+		}
+		return &EszipUnion{v2: e}
+	}
+
+	t.Run("reordered", func(t *testing.T) {
+		a := build(false, ChecksumSha256, nil)
+		b := build(true, ChecksumXxh3, nil)
+		equal, diff, err := Equal(ctx, a, b, EqualOptions{})
+		if err != nil || !equal || diff != nil {
+			t.Fatalf("Equal = %v, %v, %v; want true", equal, diff, err)
+		}
+
+		// A streaming parse compares equal once its sources arrive.
+		data, err := a.v2.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		parsed, complete, err := Parse(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		go complete(ctx)
+		if equal, diff, err := Equal(ctx, parsed, b, EqualOptions{}); err != nil || !equal {
+			t.Errorf("parsed Equal = %v, %v, %v; want true", equal, diff, err)
+		}
+	})
+
+	t.Run("compressed", func(t *testing.T) {
+		// Content not yet loaded records its compressed length, which
+		// must not be mistaken for a difference.
+		plain := build(false, ChecksumSha256, nil)
+		compressed := build(false, ChecksumSha256, func(e *EszipV2) { e.SetCompression(CompressionGzip) })
+		data, err := compressed.v2.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithInputSize(int64(len(data))))
+		if err != nil {
+			t.Fatalf("ParseV2Lazy failed: %v", err)
+		}
+		if equal, diff, err := Equal(ctx, &EszipUnion{v2: lazy}, plain, EqualOptions{}); err != nil || !equal {
+			t.Errorf("lazy Equal = %v, %v, %v; want true", equal, diff, err)
+		}
+
+		changed := build(false, ChecksumSha256, func(e *EszipV2) {
+			e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("A"), []byte("map-a"))
+		})
+		lazy, _ = ParseV2Lazy(ctx, bytes.NewReader(data), WithInputSize(int64(len(data))))
+		equal, diff, err := Equal(ctx, &EszipUnion{v2: lazy}, changed, EqualOptions{})
+		if err != nil || equal || diff.Divergences[0].Kind != DiffSource {
+			t.Errorf("changed Equal = %v, %v, %v; want a source difference", equal, diff, err)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		mutate func(*EszipV2)
+		want   DifferenceKind
+		ignore EqualOptions
+	}{
+		{"missing", func(e *EszipV2) { e.AddModule("file:///extra.js", ModuleKindJavaScript, []byte("x"), nil) }, DiffMissing, EqualOptions{}},
+		{"entry_type", func(e *EszipV2) { e.AddRedirect("file:///b.json", "file:///a.js") }, DiffEntryType, EqualOptions{}},
+		{"module_kind", func(e *EszipV2) { e.AddModule("file:///b.json", ModuleKindJsonc, []byte("{}"), nil) }, DiffModuleKind, EqualOptions{}},
+		{"source", func(e *EszipV2) { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("A"), []byte("map-a")) }, DiffSource, EqualOptions{}},
+		{"source_map", func(e *EszipV2) { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), []byte("map-A")) }, DiffSourceMap, EqualOptions{IgnoreSourceMaps: true}},
+		{"redirect", func(e *EszipV2) { e.AddRedirect("file:///alias.js", "file:///b.json") }, DiffRedirect, EqualOptions{}},
+		{"import_map", func(e *EszipV2) {
+			e.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{"imports":{"x":"y"}}`))
+		}, DiffImportMap, EqualOptions{}},
+		{"npm_snapshot", func(e *EszipV2) {
+			e.npmSnapshot.RootPackages["lodash"] = &NpmPackageID{Name: "lodash", Version: "4.17.20"}
+		}, DiffNpmSnapshot, EqualOptions{IgnoreNpmSnapshot: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := build(false, ChecksumSha256, nil)
+			b := build(false, ChecksumSha256, tt.mutate)
+			equal, diff, err := Equal(ctx, a, b, EqualOptions{})
+			if err != nil {
+				t.Fatalf("Equal failed: %v", err)
+			}
+			if equal || diff == nil || len(diff.Divergences) != 1 {
+				t.Fatalf("Equal = %v, %v; want one divergence", equal, diff)
+			}
+			if got := diff.Divergences[0].Kind; got != tt.want {
+				t.Errorf("divergence = %v, want %v", diff.Divergences[0], tt.want)
+			}
+
+			if tt.ignore != (EqualOptions{}) {
+				if equal, diff, _ := Equal(ctx, a, b, tt.ignore); !equal {
+					t.Errorf("expected %+v to ignore the difference, got %v", tt.ignore, diff)
+				}
+			}
+		})
+	}
+
+	t.Run("all", func(t *testing.T) {
+		a := build(false, ChecksumSha256, nil)
+		b := build(false, ChecksumSha256, func(e *EszipV2) {
+			e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("A"), []byte("map-A"))
+			e.AddModule("file:///extra.js", ModuleKindJavaScript, []byte("x"), nil)
+		})
+		_, first, _ := Equal(ctx, a, b, EqualOptions{})
+		_, all, _ := Equal(ctx, a, b, EqualOptions{All: true})
+		if len(first.Divergences) != 1 || len(all.Divergences) != 3 {
+			t.Errorf("got %d first and %d total divergences, want 1 and 3:\n%s", len(first.Divergences), len(all.Divergences), all)
+		}
+	})
+
+	t.Run("all_npm", func(t *testing.T) {
+		a := build(false, ChecksumSha256, nil)
+		b := build(false, ChecksumSha256, func(e *EszipV2) {
+			react := &NpmPackageID{Name: "react", Version: "18.2.0"}
+			e.npmSnapshot = &NpmResolutionSnapshot{
+				Packages:     []*NpmPackage{{ID: react, Dependencies: map[string]*NpmPackageID{}}},
+				RootPackages: map[string]*NpmPackageID{"react": react},
+			}
+		})
+		_, all, _ := Equal(ctx, a, b, EqualOptions{All: true})
+		want := []string{
+			`root "lodash" only in a`,
+			`root "react" only in b`,
+			"package lodash@4.17.21 only in a",
+			"package react@18.2.0 only in b",
+		}
+		if all == nil || len(all.Divergences) != len(want) {
+			t.Fatalf("divergences = %v, want %q", all, want)
+		}
+		for i, div := range all.Divergences {
+			if div.Kind != DiffNpmSnapshot || div.Detail != want[i] {
+				t.Errorf("divergence %d = %v, want %q", i, div, want[i])
+			}
+		}
+	})
+}
+
+func TestArchiveMetadata(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), nil)
+	eszip.SetArchiveMetadata(map[string]string{"producer": "test", "build": "42"})
+	eszip.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte("{}"))
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	metadata, err := parsed.ArchiveMetadata(ctx)
+	if err != nil {
+		t.Fatalf("ArchiveMetadata failed: %v", err)
+	}
+	if len(metadata) != 2 || metadata["producer"] != "test" || metadata["build"] != "42" {
+		t.Errorf("metadata = %v", metadata)
+	}
+
+	// Stored right after the import map, as canonical JSON.
+	keys := parsed.modules.Keys()
+	if len(keys) != 3 || keys[0] != "file:///import_map.json" || keys[1] != ArchiveMetadataSpecifier {
+		t.Errorf("entry order = %v", keys)
+	}
+	mod, _ := parsed.modules.Get(ArchiveMetadataSpecifier)
+	if content, _ := mod.(*ModuleData).Source.Get(ctx); string(content) != `{"build":"42","producer":"test"}` {
+		t.Errorf("stored content = %s", content)
+	}
+
+	if slices.Contains(parsed.Specifiers(), ArchiveMetadataSpecifier) {
+		t.Error("expected metadata entry to be hidden from Specifiers")
+	}
+	if got := parsed.Summary().Modules; got != 2 {
+		t.Errorf("summary counts %d modules, want 2", got)
+	}
+	shown, err := ParseV2Sync(ctx, bytes.NewReader(data), WithReservedSpecifiers())
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !slices.Contains(shown.Specifiers(), ArchiveMetadataSpecifier) {
+		t.Error("expected WithReservedSpecifiers to list the metadata entry")
+	}
+
+	eszip.SetArchiveMetadata(nil)
+	if metadata, err := eszip.ArchiveMetadata(ctx); metadata != nil || err != nil {
+		t.Errorf("after removal got %v, %v; want nil, nil", metadata, err)
+	}
+
+	t.Run("absent", func(t *testing.T) {
+		metadata, err := NewV2().ArchiveMetadata(ctx)
+		if metadata != nil || err != nil {
+			t.Errorf("got %v, %v; want nil, nil", metadata, err)
+		}
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		for _, content := range []string{"not json", `{"n":1}`, `["a"]`} {
+			eszip := NewV2()
+			eszip.AddOpaqueData(ArchiveMetadataSpecifier, []byte(content))
+			_, err := eszip.ArchiveMetadata(ctx)
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Type != ErrInvalidArchiveMetadata {
+				t.Errorf("%s: expected ErrInvalidArchiveMetadata, got %v", content, err)
+			}
+		}
+	})
+}
+
+func TestEntrypoints(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte(`import "./a.js";`), nil)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("export {};"), nil)
+	eszip.AddModule("file:///worker.js", ModuleKindJavaScript, []byte("export {};"), nil)
+	eszip.AddModule("file:///unused.js", ModuleKindJavaScript, []byte("export {};"), nil)
+	eszip.SetEntrypoints([]string{"file:///main.js", "file:///worker.js", "file:///main.js"})
+	eszip.SetArchiveMetadata(map[string]string{"build": "42"})
+	eszip.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte("{}"))
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	want := []string{"file:///main.js", "file:///worker.js"}
+	if got, err := parsed.Entrypoints(ctx); err != nil || !slices.Equal(got, want) {
+		t.Errorf("Entrypoints = %v, %v; want %v", got, err, want)
+	}
+	keys := parsed.modules.Keys()
+	if !slices.Equal(keys[:3], []string{"file:///import_map.json", ArchiveMetadataSpecifier, EntrypointsSpecifier}) {
+		t.Errorf("entry order = %v", keys)
+	}
+	if slices.Contains(parsed.Specifiers(), EntrypointsSpecifier) {
+		t.Error("expected entrypoints entry to be hidden from Specifiers")
+	}
+
+	normalized, err := Normalize(ctx, &EszipUnion{v2: parsed}, NormalizeOptions{Checksum: ChecksumSha256})
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	if got, _ := normalized.Entrypoints(ctx); !slices.Equal(got, want) {
+		t.Errorf("normalized Entrypoints = %v", got)
+	}
+
+	// Prune defaults to the recorded entrypoints.
+	removed, err := parsed.Prune(ctx)
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if !slices.Equal(removed, []string{"file:///unused.js"}) {
+		t.Errorf("Prune removed %v", removed)
+	}
+
+	parsed.SetEntrypoints(nil)
+	if got, err := parsed.Entrypoints(ctx); got != nil || err != nil {
+		t.Errorf("after removal got %v, %v; want nil, nil", got, err)
+	}
+	if _, err := parsed.Prune(ctx); err == nil {
+		t.Error("Prune without entrypoints succeeded")
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		archive := NewV2()
+		archive.AddModule(EntrypointsSpecifier, ModuleKindOpaqueData, []byte(`{"a": 1}`), nil)
+		_, err := archive.Entrypoints(ctx)
+		var perr *ParseError
+		if !errors.As(err, &perr) || perr.Type != ErrInvalidArchiveMetadata {
+			t.Errorf("Entrypoints error = %v, want ErrInvalidArchiveMetadata", err)
+		}
+	})
+}
+
+func TestNormalize(t *testing.T) {
+	ctx := context.Background()
+
+	react := &NpmPackageID{Name: "react", Version: "18.2.0"}
+	looseEnvify := &NpmPackageID{Name: "loose-envify", Version: "1.4.0"}
+	build := func(reverse bool, checksum ChecksumType) *EszipV2 {
+		e := NewV2()
+		e.SetChecksum(checksum)
+		add := []func(){
+			func() { e.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b"), []byte("map-b")) },
+			func() { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil) },
+			func() { e.AddRedirect("file:///z.js", "file:///a.js") },
+			func() { e.AddRedirect("file:///alias.js", "file:///b.js") },
+			func() { e.SetArchiveMetadata(map[string]string{"build": "1"}) },
+			func() { e.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte("{}")) },
+		}
+		packages := []*NpmPackage{
+			{ID: react, Dependencies: map[string]*NpmPackageID{"loose-envify": looseEnvify}},
+			{ID: looseEnvify, Dependencies: map[string]*NpmPackageID{}},
+		}
+		if reverse {
+			slices.Reverse(add)
+			slices.Reverse(packages)
+		}
+		for _, f := range add {
+			f()
+		}
+		e.npmSnapshot = &NpmResolutionSnapshot{Packages: packages, RootPackages: map[string]*NpmPackageID{"react": react}}
+		return e
+	}
+
+	normalize := func(e *EszipV2, opts NormalizeOptions) []byte {
+		t.Helper()
+		n, err := Normalize(ctx, &EszipUnion{v2: e}, opts)
+		if err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		data, err := n.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		return data
+	}
+
+	opts := NormalizeOptions{Checksum: ChecksumXxh3}
+	a := normalize(build(false, ChecksumSha256), opts)
+	b := normalize(build(true, ChecksumNone), opts)
+	if !bytes.Equal(a, b) {
+		t.Fatal("content-equal archives normalized to different bytes")
+	}
+
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(a))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if again := normalize(parsed, opts); !bytes.Equal(a, again) {
+		t.Error("Normalize is not idempotent")
+	}
+	if parsed.options.Checksum != ChecksumXxh3 || parsed.version != DefaultVersion {
+		t.Errorf("got %v %v, want xxhash3 at the default version", parsed.options.Checksum, parsed.version)
+	}
+	want := []string{"file:///import_map.json", ArchiveMetadataSpecifier, "file:///a.js", "file:///b.js", "file:///alias.js", "file:///z.js"}
+	if got := parsed.modules.Keys(); !slices.Equal(got, want) {
+		t.Errorf("entry order = %v, want %v", got, want)
+	}
+
+	stripped, err := ParseV2Sync(ctx, bytes.NewReader(normalize(build(false, ChecksumSha256), NormalizeOptions{StripSourceMaps: true})))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if sourceMap, _ := stripped.GetModule("file:///b.js").SourceMap(ctx); len(sourceMap) != 0 {
+		t.Errorf("source map = %q, want it stripped", sourceMap)
+	}
+
+	t.Run("v1", func(t *testing.T) {
+		v1, err := ParseBytes(ctx, []byte(`{"version":1,"modules":{"file:///b.js":{"Source":{"source":"b","deps":[]}},"file:///a.js":{"Redirect":"file:///b.js"}}}`))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		n, err := Normalize(ctx, v1, NormalizeOptions{})
+		if err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		if equal, diff, err := Equal(ctx, v1, &EszipUnion{v2: n}, EqualOptions{}); err != nil || !equal {
+			t.Errorf("normalized V1 differs: %v %v", diff, err)
+		}
+	})
+
+	t.Run("invalid_npm_snapshot", func(t *testing.T) {
+		e := NewV2()
+		e.npmSnapshot = &NpmResolutionSnapshot{RootPackages: map[string]*NpmPackageID{"react": react}}
+		if _, err := Normalize(ctx, &EszipUnion{v2: e}, NormalizeOptions{}); err == nil {
+			t.Error("expected error for root resolving to a missing package")
+		}
+	})
+
+	t.Run("version", func(t *testing.T) {
+		latest, err := ParseV2Sync(ctx, bytes.NewReader(normalize(build(false, ChecksumSha256), NormalizeOptions{Version: LatestVersion})))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		if latest.version != LatestVersion {
+			t.Errorf("version = %v, want %v", latest.version, LatestVersion)
+		}
+		if _, err := Normalize(ctx, &EszipUnion{v2: build(false, ChecksumSha256)}, NormalizeOptions{Version: 99}); err == nil {
+			t.Error("expected error for an unknown version")
+		}
+
+		for name, tt := range map[string]struct {
+			mutate  func(*EszipV2)
+			version EszipVersion
+		}{
+			"headers": {func(e *EszipV2) {
+				e.AddModuleWithHeaders("file:///c.js", ModuleKindJavaScript, []byte("c"), nil, map[string]string{"content-type": "text/javascript"})
+			}, VersionV2_3},
+			"aux": {func(e *EszipV2) {
+				if err := e.SetModuleAux("file:///a.js", "x", []byte("y")); err != nil {
+					t.Fatal(err)
+				}
+			}, VersionV2_4},
+			"npm_integrity": {func(e *EszipV2) { e.npmSnapshot.Packages[0].Integrity = "sha512-abc" }, VersionV2_5},
+		} {
+			e := build(false, ChecksumSha256)
+			tt.mutate(e)
+			if _, err := Normalize(ctx, &EszipUnion{v2: e}, NormalizeOptions{Version: tt.version}); !errors.Is(err, ErrVersionTooOld) {
+				t.Errorf("%s at %v: error = %v, want ErrVersionTooOld", name, tt.version, err)
+			}
+			if _, err := Normalize(ctx, &EszipUnion{v2: e}, NormalizeOptions{Version: tt.version + 1}); err != nil {
+				t.Errorf("%s at %v: %v", name, tt.version+1, err)
+			}
+		}
+	})
+}
+
+func TestFingerprint(t *testing.T) {
+	ctx := context.Background()
+
+	react := &NpmPackageID{Name: "react", Version: "18.2.0"}
+	looseEnvify := &NpmPackageID{Name: "loose-envify", Version: "1.4.0"}
+	build := func(reverse bool, checksum ChecksumType) *EszipV2 {
+		e := NewV2()
+		e.SetChecksum(checksum)
+		add := []func(){
+			func() { e.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b"), []byte("map-b")) },
+			func() { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil) },
+			func() { e.AddRedirect("file:///alias.js", "file:///b.js") },
+		}
+		packages := []*NpmPackage{
+			{ID: react, Dependencies: map[string]*NpmPackageID{"loose-envify": looseEnvify}},
+			{ID: looseEnvify, Dependencies: map[string]*NpmPackageID{}},
+		}
+		if reverse {
+			slices.Reverse(add)
+			slices.Reverse(packages)
+		}
+		for _, f := range add {
+			f()
+		}
+		e.npmSnapshot = &NpmResolutionSnapshot{Packages: packages, RootPackages: map[string]*NpmPackageID{"react": react}}
+		return e
+	}
+	fingerprint := func(t *testing.T, e *EszipV2) [32]byte {
+		t.Helper()
+		sum, err := e.Fingerprint()
+		if err != nil {
+			t.Fatalf("Fingerprint failed: %v", err)
+		}
+		return sum
+	}
+
+	want := fingerprint(t, build(false, ChecksumSha256))
+	if got := fingerprint(t, build(true, ChecksumXxh3)); got != want {
+		t.Error("entry order or checksum changed the fingerprint")
+	}
+
+	data, err := build(false, ChecksumNone).IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := parsed.Fingerprint(ctx); err != nil || got != want {
+		t.Errorf("parsed archive: fingerprint differs (err %v)", err)
+	}
+
+	changes := map[string]func(e *EszipV2){
+		"source":     func(e *EszipV2) { e.ReplaceModuleSource("file:///a.js", []byte("A"), nil) },
+		"source map": func(e *EszipV2) { e.ReplaceModuleSource("file:///b.js", []byte("b"), nil) },
+		"redirect":   func(e *EszipV2) { e.AddRedirect("file:///alias.js", "file:///a.js") },
+		"kind":       func(e *EszipV2) { e.AddModule("file:///a.js", ModuleKindJson, []byte("a"), nil) },
+		"npm":        func(e *EszipV2) { e.npmSnapshot.RootPackages["env"] = looseEnvify },
+		"specifier":  func(e *EszipV2) { e.RenameSpecifier("file:///a.js", "file:///c.js") },
+	}
+	for name, change := range changes {
+		e := build(false, ChecksumSha256)
+		change(e)
+		if fingerprint(t, e) == want {
+			t.Errorf("%s change did not change the fingerprint", name)
+		}
+	}
+
+	// A V1 archive has the fingerprint of its V2 conversion.
+	v1 := NewV1()
+	v1.AddModule("file:///main.js", []byte("main"), nil)
+	v1.AddRedirect("file:///alias.js", "file:///main.js")
+	v2, err := ConvertV1ToV2(v1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&EszipUnion{v1: v1}).Fingerprint(ctx)
+	if err != nil || got != fingerprint(t, v2) {
+		t.Errorf("V1 fingerprint differs from its conversion (err %v)", err)
+	}
+}
+
+func FuzzNormalize(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 'b', 1, 'x', 0, 4, 1, 'a', 1, 'y', 1, 'm'})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ctx := context.Background()
+		order, modules := decodeFuzzModules(data)
+
+		// Build the same content in two orders with different checksums.
+		// JSONC is avoided because a leading JSONC module is read back as
+		// the import map, which makes entry order significant.
+		build := func(specs []string, checksum ChecksumType) *EszipUnion {
+			e := NewV2()
+			e.SetChecksum(checksum)
+			for _, spec := range specs {
+				m := modules[spec]
+				kind := m.kind
+				if kind == ModuleKindJsonc {
+					kind = ModuleKindJson
+				}
+				e.AddModule(m.specifier, kind, m.source, m.sourceMap)
+			}
+			return &EszipUnion{v2: e}
+		}
+		reversed := slices.Clone(order)
+		slices.Reverse(reversed)
+
+		opts := NormalizeOptions{Checksum: ChecksumSha256}
+		var outputs [][]byte
+		for _, in := range []*EszipUnion{build(order, ChecksumNone), build(reversed, ChecksumXxh3)} {
+			n, err := Normalize(ctx, in, opts)
+			if err != nil {
+				t.Fatalf("Normalize failed: %v", err)
+			}
+			out, err := n.IntoBytes()
+			if err != nil {
+				t.Fatalf("IntoBytes failed: %v", err)
+			}
+			outputs = append(outputs, out)
+		}
+		if !bytes.Equal(outputs[0], outputs[1]) {
+			t.Fatal("normalized output depends on entry order or checksum")
+		}
+
+		parsed, err := ParseBytes(ctx, outputs[0])
+		if err != nil {
+			t.Fatalf("ParseBytes failed: %v", err)
+		}
+		n, err := Normalize(ctx, parsed, opts)
+		if err != nil {
+			t.Fatalf("Normalize failed: %v", err)
+		}
+		again, err := n.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		if !bytes.Equal(outputs[0], again) {
+			t.Fatal("Normalize is not idempotent")
+		}
+	})
+}
+
+// patchFixture builds an archive whose sources are large enough that
+// PatchArchive's copy path dominates.
+func TestPreservedRoundTrip(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	// Options header content starts at 12: [0, checksum, 1, size]. Turn the
+	// size option into an unknown option 9, and add a trailing section.
+	data[14] = 9
+	trailing := []byte("\x00\x00\x00\x03new")
+	data = append(data, trailing...)
+
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	preserved := v2.Preserved()
+	if want := []byte{9, data[15]}; !bytes.Equal(preserved.Options, want) {
+		t.Errorf("Options = %v, want %v", preserved.Options, want)
+	}
+	if !bytes.Equal(preserved.Trailing, trailing) {
+		t.Errorf("Trailing = %q, want %q", preserved.Trailing, trailing)
+	}
+
+	v2.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b"), nil)
+	out, err := v2.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if !bytes.HasSuffix(out, trailing) {
+		t.Errorf("output does not end with the trailing section")
+	}
+	if got := v2.EstimatedSize(); got != int64(len(out)) {
+		t.Errorf("EstimatedSize = %d, want %d", got, len(out))
+	}
+	reparsed, err := ParseBytes(ctx, out)
+	if err != nil {
+		t.Fatalf("failed to reparse: %v", err)
+	}
+	v2, _ = reparsed.V2()
+	if got := v2.Preserved(); !bytes.Equal(got.Options, preserved.Options) || !bytes.Equal(got.Trailing, trailing) {
+		t.Errorf("after rewrite, Preserved = %+v", got)
+	}
+	if src, _ := v2.GetModule("file:///b.js").Source(ctx); string(src) != "b" {
+		t.Errorf("b.js = %q", src)
+	}
+
+	// PatchArchive copies the trailing section too.
+	var patched bytes.Buffer
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///a.js", Source: []byte("patched")}}
+	if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+	if !bytes.HasSuffix(patched.Bytes(), trailing) {
+		t.Errorf("patched archive does not end with the trailing section")
+	}
+
+	v2.DiscardPreserved()
+	if got := v2.Preserved(); got.Options != nil || got.Trailing != nil {
+		t.Errorf("after DiscardPreserved, Preserved = %+v", got)
+	}
+	out, err = v2.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if bytes.HasSuffix(out, trailing) {
+		t.Errorf("discarded trailing section was written")
+	}
+
+	// A stream of unknown size is not read past the archive.
+	streamed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse stream: %v", err)
+	}
+	if got := streamed.Preserved(); got.Trailing != nil {
+		t.Errorf("streamed parse kept trailing data %q", got.Trailing)
+	}
+}
+
+func patchFixture(tb testing.TB, modules, sourceSize int) []byte {
+	tb.Helper()
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumSha256)
+	for i := 0; i < modules; i++ {
+		source := bytes.Repeat([]byte{byte('a' + i%26)}, sourceSize)
+		eszip.AddModule(fmt.Sprintf("file:///mod%d.js", i), ModuleKindJavaScript, source, []byte(fmt.Sprintf(`{"m":%d}`, i)))
+	}
+	eszip.AddRedirect("file:///alias.js", "file:///mod0.js")
+	id := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+	eszip.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: id, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"lodash": id},
+	}
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		tb.Fatalf("failed to serialize: %v", err)
+	}
+	return data
+}
+
+func TestPatchArchive(t *testing.T) {
+	ctx := context.Background()
+	input := patchFixture(t, 5, 100)
+
+	changes := []Change{
+		{Op: ChangeReplaceSource, Specifier: "file:///mod1.js", Source: []byte("replaced")},
+		{Op: ChangeReplaceSourceMap, Specifier: "file:///mod2.js", SourceMap: nil},
+		{Op: ChangeRemove, Specifier: "file:///mod3.js"},
+		{Op: ChangeRemove, Specifier: "file:///alias.js"},
+		{Op: ChangeAdd, Specifier: "file:///new.js", Kind: ModuleKindJson, Source: []byte("{}"), SourceMap: []byte("map")},
+	}
+
+	var patched bytes.Buffer
+	if err := PatchArchive(ctx, bytes.NewReader(input), int64(len(input)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+
+	// The same edits through a full parse and rewrite.
+	full, err := ParseV2Sync(ctx, bytes.NewReader(input))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	mod2Source, _ := full.GetModule("file:///mod2.js").Source(ctx)
+	mod1Map, _ := full.GetModule("file:///mod1.js").SourceMap(ctx)
+	full.AddModule("file:///mod1.js", ModuleKindJavaScript, []byte("replaced"), mod1Map)
+	full.AddModule("file:///mod2.js", ModuleKindJavaScript, mod2Source, nil)
+	full.modules.Remove("file:///mod3.js")
+	full.modules.Remove("file:///alias.js")
+	full.AddModule("file:///new.js", ModuleKindJson, []byte("{}"), []byte("map"))
+	want, err := full.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	if !bytes.Equal(patched.Bytes(), want) {
+		t.Fatalf("patched archive differs from a full rewrite (%d vs %d bytes)", patched.Len(), len(want))
+	}
+	if _, err := ParseBytes(ctx, patched.Bytes()); err != nil {
+		t.Fatalf("patched archive does not parse: %v", err)
+	}
+
+	t.Run("invalid_changes", func(t *testing.T) {
+		for _, c := range []Change{
+			{Op: ChangeAdd, Specifier: "file:///mod0.js"},
+			{Op: ChangeRemove, Specifier: "file:///missing.js"},
+			{Op: ChangeReplaceSource, Specifier: "file:///missing.js"},
+			{Op: ChangeReplaceSource, Specifier: "file:///alias.js"},
+		} {
+			if err := PatchArchive(ctx, bytes.NewReader(input), int64(len(input)), io.Discard, []Change{c}); err == nil {
+				t.Errorf("expected error for %+v", c)
+			}
+		}
+	})
+
+	t.Run("testdata", func(t *testing.T) {
+		for _, name := range []string{"redirect.eszip2", "json.eszip2", "wasm.eszip2_3"} {
+			data, err := os.ReadFile(filepath.Join("testdata", name))
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", name, err)
+			}
+			var out bytes.Buffer
+			if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &out, nil); err != nil {
+				t.Fatalf("%s: PatchArchive failed: %v", name, err)
+			}
+			before, _ := ParseBytes(ctx, data)
+			after, err := ParseBytes(ctx, out.Bytes())
+			if err != nil {
+				t.Fatalf("%s: patched archive does not parse: %v", name, err)
+			}
+			if equal, diff, err := Equal(ctx, before, after, EqualOptions{}); err != nil || !equal {
+				t.Errorf("%s: content changed: %v %v", name, diff, err)
+			}
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		short := input[:len(input)-10]
+		if err := PatchArchive(ctx, bytes.NewReader(short), int64(len(short)), io.Discard, nil); err == nil {
+			t.Error("expected error for truncated input")
+		}
+	})
+}
+
+func BenchmarkPatchArchive(b *testing.B) {
+	ctx := context.Background()
+	input := patchFixture(b, 256, 64<<10)
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///mod128.js", Source: []byte("patched")}}
+
+	b.Run("patch", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			if err := PatchArchive(ctx, bytes.NewReader(input), int64(len(input)), io.Discard, changes); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("rewrite", func(b *testing.B) {
+		b.SetBytes(int64(len(input)))
+		for i := 0; i < b.N; i++ {
+			e, err := ParseV2Sync(ctx, bytes.NewReader(input))
+			if err != nil {
+				b.Fatal(err)
+			}
+			e.AddModule("file:///mod128.js", ModuleKindJavaScript, []byte("patched"), nil)
+			if _, err := e.IntoBytes(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestParseBytesZeroCopy(t *testing.T) {
+	ctx := context.Background()
+	archive := NewV2()
+	archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte("export const a = 'zero-copy';"), []byte(`{"version":3}`))
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	at := bytes.Index(data, []byte("zero-copy"))
+
+	parsed, err := ParseBytes(ctx, data, WithZeroCopy())
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	source, _ := parsed.GetModule("file:///a.js").Source(ctx)
+	if string(source) != "export const a = 'zero-copy';" {
+		t.Fatalf("source = %q", source)
+	}
+	if cap(source) != len(source) {
+		t.Errorf("source has capacity %d beyond its length %d", cap(source), len(source))
+	}
+	data[at] = 'Z'
+	if !bytes.Contains(source, []byte("Zero-copy")) {
+		t.Error("source does not share the input")
+	}
+	data[at] = 'z'
+
+	copied, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	source, _ = copied.GetModule("file:///a.js").Source(ctx)
+	data[at] = 'Z'
+	if bytes.Contains(source, []byte("Zero-copy")) {
+		t.Error("source shares the input without WithZeroCopy")
+	}
+	data[at] = 'z'
+
+	// Compressed content is decoded into memory of its own.
+	archive.SetCompression(CompressionGzip)
+	compressed, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err = ParseBytes(ctx, compressed, WithZeroCopy())
+	if err != nil {
+		t.Fatalf("failed to parse compressed archive: %v", err)
+	}
+	if equal, diff, err := Equal(ctx, &EszipUnion{v2: archive}, parsed, EqualOptions{}); err != nil || !equal {
+		t.Errorf("compressed archive differs: %v %v", diff, err)
+	}
+
+	if _, err := ParseBytes(ctx, data[:len(data)-10], WithZeroCopy()); err == nil {
+		t.Error("expected error for truncated input")
+	}
+}
+
+func BenchmarkParseBytes(b *testing.B) {
+	ctx := context.Background()
+	input := patchFixture(b, 256, 64<<10)
+
+	for name, opts := range map[string][]ParseOption{"copy": nil, "zero_copy": {WithZeroCopy()}} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				if _, err := ParseBytes(ctx, input, opts...); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestOrigins(t *testing.T) {
+	for specifier, want := range map[string]string{
+		"https://deno.land/std/mod.ts":   "deno.land",
+		"http://Example.COM:8080/a.js":   "example.com:8080",
+		"file:///main.ts":                "",
+		"data:text/javascript,export {}": "",
+		"npm:/preact@10.0.0":             "",
+		"npm:preact":                     "",
+		ArchiveMetadataSpecifier:         "",
+		"https:///no-host.js":            "",
+	} {
+		host, ok := specifierOrigin(specifier)
+		if host != want || ok != (want != "") {
+			t.Errorf("specifierOrigin(%q) = %q, %v; want %q", specifier, host, ok, want)
+		}
+	}
+
+	archive := NewV2()
+	archive.AddModule("https://deno.land/std/mod.ts", ModuleKindJavaScript, []byte("export {}"), []byte("{}"))
+	archive.AddModule("https://deno.land/std/data.json", ModuleKindJson, []byte("[]"), nil)
+	archive.AddModule("https://deno.land/x/other.ts", ModuleKindJavaScript, []byte("x"), nil)
+	archive.AddModule("https://esm.sh/preact", ModuleKindJavaScript, []byte("preact"), nil)
+	archive.AddModule("file:///main.ts", ModuleKindJavaScript, []byte("main"), nil)
+	archive.AddRedirect("https://cdn.example.com/a.js", "https://esm.sh/preact")
+
+	want := map[string]OriginStats{
+		"deno.land": {Modules: 3, Bytes: 14, Kinds: []ModuleKind{ModuleKindJavaScript, ModuleKindJson}},
+		"esm.sh":    {Modules: 1, Bytes: 6, Kinds: []ModuleKind{ModuleKindJavaScript}},
+	}
+	if got := archive.Origins(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Origins() = %+v, want %+v", got, want)
+	}
+}
+
+func TestOriginPolicy(t *testing.T) {
+	ctx := context.Background()
+
+	policy := newOriginPolicy([]string{"deno.land", "*.Example.com", "localhost:8080", "[::1]"})
+	for host, want := range map[string]bool{
+		"deno.land":       true,
+		"deno.land:443":   true,
+		"evil-deno.land":  false,
+		"cdn.example.com": true,
+		"a.b.example.com": true,
+		"example.com":     false,
+		"notexample.com":  false,
+		"localhost:8080":  true,
+		"localhost:9000":  false,
+		"localhost":       false,
+		"[::1]:8000":      true,
+		"esm.sh":          false,
+	} {
+		if got := policy.allows(host); got != want {
+			t.Errorf("allows(%q) = %v, want %v", host, got, want)
+		}
+	}
+
+	archive := NewV2()
+	archive.AddModule("file:///main.ts", ModuleKindJavaScript, []byte("main"), nil)
+	archive.AddModule("https://esm.sh/preact", ModuleKindJavaScript, []byte("preact"), nil)
+	archive.AddModule("https://deno.land/std/mod.ts", ModuleKindJavaScript, []byte("std"), nil)
+	archive.AddRedirect("http://cdn.evil.com/a.js", "https://esm.sh/preact")
+
+	var perr *OriginPolicyError
+	_, err := archive.IntoBytes(WithWriteAllowedOrigins("deno.land"))
+	if !errors.As(err, &perr) || !slices.Equal(perr.Specifiers, []string{"http://cdn.evil.com/a.js", "https://esm.sh/preact"}) {
+		t.Fatalf("IntoBytes error = %v, want both out-of-policy specifiers", err)
+	}
+
+	data, err := archive.IntoBytes(WithWriteAllowedOrigins("deno.land", "esm.sh", "*.evil.com"))
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	if _, err := ParseBytes(ctx, data, WithAllowedOrigins("*.deno.land", "esm.sh", "cdn.evil.com")); !errors.As(err, &perr) || !slices.Equal(perr.Specifiers, []string{"https://deno.land/std/mod.ts"}) {
+		t.Errorf("ParseBytes error = %v, want deno.land rejected", err)
+	}
+	if _, err := ParseBytes(ctx, data, WithAllowedOrigins("deno.land", "esm.sh", "cdn.evil.com")); err != nil {
+		t.Errorf("ParseBytes failed: %v", err)
+	}
+
+	v1, err := os.ReadFile("testdata/basic.json")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	if _, err := ParseBytes(ctx, v1, WithAllowedOrigins()); !errors.As(err, &perr) {
+		t.Errorf("V1 ParseBytes error = %v, want *OriginPolicyError", err)
+	}
+}
+
+func TestTransformSources(t *testing.T) {
+	ctx := context.Background()
+	newArchive := func() *EszipV2 {
+		archive := NewV2()
+		archive.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{"imports":{}}`))
+		archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a()\n//# sourceMappingURL=a.js.map"), []byte("{}"))
+		archive.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b()"), []byte("{}"))
+		archive.AddModule("file:///c.js", ModuleKindJavaScript, []byte("c()"), []byte("{}"))
+		archive.AddRedirect("file:///alias.js", "file:///a.js")
+		archive.SetArchiveMetadata(map[string]string{"build": "1"})
+		return archive
+	}
+	source := func(archive *EszipV2, specifier string) string {
+		t.Helper()
+		b, err := archive.GetModule(specifier).Source(ctx)
+		if err != nil {
+			t.Fatalf("Source(%s) failed: %v", specifier, err)
+		}
+		return string(b)
+	}
+	sourceMap := func(archive *EszipV2, specifier string) string {
+		t.Helper()
+		b, err := archive.GetModule(specifier).SourceMap(ctx)
+		if err != nil {
+			t.Fatalf("SourceMap(%s) failed: %v", specifier, err)
+		}
+		return string(b)
+	}
+	banner := func(_ string, kind ModuleKind, source []byte) ([]byte, bool, error) {
+		if kind != ModuleKindJavaScript {
+			return nil, false, nil
+		}
+		return append([]byte("// banner\n"), source...), true, nil
+	}
+
+	t.Run("changing", func(t *testing.T) {
+		archive := newArchive()
+		var seen []string
+		n, err := archive.TransformSources(ctx, func(specifier string, kind ModuleKind, src []byte) ([]byte, bool, error) {
+			seen = append(seen, specifier)
+			return banner(specifier, kind, src)
+		})
+		if err != nil || n != 3 {
+			t.Fatalf("TransformSources = %d, %v; want 3", n, err)
+		}
+		want := []string{"file:///import_map.json", "file:///a.js", "file:///b.js", "file:///c.js"}
+		if !slices.Equal(seen, want) {
+			t.Errorf("transformed %v, want %v", seen, want)
+		}
+		if got := source(archive, "file:///b.js"); got != "// banner\nb()" {
+			t.Errorf("b.js source = %q", got)
+		}
+		if got := sourceMap(archive, "file:///b.js"); got != "" {
+			t.Errorf("b.js source map = %q, want cleared", got)
+		}
+		if got := source(archive, "file:///import_map.json"); got != `{"imports":{}}` {
+			t.Errorf("import map changed to %q", got)
+		}
+
+		data, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		parsed, err := ParseBytes(ctx, data)
+		if err != nil {
+			t.Fatalf("ParseBytes failed: %v", err)
+		}
+		if got, _ := parsed.GetModule("file:///alias.js").Source(ctx); string(got) != "// banner\na()\n//# sourceMappingURL=a.js.map" {
+			t.Errorf("redirected source = %q", got)
+		}
+		if metadata, err := parsed.ArchiveMetadata(ctx); err != nil || metadata["build"] != "1" {
+			t.Errorf("metadata = %v, %v", metadata, err)
+		}
+	})
+
+	t.Run("preserved_source_maps", func(t *testing.T) {
+		archive := newArchive()
+		if _, err := archive.TransformSources(ctx, banner, WithPreservedSourceMaps()); err != nil {
+			t.Fatalf("TransformSources failed: %v", err)
+		}
+		if got := sourceMap(archive, "file:///a.js"); got != "{}" {
+			t.Errorf("a.js source map = %q, want kept", got)
+		}
+	})
+
+	t.Run("noop", func(t *testing.T) {
+		archive := newArchive()
+		before, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		n, err := archive.TransformSources(ctx, func(_ string, _ ModuleKind, source []byte) ([]byte, bool, error) {
+			return source, false, nil
+		})
+		if err != nil || n != 0 {
+			t.Fatalf("TransformSources = %d, %v; want 0", n, err)
+		}
+		after, err := archive.IntoBytes()
+		if err != nil {
+			t.Fatalf("IntoBytes failed: %v", err)
+		}
+		if !bytes.Equal(before, after) {
+			t.Error("no-op transform changed the archive")
+		}
+	})
+
+	t.Run("error_midway", func(t *testing.T) {
+		archive := newArchive()
+		boom := errors.New("boom")
+		n, err := archive.TransformSources(ctx, func(specifier string, kind ModuleKind, source []byte) ([]byte, bool, error) {
+			if specifier == "file:///b.js" {
+				return nil, false, boom
+			}
+			return banner(specifier, kind, source)
+		})
+		if !errors.Is(err, boom) || n != 1 {
+			t.Fatalf("TransformSources = %d, %v; want 1, boom", n, err)
+		}
+		if got := source(archive, "file:///a.js"); got != "// banner\na()\n//# sourceMappingURL=a.js.map" {
+			t.Errorf("a.js source = %q, want transformed", got)
+		}
+		if got := sourceMap(archive, "file:///a.js"); got != "" {
+			t.Errorf("a.js source map = %q, want cleared", got)
+		}
+		if got := source(archive, "file:///c.js"); got != "c()" {
+			t.Errorf("c.js source = %q, want untouched", got)
+		}
+		if got := sourceMap(archive, "file:///c.js"); got != "{}" {
+			t.Errorf("c.js source map = %q, want untouched", got)
+		}
+	})
+}
+
+func TestMinifySources(t *testing.T) {
+	ctx := context.Background()
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export const  answer = 42;\n"), []byte(`{"version":3}`))
+	eszip.AddModule("file:///data.json", ModuleKindJson, []byte(`{ "a": 1 }`), nil)
+	eszip.AddRedirect("file:///alias.js", "file:///main.js")
+
+	var seen []string
+	minifier := MinifierFunc(func(specifier string, code, sourceMap []byte) ([]byte, []byte, error) {
+		seen = append(seen, specifier+" "+string(sourceMap))
+		return bytes.ReplaceAll(bytes.TrimSpace(code), []byte("  "), []byte(" ")), []byte(`{"version":3,"minified":true}`), nil
+	})
+	n, err := eszip.MinifySources(ctx, minifier)
+	if err != nil || n != 1 {
+		t.Fatalf("MinifySources = %d, %v; want 1 module", n, err)
+	}
+	if want := []string{`file:///main.js {"version":3}`}; !slices.Equal(seen, want) {
+		t.Errorf("minifier saw %q, want %q", seen, want)
+	}
+	main := eszip.GetModule("file:///main.js")
+	if source, _ := main.Source(ctx); string(source) != "export const answer = 42;" {
+		t.Errorf("minified source = %q", source)
+	}
+	if sourceMap, _ := main.SourceMap(ctx); string(sourceMap) != `{"version":3,"minified":true}` {
+		t.Errorf("minified source map = %q", sourceMap)
+	}
+	if source, _ := eszip.GetModule("file:///data.json").Source(ctx); string(source) != `{ "a": 1 }` {
+		t.Errorf("JSON module changed to %q", source)
+	}
+
+	// Minifying again reports the size before the first minification.
+	if _, err := eszip.MinifySources(ctx, minifier); err != nil {
+		t.Fatal(err)
+	}
+	var report WriteReport
+	if _, err := eszip.IntoBytes(WithWriteReport(&report)); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]int64{"file:///main.js": 27}; !maps.Equal(report.OriginalSizes, want) {
+		t.Errorf("OriginalSizes = %v, want %v", report.OriginalSizes, want)
+	}
+
+	// Replacing the source forgets the original size.
+	if err := eszip.ReplaceModuleSource("file:///main.js", []byte("export {};"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := eszip.IntoBytes(WithWriteReport(&report)); err != nil {
+		t.Fatal(err)
+	}
+	if len(report.OriginalSizes) != 0 {
+		t.Errorf("OriginalSizes after replacing the source = %v", report.OriginalSizes)
+	}
+
+	failing := MinifierFunc(func(string, []byte, []byte) ([]byte, []byte, error) {
+		return nil, nil, errors.New("syntax error")
+	})
+	if _, err := eszip.MinifySources(ctx, failing); err == nil || !strings.Contains(err.Error(), "minifying file:///main.js") {
+		t.Errorf("failing minifier error = %v", err)
+	}
+}
+
+func TestTransformers(t *testing.T) {
+	cjs := []byte("const ms = require(\"ms\");\nmodule.exports = ms(\"1s\");\n//# sourceMappingURL=index.js.map\n")
+	code, sourceMap, err := CommonJSToESM().Transform("file:///index.js", ModuleKindJavaScript, cjs, []byte(`{"version":3,"mappings":"AAAA"}`))
+	if err != nil {
+		t.Fatalf("CommonJSToESM failed: %v", err)
+	}
+	if !bytes.HasPrefix(code, []byte(cjsPrelude+"const ms = require")) || !bytes.HasSuffix(code, []byte("export default __eszipModule.exports;\n")) {
+		t.Errorf("CommonJSToESM wrapped to %q", code)
+	}
+	if bytes.Contains(code, []byte("sourceMappingURL")) {
+		t.Errorf("CommonJSToESM kept the sourceMappingURL comment: %q", code)
+	}
+	if string(sourceMap) != `{"mappings":";AAAA","version":3}` {
+		t.Errorf("CommonJSToESM source map = %s, want it shifted a line", sourceMap)
+	}
+	refs := ScanImports(code)
+	if len(refs) != 1 || refs[0].Specifier != "node:module" {
+		t.Errorf("wrapped module imports %v, want node:module", refs)
+	}
+	for _, esm := range []string{"import ms from \"ms\";\nexport default ms;\n", "export const require = 1;\n", "console.log(1);\n", "module.exports = import.meta.url;\n"} {
+		if code, _, _ := CommonJSToESM().Transform("file:///mod.js", ModuleKindJavaScript, []byte(esm), nil); string(code) != esm {
+			t.Errorf("CommonJSToESM changed %q to %q", esm, code)
+		}
+	}
+	if code, _, _ := CommonJSToESM().Transform("file:///mod.cjs?v=1", ModuleKindJavaScript, []byte("console.log(1);\n"), nil); !bytes.HasPrefix(code, []byte(cjsPrelude)) {
+		t.Errorf("CommonJSToESM did not wrap a .cjs module: %q", code)
+	}
+
+	code, sourceMap, _ = StripSourceMaps().Transform("file:///a.js", ModuleKindJavaScript, []byte("a();\n//# sourceMappingURL=a.js.map\n"), []byte("{}"))
+	if string(code) != "a();\n" || sourceMap != nil {
+		t.Errorf("StripSourceMaps = %q, %q", code, sourceMap)
+	}
+
+	minified := "function f(a){if(a){return 1}else{return[a,{}]}}for(let i=0;i<3;i++){f(i)}const re=/[;{]/g;"
+	want := "function f(a){\n  if(a){\n    return 1\n  }else{\n    return[a,{}]\n  }\n}\nfor(let i=0;i<3;i++){\n  f(i)\n}\nconst re=/[;{]/g;\n"
+	code, sourceMap, _ = PrettyPrint().Transform("file:///min.js", ModuleKindJavaScript, []byte(minified), []byte("{}"))
+	if string(code) != want || sourceMap != nil {
+		t.Errorf("PrettyPrint = %q, %q; want %q", code, sourceMap, want)
+	}
+	formatted := "function f() {\n  return `${1};`;\n}\n"
+	if code, sourceMap, _ = PrettyPrint().Transform("file:///f.js", ModuleKindJavaScript, []byte(formatted), []byte("{}")); string(code) != formatted || string(sourceMap) != "{}" {
+		t.Errorf("PrettyPrint changed formatted code to %q, %q", code, sourceMap)
+	}
+	if code, _, _ = PrettyPrint().Transform("file:///a.json", ModuleKindJson, []byte(`{"a":[1]}`), nil); string(code) != "{\n  \"a\": [\n    1\n  ]\n}\n" {
+		t.Errorf("PrettyPrint JSON = %q", code)
+	}
+
+	chain := ChainTransformers(StripSourceMaps(), TransformerFunc(func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+		return nil, nil, errors.New("boom")
+	}))
+	if _, _, err := chain.Transform("file:///a.js", ModuleKindJavaScript, []byte("a"), nil); err == nil || err.Error() != "boom" {
+		t.Errorf("ChainTransformers error = %v, want boom", err)
+	}
+}
+
+func TestReadOnlyView(t *testing.T) {
+	ctx := context.Background()
+	pkgID := &NpmPackageID{Name: "preact", Version: "10.0.0"}
+	archive := NewV2()
+	archive.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{"imports":{}}`))
+	archive.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), []byte("{}"))
+	archive.AddRedirect("file:///alias.js", "file:///main.js")
+	archive.SetArchiveMetadata(map[string]string{"build": "1"})
+	archive.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: pkgID, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"preact": pkgID},
+	}
+
+	view := archive.ReadOnly()
+
+	t.Run("mutations", func(t *testing.T) {
+		modules := []*Module{
+			view.GetModule("file:///main.js"),
+			view.GetModule("file:///alias.js"),
+			view.GetImportMap("file:///import_map.json"),
+		}
+		for _, entry := range view.Iterate() {
+			modules = append(modules, entry.Module)
+		}
+		for _, entry := range view.Entries() {
+			modules = append(modules, entry.Module)
+		}
+		for _, m := range modules {
+			if _, err := m.TakeSource(ctx); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("TakeSource(%s) error = %v, want ErrReadOnly", m.Specifier, err)
+			}
+			if _, err := m.TakeSourceMap(ctx); !errors.Is(err, ErrReadOnly) {
+				t.Errorf("TakeSourceMap(%s) error = %v, want ErrReadOnly", m.Specifier, err)
+			}
+		}
+		if source, err := archive.GetModule("file:///main.js").Source(ctx); err != nil || string(source) != "main" {
+			t.Errorf("owner source = %q, %v; want untouched", source, err)
+		}
+
+		snapshot := view.NpmSnapshot()
+		snapshot.Packages[0].ID.Version = "0.0.0"
+		delete(snapshot.RootPackages, "preact")
+		if again := view.NpmSnapshot(); again.Packages[0].ID.Version != "10.0.0" || len(again.RootPackages) != 1 {
+			t.Errorf("mutating the returned snapshot changed the view: %+v", again)
+		}
+		if pkgID.Version != "10.0.0" {
+			t.Error("mutating the returned snapshot changed the archive")
+		}
+	})
+
+	manifest := []ManifestEntry{
+		{Specifier: "file:///import_map.json", Kind: "json", SourceBytes: 14},
+		{Specifier: "file:///main.js", Kind: "javascript", SourceBytes: 4, SourceMapBytes: 2},
+		{Specifier: "file:///alias.js", Kind: "redirect", Target: "file:///main.js"},
+	}
+
+	t.Run("entries", func(t *testing.T) {
+		entries := view.Entries()
+		if len(entries) != 3 {
+			t.Fatalf("Entries() = %+v", entries)
+		}
+		for i, entry := range entries {
+			if entry.Specifier != manifest[i].Specifier || entry.Module == nil || entry.Npm {
+				t.Errorf("entry %d = %+v", i, entry)
+			}
+		}
+		if alias := entries[2]; alias.Redirect != "file:///main.js" || alias.Module.Specifier != "file:///main.js" {
+			t.Errorf("alias entry = %+v, want a redirect to main.js", alias)
+		}
+		if entries[1].Redirect != "" {
+			t.Errorf("main.js entry has redirect %q", entries[1].Redirect)
+		}
+		if got := view.Manifest(); !reflect.DeepEqual(got, manifest) {
+			t.Errorf("Manifest() = %+v, want %+v", got, manifest)
+		}
+	})
+
+	t.Run("owner_mutations", func(t *testing.T) {
+		archive.AddModule("file:///late.js", ModuleKindJavaScript, []byte("late"), nil)
+		archive.SetArchiveMetadata(map[string]string{"build": "2"})
+		if _, err := archive.TransformSources(ctx, func(_ string, _ ModuleKind, source []byte) ([]byte, bool, error) {
+			return append([]byte("// x\n"), source...), true, nil
+		}); err != nil {
+			t.Fatalf("TransformSources failed: %v", err)
+		}
+		archive.TakeNpmSnapshot()
+
+		want := []string{"file:///import_map.json", "file:///main.js", "file:///alias.js"}
+		if got := view.Specifiers(); !slices.Equal(got, want) {
+			t.Errorf("Specifiers() = %v, want %v", got, want)
+		}
+		if source, err := view.GetModule("file:///main.js").Source(ctx); err != nil || string(source) != "main" {
+			t.Errorf("view source = %q, %v; want snapshot content", source, err)
+		}
+		if metadata, err := view.ArchiveMetadata(ctx); err != nil || metadata["build"] != "1" {
+			t.Errorf("view metadata = %v, %v", metadata, err)
+		}
+		if view.NpmSnapshot() == nil {
+			t.Error("view lost its npm snapshot")
+		}
+		if got := view.Manifest(); !reflect.DeepEqual(got, manifest) {
+			t.Errorf("Manifest() = %+v, want the snapshot %+v", got, manifest)
+		}
+		if entries := view.Entries(); len(entries) != 3 || entries[2].Module == nil {
+			t.Errorf("Entries() = %+v, want the snapshot", entries)
+		}
+		if summary := view.Summary(); summary.ImportMap != "file:///import_map.json" || summary.Modules != 2 {
+			t.Errorf("view summary = %+v", summary)
+		}
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 100 {
+					for _, spec := range view.Specifiers() {
+						if m := view.GetModule(spec); m != nil {
+							_, _ = m.Source(ctx)
+							_, _ = m.TakeSource(ctx)
+						}
+					}
+					view.NpmSnapshot()
+					view.Summary()
+					view.Entries()
+					view.Manifest()
+				}
+			}()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range 100 {
+				archive.AddModule(fmt.Sprintf("file:///%d.js", i), ModuleKindJavaScript, []byte("x"), nil)
+			}
+		}()
+		wg.Wait()
+	})
+}
+
+// writeHook calls onWrite for each WriteProgress report.
+type writeHook struct {
+	Counters
+	onWrite func()
+}
+
+func (h *writeHook) WriteProgress(n int) {
+	h.onWrite()
+}
+
+func TestMaxArchiveSize(t *testing.T) {
+	pkgID := &NpmPackageID{Name: "preact", Version: "10.0.0"}
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	archive.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{"imports":{}}`))
+	archive.AddModule("file:///small.js", ModuleKindJavaScript, []byte("small"), nil)
+	archive.AddModule("file:///big.js", ModuleKindJavaScript, bytes.Repeat([]byte("b"), 1000), []byte("{}"))
+	archive.AddModule("file:///medium.js", ModuleKindJavaScript, bytes.Repeat([]byte("m"), 100), nil)
+	archive.AddRedirect("file:///alias.js", "file:///big.js")
+	archive.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: pkgID, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"preact": pkgID},
+	}
+
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	if got := archive.EstimatedSize(); got != int64(len(data)) {
+		t.Errorf("EstimatedSize() = %d, want %d", got, len(data))
+	}
+
+	t.Run("at_limit", func(t *testing.T) {
+		out, err := archive.IntoBytes(WithMaxArchiveSize(int64(len(data))))
+		if err != nil || !bytes.Equal(out, data) {
+			t.Errorf("IntoBytes at the limit = %d bytes, %v", len(out), err)
+		}
+	})
+
+	t.Run("precheck", func(t *testing.T) {
+		wrote := false
+		hook := &writeHook{onWrite: func() { wrote = true }}
+		_, err := archive.IntoBytes(WithMaxArchiveSize(int64(len(data))-1), WithWriteInstrumentation(hook))
+		var werr *WriteError
+		if !errors.As(err, &werr) {
+			t.Fatalf("IntoBytes error = %v, want *WriteError", err)
+		}
+		if wrote {
+			t.Error("serialization started before the estimate was checked")
+		}
+		if werr.Size != int64(len(data)) || werr.Limit != int64(len(data))-1 {
+			t.Errorf("WriteError size %d, limit %d", werr.Size, werr.Limit)
+		}
+		var largest []string
+		for _, m := range werr.Largest {
+			largest = append(largest, m.Specifier)
+		}
+		want := []string{"file:///big.js", "file:///medium.js", "file:///import_map.json", "file:///small.js"}
+		if !slices.Equal(largest, want) {
+			t.Errorf("Largest = %v, want %v", largest, want)
+		}
+	})
+
+	t.Run("streaming", func(t *testing.T) {
+		lazy := NewV2()
+		lazy.AddModule("file:///first.js", ModuleKindJavaScript, []byte("first"), nil)
+		slot := NewPendingSourceSlot(0, 10)
+		lazy.modules.Insert("file:///lazy.js", &ModuleData{
+			Kind:      ModuleKindJavaScript,
+			Source:    slot,
+			SourceMap: NewEmptySourceSlot(),
+		})
+		limit := lazy.EstimatedSize() + 100
+
+		// Deliver the source only once writing has begun, so it is larger
+		// than the header declared when the estimate is checked.
+		var once sync.Once
+		hook := &writeHook{onWrite: func() {
+			once.Do(func() { go slot.SetReady(bytes.Repeat([]byte("x"), 1000)) })
+		}}
+		_, err := lazy.IntoBytes(WithMaxArchiveSize(limit), WithWriteInstrumentation(hook))
+		var werr *WriteError
+		if !errors.As(err, &werr) {
+			t.Fatalf("IntoBytes error = %v, want *WriteError", err)
+		}
+		if werr.Size <= limit || werr.Limit != limit {
+			t.Errorf("WriteError size %d, limit %d", werr.Size, werr.Limit)
+		}
+		if len(werr.Largest) == 0 || werr.Largest[0].Specifier != "file:///lazy.js" {
+			t.Errorf("Largest = %+v, want lazy.js first", werr.Largest)
+		}
+	})
+}
+
+func TestScanImports(t *testing.T) {
+	source := `import a from "./a.js";
+import { b, "c-d" as cd, from } from './b.js'
+import * as ns from "https://deno.land/std/mod.ts";
+import type { T } from "./types.ts";
+import "./side-effect.js";
+export * from "./reexport.js";
+export * as re from "./reexport-ns.js";
+export { x as y } from "./named.js";
+export { local };
+export default function f() {}
+const lazy = await import("./lazy.js");
+const computed = import(name);
+const meta = import.meta.url;
+// import "./commented.js";
+/* export * from "./block-commented.js"; */
+const s = "import './in-string.js'";
+const tpl = ` + "`import \"./in-template.js\" ${ `nested ${\"}\"}` }`" + `;
+const re = /import "\.\/in-regex.js"/g;
+const ratio = total / 2 / "x".length;
+obj.import("./member.js");
+`
+	type ref struct {
+		specifier string
+		dynamic   bool
+	}
+	want := []ref{
+		{"./a.js", false},
+		{"./b.js", false},
+		{"https://deno.land/std/mod.ts", false},
+		{"./types.ts", false},
+		{"./side-effect.js", false},
+		{"./reexport.js", false},
+		{"./reexport-ns.js", false},
+		{"./named.js", false},
+		{"./lazy.js", true},
+	}
+
+	refs := ScanImports([]byte(source))
+	var got []ref
+	for _, r := range refs {
+		got = append(got, ref{r.Specifier, r.Dynamic})
+		if source[r.Start:r.End] != r.Specifier {
+			t.Errorf("offsets [%d:%d] of %q cover %q", r.Start, r.End, r.Specifier, source[r.Start:r.End])
+		}
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("ScanImports() =\n%v\nwant\n%v", got, want)
+	}
+
+	for _, src := range []string{"", "import", "import {", `import x from "unterminated`, "export {", "/", "`${"} {
+		ScanImports([]byte(src))
+	}
+}
+
+func TestSplit(t *testing.T) {
+	ctx := context.Background()
+	pkgID := &NpmPackageID{Name: "preact", Version: "10.0.0"}
+	archive := NewV2()
+	archive.SetChecksum(ChecksumXxh3)
+	archive.AddImportMap(ModuleKindJsonc, "file:///import_map.jsonc", []byte(`{"imports":{}}`))
+	archive.SetArchiveMetadata(map[string]string{"build": "42"})
+	for i := range 20 {
+		specifier := fmt.Sprintf("file:///mod%02d.js", i)
+		archive.AddModule(specifier, ModuleKindJavaScript, bytes.Repeat([]byte{'a' + byte(i)}, 100+10*i), []byte(`{"version":3}`))
+		if i%5 == 0 {
+			archive.AddRedirect(fmt.Sprintf("file:///alias%02d.js", i), specifier)
+		}
+	}
+	archive.AddRedirect("file:///dangling.js", "file:///missing.js")
+	archive.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: pkgID, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"preact": pkgID},
+	}
+	original, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+
+	const limit = 1024
+	shards, manifest, err := Split(ctx, archive, limit, SplitOptions{Name: "app"})
+	if err != nil {
+		t.Fatalf("Split failed: %v", err)
+	}
+	if len(shards) < 3 || len(shards) != len(manifest.Shards) {
+		t.Fatalf("got %d shards, manifest lists %d", len(shards), len(manifest.Shards))
+	}
+	files := make(map[string][]byte)
+	shardOf := make(map[string]int)
+	for n, shard := range shards {
+		data, err := shard.IntoBytes()
+		if err != nil {
+			t.Fatalf("shard %d: IntoBytes failed: %v", n, err)
+		}
+		info := manifest.Shards[n]
+		if int64(len(data)) > limit || int64(len(data)) != info.Size {
+			t.Errorf("shard %d is %d bytes, manifest says %d, limit %d", n, len(data), info.Size, limit)
+		}
+		if want := fmt.Sprintf("app-%d.eszip2", n); info.Name != want {
+			t.Errorf("shard %d name = %q, want %q", n, info.Name, want)
+		}
+		files[info.Name] = data
+		for _, specifier := range info.Specifiers {
+			shardOf[specifier] = n
+		}
+	}
+	if manifest.ImportMap != "file:///import_map.jsonc" || shardOf["file:///import_map.jsonc"] != 0 {
+		t.Errorf("import map %q is not in the first shard", manifest.ImportMap)
+	}
+	if shards[0].npmSnapshot == nil {
+		t.Error("first shard has no npm snapshot")
+	}
+	for i := 0; i < 20; i += 5 {
+		alias, target := fmt.Sprintf("file:///alias%02d.js", i), fmt.Sprintf("file:///mod%02d.js", i)
+		if shardOf[alias] != shardOf[target] {
+			t.Errorf("%s is in shard %d, its target in shard %d", alias, shardOf[alias], shardOf[target])
+		}
+	}
+
+	// The manifest's encoding is stable across a round trip.
+	encoded, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded ShardManifest
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := json.Marshal(&decoded); !bytes.Equal(again, encoded) {
+		t.Errorf("manifest round trip changed:\n%s\n%s", encoded, again)
+	}
+
+	open := func(name string) (io.ReaderAt, int64, error) {
+		data, ok := files[name]
+		if !ok {
+			return nil, 0, os.ErrNotExist
+		}
+		return bytes.NewReader(data), int64(len(data)), nil
+	}
+	opened, err := OpenSharded(ctx, &decoded, open)
+	if err != nil {
+		t.Fatalf("OpenSharded failed: %v", err)
+	}
+	parsed, err := ParseSync(ctx, bytes.NewReader(original))
+	if err != nil {
+		t.Fatalf("ParseSync failed: %v", err)
+	}
+	if equal, diff, err := Equal(ctx, parsed, opened, EqualOptions{}); err != nil || !equal {
+		t.Errorf("sharded archive differs from the original: %v, %v", diff, err)
+	}
+	if m := opened.GetModule("file:///alias10.js"); m == nil || m.Specifier != "file:///mod10.js" {
+		t.Errorf("redirect through the sharded archive = %v", m)
+	}
+
+	t.Run("oversized_module", func(t *testing.T) {
+		big := NewV2()
+		big.AddModule("file:///big.js", ModuleKindJavaScript, bytes.Repeat([]byte("b"), 2000), nil)
+		if _, _, err := Split(ctx, big, limit, SplitOptions{}); err == nil || !strings.Contains(err.Error(), "file:///big.js") {
+			t.Errorf("Split error = %v, want one naming file:///big.js", err)
+		}
+	})
+
+	t.Run("manifest_mismatch", func(t *testing.T) {
+		bad := decoded
+		bad.Shards = slices.Clone(decoded.Shards)
+		bad.Shards[1].Specifiers = bad.Shards[1].Specifiers[1:]
+		if _, err := OpenSharded(ctx, &bad, open); err == nil {
+			t.Error("OpenSharded accepted a shard that does not match the manifest")
+		}
+	})
+
+	t.Run("missing_shard", func(t *testing.T) {
+		bad := decoded
+		bad.Shards = append(slices.Clone(decoded.Shards), ShardInfo{Name: "app-99.eszip2"})
+		if _, err := OpenSharded(ctx, &bad, open); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("OpenSharded error = %v, want os.ErrNotExist", err)
+		}
+	})
+}
+
+func TestSlotWaitTimeout(t *testing.T) {
+	archive := NewV2()
+	archive.AddModule("file:///ready.js", ModuleKindJavaScript, []byte("ready"), nil)
+	archive.modules.Insert("file:///stuck.js", &ModuleData{
+		Kind:      ModuleKindJavaScript,
+		Source:    NewPendingSourceSlot(0, 10),
+		SourceMap: NewEmptySourceSlot(),
+	})
+	archive.modules.Insert("file:///stuck_map.js", &ModuleData{
+		Kind:      ModuleKindJavaScript,
+		Source:    NewReadySourceSlot([]byte("x")),
+		SourceMap: NewPendingSourceSlot(0, 10),
+	})
+
+	want := []string{"file:///stuck.js", "file:///stuck_map.js"}
+	if got := archive.PendingSources(); !slices.Equal(got, want) {
+		t.Errorf("PendingSources() = %v, want %v", got, want)
+	}
+
+	const timeout = 20 * time.Millisecond
+	_, err := archive.IntoBytes(WithSlotWaitTimeout(timeout))
+	var werr *WriteError
+	if !errors.As(err, &werr) {
+		t.Fatalf("IntoBytes error = %v, want *WriteError", err)
+	}
+	if werr.Pending != "file:///stuck.js" || werr.Waited < timeout {
+		t.Errorf("WriteError pending %q after %v", werr.Pending, werr.Waited)
+	}
+	if !strings.Contains(err.Error(), "file:///stuck.js") {
+		t.Errorf("error %q does not name the pending specifier", err)
+	}
+
+	done := NewV2()
+	done.AddModule("file:///ready.js", ModuleKindJavaScript, []byte("ready"), nil)
+	if got := done.PendingSources(); got != nil {
+		t.Errorf("PendingSources() = %v, want none", got)
+	}
+	if _, err := done.IntoBytes(WithSlotWaitTimeout(timeout)); err != nil {
+		t.Errorf("IntoBytes with nothing pending failed: %v", err)
+	}
+}
+
+func TestMediaTypeToModuleKind(t *testing.T) {
+	tests := []struct {
+		contentType string
+		kind        ModuleKind
+		ok          bool
+	}{
+		{"application/javascript", ModuleKindJavaScript, true},
+		{"text/javascript; charset=utf-8", ModuleKindJavaScript, true},
+		{"Application/TypeScript", ModuleKindJavaScript, true},
+		{"video/mp2t", ModuleKindJavaScript, true},
+		{"application/json;charset=UTF-8", ModuleKindJson, true},
+		{"application/wasm", ModuleKindWasm, true},
+		{"text/html; charset=utf-8", 0, false},
+		{"application/octet-stream", 0, false},
+		{"", 0, false},
+		{"not a media type;", 0, false},
+	}
+	for _, tt := range tests {
+		kind, ok := MediaTypeToModuleKind(tt.contentType)
+		if kind != tt.kind || ok != tt.ok {
+			t.Errorf("MediaTypeToModuleKind(%q) = %v, %v, want %v, %v", tt.contentType, kind, ok, tt.kind, tt.ok)
+		}
+	}
+
+	for name, want := range map[string]ModuleKind{"a/b.ts": ModuleKindJavaScript, "x.JSON": ModuleKindJson, "m.wasm": ModuleKindWasm, "deno.jsonc": ModuleKindJsonc, "c.cjs": ModuleKindJavaScript} {
+		if kind, ok := ExtensionToModuleKind(name); !ok || kind != want {
+			t.Errorf("ExtensionToModuleKind(%q) = %v, %v, want %v", name, kind, ok, want)
+		}
+	}
+	if kind, ok := DetectModuleKind("lib.js", []byte("\x00asm\x01\x00\x00\x00")); !ok || kind != ModuleKindWasm {
+		t.Errorf("DetectModuleKind of Wasm named lib.js = %v, %v", kind, ok)
+	}
+	if kind, ok := DetectModuleKind("data.json", []byte("{}")); !ok || kind != ModuleKindJson {
+		t.Errorf("DetectModuleKind(data.json) = %v, %v", kind, ok)
+	}
+	if _, ok := DetectModuleKind("README", []byte("hello")); ok {
+		t.Error("DetectModuleKind recognised an extensionless text file")
+	}
+	if _, ok := ExtensionToModuleKind("https://esm.sh/react"); ok {
+		t.Error("ExtensionToModuleKind recognised an extensionless URL")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	ctx := context.Background()
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	var specifiers []string
+	for i := range 5 {
+		specifier := fmt.Sprintf("file:///mod%d.js", i)
+		specifiers = append(specifiers, specifier)
+		archive.AddModule(specifier, ModuleKindJavaScript, bytes.Repeat([]byte{'a' + byte(i)}, 50), bytes.Repeat([]byte{'A' + byte(i)}, 20))
+	}
+	archive.AddRedirect("file:///first.js", "file:///mod0.js")
+	archive.AddRedirect("file:///last.js", "file:///mod4.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksumSize := archive.options.GetChecksumSize()
+	// end returns the offset just past the stored content and its hash.
+	end := func(content []byte) int {
+		i := bytes.Index(data, content)
+		if i < 0 {
+			t.Fatalf("content %q not found", content)
+		}
+		return i + len(content) + int(checksumSize)
+	}
+
+	cuts := []int{
+		end(bytes.Repeat([]byte("a"), 50)) - 1,  // inside the first source
+		end(bytes.Repeat([]byte("c"), 50)) + 2,  // inside the fourth source
+		end(bytes.Repeat([]byte("e"), 50)) + 2,  // inside the source maps length
+		end(bytes.Repeat([]byte("B"), 20)) + 10, // inside the third source map
+		len(data),
+	}
+	for _, cut := range cuts {
+		for _, sized := range []bool{false, true} {
+			t.Run(fmt.Sprintf("cut_%d_sized_%v", cut, sized), func(t *testing.T) {
+				var report RecoveryReport
+				opts := []ParseOption{WithRecovery(&report)}
+				if sized {
+					opts = append(opts, WithInputSize(int64(cut)))
+				}
+				parsed, err := ParseSync(ctx, bytes.NewReader(data[:cut]), opts...)
+				if err != nil {
+					t.Fatalf("ParseSync failed: %v", err)
+				}
+				if report.Truncated != (cut < len(data)) {
+					t.Errorf("Truncated = %v for a cut at %d of %d", report.Truncated, cut, len(data))
+				}
+
+				var wantSalvaged, wantLost []string
+				for i, specifier := range specifiers {
+					source := bytes.Repeat([]byte{'a' + byte(i)}, 50)
+					if end(source) <= cut {
+						wantSalvaged = append(wantSalvaged, specifier)
+					} else {
+						wantLost = append(wantLost, specifier)
+					}
+				}
+				var gotSalvaged, gotLost []string
+				for _, m := range report.Salvaged {
+					gotSalvaged = append(gotSalvaged, m.Specifier)
+					i := slices.Index(specifiers, m.Specifier)
+					mapLost := end(bytes.Repeat([]byte{'A' + byte(i)}, 20)) > cut
+					if m.SourceMapLost != mapLost {
+						t.Errorf("%s: SourceMapLost = %v, want %v", m.Specifier, m.SourceMapLost, mapLost)
+					}
+				}
+				for _, m := range report.Lost {
+					gotLost = append(gotLost, m.Specifier)
+				}
+				if !slices.Equal(gotSalvaged, wantSalvaged) || !slices.Equal(gotLost, wantLost) {
+					t.Errorf("salvaged %v, lost %v; want %v, %v", gotSalvaged, gotLost, wantSalvaged, wantLost)
+				}
+				for _, specifier := range wantLost {
+					_, err := parsed.GetModule(specifier).Source(ctx)
+					var pe *ParseError
+					if !errors.As(err, &pe) || pe.Type != ErrSourceNotLoaded {
+						t.Errorf("%s: Source error = %v, want ErrSourceNotLoaded", specifier, err)
+					}
+				}
+
+				v2, _ := parsed.V2()
+				salvaged, err := Salvage(ctx, v2)
+				if err != nil {
+					t.Fatalf("Salvage failed: %v", err)
+				}
+				out, err := salvaged.IntoBytes()
+				if err != nil {
+					t.Fatalf("IntoBytes failed: %v", err)
+				}
+				reparsed, err := ParseSync(ctx, bytes.NewReader(out))
+				if err != nil {
+					t.Fatalf("recovered archive does not parse: %v", err)
+				}
+				want := slices.Clone(wantSalvaged)
+				if slices.Contains(wantSalvaged, "file:///mod0.js") {
+					want = append(want, "file:///first.js")
+				}
+				if slices.Contains(wantSalvaged, "file:///mod4.js") {
+					want = append(want, "file:///last.js")
+				}
+				if got := reparsed.Specifiers(); !slices.Equal(got, want) {
+					t.Errorf("recovered specifiers = %v, want %v", got, want)
+				}
+			})
+		}
+	}
+
+	t.Run("header_truncated", func(t *testing.T) {
+		var report RecoveryReport
+		if _, err := ParseSync(ctx, bytes.NewReader(data[:20]), WithRecovery(&report)); err == nil {
+			t.Error("ParseSync recovered an archive with a truncated header")
+		}
+	})
+
+	t.Run("corrupt_source", func(t *testing.T) {
+		corrupt := slices.Clone(data)
+		corrupt[bytes.Index(corrupt, bytes.Repeat([]byte("b"), 50))] = 'x'
+		var report RecoveryReport
+		if _, err := ParseSync(ctx, bytes.NewReader(corrupt), WithRecovery(&report)); err == nil {
+			t.Error("ParseSync accepted a checksum mismatch while recovering")
+		}
+	})
+}
+
+// limitedWriter fails once more than n bytes have been written.
+type limitedWriter struct {
+	bytes.Buffer
+	n int
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	if w.Len()+len(p) > w.n {
+		k, _ := w.Buffer.Write(p[:w.n-w.Len()])
+		return k, io.ErrShortWrite
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestWriteTo(t *testing.T) {
+	var _ io.WriterTo = (*EszipV2)(nil)
+
+	pkgID := &NpmPackageID{Name: "preact", Version: "10.0.0"}
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	archive.AddImportMap(ModuleKindJsonc, "file:///import_map.jsonc", []byte(`{"imports":{}}`))
+	for i := range 10 {
+		archive.AddModule(fmt.Sprintf("file:///mod%d.js", i), ModuleKindJavaScript, bytes.Repeat([]byte{'a' + byte(i)}, 100*i), []byte(`{"version":3}`))
+	}
+	archive.AddRedirect("file:///alias.js", "file:///mod1.js")
+	archive.npmSnapshot = &NpmResolutionSnapshot{
+		Packages:     []*NpmPackage{{ID: pkgID, Dependencies: map[string]*NpmPackageID{}}},
+		RootPackages: map[string]*NpmPackageID{"preact": pkgID},
+	}
+	want, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	n, err := archive.WriteTo(&buf)
+	if err != nil || n != int64(len(want)) || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("WriteTo wrote %d bytes, %v; differs from IntoBytes: %v", n, err, !bytes.Equal(buf.Bytes(), want))
+	}
+	if _, err := ParseSync(context.Background(), bytes.NewReader(buf.Bytes())); err != nil {
+		t.Errorf("streamed archive does not parse: %v", err)
+	}
+
+	t.Run("writer_error", func(t *testing.T) {
+		w := &limitedWriter{n: len(want) / 2}
+		n, err := archive.WriteTo(w)
+		if !errors.Is(err, io.ErrShortWrite) || n != int64(len(want)/2) {
+			t.Errorf("WriteTo = %d, %v; want %d, io.ErrShortWrite", n, err, len(want)/2)
+		}
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := archive.WriteToContext(ctx, io.Discard); !errors.Is(err, context.Canceled) {
+			t.Errorf("WriteToContext error = %v, want context.Canceled", err)
+		}
+	})
+
+	t.Run("too_large", func(t *testing.T) {
+		var buf bytes.Buffer
+		_, err := archive.WriteToContext(context.Background(), &buf, WithMaxArchiveSize(int64(len(want))-1))
+		var werr *WriteError
+		if !errors.As(err, &werr) || buf.Len() != 0 {
+			t.Errorf("WriteToContext = %v after writing %d bytes, want *WriteError and nothing written", err, buf.Len())
+		}
+	})
+}
+
+// countingReaderAt counts the bytes read through it.
+type countingReaderAt struct {
+	r io.ReaderAt
+	n atomic.Int64
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.r.ReadAt(p, off)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+func TestParseV2Lazy(t *testing.T) {
+	ctx := context.Background()
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	for i := range 4 {
+		archive.AddModule(fmt.Sprintf("file:///mod%d.js", i), ModuleKindJavaScript, bytes.Repeat([]byte{'a' + byte(i)}, 64<<10), []byte(`{"version":3}`))
+	}
+	archive.AddRedirect("file:///alias.js", "file:///mod2.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &countingReaderAt{r: bytes.NewReader(data)}
+	lazy, err := ParseV2Lazy(ctx, r, WithInputSize(int64(len(data))))
+	if err != nil {
+		t.Fatalf("ParseV2Lazy failed: %v", err)
+	}
+	if read := r.n.Load(); read > int64(len(data))/4 {
+		t.Errorf("parsing the headers read %d of %d bytes", read, len(data))
+	}
+
+	module := lazy.GetModule("file:///alias.js")
+	before := r.n.Load()
+	for range 2 {
+		source, err := module.Source(ctx)
+		if err != nil || !bytes.Equal(source, bytes.Repeat([]byte("c"), 64<<10)) {
+			t.Fatalf("Source = %d bytes, %v", len(source), err)
+		}
+	}
+	if read := r.n.Load() - before; read != 2*(64<<10+32) {
+		t.Errorf("two Source calls read %d bytes, want each to read the content and hash", read)
+	}
+
+	eager, err := ParseSync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if equal, diff, err := Equal(ctx, eager, &EszipUnion{v2: lazy}, EqualOptions{}); err != nil || !equal {
+		t.Errorf("lazy archive differs: %v, %v", diff, err)
+	}
+	var buf bytes.Buffer
+	if _, err := lazy.WriteTo(&buf); err != nil || !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("WriteTo of the lazy archive differs from the input: %v", err)
+	}
+
+	taken, err := lazy.GetModule("file:///mod0.js").TakeSource(ctx)
+	if err != nil || len(taken) != 64<<10 {
+		t.Errorf("TakeSource = %d bytes, %v", len(taken), err)
+	}
+	if source, err := lazy.GetModule("file:///mod0.js").Source(ctx); err != nil || source != nil {
+		t.Errorf("Source after TakeSource = %d bytes, %v", len(source), err)
+	}
+
+	t.Run("corrupt_source", func(t *testing.T) {
+		corrupt := slices.Clone(data)
+		corrupt[bytes.Index(corrupt, []byte("bbbb"))] = 'x'
+		lazy, err := ParseV2Lazy(ctx, bytes.NewReader(corrupt))
+		if err != nil {
+			t.Fatalf("ParseV2Lazy failed: %v", err)
+		}
+		_, err = lazy.GetModule("file:///mod1.js").Source(ctx)
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceHash {
+			t.Errorf("Source error = %v, want ErrInvalidV2SourceHash", err)
+		}
+		if _, err := lazy.GetModule("file:///mod0.js").Source(ctx); err != nil {
+			t.Errorf("intact module: %v", err)
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		short := data[:len(data)-100]
+		if _, err := ParseV2Lazy(ctx, bytes.NewReader(short), WithInputSize(int64(len(short)))); err == nil {
+			t.Error("ParseV2Lazy accepted a truncated archive")
+		}
+		lazy, err := ParseV2Lazy(ctx, bytes.NewReader(short))
+		if err != nil {
+			t.Fatalf("ParseV2Lazy without a size failed: %v", err)
+		}
+		if _, err := lazy.GetModule("file:///mod3.js").SourceMap(ctx); err == nil {
+			t.Error("reading a source map past the end succeeded")
+		}
+	})
+}
+
+func TestAddModuleChecked(t *testing.T) {
+	tests := []struct {
+		name      string
+		kind      ModuleKind
+		source    string
+		sourceMap string
+		valid     bool
+	}{
+		{"javascript", ModuleKindJavaScript, "export default 1;", `{"version":3}`, true},
+		{"javascript_latin1", ModuleKindJavaScript, "const s = '\xe9';", "", false},
+		{"json", ModuleKindJson, `{"a": [1, 2]}`, "", true},
+		{"json_trailing_comma", ModuleKindJson, `{"a": 1,}`, "", false},
+		{"jsonc", ModuleKindJsonc, "{\n  // comment\n  \"a\": \"//not a comment\", /* block */\n  \"b\": [1, 2,],\n}", "", true},
+		{"jsonc_unterminated_comment", ModuleKindJsonc, `{"a": 1 /* oops`, "", false},
+		{"jsonc_garbage", ModuleKindJsonc, `{a: 1}`, "", false},
+		{"wasm", ModuleKindWasm, "\x00asm\x01\x00\x00\x00", "", true},
+		{"wasm_html", ModuleKindWasm, "<html>", "", false},
+		{"opaque", ModuleKindOpaqueData, "\xff\xfe", "", true},
+		{"unknown_kind", ModuleKind(9), "", "", false},
+		{"bad_source_map", ModuleKindJavaScript, "1;", "{", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			archive := NewV2()
+			err := archive.AddModuleChecked("file:///m", tt.kind, []byte(tt.source), []byte(tt.sourceMap))
+			if tt.valid {
+				if err != nil {
+					t.Fatalf("AddModuleChecked failed: %v", err)
+				}
+				if archive.GetModule("file:///m") == nil && archive.GetImportMap("file:///m") == nil {
+					t.Error("valid module was not added")
+				}
+				return
+			}
+			var merr *ModuleContentError
+			if !errors.As(err, &merr) || merr.Specifier != "file:///m" || merr.SourceMap != (tt.sourceMap != "") {
+				t.Fatalf("AddModuleChecked error = %v, want *ModuleContentError", err)
+			}
+			if len(archive.Specifiers()) != 0 {
+				t.Error("invalid module was added")
+			}
+		})
+	}
+}
+
+func TestMutateModules(t *testing.T) {
+	ctx := context.Background()
+
+	archive := NewV2()
+	archive.AddImportMap(ModuleKindJson, "file:///import_map.json", []byte(`{}`))
+	archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), []byte("map-a"))
+	archive.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b"), nil)
+	archive.AddRedirect("file:///alias.js", "file:///a.js")
+
+	if err := archive.ReplaceModuleSource("file:///a.js", []byte("A"), nil); err != nil {
+		t.Fatalf("ReplaceModuleSource failed: %v", err)
+	}
+	if err := archive.ReplaceModuleSource("file:///alias.js", []byte("x"), nil); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("ReplaceModuleSource of a redirect error = %v, want ErrSpecifierNotFound", err)
+	}
+
+	if err := archive.RenameSpecifier("file:///a.js", "file:///renamed.js"); err != nil {
+		t.Fatalf("RenameSpecifier failed: %v", err)
+	}
+	if err := archive.RenameSpecifier("file:///a.js", "file:///c.js"); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("RenameSpecifier of a missing specifier error = %v, want ErrSpecifierNotFound", err)
+	}
+	if err := archive.RenameSpecifier("file:///b.js", "file:///renamed.js"); !errors.Is(err, ErrSpecifierExists) {
+		t.Errorf("RenameSpecifier onto an existing specifier error = %v, want ErrSpecifierExists", err)
+	}
+	if err := archive.RenameSpecifier("file:///import_map.json", "file:///deno.json"); err != nil {
+		t.Fatalf("RenameSpecifier of the import map failed: %v", err)
+	}
+
+	if !archive.RemoveModule("file:///b.js") || archive.RemoveModule("file:///b.js") {
+		t.Error("RemoveModule should report true once, then false")
+	}
+
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	want := []string{"file:///deno.json", "file:///renamed.js", "file:///alias.js"}
+	if got := parsed.Specifiers(); !slices.Equal(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	if got := archive.Summary().ImportMap; got != "file:///deno.json" {
+		t.Errorf("import map = %q, want file:///deno.json", got)
+	}
+	module := parsed.GetModule("file:///alias.js")
+	if module == nil || module.Specifier != "file:///renamed.js" {
+		t.Fatalf("alias resolves to %v, want file:///renamed.js", module)
+	}
+	if source, _ := module.Source(ctx); string(source) != "A" {
+		t.Errorf("source = %q, want %q", source, "A")
+	}
+	if sourceMap, _ := module.SourceMap(ctx); len(sourceMap) != 0 {
+		t.Errorf("source map = %q, want none", sourceMap)
+	}
+}
+
+func TestMerge(t *testing.T) {
+	ctx := context.Background()
+	lodash := &NpmPackageID{Name: "lodash", Version: "4.17.21"}
+	react := &NpmPackageID{Name: "react", Version: "18.2.0"}
+
+	build := func() (*EszipV2, *EszipV2) {
+		dst := NewV2()
+		dst.AddModule("file:///main.js", ModuleKindJavaScript, []byte("main"), nil)
+		dst.AddModule("file:///shared.js", ModuleKindJavaScript, []byte("shared"), nil)
+		dst.AddModule("file:///config.js", ModuleKindJavaScript, []byte("dst"), nil)
+		dst.npmSnapshot = &NpmResolutionSnapshot{
+			Packages:     []*NpmPackage{{ID: lodash, Dependencies: map[string]*NpmPackageID{}}},
+			RootPackages: map[string]*NpmPackageID{"lodash": lodash},
+		}
+
+		src := NewV2()
+		src.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte("{}"))
+		src.AddModule("file:///shared.js", ModuleKindJavaScript, []byte("shared"), nil)
+		src.AddModule("file:///config.js", ModuleKindJavaScript, []byte("src"), nil)
+		src.AddModule("file:///worker.js", ModuleKindJavaScript, []byte("worker"), nil)
+		src.AddRedirect("file:///w.js", "file:///worker.js")
+		src.npmSnapshot = &NpmResolutionSnapshot{
+			Packages:     []*NpmPackage{{ID: react, Dependencies: map[string]*NpmPackageID{}}},
+			RootPackages: map[string]*NpmPackageID{"react": react},
+		}
+		return dst, src
+	}
+	source := func(e *EszipV2, specifier string) string {
+		module := e.GetImportMap(specifier)
+		if module == nil {
+			return ""
+		}
+		content, _ := module.Source(ctx)
+		return string(content)
+	}
+
+	t.Run("error", func(t *testing.T) {
+		dst, src := build()
+		before := dst.Specifiers()
+		if err := Merge(dst, src, MergeOptions{}); !errors.Is(err, ErrMergeConflict) || !strings.Contains(err.Error(), "file:///config.js") {
+			t.Fatalf("Merge error = %v, want ErrMergeConflict for config.js", err)
+		}
+		if got := dst.Specifiers(); !slices.Equal(got, before) || len(dst.npmSnapshot.Packages) != 1 {
+			t.Errorf("dst changed by a failed merge: %v", got)
+		}
+	})
+
+	for _, tt := range []struct {
+		policy ConflictPolicy
+		config string
+	}{{ConflictKeepFirst, "dst"}, {ConflictKeepLast, "src"}} {
+		t.Run(tt.policy.String(), func(t *testing.T) {
+			dst, src := build()
+			if err := Merge(dst, src, MergeOptions{OnConflict: tt.policy}); err != nil {
+				t.Fatalf("Merge failed: %v", err)
+			}
+			want := []string{"file:///import_map.json", "file:///main.js", "file:///shared.js", "file:///config.js", "file:///worker.js", "file:///w.js"}
+			if got := dst.Specifiers(); !slices.Equal(got, want) {
+				t.Errorf("specifiers = %v, want %v", got, want)
+			}
+			if got := source(dst, "file:///config.js"); got != tt.config {
+				t.Errorf("config.js = %q, want %q", got, tt.config)
+			}
+			if got := dst.Summary(); got.ImportMap != "file:///import_map.json" || got.NpmPackages != 2 || got.NpmSpecifiers != 2 {
+				t.Errorf("summary = %+v", got)
+			}
+			if got := source(src, "file:///worker.js"); got != "worker" || len(src.Specifiers()) != 5 {
+				t.Error("src changed by Merge")
+			}
+		})
+	}
+
+	t.Run("npm_conflict", func(t *testing.T) {
+		dst, src := build()
+		src.npmSnapshot.RootPackages["lodash"] = &NpmPackageID{Name: "lodash", Version: "4.17.20"}
+		err := Merge(dst, src, MergeOptions{OnConflict: ConflictFail})
+		if !errors.Is(err, ErrMergeConflict) {
+			t.Fatalf("Merge error = %v, want ErrMergeConflict", err)
+		}
+		if err := Merge(dst, src, MergeOptions{OnConflict: ConflictKeepLast}); err != nil {
+			t.Fatalf("Merge failed: %v", err)
+		}
+		if got := dst.npmSnapshot.RootPackages["lodash"].Version; got != "4.17.20" {
+			t.Errorf("lodash resolves to %s, want 4.17.20", got)
+		}
+	})
+}
+
+func TestCompression(t *testing.T) {
+	ctx := context.Background()
+	source := bytes.Repeat([]byte("export const value = 'compressible';\n"), 200)
+	sourceMap := bytes.Repeat([]byte(`{"mappings":"AAAA"}`), 50)
+
+	build := func(compression CompressionType) *EszipV2 {
+		e := NewV2()
+		e.SetChecksum(ChecksumSha256)
+		e.SetCompression(compression)
+		e.AddModule("file:///main.js", ModuleKindJavaScript, source, sourceMap)
+		e.AddModule("file:///empty.js", ModuleKindJavaScript, nil, nil)
+		return e
+	}
+	plain, err := build(CompressionNone).IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	data, err := build(CompressionGzip).IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if len(data)*4 > len(plain) {
+		t.Errorf("compressed archive is %d bytes, uncompressed %d", len(data), len(plain))
+	}
+	again, _ := build(CompressionGzip).IntoBytes()
+	if !bytes.Equal(data, again) {
+		t.Error("compressed output is not deterministic")
+	}
+
+	check := func(name string, e *EszipV2) {
+		t.Helper()
+		module := e.GetModule("file:///main.js")
+		if got, err := module.Source(ctx); err != nil || !bytes.Equal(got, source) {
+			t.Errorf("%s: source = %d bytes, %v", name, len(got), err)
+		}
+		if got, err := module.SourceMap(ctx); err != nil || !bytes.Equal(got, sourceMap) {
+			t.Errorf("%s: source map = %d bytes, %v", name, len(got), err)
+		}
+		if got, err := e.GetModule("file:///empty.js").Source(ctx); err != nil || len(got) != 0 {
+			t.Errorf("%s: empty source = %q, %v", name, got, err)
+		}
+	}
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	check("parsed", parsed)
+	if got := parsed.Summary().Compression; got != "gzip" {
+		t.Errorf("summary compression = %q, want gzip", got)
+	}
+	lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithInputSize(int64(len(data))))
+	if err != nil {
+		t.Fatalf("ParseV2Lazy failed: %v", err)
+	}
+	check("lazy", lazy)
+
+	// Rewriting keeps the compression.
+	rewritten, err := parsed.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to re-serialize: %v", err)
+	}
+	if !bytes.Equal(rewritten, data) {
+		t.Error("re-serialized archive differs")
+	}
+
+	// Replaced content is compressed by PatchArchive too.
+	var patched bytes.Buffer
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///empty.js", Source: source}}
+	if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+	patchedArchive, err := ParseV2Sync(ctx, bytes.NewReader(patched.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse patched archive: %v", err)
+	}
+	if got, _ := patchedArchive.GetModule("file:///empty.js").Source(ctx); !bytes.Equal(got, source) {
+		t.Errorf("patched source = %d bytes, want %d", len(got), len(source))
+	}
+
+	t.Run("zstd", func(t *testing.T) {
+		data, err := build(CompressionZstd).IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		if len(data)*4 > len(plain) {
+			t.Errorf("compressed archive is %d bytes, uncompressed %d", len(data), len(plain))
+		}
+		parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		check("zstd parsed", parsed)
+		if got := parsed.Summary().Compression; got != "zstd" {
+			t.Errorf("summary compression = %q, want zstd", got)
+		}
+		lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithInputSize(int64(len(data))))
+		if err != nil {
+			t.Fatalf("ParseV2Lazy failed: %v", err)
+		}
+		check("zstd lazy", lazy)
+		if rewritten, err := parsed.IntoBytes(); err != nil || !bytes.Equal(rewritten, data) {
+			t.Errorf("re-serialized archive differs, %v", err)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		e := build(CompressionGzip)
+		e.SetChecksum(ChecksumNone)
+		corrupt, err := e.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		// The gzip trailer ends the first source; without a checksum only
+		// decompression notices the damage.
+		compressed, _ := CompressionGzip.compress(source)
+		i := bytes.Index(corrupt, compressed)
+		corrupt[i+len(compressed)-1] ^= 0xff
+		_, err = ParseV2Sync(ctx, bytes.NewReader(corrupt))
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceCompression {
+			t.Errorf("error = %v, want ErrInvalidV2SourceCompression", err)
+		}
+	})
+
+	t.Run("bomb", func(t *testing.T) {
+		for _, compression := range []CompressionType{CompressionGzip, CompressionZstd} {
+			t.Run(compression.String(), func(t *testing.T) {
+				// A megabyte of zeros compresses to about a kilobyte,
+				// well within the section limit, but must not be
+				// inflated past it.
+				e := NewV2()
+				e.SetCompression(compression)
+				e.AddModule("file:///bomb.js", ModuleKindJavaScript, make([]byte, 1<<20), nil)
+				bomb, err := e.IntoBytes()
+				if err != nil {
+					t.Fatalf("failed to serialize: %v", err)
+				}
+				if len(bomb) > 8<<10 {
+					t.Fatalf("bomb archive is %d bytes", len(bomb))
+				}
+				opts := WithParseOptions(ParseOptions{MaxSectionSize: 64 << 10})
+				check := func(name string, err error) {
+					t.Helper()
+					var pe *ParseError
+					if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceCompression || !strings.Contains(err.Error(), "exceeds 65536 bytes") {
+						t.Errorf("%s: error = %v, want ErrInvalidV2SourceCompression", name, err)
+					}
+				}
+				_, err = ParseV2Sync(ctx, bytes.NewReader(bomb), opts)
+				check("eager", err)
+				lazy, err := ParseV2Lazy(ctx, bytes.NewReader(bomb), WithInputSize(int64(len(bomb))), opts)
+				if err != nil {
+					t.Fatalf("ParseV2Lazy failed: %v", err)
+				}
+				_, err = lazy.GetModule("file:///bomb.js").Source(ctx)
+				check("lazy", err)
+
+				// Without MaxSectionSize the default limit still lets it load.
+				parsed, err := ParseV2Sync(ctx, bytes.NewReader(bomb))
+				if err != nil {
+					t.Fatalf("failed to parse: %v", err)
+				}
+				if got, _ := parsed.GetModule("file:///bomb.js").Source(ctx); len(got) != 1<<20 {
+					t.Errorf("source = %d bytes, want %d", len(got), 1<<20)
+				}
+			})
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		// Without a checksum the options header can be edited in place.
+		e := NewV2()
+		e.SetCompression(CompressionGzip)
+		e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+		unknown, err := e.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		// The compression option follows the checksum options.
+		i := bytes.Index(unknown, []byte{0, byte(ChecksumNone), 1, 0, optionCompression, byte(CompressionGzip)})
+		unknown[i+5] = 9
+		_, err = ParseV2Sync(ctx, bytes.NewReader(unknown))
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Type != ErrInvalidV22OptionsHeader {
+			t.Errorf("error = %v, want ErrInvalidV22OptionsHeader", err)
+		}
+	})
+}
+
+func TestNpmSnapshotFromLockfile(t *testing.T) {
+	ctx := context.Background()
+	ids := func(m map[string]*NpmPackageID) map[string]string {
+		out := make(map[string]string, len(m))
+		for k, id := range m {
+			out[k] = id.String()
+		}
+		return out
+	}
+	deps := func(s *NpmResolutionSnapshot) map[string]map[string]string {
+		out := make(map[string]map[string]string)
+		for _, pkg := range s.Packages {
+			out[pkg.ID.String()] = ids(pkg.Dependencies)
+		}
+		return out
+	}
+
+	t.Run("package-lock", func(t *testing.T) {
+		lock := []byte(`{
+  "name": "app",
+  "lockfileVersion": 3,
+  "packages": {
+    "": {"name": "app", "dependencies": {"a": "^1.0.0", "b": "^2.0.0"}, "optionalDependencies": {"fsevents": "^2"}, "devDependencies": {"jest": "^29"}},
+    "node_modules/a": {"version": "1.0.0", "dependencies": {"b": "^1.0.0", "c": "^1.0.0"}},
+    "node_modules/a/node_modules/b": {"version": "1.5.0"},
+    "node_modules/b": {"version": "2.0.0", "dependencies": {"c": "^1.0.0"}, "peerDependencies": {"react": "*"}},
+    "node_modules/c": {"name": "@scope/real-c", "version": "1.2.3"},
+    "node_modules/jest": {"version": "29.0.0", "dev": true},
+    "packages/local": {"version": "0.0.0"},
+    "node_modules/local": {"resolved": "packages/local", "link": true}
+  }
+}`)
+		snapshot, err := NpmSnapshotFromLockfile(lock, LockfilePackageLock)
+		if err != nil {
+			t.Fatalf("NpmSnapshotFromLockfile failed: %v", err)
+		}
+		wantRoots := map[string]string{"a@^1.0.0": "a@1.0.0", "b@^2.0.0": "b@2.0.0"}
+		if got := ids(snapshot.RootPackages); !maps.Equal(got, wantRoots) {
+			t.Errorf("roots = %v, want %v", got, wantRoots)
+		}
+		got := deps(snapshot)
+		want := map[string]map[string]string{
+			"a@1.0.0":             {"b": "b@1.5.0", "c": "@scope/real-c@1.2.3"},
+			"b@1.5.0":             {},
+			"b@2.0.0":             {"c": "@scope/real-c@1.2.3"},
+			"@scope/real-c@1.2.3": {},
+		}
+		if !maps.EqualFunc(got, want, maps.Equal) {
+			t.Errorf("packages = %v, want %v", got, want)
+		}
+
+		// The snapshot survives a round trip through an archive.
+		e := NewV2()
+		e.SetNpmSnapshot(snapshot)
+		data, err := e.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		if diff := npmSnapshotDifferences(snapshot, parsed.TakeNpmSnapshot()); diff != nil {
+			t.Errorf("parsed snapshot differs: %v", diff)
+		}
+
+		missing := []byte(`{"lockfileVersion": 3, "packages": {"": {"dependencies": {"gone": "1"}}}}`)
+		if _, err := NpmSnapshotFromLockfile(missing, LockfilePackageLock); err == nil || !strings.Contains(err.Error(), "gone") {
+			t.Errorf("missing dependency error = %v", err)
+		}
+		if _, err := NpmSnapshotFromLockfile([]byte(`{"lockfileVersion": 1, "dependencies": {}}`), LockfilePackageLock); err == nil {
+			t.Error("expected lockfileVersion 1 to be rejected")
+		}
+	})
+
+	denoLocks := map[string]string{
+		"v3": `{
+  "version": "3",
+  "packages": {
+    "specifiers": {"npm:chalk@5": "npm:chalk@5.3.0", "npm:@types/node": "npm:@types/node@20.0.0", "jsr:@std/path@1": "jsr:@std/path@1.0.0"},
+    "npm": {
+      "chalk@5.3.0": {"integrity": "x", "dependencies": {"ansi-styles": "ansi-styles@6.2.1"}},
+      "ansi-styles@6.2.1": {"integrity": "x", "dependencies": {}},
+      "@types/node@20.0.0": {"integrity": "x", "dependencies": {}}
+    }
+  }
+}`,
+		"v4": `{
+  "version": "4",
+  "specifiers": {"npm:chalk@5": "5.3.0", "npm:@types/node": "20.0.0", "jsr:@std/path@1": "1.0.0"},
+  "jsr": {"@std/path@1.0.0": {"integrity": "x"}},
+  "npm": {
+    "chalk@5.3.0": {"integrity": "x", "dependencies": ["ansi-styles"]},
+    "ansi-styles@6.2.1": {"integrity": "x"},
+    "@types/node@20.0.0": {"integrity": "x"}
+  }
+}`,
+	}
+	for name, lock := range denoLocks {
+		t.Run("deno-"+name, func(t *testing.T) {
+			snapshot, err := NpmSnapshotFromLockfile([]byte(lock), LockfileDeno)
+			if err != nil {
+				t.Fatalf("NpmSnapshotFromLockfile failed: %v", err)
+			}
+			wantRoots := map[string]string{"chalk@5": "chalk@5.3.0", "@types/node": "@types/node@20.0.0"}
+			if got := ids(snapshot.RootPackages); !maps.Equal(got, wantRoots) {
+				t.Errorf("roots = %v, want %v", got, wantRoots)
+			}
+			want := map[string]map[string]string{
+				"chalk@5.3.0":        {"ansi-styles": "ansi-styles@6.2.1"},
+				"ansi-styles@6.2.1":  {},
+				"@types/node@20.0.0": {},
+			}
+			if got := deps(snapshot); !maps.EqualFunc(got, want, maps.Equal) {
+				t.Errorf("packages = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte("export const a = 1;"), []byte(`{"version":3}`))
+	archive.AddModule("file:///b.js", ModuleKindJavaScript, []byte("export const b = 2;"), nil)
+	archive.AddRedirect("file:///alias.js", "file:///a.js")
+	archive.AddRedirect("file:///dangling.js", "file:///gone.js")
+	archive.AddRedirect("file:///loop1.js", "file:///loop2.js")
+	archive.AddRedirect("file:///loop2.js", "file:///loop1.js")
+	archive.AddRedirect("file:///into-loop.js", "file:///loop2.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	kinds := func(report *VerifyReport) []string {
+		var got []string
+		for _, p := range report.Problems {
+			got = append(got, p.Kind.String()+" "+p.Specifier)
+		}
+		return got
+	}
+	redirectProblems := []string{"redirect_target file:///dangling.js", "redirect_cycle file:///loop1.js"}
+
+	t.Run("archive", func(t *testing.T) {
+		report, err := VerifyArchive(ctx, bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if got := kinds(report); !slices.Equal(got, redirectProblems) {
+			t.Errorf("problems = %v, want %v", got, redirectProblems)
+		}
+		if report.Modules != 2 || report.Redirects != 5 {
+			t.Errorf("counted %d modules and %d redirects, want 2 and 5", report.Modules, report.Redirects)
+		}
+		if want := int64(len("export const a = 1;") + len(`{"version":3}`) + len("export const b = 2;")); report.Bytes != want {
+			t.Errorf("bytes = %d, want %d", report.Bytes, want)
+		}
+		if got := report.Problems[1].Detail; got != "file:///loop1.js -> file:///loop2.js -> file:///loop1.js" {
+			t.Errorf("cycle detail = %q", got)
+		}
+	})
+
+	t.Run("corrupt_source", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		corrupt[bytes.Index(corrupt, []byte("const b"))] ^= 0xff
+		report, err := VerifyArchive(ctx, bytes.NewReader(corrupt), int64(len(corrupt)))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		want := append([]string{"checksum file:///b.js"}, redirectProblems...)
+		if got := kinds(report); !slices.Equal(got, want) {
+			t.Errorf("problems = %v, want %v", got, want)
+		}
+	})
+
+	t.Run("corrupt_header", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		corrupt[bytes.Index(corrupt, []byte("file:///b.js"))] ^= 0xff
+		report, err := VerifyArchive(ctx, bytes.NewReader(corrupt), int64(len(corrupt)))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if got := kinds(report); !slices.Equal(got, []string{"header "}) {
+			t.Errorf("problems = %v, want a header problem", got)
+		}
+	})
+
+	t.Run("origins", func(t *testing.T) {
+		remote := NewV2()
+		remote.AddModule("https://deno.land/std/mod.ts", ModuleKindJavaScript, []byte("export {};"), nil)
+		remote.AddModule("https://evil.example/x.js", ModuleKindJavaScript, []byte("export {};"), nil)
+		remoteData, err := remote.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		report, err := VerifyArchive(ctx, bytes.NewReader(remoteData), int64(len(remoteData)), WithAllowedOrigins("deno.land"))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if got := kinds(report); !slices.Equal(got, []string{"origin https://evil.example/x.js"}) {
+			t.Errorf("problems = %v, want the disallowed origin", got)
+		}
+		// The content is still checked.
+		if report.Modules != 2 || report.Bytes != int64(2*len("export {};")) {
+			t.Errorf("checked %d modules and %d bytes", report.Modules, report.Bytes)
+		}
+	})
+
+	t.Run("npm_redirect", func(t *testing.T) {
+		npm := NewV2()
+		foo := &NpmPackageID{Name: "foo", Version: "1.0.0"}
+		npm.SetNpmSnapshot(&NpmResolutionSnapshot{
+			Packages:     []*NpmPackage{{ID: foo, Dependencies: map[string]*NpmPackageID{}}},
+			RootPackages: map[string]*NpmPackageID{"foo@1": foo},
+		})
+		npm.AddRedirect("file:///r.js", "foo@1")
+		npm.AddRedirect("file:///alias.js", "file:///r.js")
+		npmData, err := npm.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		report, err := VerifyArchive(ctx, bytes.NewReader(npmData), int64(len(npmData)))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if !report.OK() {
+			t.Errorf("problems = %v, want none", kinds(report))
+		}
+		parsed, err := ParseV2Sync(ctx, bytes.NewReader(npmData))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		report, err = parsed.Verify(ctx)
+		if err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		if !report.OK() {
+			t.Errorf("Verify problems = %v, want none", kinds(report))
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		report, err := VerifyArchive(ctx, bytes.NewReader(data), int64(len(data)-10))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if report.OK() || report.Problems[0].Kind != ProblemHeader {
+			t.Errorf("problems = %v, want a header problem", kinds(report))
+		}
+	})
+
+	t.Run("in_memory", func(t *testing.T) {
+		parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		report, err := parsed.Verify(ctx)
+		if err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		if got := kinds(report); !slices.Equal(got, redirectProblems) {
+			t.Errorf("problems = %v, want %v", got, redirectProblems)
+		}
+	})
+
+	t.Run("overlap", func(t *testing.T) {
+		slot := func(offset, length uint32) *SourceSlot {
+			s := NewReadySourceSlot(make([]byte, length))
+			s.offset, s.length = offset, length
+			return s
+		}
+		e := NewV2()
+		e.modules.Insert("file:///a.js", &ModuleData{Source: slot(0, 10), SourceMap: NewEmptySourceSlot()})
+		e.modules.Insert("file:///shared.js", &ModuleData{Source: slot(0, 10), SourceMap: NewEmptySourceSlot()})
+		e.modules.Insert("file:///b.js", &ModuleData{Source: slot(5, 10), SourceMap: NewEmptySourceSlot()})
+		e.modules.Insert("file:///c.js", &ModuleData{Source: slot(15, 10), SourceMap: NewEmptySourceSlot()})
+		report, err := e.Verify(ctx)
+		if err != nil {
+			t.Fatalf("Verify failed: %v", err)
+		}
+		if got, want := kinds(report), []string{"offset_overlap file:///b.js"}; !slices.Equal(got, want) {
+			t.Errorf("problems = %v, want %v", got, want)
+		}
+	})
+}
+
+func TestConcurrentVerification(t *testing.T) {
+	ctx := context.Background()
+
+	archive := NewV2()
+	archive.SetChecksum(ChecksumSha256)
+	for i := range 50 {
+		archive.AddModule(fmt.Sprintf("file:///m%d.js", i), ModuleKindJavaScript,
+			[]byte(fmt.Sprintf("export const m = %d;", i)), []byte(fmt.Sprintf(`{"version":3,"file":"m%d.js"}`, i)))
+	}
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	var counters Counters
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(data), WithConcurrency(4), WithInstrumentation(&counters))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	for i := range 50 {
+		module := parsed.GetModule(fmt.Sprintf("file:///m%d.js", i))
+		source, _ := module.Source(ctx)
+		sourceMap, _ := module.SourceMap(ctx)
+		if string(source) != fmt.Sprintf("export const m = %d;", i) || !strings.Contains(string(sourceMap), fmt.Sprintf("m%d.js", i)) {
+			t.Fatalf("module %d: source %q, source map %q", i, source, sourceMap)
+		}
+	}
+	if got := counters.SourcesLoaded.Load(); got != 100 {
+		t.Errorf("sources loaded = %d, want 100", got)
+	}
+
+	corrupt := bytes.Clone(data)
+	corrupt[bytes.Index(corrupt, []byte("m = 7;"))] ^= 0xff
+	_, err = ParseV2Sync(ctx, bytes.NewReader(corrupt), WithConcurrency(4))
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceHash || !strings.Contains(pe.Message, "file:///m7.js") {
+		t.Errorf("parse of corrupt archive error = %v, want a source hash error for m7.js", err)
+	}
+
+	// Aborting after a few steps leaves what was read usable.
+	union, completion, err := ParseIncremental(ctx, bytes.NewReader(data), WithConcurrency(4))
+	if err != nil {
+		t.Fatalf("ParseIncremental failed: %v", err)
+	}
+	for range 3 {
+		if _, _, err := completion.Next(ctx); err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+	}
+	completion.Abort()
+	if source, err := union.GetModule("file:///m2.js").Source(ctx); err != nil || string(source) != "export const m = 2;" {
+		t.Errorf("m2.js after abort = %q, %v", source, err)
+	}
+	if _, err := union.GetModule("file:///m3.js").Source(ctx); !errors.As(err, &pe) || pe.Type != ErrSourceNotLoaded {
+		t.Errorf("m3.js after abort error = %v, want ErrSourceNotLoaded", err)
+	}
+}
+
+func TestConvert(t *testing.T) {
+	ctx := context.Background()
+
+	data, err := os.ReadFile("testdata/basic.json")
+	if err != nil {
+		t.Fatalf("failed to read test file: %v", err)
+	}
+	v1, err := ParseV1(data)
+	if err != nil {
+		t.Fatalf("failed to parse eszip: %v", err)
+	}
+	v2, err := ConvertV1ToV2(v1)
+	if err != nil {
+		t.Fatalf("ConvertV1ToV2 failed: %v", err)
+	}
+	encoded, err := v2.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseV2Sync(ctx, bytes.NewReader(encoded))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if !slices.Equal(parsed.Specifiers(), v1.Specifiers()) {
+		t.Errorf("specifiers = %v, want %v", parsed.Specifiers(), v1.Specifiers())
+	}
+	for _, spec := range v1.Specifiers() {
+		want, _ := v1.GetModule(spec).Source(ctx)
+		got, _ := parsed.GetModule(spec).Source(ctx)
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s: source = %q, want %q", spec, got, want)
+		}
+	}
+
+	// Dependencies that are a module's imports survive V1 to V2 and back.
+	deps := NewV1()
+	deps.AddModule("file:///src/main.js", []byte(`import { a } from "./a.js"; import "node:fs"; import("../b.js"); export * from "./a.js";`), []string{"file:///src/a.js", "file:///b.js"})
+	deps.AddModule("file:///src/a.js", []byte("export const a = 1;"), nil)
+	deps.AddModule("file:///b.js", []byte("export {};"), nil)
+	roundtrip, err := ConvertV1ToV2(deps)
+	if err != nil {
+		t.Fatalf("ConvertV1ToV2 failed: %v", err)
+	}
+	if got := roundtrip.GetModule("file:///src/main.js").Dependencies(); got != nil {
+		t.Errorf("V2 module dependencies = %v, want none", got)
+	}
+	returned, err := ConvertV2ToV1(ctx, roundtrip)
+	if err != nil {
+		t.Fatalf("ConvertV2ToV1 failed: %v", err)
+	}
+	for _, spec := range []string{"file:///src/main.js", "file:///src/a.js"} {
+		if got, want := returned.GetModule(spec).Dependencies(), deps.GetModule(spec).Dependencies(); !slices.Equal(got, want) {
+			t.Errorf("%s dependencies after roundtrip = %v, want %v", spec, got, want)
+		}
+	}
+
+	archive := NewV2()
+	archive.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export {};"), nil)
+	archive.AddRedirect("file:///alias.js", "file:///main.js")
+	back, err := ConvertV2ToV1(ctx, archive)
+	if err != nil {
+		t.Fatalf("ConvertV2ToV1 failed: %v", err)
+	}
+	encoded, err = back.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	reparsed, err := ParseV1(encoded)
+	if err != nil {
+		t.Fatalf("failed to parse converted archive: %v\n%s", err, encoded)
+	}
+	module := reparsed.GetModule("file:///alias.js")
+	if module == nil || module.Specifier != "file:///main.js" {
+		t.Fatalf("alias resolves to %v, want file:///main.js", module)
+	}
+	if source, _ := module.Source(ctx); string(source) != "export {};" {
+		t.Errorf("source = %q", source)
+	}
+
+	for name, build := range map[string]func(*EszipV2){
+		"source_map": func(e *EszipV2) {
+			e.AddModule("file:///mapped.js", ModuleKindJavaScript, []byte("x"), []byte("{}"))
+		},
+		"json": func(e *EszipV2) {
+			e.AddModule("file:///data.json", ModuleKindJson, []byte("{}"), nil)
+		},
+		"npm": func(e *EszipV2) {
+			e.SetNpmSnapshot(&NpmResolutionSnapshot{})
+		},
+	} {
+		e := NewV2()
+		build(e)
+		if _, err := ConvertV2ToV1(ctx, e); !errors.Is(err, ErrNotConvertible) {
+			t.Errorf("%s: ConvertV2ToV1 error = %v, want ErrNotConvertible", name, err)
+		}
+	}
+}
+
+func TestSetVersion(t *testing.T) {
+	ctx := context.Background()
+
+	for _, version := range []EszipVersion{VersionV2, VersionV2_1, VersionV2_2, VersionV2_3, VersionV2_4} {
+		t.Run(version.String(), func(t *testing.T) {
+			archive := NewV2()
+			archive.AddModule("file:///main.js", ModuleKindJavaScript, []byte("export {};"), []byte("{}"))
+			archive.AddRedirect("file:///alias.js", "file:///main.js")
+			if version.SupportsNpm() {
+				archive.SetNpmSnapshot(&NpmResolutionSnapshot{
+					Packages:     []*NpmPackage{{ID: &NpmPackageID{Name: "a", Version: "1.0.0"}, Dependencies: map[string]*NpmPackageID{}}},
+					RootPackages: map[string]*NpmPackageID{"a@1": {Name: "a", Version: "1.0.0"}},
+				})
+			}
+			if err := archive.SetVersion(version); err != nil {
+				t.Fatalf("SetVersion failed: %v", err)
+			}
+			data, err := archive.IntoBytes()
+			if err != nil {
+				t.Fatalf("failed to serialize: %v", err)
+			}
+			if magic := version.ToMagic(); !bytes.HasPrefix(data, magic[:]) {
+				t.Errorf("magic = %q, want %q", data[:8], magic[:])
+			}
+			if size := archive.EstimatedSize(); size != int64(len(data)) {
+				t.Errorf("EstimatedSize = %d, want %d", size, len(data))
+			}
+			parsed, err := ParseV2Sync(ctx, bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if parsed.Version() != version {
+				t.Errorf("parsed version = %v, want %v", parsed.Version(), version)
+			}
+			if source, _ := parsed.GetModule("file:///alias.js").Source(ctx); string(source) != "export {};" {
+				t.Errorf("source = %q", source)
+			}
+			if snapshot := parsed.TakeNpmSnapshot(); version.SupportsNpm() && (snapshot == nil || len(snapshot.Packages) != 1) {
+				t.Errorf("npm snapshot = %v", snapshot)
+			}
+		})
+	}
+
+	t.Run("checksum_default", func(t *testing.T) {
+		archive := NewV2()
+		if err := archive.SetVersion(VersionV2_1); err != nil {
+			t.Fatalf("SetVersion failed: %v", err)
+		}
+		if got := archive.Summary().Checksum; got != ChecksumSha256.String() {
+			t.Errorf("checksum = %s, want sha256", got)
+		}
+		archive.SetCompression(CompressionGzip)
+		if _, err := archive.IntoBytes(); !errors.Is(err, ErrVersionTooOld) {
+			t.Errorf("IntoBytes of a compressed v2.1 archive error = %v, want ErrVersionTooOld", err)
+		}
+	})
+
+	for name, build := range map[string]func(*EszipV2) EszipVersion{
+		"xxhash3": func(e *EszipV2) EszipVersion {
+			e.SetChecksum(ChecksumXxh3)
+			return VersionV2_1
+		},
+		"npm": func(e *EszipV2) EszipVersion {
+			e.SetNpmSnapshot(&NpmResolutionSnapshot{})
+			return VersionV2
+		},
+		"wasm": func(e *EszipV2) EszipVersion {
+			e.AddModule("file:///m.wasm", ModuleKindWasm, []byte("\x00asm\x01\x00\x00\x00"), nil)
+			return VersionV2_2
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			archive := NewV2()
+			version := build(archive)
+			if err := archive.SetVersion(version); !errors.Is(err, ErrVersionTooOld) {
+				t.Errorf("SetVersion(%s) error = %v, want ErrVersionTooOld", version, err)
+			}
+			if archive.Version() != DefaultVersion {
+				t.Errorf("version changed to %v after a failed SetVersion", archive.Version())
+			}
+		})
+	}
+}
+
+func TestLinkSourceMap(t *testing.T) {
+	tests := []struct {
+		name, source, mapName, want string
+	}{
+		{"append", "main();", "main.js.map", "main();\n//# sourceMappingURL=main.js.map\n"},
+		{"trailing_newline", "main();\n\n", "main.js.map", "main();\n//# sourceMappingURL=main.js.map\n"},
+		{"replace", "main();\n//# sourceMappingURL=data:application/json;base64,e30=\n", "main.js.map", "main();\n//# sourceMappingURL=main.js.map\n"},
+		{"replace_deprecated", "main();\r\n  //@ sourceMappingURL=old.map", "main.js.map", "main();\n//# sourceMappingURL=main.js.map\n"},
+		{"comment_not_last", "//# sourceMappingURL=old.map\nmain();", "main.js.map", "//# sourceMappingURL=old.map\nmain();\n//# sourceMappingURL=main.js.map\n"},
+		{"empty", "", "a.js.map", "//# sourceMappingURL=a.js.map\n"},
+		{"escaped", "x", "my util.js.map", "x\n//# sourceMappingURL=my%20util.js.map\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			source := []byte(tt.source)
+			if got := LinkSourceMap(source, tt.mapName); string(got) != tt.want {
+				t.Errorf("LinkSourceMap = %q, want %q", got, tt.want)
+			}
+			if string(source) != tt.source {
+				t.Errorf("source modified to %q", source)
+			}
+		})
+	}
+}
+
+func TestModuleGraph(t *testing.T) {
+	ctx := context.Background()
+	archive := NewV2()
+	archive.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte(`{"imports":{"std/":"https://deno.land/std/"}}`))
+	archive.AddModule("file:///main.js", ModuleKindJavaScript, []byte(`
+import { a } from "./a.js";
+import "std/path.js";
+import fs from "node:fs";
+import "./missing.js";
+import "lodash";
+const lazy = () => import("./lazy.js");
+`), nil)
+	archive.AddModule("file:///a.js", ModuleKindJavaScript, []byte(`export * from "./b.js"; export const a = 1;`), nil)
+	archive.AddModule("file:///b.js", ModuleKindJavaScript, []byte(`import { a } from "./alias.js";`), nil)
+	archive.AddModule("file:///lazy.js", ModuleKindJavaScript, []byte(`export default 1;`), nil)
+	archive.AddModule("https://deno.land/std/path.js", ModuleKindJavaScript, []byte(`import "./path.js";`), nil)
+	archive.AddModule("file:///island1.js", ModuleKindJavaScript, []byte(`import "./island2.js";`), nil)
+	archive.AddModule("file:///island2.js", ModuleKindJavaScript, []byte(`import "./island1.js";`), nil)
+	archive.AddModule("file:///data.json", ModuleKindJson, []byte(`{"import":"./a.js"}`), nil)
+	archive.AddRedirect("file:///alias.js", "file:///a.js")
+	data, err := archive.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+
+	graph, err := BuildModuleGraph(ctx, parsed)
+	if err != nil {
+		t.Fatalf("BuildModuleGraph failed: %v", err)
+	}
+
+	wantModules := []string{"file:///main.js", "file:///a.js", "file:///b.js", "file:///lazy.js", "https://deno.land/std/path.js", "file:///island1.js", "file:///island2.js", "file:///data.json"}
+	if got := graph.Modules(); !slices.Equal(got, wantModules) {
+		t.Errorf("Modules = %v, want %v", got, wantModules)
+	}
+	wantImports := []GraphEdge{
+		{From: "file:///main.js", To: "file:///a.js", Specifier: "./a.js"},
+		{From: "file:///main.js", To: "https://deno.land/std/path.js", Specifier: "std/path.js"},
+		{From: "file:///main.js", To: "file:///lazy.js", Specifier: "./lazy.js", Dynamic: true},
+	}
+	if got := graph.Imports("file:///main.js"); !slices.Equal(got, wantImports) {
+		t.Errorf("Imports(main) = %v, want %v", got, wantImports)
+	}
+	if got := graph.Importers("file:///alias.js"); !slices.Equal(got, []string{"file:///main.js", "file:///b.js"}) {
+		t.Errorf("Importers(alias) = %v", got)
+	}
+	wantUnresolved := []GraphEdge{
+		{From: "file:///main.js", To: "file:///missing.js", Specifier: "./missing.js"},
+		{From: "file:///main.js", Specifier: "lodash"},
+	}
+	if got := graph.Unresolved(); !slices.Equal(got, wantUnresolved) {
+		t.Errorf("Unresolved = %v, want %v", got, wantUnresolved)
+	}
+	if got, want := graph.EntryPoints(), []string{"file:///main.js", "file:///data.json"}; !slices.Equal(got, want) {
+		t.Errorf("EntryPoints = %v, want %v", got, want)
+	}
+	if got, want := graph.Unreachable(), []string{"file:///island1.js", "file:///island2.js"}; !slices.Equal(got, want) {
+		t.Errorf("Unreachable() = %v, want %v", got, want)
+	}
+	if got, want := graph.Unreachable("file:///main.js"), []string{"file:///island1.js", "file:///island2.js", "file:///data.json"}; !slices.Equal(got, want) {
+		t.Errorf("Unreachable(main) = %v, want %v", got, want)
+	}
+	wantCycles := [][]string{
+		{"file:///a.js", "file:///b.js"},
+		{"https://deno.land/std/path.js"},
+		{"file:///island1.js", "file:///island2.js"},
+	}
+	if got := graph.Cycles(); !slices.EqualFunc(got, wantCycles, slices.Equal) {
+		t.Errorf("Cycles = %v, want %v", got, wantCycles)
+	}
+}
+
+func TestImportMap(t *testing.T) {
+	m, err := ParseImportMap("file:///app/import_map.json", []byte(`{
+  // deno.json style comments are allowed
+  "imports": {
+    "react": "https://esm.sh/react@18",
+    "std/": "https://deno.land/std@0.200.0/",
+    "std/path": "./vendor/path.js",
+    "broken/": "./no-trailing-slash.js",
+    "https://cdn.example.com/": "./cdn/",
+    "./shim.js": "./real-shim.js",
+  },
+  "scopes": {
+    "./vendor/": { "react": "./vendor/react.js" },
+    "./vendor/legacy/": { "react": "./vendor/react16.js" },
+  },
+}`))
+	if err != nil {
+		t.Fatalf("ParseImportMap failed: %v", err)
+	}
+
+	for _, tt := range []struct {
+		referrer, specifier string
+		want                string
+	}{
+		{"file:///app/main.js", "react", "https://esm.sh/react@18"},
+		{"file:///app/main.js", "std/fs/mod.ts", "https://deno.land/std@0.200.0/fs/mod.ts"},
+		{"file:///app/main.js", "std/path", "file:///app/vendor/path.js"},
+		{"file:///app/main.js", "https://cdn.example.com/lib.js", "file:///app/cdn/lib.js"},
+		{"file:///app/main.js", "./shim.js", "file:///app/real-shim.js"},
+		{"file:///app/main.js", "../other.js", "file:///other.js"},
+		{"file:///app/main.js", "https://esm.sh/preact", "https://esm.sh/preact"},
+		{"file:///app/main.js", "node:fs", "node:fs"},
+		{"file:///app/vendor/a.js", "react", "file:///app/vendor/react.js"},
+		{"file:///app/vendor/legacy/a.js", "react", "file:///app/vendor/react16.js"},
+		{"file:///app/vendor/a.js", "std/path", "file:///app/vendor/path.js"},
+	} {
+		if got, ok := m.Resolve(tt.referrer, tt.specifier); !ok || got != tt.want {
+			t.Errorf("Resolve(%q, %q) = %q, %v, want %q", tt.referrer, tt.specifier, got, ok, tt.want)
+		}
+	}
+	for _, specifier := range []string{"lodash", "broken/x.js"} {
+		if got, ok := m.Resolve("file:///app/main.js", specifier); ok {
+			t.Errorf("Resolve(%q) = %q, want no resolution", specifier, got)
+		}
+	}
+
+	var none *ImportMap
+	if got, ok := none.Resolve("file:///app/main.js", "./a.js"); !ok || got != "file:///app/a.js" {
+		t.Errorf("nil map: Resolve(./a.js) = %q, %v", got, ok)
+	}
+	if _, ok := none.Resolve("file:///app/main.js", "react"); ok {
+		t.Error("nil map resolved a bare specifier")
+	}
+
+	for _, source := range []string{`{"imports": [1]}`, `{"imports": {"a": 1}}`, `{`} {
+		if _, err := ParseImportMap("file:///import_map.json", []byte(source)); err == nil {
+			t.Errorf("ParseImportMap(%s): expected an error", source)
+		}
+	}
+}
+
+func TestNpmPackageFiles(t *testing.T) {
+	for _, tt := range []struct {
+		id   NpmPackageID
+		path string
+		want string
+	}{
+		{NpmPackageID{"chalk", "5.3.0"}, "source/index.js", "npm:///chalk@5.3.0/source/index.js"},
+		{NpmPackageID{"@types/node", "20.1.0"}, "fs/promises.d.ts", "npm:///@types/node@20.1.0/fs/promises.d.ts"},
+		{NpmPackageID{"odd", "1.0.0"}, "a b/100%.js", "npm:///odd@1.0.0/a%20b/100%25.js"},
+	} {
+		specifier := NpmFileSpecifier(&tt.id, tt.path)
+		if specifier != tt.want {
+			t.Errorf("NpmFileSpecifier(%v, %q) = %q, want %q", tt.id, tt.path, specifier, tt.want)
+		}
+		id, path, ok := ParseNpmFileSpecifier(specifier)
+		if !ok || *id != tt.id || path != tt.path {
+			t.Errorf("ParseNpmFileSpecifier(%q) = %v, %q, %v", specifier, id, path, ok)
+		}
+	}
+	for _, specifier := range []string{
+		"file:///chalk@5.3.0/index.js",
+		"npm:///chalk@5.3.0",
+		"npm:///chalk/index.js",
+		"npm:///@types/node@20/",
+		"npm:///chalk@5.3.0/../../etc/passwd",
+		"npm:///chalk@5.3.0/a%2F..%2Fb",
+	} {
+		if id, path, ok := ParseNpmFileSpecifier(specifier); ok {
+			t.Errorf("ParseNpmFileSpecifier(%q) = %v, %q, want no match", specifier, id, path)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	ctx := context.Background()
+	newArchive := func() *EszipV2 {
+		archive := NewV2()
+		archive.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte(`{"imports":{"lib":"./lib.js"}}`))
+		archive.SetArchiveMetadata(map[string]string{"build": "1"})
+		archive.AddModule("file:///main.js", ModuleKindJavaScript, []byte(`import "lib"; import("./alias.js");`), nil)
+		archive.AddModule("file:///lib.js", ModuleKindJavaScript, []byte(`import data from "./data.json" with { type: "json" };`), nil)
+		archive.AddModule("file:///data.json", ModuleKindJson, []byte(`{}`), nil)
+		archive.AddModule("file:///lazy.js", ModuleKindJavaScript, []byte(`export {};`), nil)
+		archive.AddModule("file:///worker.js", ModuleKindJavaScript, []byte(`import "./unused.js";`), nil)
+		archive.AddModule("file:///unused.js", ModuleKindJavaScript, []byte(`export {};`), nil)
+		archive.AddRedirect("file:///alias.js", "file:///lazy.js")
+		archive.AddRedirect("file:///old.js", "file:///unused.js")
+		archive.AddRedirect("file:///dangling.js", "file:///nowhere.js")
+		return archive
+	}
+
+	archive := newArchive()
+	removed, err := archive.Prune(ctx, "file:///main.js")
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if want := []string{"file:///worker.js", "file:///unused.js", "file:///old.js"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+	want := []string{"file:///import_map.json", "file:///main.js", "file:///lib.js", "file:///data.json", "file:///lazy.js", "file:///alias.js", "file:///dangling.js"}
+	if got := archive.Specifiers(); !slices.Equal(got, want) {
+		t.Errorf("Specifiers = %v, want %v", got, want)
+	}
+	if metadata, err := archive.ArchiveMetadata(ctx); err != nil || metadata["build"] != "1" {
+		t.Errorf("ArchiveMetadata = %v, %v", metadata, err)
+	}
+
+	archive = newArchive()
+	removed, err = archive.Prune(ctx, "file:///main.js", "file:///old.js")
+	if err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+	if want := []string{"file:///worker.js"}; !slices.Equal(removed, want) {
+		t.Errorf("removed %v, want %v", removed, want)
+	}
+
+	if _, err := newArchive().Prune(ctx, "file:///missing.js"); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("Prune of a missing entrypoint error = %v, want ErrSpecifierNotFound", err)
+	}
+	if _, err := newArchive().Prune(ctx); err == nil {
+		t.Error("Prune without entrypoints succeeded")
+	}
+}
+
+func TestDeterministicWrite(t *testing.T) {
+	ctx := context.Background()
+	react := &NpmPackageID{Name: "react", Version: "18.2.0"}
+	looseEnvify := &NpmPackageID{Name: "loose-envify", Version: "1.4.0"}
+
+	// build adds the same entries in the given order.
+	build := func(order []int) *EszipV2 {
+		e := NewV2()
+		e.SetChecksum(ChecksumXxh3)
+		adds := []func(){
+			func() { e.AddModule("file:///b.js", ModuleKindJavaScript, []byte("b()"), []byte("{}")) },
+			func() { e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a()"), nil) },
+			func() { e.AddRedirect("file:///alias.js", "file:///a.js") },
+			func() { e.AddModule("file:///data.json", ModuleKindJson, []byte("{}"), nil) },
+			func() { e.SetArchiveMetadata(map[string]string{"build": "1", "git": "abc"}) },
+			func() {
+				e.AddImportMap(ModuleKindJsonc, "file:///import_map.json", []byte(`{"imports":{}}`))
+			},
+		}
+		for _, i := range order {
+			adds[i]()
+		}
+		packages := []*NpmPackage{
+			{ID: react, Dependencies: map[string]*NpmPackageID{"loose-envify": looseEnvify}},
+			{ID: looseEnvify, Dependencies: map[string]*NpmPackageID{}},
+		}
+		if order[0]%2 == 1 {
+			slices.Reverse(packages)
+		}
+		e.npmSnapshot = &NpmResolutionSnapshot{Packages: packages, RootPackages: map[string]*NpmPackageID{"react": react}}
+		return e
+	}
+	x := build([]int{0, 1, 2, 3, 4, 5})
+	y := build([]int{5, 3, 2, 1, 0, 4})
+	order := x.Specifiers()
+
+	plainX, err := x.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	plainY, err := y.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	if bytes.Equal(plainX, plainY) {
+		t.Fatal("insertion order did not affect the plain encoding; the test proves nothing")
+	}
+
+	dataX, err := x.IntoBytes(WithDeterministicWrite())
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	dataY, err := y.IntoBytes(WithDeterministicWrite())
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	if !bytes.Equal(dataX, dataY) {
+		t.Error("deterministic writes of the same entries differ")
+	}
+	if got := x.Specifiers(); !slices.Equal(got, order) {
+		t.Errorf("archive reordered by the write: %v, was %v", got, order)
+	}
+
+	parsed, err := ParseBytes(ctx, dataX)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	want := []string{"file:///import_map.json", "file:///a.js", "file:///b.js", "file:///data.json", "file:///alias.js"}
+	if got := v2.Specifiers(); !slices.Equal(got, want) {
+		t.Errorf("Specifiers = %v, want %v", got, want)
+	}
+
+	normalized, err := Normalize(ctx, &EszipUnion{v2: y}, NormalizeOptions{Checksum: ChecksumXxh3})
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	normalizedData, err := normalized.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	if !bytes.Equal(dataX, normalizedData) {
+		t.Error("deterministic write differs from Normalize")
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	ctx := context.Background()
+	key := StaticKey(bytes.Repeat([]byte{0x42}, 32))
+	source := bytes.Repeat([]byte("export const secret = 'proprietary';\n"), 20)
+	sourceMap := []byte(`{"mappings":"AAAA"}`)
+
+	e := NewV2()
+	e.SetChecksum(ChecksumXxh3)
+	e.SetCompression(CompressionGzip)
+	e.SetEncryption(EncryptionAESGCM, key)
+	e.AddModule("file:///main.js", ModuleKindJavaScript, source, sourceMap)
+	e.AddModule("file:///empty.js", ModuleKindJavaScript, nil, nil)
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if bytes.Contains(data, []byte("proprietary")) || bytes.Contains(data, []byte("mappings")) {
+		t.Error("encrypted archive contains plaintext")
+	}
+	if !bytes.Contains(data, []byte("file:///main.js")) {
+		t.Error("specifiers should stay readable")
+	}
+
+	check := func(name string, e *EszipV2) {
+		t.Helper()
+		module := e.GetModule("file:///main.js")
+		if got, err := module.Source(ctx); err != nil || !bytes.Equal(got, source) {
+			t.Errorf("%s: source = %d bytes, %v", name, len(got), err)
+		}
+		if got, err := module.SourceMap(ctx); err != nil || !bytes.Equal(got, sourceMap) {
+			t.Errorf("%s: source map = %q, %v", name, got, err)
+		}
+		if got, err := e.GetModule("file:///empty.js").Source(ctx); err != nil || len(got) != 0 {
+			t.Errorf("%s: empty source = %q, %v", name, got, err)
+		}
+	}
+	parsed, err := ParseBytes(ctx, data, WithDecryptionKey(key))
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	check("ParseBytes", v2)
+	if got := parsed.Summary().Encryption; got != "aes-gcm" {
+		t.Errorf("Summary().Encryption = %q", got)
+	}
+	lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithDecryptionKey(key))
+	if err != nil {
+		t.Fatalf("ParseV2Lazy failed: %v", err)
+	}
+	check("ParseV2Lazy", lazy)
+
+	// A parsed archive keeps its key for writing.
+	rewritten, err := v2.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to rewrite: %v", err)
+	}
+	reparsed, err := ParseBytes(ctx, rewritten, WithDecryptionKey(key))
+	if err != nil {
+		t.Fatalf("failed to parse rewritten archive: %v", err)
+	}
+	v2, _ = reparsed.V2()
+	check("rewritten", v2)
+
+	if report, err := VerifyArchive(ctx, bytes.NewReader(data), int64(len(data)), WithDecryptionKey(key)); err != nil || !report.OK() {
+		t.Errorf("VerifyArchive = %v, %v", report, err)
+	}
+
+	t.Run("missing_key", func(t *testing.T) {
+		if _, err := ParseBytes(ctx, data); !errors.Is(err, ErrMissingKey) {
+			t.Errorf("parse without key error = %v, want ErrMissingKey", err)
+		}
+		unkeyed := NewV2()
+		unkeyed.SetEncryption(EncryptionAESGCM, nil)
+		if _, err := unkeyed.IntoBytes(); !errors.Is(err, ErrMissingKey) {
+			t.Errorf("write without key error = %v, want ErrMissingKey", err)
+		}
+	})
+
+	t.Run("wrong_key", func(t *testing.T) {
+		_, err := ParseBytes(ctx, data, WithDecryptionKey(StaticKey(bytes.Repeat([]byte{0x24}, 32))))
+		var pe *ParseError
+		if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceEncryption {
+			t.Errorf("parse with wrong key error = %v, want ErrInvalidV2SourceEncryption", err)
+		}
+	})
+
+	t.Run("swapped", func(t *testing.T) {
+		// Without checksums or compression the ciphertexts can be moved
+		// around unnoticed; only their binding to the module and section
+		// gives them away. Each is a nonce, the content and a tag.
+		build := func(sourceMap []byte) []byte {
+			e := NewV2()
+			e.SetEncryption(EncryptionAESGCM, key)
+			e.AddModule("file:///a.js", ModuleKindJavaScript, []byte("aaaa"), sourceMap)
+			if sourceMap == nil {
+				e.AddModule("file:///b.js", ModuleKindJavaScript, []byte("bbbb"), nil)
+			}
+			data, err := e.IntoBytes()
+			if err != nil {
+				t.Fatalf("failed to serialize: %v", err)
+			}
+			return data
+		}
+		swap := func(data []byte, i, j, n int) {
+			x := bytes.Clone(data[i : i+n])
+			copy(data[i:], data[j:j+n])
+			copy(data[j:], x)
+		}
+		n := 12 + 4 + 16
+
+		// The sources of a.js and b.js end the sources section, which the
+		// empty source maps section follows.
+		modules := build(nil)
+		end := len(modules) - 4
+		swap(modules, end-2*n, end-n, n)
+		// The source of a.js is followed by the source maps section, which
+		// holds its source map.
+		sections := build([]byte("mmmm"))
+		end = len(sections)
+		swap(sections, end-2*n-4, end-n, n)
+
+		for name, data := range map[string][]byte{"modules": modules, "sections": sections} {
+			_, err := ParseBytes(ctx, data, WithDecryptionKey(key))
+			var pe *ParseError
+			if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceEncryption {
+				t.Errorf("%s: parse error = %v, want ErrInvalidV2SourceEncryption", name, err)
+			}
+			lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithDecryptionKey(key))
+			if err != nil {
+				t.Fatalf("%s: ParseV2Lazy failed: %v", name, err)
+			}
+			if _, err := lazy.GetModule("file:///a.js").Source(ctx); !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceEncryption {
+				t.Errorf("%s: lazy source error = %v, want ErrInvalidV2SourceEncryption", name, err)
+			}
+		}
+	})
+
+	t.Run("dedup", func(t *testing.T) {
+		// Encrypted content is bound to its module, so it is not shared.
+		e := NewV2()
+		e.SetEncryption(EncryptionAESGCM, key)
+		e.AddModule("file:///a.js", ModuleKindJavaScript, source, nil)
+		e.AddModule("file:///b.js", ModuleKindJavaScript, source, nil)
+		var report WriteReport
+		data, err := e.IntoBytes(WithDeduplication(), WithWriteReport(&report))
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		if report.SharedSources != 0 {
+			t.Errorf("shared %d sources", report.SharedSources)
+		}
+		parsed, err := ParseBytes(ctx, data, WithDecryptionKey(key))
+		if err != nil {
+			t.Fatalf("failed to parse: %v", err)
+		}
+		if got, err := parsed.GetModule("file:///b.js").Source(ctx); err != nil || !bytes.Equal(got, source) {
+			t.Errorf("b.js source = %d bytes, %v", len(got), err)
+		}
+	})
+
+	t.Run("bad_key_size", func(t *testing.T) {
+		bad := NewV2()
+		bad.SetEncryption(EncryptionAESGCM, StaticKey("short"))
+		bad.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+		if _, err := bad.IntoBytes(); err == nil {
+			t.Error("write with a 5-byte key succeeded")
+		}
+	})
+
+	t.Run("old_version", func(t *testing.T) {
+		old := NewV2()
+		old.SetEncryption(EncryptionAESGCM, key)
+		if err := old.SetVersion(VersionV2_1); !errors.Is(err, ErrVersionTooOld) {
+			t.Errorf("SetVersion(v2.1) error = %v, want ErrVersionTooOld", err)
+		}
+	})
+
+	t.Run("patch", func(t *testing.T) {
+		var out bytes.Buffer
+		changes := []Change{{Op: ChangeAdd, Specifier: "file:///new.js", Kind: ModuleKindJavaScript, Source: []byte("added secret")}}
+		if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &out, changes, WithDecryptionKey(key)); err != nil {
+			t.Fatalf("PatchArchive failed: %v", err)
+		}
+		if bytes.Contains(out.Bytes(), []byte("added secret")) {
+			t.Error("patched content is not encrypted")
+		}
+		patched, err := ParseBytes(ctx, out.Bytes(), WithDecryptionKey(key))
+		if err != nil {
+			t.Fatalf("failed to parse patched archive: %v", err)
+		}
+		v2, _ := patched.V2()
+		check("patched", v2)
+		if got, err := patched.GetModule("file:///new.js").Source(ctx); err != nil || string(got) != "added secret" {
+			t.Errorf("added source = %q, %v", got, err)
+		}
+	})
+}
+
+func TestParseOptions(t *testing.T) {
+	ctx := context.Background()
+	source := bytes.Repeat([]byte("export const x = 1;\n"), 10)
+
+	build := func(checksum ChecksumType) []byte {
+		t.Helper()
+		e := NewV2()
+		e.SetChecksum(checksum)
+		e.AddModule("file:///main.js", ModuleKindJavaScript, source, nil)
+		e.AddModule("file:///util.js", ModuleKindJavaScript, []byte("export {};"), nil)
+		e.AddRedirect("file:///alias.js", "file:///main.js")
+		data, err := e.IntoBytes()
+		if err != nil {
+			t.Fatalf("failed to serialize: %v", err)
+		}
+		return data
+	}
+	isType := func(err error, typ ParseErrorType) bool {
+		var pe *ParseError
+		return errors.As(err, &pe) && pe.Type == typ
+	}
+	data := build(ChecksumSha256)
+
+	if _, err := ParseBytes(ctx, data, WithParseOptions(ParseOptions{})); err != nil {
+		t.Fatalf("zero ParseOptions should parse: %v", err)
+	}
+
+	t.Run("max_section_size", func(t *testing.T) {
+		opts := ParseOptions{MaxSectionSize: int64(len(source)) - 1}
+		if _, err := ParseBytes(ctx, data, WithParseOptions(opts)); !isType(err, ErrLimitExceeded) {
+			t.Errorf("ParseBytes error = %v, want ErrLimitExceeded", err)
+		}
+		if _, err := ParseV2Lazy(ctx, bytes.NewReader(data), WithParseOptions(opts)); !isType(err, ErrLimitExceeded) {
+			t.Errorf("ParseV2Lazy error = %v, want ErrLimitExceeded", err)
+		}
+		opts.MaxSectionSize = int64(len(data))
+		if _, err := ParseBytes(ctx, data, WithParseOptions(opts)); err != nil {
+			t.Errorf("parse within limit: %v", err)
+		}
+	})
+
+	t.Run("max_modules", func(t *testing.T) {
+		if _, err := ParseBytes(ctx, data, WithParseOptions(ParseOptions{MaxModules: 2})); !isType(err, ErrLimitExceeded) {
+			t.Errorf("error = %v, want ErrLimitExceeded", err)
+		}
+		if _, err := ParseBytes(ctx, data, WithParseOptions(ParseOptions{MaxModules: 3})); err != nil {
+			t.Errorf("parse within limit: %v", err)
+		}
+		v1 := []byte(`{"version":1,"modules":{"file:///b.js":{"Source":{"source":"b","deps":[]}},"file:///a.js":{"Redirect":"file:///b.js"}}}`)
+		if _, err := ParseBytes(ctx, v1, WithParseOptions(ParseOptions{MaxModules: 1})); !isType(err, ErrLimitExceeded) {
+			t.Errorf("v1 error = %v, want ErrLimitExceeded", err)
+		}
+	})
+
+	t.Run("require_checksum", func(t *testing.T) {
+		opts := ParseOptions{RequireChecksum: true}
+		if _, err := ParseBytes(ctx, build(ChecksumNone), WithParseOptions(opts)); !isType(err, ErrChecksumRequired) {
+			t.Errorf("ChecksumNone error = %v, want ErrChecksumRequired", err)
+		}
+		v1 := []byte(`{"version":1,"modules":{"file:///b.js":{"Source":{"source":"b","deps":[]}}}}`)
+		if _, err := ParseBytes(ctx, v1, WithParseOptions(opts)); !isType(err, ErrChecksumRequired) {
+			t.Errorf("v1 error = %v, want ErrChecksumRequired", err)
+		}
+		if _, err := ParseBytes(ctx, build(ChecksumXxh3), WithParseOptions(opts)); err != nil {
+			t.Errorf("checksummed archive: %v", err)
+		}
+	})
+
+	t.Run("skip_checksum_verify", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		idx := bytes.Index(corrupt, []byte("export {};"))
+		if idx < 0 {
+			t.Fatal("could not find source content")
+		}
+		corrupt[idx] = 'E'
+		if _, err := ParseBytes(ctx, corrupt); !isType(err, ErrInvalidV2SourceHash) {
+			t.Fatalf("default parse error = %v, want ErrInvalidV2SourceHash", err)
+		}
+
+		opts := ParseOptions{SkipChecksumVerify: true}
+		parsed, complete, err := ParseWithOptions(ctx, bytes.NewReader(corrupt), opts)
+		if err != nil {
+			t.Fatalf("ParseWithOptions failed: %v", err)
+		}
+		if err := complete(ctx); err != nil {
+			t.Fatalf("completion failed: %v", err)
+		}
+		if got, err := parsed.GetModule("file:///util.js").Source(ctx); err != nil || string(got) != "Export {};" {
+			t.Errorf("source = %q, %v", got, err)
+		}
+		lazy, err := ParseV2Lazy(ctx, bytes.NewReader(corrupt), WithParseOptions(opts))
+		if err != nil {
+			t.Fatalf("ParseV2Lazy failed: %v", err)
+		}
+		if _, err := lazy.GetModule("file:///util.js").Source(ctx); err != nil {
+			t.Errorf("lazy source: %v", err)
+		}
+
+		report, err := VerifyArchive(ctx, bytes.NewReader(corrupt), int64(len(corrupt)), WithParseOptions(opts))
+		if err != nil {
+			t.Fatalf("VerifyArchive failed: %v", err)
+		}
+		if report.OK() {
+			t.Error("VerifyArchive should ignore SkipChecksumVerify")
+		}
+	})
+
+	t.Run("strict_offsets", func(t *testing.T) {
+		strict := WithParseOptions(ParseOptions{StrictOffsets: true})
+		plain := build(ChecksumNone)
+		if _, err := ParseBytes(ctx, plain, strict); err != nil {
+			t.Fatalf("well laid out archive: %v", err)
+		}
+		// setOffset points the source of specifier at offset, editing the
+		// modules header, which has no hash.
+		setOffset := func(data []byte, specifier string, offset uint32) {
+			idx := bytes.Index(data, []byte(specifier))
+			binary.BigEndian.PutUint32(data[idx+len(specifier)+1:], offset)
+		}
+
+		overlapping := bytes.Clone(plain)
+		setOffset(overlapping, "file:///util.js", uint32(len(source))-10)
+		var pe *ParseError
+		if _, err := ParseBytes(ctx, overlapping, strict); !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceOffset || pe.Section != "modules" ||
+			!strings.Contains(pe.Message, "overlaps file:///main.js at 0-200") || pe.Offset == 0 || pe.Length != 10 {
+			t.Errorf("overlapping source error = %v, want the range and the module it overlaps", err)
+		}
+		if _, err := ParseV2Lazy(ctx, bytes.NewReader(overlapping), strict); !isType(err, ErrInvalidV2SourceOffset) {
+			t.Errorf("ParseV2Lazy overlapping source error = %v, want ErrInvalidV2SourceOffset", err)
+		}
+
+		// Content out of header order loads, but is not how writers lay it
+		// out.
+		swapped := bytes.Clone(plain)
+		content := bytes.Index(swapped, source)
+		copy(swapped[content:], append([]byte("export {};"), source...))
+		setOffset(swapped, "file:///main.js", 10)
+		setOffset(swapped, "file:///util.js", 0)
+		parsed, err := ParseBytes(ctx, swapped)
+		if err != nil {
+			t.Fatalf("swapped content: %v", err)
+		}
+		if got, err := parsed.GetModule("file:///util.js").Source(ctx); err != nil || string(got) != "export {};" {
+			t.Errorf("swapped source = %q, %v", got, err)
+		}
+		if _, err := ParseBytes(ctx, swapped, strict); err == nil || !strings.Contains(err.Error(), "leaves bytes 0-10 unused") {
+			t.Errorf("swapped content error = %v, want unused bytes", err)
+		}
+
+		// A sources section longer than its content.
+		padded := bytes.Clone(plain)
+		content = bytes.Index(padded, source)
+		binary.BigEndian.PutUint32(padded[content-4:], uint32(len(source))+11)
+		end := content + len(source) + 10
+		padded = slices.Insert(padded, end, 0)
+		if _, err := ParseV2Lazy(ctx, bytes.NewReader(padded)); err != nil {
+			t.Fatalf("ParseV2Lazy padded sources: %v", err)
+		}
+		for name, parse := range map[string]func() error{
+			"ParseBytes": func() error { _, err := ParseBytes(ctx, padded, strict); return err },
+			"ParseV2Lazy": func() error {
+				_, err := ParseV2Lazy(ctx, bytes.NewReader(padded), strict)
+				return err
+			},
+			"PatchArchive": func() error {
+				return PatchArchive(ctx, bytes.NewReader(padded), int64(len(padded)), io.Discard, nil, strict)
+			},
+		} {
+			err := parse()
+			if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SectionLength || pe.Expected != "210" || pe.Got != "211" {
+				t.Errorf("%s padded sources error = %v, want a section length mismatch", name, err)
+			}
+		}
+	})
+}
+
+func TestModuleHeaders(t *testing.T) {
+	ctx := context.Background()
+	headers := map[string]string{"content-type": "application/typescript", "x-deno-warning": "deprecated"}
+
+	e := NewV2()
+	e.SetChecksum(ChecksumXxh3)
+	e.AddModuleWithHeaders("https://deno.land/x/mod.ts", ModuleKindJavaScript, []byte("export {};"), nil, headers)
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import 'https://deno.land/x/mod.ts';"), nil)
+	e.AddRedirect("https://deno.land/x/latest.ts", "https://deno.land/x/mod.ts")
+	if e.Version() != VersionV2_4 {
+		t.Errorf("version = %v, want v2.4 after adding headers", e.Version())
+	}
+	headers["content-type"] = "changed"
+
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if !bytes.HasPrefix(data, MagicV2_4[:]) {
+		t.Errorf("magic = %q, want %q", data[:8], MagicV2_4[:])
+	}
+	if size := e.EstimatedSize(); size != int64(len(data)) {
+		t.Errorf("EstimatedSize = %d, want %d", size, len(data))
+	}
+
+	want := map[string]string{"content-type": "application/typescript", "x-deno-warning": "deprecated"}
+	check := func(name string, e *EszipV2) {
+		t.Helper()
+		if got := e.GetModule("https://deno.land/x/latest.ts").Headers(); !maps.Equal(got, want) {
+			t.Errorf("%s: headers = %v, want %v", name, got, want)
+		}
+		if got := e.GetModule("file:///main.js").Headers(); got != nil {
+			t.Errorf("%s: headers of main.js = %v, want nil", name, got)
+		}
+	}
+	check("built", e)
+	e.GetModule("https://deno.land/x/mod.ts").Headers()["content-type"] = "mutated"
+	check("after mutating a copy", e)
+
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	check("ParseBytes", v2)
+	if got := parsed.Summary().Format; got != "v2.4" {
+		t.Errorf("Summary().Format = %q", got)
+	}
+	lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseV2Lazy failed: %v", err)
+	}
+	check("ParseV2Lazy", lazy)
+	if ok, diff, err := Equal(ctx, &EszipUnion{v2: e}, parsed, EqualOptions{}); err != nil || !ok {
+		t.Errorf("Equal = %v, %v, %v", ok, diff, err)
+	}
+
+	var patched bytes.Buffer
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///main.js", Source: []byte("export {};")}}
+	if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+	repatched, err := ParseV2Sync(ctx, bytes.NewReader(patched.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse patched archive: %v", err)
+	}
+	check("PatchArchive", repatched)
+
+	t.Run("version_too_old", func(t *testing.T) {
+		if err := e.SetVersion(VersionV2_3); !errors.Is(err, ErrVersionTooOld) {
+			t.Errorf("SetVersion(v2.3) error = %v, want ErrVersionTooOld", err)
+		}
+		plain := NewV2()
+		plain.AddModuleWithHeaders("file:///a.js", ModuleKindJavaScript, nil, nil, nil)
+		if plain.Version() != DefaultVersion {
+			t.Errorf("version = %v after adding no headers", plain.Version())
+		}
+	})
+
+	t.Run("equal", func(t *testing.T) {
+		other := NewV2()
+		other.AddModuleWithHeaders("https://deno.land/x/mod.ts", ModuleKindJavaScript, []byte("export {};"), nil, map[string]string{"content-type": "text/plain"})
+		other.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import 'https://deno.land/x/mod.ts';"), nil)
+		other.AddRedirect("https://deno.land/x/latest.ts", "https://deno.land/x/mod.ts")
+		ok, diff, err := Equal(ctx, parsed, &EszipUnion{v2: other}, EqualOptions{})
+		if err != nil || ok || diff.Divergences[0].Kind != DiffHeaders {
+			t.Errorf("Equal = %v, %v, %v; want a headers divergence", ok, diff, err)
+		}
+	})
+
+	t.Run("corrupt", func(t *testing.T) {
+		corrupt := bytes.Clone(data)
+		idx := bytes.Index(corrupt, []byte("x-deno-warning"))
+		if idx < 0 {
+			t.Fatal("could not find header key")
+		}
+		corrupt[idx] = 'y'
+		var pe *ParseError
+		if _, err := ParseBytes(ctx, corrupt); !errors.As(err, &pe) || pe.Type != ErrInvalidV24ModuleHeadersHash {
+			t.Errorf("error = %v, want ErrInvalidV24ModuleHeadersHash", err)
+		}
+	})
+}
+
+func TestModuleAux(t *testing.T) {
+	ctx := context.Background()
+	cache := []byte{0xc0, 0xde, 0x00, 0xff}
+
+	e := NewV2()
+	e.SetChecksum(ChecksumSha256)
+	e.AddModuleWithHeaders("file:///mod.js", ModuleKindJavaScript, []byte("export {};"), nil, map[string]string{"etag": "1"})
+	e.AddModule("file:///main.js", ModuleKindJavaScript, []byte("import './mod.js';"), nil)
+	e.AddRedirect("file:///alias.js", "file:///mod.js")
+	if err := e.GetModule("file:///alias.js").SetAux("v8-code-cache", cache); err != nil {
+		t.Fatalf("SetAux failed: %v", err)
+	}
+	if err := e.SetModuleAux("file:///mod.js", "empty", []byte{}); err != nil {
+		t.Fatalf("SetModuleAux failed: %v", err)
+	}
+	if e.Version() != VersionV2_5 {
+		t.Errorf("version = %v, want v2.5 after adding aux data", e.Version())
+	}
+	cache[0] = 0
+
+	data, err := e.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if !bytes.HasPrefix(data, MagicV2_5[:]) {
+		t.Errorf("magic = %q, want %q", data[:8], MagicV2_5[:])
+	}
+	if size := e.EstimatedSize(); size != int64(len(data)) {
+		t.Errorf("EstimatedSize = %d, want %d", size, len(data))
+	}
+
+	check := func(name string, e *EszipV2) {
+		t.Helper()
+		m := e.GetModule("file:///mod.js")
+		if got := m.AuxNames(); !slices.Equal(got, []string{"empty", "v8-code-cache"}) {
+			t.Errorf("%s: AuxNames = %v", name, got)
+		}
+		if got, ok := m.GetAux("v8-code-cache"); !ok || !bytes.Equal(got, []byte{0xc0, 0xde, 0x00, 0xff}) {
+			t.Errorf("%s: GetAux = %x, %v", name, got, ok)
+		}
+		if got, ok := m.GetAux("empty"); !ok || len(got) != 0 {
+			t.Errorf("%s: GetAux(empty) = %x, %v", name, got, ok)
+		}
+		if m.Headers()["etag"] != "1" {
+			t.Errorf("%s: headers = %v", name, m.Headers())
+		}
+		if _, ok := e.GetModule("file:///main.js").GetAux("v8-code-cache"); ok {
+			t.Errorf("%s: main.js has aux data", name)
+		}
+	}
+	check("built", e)
+
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	v2, _ := parsed.V2()
+	check("ParseBytes", v2)
+	lazy, err := ParseV2Lazy(ctx, bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("ParseV2Lazy failed: %v", err)
+	}
+	check("ParseV2Lazy", lazy)
+	normalized, err := Normalize(ctx, parsed, NormalizeOptions{})
+	if err != nil {
+		t.Fatalf("Normalize failed: %v", err)
+	}
+	check("Normalize", normalized)
+
+	var patched bytes.Buffer
+	changes := []Change{{Op: ChangeReplaceSource, Specifier: "file:///main.js", Source: []byte("export {};")}}
+	if err := PatchArchive(ctx, bytes.NewReader(data), int64(len(data)), &patched, changes); err != nil {
+		t.Fatalf("PatchArchive failed: %v", err)
+	}
+	repatched, err := ParseV2Sync(ctx, bytes.NewReader(patched.Bytes()))
+	if err != nil {
+		t.Fatalf("failed to parse patched archive: %v", err)
+	}
+	check("PatchArchive", repatched)
+
+	if ok, diff, err := Equal(ctx, &EszipUnion{v2: e}, parsed, EqualOptions{}); err != nil || !ok {
+		t.Errorf("Equal = %v, %v, %v", ok, diff, err)
+	}
+	if err := v2.SetModuleAux("file:///mod.js", "v8-code-cache", nil); err != nil {
+		t.Fatal(err)
+	}
+	ok, diff, err := Equal(ctx, &EszipUnion{v2: e}, parsed, EqualOptions{})
+	if err != nil || ok || diff.Divergences[0].Kind != DiffAux {
+		t.Errorf("Equal = %v, %v, %v; want an aux divergence", ok, diff, err)
+	}
+
+	if err := e.SetVersion(VersionV2_4); !errors.Is(err, ErrVersionTooOld) {
+		t.Errorf("SetVersion(v2.4) error = %v, want ErrVersionTooOld", err)
+	}
+	if err := e.SetModuleAux("file:///alias.js", "x", []byte("x")); !errors.Is(err, ErrSpecifierNotFound) {
+		t.Errorf("SetModuleAux on a redirect error = %v, want ErrSpecifierNotFound", err)
+	}
+	if err := e.SetModuleAux("file:///mod.js", "", []byte("x")); err == nil {
+		t.Error("SetModuleAux accepted an empty name")
+	}
+	v1 := NewV1()
+	v1.AddModule("file:///a.js", nil, nil)
+	if err := v1.GetModule("file:///a.js").SetAux("x", []byte("x")); err == nil {
+		t.Error("SetAux on a V1 module succeeded")
+	}
+
+	corrupt := bytes.Clone(data)
+	idx := bytes.Index(corrupt, []byte("v8-code-cache"))
+	if idx < 0 {
+		t.Fatal("could not find aux name")
+	}
+	corrupt[idx] = 'w'
+	var pe *ParseError
+	if _, err := ParseBytes(ctx, corrupt); !errors.As(err, &pe) || pe.Type != ErrInvalidV25ModuleAuxHash || pe.Section != "module_aux" {
+		t.Errorf("error = %v, want ErrInvalidV25ModuleAuxHash in module_aux", err)
+	}
+}
+
+func TestTranspile(t *testing.T) {
+	for name, want := range map[string]bool{
+		"file:///a.ts": true, "file:///a.TSX": true, "file:///a.jsx": true, "file:///a.mts": true,
+		"file:///a.js": false, "file:///a.json": false, "https://example.com/mod": false,
+	} {
+		if got := NeedsTranspile(name); got != want {
+			t.Errorf("NeedsTranspile(%q) = %v, want %v", name, got, want)
+		}
+	}
+
+	var calls []string
+	upper := TranspilerFunc(func(specifier string, source []byte) ([]byte, []byte, error) {
+		calls = append(calls, specifier)
+		if bytes.Contains(source, []byte("syntax error")) {
+			return nil, nil, errors.New("unexpected token")
+		}
+		return bytes.ToUpper(source), []byte(`{"version":3}`), nil
+	})
+	code, sourceMap, err := Transpile(upper, "file:///main.ts", []byte("let x: number;"))
+	if err != nil || string(code) != "LET X: NUMBER;" || string(sourceMap) != `{"version":3}` {
+		t.Errorf("Transpile = %q, %q, %v", code, sourceMap, err)
+	}
+	if code, sourceMap, err := Transpile(upper, "file:///main.js", []byte("let x;")); err != nil || string(code) != "let x;" || sourceMap != nil {
+		t.Errorf("Transpile of JavaScript = %q, %q, %v", code, sourceMap, err)
+	}
+	if code, _, err := Transpile(nil, "file:///main.ts", []byte("let x: number;")); err != nil || string(code) != "let x: number;" {
+		t.Errorf("Transpile without a transpiler = %q, %v", code, err)
+	}
+	if !slices.Equal(calls, []string{"file:///main.ts"}) {
+		t.Errorf("transpiler called for %v", calls)
+	}
+	if _, _, err := Transpile(upper, "file:///bad.tsx", []byte("syntax error")); err == nil || !strings.Contains(err.Error(), "transpiling file:///bad.tsx: unexpected token") {
+		t.Errorf("Transpile error = %v", err)
+	}
+}
+
+func TestSplitInlineSourceMap(t *testing.T) {
+	for _, tt := range []struct {
+		name, source, code, sourceMap string
+	}{
+		{"inline", "export const x = 1;\n//# sourceMappingURL=data:application/json;base64,eyJ2ZXJzaW9uIjozfQ==\n", "export const x = 1;\n", `{"version":3}`},
+		{"charset", "x;\n//@ sourceMappingURL=data:application/json;charset=utf-8;base64,eyJ2ZXJzaW9uIjozfQ==", "x;\n", `{"version":3}`},
+		{"external", "x;\n//# sourceMappingURL=main.js.map\n", "x;\n//# sourceMappingURL=main.js.map\n", ""},
+		{"not_base64", "x;\n//# sourceMappingURL=data:application/json,%7B%7D\n", "x;\n//# sourceMappingURL=data:application/json,%7B%7D\n", ""},
+		{"none", "x;\n", "x;\n", ""},
+	} {
+		code, sourceMap := SplitInlineSourceMap([]byte(tt.source))
+		if string(code) != tt.code || string(sourceMap) != tt.sourceMap {
+			t.Errorf("%s: SplitInlineSourceMap = %q, %q; want %q, %q", tt.name, code, sourceMap, tt.code, tt.sourceMap)
+		}
+	}
+}
+
+func BenchmarkIntoBytes(b *testing.B) {
+	for _, modules := range []int{100, 10000} {
+		archive := NewV2()
+		archive.SetChecksum(ChecksumSha256)
+		for i := 0; i < modules; i++ {
+			archive.AddModule(fmt.Sprintf("file:///src/mod%d.js", i), ModuleKindJavaScript, bytes.Repeat([]byte("x"), 512), []byte(fmt.Sprintf(`{"version":3,"m":%d}`, i)))
+		}
+		size := archive.EstimatedSize()
+
+		b.Run(fmt.Sprintf("modules=%d", modules), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if _, err := archive.IntoBytes(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildFromSpecifiers(t *testing.T) {
+	ctx := context.Background()
+	fsys := fstest.MapFS{
+		"app/main.js":     {Data: []byte("import { a } from './lib/a.js';\nimport 'react';\nimport fs from 'node:fs';\nimport('./lazy.js');\nexport * from 'https://example.com/remote.js';")},
+		"app/lib/a.js":    {Data: []byte("import data from '../data.json' with { type: 'json' };\nimport '../main.js';\nexport const a = data;")},
+		"app/data.json":   {Data: []byte(`{"a":1}`)},
+		"app/lazy.js":     {Data: []byte("export default 1;")},
+		"app/unused.js":   {Data: []byte("export {};")},
+		"app/worker.js":   {Data: []byte("import './lib/a.js';")},
+		"app/broken.js":   {Data: []byte("import './missing.js';")},
+		"secret/token.js": {Data: []byte("export const token = 'x';")},
+	}
+	files := FSLoader(fsys)
+	var loaded []string
+	loader := LoaderFunc(func(ctx context.Context, specifier string) (ModuleKind, []byte, []byte, error) {
+		loaded = append(loaded, specifier)
+		if specifier == "https://example.com/remote.js" {
+			return ModuleKindJavaScript, []byte("import 'file:///secret/token.js';"), []byte(`{"version":3}`), nil
+		}
+		return files.Load(ctx, specifier)
+	})
+
+	archive, err := BuildFromSpecifiers(ctx, loader, []string{"file:///app/main.js", "file:///app/worker.js"})
+	if err != nil {
+		t.Fatalf("BuildFromSpecifiers failed: %v", err)
+	}
+	want := []string{
+		"file:///app/main.js",
+		"file:///app/worker.js",
+		"file:///app/lib/a.js",
+		"file:///app/lazy.js",
+		"https://example.com/remote.js",
+		"file:///app/data.json",
+	}
+	if !slices.Equal(loaded, want) {
+		t.Errorf("loaded %q, want %q", loaded, want)
+	}
+	if got := archive.Specifiers(); !slices.Equal(got, want) {
+		t.Errorf("specifiers = %q", got)
+	}
+	if module := archive.GetModule("file:///app/data.json"); module == nil || module.Kind != ModuleKindJson {
+		t.Errorf("data.json = %+v, want a JSON module", module)
+	}
+	if sourceMap, _ := archive.GetModule("https://example.com/remote.js").SourceMap(ctx); string(sourceMap) != `{"version":3}` {
+		t.Errorf("remote source map = %q", sourceMap)
+	}
+	if entrypoints, err := archive.Entrypoints(ctx); err != nil || !slices.Equal(entrypoints, []string{"file:///app/main.js", "file:///app/worker.js"}) {
+		t.Errorf("Entrypoints = %q, %v", entrypoints, err)
+	}
+
+	_, err = BuildFromSpecifiers(ctx, files, []string{"file:///app/broken.js"})
+	if !errors.Is(err, fs.ErrNotExist) || !strings.Contains(err.Error(), "imported by file:///app/broken.js") {
+		t.Errorf("missing import error = %v", err)
+	}
+	if _, err := BuildFromSpecifiers(ctx, files, []string{"https://example.com/remote.js"}); err == nil {
+		t.Error("expected FSLoader to fail for an https specifier")
+	}
+}
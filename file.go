@@ -0,0 +1,200 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build !js
+
+package eszip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// AddModuleFromFile adds the file at path as a module under specifier, which
+// need not have anything to do with path, so archives built on different
+// machines can use the same specifiers. The module kind is detected from
+// the content and the extension of specifier, or of path if specifier has
+// none that DetectModuleKind knows, and is JavaScript otherwise. If t is
+// not nil the source is passed through Transpile first.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) AddModuleFromFile(path, specifier string, t Transpiler) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	kind, ok := DetectModuleKind(specifier, source)
+	if !ok {
+		if kind, ok = DetectModuleKind(filepath.ToSlash(path), source); !ok {
+			kind = ModuleKindJavaScript
+		}
+	}
+	code, sourceMap, err := Transpile(t, specifier, source)
+	if err != nil {
+		return err
+	}
+	e.AddModule(specifier, kind, code, sourceMap)
+	return nil
+}
+
+// ParseFile parses the eszip archive at path. The file size bounds every
+// section length, so a corrupt length field fails immediately instead of
+// triggering a large allocation. Sources are loaded and verified before it
+// returns, by the same streaming parser as ParseSync, so the archive is
+// checked as ParseBytes checks it and its trailing bytes are kept; see
+// Preserved. OpenFile reads V2 archives with ReadAt instead, leaving their
+// sources in the file until they are asked for.
+func ParseFile(ctx context.Context, path string, opts ...ParseOption) (_ *EszipUnion, retErr error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err := f.Close(); err != nil && retErr == nil {
+			retErr = err
+		}
+	}()
+
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append(opts[:len(opts):len(opts)], WithInputSize(stat.Size()))
+	return ParseSync(ctx, f, opts...)
+}
+
+// ArchiveFile is an archive opened with OpenFile. It must be closed once
+// neither it nor its modules are in use.
+type ArchiveFile struct {
+	*EszipUnion
+	content *fileContent
+}
+
+// Close releases the file. Content already returned stays valid; reading
+// content afterwards fails with an ErrIO ParseError.
+func (f *ArchiveFile) Close() error {
+	return f.content.Close()
+}
+
+// OpenFile opens the archive at path without reading its sources. The file
+// is memory-mapped where the platform allows, and read with ReadAt
+// otherwise. A V2 archive is parsed as by ParseV2Lazy: only the headers
+// are read, and each Source or SourceMap call reads its content from the
+// file and verifies it, so looking up one module of a large archive costs
+// little more than its headers. A V1 archive is parsed in full and the
+// file released at once.
+//
+// The file must not be truncated while it is open; on most platforms
+// reading a mapped page past the new end crashes the program.
+func OpenFile(ctx context.Context, path string, opts ...ParseOption) (*ArchiveFile, error) {
+	return openFile(ctx, path, mmapFile, opts)
+}
+
+// openFile is OpenFile with the mapping function as a parameter, so that
+// the ReadAt fallback can be tested.
+func openFile(ctx context.Context, path string, mmap func(*os.File, int64) ([]byte, func() error, error), opts []ParseOption) (_ *ArchiveFile, retErr error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	size := stat.Size()
+
+	content := &fileContent{r: f, close: f.Close}
+	if data, unmap, err := mmap(f, size); err == nil {
+		// The mapping outlives the descriptor.
+		if err := f.Close(); err != nil {
+			unmap()
+			return nil, err
+		}
+		content = &fileContent{r: bytes.NewReader(data), close: unmap}
+	}
+	defer func() {
+		if retErr != nil {
+			content.Close()
+		}
+	}()
+
+	opts = append(opts[:len(opts):len(opts)], WithInputSize(size))
+	magic := make([]byte, 8)
+	if n, _ := content.ReadAt(magic, 0); n == len(magic) {
+		if _, ok := VersionFromMagic(magic); ok {
+			archive, err := ParseV2Lazy(ctx, content, opts...)
+			if err != nil {
+				return nil, err
+			}
+			return &ArchiveFile{EszipUnion: &EszipUnion{v2: archive}, content: content}, nil
+		}
+	}
+	archive, err := ParseSync(ctx, io.NewSectionReader(content, 0, size), opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := content.Close(); err != nil {
+		return nil, err
+	}
+	return &ArchiveFile{EszipUnion: archive, content: content}, nil
+}
+
+// errMmapUnavailable is returned by mmapFile where a file cannot be mapped.
+var errMmapUnavailable = errors.New("eszip: memory mapping unavailable")
+
+// fileContent is the content of an open archive file, which readers stop
+// reaching once it is closed.
+type fileContent struct {
+	mu    sync.RWMutex
+	r     io.ReaderAt // nil once closed
+	close func() error
+}
+
+func (c *fileContent) ReadAt(p []byte, off int64) (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.r == nil {
+		return 0, os.ErrClosed
+	}
+	return c.r.ReadAt(p, off)
+}
+
+// Close releases the content, waiting for reads in progress. Closing twice
+// does nothing.
+func (c *fileContent) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.r == nil {
+		return nil
+	}
+	c.r = nil
+	return c.close()
+}
+
+// AddNpmPackageDir adds every regular file under dir, such as a package
+// unpacked from its tarball, as a file of the npm package id; see
+// AddNpmPackageFile. Files are added in lexical order. Symbolic links and
+// other irregular files are skipped.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) AddNpmPackageDir(id *NpmPackageID, dir string) error {
+	fsys := os.DirFS(dir)
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, path)
+		if err != nil {
+			return err
+		}
+		return e.AddNpmPackageFile(id, path, content)
+	})
+}
@@ -0,0 +1,12 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build !js && !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package eszip
+
+import "os"
+
+// mmapFile always fails here, so OpenFile reads the file with ReadAt.
+func mmapFile(*os.File, int64) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnavailable
+}
@@ -0,0 +1,412 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build !js
+
+package eszip
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseFileCorruptLengthNearEOF(t *testing.T) {
+	ctx := context.Background()
+
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///test.js", ModuleKindJavaScript, []byte("hello world"), nil)
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+
+	// With no checksums the sources section length directly precedes the
+	// first source. Claim far more bytes than the file holds.
+	idx := bytes.Index(data, []byte("hello world"))
+	if idx < 4 {
+		t.Fatal("could not find source content in serialized data")
+	}
+	binary.BigEndian.PutUint32(data[idx-4:idx], 0x7fffffff)
+
+	path := filepath.Join(t.TempDir(), "corrupt.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	_, err = ParseFile(ctx, path)
+	var pe *ParseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected ParseError, got %T: %v", err, err)
+	}
+	if pe.Type != ErrInvalidV2SectionLength {
+		t.Errorf("expected ErrInvalidV2SectionLength, got %v", pe.Type)
+	}
+	if pe.Offset != idx {
+		t.Errorf("expected offset %d, got %d", idx, pe.Offset)
+	}
+	if !strings.Contains(pe.Error(), "2147483647") {
+		t.Errorf("expected declared length in error, got %q", pe.Error())
+	}
+}
+
+func TestParseFileLarge(t *testing.T) {
+	ctx := context.Background()
+
+	source := bytes.Repeat([]byte("x"), 4<<20)
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumXxh3)
+	eszip.AddModule("file:///big.js", ModuleKindJavaScript, source, []byte("{}"))
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "big.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	parsed, err := ParseFile(ctx, path)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	got, err := parsed.GetModule("file:///big.js").Source(ctx)
+	if err != nil {
+		t.Fatalf("failed to get source: %v", err)
+	}
+	if !bytes.Equal(got, source) {
+		t.Errorf("source mismatch: got %d bytes, want %d", len(got), len(source))
+	}
+}
+
+func TestParseFileLoadsSources(t *testing.T) {
+	ctx := context.Background()
+	source := []byte("export const a = 1;")
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumSha256)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, source, []byte("{}"))
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "a.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	parsed, err := ParseFile(ctx, path)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	// Nothing is read from the file once ParseFile returns.
+	if err := os.WriteFile(path, make([]byte, len(data)), 0644); err != nil {
+		t.Fatalf("failed to overwrite: %v", err)
+	}
+	v2, _ := parsed.V2()
+	entry, _ := v2.modules.Get("file:///a.js")
+	for _, slot := range []*SourceSlot{entry.(*ModuleData).Source, entry.(*ModuleData).SourceMap} {
+		if state := slot.State(); state != SourceSlotReady {
+			t.Errorf("slot state = %v, want SourceSlotReady", state)
+		}
+	}
+	if got, err := parsed.GetModule("file:///a.js").Source(ctx); err != nil || !bytes.Equal(got, source) {
+		t.Errorf("source = %q, %v; want %q", got, err, source)
+	}
+
+	// Corrupt content fails ParseFile itself, not a later Source call.
+	data[bytes.Index(data, source)] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	_, err = ParseFile(ctx, path)
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceHash {
+		t.Errorf("ParseFile error = %v, want ErrInvalidV2SourceHash", err)
+	}
+}
+
+func TestParseFileTrailing(t *testing.T) {
+	ctx := context.Background()
+	eszip := NewV2()
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	trailing := []byte("TRAILINGSECTION")
+	data = append(data, trailing...)
+	path := filepath.Join(t.TempDir(), "trailing.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	parsed, err := ParseFile(ctx, path)
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	v2, _ := parsed.V2()
+	if got := v2.Preserved().Trailing; !bytes.Equal(got, trailing) {
+		t.Errorf("Trailing = %q, want %q", got, trailing)
+	}
+	out, err := v2.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	if !bytes.Equal(out, data) {
+		t.Errorf("round trip wrote %d bytes, want the %d read", len(out), len(data))
+	}
+}
+
+func TestParseFileUnreferencedContent(t *testing.T) {
+	ctx := context.Background()
+	eszip := NewV2()
+	eszip.SetChecksum(ChecksumNone)
+	eszip.AddModule("file:///a.js", ModuleKindJavaScript, []byte("hello"), nil)
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("failed to serialize: %v", err)
+	}
+	// Grow the sources section by bytes no header refers to.
+	idx := bytes.Index(data, []byte("hello"))
+	binary.BigEndian.PutUint32(data[idx-4:idx], uint32(len("hello")+len("extra")))
+	data = slices.Insert(data, idx+len("hello"), []byte("extra")...)
+	path := filepath.Join(t.TempDir(), "unreferenced.eszip2")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+
+	_, want := ParseBytes(ctx, data)
+	_, err = ParseFile(ctx, path)
+	var pe *ParseError
+	if !errors.As(err, &pe) || pe.Type != ErrInvalidV2SourceOffset {
+		t.Fatalf("ParseFile error = %v, want ErrInvalidV2SourceOffset", err)
+	}
+	if want == nil || err.Error() != want.Error() {
+		t.Errorf("ParseFile error = %v, ParseBytes error = %v", err, want)
+	}
+}
+
+func TestAddModuleFromFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ts := write("main.ts", "let x: number = 1;")
+	data := write("data", "{}")
+
+	transpiler := TranspilerFunc(func(specifier string, source []byte) ([]byte, []byte, error) {
+		return []byte("let x = 1;"), []byte("{}"), nil
+	})
+	eszip := NewV2()
+	if err := eszip.AddModuleFromFile(ts, "file:///src/main.ts", transpiler); err != nil {
+		t.Fatalf("AddModuleFromFile failed: %v", err)
+	}
+	// The specifier's extension decides the kind even if the path has none.
+	if err := eszip.AddModuleFromFile(data, "file:///src/data.json", nil); err != nil {
+		t.Fatalf("AddModuleFromFile failed: %v", err)
+	}
+	if err := eszip.AddModuleFromFile(data, "https://example.com/mod", nil); err != nil {
+		t.Fatalf("AddModuleFromFile failed: %v", err)
+	}
+	if err := eszip.AddModuleFromFile(filepath.Join(dir, "missing.js"), "file:///missing.js", nil); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing file: err = %v, want os.ErrNotExist", err)
+	}
+
+	for specifier, want := range map[string]struct {
+		kind              ModuleKind
+		source, sourceMap string
+	}{
+		"file:///src/main.ts":     {ModuleKindJavaScript, "let x = 1;", "{}"},
+		"file:///src/data.json":   {ModuleKindJson, "{}", ""},
+		"https://example.com/mod": {ModuleKindJavaScript, "{}", ""},
+	} {
+		module := eszip.GetModule(specifier)
+		if module == nil {
+			t.Fatalf("%s not added", specifier)
+		}
+		source, _ := module.Source(ctx)
+		sourceMap, _ := module.SourceMap(ctx)
+		if module.Kind != want.kind || string(source) != want.source || string(sourceMap) != want.sourceMap {
+			t.Errorf("%s = %v %q %q, want %v %q %q", specifier, module.Kind, source, sourceMap, want.kind, want.source, want.sourceMap)
+		}
+	}
+}
+
+func TestParseFileV1(t *testing.T) {
+	parsed, err := ParseFile(context.Background(), "testdata/basic.json")
+	if err != nil {
+		t.Fatalf("ParseFile failed: %v", err)
+	}
+	if !parsed.IsV1() {
+		t.Fatal("expected V1 eszip")
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	ctx := context.Background()
+	noMmap := func(*os.File, int64) ([]byte, func() error, error) {
+		return nil, nil, errMmapUnavailable
+	}
+	opens := map[string]func(string) (*ArchiveFile, error){
+		"mmap": func(path string) (*ArchiveFile, error) { return OpenFile(ctx, path) },
+		"read_at": func(path string) (*ArchiveFile, error) {
+			return openFile(ctx, path, noMmap, nil)
+		},
+	}
+	for name, open := range opens {
+		t.Run(name, func(t *testing.T) {
+			for _, file := range []string{"json.eszip2", "redirect.eszip2", "wasm.eszip2_3", "basic.json"} {
+				path := filepath.Join("testdata", file)
+				want, err := ParseFile(ctx, path)
+				if err != nil {
+					t.Fatalf("ParseFile(%s) failed: %v", file, err)
+				}
+				archive, err := open(path)
+				if err != nil {
+					t.Fatalf("open(%s) failed: %v", file, err)
+				}
+				if equal, diff, err := Equal(ctx, want, archive.EszipUnion, EqualOptions{}); err != nil || !equal {
+					t.Errorf("%s: opened archive differs: %v %v", file, diff, err)
+				}
+				if err := archive.Close(); err != nil {
+					t.Errorf("%s: Close failed: %v", file, err)
+				}
+				if err := archive.Close(); err != nil {
+					t.Errorf("%s: second Close failed: %v", file, err)
+				}
+			}
+
+			path := filepath.Join(t.TempDir(), "app.eszip2")
+			v2 := NewV2()
+			v2.AddModule("file:///a.js", ModuleKindJavaScript, []byte("a"), nil)
+			data, err := v2.IntoBytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			archive, err := open(path)
+			if err != nil {
+				t.Fatalf("open failed: %v", err)
+			}
+			opened, _ := archive.V2()
+			if entry, _ := opened.modules.Get("file:///a.js"); entry.(*ModuleData).Source.State() != SourceSlotLazy {
+				t.Error("expected the source to be left in the file")
+			}
+			module := archive.GetModule("file:///a.js")
+			source, err := module.Source(ctx)
+			if err != nil || string(source) != "a" {
+				t.Errorf("Source = %q, %v", source, err)
+			}
+			archive.Close()
+			if string(source) != "a" {
+				t.Error("content changed after Close")
+			}
+			var perr *ParseError
+			if _, err := module.Source(ctx); !errors.As(err, &perr) || perr.Type != ErrIO {
+				t.Errorf("Source after Close error = %v, want an ErrIO ParseError", err)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		if _, err := OpenFile(ctx, filepath.Join(t.TempDir(), "missing.eszip2")); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("missing file error = %v", err)
+		}
+		empty := filepath.Join(t.TempDir(), "empty.eszip2")
+		if err := os.WriteFile(empty, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := OpenFile(ctx, empty); err == nil {
+			t.Error("expected error for an empty file")
+		}
+	})
+}
+
+func TestAddNpmPackageDir(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"package.json":   `{"name":"chalk","main":"index.js"}`,
+		"index.js":       `import "./lib/util.js";`,
+		"lib/util.js":    `export {};`,
+		"lib/empty.d.ts": ``,
+	} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("index.js", filepath.Join(dir, "link.js")); err != nil {
+		t.Logf("no symlink: %v", err)
+	}
+
+	eszip := NewV2()
+	eszip.AddModule("file:///main.js", ModuleKindJavaScript, []byte(`import "npm:chalk";`), nil)
+	chalk := &NpmPackageID{Name: "chalk", Version: "5.3.0"}
+	if err := eszip.AddNpmPackageDir(chalk, dir); err != nil {
+		t.Fatalf("AddNpmPackageDir failed: %v", err)
+	}
+	if err := eszip.AddNpmPackageDir(&NpmPackageID{Name: "chalk"}, dir); err == nil {
+		t.Error("expected an error for a package ID without a version")
+	}
+	if err := eszip.AddNpmPackageFile(chalk, "../escape.js", nil); err == nil {
+		t.Error("expected an error for a path outside the package")
+	}
+
+	data, err := eszip.IntoBytes()
+	if err != nil {
+		t.Fatalf("IntoBytes failed: %v", err)
+	}
+	parsed, err := ParseBytes(ctx, data)
+	if err != nil {
+		t.Fatalf("ParseBytes failed: %v", err)
+	}
+	want := []string{
+		"file:///main.js",
+		"npm:///chalk@5.3.0/index.js",
+		"npm:///chalk@5.3.0/lib/empty.d.ts",
+		"npm:///chalk@5.3.0/lib/util.js",
+		"npm:///chalk@5.3.0/package.json",
+	}
+	if got := parsed.Specifiers(); !slices.Equal(got, want) {
+		t.Errorf("specifiers = %v, want %v", got, want)
+	}
+	m := parsed.GetModule("npm:///chalk@5.3.0/index.js")
+	if m == nil || m.Kind != ModuleKindOpaqueData {
+		t.Fatalf("index.js = %v, want opaque data", m)
+	}
+	if source, _ := m.Source(ctx); string(source) != `import "./lib/util.js";` {
+		t.Errorf("index.js source = %q", source)
+	}
+
+	// Package files are neither graph nodes nor pruned.
+	graph, err := BuildModuleGraph(ctx, parsed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := graph.Modules(); !slices.Equal(got, []string{"file:///main.js"}) {
+		t.Errorf("graph modules = %v", got)
+	}
+	removed, err := eszip.Prune(ctx, "file:///main.js")
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Prune = %v, %v, want nothing removed", removed, err)
+	}
+}
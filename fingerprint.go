@@ -0,0 +1,127 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// fingerprintPrefix starts every fingerprint's input, so a change to what
+// is hashed can change the prefix rather than silently reusing old keys.
+const fingerprintPrefix = "eszip fingerprint v1\n"
+
+// Fingerprint returns a SHA-256 digest of the archive's logical content,
+// for use as a cache key. See FingerprintContext.
+func (e *EszipV2) Fingerprint() ([32]byte, error) {
+	return e.FingerprintContext(context.Background())
+}
+
+// FingerprintContext returns a SHA-256 digest of the specifiers, module
+// kinds, headers, auxiliary data, sources, source maps and redirect targets
+// of the archive and of its npm snapshot, integrity data included. Entry order, format version,
+// checksum, compression and encryption do not affect it, so archives that
+// Equal reports as equal have the same fingerprint, and an archive keeps its
+// fingerprint through Normalize, repacking and conversion between formats.
+// Sources still streaming in are waited for on ctx.
+func (e *EszipV2) FingerprintContext(ctx context.Context) ([32]byte, error) {
+	return (&EszipUnion{v2: e}).fingerprint(ctx)
+}
+
+// Fingerprint returns the fingerprint of the archive, V1 or V2. A V1
+// archive's modules count as JavaScript without source maps, so it has the
+// fingerprint of the V2 archive it converts to. See
+// EszipV2.FingerprintContext.
+func (e *EszipUnion) Fingerprint(ctx context.Context) ([32]byte, error) {
+	return e.fingerprint(ctx)
+}
+
+func (e *EszipUnion) fingerprint(ctx context.Context) ([32]byte, error) {
+	h := sha256.New()
+	h.Write([]byte(fingerprintPrefix))
+
+	entries := e.equalEntries()
+	for _, spec := range slices.Sorted(maps.Keys(entries)) {
+		entry := entries[spec]
+		writeFingerprintString(h, spec)
+		if entry.data == nil {
+			h.Write([]byte{byte(HeaderFrameRedirect)})
+			writeFingerprintString(h, entry.target)
+			continue
+		}
+		h.Write([]byte{byte(HeaderFrameModule), byte(entry.data.Kind)})
+		writeFingerprintLen(h, len(entry.data.Headers))
+		for _, key := range slices.Sorted(maps.Keys(entry.data.Headers)) {
+			writeFingerprintString(h, key)
+			writeFingerprintString(h, entry.data.Headers[key])
+		}
+		writeFingerprintLen(h, len(entry.data.Aux))
+		for _, name := range slices.Sorted(maps.Keys(entry.data.Aux)) {
+			writeFingerprintString(h, name)
+			writeFingerprintString(h, string(entry.data.Aux[name]))
+		}
+		for _, slot := range []*SourceSlot{entry.data.Source, entry.data.SourceMap} {
+			content, err := slot.Get(ctx)
+			if err != nil {
+				return [32]byte{}, err
+			}
+			writeFingerprintLen(h, len(content))
+			h.Write(content)
+		}
+	}
+
+	// The npm snapshot is hashed as its roots and packages, each sorted,
+	// whatever order the archive stores them in.
+	snapshot := e.npmSnapshot()
+	var roots map[string]*NpmPackageID
+	var packages []*NpmPackage
+	if snapshot != nil {
+		roots = snapshot.RootPackages
+		packages = slices.SortedFunc(slices.Values(snapshot.Packages), func(a, b *NpmPackage) int {
+			return strings.Compare(a.ID.String(), b.ID.String())
+		})
+	}
+	writeFingerprintLen(h, len(roots))
+	for _, req := range slices.Sorted(maps.Keys(roots)) {
+		writeFingerprintString(h, req)
+		writeFingerprintString(h, roots[req].String())
+	}
+	writeFingerprintLen(h, len(packages))
+	for _, pkg := range packages {
+		writeFingerprintString(h, pkg.ID.String())
+		writeFingerprintLen(h, len(pkg.Dependencies))
+		for _, req := range slices.Sorted(maps.Keys(pkg.Dependencies)) {
+			writeFingerprintString(h, req)
+			writeFingerprintString(h, pkg.Dependencies[req].String())
+		}
+	}
+	// Integrity data came later, so it is hashed after everything else and
+	// only when there is some, keeping the fingerprints of archives
+	// without it as they were.
+	if hasNpmIntegrity(snapshot) {
+		for _, pkg := range packages {
+			writeFingerprintString(h, pkg.Integrity)
+			writeFingerprintString(h, pkg.Tarball)
+		}
+	}
+
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum, nil
+}
+
+// writeFingerprintLen writes n as a big-endian u64, so that the fields
+// around it cannot be mistaken for one another.
+func writeFingerprintLen(h hash.Hash, n int) {
+	h.Write(binary.BigEndian.AppendUint64(nil, uint64(n)))
+}
+
+func writeFingerprintString(h hash.Hash, s string) {
+	writeFingerprintLen(h, len(s))
+	h.Write([]byte(s))
+}
@@ -0,0 +1,281 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// GraphEdge is an import of one module by another.
+type GraphEdge struct {
+	// From is the importing module.
+	From string
+	// To is the imported module, with redirects followed. For unresolved
+	// imports it is the specifier the import resolved to outside the
+	// archive, or empty if it could not be resolved at all.
+	To string
+	// Specifier is the import as written in From.
+	Specifier string
+	// Dynamic is set for import("...") calls.
+	Dynamic bool
+}
+
+// ModuleGraph is the import graph of the modules in an archive, as found
+// by scanning each JavaScript module with ScanImports. Its nodes are the
+// archive's modules other than the import map and embedded npm package
+// files, named by the specifier they are stored under; redirects are
+// followed rather than being nodes of their own.
+type ModuleGraph struct {
+	// modules lists the nodes in archive order.
+	modules []string
+	// canonical maps every specifier in the archive, including redirects,
+	// to the module it leads to.
+	canonical  map[string]string
+	edges      map[string][]GraphEdge
+	importers  map[string][]string
+	unresolved []GraphEdge
+}
+
+// BuildModuleGraph scans the JavaScript modules of e for imports,
+// re-exports and string-literal dynamic imports, and resolves them the way
+// Deno does: relative specifiers against the importing module, bare ones
+// through the archive's import map. Imports of node: and npm: specifiers
+// are left out, since the runtime provides them. Sources still streaming
+// in are waited for on ctx.
+func BuildModuleGraph(ctx context.Context, e *EszipUnion) (*ModuleGraph, error) {
+	g := &ModuleGraph{
+		canonical: make(map[string]string),
+		edges:     make(map[string][]GraphEdge),
+		importers: make(map[string][]string),
+	}
+	var imports *ImportMap
+	importMap := e.Summary().ImportMap
+	if importMap != "" {
+		if m := e.GetImportMap(importMap); m != nil {
+			source, err := m.Source(ctx)
+			if err != nil {
+				return nil, err
+			}
+			// A malformed import map maps nothing.
+			imports, _ = ParseImportMap(importMap, source)
+		}
+	}
+
+	var sources []*Module
+	for specifier, module := range e.All() {
+		if specifier == importMap || isNpmFileSpecifier(specifier) {
+			continue
+		}
+		g.canonical[specifier] = module.Specifier
+		if specifier == module.Specifier {
+			g.modules = append(g.modules, specifier)
+			sources = append(sources, module)
+		}
+	}
+
+	for _, module := range sources {
+		if module.Kind != ModuleKindJavaScript {
+			continue
+		}
+		source, err := module.Source(ctx)
+		if err != nil {
+			return nil, err
+		}
+		seen := make(map[GraphEdge]bool)
+		for _, ref := range ScanImports(source) {
+			edge := GraphEdge{From: module.Specifier, Specifier: ref.Specifier, Dynamic: ref.Dynamic}
+			target, ok := resolveImport(module.Specifier, ref.Specifier, imports)
+			if ok && isBuiltinImport(target) {
+				continue
+			}
+			edge.To = target
+			if seen[edge] {
+				continue
+			}
+			seen[edge] = true
+			to, inArchive := g.canonical[target]
+			if !ok || !inArchive {
+				g.unresolved = append(g.unresolved, edge)
+				continue
+			}
+			edge.To = to
+			g.edges[edge.From] = append(g.edges[edge.From], edge)
+			if !slices.Contains(g.importers[to], edge.From) {
+				g.importers[to] = append(g.importers[to], edge.From)
+			}
+		}
+	}
+	return g, nil
+}
+
+// Modules returns the modules of the graph in archive order.
+func (g *ModuleGraph) Modules() []string {
+	return slices.Clone(g.modules)
+}
+
+// Imports returns the imports of a module that resolve to modules in the
+// archive, in source order. specifier may name a redirect.
+func (g *ModuleGraph) Imports(specifier string) []GraphEdge {
+	return slices.Clone(g.edges[g.canonical[specifier]])
+}
+
+// Importers returns the modules that import a module, in archive order of
+// their first import of it. specifier may name a redirect.
+func (g *ModuleGraph) Importers(specifier string) []string {
+	return slices.Clone(g.importers[g.canonical[specifier]])
+}
+
+// Edges returns every import between modules in the archive, grouped by
+// importing module in archive order.
+func (g *ModuleGraph) Edges() []GraphEdge {
+	var edges []GraphEdge
+	for _, spec := range g.modules {
+		edges = append(edges, g.edges[spec]...)
+	}
+	return edges
+}
+
+// Unresolved returns the imports of modules that are not in the archive,
+// such as remote modules that were not bundled or bare specifiers missing
+// from the import map.
+func (g *ModuleGraph) Unresolved() []GraphEdge {
+	return slices.Clone(g.unresolved)
+}
+
+// EntryPoints returns the modules no other module imports, in archive
+// order.
+func (g *ModuleGraph) EntryPoints() []string {
+	var entries []string
+	for _, spec := range g.modules {
+		importers := g.importers[spec]
+		if len(importers) == 0 || (len(importers) == 1 && importers[0] == spec) {
+			entries = append(entries, spec)
+		}
+	}
+	return entries
+}
+
+// Unreachable returns the modules that no chain of static or dynamic
+// imports leads to from roots, in archive order. Roots may name redirects;
+// those not in the archive are ignored. Without roots, the entry points
+// are used, so only modules imported solely from within import cycles are
+// reported.
+func (g *ModuleGraph) Unreachable(roots ...string) []string {
+	if len(roots) == 0 {
+		roots = g.EntryPoints()
+	}
+	reached := make(map[string]bool)
+	var stack []string
+	for _, root := range roots {
+		if spec, ok := g.canonical[root]; ok && !reached[spec] {
+			reached[spec] = true
+			stack = append(stack, spec)
+		}
+	}
+	for len(stack) > 0 {
+		spec := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		for _, edge := range g.edges[spec] {
+			if !reached[edge.To] {
+				reached[edge.To] = true
+				stack = append(stack, edge.To)
+			}
+		}
+	}
+
+	var unreachable []string
+	for _, spec := range g.modules {
+		if !reached[spec] {
+			unreachable = append(unreachable, spec)
+		}
+	}
+	return unreachable
+}
+
+// Cycles returns the groups of modules that import each other through
+// static imports, each in archive order: the strongly connected components
+// with more than one module, and modules that import themselves. Dynamic
+// imports are left out, since they do not constrain evaluation order.
+// Groups are ordered by their first module.
+func (g *ModuleGraph) Cycles() [][]string {
+	order := make(map[string]int, len(g.modules))
+	for i, spec := range g.modules {
+		order[spec] = i
+	}
+
+	// Tarjan's algorithm.
+	index := make(map[string]int)
+	lowlink := make(map[string]int)
+	onStack := make(map[string]bool)
+	var stack []string
+	var cycles [][]string
+	var connect func(spec string)
+	connect = func(spec string) {
+		index[spec] = len(index)
+		lowlink[spec] = index[spec]
+		stack = append(stack, spec)
+		onStack[spec] = true
+
+		selfImport := false
+		for _, edge := range g.edges[spec] {
+			if edge.Dynamic {
+				continue
+			}
+			if edge.To == spec {
+				selfImport = true
+			}
+			if _, visited := index[edge.To]; !visited {
+				connect(edge.To)
+				lowlink[spec] = min(lowlink[spec], lowlink[edge.To])
+			} else if onStack[edge.To] {
+				lowlink[spec] = min(lowlink[spec], index[edge.To])
+			}
+		}
+
+		if lowlink[spec] != index[spec] {
+			return
+		}
+		i := slices.Index(stack, spec)
+		component := slices.Clone(stack[i:])
+		for _, member := range component {
+			onStack[member] = false
+		}
+		stack = stack[:i]
+		if len(component) > 1 || selfImport {
+			slices.SortFunc(component, func(a, b string) int { return order[a] - order[b] })
+			cycles = append(cycles, component)
+		}
+	}
+	for _, spec := range g.modules {
+		if _, visited := index[spec]; !visited {
+			connect(spec)
+		}
+	}
+
+	slices.SortFunc(cycles, func(a, b []string) int { return order[a[0]] - order[b[0]] })
+	return cycles
+}
+
+// resolveImport resolves specifier through imports, which may be nil, and
+// drops any fragment from the result.
+func resolveImport(referrer, specifier string, imports *ImportMap) (string, bool) {
+	target, ok := imports.Resolve(referrer, specifier)
+	if !ok {
+		return "", false
+	}
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", false
+	}
+	u.Fragment = ""
+	return u.String(), true
+}
+
+// isBuiltinImport reports whether a resolved specifier is provided by the
+// runtime rather than the archive.
+func isBuiltinImport(specifier string) bool {
+	return strings.HasPrefix(specifier, "node:") || strings.HasPrefix(specifier, "npm:")
+}
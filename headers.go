@@ -0,0 +1,103 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"encoding/binary"
+	"maps"
+	"slices"
+)
+
+// The module headers section of V2.4 follows the npm section. For each
+// module with headers, in archive order, it holds the specifier, the
+// number of headers and then each key and value, sorted by key. Strings
+// are prefixed with their length as a big-endian u32.
+
+// appendModuleHeaders returns the content of the module headers section
+// for entries.
+func appendModuleHeaders(buf []byte, keys []string, entries []EszipV2Module) []byte {
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok || len(data.Headers) == 0 {
+			continue
+		}
+		appendString(&buf, specifier)
+		buf = appendU32BE(buf, uint32(len(data.Headers)))
+		for _, key := range slices.Sorted(maps.Keys(data.Headers)) {
+			appendString(&buf, key)
+			appendString(&buf, data.Headers[key])
+		}
+	}
+	return buf
+}
+
+// parseModuleHeadersSection reads the module headers section and attaches
+// the headers to the modules of modules.
+func parseModuleHeadersSection(br *archiveReader, options Options, modules *ModuleMap) error {
+	start := br.offset
+	section, err := readSection(br, options)
+	if err != nil {
+		return err
+	}
+	br.reportSection("module_headers", start)
+
+	if !br.checksumValid(section) {
+		return errInvalidV24ModuleHeadersHash(section)
+	}
+
+	content := section.Content()
+	read := 0
+	readString := func(what string) (string, error) {
+		if read+4 > len(content) {
+			return "", errInvalidV24ModuleHeaders(what+" len", section.offset+read)
+		}
+		n := int(binary.BigEndian.Uint32(content[read : read+4]))
+		read += 4
+		if n > len(content)-read {
+			return "", errInvalidV24ModuleHeaders(what, section.offset+read)
+		}
+		s := string(content[read : read+n])
+		read += n
+		return s, nil
+	}
+
+	for read < len(content) {
+		offset := section.offset + read
+		specifier, err := readString("specifier")
+		if err != nil {
+			return err
+		}
+		entry, _ := modules.Get(specifier)
+		data, ok := entry.(*ModuleData)
+		if !ok {
+			return errInvalidV24ModuleHeaders("headers for "+specifier+", which is not a module", offset)
+		}
+		if data.Headers != nil {
+			return errInvalidV24ModuleHeaders("duplicate headers for "+specifier, offset)
+		}
+
+		if read+4 > len(content) {
+			return errInvalidV24ModuleHeaders("header count", section.offset+read)
+		}
+		count := int(binary.BigEndian.Uint32(content[read : read+4]))
+		read += 4
+		// Each header takes at least its two length prefixes.
+		if count > (len(content)-read)/8 {
+			return errInvalidV24ModuleHeaders("header count", section.offset+read-4)
+		}
+		headers := make(map[string]string, count)
+		for range count {
+			key, err := readString("header key")
+			if err != nil {
+				return err
+			}
+			value, err := readString("header value")
+			if err != nil {
+				return err
+			}
+			headers[key] = value
+		}
+		data.Headers = headers
+	}
+	return nil
+}
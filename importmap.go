@@ -0,0 +1,150 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// ImportMap is a parsed import map, or the "imports" and "scopes" of a
+// deno.json configuration file. Keys that look like URLs and every target
+// are resolved against the specifier the map was parsed with.
+type ImportMap struct {
+	// Imports maps specifiers, and prefixes ending in "/", to URLs.
+	Imports map[string]string
+	// Scopes maps URL prefixes to imports that apply only to modules whose
+	// specifier starts with them.
+	Scopes map[string]map[string]string
+}
+
+// ParseImportMap parses an import map, which may be JSONC, that lives at
+// specifier. As in browsers and Deno, entries whose target is not a valid
+// URL, and prefix entries whose target does not end in "/", are ignored.
+func ParseImportMap(specifier string, source []byte) (*ImportMap, error) {
+	var parsed struct {
+		Imports map[string]string            `json:"imports"`
+		Scopes  map[string]map[string]string `json:"scopes"`
+	}
+	if err := json.Unmarshal(stripJSONC(source), &parsed); err != nil {
+		return nil, fmt.Errorf("import map %s: %w", specifier, err)
+	}
+	base, err := url.Parse(specifier)
+	if err != nil {
+		return nil, fmt.Errorf("import map %s: %w", specifier, err)
+	}
+	m := &ImportMap{Imports: normalizeImports(base, parsed.Imports)}
+	if len(parsed.Scopes) > 0 {
+		m.Scopes = make(map[string]map[string]string, len(parsed.Scopes))
+		for prefix, imports := range parsed.Scopes {
+			ref, err := url.Parse(prefix)
+			if err != nil {
+				continue
+			}
+			m.Scopes[base.ResolveReference(ref).String()] = normalizeImports(base, imports)
+		}
+	}
+	return m, nil
+}
+
+// normalizeImports resolves the URL-like keys and the targets of imports
+// against base.
+func normalizeImports(base *url.URL, imports map[string]string) map[string]string {
+	normalized := make(map[string]string, len(imports))
+	for key, target := range imports {
+		if key == "" {
+			continue
+		}
+		if u, ok := parseURLLike(base, key); ok {
+			key = u.String()
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			continue
+		}
+		target = base.ResolveReference(ref).String()
+		if strings.HasSuffix(key, "/") && !strings.HasSuffix(target, "/") {
+			continue
+		}
+		normalized[key] = target
+	}
+	return normalized
+}
+
+// Resolve returns the URL that specifier, imported by referrer, refers to.
+// Relative specifiers resolve against referrer. The most specific scope
+// that contains referrer is consulted first, then the top-level imports,
+// each by exact match and then by the longest matching prefix. URLs the
+// map does not remap stand for themselves; bare specifiers it does not map
+// do not resolve. A nil map resolves only URLs and relative specifiers.
+func (m *ImportMap) Resolve(referrer, specifier string) (string, bool) {
+	base, err := url.Parse(referrer)
+	if err != nil {
+		return "", false
+	}
+	asURL, isURL := parseURLLike(base, specifier)
+	normalized := specifier
+	if isURL {
+		normalized = asURL.String()
+	}
+
+	if m != nil {
+		scopes := make([]string, 0, len(m.Scopes))
+		for prefix := range m.Scopes {
+			if prefix == referrer || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(referrer, prefix)) {
+				scopes = append(scopes, prefix)
+			}
+		}
+		// Longer prefixes are more specific.
+		slices.SortFunc(scopes, func(a, b string) int { return len(b) - len(a) })
+		for _, prefix := range scopes {
+			if target, ok := matchImports(normalized, m.Scopes[prefix]); ok {
+				return target, true
+			}
+		}
+		if target, ok := matchImports(normalized, m.Imports); ok {
+			return target, true
+		}
+	}
+	if isURL {
+		return normalized, true
+	}
+	return "", false
+}
+
+// matchImports looks specifier up in imports, exact matches first and then
+// the longest key ending in "/" that prefixes it.
+func matchImports(specifier string, imports map[string]string) (string, bool) {
+	if target, ok := imports[specifier]; ok {
+		return target, true
+	}
+	best := ""
+	for key := range imports {
+		if strings.HasSuffix(key, "/") && strings.HasPrefix(specifier, key) && len(key) > len(best) {
+			best = key
+		}
+	}
+	if best == "" {
+		return "", false
+	}
+	return imports[best] + strings.TrimPrefix(specifier, best), true
+}
+
+// parseURLLike resolves specifier against base if it is relative ("./",
+// "../" or "/") or an absolute URL, and reports false for bare specifiers.
+func parseURLLike(base *url.URL, specifier string) (*url.URL, bool) {
+	if strings.HasPrefix(specifier, "./") || strings.HasPrefix(specifier, "../") || strings.HasPrefix(specifier, "/") {
+		ref, err := url.Parse(specifier)
+		if err != nil {
+			return nil, false
+		}
+		return base.ResolveReference(ref), true
+	}
+	if u, err := url.Parse(specifier); err == nil && u.Scheme != "" {
+		return u, true
+	}
+	return nil, false
+}
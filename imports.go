@@ -0,0 +1,324 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+// ImportRef is a module specifier found in JavaScript source by
+// ScanImports.
+type ImportRef struct {
+	Specifier string
+	// Start and End are the byte offsets of the specifier in the source,
+	// excluding its quotes.
+	Start, End int
+	// Dynamic is set for import("...") calls with a string literal
+	// argument; static imports and re-exports leave it false.
+	Dynamic bool
+}
+
+// ScanImports returns the specifiers of the static imports, re-exports and
+// string-literal dynamic imports in a JavaScript or TypeScript module, in
+// source order. It is a lexical scan, not a parser: it skips comments,
+// strings, template literals and regular expressions, and recognises
+// import and export statements by their shape. Specifiers containing
+// escape sequences are reported as written.
+func ScanImports(source []byte) []ImportRef {
+	s := &importScanner{src: source}
+	s.scan()
+	return s.refs
+}
+
+type importScanner struct {
+	src  []byte
+	pos  int
+	refs []ImportRef
+	// prev is the last significant byte before pos, and prevWord the last
+	// identifier if that byte ended one; they tell a regular expression
+	// from a division.
+	prev     byte
+	prevWord string
+	// moduleSyntax is set by an import or export statement, and
+	// commonJS by a reference to require, module or exports.
+	moduleSyntax bool
+	commonJS     bool
+}
+
+func (s *importScanner) scan() {
+	for s.pos < len(s.src) {
+		c := s.src[s.pos]
+		switch {
+		case s.skipTrivia():
+		case c == '"' || c == '\'':
+			s.skipString()
+			s.setPrev('"', "")
+		case c == '`':
+			s.skipTemplate()
+			s.setPrev('`', "")
+		case c == '/' && s.regexAllowed():
+			s.skipRegex()
+			s.setPrev('/', "")
+		case isIdentStart(c):
+			afterDot := s.prev == '.'
+			word := s.readWord()
+			if !afterDot {
+				switch word {
+				case "import":
+					s.importStatement()
+				case "export":
+					s.moduleSyntax = true
+					s.exportStatement()
+				case "require", "module", "exports":
+					s.commonJS = true
+				}
+			}
+		default:
+			s.pos++
+			s.setPrev(c, "")
+		}
+	}
+}
+
+func (s *importScanner) setPrev(c byte, word string) {
+	s.prev, s.prevWord = c, word
+}
+
+// skipTrivia skips whitespace and comments at pos and reports whether there
+// were any.
+func (s *importScanner) skipTrivia() bool {
+	start := s.pos
+	for s.pos < len(s.src) {
+		switch c := s.src[s.pos]; {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' || c == '\v':
+			s.pos++
+		case c == '/' && s.peek(1) == '/':
+			for s.pos < len(s.src) && s.src[s.pos] != '\n' {
+				s.pos++
+			}
+		case c == '/' && s.peek(1) == '*':
+			s.pos += 2
+			for s.pos < len(s.src) && !(s.src[s.pos] == '*' && s.peek(1) == '/') {
+				s.pos++
+			}
+			s.pos = min(s.pos+2, len(s.src))
+		default:
+			return s.pos > start
+		}
+	}
+	return s.pos > start
+}
+
+func (s *importScanner) peek(n int) byte {
+	if s.pos+n < len(s.src) {
+		return s.src[s.pos+n]
+	}
+	return 0
+}
+
+// skipString skips the string literal at pos and returns its content
+// offsets.
+func (s *importScanner) skipString() (start, end int) {
+	quote := s.src[s.pos]
+	s.pos++
+	start = s.pos
+	for s.pos < len(s.src) {
+		switch s.src[s.pos] {
+		case '\\':
+			s.pos += 2
+			continue
+		case quote:
+			end = s.pos
+			s.pos++
+			return start, end
+		case '\n':
+			// Unterminated; resume scanning on the next line.
+			return start, s.pos
+		}
+		s.pos++
+	}
+	s.pos = len(s.src)
+	return start, s.pos
+}
+
+// skipTemplate skips the template literal at pos, including any
+// substitutions.
+func (s *importScanner) skipTemplate() {
+	s.pos++
+	for s.pos < len(s.src) {
+		switch s.src[s.pos] {
+		case '\\':
+			s.pos += 2
+			continue
+		case '`':
+			s.pos++
+			return
+		case '$':
+			if s.peek(1) == '{' {
+				s.pos += 2
+				s.skipBraces(1)
+				continue
+			}
+		}
+		s.pos++
+	}
+}
+
+// skipBraces skips code until depth unmatched closing braces have been
+// consumed.
+func (s *importScanner) skipBraces(depth int) {
+	for s.pos < len(s.src) && depth > 0 {
+		c := s.src[s.pos]
+		switch {
+		case s.skipTrivia():
+		case c == '"' || c == '\'':
+			s.skipString()
+		case c == '`':
+			s.skipTemplate()
+		default:
+			switch c {
+			case '{':
+				depth++
+			case '}':
+				depth--
+			}
+			s.pos++
+		}
+	}
+}
+
+// regexAllowed reports whether a '/' at pos starts a regular expression
+// rather than a division, judging by what precedes it.
+func (s *importScanner) regexAllowed() bool {
+	switch {
+	case s.prevWord != "":
+		switch s.prevWord {
+		case "return", "typeof", "case", "do", "else", "in", "of", "new",
+			"delete", "void", "throw", "instanceof", "yield", "await":
+			return true
+		}
+		return false
+	case s.prev == ')' || s.prev == ']' || s.prev == '}' || s.prev == '"' || s.prev == '`' || s.prev == '/':
+		return false
+	case s.prev >= '0' && s.prev <= '9':
+		return false
+	}
+	return true
+}
+
+func (s *importScanner) skipRegex() {
+	s.pos++
+	inClass := false
+	for s.pos < len(s.src) {
+		switch s.src[s.pos] {
+		case '\\':
+			s.pos += 2
+			continue
+		case '[':
+			inClass = true
+		case ']':
+			inClass = false
+		case '/':
+			if !inClass {
+				s.pos++
+				for s.pos < len(s.src) && isIdentPart(s.src[s.pos]) {
+					s.pos++
+				}
+				return
+			}
+		case '\n':
+			return
+		}
+		s.pos++
+	}
+}
+
+func (s *importScanner) readWord() string {
+	start := s.pos
+	for s.pos < len(s.src) && isIdentPart(s.src[s.pos]) {
+		s.pos++
+	}
+	word := string(s.src[start:s.pos])
+	s.setPrev(s.src[s.pos-1], word)
+	return word
+}
+
+// addString records the string literal at pos as a specifier.
+func (s *importScanner) addString(dynamic bool) {
+	start, end := s.skipString()
+	s.refs = append(s.refs, ImportRef{Specifier: string(s.src[start:end]), Start: start, End: end, Dynamic: dynamic})
+	s.setPrev('"', "")
+}
+
+// importStatement handles what follows the import keyword: a side-effect
+// import, an import clause ending in from "...", import(...) or
+// import.meta.
+func (s *importScanner) importStatement() {
+	s.skipTrivia()
+	switch c := s.peek(0); {
+	case c == '"' || c == '\'':
+		s.moduleSyntax = true
+		s.addString(false)
+	case c == '(':
+		s.pos++
+		s.setPrev('(', "")
+		s.skipTrivia()
+		if c := s.peek(0); c == '"' || c == '\'' {
+			s.addString(true)
+		}
+	case c == '.':
+		// import.meta, which only modules have.
+		s.moduleSyntax = true
+	default:
+		s.moduleSyntax = true
+		s.fromClause()
+	}
+}
+
+// exportStatement handles a re-export: export * from "...", export * as ns
+// from "..." or export { ... } from "...".
+func (s *importScanner) exportStatement() {
+	s.skipTrivia()
+	if c := s.peek(0); c == '*' || c == '{' {
+		s.fromClause()
+	}
+}
+
+// fromClause scans an import or export clause and records the specifier
+// after its from keyword. It gives up at anything that cannot be part of a
+// clause, leaving pos there.
+func (s *importScanner) fromClause() {
+	depth := 0
+	for s.pos < len(s.src) {
+		c := s.src[s.pos]
+		switch {
+		case s.skipTrivia():
+		case c == '{':
+			depth++
+			s.pos++
+		case c == '}':
+			depth--
+			s.pos++
+			s.setPrev('}', "")
+		case c == ',' || c == '*':
+			s.pos++
+		case (c == '"' || c == '\'') && depth > 0:
+			// An arbitrary module namespace name, { "a-b" as ab }.
+			s.skipString()
+		case isIdentStart(c):
+			if s.readWord() == "from" && depth == 0 {
+				s.skipTrivia()
+				if c := s.peek(0); c == '"' || c == '\'' {
+					s.addString(false)
+				}
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c >= 0x80
+}
+
+func isIdentPart(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
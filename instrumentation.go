@@ -0,0 +1,77 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import "sync/atomic"
+
+// Instrumentation receives byte-level reports of parse and serialize
+// activity, e.g. to feed metrics. Methods are called synchronously from the
+// goroutine doing the work and must not block. Leaving instrumentation unset
+// costs a single nil check at each reporting point.
+type Instrumentation interface {
+	// SectionRead reports that a section of the archive was consumed. n is
+	// its full encoded size, including length prefix and hash, so the
+	// reports of a successful parse sum to the archive size. kind is one of
+	// "magic", "options", "modules", "npm", "module_headers", "module_aux",
+	// "npm_integrity", "sources", "source_maps" or "v1_json".
+	SectionRead(kind string, n int)
+	// SourceLoaded reports that n bytes of source or source map content
+	// were loaded for specifier. verified is true when a checksum was
+	// checked for it.
+	SourceLoaded(specifier string, n int, verified bool)
+	// WriteProgress reports that n more bytes of output were produced. The
+	// reports of one serialization sum to the size of the output.
+	WriteProgress(n int)
+}
+
+// Progress receives coarse reports of how far a parse or serialization
+// has got, such as to drive a progress bar; see WithProgress and
+// WithWriteProgress. Either hook may be nil. Hooks are called
+// synchronously from the goroutine doing the work and should return
+// quickly.
+type Progress struct {
+	// OnSectionRead is called as a parse consumes the archive: after each
+	// section, and within the sources and source maps sections after each
+	// entry. name is the section, as for Instrumentation.SectionRead. read
+	// is the number of archive bytes consumed so far and total the archive
+	// size, or -1 if it is unknown; see WithInputSize.
+	OnSectionRead func(name string, read, total int64)
+	// OnModuleWritten is called once for every entry of an archive being
+	// serialized, once everything the archive holds for it has been
+	// written: its header entry, source and source map. written is the
+	// number of bytes written so far and total the size of the output.
+	OnModuleWritten func(specifier string, written, total int64)
+}
+
+// Counters is an Instrumentation that totals what it is told. It is safe
+// for concurrent use.
+type Counters struct {
+	BytesRead     atomic.Int64
+	Sections      atomic.Int64
+	SourcesLoaded atomic.Int64
+	SourceBytes   atomic.Int64
+	BytesVerified atomic.Int64
+	BytesWritten  atomic.Int64
+}
+
+var _ Instrumentation = (*Counters)(nil)
+
+// SectionRead implements Instrumentation.
+func (c *Counters) SectionRead(_ string, n int) {
+	c.Sections.Add(1)
+	c.BytesRead.Add(int64(n))
+}
+
+// SourceLoaded implements Instrumentation.
+func (c *Counters) SourceLoaded(_ string, n int, verified bool) {
+	c.SourcesLoaded.Add(1)
+	c.SourceBytes.Add(int64(n))
+	if verified {
+		c.BytesVerified.Add(int64(n))
+	}
+}
+
+// WriteProgress implements Instrumentation.
+func (c *Counters) WriteProgress(n int) {
+	c.BytesWritten.Add(int64(n))
+}
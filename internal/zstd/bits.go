@@ -0,0 +1,119 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+)
+
+// backwardReader reads a bitstream that was written forwards, as FSE and
+// Huffman streams are, from its end: the highest set bit of the last byte
+// marks where the bits stop, and they are read downwards from there.
+type backwardReader struct {
+	in []byte
+	// pos is the number of bits left to read. It goes negative once reads
+	// run past the start of the stream.
+	pos int
+}
+
+func newBackwardReader(in []byte) (backwardReader, error) {
+	if len(in) == 0 || in[len(in)-1] == 0 {
+		return backwardReader{}, errCorrupt
+	}
+	last := in[len(in)-1]
+	return backwardReader{in: in, pos: (len(in)-1)*8 + bits.Len8(last) - 1}, nil
+}
+
+// peek returns the next n bits, n <= 56, without consuming them. Bits
+// before the start of the stream read as zeros.
+func (r *backwardReader) peek(n uint) uint64 {
+	if n == 0 {
+		return 0
+	}
+	start := r.pos - int(n)
+	if start >= 0 {
+		return r.at(start, n)
+	}
+	short := uint(-start)
+	if short >= n {
+		return 0
+	}
+	return r.at(0, n-short) << short
+}
+
+// at returns the n bits starting at bit start.
+func (r *backwardReader) at(start int, n uint) uint64 {
+	i := start >> 3
+	var v uint64
+	if i+8 <= len(r.in) {
+		v = binary.LittleEndian.Uint64(r.in[i:])
+	} else {
+		for j := 0; i+j < len(r.in); j++ {
+			v |= uint64(r.in[i+j]) << (8 * j)
+		}
+	}
+	return v >> (uint(start) & 7) & (1<<n - 1)
+}
+
+func (r *backwardReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos -= int(n)
+	return v
+}
+
+// overflowed reports whether more bits were read than the stream holds.
+func (r *backwardReader) overflowed() bool {
+	return r.pos < 0
+}
+
+// forwardReader reads bits from the start of a buffer upwards, as the
+// FSE table descriptions are written.
+type forwardReader struct {
+	in  []byte
+	pos int
+}
+
+func (r *forwardReader) peek(n uint) uint64 {
+	var v uint64
+	i := r.pos >> 3
+	for j := 0; j < 8 && i+j < len(r.in); j++ {
+		v |= uint64(r.in[i+j]) << (8 * j)
+	}
+	return v >> (uint(r.pos) & 7) & (1<<n - 1)
+}
+
+func (r *forwardReader) read(n uint) uint64 {
+	v := r.peek(n)
+	r.pos += int(n)
+	return v
+}
+
+// bitWriter writes a bitstream forwards, for reading by backwardReader.
+type bitWriter struct {
+	out   []byte
+	acc   uint64
+	nbits uint
+}
+
+// add writes the low n bits of v, n <= 32.
+func (w *bitWriter) add(v uint64, n uint) {
+	w.acc |= (v & (1<<n - 1)) << w.nbits
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc >>= 8
+		w.nbits -= 8
+	}
+}
+
+// close ends the stream with the marker bit a reader starts from and
+// returns it.
+func (w *bitWriter) close() []byte {
+	w.add(1, 1)
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+		w.acc, w.nbits = 0, 0
+	}
+	return w.out
+}
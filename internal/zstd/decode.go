@@ -0,0 +1,427 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// Decompress returns the content of the Zstandard frames in src, skipping
+// skippable frames. It fails with ErrTooLarge rather than produce more
+// than limit bytes.
+func Decompress(src []byte, limit int64) ([]byte, error) {
+	var out []byte
+	for len(src) > 0 {
+		if len(src) < 4 {
+			return nil, errCorrupt
+		}
+		magic := binary.LittleEndian.Uint32(src)
+		if magic&skippableMagicMask == skippableMagic {
+			if len(src) < 8 {
+				return nil, errCorrupt
+			}
+			size := uint64(binary.LittleEndian.Uint32(src[4:]))
+			if size > uint64(len(src)-8) {
+				return nil, errCorrupt
+			}
+			src = src[8+size:]
+			continue
+		}
+		if magic != frameMagic {
+			return nil, errors.New("zstd: not a Zstandard frame")
+		}
+		var err error
+		if out, src, err = decodeFrame(out, src[4:], limit); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// frameDecoder holds what the blocks of a frame carry over to the next.
+type frameDecoder struct {
+	huff   *huffTable
+	tables [3]*fseTable
+	rep    [3]int
+	// start is where the frame's content begins in the output, which its
+	// matches cannot reach behind.
+	start int
+	limit int64
+}
+
+// decodeFrame appends the content of the frame at the start of src, after
+// its magic, to out and returns what follows the frame.
+func decodeFrame(out, src []byte, limit int64) ([]byte, []byte, error) {
+	if len(src) < 1 {
+		return nil, nil, errCorrupt
+	}
+	fhd := src[0]
+	p := 1
+	if fhd&8 != 0 {
+		return nil, nil, errCorrupt
+	}
+	single := fhd&0x20 != 0
+	checksum := fhd&4 != 0
+	window := uint64(0)
+	if !single {
+		if len(src) < p+1 {
+			return nil, nil, errCorrupt
+		}
+		exponent, mantissa := src[p]>>3, src[p]&7
+		base := uint64(1) << (10 + exponent)
+		window = base + base/8*uint64(mantissa)
+		p++
+	}
+	dictSize := [4]int{0, 1, 2, 4}[fhd&3]
+	if len(src) < p+dictSize {
+		return nil, nil, errCorrupt
+	}
+	for _, b := range src[p : p+dictSize] {
+		if b != 0 {
+			return nil, nil, errors.New("zstd: dictionaries are not supported")
+		}
+	}
+	p += dictSize
+	fcsSize := [4]int{0, 2, 4, 8}[fhd>>6]
+	if fhd>>6 == 0 && single {
+		fcsSize = 1
+	}
+	if len(src) < p+fcsSize {
+		return nil, nil, errCorrupt
+	}
+	var fcs uint64
+	for i := fcsSize - 1; i >= 0; i-- {
+		fcs = fcs<<8 | uint64(src[p+i])
+	}
+	if fcsSize == 2 {
+		fcs += 256
+	}
+	p += fcsSize
+	if single {
+		window = fcs
+	}
+	start := len(out)
+	if fcsSize > 0 {
+		if fcs > uint64(limit-int64(start)) {
+			return nil, nil, ErrTooLarge
+		}
+		if grow := min(fcs, 1<<20); uint64(cap(out)-len(out)) < grow {
+			out = append(make([]byte, 0, len(out)+int(grow)), out...)
+		}
+	}
+	blockMax := int(min(window, maxBlockSize))
+
+	d := &frameDecoder{rep: [3]int{1, 4, 8}, start: start, limit: limit}
+	for last := false; !last; {
+		if len(src) < p+3 {
+			return nil, nil, errCorrupt
+		}
+		h := uint32(src[p]) | uint32(src[p+1])<<8 | uint32(src[p+2])<<16
+		p += 3
+		last = h&1 != 0
+		size := int(h >> 3)
+		switch h >> 1 & 3 {
+		case blockRaw:
+			if size > blockMax || len(src) < p+size {
+				return nil, nil, errCorrupt
+			}
+			out = append(out, src[p:p+size]...)
+			p += size
+		case blockRLE:
+			if size > blockMax || len(src) < p+1 {
+				return nil, nil, errCorrupt
+			}
+			for i := 0; i < size; i++ {
+				out = append(out, src[p])
+			}
+			p++
+		case blockCompressed:
+			if size > blockMax || len(src) < p+size {
+				return nil, nil, errCorrupt
+			}
+			var err error
+			if out, err = d.decodeBlock(out, src[p:p+size], blockMax); err != nil {
+				return nil, nil, err
+			}
+			p += size
+		default:
+			return nil, nil, errCorrupt
+		}
+		if int64(len(out)) > limit {
+			return nil, nil, ErrTooLarge
+		}
+	}
+	if fcsSize > 0 && uint64(len(out)-start) != fcs {
+		return nil, nil, errors.New("zstd: frame content size mismatch")
+	}
+	if checksum {
+		if len(src) < p+4 {
+			return nil, nil, errCorrupt
+		}
+		if uint32(xxhash64(out[start:])) != binary.LittleEndian.Uint32(src[p:]) {
+			return nil, nil, errors.New("zstd: checksum mismatch")
+		}
+		p += 4
+	}
+	return out, src[p:], nil
+}
+
+// decodeBlock appends the content of a compressed block to out.
+func (d *frameDecoder) decodeBlock(out, in []byte, blockMax int) ([]byte, error) {
+	lits, n, err := d.decodeLiterals(in, blockMax)
+	if err != nil {
+		return nil, err
+	}
+	blockStart := len(out)
+	if out, err = d.decodeSequences(out, in[n:], lits); err != nil {
+		return nil, err
+	}
+	if len(out)-blockStart > blockMax {
+		return nil, errCorrupt
+	}
+	return out, nil
+}
+
+// decodeLiterals reads the literals section at the start of in, returning
+// the literals and the bytes the section took.
+func (d *frameDecoder) decodeLiterals(in []byte, blockMax int) ([]byte, int, error) {
+	if len(in) == 0 {
+		return nil, 0, errCorrupt
+	}
+	typ := in[0] & 3
+	format := in[0] >> 2 & 3
+	switch typ {
+	case literalsRaw, literalsRLE:
+		var size, hdr int
+		switch format {
+		case 0, 2:
+			size, hdr = int(in[0]>>3), 1
+		case 1:
+			if len(in) < 2 {
+				return nil, 0, errCorrupt
+			}
+			size, hdr = int(in[0]>>4)|int(in[1])<<4, 2
+		case 3:
+			if len(in) < 3 {
+				return nil, 0, errCorrupt
+			}
+			size, hdr = int(in[0]>>4)|int(in[1])<<4|int(in[2])<<12, 3
+		}
+		if size > blockMax {
+			return nil, 0, errCorrupt
+		}
+		if typ == literalsRaw {
+			if len(in) < hdr+size {
+				return nil, 0, errCorrupt
+			}
+			return in[hdr : hdr+size], hdr + size, nil
+		}
+		if len(in) < hdr+1 {
+			return nil, 0, errCorrupt
+		}
+		lits := make([]byte, size)
+		for i := range lits {
+			lits[i] = in[hdr]
+		}
+		return lits, hdr + 1, nil
+	}
+
+	var regen, comp, hdr int
+	switch format {
+	case 0, 1:
+		if len(in) < 3 {
+			return nil, 0, errCorrupt
+		}
+		v := int(in[0]) | int(in[1])<<8 | int(in[2])<<16
+		regen, comp, hdr = v>>4&0x3FF, v>>14&0x3FF, 3
+	case 2:
+		if len(in) < 4 {
+			return nil, 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(in))
+		regen, comp, hdr = v>>4&0x3FFF, v>>18&0x3FFF, 4
+	case 3:
+		if len(in) < 5 {
+			return nil, 0, errCorrupt
+		}
+		v := int(binary.LittleEndian.Uint32(in)) | int(in[4])<<32
+		regen, comp, hdr = v>>4&0x3FFFF, v>>22&0x3FFFF, 5
+	}
+	if regen > blockMax || len(in) < hdr+comp {
+		return nil, 0, errCorrupt
+	}
+	data := in[hdr : hdr+comp]
+	if typ == literalsCompressed {
+		t, n, err := readHuffman(data)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.huff = t
+		data = data[n:]
+	} else if d.huff == nil {
+		return nil, 0, errCorrupt
+	}
+	lits := make([]byte, regen)
+	var err error
+	if format == 0 {
+		err = d.huff.decode(lits, data)
+	} else {
+		err = d.huff.decode4(lits, data)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return lits, hdr + comp, nil
+}
+
+// decodeSequences reads the sequences section in and executes it against
+// lits, appending the result to out.
+func (d *frameDecoder) decodeSequences(out, in, lits []byte) ([]byte, error) {
+	if len(in) == 0 {
+		return nil, errCorrupt
+	}
+	count := int(in[0])
+	p := 1
+	switch {
+	case count == 0:
+		if len(in) != 1 {
+			return nil, errCorrupt
+		}
+		return append(out, lits...), nil
+	case count == 255:
+		if len(in) < 3 {
+			return nil, errCorrupt
+		}
+		count = int(in[1]) | int(in[2])<<8 + 0x7F00
+		p = 3
+	case count >= 128:
+		if len(in) < 2 {
+			return nil, errCorrupt
+		}
+		count = (count-128)<<8 | int(in[1])
+		p = 2
+	}
+	if len(in) < p+1 {
+		return nil, errCorrupt
+	}
+	modes := in[p]
+	p++
+	if modes&3 != 0 {
+		return nil, errCorrupt
+	}
+	var tables [3]*fseTable
+	for i, shift := range [3]uint{6, 4, 2} {
+		t, n, err := d.table(i, modes>>shift&3, in[p:])
+		if err != nil {
+			return nil, err
+		}
+		tables[i] = t
+		p += n
+	}
+
+	r, err := newBackwardReader(in[p:])
+	if err != nil {
+		return nil, err
+	}
+	var ll, of, ml fseState
+	ll.init(tables[tableLL], &r)
+	of.init(tables[tableOF], &r)
+	ml.init(tables[tableML], &r)
+	for i := 0; i < count; i++ {
+		ofCode, mlCode, llCode := of.symbol(), ml.symbol(), ll.symbol()
+		offsetValue := 1<<ofCode + int(r.read(uint(ofCode)))
+		matchLen := int(mlBase[mlCode]) + int(r.read(uint(mlBits[mlCode])))
+		litLen := int(llBase[llCode]) + int(r.read(uint(llBits[llCode])))
+		if i < count-1 {
+			ll.update(&r)
+			ml.update(&r)
+			of.update(&r)
+		}
+
+		offset := d.offset(offsetValue, litLen)
+		if litLen > len(lits) {
+			return nil, errCorrupt
+		}
+		out = append(out, lits[:litLen]...)
+		lits = lits[litLen:]
+		if offset <= 0 || offset > len(out)-d.start {
+			return nil, errCorrupt
+		}
+		if int64(len(out)+matchLen) > d.limit {
+			return nil, ErrTooLarge
+		}
+		from := len(out) - offset
+		if offset >= matchLen {
+			out = append(out, out[from:from+matchLen]...)
+		} else {
+			for j := 0; j < matchLen; j++ {
+				out = append(out, out[from+j])
+			}
+		}
+	}
+	if r.pos != 0 {
+		return nil, errCorrupt
+	}
+	return append(out, lits...), nil
+}
+
+// offset turns an offset value into an offset, updating the repeat
+// offsets.
+func (d *frameDecoder) offset(value, litLen int) int {
+	if value > 3 {
+		d.rep = [3]int{value - 3, d.rep[0], d.rep[1]}
+		return d.rep[0]
+	}
+	index := value - 1
+	if litLen == 0 {
+		index++
+	}
+	var offset int
+	switch index {
+	case 0:
+		return d.rep[0]
+	case 3:
+		offset = d.rep[0] - 1
+	default:
+		offset = d.rep[index]
+	}
+	if index > 1 {
+		d.rep[2] = d.rep[1]
+	}
+	d.rep[1] = d.rep[0]
+	d.rep[0] = offset
+	return offset
+}
+
+// table returns the decoding table of kind for mode, reading its
+// description from in when it has one, and the bytes that took.
+func (d *frameDecoder) table(kind int, mode byte, in []byte) (*fseTable, int, error) {
+	switch mode {
+	case 0:
+		d.tables[kind] = predefinedTables[kind]
+		return d.tables[kind], 0, nil
+	case 1:
+		if len(in) < 1 || int(in[0]) > maxSymbols[kind] {
+			return nil, 0, errCorrupt
+		}
+		d.tables[kind] = rleTable(in[0])
+		return d.tables[kind], 1, nil
+	case 2:
+		norm, log, n, err := readNCount(in, maxSymbols[kind], maxLogs[kind])
+		if err != nil {
+			return nil, 0, err
+		}
+		t, err := buildFSE(norm, log)
+		if err != nil {
+			return nil, 0, err
+		}
+		d.tables[kind] = t
+		return t, n, nil
+	default:
+		if d.tables[kind] == nil {
+			return nil, 0, errCorrupt
+		}
+		return d.tables[kind], 0, nil
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+const (
+	hashLog  = 17
+	minMatch = 4
+	// maxChain bounds how many earlier positions are tried for a match.
+	maxChain = 48
+	// maxOffset keeps offset codes within what every decoder must accept.
+	maxOffset = 1<<27 - 4
+)
+
+// Compress returns src as a single Zstandard frame that records its
+// content size and checksum.
+func Compress(src []byte) []byte {
+	out := make([]byte, 0, len(src)/2+32)
+	out = binary.LittleEndian.AppendUint32(out, frameMagic)
+	n := uint64(len(src))
+	// A single segment frame: the window is the whole content, so the
+	// header has no window descriptor.
+	const singleSegment, checksum = 0x20, 0x04
+	switch {
+	case n < 256:
+		out = append(out, singleSegment|checksum, byte(n))
+	case n < 256+1<<16:
+		out = append(out, 1<<6|singleSegment|checksum)
+		out = binary.LittleEndian.AppendUint16(out, uint16(n-256))
+	case n <= math.MaxUint32:
+		out = append(out, 2<<6|singleSegment|checksum)
+		out = binary.LittleEndian.AppendUint32(out, uint32(n))
+	default:
+		out = append(out, 3<<6|singleSegment|checksum)
+		out = binary.LittleEndian.AppendUint64(out, n)
+	}
+	if len(src) == 0 {
+		out = appendBlockHeader(out, true, blockRaw, 0)
+	}
+	e := newEncoder(src)
+	for start := 0; start < len(src); start += maxBlockSize {
+		end := min(start+maxBlockSize, len(src))
+		out = e.appendBlock(out, start, end, end == len(src))
+	}
+	return binary.LittleEndian.AppendUint32(out, uint32(xxhash64(src)))
+}
+
+func appendBlockHeader(out []byte, last bool, typ, size int) []byte {
+	h := typ<<1 | size<<3
+	if last {
+		h |= 1
+	}
+	return append(out, byte(h), byte(h>>8), byte(h>>16))
+}
+
+// encoder finds matches over the whole of src, so blocks can refer back
+// into earlier ones.
+type encoder struct {
+	src []byte
+	// head holds, per hash, the last position inserted plus one, and chain
+	// the position before it with the same hash plus one.
+	head  []int32
+	chain []int32
+	// next is the first position not yet inserted.
+	next int
+}
+
+// sequence is literals followed by a match.
+type sequence struct {
+	litLen, matchLen, offsetValue uint32
+}
+
+func newEncoder(src []byte) *encoder {
+	return &encoder{src: src, head: make([]int32, 1<<hashLog), chain: make([]int32, len(src))}
+}
+
+func (e *encoder) appendBlock(out []byte, start, end int, last bool) []byte {
+	block := e.src[start:end]
+	if allSame(block) {
+		out = appendBlockHeader(out, last, blockRLE, len(block))
+		return append(out, block[0])
+	}
+	if body := e.compressBlock(start, end); len(body) < len(block) {
+		out = appendBlockHeader(out, last, blockCompressed, len(body))
+		return append(out, body...)
+	}
+	out = appendBlockHeader(out, last, blockRaw, len(block))
+	return append(out, block...)
+}
+
+func allSame(b []byte) bool {
+	for _, c := range b {
+		if c != b[0] {
+			return false
+		}
+	}
+	return len(b) > 1
+}
+
+func (e *encoder) compressBlock(start, end int) []byte {
+	seqs, lits := e.parse(start, end)
+	out := appendLiterals(nil, lits)
+	return appendSequences(out, seqs)
+}
+
+func hash4(v uint32) uint32 {
+	return v * 2654435761 >> (32 - hashLog)
+}
+
+func (e *encoder) load32(i int) uint32 {
+	return binary.LittleEndian.Uint32(e.src[i:])
+}
+
+// insert adds the positions before upto to the hash chains.
+func (e *encoder) insert(upto int) {
+	for ; e.next < upto && e.next+minMatch <= len(e.src); e.next++ {
+		h := hash4(e.load32(e.next))
+		e.chain[e.next] = e.head[h]
+		e.head[h] = int32(e.next + 1)
+	}
+	e.next = max(e.next, upto)
+}
+
+// findMatch returns the longest match for pos that ends by end.
+func (e *encoder) findMatch(pos, end int) (length, offset int) {
+	if pos+minMatch > end {
+		return 0, 0
+	}
+	e.insert(pos)
+	v := e.load32(pos)
+	cand := int(e.head[hash4(v)]) - 1
+	for depth := 0; cand >= 0 && depth < maxChain; depth++ {
+		if pos-cand > maxOffset {
+			break
+		}
+		if e.load32(cand) == v {
+			l := minMatch
+			for pos+l < end && e.src[cand+l] == e.src[pos+l] {
+				l++
+			}
+			if l > length {
+				length, offset = l, pos-cand
+				if pos+l == end {
+					break
+				}
+			}
+		}
+		cand = int(e.chain[cand]) - 1
+	}
+	return length, offset
+}
+
+// parse splits src[start:end] into sequences and the literals they take,
+// deferring a match by a byte when that finds a longer one.
+func (e *encoder) parse(start, end int) ([]sequence, []byte) {
+	var seqs []sequence
+	var lits []byte
+	anchor, pos := start, start
+	for pos+minMatch <= end {
+		length, offset := e.findMatch(pos, end)
+		if length < minMatch {
+			pos++
+			continue
+		}
+		if l, o := e.findMatch(pos+1, end); l > length {
+			pos, length, offset = pos+1, l, o
+		}
+		seqs = append(seqs, sequence{uint32(pos - anchor), uint32(length), uint32(offset + 3)})
+		lits = append(lits, e.src[anchor:pos]...)
+		pos += length
+		anchor = pos
+	}
+	return seqs, append(lits, e.src[anchor:end]...)
+}
+
+// appendLiterals appends the literals section for lits, Huffman-coded
+// when that is smaller.
+func appendLiterals(out, lits []byte) []byte {
+	if allSame(lits) {
+		out = appendLiteralsHeader(out, literalsRLE, len(lits))
+		return append(out, lits[0])
+	}
+	if len(lits) >= 32 {
+		if section := huffmanLiterals(lits); section != nil && len(section) < len(lits) {
+			return append(out, section...)
+		}
+	}
+	out = appendLiteralsHeader(out, literalsRaw, len(lits))
+	return append(out, lits...)
+}
+
+// appendLiteralsHeader appends the header of a raw or RLE literals
+// section.
+func appendLiteralsHeader(out []byte, typ, size int) []byte {
+	switch {
+	case size < 32:
+		return append(out, byte(typ|size<<3))
+	case size < 4096:
+		h := typ | 1<<2 | size<<4
+		return append(out, byte(h), byte(h>>8))
+	default:
+		h := typ | 3<<2 | size<<4
+		return append(out, byte(h), byte(h>>8), byte(h>>16))
+	}
+}
+
+// huffmanLiterals returns the Huffman-coded literals section for lits, or
+// nil if their code cannot be described.
+func huffmanLiterals(lits []byte) []byte {
+	var counts [256]int
+	for _, b := range lits {
+		counts[b]++
+	}
+	h := newHuffEncoder(&counts)
+	desc := h.description()
+	if desc == nil {
+		return nil
+	}
+	// One stream for short literals, as the reference encoder does; the
+	// jump table is not worth it.
+	single := len(lits) < 256
+	var body []byte
+	body = append(body, desc...)
+	if single {
+		body = h.encode(body, lits)
+	} else {
+		body = h.encode4(body, lits)
+	}
+	regen, comp := len(lits), len(body)
+	var format, sizeBits, size int
+	switch {
+	case single && comp < 1<<10:
+		format, sizeBits, size = 0, 10, 3
+	case single:
+		return nil
+	case regen < 1<<10 && comp < 1<<10:
+		format, sizeBits, size = 1, 10, 3
+	case regen < 1<<14 && comp < 1<<14:
+		format, sizeBits, size = 2, 14, 4
+	case regen < 1<<18 && comp < 1<<18:
+		format, sizeBits, size = 3, 18, 5
+	default:
+		return nil
+	}
+	h64 := uint64(literalsCompressed) | uint64(format)<<2 | uint64(regen)<<4 | uint64(comp)<<(4+sizeBits)
+	out := make([]byte, 0, size+comp)
+	for i := 0; i < size; i++ {
+		out = append(out, byte(h64>>(8*i)))
+	}
+	return append(out, body...)
+}
+
+// appendSequences appends the sequences section for seqs, coded with the
+// predefined tables.
+func appendSequences(out []byte, seqs []sequence) []byte {
+	n := len(seqs)
+	switch {
+	case n < 128:
+		out = append(out, byte(n))
+	case n < 0x7F00:
+		out = append(out, byte(n>>8+128), byte(n))
+	default:
+		out = append(out, 255, byte(n-0x7F00), byte((n-0x7F00)>>8))
+	}
+	if n == 0 {
+		return out
+	}
+	out = append(out, 0)
+
+	llCodes := make([]uint8, n)
+	mlCodes := make([]uint8, n)
+	ofCodes := make([]uint8, n)
+	for i, s := range seqs {
+		llCodes[i] = litLenCode(s.litLen)
+		mlCodes[i] = matchLenCode(s.matchLen)
+		ofCodes[i] = uint8(bits.Len32(s.offsetValue) - 1)
+	}
+	extraBits := func(w *bitWriter, i int) {
+		s := seqs[i]
+		w.add(uint64(s.litLen-llBase[llCodes[i]]), uint(llBits[llCodes[i]]))
+		w.add(uint64(s.matchLen-mlBase[mlCodes[i]]), uint(mlBits[mlCodes[i]]))
+		w.add(uint64(s.offsetValue), uint(ofCodes[i]))
+	}
+
+	// The decoder reads the sequences from the end of the bitstream, so
+	// they are written last first.
+	w := bitWriter{out: out}
+	ll := predefinedEncoders[tableLL].init(llCodes[n-1])
+	of := predefinedEncoders[tableOF].init(ofCodes[n-1])
+	ml := predefinedEncoders[tableML].init(mlCodes[n-1])
+	extraBits(&w, n-1)
+	for i := n - 2; i >= 0; i-- {
+		of.encode(&w, ofCodes[i])
+		ml.encode(&w, mlCodes[i])
+		ll.encode(&w, llCodes[i])
+		extraBits(&w, i)
+	}
+	ml.flush(&w)
+	of.flush(&w)
+	ll.flush(&w)
+	return w.close()
+}
+
+func litLenCode(litLen uint32) uint8 {
+	if litLen < 16 {
+		return uint8(litLen)
+	}
+	code := len(llBase) - 1
+	for llBase[code] > litLen {
+		code--
+	}
+	return uint8(code)
+}
+
+func matchLenCode(matchLen uint32) uint8 {
+	if matchLen < 35 {
+		return uint8(matchLen - 3)
+	}
+	code := len(mlBase) - 1
+	for mlBase[code] > matchLen {
+		code--
+	}
+	return uint8(code)
+}
@@ -0,0 +1,330 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import "math/bits"
+
+// minTableLog is the smallest accuracy log a table description can state.
+const minTableLog = 5
+
+// fseEntry is one state of an FSE decoding table.
+type fseEntry struct {
+	symbol uint8
+	nbBits uint8
+	base   uint16
+}
+
+type fseTable struct {
+	log     uint8
+	entries []fseEntry
+}
+
+// spreadSymbols lays out the symbols of a distribution over a table of
+// 1<<log states, as both the decoder and encoder tables are built. The
+// symbols with probability "less than one" (-1) take the last states.
+func spreadSymbols(norm []int16, log uint8) ([]uint8, error) {
+	size := 1 << log
+	symbols := make([]uint8, size)
+	high := size - 1
+	for s, c := range norm {
+		if c == -1 {
+			symbols[high] = uint8(s)
+			high--
+		}
+	}
+	mask := size - 1
+	step := size>>1 + size>>3 + 3
+	pos := 0
+	for s, c := range norm {
+		for i := 0; i < int(c); i++ {
+			symbols[pos] = uint8(s)
+			for {
+				pos = (pos + step) & mask
+				if pos <= high {
+					break
+				}
+			}
+		}
+	}
+	if pos != 0 {
+		return nil, errCorrupt
+	}
+	return symbols, nil
+}
+
+// buildFSE builds the decoding table for the normalized distribution norm
+// at accuracy log.
+func buildFSE(norm []int16, log uint8) (*fseTable, error) {
+	symbols, err := spreadSymbols(norm, log)
+	if err != nil {
+		return nil, err
+	}
+	size := uint16(1) << log
+	next := make([]uint16, len(norm))
+	for s, c := range norm {
+		if c == -1 {
+			next[s] = 1
+		} else {
+			next[s] = uint16(c)
+		}
+	}
+	t := &fseTable{log: log, entries: make([]fseEntry, size)}
+	for u, s := range symbols {
+		n := next[s]
+		next[s]++
+		nb := log - uint8(bits.Len16(n)-1)
+		t.entries[u] = fseEntry{symbol: s, nbBits: nb, base: n<<nb - size}
+	}
+	return t, nil
+}
+
+// rleTable is the table of RLE_Mode: one state, always decoding symbol.
+func rleTable(symbol uint8) *fseTable {
+	return &fseTable{entries: []fseEntry{{symbol: symbol}}}
+}
+
+type fseState struct {
+	t     *fseTable
+	state uint16
+}
+
+func (s *fseState) init(t *fseTable, r *backwardReader) {
+	s.t = t
+	s.state = uint16(r.read(uint(t.log)))
+}
+
+func (s *fseState) symbol() uint8 {
+	return s.t.entries[s.state].symbol
+}
+
+func (s *fseState) update(r *backwardReader) {
+	e := s.t.entries[s.state]
+	s.state = e.base + uint16(r.read(uint(e.nbBits)))
+}
+
+// readNCount reads an FSE table description from the start of in,
+// returning the distribution, its accuracy log and the bytes it took.
+func readNCount(in []byte, maxSymbol int, maxLog uint8) ([]int16, uint8, int, error) {
+	r := forwardReader{in: in}
+	log := uint8(r.read(4)) + minTableLog
+	if log > maxLog {
+		return nil, 0, 0, errCorrupt
+	}
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := uint(log) + 1
+	var norm []int16
+	for remaining > 1 {
+		if len(norm) > maxSymbol {
+			return nil, 0, 0, errCorrupt
+		}
+		max := 2*threshold - 1 - remaining
+		v := int(r.peek(nbBits))
+		var count int
+		if v&(threshold-1) < max {
+			count = v & (threshold - 1)
+			r.pos += int(nbBits) - 1
+		} else {
+			count = v & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			r.pos += int(nbBits)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		norm = append(norm, int16(count))
+		if count == 0 {
+			for {
+				repeat := r.read(2)
+				for i := uint64(0); i < repeat; i++ {
+					norm = append(norm, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+			if len(norm) > maxSymbol+1 {
+				return nil, 0, 0, errCorrupt
+			}
+		}
+		if remaining < 1 {
+			return nil, 0, 0, errCorrupt
+		}
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || len(norm) > maxSymbol+1 {
+		return nil, 0, 0, errCorrupt
+	}
+	n := (r.pos + 7) / 8
+	if n > len(in) {
+		return nil, 0, 0, errCorrupt
+	}
+	return norm, log, n, nil
+}
+
+// appendNCount appends the description of the distribution norm, which
+// must sum to 1<<log, the inverse of readNCount.
+func appendNCount(out []byte, norm []int16, log uint8) []byte {
+	var w bitWriter
+	w.out = out
+	w.add(uint64(log-minTableLog), 4)
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	nbBits := uint(log) + 1
+	previous0 := false
+	for s := 0; s < len(norm) && remaining > 1; {
+		if previous0 {
+			start := s
+			for norm[s] == 0 {
+				s++
+			}
+			for s >= start+3 {
+				start += 3
+				w.add(3, 2)
+			}
+			w.add(uint64(s-start), 2)
+		}
+		count := int(norm[s])
+		s++
+		max := 2*threshold - 1 - remaining
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		count++
+		if count >= threshold {
+			count += max
+		}
+		if count < max {
+			w.add(uint64(count), nbBits-1)
+		} else {
+			w.add(uint64(count), nbBits)
+		}
+		previous0 = count == 1
+		for remaining < threshold {
+			nbBits--
+			threshold >>= 1
+		}
+	}
+	if w.nbits > 0 {
+		w.out = append(w.out, byte(w.acc))
+	}
+	return w.out
+}
+
+// normalize scales counts to a distribution summing to 1<<log in which
+// every present symbol keeps a probability of at least one state.
+func normalize(counts []int, total int, log uint8) []int16 {
+	size := 1 << log
+	norm := make([]int16, len(counts))
+	sum := 0
+	largest := 0
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		n := max(c*size/total, 1)
+		norm[s] = int16(n)
+		sum += n
+		if c > counts[largest] {
+			largest = s
+		}
+	}
+	norm[largest] += int16(size - sum)
+	for norm[largest] < 1 {
+		// Rounding small counts up took more than the largest symbol can
+		// give back: take the rest from the biggest other share.
+		biggest := -1
+		for s, n := range norm {
+			if s != largest && n > 1 && (biggest < 0 || n > norm[biggest]) {
+				biggest = s
+			}
+		}
+		norm[biggest]--
+		norm[largest]++
+	}
+	return norm
+}
+
+// fseTransform is how an encoder moves between states for one symbol.
+type fseTransform struct {
+	deltaNbBits    uint32
+	deltaFindState int32
+}
+
+type fseEncoder struct {
+	log        uint8
+	stateTable []uint16
+	symbols    []fseTransform
+}
+
+// newFSEEncoder builds the encoding table matching buildFSE(norm, log).
+func newFSEEncoder(norm []int16, log uint8) *fseEncoder {
+	symbols, err := spreadSymbols(norm, log)
+	if err != nil {
+		panic(err)
+	}
+	size := 1 << log
+	cumul := make([]int, len(norm)+1)
+	for s, c := range norm {
+		n := int(c)
+		if c == -1 {
+			n = 1
+		}
+		cumul[s+1] = cumul[s] + n
+	}
+	e := &fseEncoder{log: log, stateTable: make([]uint16, size), symbols: make([]fseTransform, len(norm))}
+	for u, s := range symbols {
+		e.stateTable[cumul[s]] = uint16(size + u)
+		cumul[s]++
+	}
+	total := 0
+	for s, c := range norm {
+		switch c {
+		case 0:
+			e.symbols[s].deltaNbBits = uint32(log+1)<<16 - uint32(size)
+		case -1, 1:
+			e.symbols[s] = fseTransform{uint32(log)<<16 - uint32(size), int32(total - 1)}
+			total++
+		default:
+			maxBitsOut := uint32(log) - uint32(bits.Len16(uint16(c-1))-1)
+			minStatePlus := uint32(c) << maxBitsOut
+			e.symbols[s] = fseTransform{maxBitsOut<<16 - minStatePlus, int32(total - int(c))}
+			total += int(c)
+		}
+	}
+	return e
+}
+
+type fseEncState struct {
+	e     *fseEncoder
+	value uint32
+}
+
+// init starts in the state a decoder ends in after its last symbol.
+func (e *fseEncoder) init(symbol uint8) fseEncState {
+	tt := e.symbols[symbol]
+	nbBitsOut := (tt.deltaNbBits + 1<<15) >> 16
+	value := nbBitsOut<<16 - tt.deltaNbBits
+	return fseEncState{e: e, value: uint32(e.stateTable[int32(value>>nbBitsOut)+tt.deltaFindState])}
+}
+
+func (s *fseEncState) encode(w *bitWriter, symbol uint8) {
+	tt := s.e.symbols[symbol]
+	nbBitsOut := (s.value + tt.deltaNbBits) >> 16
+	w.add(uint64(s.value), uint(nbBitsOut))
+	s.value = uint32(s.e.stateTable[int32(s.value>>nbBitsOut)+tt.deltaFindState])
+}
+
+func (s *fseEncState) flush(w *bitWriter) {
+	w.add(uint64(s.value), uint(s.e.log))
+}
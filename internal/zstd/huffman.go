@@ -0,0 +1,413 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"sort"
+)
+
+// maxHuffmanBits bounds the length of a Huffman code.
+const maxHuffmanBits = 11
+
+type huffEntry struct {
+	symbol uint8
+	nbBits uint8
+}
+
+// huffTable decodes a Huffman code by looking up the next log bits.
+type huffTable struct {
+	log     uint8
+	entries []huffEntry
+}
+
+// readHuffman reads a Huffman tree description from the start of in,
+// returning the table and the bytes it took.
+func readHuffman(in []byte) (*huffTable, int, error) {
+	if len(in) == 0 {
+		return nil, 0, errCorrupt
+	}
+	var weights []uint8
+	var n int
+	if header := int(in[0]); header >= 128 {
+		count := header - 127
+		n = 1 + (count+1)/2
+		if n > len(in) {
+			return nil, 0, errCorrupt
+		}
+		weights = make([]uint8, count)
+		for i := range weights {
+			b := in[1+i/2]
+			if i%2 == 0 {
+				weights[i] = b >> 4
+			} else {
+				weights[i] = b & 15
+			}
+		}
+	} else {
+		n = 1 + header
+		if n > len(in) {
+			return nil, 0, errCorrupt
+		}
+		var err error
+		if weights, err = readFSEWeights(in[1:n]); err != nil {
+			return nil, 0, err
+		}
+	}
+	t, err := buildHuffman(weights)
+	if err != nil {
+		return nil, 0, err
+	}
+	return t, n, nil
+}
+
+// readFSEWeights reads Huffman weights compressed with FSE, which
+// interleaves two states until the bitstream runs out.
+func readFSEWeights(in []byte) ([]uint8, error) {
+	norm, log, used, err := readNCount(in, maxHuffmanBits+1, 6)
+	if err != nil {
+		return nil, err
+	}
+	t, err := buildFSE(norm, log)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newBackwardReader(in[used:])
+	if err != nil {
+		return nil, err
+	}
+	var s1, s2 fseState
+	s1.init(t, &r)
+	s2.init(t, &r)
+	var weights []uint8
+	for {
+		if len(weights) >= 254 {
+			return nil, errCorrupt
+		}
+		weights = append(weights, s1.symbol())
+		s1.update(&r)
+		if r.overflowed() {
+			weights = append(weights, s2.symbol())
+			break
+		}
+		weights = append(weights, s2.symbol())
+		s2.update(&r)
+		if r.overflowed() {
+			weights = append(weights, s1.symbol())
+			break
+		}
+	}
+	return weights, nil
+}
+
+// buildHuffman builds the decoding table for the weights of all but the
+// last symbol, whose weight is implied by the others.
+func buildHuffman(weights []uint8) (*huffTable, error) {
+	if len(weights) == 0 || len(weights) > 255 {
+		return nil, errCorrupt
+	}
+	var counts [maxHuffmanBits + 2]uint32
+	var total uint32
+	for _, w := range weights {
+		if w > maxHuffmanBits+1 {
+			return nil, errCorrupt
+		}
+		counts[w]++
+		if w > 0 {
+			total += 1 << (w - 1)
+		}
+	}
+	if total == 0 {
+		return nil, errCorrupt
+	}
+	log := bits.Len32(total)
+	if log > maxHuffmanBits {
+		return nil, errCorrupt
+	}
+	left := uint32(1)<<log - total
+	if left&(left-1) != 0 {
+		return nil, errCorrupt
+	}
+	last := uint8(bits.Len32(left))
+	weights = append(weights, last)
+	counts[last]++
+
+	var start [maxHuffmanBits + 2]uint32
+	next := uint32(0)
+	for w := 1; w <= log; w++ {
+		start[w] = next
+		next += counts[w] << (w - 1)
+	}
+	t := &huffTable{log: uint8(log), entries: make([]huffEntry, 1<<log)}
+	for s, w := range weights {
+		if w == 0 {
+			continue
+		}
+		e := huffEntry{symbol: uint8(s), nbBits: uint8(log) + 1 - w}
+		n := uint32(1) << (w - 1)
+		for i := start[w]; i < start[w]+n; i++ {
+			t.entries[i] = e
+		}
+		start[w] += n
+	}
+	return t, nil
+}
+
+// decode fills out from one Huffman-coded stream.
+func (t *huffTable) decode(out, in []byte) error {
+	r, err := newBackwardReader(in)
+	if err != nil {
+		return err
+	}
+	for i := range out {
+		e := t.entries[r.peek(uint(t.log))]
+		out[i] = e.symbol
+		r.pos -= int(e.nbBits)
+	}
+	if r.pos != 0 {
+		return errCorrupt
+	}
+	return nil
+}
+
+// decode4 fills out from four Huffman-coded streams, each a quarter of it,
+// behind a jump table of the first three sizes.
+func (t *huffTable) decode4(out, in []byte) error {
+	if len(in) < 6 {
+		return errCorrupt
+	}
+	segment := (len(out) + 3) / 4
+	if 3*segment > len(out) {
+		return errCorrupt
+	}
+	sizes := [4]int{
+		int(binary.LittleEndian.Uint16(in)),
+		int(binary.LittleEndian.Uint16(in[2:])),
+		int(binary.LittleEndian.Uint16(in[4:])),
+	}
+	in = in[6:]
+	sizes[3] = len(in) - sizes[0] - sizes[1] - sizes[2]
+	if sizes[3] < 0 {
+		return errCorrupt
+	}
+	for i, size := range sizes {
+		end := min((i+1)*segment, len(out))
+		if err := t.decode(out[i*segment:end], in[:size]); err != nil {
+			return err
+		}
+		in = in[size:]
+	}
+	return nil
+}
+
+// huffEncoder holds the code of each symbol of a literals section.
+type huffEncoder struct {
+	codes   [256]uint16
+	lengths [256]uint8
+	// weights are those of symbols 0 up to the last one used.
+	weights []uint8
+}
+
+// newHuffEncoder builds a code for the byte counts, which must have at
+// least two distinct symbols.
+func newHuffEncoder(counts *[256]int) *huffEncoder {
+	maxSymbol := 255
+	for counts[maxSymbol] == 0 {
+		maxSymbol--
+	}
+	lengths := huffLengths(counts[:maxSymbol+1])
+	maxLen := uint8(0)
+	for _, l := range lengths {
+		maxLen = max(maxLen, l)
+	}
+	e := &huffEncoder{weights: make([]uint8, maxSymbol+1)}
+	var perWeight [maxHuffmanBits + 2]uint32
+	for s, l := range lengths {
+		if l > 0 {
+			e.weights[s] = maxLen + 1 - l
+			perWeight[e.weights[s]]++
+		}
+	}
+	// Codes are assigned as buildHuffman lays out its table: by weight,
+	// then by symbol.
+	var start [maxHuffmanBits + 2]uint32
+	next := uint32(0)
+	for w := 1; w <= int(maxLen); w++ {
+		start[w] = next
+		next += perWeight[w] << (w - 1)
+	}
+	for s, w := range e.weights {
+		if w == 0 {
+			continue
+		}
+		e.codes[s] = uint16(start[w] >> (w - 1))
+		e.lengths[s] = lengths[s]
+		start[w] += 1 << (w - 1)
+	}
+	return e
+}
+
+// huffLengths returns code lengths of at most maxHuffmanBits for counts,
+// flattening the counts until the Huffman code fits.
+func huffLengths(counts []int) []uint8 {
+	counts = append([]int(nil), counts...)
+	for {
+		lengths := huffmanLengths(counts)
+		longest := uint8(0)
+		for _, l := range lengths {
+			longest = max(longest, l)
+		}
+		if longest <= maxHuffmanBits {
+			return lengths
+		}
+		for s, c := range counts {
+			if c > 0 {
+				counts[s] = (c + 1) / 2
+			}
+		}
+	}
+}
+
+// huffmanLengths returns the lengths of an unrestricted Huffman code.
+func huffmanLengths(counts []int) []uint8 {
+	type node struct {
+		count  int
+		parent int
+	}
+	var symbols []int
+	for s, c := range counts {
+		if c > 0 {
+			symbols = append(symbols, s)
+		}
+	}
+	sort.SliceStable(symbols, func(i, j int) bool { return counts[symbols[i]] < counts[symbols[j]] })
+	n := len(symbols)
+	nodes := make([]node, n, 2*n-1)
+	for i, s := range symbols {
+		nodes[i].count = counts[s]
+	}
+	// Leaves and merged nodes each come out in order of count, so the two
+	// smallest are always at the head of one queue or the other.
+	leaf, merged := 0, n
+	pop := func() int {
+		if leaf < n && (merged >= len(nodes) || nodes[leaf].count <= nodes[merged].count) {
+			leaf++
+			return leaf - 1
+		}
+		merged++
+		return merged - 1
+	}
+	for len(nodes) < 2*n-1 {
+		a, b := pop(), pop()
+		nodes = append(nodes, node{count: nodes[a].count + nodes[b].count})
+		nodes[a].parent = len(nodes) - 1
+		nodes[b].parent = len(nodes) - 1
+	}
+	depths := make([]uint8, len(nodes))
+	for i := len(nodes) - 2; i >= 0; i-- {
+		depths[i] = depths[nodes[i].parent] + 1
+	}
+	lengths := make([]uint8, len(counts))
+	for i, s := range symbols {
+		lengths[s] = depths[i]
+	}
+	return lengths
+}
+
+// description returns the tree description of the code, or nil if it has
+// none that fits.
+func (e *huffEncoder) description() []byte {
+	stored := e.weights[:len(e.weights)-1]
+	if fse := compressWeights(stored); fse != nil && (len(fse) < (len(stored)+1)/2 || len(stored) > 128) {
+		return append([]byte{byte(len(fse))}, fse...)
+	}
+	if len(stored) > 128 {
+		return nil
+	}
+	out := make([]byte, 1+(len(stored)+1)/2)
+	out[0] = byte(127 + len(stored))
+	for i, w := range stored {
+		if i%2 == 0 {
+			out[1+i/2] = w << 4
+		} else {
+			out[1+i/2] |= w
+		}
+	}
+	return out
+}
+
+// compressWeights codes Huffman weights with FSE, or returns nil if they
+// cannot be: the description must stay under 128 bytes, and a single
+// repeated weight would never run the decoder's bitstream dry.
+func compressWeights(weights []uint8) []byte {
+	if len(weights) < 2 {
+		return nil
+	}
+	var counts [maxHuffmanBits + 2]int
+	maxWeight := 0
+	for _, w := range weights {
+		counts[w]++
+		maxWeight = max(maxWeight, int(w))
+	}
+	for _, c := range counts {
+		if c == len(weights) {
+			return nil
+		}
+	}
+	const log = 6
+	norm := normalize(counts[:maxWeight+1], len(weights), log)
+	out := appendNCount(nil, norm, log)
+	enc := newFSEEncoder(norm, log)
+
+	var w bitWriter
+	i := len(weights)
+	var s1, s2 fseEncState
+	if i%2 == 1 {
+		s1 = enc.init(weights[i-1])
+		s2 = enc.init(weights[i-2])
+		s1.encode(&w, weights[i-3])
+		i -= 3
+	} else {
+		s2 = enc.init(weights[i-1])
+		s1 = enc.init(weights[i-2])
+		i -= 2
+	}
+	for ; i > 0; i -= 2 {
+		s2.encode(&w, weights[i-1])
+		s1.encode(&w, weights[i-2])
+	}
+	s2.flush(&w)
+	s1.flush(&w)
+	out = append(out, w.close()...)
+	if len(out) >= 128 {
+		return nil
+	}
+	return out
+}
+
+// encode appends one Huffman-coded stream of lits.
+func (e *huffEncoder) encode(out, lits []byte) []byte {
+	w := bitWriter{out: out}
+	for i := len(lits) - 1; i >= 0; i-- {
+		s := lits[i]
+		w.add(uint64(e.codes[s]), uint(e.lengths[s]))
+	}
+	return w.close()
+}
+
+// encode4 appends four Huffman-coded streams of lits behind their jump
+// table.
+func (e *huffEncoder) encode4(out, lits []byte) []byte {
+	segment := (len(lits) + 3) / 4
+	table := len(out)
+	out = append(out, make([]byte, 6)...)
+	for i := 0; i < 4; i++ {
+		start := len(out)
+		out = e.encode(out, lits[i*segment:min((i+1)*segment, len(lits))])
+		if i < 3 {
+			binary.LittleEndian.PutUint16(out[table+2*i:], uint16(len(out)-start))
+		}
+	}
+	return out
+}
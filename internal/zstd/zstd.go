@@ -0,0 +1,196 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+// Package zstd reads and writes Zstandard frames, as described in RFC
+// 8878, for the compression of eszip sources and source maps. Decompress
+// reads any frame that does not need a dictionary. Compress writes a
+// single frame, finding matches with hash chains and coding literals with
+// Huffman codes and sequences with the predefined FSE tables; it trades
+// some ratio against the reference encoder for simplicity.
+package zstd
+
+import (
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ErrTooLarge is returned by Decompress when the content would exceed the
+// limit it was given.
+var ErrTooLarge = errors.New("zstd: decompressed content exceeds the limit")
+
+// errCorrupt is returned for input that is not valid Zstandard.
+var errCorrupt = errors.New("zstd: corrupt input")
+
+const (
+	frameMagic = 0xFD2FB528
+	// Skippable frames have magics 0x184D2A50 to 0x184D2A5F.
+	skippableMagic     = 0x184D2A50
+	skippableMagicMask = 0xFFFFFFF0
+
+	// maxBlockSize bounds the content of every block, compressed or not.
+	maxBlockSize = 128 << 10
+)
+
+// Block types.
+const (
+	blockRaw        = 0
+	blockRLE        = 1
+	blockCompressed = 2
+)
+
+// Literals section types.
+const (
+	literalsRaw        = 0
+	literalsRLE        = 1
+	literalsCompressed = 2
+	literalsTreeless   = 3
+)
+
+// Literals length codes: the baseline of each code and the number of
+// extra bits added to it.
+var (
+	llBase = [36]uint32{
+		0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+		16, 18, 20, 22, 24, 28, 32, 40, 48, 64, 128, 256, 512, 1024, 2048, 4096,
+		8192, 16384, 32768, 65536,
+	}
+	llBits = [36]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 6, 7, 8, 9, 10, 11, 12,
+		13, 14, 15, 16,
+	}
+)
+
+// Match length codes, as for literals lengths.
+var (
+	mlBase = [53]uint32{
+		3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18,
+		19, 20, 21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34,
+		35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051,
+		4099, 8195, 16387, 32771, 65539,
+	}
+	mlBits = [53]uint8{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11,
+		12, 13, 14, 15, 16,
+	}
+)
+
+// The sequence tables: literals lengths, offsets and match lengths, in the
+// order their modes and descriptions appear.
+const (
+	tableLL = iota
+	tableOF
+	tableML
+)
+
+// Per table, the largest symbol and accuracy log a description may use.
+var (
+	maxSymbols = [3]int{35, 31, 52}
+	maxLogs    = [3]uint8{9, 8, 9}
+)
+
+// The predefined distributions, used by Predefined_Mode.
+var (
+	predefinedNorms = [3][]int16{
+		tableLL: {
+			4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1,
+			2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1,
+			-1, -1, -1, -1,
+		},
+		tableOF: {
+			1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1,
+		},
+		tableML: {
+			1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+			1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1,
+			-1, -1, -1, -1, -1,
+		},
+	}
+	predefinedLogs = [3]uint8{6, 5, 6}
+)
+
+var (
+	predefinedTables   [3]*fseTable
+	predefinedEncoders [3]*fseEncoder
+)
+
+func init() {
+	for i, norm := range predefinedNorms {
+		t, err := buildFSE(norm, predefinedLogs[i])
+		if err != nil {
+			panic(err)
+		}
+		predefinedTables[i] = t
+		predefinedEncoders[i] = newFSEEncoder(norm, predefinedLogs[i])
+	}
+}
+
+const (
+	prime64v1 = 11400714785074694791
+	prime64v2 = 14029467366897019727
+	prime64v3 = 1609587929392839161
+	prime64v4 = 9650029242287828579
+	prime64v5 = 2870177450012600261
+)
+
+// xxhash64 returns the XXH64 hash of b with seed 0, whose low 32 bits are
+// a frame's content checksum.
+func xxhash64(b []byte) uint64 {
+	n := len(b)
+	var h uint64
+	if n >= 32 {
+		p1 := uint64(prime64v1)
+		v1 := p1 + prime64v2
+		v2 := uint64(prime64v2)
+		v3 := uint64(0)
+		v4 := -p1
+		for len(b) >= 32 {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(b))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(b[8:]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(b[16:]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(b[24:]))
+			b = b[32:]
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxhMerge(h, v1)
+		h = xxhMerge(h, v2)
+		h = xxhMerge(h, v3)
+		h = xxhMerge(h, v4)
+	} else {
+		h = prime64v5
+	}
+	h += uint64(n)
+	for ; len(b) >= 8; b = b[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		h = bits.RotateLeft64(h, 27)*prime64v1 + prime64v4
+	}
+	if len(b) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(b)) * prime64v1
+		h = bits.RotateLeft64(h, 23)*prime64v2 + prime64v3
+		b = b[4:]
+	}
+	for _, c := range b {
+		h ^= uint64(c) * prime64v5
+		h = bits.RotateLeft64(h, 11) * prime64v1
+	}
+	h ^= h >> 33
+	h *= prime64v2
+	h ^= h >> 29
+	h *= prime64v3
+	h ^= h >> 32
+	return h
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * prime64v2
+	return bits.RotateLeft64(acc, 31) * prime64v1
+}
+
+func xxhMerge(acc, val uint64) uint64 {
+	acc ^= xxhRound(0, val)
+	return acc*prime64v1 + prime64v4
+}
@@ -0,0 +1,140 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package zstd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+)
+
+// source returns lines of JavaScript-like text, as testdata/*.zst were
+// made from with the reference zstd CLI.
+func source(lines int) []byte {
+	var b strings.Builder
+	for i := 0; i < lines; i++ {
+		fmt.Fprintf(&b, "export const value%d = %d; // %s\n", i, i*i%7919, strings.Repeat("ab", i%13))
+	}
+	return []byte(b.String())
+}
+
+func TestRoundTrip(t *testing.T) {
+	random := make([]byte, 300<<10)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, tc := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"one byte", []byte("a")},
+		{"short", []byte("export default 1;\n")},
+		{"zeros", make([]byte, 200<<10)},
+		{"random", random},
+		{"source", source(4000)},
+		{"source twice", append(source(4000), source(4000)...)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			frame := Compress(tc.data)
+			got, err := Decompress(frame, 1<<30)
+			if err != nil {
+				t.Fatalf("Decompress failed: %v", err)
+			}
+			if !bytes.Equal(got, tc.data) {
+				t.Fatalf("round trip changed the content")
+			}
+		})
+	}
+
+	data := source(4000)
+	if n := len(Compress(data)); n > len(data)/4 {
+		t.Errorf("Compress(source) = %d bytes, want at most %d", n, len(data)/4)
+	}
+}
+
+// TestReference decodes frames written by the reference encoder: one
+// with compressed tables and several blocks, and one streamed without
+// its content size or checksum.
+func TestReference(t *testing.T) {
+	for _, tc := range []struct {
+		file string
+		want []byte
+	}{
+		{"testdata/level19.zst", source(4000)},
+		{"testdata/streamed.zst", source(500)},
+	} {
+		frame, err := os.ReadFile(tc.file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := Decompress(frame, 1<<30)
+		if err != nil {
+			t.Fatalf("Decompress(%s) failed: %v", tc.file, err)
+		}
+		if !bytes.Equal(got, tc.want) {
+			t.Errorf("Decompress(%s) returned the wrong content", tc.file)
+		}
+	}
+}
+
+func TestFrames(t *testing.T) {
+	skippable := []byte{0x5a, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 'x', 'y', 'z'}
+	var in []byte
+	in = append(in, Compress([]byte("first "))...)
+	in = append(in, skippable...)
+	in = append(in, Compress([]byte("second"))...)
+	got, err := Decompress(in, 1<<30)
+	if err != nil || string(got) != "first second" {
+		t.Errorf("Decompress = %q, %v", got, err)
+	}
+}
+
+func TestLimit(t *testing.T) {
+	frame := Compress(make([]byte, 1<<20))
+	if _, err := Decompress(frame, 1<<20); err != nil {
+		t.Errorf("Decompress at the limit failed: %v", err)
+	}
+	if _, err := Decompress(frame, 1<<20-1); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Decompress over the limit error = %v, want ErrTooLarge", err)
+	}
+
+	// Without a content size the limit is only found while decoding.
+	streamed, err := os.ReadFile("testdata/streamed.zst")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Decompress(streamed, 1000); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("Decompress(streamed) over the limit error = %v, want ErrTooLarge", err)
+	}
+}
+
+func TestCorrupt(t *testing.T) {
+	frame := Compress(source(500))
+	for _, tc := range []struct {
+		name string
+		in   []byte
+	}{
+		{"not zstd", []byte("hello world")},
+		{"truncated", frame[:len(frame)/2]},
+		{"checksum", append(append([]byte(nil), frame[:len(frame)-1]...), frame[len(frame)-1]^1)},
+		{"dictionary", []byte{0x28, 0xb5, 0x2f, 0xfd, 0x21, 1, 0, 1, 0, 0}},
+	} {
+		if _, err := Decompress(tc.in, 1<<30); err == nil {
+			t.Errorf("%s: Decompress succeeded", tc.name)
+		}
+	}
+
+	// Flipped bits anywhere must give an error or some content, never a
+	// panic.
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		in := append([]byte(nil), frame...)
+		for j := 0; j < 1+r.Intn(4); j++ {
+			in[r.Intn(len(in))] ^= byte(1 << r.Intn(8))
+		}
+		Decompress(in, 1<<20)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// SpecifierMapper chooses where each module goes when an archive is
+// unpacked into a directory. Path returns a slash-separated path relative
+// to that directory. It should depend only on the specifier, so that the
+// same archive always gives the same tree, and it must not return "." or
+// ".." elements.
+type SpecifierMapper interface {
+	Path(specifier string) string
+}
+
+// SpecifierMapperFunc adapts a function to the SpecifierMapper interface.
+type SpecifierMapperFunc func(specifier string) string
+
+// Path calls f.
+func (f SpecifierMapperFunc) Path(specifier string) string {
+	return f(specifier)
+}
+
+// HostPrefixedLayout mirrors specifiers as directories: http and https
+// modules go under their host, with a port joined by "_", file modules
+// under their path and others, such as npm: and jsr: ones, under their
+// scheme. A query or fragment is replaced by a short hash of it before the
+// extension, so "https://esm.sh/mod.ts?v=1" goes to "esm.sh/mod_<hash>.ts"
+// and does not collide with other versions of the module. With decode,
+// each path element is percent-decoded unless that would make it unsafe.
+// Modules whose specifiers differ only in their scheme, such as http and
+// https ones from the same host, share a path.
+func HostPrefixedLayout(decode bool) SpecifierMapper {
+	return SpecifierMapperFunc(func(specifier string) string {
+		return hostPrefixedPath(specifier, decode)
+	})
+}
+
+// FlatLayout puts every module directly in the output directory, under the
+// last element of its HostPrefixedLayout path. Modules with the same file
+// name collide.
+func FlatLayout(decode bool) SpecifierMapper {
+	return SpecifierMapperFunc(func(specifier string) string {
+		return path.Base(hostPrefixedPath(specifier, decode))
+	})
+}
+
+// HashedLayout puts every module directly in the output directory, named
+// by a hash of its specifier and keeping its extension, such as
+// "1f0e3dad99908345.ts". Distinct specifiers never collide in practice.
+func HashedLayout() SpecifierMapper {
+	return SpecifierMapperFunc(func(specifier string) string {
+		p, _ := splitSpecifierQuery(specifier)
+		return shortHash(specifier, 16) + safeExt(path.Base(p))
+	})
+}
+
+func hostPrefixedPath(specifier string, decode bool) string {
+	p, query := splitSpecifierQuery(specifier)
+	switch {
+	case strings.HasPrefix(p, "file:///"):
+		p = strings.TrimPrefix(p, "file:///")
+	case strings.HasPrefix(p, "file://"):
+		p = strings.TrimPrefix(p, "file://")
+	case strings.HasPrefix(p, "https://"), strings.HasPrefix(p, "http://"):
+		_, rest, _ := strings.Cut(p, "://")
+		host, rest, _ := strings.Cut(rest, "/")
+		p = strings.ReplaceAll(host, ":", "_") + "/" + rest
+	default:
+		if u, err := url.Parse(p); err == nil && u.Scheme != "" {
+			p = u.Scheme + "/" + strings.TrimLeft(p[len(u.Scheme)+1:], "/")
+		}
+	}
+	p = strings.TrimPrefix(p, "/")
+
+	segments := strings.Split(p, "/")
+	for i, segment := range segments {
+		if decode {
+			segment = decodePathSegment(segment)
+		}
+		switch segment {
+		case ".":
+			segment = "%2E"
+		case "..":
+			segment = "%2E%2E"
+		}
+		segments[i] = segment
+	}
+	if query != "" {
+		last := segments[len(segments)-1]
+		ext := safeExt(last)
+		segments[len(segments)-1] = strings.TrimSuffix(last, ext) + "_" + shortHash(query, 8) + ext
+	}
+	return strings.Join(segments, "/")
+}
+
+// splitSpecifierQuery splits a specifier before its query or fragment.
+func splitSpecifierQuery(specifier string) (p, query string) {
+	if i := strings.IndexAny(specifier, "?#"); i >= 0 {
+		return specifier[:i], specifier[i:]
+	}
+	return specifier, ""
+}
+
+// decodePathSegment percent-decodes a single path segment, returning it
+// unchanged if it is malformed or would decode to something unsafe.
+//
+// Decoding preserves bytes exactly and performs no Unicode normalization:
+// "%C3%A9" (NFC) and "e%CC%81" (NFD) map to different names. Filesystems that
+// normalize on their own (HFS+ on macOS) may report the NFD spelling back when
+// the directory is listed, while Linux filesystems keep whatever was written.
+func decodePathSegment(segment string) string {
+	if !strings.Contains(segment, "%") {
+		return segment
+	}
+	decoded, err := url.PathUnescape(segment)
+	if err != nil {
+		return segment
+	}
+	if decoded == "." || decoded == ".." || strings.ContainsAny(decoded, "/\\\x00") {
+		return segment
+	}
+	return decoded
+}
+
+// safeExt returns the extension of name if it is short and alphanumeric,
+// and "" otherwise.
+func safeExt(name string) string {
+	ext := path.Ext(name)
+	if len(ext) < 2 || len(ext) > 8 || ext == name {
+		return ""
+	}
+	for _, c := range ext[1:] {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			return ""
+		}
+	}
+	return ext
+}
+
+// shortHash returns the first n hex digits of the SHA-256 of s.
+func shortHash(s string, n int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:n]
+}
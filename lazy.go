@@ -0,0 +1,164 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// ParseV2Lazy parses the headers of a V2 archive from r and leaves the
+// sources and source maps in place. Each call to Source or SourceMap reads
+// the content from r at its recorded offset and verifies its checksum, and
+// nothing is cached, so memory use stays at the size of the headers however
+// large the archive is. The slots are in SourceSlotLazy. TakeSource reads
+// the content once more and then forgets the slot.
+//
+// r must stay readable for as long as the archive is used. Pass
+// WithInputSize to have section lengths checked against the input size.
+// Content is only read when requested, so a corrupt source is reported by
+// the Source call that reads it rather than by ParseV2Lazy.
+func ParseV2Lazy(ctx context.Context, r io.ReaderAt, opts ...ParseOption) (*EszipV2, error) {
+	cfg := newParseConfig(opts)
+	size := cfg.inputSize
+	if size < 0 {
+		size = math.MaxInt64
+	}
+	br := newArchiveReader(io.NewSectionReader(r, 0, size), cfg)
+
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return nil, errIO(err)
+	}
+	br.reportSection("magic", 0)
+	version, ok := VersionFromMagic(magic)
+	if !ok {
+		return nil, errInvalidV2()
+	}
+
+	eszip, _, err := parseV2WithVersion(ctx, version, br)
+	if err != nil {
+		return nil, err
+	}
+
+	// The headers end where the sources section begins; the source maps
+	// section follows it.
+	checksumSize := int64(eszip.options.GetChecksumSize())
+	sources, err := readLazySection(r, br.offset, cfg.inputSize)
+	if err != nil {
+		return nil, err
+	}
+	sourceMaps, err := readLazySection(r, sources.start+sources.length, cfg.inputSize)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range []lazySection{sources, sourceMaps} {
+		if limit := cfg.policy.MaxSectionSize; limit > 0 && s.length > limit {
+			return nil, errSectionTooLarge(s.length, limit, int(s.start-4))
+		}
+		if err := br.checkContentLength(i == 1, s.length, s.start-4); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, entries := eszip.modules.snapshot()
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok {
+			continue
+		}
+		for j, slot := range []struct {
+			slot    *SourceSlot
+			section lazySection
+		}{{data.Source, sources}, {data.SourceMap, sourceMaps}} {
+			if slot.slot.State() != SourceSlotPending {
+				continue
+			}
+			offset := int64(slot.slot.Offset())
+			if offset+int64(slot.slot.Length())+checksumSize > slot.section.length {
+				return nil, errInvalidV2SourceOffset(int(offset), int(slot.section.start+offset))
+			}
+			slot.slot.setLazy(&lazyContent{
+				r:          r,
+				offset:     slot.section.start + offset,
+				options:    eszip.options,
+				specifier:  specifier,
+				sourceMap:  j == 1,
+				skipVerify: cfg.policy.SkipChecksumVerify,
+				maxSize:    cfg.policy.decompressLimit(),
+			})
+		}
+	}
+	return eszip, nil
+}
+
+// lazySection locates a content section within the archive.
+type lazySection struct {
+	start  int64 // archive offset of the first entry
+	length int64
+}
+
+// readLazySection reads the length prefix of the content section at
+// offset. inputSize is the archive size, or -1 if unknown.
+func readLazySection(r io.ReaderAt, offset, inputSize int64) (lazySection, error) {
+	var prefix [4]byte
+	if _, err := r.ReadAt(prefix[:], offset); err != nil {
+		return lazySection{}, errIO(err)
+	}
+	s := lazySection{start: offset + 4, length: int64(binary.BigEndian.Uint32(prefix[:]))}
+	if inputSize >= 0 && s.start+s.length > inputSize {
+		return lazySection{}, errInvalidV2SectionLength(s.length, max(inputSize-s.start, 0), int(s.start))
+	}
+	return s, nil
+}
+
+// lazyContent is the location of a source or source map left in the
+// archive by ParseV2Lazy.
+type lazyContent struct {
+	r         io.ReaderAt
+	offset    int64 // archive offset of the content
+	options   Options
+	specifier string
+	// sourceMap is set if the content is a source map.
+	sourceMap bool
+	// skipVerify is set by ParseOptions.SkipChecksumVerify.
+	skipVerify bool
+	// maxSize bounds the decompressed content; see
+	// ParseOptions.decompressLimit.
+	maxSize int64
+}
+
+// read reads length bytes of content and verifies them against the hash
+// that follows.
+func (c *lazyContent) read(ctx context.Context, length int) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, length+int(c.options.GetChecksumSize()))
+	if n, err := c.r.ReadAt(buf, c.offset); n < len(buf) {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, errIO(err)
+	}
+	section := &Section{
+		content:  buf[:length:length],
+		hash:     buf[length:],
+		checksum: c.options.Checksum,
+		offset:   int(c.offset),
+	}
+	if !c.skipVerify && !section.IsChecksumValid() {
+		return nil, errInvalidV2SourceHash(c.specifier, section)
+	}
+	content, err := c.options.decrypt(section.IntoContent(), c.specifier, c.sourceMap)
+	if err != nil {
+		return nil, errInvalidV2SourceEncryption(c.specifier, section.offset, err)
+	}
+	content, err = c.options.Compression.decompress(content, c.maxSize)
+	if err != nil {
+		return nil, errInvalidV2SourceCompression(c.specifier, section.offset, err)
+	}
+	return content, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"sync"
+)
+
+// ParseLenient parses an archive as ParseSync does, but instead of failing
+// on the first corruption confined to one module it collects the error and
+// carries on, for inspecting damaged archives. It returns the archive with
+// every module it could recover and the errors it collected, in the order
+// they were found; each names its section and the archive bytes at fault.
+//
+// A module whose header entry names an unknown module kind is left out of
+// the archive. A source or source map whose checksum does not match, or
+// that cannot be decrypted or decompressed, is left in SourceSlotNotLoaded,
+// so reading it fails with ErrSourceNotLoaded while the rest of its module
+// stays usable; Salvage builds a valid archive from what was recovered.
+// Damage to the archive's structure, such as a bad header hash, an unknown
+// entry kind or truncation, still fails the parse, since the modules after
+// it cannot be located. On failure the errors collected so far are
+// returned too.
+func ParseLenient(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipUnion, []*ParseError, error) {
+	faults := &faultLog{}
+	opts = append(opts, func(c *parseConfig) { c.faults = faults })
+	archive, err := ParseSync(ctx, r, opts...)
+	return archive, faults.errors(), err
+}
+
+// faultLog collects the errors tolerated by a lenient parse. The source
+// loader may report them from several goroutines.
+type faultLog struct {
+	mu   sync.Mutex
+	errs []*ParseError
+	// dropped lists the modules whose header entries were unusable, to be
+	// removed from the archive once their content offsets are recorded.
+	dropped []string
+}
+
+func (f *faultLog) add(err *ParseError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errs = append(f.errs, err)
+}
+
+func (f *faultLog) errors() []*ParseError {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.errs
+}
+
+// tolerate records err, which arose in section and affects only one
+// module, and returns true if the parse is lenient. Otherwise it returns
+// false and err should fail the parse.
+func (r *archiveReader) tolerate(err *ParseError, section string) bool {
+	inSection(err, section)
+	if r.faults == nil {
+		return false
+	}
+	r.warn("tolerated", slog.String("section", section), slog.Int("offset", err.Offset), slog.String("error", err.Message))
+	r.faults.add(err)
+	return true
+}
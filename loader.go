@@ -0,0 +1,107 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"strings"
+)
+
+// Loader supplies the modules BuildFromSpecifiers puts in an archive, so
+// they can come from any file system, cache or CDN.
+type Loader interface {
+	// Load returns the kind, source and source map of the module at
+	// specifier. A nil source map means the module has none.
+	Load(ctx context.Context, specifier string) (kind ModuleKind, source, sourceMap []byte, err error)
+}
+
+// LoaderFunc adapts a function to the Loader interface.
+type LoaderFunc func(ctx context.Context, specifier string) (ModuleKind, []byte, []byte, error)
+
+// Load calls f.
+func (f LoaderFunc) Load(ctx context.Context, specifier string) (ModuleKind, []byte, []byte, error) {
+	return f(ctx, specifier)
+}
+
+// FSLoader returns a Loader that reads file: specifiers from fsys, with
+// file:///a/b.js naming the file a/b.js. The module kind is detected as
+// for AddModuleFromFile. Other specifiers fail to load.
+func FSLoader(fsys fs.FS) Loader {
+	return LoaderFunc(func(ctx context.Context, specifier string) (ModuleKind, []byte, []byte, error) {
+		u, err := url.Parse(specifier)
+		if err != nil || u.Scheme != "file" {
+			return 0, nil, nil, fmt.Errorf("eszip: %s is not a file: specifier", specifier)
+		}
+		name := strings.TrimPrefix(u.Path, "/")
+		source, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		kind, ok := DetectModuleKind(name, source)
+		if !ok {
+			kind = ModuleKindJavaScript
+		}
+		return kind, source, nil, nil
+	})
+}
+
+// BuildFromSpecifiers builds an archive from roots and every module they
+// import, directly or not, loading each module once through loader.
+// JavaScript modules are scanned for imports as by BuildModuleGraph, and
+// each import is resolved against the module importing it. Bare
+// specifiers, which need an import map, and node: and npm: imports, which
+// the runtime provides, are not followed, nor are file: imports from
+// modules that are not themselves local.
+//
+// Modules are added in the order they are reached, breadth first, roots
+// first, and the roots are recorded as the archive's entrypoints. A module
+// that fails to load fails the build, naming the module that imported it.
+func BuildFromSpecifiers(ctx context.Context, loader Loader, roots []string) (*EszipV2, error) {
+	archive := NewV2()
+	seen := make(map[string]bool)
+	importers := make(map[string]string)
+	var queue []string
+	for _, root := range roots {
+		if !seen[root] {
+			seen[root] = true
+			queue = append(queue, root)
+		}
+	}
+
+	for len(queue) > 0 {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		specifier := queue[0]
+		queue = queue[1:]
+		kind, source, sourceMap, err := loader.Load(ctx, specifier)
+		if err != nil {
+			if importer, ok := importers[specifier]; ok {
+				return nil, fmt.Errorf("eszip: loading %s, imported by %s: %w", specifier, importer, err)
+			}
+			return nil, fmt.Errorf("eszip: loading %s: %w", specifier, err)
+		}
+		archive.AddModule(specifier, kind, source, sourceMap)
+		if kind != ModuleKindJavaScript {
+			continue
+		}
+
+		for _, ref := range ScanImports(source) {
+			target, ok := resolveImport(specifier, ref.Specifier, nil)
+			if !ok || isBuiltinImport(target) || seen[target] {
+				continue
+			}
+			if strings.HasPrefix(target, "file:") && !strings.HasPrefix(specifier, "file:") {
+				continue
+			}
+			seen[target] = true
+			importers[target] = specifier
+			queue = append(queue, target)
+		}
+	}
+	archive.SetEntrypoints(roots)
+	return archive, nil
+}
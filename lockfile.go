@@ -0,0 +1,314 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// LockfileFormat identifies the lockfile NpmSnapshotFromLockfile reads.
+type LockfileFormat int
+
+const (
+	// LockfilePackageLock is npm's package-lock.json, lockfileVersion 2 or
+	// 3.
+	LockfilePackageLock LockfileFormat = iota
+	// LockfileDeno is deno.lock, version 3, 4 or 5.
+	LockfileDeno
+)
+
+func (f LockfileFormat) String() string {
+	switch f {
+	case LockfilePackageLock:
+		return "package-lock.json"
+	case LockfileDeno:
+		return "deno.lock"
+	default:
+		return "unknown"
+	}
+}
+
+// NpmSnapshotFromLockfile builds an npm resolution snapshot from lockfile
+// content, ready for SetNpmSnapshot.
+//
+// For package-lock.json, the root requirements are the project's
+// dependencies, optional and peer dependencies as "name@range", and each
+// package's dependencies are resolved the way Node.js resolves them
+// through nested node_modules directories. Development-only packages and
+// workspace links are left out. For deno.lock, the root requirements are
+// the npm: specifiers without their prefix, and jsr: and other specifiers
+// are ignored.
+//
+// A dependency that the lockfile does not resolve is an error unless it is
+// optional or a peer dependency. Packages keep the integrity digest the
+// lockfile records for them and, from package-lock.json, the URL they
+// were resolved from; deno.lock records a tarball URL only for packages
+// from other registries.
+func NpmSnapshotFromLockfile(data []byte, format LockfileFormat) (*NpmResolutionSnapshot, error) {
+	var snapshot *NpmResolutionSnapshot
+	var err error
+	switch format {
+	case LockfilePackageLock:
+		snapshot, err = snapshotFromPackageLock(data)
+	case LockfileDeno:
+		snapshot, err = snapshotFromDenoLock(data)
+	default:
+		return nil, fmt.Errorf("eszip: unknown lockfile format %d", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("eszip: %s: %w", format, err)
+	}
+	sort.Slice(snapshot.Packages, func(i, j int) bool {
+		return snapshot.Packages[i].ID.String() < snapshot.Packages[j].ID.String()
+	})
+	return snapshot, nil
+}
+
+// SetNpmSnapshot replaces the archive's npm resolution snapshot; nil
+// removes it.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) SetNpmSnapshot(snapshot *NpmResolutionSnapshot) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.npmSnapshot = snapshot
+}
+
+// packageLockEntry is one entry of package-lock.json's "packages" map.
+type packageLockEntry struct {
+	Name                 string            `json:"name"`
+	Version              string            `json:"version"`
+	Dev                  bool              `json:"dev"`
+	Link                 bool              `json:"link"`
+	Dependencies         map[string]string `json:"dependencies"`
+	OptionalDependencies map[string]string `json:"optionalDependencies"`
+	PeerDependencies     map[string]string `json:"peerDependencies"`
+	Integrity            string            `json:"integrity"`
+	Resolved             string            `json:"resolved"`
+}
+
+func snapshotFromPackageLock(data []byte) (*NpmResolutionSnapshot, error) {
+	var lock struct {
+		LockfileVersion int                         `json:"lockfileVersion"`
+		Packages        map[string]packageLockEntry `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	if lock.LockfileVersion < 2 || lock.Packages == nil {
+		return nil, fmt.Errorf("lockfileVersion %d is not supported; regenerate it with npm 7 or later", lock.LockfileVersion)
+	}
+
+	// installed maps each node_modules path to the package there.
+	installed := make(map[string]*NpmPackage)
+	for path, entry := range lock.Packages {
+		i := strings.LastIndex(path, "node_modules/")
+		if i < 0 || entry.Dev || entry.Link {
+			continue
+		}
+		name := entry.Name
+		if name == "" {
+			name = path[i+len("node_modules/"):]
+		}
+		installed[path] = &NpmPackage{
+			ID:           &NpmPackageID{Name: name, Version: entry.Version},
+			Dependencies: make(map[string]*NpmPackageID),
+			Integrity:    entry.Integrity,
+			Tarball:      entry.Resolved,
+		}
+	}
+
+	// resolve finds the package dep refers to from the package at path,
+	// searching its node_modules and then each enclosing one.
+	resolve := func(path, dep string) *NpmPackage {
+		for {
+			prefix := path
+			if prefix != "" {
+				prefix += "/"
+			}
+			if pkg, ok := installed[prefix+"node_modules/"+dep]; ok {
+				return pkg
+			}
+			if path == "" {
+				return nil
+			}
+			path = strings.TrimSuffix(path[:strings.LastIndex(path, "node_modules/")], "/")
+		}
+	}
+	link := func(path string, entry packageLockEntry, add func(dep, spec string, pkg *NpmPackage)) error {
+		for _, deps := range []struct {
+			m        map[string]string
+			required bool
+		}{{entry.Dependencies, true}, {entry.OptionalDependencies, false}, {entry.PeerDependencies, false}} {
+			for _, dep := range slices.Sorted(maps.Keys(deps.m)) {
+				pkg := resolve(path, dep)
+				if pkg == nil {
+					if deps.required {
+						return fmt.Errorf("%s: dependency %s is not in the lockfile", cmp.Or(path, "root"), dep)
+					}
+					continue
+				}
+				add(dep, deps.m[dep], pkg)
+			}
+		}
+		return nil
+	}
+
+	snapshot := &NpmResolutionSnapshot{RootPackages: make(map[string]*NpmPackageID)}
+	for _, path := range slices.Sorted(maps.Keys(installed)) {
+		pkg := installed[path]
+		err := link(path, lock.Packages[path], func(dep, _ string, target *NpmPackage) {
+			pkg.Dependencies[dep] = target.ID
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := link("", lock.Packages[""], func(dep, spec string, target *NpmPackage) {
+		snapshot.RootPackages[dep+"@"+spec] = target.ID
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// The same version may be installed at several paths.
+	seen := make(map[string]bool)
+	for _, path := range slices.Sorted(maps.Keys(installed)) {
+		pkg := installed[path]
+		if !seen[pkg.ID.String()] {
+			seen[pkg.ID.String()] = true
+			snapshot.Packages = append(snapshot.Packages, pkg)
+		}
+	}
+	return snapshot, nil
+}
+
+func snapshotFromDenoLock(data []byte) (*NpmResolutionSnapshot, error) {
+	var lock struct {
+		Version string `json:"version"`
+		// Version 4 and later.
+		Specifiers map[string]string          `json:"specifiers"`
+		Npm        map[string]json.RawMessage `json:"npm"`
+		// Version 3.
+		Packages struct {
+			Specifiers map[string]string          `json:"specifiers"`
+			Npm        map[string]json.RawMessage `json:"npm"`
+		} `json:"packages"`
+	}
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, err
+	}
+	v3 := lock.Version == "3"
+	if v3 {
+		lock.Specifiers, lock.Npm = lock.Packages.Specifiers, lock.Packages.Npm
+	} else if lock.Version != "4" && lock.Version != "5" {
+		return nil, fmt.Errorf("version %q is not supported", lock.Version)
+	}
+
+	packages := make(map[string]*NpmPackage, len(lock.Npm))
+	byName := make(map[string][]string)
+	for key := range lock.Npm {
+		id := denoPackageID(key)
+		packages[key] = &NpmPackage{ID: id, Dependencies: make(map[string]*NpmPackageID)}
+		byName[id.Name] = append(byName[id.Name], key)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(lock.Npm)) {
+		pkg := packages[key]
+		if v3 {
+			// Dependencies map names to package keys.
+			var entry struct {
+				Integrity    string            `json:"integrity"`
+				Dependencies map[string]string `json:"dependencies"`
+			}
+			if err := json.Unmarshal(lock.Npm[key], &entry); err != nil {
+				return nil, fmt.Errorf("package %s: %w", key, err)
+			}
+			pkg.Integrity = entry.Integrity
+			for dep, target := range entry.Dependencies {
+				resolved, ok := packages[target]
+				if !ok {
+					return nil, fmt.Errorf("package %s: dependency %s is not in the lockfile", key, target)
+				}
+				pkg.Dependencies[dep] = resolved.ID
+			}
+			continue
+		}
+		// Dependencies list package keys, shortened to the name when only
+		// one version of the package is locked.
+		var entry struct {
+			Integrity            string   `json:"integrity"`
+			Tarball              string   `json:"tarball"`
+			Dependencies         []string `json:"dependencies"`
+			OptionalDependencies []string `json:"optionalDependencies"`
+		}
+		if err := json.Unmarshal(lock.Npm[key], &entry); err != nil {
+			return nil, fmt.Errorf("package %s: %w", key, err)
+		}
+		pkg.Integrity, pkg.Tarball = entry.Integrity, entry.Tarball
+		for _, deps := range []struct {
+			list     []string
+			required bool
+		}{{entry.Dependencies, true}, {entry.OptionalDependencies, false}} {
+			for _, target := range deps.list {
+				resolved, ok := packages[target]
+				if !ok && len(byName[target]) == 1 {
+					resolved, ok = packages[byName[target][0]], true
+				}
+				if !ok {
+					if deps.required {
+						return nil, fmt.Errorf("package %s: dependency %s is not in the lockfile", key, target)
+					}
+					continue
+				}
+				pkg.Dependencies[resolved.ID.Name] = resolved.ID
+			}
+		}
+	}
+
+	snapshot := &NpmResolutionSnapshot{RootPackages: make(map[string]*NpmPackageID)}
+	for specifier, resolution := range lock.Specifiers {
+		req, ok := strings.CutPrefix(specifier, "npm:")
+		if !ok {
+			continue
+		}
+		// Version 3 resolves to "npm:name@version", later ones to the
+		// version alone.
+		key, ok := strings.CutPrefix(resolution, "npm:")
+		if !ok {
+			key = denoPackageID(req).Name + "@" + resolution
+		}
+		pkg, found := packages[key]
+		if !found {
+			return nil, fmt.Errorf("specifier %s resolves to %s, which is not in the lockfile", specifier, key)
+		}
+		snapshot.RootPackages[req] = pkg.ID
+	}
+	for _, key := range slices.Sorted(maps.Keys(packages)) {
+		snapshot.Packages = append(snapshot.Packages, packages[key])
+	}
+	return snapshot, nil
+}
+
+// denoPackageID splits a deno.lock package key or requirement, such as
+// "@std/path@1.0.0" or "react-dom@18.2.0_react@18.2.0", at the @ that ends
+// the name. Peer dependency suffixes stay part of the version, as they are
+// part of the package's identity.
+func denoPackageID(key string) *NpmPackageID {
+	// Scoped names start with an @ of their own.
+	start := 0
+	if strings.HasPrefix(key, "@") {
+		start = 1
+	}
+	i := strings.Index(key[start:], "@")
+	if i < 0 {
+		return &NpmPackageID{Name: key}
+	}
+	i += start
+	return &NpmPackageID{Name: key[:i], Version: key[i+1:]}
+}
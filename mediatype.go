@@ -0,0 +1,77 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/JakeChampion/eszip/wasm"
+)
+
+// mediaTypeKinds maps the media types servers use for modules to the kind
+// they are stored as. TypeScript and JSX are stored as JavaScript, the kind
+// the archive format uses for every source a runtime transpiles.
+var mediaTypeKinds = map[string]ModuleKind{
+	"application/javascript":     ModuleKindJavaScript,
+	"text/javascript":            ModuleKindJavaScript,
+	"application/ecmascript":     ModuleKindJavaScript,
+	"text/ecmascript":            ModuleKindJavaScript,
+	"application/x-javascript":   ModuleKindJavaScript,
+	"application/node":           ModuleKindJavaScript,
+	"text/jsx":                   ModuleKindJavaScript,
+	"application/typescript":     ModuleKindJavaScript,
+	"text/typescript":            ModuleKindJavaScript,
+	"application/x-typescript":   ModuleKindJavaScript,
+	"video/vnd.dlna.mpeg-tts":    ModuleKindJavaScript, // .ts, as some servers guess
+	"video/mp2t":                 ModuleKindJavaScript,
+	"text/tsx":                   ModuleKindJavaScript,
+	"application/json":           ModuleKindJson,
+	"text/json":                  ModuleKindJson,
+	"application/importmap+json": ModuleKindJson,
+	"application/wasm":           ModuleKindWasm,
+}
+
+// MediaTypeToModuleKind returns the module kind for an HTTP Content-Type
+// value. Parameters such as charset are ignored, as is case. It reports
+// false for media types that are not modules, such as text/html, and for
+// values that do not parse.
+func MediaTypeToModuleKind(contentType string) (ModuleKind, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return 0, false
+	}
+	kind, ok := mediaTypeKinds[mediaType]
+	return kind, ok
+}
+
+// ExtensionToModuleKind returns the module kind for the extension of a
+// path or URL path, or false if the extension does not name a module type.
+// JSON with comments, such as deno.jsonc, is ModuleKindJsonc, which
+// GetModule leaves to GetImportMap as Deno does.
+func ExtensionToModuleKind(name string) (ModuleKind, bool) {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".js", ".mjs", ".cjs", ".jsx", ".ts", ".mts", ".cts", ".tsx":
+		return ModuleKindJavaScript, true
+	case ".json":
+		return ModuleKindJson, true
+	case ".jsonc":
+		return ModuleKindJsonc, true
+	case ".wasm":
+		return ModuleKindWasm, true
+	}
+	return 0, false
+}
+
+// DetectModuleKind returns the module kind of content stored under name.
+// Content starting with the WebAssembly magic is Wasm whatever its name;
+// otherwise the kind comes from the extension, as for
+// ExtensionToModuleKind.
+func DetectModuleKind(name string, content []byte) (ModuleKind, bool) {
+	if bytes.HasPrefix(content, []byte(wasm.Magic)) {
+		return ModuleKindWasm, true
+	}
+	return ExtensionToModuleKind(name)
+}
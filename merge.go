@@ -0,0 +1,242 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+)
+
+// ErrMergeConflict is returned by Merge when both archives hold different
+// content under the same specifier and MergeOptions.OnConflict is
+// ConflictFail.
+var ErrMergeConflict = errors.New("eszip: merge conflict")
+
+// ConflictPolicy says how Merge resolves a specifier that both archives
+// hold with different content.
+type ConflictPolicy int
+
+const (
+	// ConflictFail fails the merge with ErrMergeConflict.
+	ConflictFail ConflictPolicy = iota
+	// ConflictKeepFirst keeps the destination's entry.
+	ConflictKeepFirst
+	// ConflictKeepLast replaces the destination's entry with the source's.
+	ConflictKeepLast
+)
+
+func (p ConflictPolicy) String() string {
+	switch p {
+	case ConflictFail:
+		return "error"
+	case ConflictKeepFirst:
+		return "keep-first"
+	case ConflictKeepLast:
+		return "keep-last"
+	default:
+		return "unknown"
+	}
+}
+
+// MergeOptions controls Merge.
+type MergeOptions struct {
+	// OnConflict resolves specifiers, npm root requirements and npm
+	// packages that differ between the archives.
+	OnConflict ConflictPolicy
+}
+
+// Merge adds the modules, redirects and npm snapshot of src to dst. Entries
+// new to dst are appended in src's order; identical entries are skipped;
+// conflicting ones are resolved by opts.OnConflict, and a replaced entry
+// keeps its place in dst. If dst has no import map, src's import map is
+// placed at the front of dst and becomes its import map. dst keeps its
+// checksum algorithm and format version. src is not changed, but module
+// content is shared rather than copied, so taking a source from one
+// archive takes it from the other.
+//
+// Merge compares content of specifiers present in both archives, waiting
+// for sources still streaming in; see MergeContext. On error, dst is left
+// unchanged.
+func Merge(dst, src *EszipV2, opts MergeOptions) error {
+	return MergeContext(context.Background(), dst, src, opts)
+}
+
+// MergeContext is Merge with a context for waiting on sources that are
+// still streaming in.
+func MergeContext(ctx context.Context, dst, src *EszipV2, opts MergeOptions) error {
+	if dst == src {
+		return nil
+	}
+	src.mu.RLock()
+	srcKeys, srcEntries := src.modules.snapshot()
+	srcImportMap := leadingImportMap(src.importMap, srcKeys, srcEntries)
+	srcSnapshot := copyNpmSnapshot(src.npmSnapshot)
+	src.mu.RUnlock()
+
+	dst.mu.RLock()
+	dstKeys, dstEntries := dst.modules.snapshot()
+	dstImportMap := leadingImportMap(dst.importMap, dstKeys, dstEntries)
+	dstSnapshot := dst.npmSnapshot
+	dst.mu.RUnlock()
+
+	// Decide everything before changing dst, so a conflict leaves it as it
+	// was.
+	type insert struct {
+		specifier string
+		entry     EszipV2Module
+	}
+	var inserts []insert
+	for i, specifier := range srcKeys {
+		entry := srcEntries[i]
+		// npm root requirements travel in the snapshot; a bare entry's
+		// package index only means something in its own archive.
+		if _, ok := entry.(*NpmSpecifierEntry); ok {
+			continue
+		}
+		existing, ok := dst.modules.Get(specifier)
+		if !ok {
+			inserts = append(inserts, insert{specifier, entry})
+			continue
+		}
+		detail, err := entryConflict(ctx, existing, entry)
+		if err != nil {
+			return err
+		}
+		if detail == "" {
+			continue
+		}
+		switch opts.OnConflict {
+		case ConflictKeepFirst:
+		case ConflictKeepLast:
+			inserts = append(inserts, insert{specifier, entry})
+		default:
+			return fmt.Errorf("%w: %s: %s", ErrMergeConflict, specifier, detail)
+		}
+	}
+	snapshot, err := mergeNpmSnapshots(dstSnapshot, srcSnapshot, opts.OnConflict)
+	if err != nil {
+		return err
+	}
+
+	dst.mu.Lock()
+	defer dst.mu.Unlock()
+	for _, in := range inserts {
+		if in.specifier == srcImportMap && dstImportMap == "" {
+			dst.modules.InsertFront(in.specifier, in.entry)
+			dst.importMap = in.specifier
+			continue
+		}
+		dst.modules.Insert(in.specifier, in.entry)
+		if data, ok := in.entry.(*ModuleData); ok {
+			if len(data.Headers) > 0 {
+				dst.version = max(dst.version, VersionV2_4)
+			}
+			if len(data.Aux) > 0 {
+				dst.version = max(dst.version, VersionV2_5)
+			}
+		}
+	}
+	dst.npmSnapshot = snapshot
+	return nil
+}
+
+// entryConflict returns "" if the entries hold the same content and a
+// description of the difference otherwise, from dst's point of view.
+func entryConflict(ctx context.Context, dst, src EszipV2Module) (string, error) {
+	switch d := dst.(type) {
+	case *ModuleData:
+		s, ok := src.(*ModuleData)
+		if !ok {
+			return "module in destination, redirect in source", nil
+		}
+		if d.Kind != s.Kind {
+			return fmt.Sprintf("%s in destination, %s in source", d.Kind, s.Kind), nil
+		}
+		if !maps.Equal(d.Headers, s.Headers) {
+			return "headers differ", nil
+		}
+		if !maps.EqualFunc(d.Aux, s.Aux, bytes.Equal) {
+			return "auxiliary data differs", nil
+		}
+		same, err := sameContent(ctx, d.Source, s.Source)
+		if err != nil || !same {
+			return "source differs", err
+		}
+		same, err = sameContent(ctx, d.SourceMap, s.SourceMap)
+		if err != nil || !same {
+			return "source map differs", err
+		}
+		return "", nil
+	case *ModuleRedirect:
+		s, ok := src.(*ModuleRedirect)
+		if !ok {
+			return "redirect in destination, module in source", nil
+		}
+		if d.Target != s.Target {
+			return fmt.Sprintf("redirects to %q in destination, %q in source", d.Target, s.Target), nil
+		}
+		return "", nil
+	default:
+		return "npm specifier in destination", nil
+	}
+}
+
+// mergeNpmSnapshots returns the union of two snapshots. Root requirements
+// resolving to different packages, and packages with different
+// dependencies, are resolved by policy. The result shares no memory with
+// dst, so dst's snapshot is unchanged until the caller installs it.
+func mergeNpmSnapshots(dst, src *NpmResolutionSnapshot, policy ConflictPolicy) (*NpmResolutionSnapshot, error) {
+	if src == nil {
+		return dst, nil
+	}
+	merged := copyNpmSnapshot(dst)
+	if merged == nil {
+		return src, nil
+	}
+
+	for _, req := range slices.Sorted(maps.Keys(src.RootPackages)) {
+		id := src.RootPackages[req]
+		existing, ok := merged.RootPackages[req]
+		if ok && existing.String() != id.String() {
+			switch policy {
+			case ConflictKeepFirst:
+				continue
+			case ConflictFail:
+				return nil, fmt.Errorf("%w: npm root %q resolves to %s in destination, %s in source", ErrMergeConflict, req, existing, id)
+			}
+		}
+		merged.RootPackages[req] = id
+	}
+
+	index := make(map[string]int, len(merged.Packages))
+	for i, pkg := range merged.Packages {
+		index[pkg.ID.String()] = i
+	}
+	for _, pkg := range src.Packages {
+		i, ok := index[pkg.ID.String()]
+		if !ok {
+			index[pkg.ID.String()] = len(merged.Packages)
+			merged.Packages = append(merged.Packages, pkg)
+			continue
+		}
+		diffs := npmSnapshotDifferences(
+			&NpmResolutionSnapshot{Packages: []*NpmPackage{merged.Packages[i]}},
+			&NpmResolutionSnapshot{Packages: []*NpmPackage{pkg}},
+		)
+		if diffs == nil {
+			continue
+		}
+		switch policy {
+		case ConflictKeepFirst:
+		case ConflictKeepLast:
+			merged.Packages[i] = pkg
+		default:
+			return nil, fmt.Errorf("%w: npm %s", ErrMergeConflict, diffs[0])
+		}
+	}
+	return merged, nil
+}
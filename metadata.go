@@ -0,0 +1,83 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ArchiveMetadataSpecifier is the reserved specifier under which archive
+// metadata is stored, as an opaque data module holding a JSON object of
+// strings with sorted keys. Readers that do not know about it see ordinary
+// opaque data.
+const ArchiveMetadataSpecifier = "eszip:archive-metadata"
+
+// isReservedSpecifier reports whether specifier is one this package stores
+// its own data under.
+func isReservedSpecifier(specifier string) bool {
+	return strings.HasPrefix(specifier, "eszip:")
+}
+
+// SetArchiveMetadata stores archive-level key/value pairs, such as a build
+// ID or producer name, replacing any set before. The entry is placed first,
+// after the import map if there is one, so that streaming readers get it
+// before any module source. An empty or nil map removes the metadata.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) SetArchiveMetadata(metadata map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(metadata) == 0 {
+		e.modules.Remove(ArchiveMetadataSpecifier)
+		return
+	}
+
+	// encoding/json sorts map keys, which makes the encoding canonical.
+	content, _ := json.Marshal(metadata)
+	pos := 0
+	if keys, entries := e.modules.snapshot(); leadingImportMap(e.importMap, keys, entries) != "" {
+		pos = 1
+	}
+	e.modules.insertAt(pos, ArchiveMetadataSpecifier, &ModuleData{
+		Kind:      ModuleKindOpaqueData,
+		Source:    NewReadySourceSlot(content),
+		SourceMap: NewEmptySourceSlot(),
+	})
+}
+
+// ArchiveMetadata returns the archive-level metadata, or nil if there is
+// none. For a streaming parse it waits only for the metadata entry, which
+// precedes every module source. Content that is not a JSON object of
+// strings is reported as an ErrInvalidArchiveMetadata ParseError.
+func (e *EszipV2) ArchiveMetadata(ctx context.Context) (map[string]string, error) {
+	mod, ok := e.modules.Get(ArchiveMetadataSpecifier)
+	if !ok {
+		return nil, nil
+	}
+	data, ok := mod.(*ModuleData)
+	if !ok || data.Kind != ModuleKindOpaqueData {
+		return nil, errInvalidArchiveMetadata(fmt.Errorf("entry is not opaque data"))
+	}
+
+	content, err := data.Source.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal(content, &metadata); err != nil {
+		return nil, errInvalidArchiveMetadata(err)
+	}
+	return metadata, nil
+}
+
+// ArchiveMetadata returns the archive-level metadata. V1 archives have
+// none.
+func (e *EszipUnion) ArchiveMetadata(ctx context.Context) (map[string]string, error) {
+	if e.v1 != nil {
+		return nil, nil
+	}
+	return e.v2.ArchiveMetadata(ctx)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+)
+
+// Minifier shrinks JavaScript before it is embedded, such as through
+// esbuild or terser bindings. Minify gets a module's code and its source
+// map, which may be nil, and returns the minified code and a source map for
+// it. A minifier that can chain maps should map back to the original
+// source; a nil map leaves the module without one, since the old map no
+// longer matches the code.
+type Minifier interface {
+	Minify(specifier string, code, sourceMap []byte) (minified, minifiedMap []byte, err error)
+}
+
+// MinifierFunc adapts a function to the Minifier interface.
+type MinifierFunc func(specifier string, code, sourceMap []byte) (minified, minifiedMap []byte, err error)
+
+// Minify calls f.
+func (f MinifierFunc) Minify(specifier string, code, sourceMap []byte) ([]byte, []byte, error) {
+	return f(specifier, code, sourceMap)
+}
+
+// MinifySources passes every JavaScript module through m in archive order,
+// waiting on ctx for sources still streaming in, and returns how many
+// modules it minified. Other kinds of module, redirects and reserved
+// entries are left alone. Minified modules remember the length of their
+// source before, which WithWriteReport reports, until their source is
+// replaced.
+//
+// Changes are applied one module at a time, as by TransformSources: if m
+// fails, the modules before it stay minified, and a module replaced
+// concurrently keeps the newer content.
+func (e *EszipV2) MinifySources(ctx context.Context, m Minifier) (int, error) {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	minified := 0
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok || data.Kind != ModuleKindJavaScript || isReservedSpecifier(specifier) {
+			continue
+		}
+		source, err := data.Source.Get(ctx)
+		if err != nil {
+			return minified, err
+		}
+		sourceMap, err := data.SourceMap.Get(ctx)
+		if err != nil {
+			return minified, err
+		}
+		if len(sourceMap) == 0 {
+			sourceMap = nil
+		}
+		code, codeMap, err := m.Minify(specifier, source, sourceMap)
+		if err != nil {
+			return minified, fmt.Errorf("minifying %s: %w", specifier, err)
+		}
+
+		updated := &ModuleData{
+			Kind:         data.Kind,
+			Source:       NewReadySourceSlot(code),
+			SourceMap:    NewReadySourceSlot(codeMap),
+			Headers:      data.Headers,
+			Aux:          data.Aux,
+			minified:     true,
+			originalSize: int64(len(source)),
+		}
+		// A module minified twice reports the size it had to begin with.
+		if data.minified {
+			updated.originalSize = data.originalSize
+		}
+
+		e.mu.Lock()
+		if current, ok := e.modules.Get(specifier); ok && current == entries[i] {
+			e.modules.Insert(specifier, updated)
+			minified++
+		}
+		e.mu.Unlock()
+	}
+	return minified, nil
+}
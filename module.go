@@ -4,7 +4,13 @@ package eszip
 
 import (
 	"context"
+	"fmt"
+	"maps"
+	"slices"
 	"sync"
+
+	"github.com/JakeChampion/eszip/sourcemap"
+	"github.com/JakeChampion/eszip/wasm"
 )
 
 // ModuleKind represents the type of module stored
@@ -39,6 +45,8 @@ func (k ModuleKind) String() string {
 type Module struct {
 	Specifier string
 	Kind      ModuleKind
+	headers   map[string]string
+	deps      []string
 	inner     moduleInner
 }
 
@@ -71,6 +79,58 @@ func (m *Module) TakeSourceMap(ctx context.Context) ([]byte, error) {
 	return m.inner.takeSourceMap(ctx, m.Specifier)
 }
 
+// Headers returns a copy of the headers stored with the module, or nil if
+// it has none. V1 archives and archives before v2.4 have none.
+func (m *Module) Headers() map[string]string {
+	return maps.Clone(m.headers)
+}
+
+// Dependencies returns a copy of the specifiers the module depends on, as
+// recorded in V1 archives, or nil if none are recorded. V2 archives do not
+// record dependencies; BuildModuleGraph finds them by scanning sources.
+func (m *Module) Dependencies() []string {
+	return slices.Clone(m.deps)
+}
+
+// WasmInfo decodes the imports, exports and memories of a Wasm module's
+// source; see wasm.Parse. It fails for modules of other kinds, and with a
+// *wasm.FormatError if the source is not a well-formed WebAssembly binary.
+func (m *Module) WasmInfo(ctx context.Context) (*wasm.Info, error) {
+	if m.Kind != ModuleKindWasm {
+		return nil, fmt.Errorf("eszip: %s is a %s module, not wasm", m.Specifier, m.Kind)
+	}
+	source, err := m.Source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if source == nil {
+		return nil, fmt.Errorf("eszip: source of %s was taken", m.Specifier)
+	}
+	return wasm.Parse(source)
+}
+
+// ParsedSourceMap decodes the module's source map; see sourcemap.Parse.
+// A JavaScript module stored without one falls back to a map inlined in
+// its source as a data: URL. It fails if the module has no source map, and
+// with a *sourcemap.FormatError if the map is malformed.
+func (m *Module) ParsedSourceMap(ctx context.Context) (*sourcemap.Map, error) {
+	data, err := m.SourceMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 && m.Kind == ModuleKindJavaScript {
+		source, err := m.Source(ctx)
+		if err != nil {
+			return nil, err
+		}
+		_, data = SplitInlineSourceMap(source)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("eszip: %s has no source map", m.Specifier)
+	}
+	return sourcemap.Parse(data)
+}
+
 // SourceSlotState represents the state of a source slot
 type SourceSlotState int
 
@@ -78,6 +138,12 @@ const (
 	SourceSlotPending SourceSlotState = iota
 	SourceSlotReady
 	SourceSlotTaken
+	// SourceSlotNotLoaded means loading stopped before reaching the slot;
+	// see Completion.Abort and WithRecovery.
+	SourceSlotNotLoaded
+	// SourceSlotLazy means the content stays in the archive and is read
+	// each time it is requested; see ParseV2Lazy.
+	SourceSlotLazy
 )
 
 // SourceSlot represents a pending or loaded source
@@ -88,6 +154,7 @@ type SourceSlot struct {
 	offset uint32
 	length uint32
 	waitCh chan struct{}
+	lazy   *lazyContent
 }
 
 // NewPendingSourceSlot creates a new pending source slot
@@ -125,6 +192,29 @@ func (s *SourceSlot) SetReady(data []byte) {
 	close(s.waitCh)
 }
 
+// setNotLoaded resolves a pending slot as never to be loaded, waking any
+// waiters.
+func (s *SourceSlot) setNotLoaded() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == SourceSlotPending {
+		s.state = SourceSlotNotLoaded
+		close(s.waitCh)
+	}
+}
+
+// setLazy resolves a pending slot as read on demand from lazy, waking any
+// waiters.
+func (s *SourceSlot) setLazy(lazy *lazyContent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state == SourceSlotPending {
+		s.lazy = lazy
+		s.state = SourceSlotLazy
+		close(s.waitCh)
+	}
+}
+
 // Get returns the source data, blocking until ready or context cancelled
 func (s *SourceSlot) Get(ctx context.Context) ([]byte, error) {
 	s.mu.RLock()
@@ -133,10 +223,19 @@ func (s *SourceSlot) Get(ctx context.Context) ([]byte, error) {
 		s.mu.RUnlock()
 		return data, nil
 	}
+	if s.state == SourceSlotLazy {
+		lazy := s.lazy
+		s.mu.RUnlock()
+		return lazy.read(ctx, int(s.length))
+	}
 	if s.state == SourceSlotTaken {
 		s.mu.RUnlock()
 		return nil, nil
 	}
+	if s.state == SourceSlotNotLoaded {
+		s.mu.RUnlock()
+		return nil, errSourceNotLoaded()
+	}
 	waitCh := s.waitCh
 	s.mu.RUnlock()
 
@@ -146,8 +245,13 @@ func (s *SourceSlot) Get(ctx context.Context) ([]byte, error) {
 	case <-waitCh:
 		s.mu.RLock()
 		defer s.mu.RUnlock()
-		if s.state == SourceSlotTaken {
+		switch s.state {
+		case SourceSlotTaken:
 			return nil, nil
+		case SourceSlotNotLoaded:
+			return nil, errSourceNotLoaded()
+		case SourceSlotLazy:
+			return s.lazy.read(ctx, int(s.length))
 		}
 		return s.data, nil
 	}
@@ -174,8 +278,19 @@ func (s *SourceSlot) Take(ctx context.Context) ([]byte, error) {
 
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.state == SourceSlotTaken {
+	switch s.state {
+	case SourceSlotTaken:
 		return nil, nil
+	case SourceSlotNotLoaded:
+		return nil, errSourceNotLoaded()
+	case SourceSlotLazy:
+		data, err := s.lazy.read(ctx, int(s.length))
+		if err != nil {
+			return nil, err
+		}
+		s.lazy = nil
+		s.state = SourceSlotTaken
+		return data, nil
 	}
 	data := s.data
 	s.data = nil
@@ -195,6 +310,26 @@ func (s *SourceSlot) Offset() uint32 {
 	return s.offset
 }
 
+// declaredLen returns the content length without waiting for the slot: the
+// length recorded in the header while pending, otherwise the loaded length.
+func (s *SourceSlot) declaredLen() int64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.state == SourceSlotPending || s.state == SourceSlotLazy {
+		return int64(s.length)
+	}
+	return int64(len(s.data))
+}
+
+// recordedOffset returns the offset the header records for the content,
+// or -1 if it records none.
+func (s *SourceSlot) recordedOffset() int64 {
+	if s.length == 0 {
+		return -1
+	}
+	return int64(s.offset)
+}
+
 // Length returns the length in the sources section
 func (s *SourceSlot) Length() uint32 {
 	return s.length
@@ -3,6 +3,7 @@
 package eszip
 
 import (
+	"slices"
 	"sync"
 )
 
@@ -23,6 +24,19 @@ type ModuleData struct {
 	Kind      ModuleKind
 	Source    *SourceSlot
 	SourceMap *SourceSlot
+	// Headers are key/value pairs kept with the module, such as HTTP
+	// response headers; see AddModuleWithHeaders. They are written from
+	// format v2.4 and must not be modified once added.
+	Headers map[string]string
+	// Aux holds named auxiliary blobs kept with the module, such as a
+	// compiled code cache; see Module.SetAux. They are written from format
+	// v2.5 and must not be modified once added.
+	Aux map[string][]byte
+
+	// minified is set by MinifySources, and originalSize is then the
+	// length of the source before it was first minified.
+	minified     bool
+	originalSize int64
 }
 
 func (ModuleData) isEszipV2Module() {}
@@ -61,18 +75,24 @@ func (m *ModuleMap) Insert(specifier string, module EszipV2Module) {
 
 // InsertFront adds a module at the front (for import maps)
 func (m *ModuleMap) InsertFront(specifier string, module EszipV2Module) {
+	m.insertAt(0, specifier, module)
+}
+
+// insertAt adds or moves a module to position i, or to the end if there are
+// fewer than i other entries.
+func (m *ModuleMap) insertAt(i int, specifier string, module EszipV2Module) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if _, exists := m.data[specifier]; exists {
 		// Remove from current position
-		for i, s := range m.order {
+		for j, s := range m.order {
 			if s == specifier {
-				m.order = append(m.order[:i], m.order[i+1:]...)
+				m.order = append(m.order[:j], m.order[j+1:]...)
 				break
 			}
 		}
 	}
-	m.order = append([]string{specifier}, m.order...)
+	m.order = slices.Insert(m.order, min(i, len(m.order)), specifier)
 	m.data[specifier] = module
 }
 
@@ -101,6 +121,33 @@ func (m *ModuleMap) Remove(specifier string) (EszipV2Module, bool) {
 	return mod, ok
 }
 
+// rename moves the entry under oldSpecifier to newSpecifier in the same
+// position. newSpecifier must not be in the map.
+func (m *ModuleMap) rename(oldSpecifier, newSpecifier string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	mod, ok := m.data[oldSpecifier]
+	if !ok {
+		return false
+	}
+	delete(m.data, oldSpecifier)
+	m.data[newSpecifier] = mod
+	m.order[slices.Index(m.order, oldSpecifier)] = newSpecifier
+	return true
+}
+
+// at returns the specifier and entry at position i, or false if there are
+// no more than i entries.
+func (m *ModuleMap) at(i int) (string, EszipV2Module, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if i >= len(m.order) {
+		return "", nil, false
+	}
+	specifier := m.order[i]
+	return specifier, m.data[specifier], true
+}
+
 // Keys returns all specifiers in order
 func (m *ModuleMap) Keys() []string {
 	m.mu.RLock()
@@ -110,6 +157,20 @@ func (m *ModuleMap) Keys() []string {
 	return keys
 }
 
+// snapshot returns the specifiers and their entries in order, captured
+// under a single lock so the two slices are consistent with each other.
+func (m *ModuleMap) snapshot() ([]string, []EszipV2Module) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, len(m.order))
+	copy(keys, m.order)
+	entries := make([]EszipV2Module, len(keys))
+	for i, key := range keys {
+		entries[i] = m.data[key]
+	}
+	return keys, entries
+}
+
 // Len returns the number of modules
 func (m *ModuleMap) Len() int {
 	m.mu.RLock()
@@ -0,0 +1,89 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrSpecifierNotFound is returned when a mutation names a specifier the
+// archive does not have.
+var ErrSpecifierNotFound = errors.New("eszip: specifier not found")
+
+// ErrSpecifierExists is returned by RenameSpecifier when the new name is
+// already taken.
+var ErrSpecifierExists = errors.New("eszip: specifier already exists")
+
+// RemoveModule removes the module or redirect stored under specifier and
+// reports whether there was one. Redirects that pointed at it are kept and
+// no longer resolve; remove or rename them too if that is not wanted.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) RemoveModule(specifier string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.modules.Remove(specifier); !ok {
+		return false
+	}
+	if e.importMap == specifier {
+		e.importMap = ""
+	}
+	return true
+}
+
+// ReplaceModuleSource replaces the source and source map of the module
+// stored under specifier, keeping its kind and its place in the archive.
+// A nil sourceMap removes the source map. It fails with
+// ErrSpecifierNotFound if specifier is missing or is not a module; use the
+// redirect's target to replace the module behind a redirect.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) ReplaceModuleSource(specifier string, source, sourceMap []byte) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	existing, _ := e.modules.Get(specifier)
+	data, ok := existing.(*ModuleData)
+	if !ok {
+		return fmt.Errorf("%w: %s is not a module", ErrSpecifierNotFound, specifier)
+	}
+	// Readers holding the old entry keep its slots.
+	e.modules.Insert(specifier, &ModuleData{
+		Kind:      data.Kind,
+		Source:    NewReadySourceSlot(source),
+		SourceMap: NewReadySourceSlot(sourceMap),
+		Headers:   data.Headers,
+		Aux:       data.Aux,
+	})
+	return nil
+}
+
+// RenameSpecifier moves the entry stored under oldSpecifier to
+// newSpecifier, keeping its place in the archive, and points every
+// redirect that targeted oldSpecifier at newSpecifier. It fails with
+// ErrSpecifierNotFound if oldSpecifier is missing and ErrSpecifierExists if
+// newSpecifier is taken.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) RenameSpecifier(oldSpecifier, newSpecifier string) error {
+	if oldSpecifier == newSpecifier {
+		return nil
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, ok := e.modules.Get(oldSpecifier); !ok {
+		return fmt.Errorf("%w: %s", ErrSpecifierNotFound, oldSpecifier)
+	}
+	if _, ok := e.modules.Get(newSpecifier); ok {
+		return fmt.Errorf("%w: %s", ErrSpecifierExists, newSpecifier)
+	}
+	e.modules.rename(oldSpecifier, newSpecifier)
+
+	keys, entries := e.modules.snapshot()
+	for i, entry := range entries {
+		if r, ok := entry.(*ModuleRedirect); ok && r.Target == oldSpecifier {
+			e.modules.Insert(keys[i], &ModuleRedirect{Target: newSpecifier})
+		}
+	}
+	if e.importMap == oldSpecifier {
+		e.importMap = newSpecifier
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+)
+
+// NormalizeOptions controls the canonical form produced by Normalize.
+type NormalizeOptions struct {
+	// Checksum is the checksum algorithm of the result.
+	Checksum ChecksumType
+	// ChecksumSize truncates each checksum; see SetChecksumSize. Zero
+	// keeps the full digest.
+	ChecksumSize uint8
+	// StripSourceMaps drops every source map.
+	StripSourceMaps bool
+	// Version is the format version of the result, checked as SetVersion
+	// checks it; in addition, npm package integrity data fails before
+	// V2.6 rather than being left out. The zero value, VersionV2, leaves
+	// the version to Normalize; call SetVersion on the result to write
+	// V2 itself.
+	Version EszipVersion
+}
+
+// Normalize returns a canonical copy of e: opts.Version, or DefaultVersion
+// (v2.4 if any module has headers, v2.5 if any has auxiliary data, v2.6 if
+// any npm package has integrity data), the requested checksum, the import
+// map first, the archive metadata and entrypoints next, then modules
+// sorted by specifier followed by redirects sorted by specifier, and a
+// validated npm snapshot with packages sorted by ID.
+//
+// Archives with the same content normalize to byte-identical output from
+// IntoBytes, whatever their entry order, checksum or version, and
+// normalizing a normalized archive changes nothing. Sources still streaming
+// in are waited for on ctx.
+//
+// For parsed archives the import map is recognised as Summary does, so a
+// JSON (rather than JSONC) import map only keeps its place while the
+// archive is in memory.
+//
+// npm specifier entries added directly to the module map are dropped; the
+// npm snapshot's root packages describe the same thing.
+func Normalize(ctx context.Context, e *EszipUnion, opts NormalizeOptions) (*EszipV2, error) {
+	if opts.Version < VersionV2 || opts.Version > LatestVersion {
+		return nil, fmt.Errorf("eszip: unknown format version %d", opts.Version)
+	}
+	out := NewV2()
+	out.SetChecksum(opts.Checksum)
+	if err := out.SetChecksumSize(opts.ChecksumSize); err != nil {
+		return nil, err
+	}
+
+	var importMap string
+	var keys []string
+	var entries []EszipV2Module
+	if e.v1 != nil {
+		for spec, entry := range e.equalEntries() {
+			keys = append(keys, spec)
+			if entry.data != nil {
+				entries = append(entries, entry.data)
+			} else {
+				entries = append(entries, &ModuleRedirect{Target: entry.target})
+			}
+		}
+	} else {
+		e.v2.mu.RLock()
+		importMap = e.v2.importMap
+		keys, entries = e.v2.modules.snapshot()
+		e.v2.mu.RUnlock()
+		importMap = leadingImportMap(importMap, keys, entries)
+	}
+
+	type module struct {
+		specifier string
+		data      *ModuleData
+	}
+	var modules []module
+	var redirects []string
+	targets := make(map[string]string)
+	var importMapData *ModuleData
+	for i, entry := range entries {
+		switch m := entry.(type) {
+		case *ModuleData:
+			switch {
+			case keys[i] == importMap:
+				importMapData = m
+			case keys[i] == ArchiveMetadataSpecifier, keys[i] == EntrypointsSpecifier:
+				// Re-encoded below, which also validates them.
+			default:
+				modules = append(modules, module{keys[i], m})
+			}
+		case *ModuleRedirect:
+			redirects = append(redirects, keys[i])
+			targets[keys[i]] = m.Target
+		}
+	}
+	sort.Slice(modules, func(i, j int) bool { return modules[i].specifier < modules[j].specifier })
+	slices.Sort(redirects)
+
+	for _, m := range modules {
+		source, err := m.data.Source.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		var sourceMap []byte
+		if !opts.StripSourceMaps {
+			if sourceMap, err = m.data.SourceMap.Get(ctx); err != nil {
+				return nil, err
+			}
+		}
+		out.AddModuleWithHeaders(m.specifier, m.data.Kind, source, sourceMap, m.data.Headers)
+		for name, blob := range m.data.Aux {
+			if err := out.SetModuleAux(m.specifier, name, blob); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, spec := range redirects {
+		out.AddRedirect(spec, targets[spec])
+	}
+
+	metadata, err := e.ArchiveMetadata(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out.SetArchiveMetadata(metadata)
+	entrypoints, err := e.Entrypoints(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out.SetEntrypoints(entrypoints)
+
+	if importMapData != nil {
+		source, err := importMapData.Source.Get(ctx)
+		if err != nil {
+			return nil, err
+		}
+		out.AddImportMap(importMapData.Kind, importMap, source)
+	}
+
+	snapshot, err := normalizeNpmSnapshot(e.npmSnapshot())
+	if err != nil {
+		return nil, err
+	}
+	out.npmSnapshot = snapshot
+	if hasNpmIntegrity(snapshot) {
+		if opts.Version != VersionV2 && !opts.Version.SupportsNpmIntegrity() {
+			return nil, fmt.Errorf("%w: %s has no npm package integrity", ErrVersionTooOld, opts.Version)
+		}
+		out.version = max(out.version, VersionV2_6)
+	}
+	if opts.Version != VersionV2 {
+		if err := out.SetVersion(opts.Version); err != nil {
+			return nil, err
+		}
+	}
+
+	return out, nil
+}
+
+// normalizeNpmSnapshot copies snapshot with packages sorted by ID, checking
+// that package IDs are unique and that every root and dependency refers to
+// a package in the snapshot. An empty snapshot normalizes to nil.
+func normalizeNpmSnapshot(snapshot *NpmResolutionSnapshot) (*NpmResolutionSnapshot, error) {
+	if snapshot == nil || (len(snapshot.Packages) == 0 && len(snapshot.RootPackages) == 0) {
+		return nil, nil
+	}
+
+	known := make(map[string]bool, len(snapshot.Packages))
+	for _, pkg := range snapshot.Packages {
+		id := pkg.ID.String()
+		if known[id] {
+			return nil, fmt.Errorf("invalid npm snapshot: duplicate package %s", id)
+		}
+		known[id] = true
+	}
+	for req, id := range snapshot.RootPackages {
+		if !known[id.String()] {
+			return nil, fmt.Errorf("invalid npm snapshot: root %q resolves to unknown package %s", req, id)
+		}
+	}
+
+	packages := make([]*NpmPackage, 0, len(snapshot.Packages))
+	for _, pkg := range snapshot.Packages {
+		deps := make(map[string]*NpmPackageID, len(pkg.Dependencies))
+		for req, id := range pkg.Dependencies {
+			if !known[id.String()] {
+				return nil, fmt.Errorf("invalid npm snapshot: package %s depends on unknown package %s", pkg.ID, id)
+			}
+			deps[req] = &NpmPackageID{Name: id.Name, Version: id.Version}
+		}
+		packages = append(packages, &NpmPackage{
+			ID:           &NpmPackageID{Name: pkg.ID.Name, Version: pkg.ID.Version},
+			Dependencies: deps,
+			Integrity:    pkg.Integrity,
+			Tarball:      pkg.Tarball,
+		})
+	}
+	sort.Slice(packages, func(i, j int) bool { return packages[i].ID.String() < packages[j].ID.String() })
+
+	roots := make(map[string]*NpmPackageID, len(snapshot.RootPackages))
+	for req, id := range snapshot.RootPackages {
+		roots[req] = &NpmPackageID{Name: id.Name, Version: id.Version}
+	}
+
+	return &NpmResolutionSnapshot{Packages: packages, RootPackages: roots}, nil
+}
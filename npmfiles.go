@@ -0,0 +1,77 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// The files of npm packages can be embedded beside the resolution snapshot,
+// so that an archive carries everything needed to run offline. Each file
+// is an opaque data module under npm:///<name>@<version>/<path>, with the
+// path segments percent-encoded. Package files are not part of the module
+// graph.
+const npmFilePrefix = "npm:///"
+
+// NpmFileSpecifier returns the specifier of the file at path, slash-separated
+// and relative to the package root, of the npm package id.
+func NpmFileSpecifier(id *NpmPackageID, path string) string {
+	segments := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return npmFilePrefix + id.String() + "/" + strings.Join(segments, "/")
+}
+
+// ParseNpmFileSpecifier is the inverse of NpmFileSpecifier. It reports false
+// for specifiers that do not name an npm package file.
+func ParseNpmFileSpecifier(specifier string) (id *NpmPackageID, path string, ok bool) {
+	rest, ok := strings.CutPrefix(specifier, npmFilePrefix)
+	if !ok {
+		return nil, "", false
+	}
+	segments := strings.Split(rest, "/")
+	n := 1
+	if strings.HasPrefix(rest, "@") {
+		// A scoped name, such as @types/node, spans two segments.
+		n = 2
+	}
+	if len(segments) <= n {
+		return nil, "", false
+	}
+	id, err := ParseNpmPackageID(strings.Join(segments[:n], "/"))
+	if err != nil || id.Version == "" || strings.ContainsAny(id.String(), "\\\x00") {
+		return nil, "", false
+	}
+	for i, segment := range segments[n:] {
+		decoded, err := url.PathUnescape(segment)
+		if err != nil || decoded == "" || decoded == "." || decoded == ".." || strings.ContainsAny(decoded, "/\\\x00") {
+			return nil, "", false
+		}
+		segments[n+i] = decoded
+	}
+	return id, strings.Join(segments[n:], "/"), true
+}
+
+// isNpmFileSpecifier reports whether specifier names an embedded npm
+// package file.
+func isNpmFileSpecifier(specifier string) bool {
+	return strings.HasPrefix(specifier, npmFilePrefix)
+}
+
+// AddNpmPackageFile adds the file at path, slash-separated and relative to
+// the package root, of the npm package id as opaque data.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) AddNpmPackageFile(id *NpmPackageID, path string, content []byte) error {
+	if id == nil || id.Name == "" || id.Version == "" {
+		return fmt.Errorf("invalid npm package id: %v", id)
+	}
+	specifier := NpmFileSpecifier(id, path)
+	if _, p, ok := ParseNpmFileSpecifier(specifier); !ok || p != strings.TrimPrefix(path, "/") {
+		return fmt.Errorf("invalid path %q in npm package %s", path, id)
+	}
+	e.AddOpaqueData(specifier, content)
+	return nil
+}
@@ -0,0 +1,181 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"sort"
+	"strings"
+)
+
+// The npm integrity section of V2.6 follows the module aux section. For
+// each package of the npm snapshot with an integrity digest or a tarball
+// URL, in the order of the npm section, it holds the package id, the
+// integrity and the tarball URL, each prefixed with its length as a
+// big-endian u32; either may be empty. Archives before V2.6 keep only the
+// resolution, so a reader that does not know the section loses nothing it
+// could use.
+
+// ErrNpmIntegrityMismatch is returned by VerifyTarball when a tarball does
+// not match the package's integrity digest.
+var ErrNpmIntegrityMismatch = errors.New("eszip: npm package integrity mismatch")
+
+// integrityAlgorithms are the Subresource Integrity algorithms
+// VerifyTarball checks, strongest first. sha1 is what the npm registry
+// recorded for older packages.
+var integrityAlgorithms = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha512", sha512.New},
+	{"sha384", sha512.New384},
+	{"sha256", sha256.New},
+	{"sha1", sha1.New},
+}
+
+// VerifyTarball checks a downloaded tarball against the package's
+// Integrity. As in Subresource Integrity, an integrity with several
+// digests is checked with the strongest algorithm it has, and the tarball
+// matches if any digest of that algorithm does. It fails with
+// ErrNpmIntegrityMismatch if the tarball does not match, and with another
+// error if the package has no integrity or none that can be checked.
+func (p *NpmPackage) VerifyTarball(data []byte) error {
+	if p.Integrity == "" {
+		return fmt.Errorf("eszip: npm package %s has no integrity", p.ID)
+	}
+	digests := make(map[string][][]byte)
+	for _, field := range strings.Fields(p.Integrity) {
+		algorithm, digest, ok := strings.Cut(field, "-")
+		if !ok {
+			continue
+		}
+		// Options after a ? are reserved and ignored.
+		digest, _, _ = strings.Cut(digest, "?")
+		decoded, err := base64.StdEncoding.DecodeString(digest)
+		if err != nil {
+			continue
+		}
+		digests[algorithm] = append(digests[algorithm], decoded)
+	}
+	for _, algorithm := range integrityAlgorithms {
+		want, ok := digests[algorithm.name]
+		if !ok {
+			continue
+		}
+		h := algorithm.new()
+		h.Write(data)
+		got := h.Sum(nil)
+		for _, digest := range want {
+			if bytes.Equal(got, digest) {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w: %s tarball has %s-%s", ErrNpmIntegrityMismatch, p.ID, algorithm.name, base64.StdEncoding.EncodeToString(got))
+	}
+	return fmt.Errorf("eszip: npm package %s has no supported integrity digest: %s", p.ID, p.Integrity)
+}
+
+// hasNpmIntegrity reports whether any package of snapshot has an integrity
+// or tarball URL to write.
+func hasNpmIntegrity(snapshot *NpmResolutionSnapshot) bool {
+	if snapshot == nil {
+		return false
+	}
+	for _, pkg := range snapshot.Packages {
+		if pkg.Integrity != "" || pkg.Tarball != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// appendNpmIntegrity returns the content of the npm integrity section for
+// snapshot, with packages sorted by ID as appendNpmSnapshot sorts them.
+func appendNpmIntegrity(buf []byte, snapshot *NpmResolutionSnapshot) []byte {
+	if !hasNpmIntegrity(snapshot) {
+		return buf
+	}
+	packages := make([]*NpmPackage, len(snapshot.Packages))
+	copy(packages, snapshot.Packages)
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].ID.String() < packages[j].ID.String()
+	})
+	for _, pkg := range packages {
+		if pkg.Integrity == "" && pkg.Tarball == "" {
+			continue
+		}
+		appendString(&buf, pkg.ID.String())
+		appendString(&buf, pkg.Integrity)
+		appendString(&buf, pkg.Tarball)
+	}
+	return buf
+}
+
+// parseNpmIntegritySection reads the npm integrity section and sets the
+// integrity and tarball URL of the packages of snapshot.
+func parseNpmIntegritySection(br *archiveReader, options Options, snapshot *NpmResolutionSnapshot) error {
+	start := br.offset
+	section, err := readSection(br, options)
+	if err != nil {
+		return err
+	}
+	br.reportSection("npm_integrity", start)
+
+	if !br.checksumValid(section) {
+		return errInvalidV26NpmIntegrityHash(section)
+	}
+
+	content := section.Content()
+	read := 0
+	readString := func(what string) (string, error) {
+		if read+4 > len(content) {
+			return "", errInvalidV26NpmIntegrity(what+" len", section.offset+read)
+		}
+		n := int(binary.BigEndian.Uint32(content[read : read+4]))
+		read += 4
+		if n > len(content)-read {
+			return "", errInvalidV26NpmIntegrity(what, section.offset+read)
+		}
+		s := string(content[read : read+n])
+		read += n
+		return s, nil
+	}
+
+	packages := make(map[string]*NpmPackage)
+	if snapshot != nil {
+		for _, pkg := range snapshot.Packages {
+			packages[pkg.ID.String()] = pkg
+		}
+	}
+	seen := make(map[string]bool)
+	for read < len(content) {
+		offset := section.offset + read
+		id, err := readString("package id")
+		if err != nil {
+			return err
+		}
+		pkg, ok := packages[id]
+		if !ok {
+			return errInvalidV26NpmIntegrity("integrity for "+id+", which is not in the npm snapshot", offset)
+		}
+		if seen[id] {
+			return errInvalidV26NpmIntegrity("duplicate integrity for "+id, offset)
+		}
+		seen[id] = true
+		if pkg.Integrity, err = readString("integrity"); err != nil {
+			return err
+		}
+		if pkg.Tarball, err = readString("tarball"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
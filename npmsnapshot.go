@@ -0,0 +1,283 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ErrNpmPackageNotFound is returned when an npm requirement or package id is
+// not in the resolution snapshot.
+var ErrNpmPackageNotFound = errors.New("eszip: npm package not found")
+
+// NpmDependencyNode is a package in the tree DependencyTree returns.
+type NpmDependencyNode struct {
+	// Req is the requirement the parent resolved to this package, such as
+	// "ms@^2.1.3", and is empty for the root of the tree.
+	Req     string
+	Package *NpmPackage
+	// Dependencies are the package's dependencies, sorted by requirement.
+	Dependencies []*NpmDependencyNode
+	// Cycle is set when the package is already one of the node's
+	// ancestors. Its dependencies are then not repeated.
+	Cycle bool
+}
+
+// Package returns the package with the given id.
+func (s *NpmResolutionSnapshot) Package(id *NpmPackageID) (*NpmPackage, error) {
+	key := id.String()
+	for _, pkg := range s.Packages {
+		if pkg.ID.String() == key {
+			return pkg, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNpmPackageNotFound, key)
+}
+
+// roots returns s.RootPackages, or nil if s is nil. Their requirements are
+// the archive's npm specifiers, which redirects may lead to.
+func (s *NpmResolutionSnapshot) roots() map[string]*NpmPackageID {
+	if s == nil {
+		return nil
+	}
+	return s.RootPackages
+}
+
+// ResolvePackage returns the package a root requirement, such as "chalk@5"
+// or "npm:chalk@5", resolves to. A requirement that is not a root but is
+// the exact id of a package, such as "chalk@5.3.0", resolves to that
+// package.
+func (s *NpmResolutionSnapshot) ResolvePackage(req string) (*NpmPackage, error) {
+	req = strings.TrimPrefix(req, "npm:")
+	if id, ok := s.RootPackages[req]; ok {
+		pkg, err := s.Package(id)
+		if err != nil {
+			return nil, fmt.Errorf("%w, resolved to from %s", err, req)
+		}
+		return pkg, nil
+	}
+	if id, err := ParseNpmPackageID(req); err == nil {
+		if pkg, err := s.Package(id); err == nil {
+			return pkg, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNpmPackageNotFound, req)
+}
+
+// DependencyTree returns the package with the given id and, recursively,
+// the packages it depends on. A package reached again below itself is
+// marked as a cycle rather than expanded, so the tree is always finite; one
+// reached again on another branch is expanded there too.
+func (s *NpmResolutionSnapshot) DependencyTree(id *NpmPackageID) (*NpmDependencyNode, error) {
+	packages := s.packagesByID()
+	var build func(req string, id *NpmPackageID, ancestors map[string]bool) (*NpmDependencyNode, error)
+	build = func(req string, id *NpmPackageID, ancestors map[string]bool) (*NpmDependencyNode, error) {
+		key := id.String()
+		pkg, ok := packages[key]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrNpmPackageNotFound, key)
+		}
+		node := &NpmDependencyNode{Req: req, Package: pkg}
+		if ancestors[key] {
+			node.Cycle = true
+			return node, nil
+		}
+		ancestors[key] = true
+		defer delete(ancestors, key)
+		for _, depReq := range slices.Sorted(maps.Keys(pkg.Dependencies)) {
+			child, err := build(depReq, pkg.Dependencies[depReq], ancestors)
+			if err != nil {
+				return nil, fmt.Errorf("%w, a dependency of %s", err, key)
+			}
+			node.Dependencies = append(node.Dependencies, child)
+		}
+		return node, nil
+	}
+	return build("", id, make(map[string]bool))
+}
+
+// AllVersionsOf returns the packages named name, oldest version first.
+func (s *NpmResolutionSnapshot) AllVersionsOf(name string) []*NpmPackage {
+	var versions []*NpmPackage
+	for _, pkg := range s.Packages {
+		if pkg.ID.Name == name {
+			versions = append(versions, pkg)
+		}
+	}
+	slices.SortFunc(versions, func(a, b *NpmPackage) int {
+		return compareNpmVersions(a.ID.Version, b.ID.Version)
+	})
+	return versions
+}
+
+// Cycles returns the groups of packages that depend on each other, directly
+// or through other packages, including a package that depends on itself.
+// npm allows such cycles, but a runtime that loads dependencies before
+// their dependents has to break them. Each group is sorted by id, and the
+// groups by their first id. Dependencies on packages that are not in the
+// snapshot are ignored.
+func (s *NpmResolutionSnapshot) Cycles() [][]*NpmPackageID {
+	packages := s.packagesByID()
+
+	// Tarjan's strongly connected components algorithm.
+	index := make(map[string]int, len(packages))
+	lowlink := make(map[string]int, len(packages))
+	onStack := make(map[string]bool)
+	var stack []string
+	var cycles [][]*NpmPackageID
+	var visit func(key string)
+	visit = func(key string) {
+		index[key] = len(index)
+		lowlink[key] = index[key]
+		stack = append(stack, key)
+		onStack[key] = true
+		selfLoop := false
+		for _, dep := range packages[key].Dependencies {
+			depKey := dep.String()
+			if _, ok := packages[depKey]; !ok {
+				continue
+			}
+			if depKey == key {
+				selfLoop = true
+			}
+			if _, seen := index[depKey]; !seen {
+				visit(depKey)
+				lowlink[key] = min(lowlink[key], lowlink[depKey])
+			} else if onStack[depKey] {
+				lowlink[key] = min(lowlink[key], index[depKey])
+			}
+		}
+		if lowlink[key] != index[key] {
+			return
+		}
+		var group []string
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			group = append(group, top)
+			if top == key {
+				break
+			}
+		}
+		if len(group) == 1 && !selfLoop {
+			return
+		}
+		slices.Sort(group)
+		ids := make([]*NpmPackageID, len(group))
+		for i, k := range group {
+			ids[i] = packages[k].ID
+		}
+		cycles = append(cycles, ids)
+	}
+	for _, key := range slices.Sorted(maps.Keys(packages)) {
+		if _, seen := index[key]; !seen {
+			visit(key)
+		}
+	}
+	slices.SortFunc(cycles, func(a, b []*NpmPackageID) int {
+		return strings.Compare(a[0].String(), b[0].String())
+	})
+	return cycles
+}
+
+// packagesByID indexes the snapshot's packages by their serialized id.
+func (s *NpmResolutionSnapshot) packagesByID() map[string]*NpmPackage {
+	packages := make(map[string]*NpmPackage, len(s.Packages))
+	for _, pkg := range s.Packages {
+		packages[pkg.ID.String()] = pkg
+	}
+	return packages
+}
+
+// compareNpmVersions orders versions by semver precedence: numerically by
+// major, minor and patch, a prerelease before its release, and build
+// metadata last. Versions that are not semver sort after those that are,
+// by string.
+func compareNpmVersions(a, b string) int {
+	av, aok := parseNpmVersion(a)
+	bv, bok := parseNpmVersion(b)
+	switch {
+	case !aok && !bok:
+		return strings.Compare(a, b)
+	case !aok:
+		return 1
+	case !bok:
+		return -1
+	}
+	for i := range av.core {
+		if av.core[i] != bv.core[i] {
+			if av.core[i] < bv.core[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case av.prerelease == "" && bv.prerelease != "":
+		return 1
+	case av.prerelease != "" && bv.prerelease == "":
+		return -1
+	}
+	if c := comparePrerelease(av.prerelease, bv.prerelease); c != 0 {
+		return c
+	}
+	return strings.Compare(av.build, bv.build)
+}
+
+type npmVersion struct {
+	core       [3]uint64
+	prerelease string
+	build      string
+}
+
+func parseNpmVersion(s string) (npmVersion, bool) {
+	var v npmVersion
+	s, v.build, _ = strings.Cut(s, "+")
+	s, v.prerelease, _ = strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	return v, true
+}
+
+// comparePrerelease compares dot-separated prerelease identifiers, numeric
+// ones numerically and before alphanumeric ones.
+func comparePrerelease(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.ParseUint(as[i], 10, 64)
+		bn, berr := strconv.ParseUint(bs[i], 10, 64)
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an < bn {
+					return -1
+				}
+				return 1
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		default:
+			if c := strings.Compare(as[i], bs[i]); c != 0 {
+				return c
+			}
+		}
+	}
+	return len(as) - len(bs)
+}
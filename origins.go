@@ -0,0 +1,141 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// OriginStats summarizes the modules fetched from one network origin.
+type OriginStats struct {
+	Modules int
+	// Bytes is the total size of the modules' sources and source maps.
+	Bytes int64
+	// Kinds lists the distinct module kinds, in ascending order.
+	Kinds []ModuleKind
+}
+
+// Origins returns statistics for every network origin modules were fetched
+// from, keyed by host (including any port). Only http and https specifiers
+// have an origin; file, data, npm and other specifiers are local. Like
+// Summary, it never waits for or loads module sources.
+func (e *EszipUnion) Origins() map[string]OriginStats {
+	return originsOf(e.ModuleSizes())
+}
+
+// Origins returns statistics for every network origin; see
+// EszipUnion.Origins.
+func (e *EszipV2) Origins() map[string]OriginStats {
+	return originsOf(e.ModuleSizes())
+}
+
+func originsOf(sizes []ModuleSize) map[string]OriginStats {
+	origins := make(map[string]OriginStats)
+	for _, m := range sizes {
+		host, ok := specifierOrigin(m.Specifier)
+		if !ok {
+			continue
+		}
+		stats := origins[host]
+		stats.Modules++
+		stats.Bytes += m.Source + m.SourceMap
+		if i, found := slices.BinarySearch(stats.Kinds, m.Kind); !found {
+			stats.Kinds = slices.Insert(stats.Kinds, i, m.Kind)
+		}
+		origins[host] = stats
+	}
+	return origins
+}
+
+// specifierOrigin returns the lower-cased host of an http or https
+// specifier, and false for specifiers that were not fetched over the
+// network.
+func specifierOrigin(specifier string) (string, bool) {
+	u, err := url.Parse(specifier)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	return strings.ToLower(u.Host), true
+}
+
+// OriginPolicyError is returned when an archive names modules from origins
+// outside the allowlist given to WithAllowedOrigins or
+// WithWriteAllowedOrigins.
+type OriginPolicyError struct {
+	// Specifiers lists every out-of-policy specifier, sorted.
+	Specifiers []string
+}
+
+func (e *OriginPolicyError) Error() string {
+	return fmt.Sprintf("eszip: %d specifier(s) from disallowed origins: %s", len(e.Specifiers), strings.Join(e.Specifiers, ", "))
+}
+
+// originPolicy is an allowlist of network origins. Each entry is a host,
+// optionally with a port, or "*." followed by a domain to allow every
+// subdomain of that domain (but not the domain itself). An entry without a
+// port allows the host on any port.
+type originPolicy struct {
+	allowed []originPattern
+}
+
+type originPattern struct {
+	host     string
+	withPort bool
+}
+
+func newOriginPolicy(allowed []string) *originPolicy {
+	p := &originPolicy{allowed: make([]originPattern, len(allowed))}
+	for i, pattern := range allowed {
+		pattern = strings.ToLower(pattern)
+		withPort := hasPort(pattern)
+		if !withPort {
+			// url.URL.Hostname drops the brackets of an IPv6 address.
+			pattern = strings.TrimSuffix(strings.TrimPrefix(pattern, "["), "]")
+		}
+		p.allowed[i] = originPattern{host: pattern, withPort: withPort}
+	}
+	return p
+}
+
+// check returns an *OriginPolicyError listing every specifier whose
+// origin is not allowed. Local specifiers are always allowed.
+func (p *originPolicy) check(specifiers []string) error {
+	var denied []string
+	for _, specifier := range specifiers {
+		if host, ok := specifierOrigin(specifier); ok && !p.allows(host) {
+			denied = append(denied, specifier)
+		}
+	}
+	if len(denied) == 0 {
+		return nil
+	}
+	slices.Sort(denied)
+	return &OriginPolicyError{Specifiers: denied}
+}
+
+func (p *originPolicy) allows(host string) bool {
+	hostname := (&url.URL{Host: host}).Hostname()
+	for _, pattern := range p.allowed {
+		candidate := hostname
+		if pattern.withPort {
+			candidate = host
+		}
+		if domain, ok := strings.CutPrefix(pattern.host, "*."); ok {
+			if strings.HasSuffix(candidate, "."+domain) {
+				return true
+			}
+		} else if candidate == pattern.host {
+			return true
+		}
+	}
+	return false
+}
+
+// hasPort reports whether a host pattern ends in a port, allowing for
+// bracketed IPv6 addresses.
+func hasPort(pattern string) bool {
+	return strings.LastIndex(pattern, ":") > strings.LastIndex(pattern, "]")
+}
@@ -0,0 +1,285 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ChangeOp is the kind of edit a Change makes.
+type ChangeOp int
+
+const (
+	// ChangeAdd appends a new module with Kind, Source and SourceMap.
+	ChangeAdd ChangeOp = iota
+	// ChangeReplaceSource replaces the source of an existing module.
+	ChangeReplaceSource
+	// ChangeReplaceSourceMap replaces the source map of an existing module;
+	// a nil SourceMap removes it.
+	ChangeReplaceSourceMap
+	// ChangeRemove removes a module or redirect.
+	ChangeRemove
+)
+
+// Change is one edit applied by PatchArchive.
+type Change struct {
+	Op        ChangeOp
+	Specifier string
+	Kind      ModuleKind
+	Source    []byte
+	SourceMap []byte
+}
+
+// PatchArchive writes to w a copy of the V2 archive in r with changes
+// applied, without loading the archive into memory. Only the headers are
+// parsed; every unchanged source and source map is copied byte for byte,
+// checksum included, from r to w, so memory use is proportional to the
+// headers and the changed content rather than the archive size.
+//
+// The output keeps the input's checksum algorithm and is written at
+// DefaultVersion, or the input's version if later. Copied content is not
+// re-verified. Changes are applied in order; adding an existing specifier
+// or changing a missing one is an error. Encrypted archives need
+// WithDecryptionKey in opts; replaced content is encrypted with the same
+// key.
+func PatchArchive(ctx context.Context, r io.ReaderAt, size int64, w io.Writer, changes []Change, opts ...ParseOption) error {
+	br := newArchiveReader(io.NewSectionReader(r, 0, size), newParseConfig(append(slices.Clip(opts), WithInputSize(size))))
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return errIO(err)
+	}
+	version, ok := VersionFromMagic(magic)
+	if !ok {
+		return errInvalidV2()
+	}
+	eszip, _, err := parseV2WithVersion(ctx, version, br)
+	if err != nil {
+		return err
+	}
+	sourcesStart := br.offset
+
+	sectionLen := func(at int64) (int64, error) {
+		var lenBytes [4]byte
+		if _, err := r.ReadAt(lenBytes[:], at); err != nil {
+			return 0, errIO(err)
+		}
+		n := int64(binary.BigEndian.Uint32(lenBytes[:]))
+		if at+4+n > size {
+			return 0, errInvalidV2SectionLength(n, size-at-4, int(at))
+		}
+		return n, nil
+	}
+	sourcesLen, err := sectionLen(sourcesStart)
+	if err != nil {
+		return err
+	}
+	sourceMapsStart := sourcesStart + 4 + sourcesLen
+	sourceMapsLen, err := sectionLen(sourceMapsStart)
+	if err != nil {
+		return err
+	}
+	if err := br.checkContentLength(false, sourcesLen, sourcesStart); err != nil {
+		return err
+	}
+	if err := br.checkContentLength(true, sourceMapsLen, sourceMapsStart); err != nil {
+		return err
+	}
+
+	if err := applyChanges(eszip.modules, changes); err != nil {
+		return err
+	}
+
+	checksum := eszip.options.Checksum
+	checksumSize := int64(eszip.options.GetChecksumSize())
+	options := eszip.options
+	sources := &patchSection{in: r, base: sourcesStart + 4, inLen: sourcesLen, checksum: checksum, checksumSize: checksumSize, options: options}
+	sourceMaps := &patchSection{in: r, base: sourceMapsStart + 4, inLen: sourceMapsLen, checksum: checksum, checksumSize: checksumSize, options: options, sourceMap: true}
+
+	var modulesHeader []byte
+	keys, entries := eszip.modules.snapshot()
+	for i, specifier := range keys {
+		appendString(&modulesHeader, specifier)
+		switch m := entries[i].(type) {
+		case *ModuleData:
+			modulesHeader = append(modulesHeader, byte(HeaderFrameModule))
+			if modulesHeader, err = sources.add(modulesHeader, specifier, m.Source); err != nil {
+				return err
+			}
+			if modulesHeader, err = sourceMaps.add(modulesHeader, specifier, m.SourceMap); err != nil {
+				return err
+			}
+			modulesHeader = append(modulesHeader, byte(m.Kind))
+		case *ModuleRedirect:
+			modulesHeader = append(modulesHeader, byte(HeaderFrameRedirect))
+			appendString(&modulesHeader, m.Target)
+		}
+	}
+	modulesHeader, npmBytes := appendNpmSnapshot(modulesHeader, eszip.npmSnapshot)
+
+	version = max(version, DefaultVersion)
+	magicOut := version.ToMagic()
+	header := append([]byte(nil), magicOut[:]...)
+	header = appendHashedSection(header, optionsHeaderContent(eszip.options), checksum, int(checksumSize))
+	header = appendHashedSection(header, modulesHeader, checksum, int(checksumSize))
+	header = appendHashedSection(header, npmBytes, checksum, int(checksumSize))
+	if version.SupportsHeaders() {
+		header = appendHashedSection(header, appendModuleHeaders(nil, keys, entries), checksum, int(checksumSize))
+	}
+	if version.SupportsAux() {
+		header = appendHashedSection(header, appendModuleAux(nil, keys, entries), checksum, int(checksumSize))
+	}
+	if version.SupportsNpmIntegrity() {
+		header = appendHashedSection(header, appendNpmIntegrity(nil, eszip.npmSnapshot), checksum, int(checksumSize))
+	}
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	if err := sources.writeTo(w); err != nil {
+		return err
+	}
+	if err := sourceMaps.writeTo(w); err != nil {
+		return err
+	}
+	// Whatever follows the known sections is copied as it is.
+	trailingStart := sourceMapsStart + 4 + sourceMapsLen
+	_, err = io.Copy(w, io.NewSectionReader(r, trailingStart, size-trailingStart))
+	return err
+}
+
+// applyChanges edits the parsed module map. Replaced content becomes a
+// ready slot; untouched slots stay pending and point into the input.
+func applyChanges(modules *ModuleMap, changes []Change) error {
+	for _, c := range changes {
+		existing, ok := modules.Get(c.Specifier)
+		switch c.Op {
+		case ChangeAdd:
+			if ok {
+				return fmt.Errorf("patch: %s already exists", c.Specifier)
+			}
+			modules.Insert(c.Specifier, &ModuleData{
+				Kind:      c.Kind,
+				Source:    NewReadySourceSlot(c.Source),
+				SourceMap: NewReadySourceSlot(c.SourceMap),
+			})
+		case ChangeRemove:
+			if !ok {
+				return fmt.Errorf("patch: %s not found", c.Specifier)
+			}
+			modules.Remove(c.Specifier)
+		case ChangeReplaceSource, ChangeReplaceSourceMap:
+			data, isModule := existing.(*ModuleData)
+			if !isModule {
+				return fmt.Errorf("patch: %s is not a module", c.Specifier)
+			}
+			replaced := *data
+			if c.Op == ChangeReplaceSource {
+				replaced.Source = NewReadySourceSlot(c.Source)
+			} else {
+				replaced.SourceMap = NewReadySourceSlot(c.SourceMap)
+			}
+			modules.Insert(c.Specifier, &replaced)
+		default:
+			return fmt.Errorf("patch: unknown change op %d", c.Op)
+		}
+	}
+	return nil
+}
+
+// patchSection lays out the sources or source maps section of a patched
+// archive as a list of pieces, each copied from the input or written from
+// memory.
+type patchSection struct {
+	in           io.ReaderAt
+	base         int64 // input offset of the section content
+	inLen        int64 // input length of the section content
+	checksum     ChecksumType
+	checksumSize int64
+	options      Options // compression and encryption of replaced content
+	sourceMap    bool    // set for the source maps section
+
+	pieces []patchPiece
+	length int64
+	// copied maps input offsets to output offsets so content shared by
+	// several modules stays shared.
+	copied map[uint32]uint32
+}
+
+// patchPiece is either a run of input bytes starting at from, or data.
+type patchPiece struct {
+	from int64
+	n    int64
+	data []byte
+}
+
+// add places the content of specifier's slot in the section and appends
+// its offset and length to the modules header.
+func (s *patchSection) add(header []byte, specifier string, slot *SourceSlot) ([]byte, error) {
+	var offset, length uint32
+	switch {
+	case slot.State() == SourceSlotPending && slot.Length() > 0:
+		if int64(slot.Offset())+int64(slot.Length())+s.checksumSize > s.inLen {
+			return nil, errInvalidV2SourceOffset(int(slot.Offset()), int(s.base)+int(slot.Offset()))
+		}
+		if s.copied == nil {
+			s.copied = make(map[uint32]uint32)
+		}
+		var ok bool
+		if offset, ok = s.copied[slot.Offset()]; !ok {
+			offset = uint32(s.length)
+			s.copied[slot.Offset()] = offset
+			s.copy(s.base+int64(slot.Offset()), int64(slot.Length())+s.checksumSize)
+		}
+		length = slot.Length()
+	case slot.State() == SourceSlotReady:
+		data, _ := slot.Get(context.Background())
+		data, err := s.options.Compression.compress(data)
+		if err != nil {
+			return nil, err
+		}
+		if data, err = s.options.encrypt(data, specifier, s.sourceMap); err != nil {
+			return nil, err
+		}
+		if len(data) > 0 {
+			offset, length = uint32(s.length), uint32(len(data))
+			piece := s.checksum.appendHash(append([]byte(nil), data...), data, int(s.checksumSize))
+			s.pieces = append(s.pieces, patchPiece{data: piece, n: int64(len(piece))})
+			s.length += int64(len(piece))
+		}
+	}
+	header = appendU32BE(header, offset)
+	return appendU32BE(header, length), nil
+}
+
+// copy schedules n input bytes starting at from, merging with the previous
+// piece when the two are contiguous in the input.
+func (s *patchSection) copy(from, n int64) {
+	if last := len(s.pieces) - 1; last >= 0 && s.pieces[last].data == nil && s.pieces[last].from+s.pieces[last].n == from {
+		s.pieces[last].n += n
+	} else {
+		s.pieces = append(s.pieces, patchPiece{from: from, n: n})
+	}
+	s.length += n
+}
+
+func (s *patchSection) writeTo(w io.Writer) error {
+	if _, err := w.Write(appendU32BE(nil, uint32(s.length))); err != nil {
+		return err
+	}
+	for _, p := range s.pieces {
+		if p.data != nil {
+			if _, err := w.Write(p.data); err != nil {
+				return err
+			}
+			continue
+		}
+		if _, err := io.Copy(w, io.NewSectionReader(s.in, p.from, p.n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Prune removes the modules that no chain of imports leads to from
+// entrypoints, as found by BuildModuleGraph, along with the redirects that
+// led to them, and returns the removed specifiers in archive order. Static
+// and string-literal dynamic imports are both followed. The import map,
+// the archive metadata, npm specifier entries, embedded npm package files
+// and redirects that resolve nowhere are kept. Entrypoints may name redirects; one that is not a
+// module in the archive fails with ErrSpecifierNotFound. With no
+// entrypoints, those recorded with SetEntrypoints are used. Sources still
+// streaming in are waited for on ctx.
+//
+// Modules loaded only through computed specifiers, such as
+// import(`./locale/${lang}.js`), are invisible to the scan and are
+// removed; name them as entrypoints to keep them.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) Prune(ctx context.Context, entrypoints ...string) ([]string, error) {
+	if len(entrypoints) == 0 {
+		recorded, err := e.Entrypoints(ctx)
+		if err != nil {
+			return nil, err
+		}
+		entrypoints = recorded
+	}
+	if len(entrypoints) == 0 {
+		return nil, errors.New("eszip: prune needs at least one entrypoint")
+	}
+	graph, err := BuildModuleGraph(ctx, &EszipUnion{v2: e})
+	if err != nil {
+		return nil, err
+	}
+	for _, spec := range entrypoints {
+		if _, ok := graph.canonical[spec]; !ok {
+			return nil, fmt.Errorf("%w: entrypoint %s", ErrSpecifierNotFound, spec)
+		}
+	}
+	unreachable := make(map[string]bool)
+	for _, spec := range graph.Unreachable(entrypoints...) {
+		unreachable[spec] = true
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	var removed []string
+	keys, _ := e.modules.snapshot()
+	for _, spec := range keys {
+		target, ok := graph.canonical[spec]
+		if !ok || !unreachable[target] || isReservedSpecifier(spec) {
+			continue
+		}
+		e.modules.Remove(spec)
+		removed = append(removed, spec)
+	}
+	return removed, nil
+}
@@ -0,0 +1,163 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"errors"
+)
+
+// RecoveryReport describes what survived the parse of a truncated V2
+// archive. See WithRecovery.
+type RecoveryReport struct {
+	// Truncated is set if the input ended inside the sources or source
+	// maps section.
+	Truncated bool
+	// TruncatedAt is the archive offset of the first entry that was cut
+	// off.
+	TruncatedAt int64
+	// Salvaged lists, in archive order, the modules whose source was read
+	// and verified in full.
+	Salvaged []RecoveredModule
+	// Lost lists, in archive order, the modules whose source was cut off.
+	Lost []RecoveredModule
+}
+
+// RecoveredModule is a module in a RecoveryReport.
+type RecoveredModule struct {
+	Specifier string
+	// Bytes is the source and source map content that was salvaged, or for
+	// a lost module the length of the content that was lost.
+	Bytes int64
+	// SourceMapLost is set for salvaged modules whose source map was cut
+	// off. They are usable without it.
+	SourceMapLost bool
+}
+
+// WithRecovery makes the parse of a V2 archive whose input ends inside the
+// sources or source maps section, as after a disk filled up mid-write,
+// succeed with whatever was read before the end. Modules whose content was
+// read and verified in full stay usable; the content of the rest is in
+// SourceSlotNotLoaded and reading it fails with ErrSourceNotLoaded. The
+// headers must be intact, and a checksum mismatch is still an error.
+//
+// report is filled in when loading the sources completes: when Parse or
+// ParseSync returns, or when a Completion reports done. Salvage builds a
+// valid archive from what was recovered.
+func WithRecovery(report *RecoveryReport) ParseOption {
+	return func(c *parseConfig) {
+		c.recovery = report
+	}
+}
+
+// isTruncation reports whether err from reading a content section means
+// the input ended.
+func isTruncation(err error) bool {
+	var pe *ParseError
+	return errors.As(err, &pe) && (pe.Type == ErrIO || pe.Type == ErrInvalidV2SectionLength)
+}
+
+// fillRecoveryReport records which modules of e have their source loaded.
+func fillRecoveryReport(report *RecoveryReport, e *EszipV2) {
+	report.Salvaged, report.Lost = nil, nil
+	keys, entries := e.modules.snapshot()
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok {
+			continue
+		}
+		if data.Source.State() == SourceSlotNotLoaded {
+			lost := int64(data.Source.Length())
+			if data.SourceMap.State() == SourceSlotNotLoaded {
+				lost += int64(data.SourceMap.Length())
+			}
+			report.Lost = append(report.Lost, RecoveredModule{Specifier: specifier, Bytes: lost})
+			continue
+		}
+		m := RecoveredModule{Specifier: specifier, Bytes: int64(data.Source.Length())}
+		if data.SourceMap.State() == SourceSlotNotLoaded {
+			m.SourceMapLost = true
+		} else {
+			m.Bytes += int64(data.SourceMap.Length())
+		}
+		report.Salvaged = append(report.Salvaged, m)
+	}
+}
+
+// Salvage returns a copy of e without the modules whose source was not
+// loaded, for writing out what WithRecovery recovered as a valid archive.
+// Source maps that were not loaded are dropped from the modules kept, and
+// redirects that no longer lead to a module are dropped too. The import
+// map, npm entries and npm snapshot are kept. Sources still streaming in
+// are waited for on ctx.
+func Salvage(ctx context.Context, e *EszipV2) (*EszipV2, error) {
+	e.mu.RLock()
+	out := &EszipV2{
+		modules:      NewModuleMap(),
+		npmSnapshot:  copyNpmSnapshot(e.npmSnapshot),
+		options:      e.options,
+		version:      e.version,
+		importMap:    e.importMap,
+		keys:         e.keys,
+		showReserved: e.showReserved,
+	}
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	kept := make([]EszipV2Module, len(entries))
+	for i, entry := range entries {
+		data, ok := entry.(*ModuleData)
+		if !ok {
+			kept[i] = entry
+			continue
+		}
+		source, err := loadedContent(ctx, data.Source)
+		if err != nil {
+			return nil, err
+		}
+		if source == nil {
+			continue
+		}
+		sourceMap, err := loadedContent(ctx, data.SourceMap)
+		if err != nil {
+			return nil, err
+		}
+		if sourceMap == nil {
+			sourceMap = NewEmptySourceSlot()
+		}
+		kept[i] = &ModuleData{Kind: data.Kind, Source: source, SourceMap: sourceMap, Headers: data.Headers, Aux: data.Aux}
+	}
+
+	index := make(map[string]int, len(keys))
+	for i, specifier := range keys {
+		if kept[i] != nil {
+			index[specifier] = i
+		}
+	}
+	for i, specifier := range keys {
+		switch entry := kept[i].(type) {
+		case nil:
+			continue
+		case *ModuleRedirect:
+			if _, ok := redirectTarget(entry.Target, index, keys, kept); !ok {
+				continue
+			}
+		}
+		out.modules.Insert(specifier, kept[i])
+	}
+	return out, nil
+}
+
+// loadedContent returns a ready slot holding the content of slot, or nil if
+// it was not loaded.
+func loadedContent(ctx context.Context, slot *SourceSlot) (*SourceSlot, error) {
+	data, err := slot.Get(ctx)
+	var pe *ParseError
+	if errors.As(err, &pe) && pe.Type == ErrSourceNotLoaded {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewReadySourceSlot(data), nil
+}
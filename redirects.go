@@ -0,0 +1,176 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrRedirectCycle is returned by ResolveSpecifier when redirects lead back
+// to a specifier already passed through.
+var ErrRedirectCycle = errors.New("eszip: redirect cycle")
+
+// ResolveSpecifier follows the redirects from specifier to the entry they
+// end at, a module or an npm specifier, and returns its specifier with the
+// chain of specifiers passed through: specifier first, then each redirect
+// target, ending with finalSpecifier. A specifier that is not redirected
+// is its own chain.
+//
+// An npm specifier is a root package requirement of the npm snapshot,
+// such as "chalk@5", or an NpmSpecifierEntry; IsNpmSpecifier tells one
+// from a module. GetModule returns nil for it.
+//
+// Where GetModule returns nil, ResolveSpecifier says why: it fails with
+// ErrSpecifierNotFound if specifier or a redirect target is missing, and
+// with ErrRedirectCycle if the chain comes back on itself, in which case
+// chain ends with the repeated specifier. chain is returned with the error
+// too, as far as it got.
+func (e *EszipV2) ResolveSpecifier(specifier string) (finalSpecifier string, chain []string, err error) {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	finalSpecifier, _, chain, err = e.resolveLocked(specifier)
+	return finalSpecifier, chain, err
+}
+
+// resolveLocked is ResolveSpecifier returning the final entry too. e.mu
+// must be held.
+func (e *EszipV2) resolveLocked(specifier string) (string, EszipV2Module, []string, error) {
+	chain := []string{specifier}
+	visited := map[string]bool{specifier: true}
+	current := specifier
+	for {
+		entry, ok := e.modules.Get(current)
+		if !ok {
+			if npm, ok := e.npmSpecifierLocked(current); ok {
+				return current, npm, chain, nil
+			}
+			if len(chain) == 1 {
+				return "", nil, chain, fmt.Errorf("%w: %s", ErrSpecifierNotFound, current)
+			}
+			return "", nil, chain, fmt.Errorf("%w: %s, redirected to from %s", ErrSpecifierNotFound, current, chain[len(chain)-2])
+		}
+		redirect, ok := entry.(*ModuleRedirect)
+		if !ok {
+			return current, entry, chain, nil
+		}
+		current = redirect.Target
+		chain = append(chain, current)
+		if visited[current] {
+			return "", nil, chain, fmt.Errorf("%w: %s", ErrRedirectCycle, strings.Join(chain, " -> "))
+		}
+		visited[current] = true
+	}
+}
+
+// IsNpmSpecifier reports whether specifier is one of the archive's npm
+// specifiers, as ResolveSpecifier describes, rather than a module or
+// redirect.
+func (e *EszipV2) IsNpmSpecifier(specifier string) bool {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	if entry, ok := e.modules.Get(specifier); ok {
+		_, ok = entry.(*NpmSpecifierEntry)
+		return ok
+	}
+	_, ok := e.npmSpecifierLocked(specifier)
+	return ok
+}
+
+// npmSpecifierLocked returns the entry for specifier if it is a root
+// package requirement of the npm snapshot. PackageID is the package's
+// index as written, in order of package id. e.mu must be held.
+func (e *EszipV2) npmSpecifierLocked(specifier string) (*NpmSpecifierEntry, bool) {
+	id, ok := e.npmSnapshot.roots()[specifier]
+	if !ok {
+		return nil, false
+	}
+	var index uint32
+	for _, pkg := range e.npmSnapshot.Packages {
+		if pkg.ID.String() < id.String() {
+			index++
+		}
+	}
+	return &NpmSpecifierEntry{PackageID: index}, true
+}
+
+// Redirects returns the archive's redirects, mapping each redirected
+// specifier to the specifier it redirects to. Targets may themselves be
+// redirects; see ResolveSpecifier.
+func (e *EszipV2) Redirects() map[string]string {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+	redirects := make(map[string]string)
+	for i, specifier := range keys {
+		if redirect, ok := entries[i].(*ModuleRedirect); ok {
+			redirects[specifier] = redirect.Target
+		}
+	}
+	return redirects
+}
+
+// RemoveRedirect removes the redirect stored under from and reports
+// whether there was one. Modules and npm specifiers are left alone; use
+// RemoveModule for those.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) RemoveRedirect(from string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if entry, ok := e.modules.Get(from); !ok {
+		return false
+	} else if _, ok := entry.(*ModuleRedirect); !ok {
+		return false
+	}
+	e.modules.Remove(from)
+	return true
+}
+
+// WithRedirectValidation makes IntoBytes fail, writing nothing, if a
+// redirect does not lead to a module or npm specifier in the archive: with
+// ErrSpecifierNotFound if a target is missing and ErrRedirectCycle if the
+// redirects loop. Without it such redirects are written as they are, and
+// GetModule returns nil for them once the archive is parsed.
+func WithRedirectValidation() WriteOption {
+	return func(c *writeConfig) {
+		c.checkRedirects = true
+	}
+}
+
+// checkRedirects reports the first redirect in entries that does not
+// resolve, as WithRedirectValidation describes. npmRoots are the root
+// packages of the npm snapshot; see NpmResolutionSnapshot.roots.
+func checkRedirects(keys []string, entries []EszipV2Module, npmRoots map[string]*NpmPackageID) error {
+	index := make(map[string]EszipV2Module, len(keys))
+	for i, specifier := range keys {
+		index[specifier] = entries[i]
+	}
+	for i, specifier := range keys {
+		redirect, ok := entries[i].(*ModuleRedirect)
+		if !ok {
+			continue
+		}
+		chain := []string{specifier}
+		visited := map[string]bool{specifier: true}
+		for {
+			target := redirect.Target
+			chain = append(chain, target)
+			if visited[target] {
+				return fmt.Errorf("%w: %s", ErrRedirectCycle, strings.Join(chain, " -> "))
+			}
+			visited[target] = true
+			entry, ok := index[target]
+			if !ok {
+				if _, ok := npmRoots[target]; ok {
+					break
+				}
+				return fmt.Errorf("%w: %s, redirected to from %s", ErrSpecifierNotFound, target, chain[len(chain)-2])
+			}
+			if redirect, ok = entry.(*ModuleRedirect); !ok {
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// ParseURL downloads the archive at url with client, or
+// http.DefaultClient if nil, and returns it as soon as its headers have
+// arrived. Sources keep streaming in the background, and reading one
+// waits only until its own bytes are in, so a runtime can start running the
+// entry module before the rest of the archive has downloaded. A
+// Content-Length bounds section lengths as WithInputSize does.
+//
+// The returned function waits for the download to finish and returns its
+// error, if any. If the download fails or ctx is cancelled, sources not
+// yet loaded fail with ErrSourceNotLoaded, as after Completion.Abort.
+func ParseURL(ctx context.Context, url string, client *http.Client, opts ...ParseOption) (*EszipUnion, func(context.Context) error, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("eszip: fetching %s: %s", url, resp.Status)
+	}
+	if resp.ContentLength >= 0 {
+		opts = append(slices.Clip(opts), WithInputSize(resp.ContentLength))
+	}
+
+	archive, completion, err := parse(ctx, resp.Body, opts)
+	if err != nil {
+		resp.Body.Close()
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	var loadErr error
+	go func() {
+		defer close(done)
+		defer resp.Body.Close()
+		if loadErr = completion.Complete(ctx); loadErr != nil {
+			completion.Abort()
+		}
+	}()
+	wait := func(waitCtx context.Context) error {
+		select {
+		case <-done:
+			return loadErr
+		case <-waitCtx.Done():
+			return waitCtx.Err()
+		}
+	}
+	return archive, wait, nil
+}
+
+// rangeBlockSize is how much RangeReader fetches at least per request, so
+// parsing headers a few bytes at a time does not cost a request each.
+const rangeBlockSize = 64 << 10
+
+// RangeReader reads a remote file with HTTP Range requests, as an
+// io.ReaderAt for ParseV2Lazy, VerifyArchive and the like. Reads smaller
+// than 64 KiB are served from a block of that size fetched from where they
+// start; larger ones fetch exactly the
+// bytes asked for. If the server reported an ETag, every request requires
+// it, so a file replaced while being read fails instead of mixing versions.
+//
+// A RangeReader is safe for concurrent use. Its requests are made with the
+// context it was created with.
+type RangeReader struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+	etag   string
+
+	mu         sync.Mutex
+	block      []byte
+	blockStart int64
+}
+
+// NewRangeReader fetches the first block of the file at url with client,
+// or http.DefaultClient if nil, to learn its size. It fails if the server
+// does not answer Range requests with partial content.
+func NewRangeReader(ctx context.Context, url string, client *http.Client) (*RangeReader, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	r := &RangeReader{ctx: ctx, client: client, url: url}
+	block, size, etag, err := r.get(0, rangeBlockSize)
+	if err != nil {
+		return nil, err
+	}
+	r.block, r.size = block, size
+	if !strings.HasPrefix(etag, "W/") {
+		r.etag = etag
+	}
+	return r, nil
+}
+
+// Size returns the size of the remote file.
+func (r *RangeReader) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes from off, returning io.EOF if the file ends
+// first.
+func (r *RangeReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("eszip: negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	want := min(int64(len(p)), r.size-off)
+
+	r.mu.Lock()
+	if off >= r.blockStart && off+want <= r.blockStart+int64(len(r.block)) {
+		n := copy(p[:want], r.block[off-r.blockStart:])
+		r.mu.Unlock()
+		return r.eof(n, len(p))
+	}
+	r.mu.Unlock()
+
+	fetch := max(want, rangeBlockSize)
+	data, _, _, err := r.get(off, min(fetch, r.size-off))
+	if err != nil {
+		return 0, err
+	}
+	n := copy(p[:want], data)
+	if int64(n) < want {
+		return n, io.ErrUnexpectedEOF
+	}
+	if int64(len(data)) <= rangeBlockSize {
+		r.mu.Lock()
+		r.block, r.blockStart = data, off
+		r.mu.Unlock()
+	}
+	return r.eof(n, len(p))
+}
+
+func (r *RangeReader) eof(n, want int) (int, error) {
+	if n < want {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// get fetches length bytes from off and returns them with the total size
+// and ETag the server reported.
+func (r *RangeReader) get(off, length int64) ([]byte, int64, string, error) {
+	req, err := http.NewRequestWithContext(r.ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	if r.etag != "" {
+		req.Header.Set("If-Match", r.etag)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return nil, 0, "", fmt.Errorf("eszip: %s does not support range requests", r.url)
+	case http.StatusPreconditionFailed:
+		return nil, 0, "", fmt.Errorf("eszip: %s changed while being read", r.url)
+	default:
+		return nil, 0, "", fmt.Errorf("eszip: fetching %s: %s", r.url, resp.Status)
+	}
+
+	var start, end, size int64
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err != nil || start != off || end < start {
+		return nil, 0, "", fmt.Errorf("eszip: fetching %s: unexpected Content-Range %q", r.url, resp.Header.Get("Content-Range"))
+	}
+	data := make([]byte, end-start+1)
+	if _, err := io.ReadFull(resp.Body, data); err != nil {
+		return nil, 0, "", fmt.Errorf("eszip: fetching %s: %w", r.url, err)
+	}
+	return data, size, resp.Header.Get("ETag"), nil
+}
+
+// ParseURLLazy parses the headers of the V2 archive at url with
+// ParseV2Lazy over a RangeReader, so only the headers are downloaded up
+// front and each Source or SourceMap call fetches just that module's
+// bytes. This suits archives used as remote module stores, of which a
+// caller needs a few modules. client may be nil, as for NewRangeReader.
+func ParseURLLazy(ctx context.Context, url string, client *http.Client, opts ...ParseOption) (*EszipV2, error) {
+	r, err := NewRangeReader(ctx, url, client)
+	if err != nil {
+		return nil, err
+	}
+	return ParseV2Lazy(ctx, r, append(slices.Clip(opts), WithInputSize(r.Size()))...)
+}
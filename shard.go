@@ -0,0 +1,255 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+)
+
+// ShardManifest indexes the shards of an archive split by Split. Its JSON
+// encoding is stable: shards and specifiers are listed in archive order.
+type ShardManifest struct {
+	// ImportMap is the specifier of the import map, which is in the first
+	// shard, or empty.
+	ImportMap string      `json:"import_map,omitempty"`
+	Shards    []ShardInfo `json:"shards"`
+}
+
+// ShardInfo describes one shard.
+type ShardInfo struct {
+	Name string `json:"name"`
+	// Size is the length of the shard as written by IntoBytes.
+	Size int64 `json:"size"`
+	// Specifiers lists every entry of the shard, in order.
+	Specifiers []string `json:"specifiers"`
+}
+
+// SplitOptions configures Split.
+type SplitOptions struct {
+	// Name is the prefix of the shard names, which are Name-0.eszip2,
+	// Name-1.eszip2 and so on. It defaults to "shard".
+	Name string
+}
+
+// Split partitions e into shards that each serialize to at most
+// maxShardBytes, for stores that limit object sizes, and returns them with
+// a manifest for OpenSharded. Modules keep their source maps. Redirects go
+// in the shard of the module they lead to unless that would overflow it.
+// The first shard holds the import map, the archive metadata and the npm
+// snapshot. Modules are placed in archive order, filling each shard before
+// starting the next. Sources still streaming in are waited for on ctx.
+//
+// Shards keep e's checksum algorithm. A module that does not fit in a shard
+// on its own is an error.
+func Split(ctx context.Context, e *EszipV2, maxShardBytes int64, opts SplitOptions) ([]*EszipV2, *ShardManifest, error) {
+	if opts.Name == "" {
+		opts.Name = "shard"
+	}
+
+	e.mu.RLock()
+	options := e.options
+	version := max(e.version, DefaultVersion)
+	importMap := e.importMap
+	npmSnapshot := copyNpmSnapshot(e.npmSnapshot)
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+	importMap = leadingImportMap(importMap, keys, entries)
+
+	// Copy every entry with its content loaded, so sizes are exact and
+	// the shards do not share slots with e.
+	index := make(map[string]int, len(keys))
+	for i, specifier := range keys {
+		index[specifier] = i
+		data, ok := entries[i].(*ModuleData)
+		if !ok {
+			continue
+		}
+		source, err := data.Source.Get(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		sourceMap, err := data.SourceMap.Get(ctx)
+		if err != nil {
+			return nil, nil, err
+		}
+		entries[i] = &ModuleData{Kind: data.Kind, Source: NewReadySourceSlot(source), SourceMap: NewReadySourceSlot(sourceMap), Headers: data.Headers, Aux: data.Aux}
+	}
+
+	checksumSize := int64(options.GetChecksumSize())
+	cost := func(i int) int64 {
+		header, source, sourceMap := entrySize(keys[i], entries[i], checksumSize)
+		return header + source + sourceMap
+	}
+	// An empty shard is the magic and five empty sections, three of them
+	// hashed.
+	emptySize := 8 + 3*(4+checksumSize) + int64(len(optionsHeaderContent(Options{}))) + 4 + 4
+	if version.SupportsHeaders() {
+		emptySize += 4 + checksumSize
+	}
+	if version.SupportsAux() {
+		emptySize += 4 + checksumSize
+	}
+	if version.SupportsNpmIntegrity() {
+		emptySize += 4 + checksumSize
+	}
+	npmHeader, npmBytes := appendNpmSnapshot(nil, npmSnapshot)
+	if version.SupportsNpmIntegrity() {
+		npmBytes = appendNpmIntegrity(npmBytes, npmSnapshot)
+	}
+
+	type plan struct {
+		items []int
+		size  int64
+	}
+	shards := []*plan{{size: emptySize + int64(len(npmHeader)+len(npmBytes))}}
+	current := shards[0]
+	place := func(i int) error {
+		if current.size+cost(i) > maxShardBytes {
+			if emptySize+cost(i) > maxShardBytes {
+				return fmt.Errorf("split: %s needs %d bytes, more than the shard limit of %d", keys[i], emptySize+cost(i), maxShardBytes)
+			}
+			current = &plan{size: emptySize}
+			shards = append(shards, current)
+		}
+		current.items = append(current.items, i)
+		current.size += cost(i)
+		return nil
+	}
+
+	// The first shard's fixed content, then groups of a module and the
+	// redirects leading to it.
+	groups := make(map[int][]int)
+	var heads []int
+	for i, specifier := range keys {
+		switch entry := entries[i].(type) {
+		case *NpmSpecifierEntry:
+			current.items = append(current.items, i)
+			current.size += cost(i)
+			continue
+		case *ModuleData:
+			if specifier == importMap || isReservedSpecifier(specifier) {
+				current.items = append(current.items, i)
+				current.size += cost(i)
+				continue
+			}
+		case *ModuleRedirect:
+			if target, ok := redirectTarget(entry.Target, index, keys, entries); ok {
+				groups[target] = append(groups[target], i)
+				continue
+			}
+		}
+		heads = append(heads, i)
+	}
+	if shards[0].size > maxShardBytes {
+		return nil, nil, fmt.Errorf("split: the import map, metadata and npm snapshot need %d bytes, more than the shard limit of %d", shards[0].size, maxShardBytes)
+	}
+
+	for _, head := range heads {
+		group := append([]int{head}, groups[head]...)
+		var total int64
+		for _, i := range group {
+			total += cost(i)
+		}
+		if current.size+total > maxShardBytes && emptySize+total <= maxShardBytes {
+			current = &plan{size: emptySize}
+			shards = append(shards, current)
+		}
+		for _, i := range group {
+			if err := place(i); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	out := make([]*EszipV2, len(shards))
+	manifest := &ShardManifest{ImportMap: importMap, Shards: make([]ShardInfo, len(shards))}
+	for n, p := range shards {
+		slices.Sort(p.items)
+		shard := NewV2()
+		shard.options = options
+		shard.version = version
+		if n == 0 {
+			shard.npmSnapshot = npmSnapshot
+			if _, ok := index[importMap]; ok {
+				shard.importMap = importMap
+			}
+		}
+		specifiers := make([]string, len(p.items))
+		for j, i := range p.items {
+			shard.modules.Insert(keys[i], entries[i])
+			specifiers[j] = keys[i]
+		}
+		out[n] = shard
+		manifest.Shards[n] = ShardInfo{
+			Name:       fmt.Sprintf("%s-%d.eszip2", opts.Name, n),
+			Size:       shard.EstimatedSize(),
+			Specifiers: specifiers,
+		}
+	}
+	return out, manifest, nil
+}
+
+// redirectTarget follows a chain of redirects from target and returns the
+// index of the module it ends at, if that module is in the archive.
+func redirectTarget(target string, index map[string]int, keys []string, entries []EszipV2Module) (int, bool) {
+	for range len(keys) {
+		i, ok := index[target]
+		if !ok {
+			return 0, false
+		}
+		switch entry := entries[i].(type) {
+		case *ModuleData:
+			return i, true
+		case *ModuleRedirect:
+			target = entry.Target
+		default:
+			return 0, false
+		}
+	}
+	return 0, false // a cycle
+}
+
+// OpenSharded parses the shards listed in manifest, obtained from open by
+// name, and presents them as one archive. Every shard is loaded in full
+// before OpenSharded returns, so the readers may be closed afterwards. A
+// shard whose entries differ from the manifest's list is an error, as is
+// a specifier found in more than one shard.
+func OpenSharded(ctx context.Context, manifest *ShardManifest, open func(name string) (io.ReaderAt, int64, error), opts ...ParseOption) (*EszipUnion, error) {
+	merged := NewV2()
+	merged.importMap = manifest.ImportMap
+	for n, info := range manifest.Shards {
+		r, size, err := open(info.Name)
+		if err != nil {
+			return nil, fmt.Errorf("opening shard %s: %w", info.Name, err)
+		}
+		shardOpts := append(opts[:len(opts):len(opts)], WithInputSize(size))
+		parsed, err := ParseSync(ctx, io.NewSectionReader(r, 0, size), shardOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("parsing shard %s: %w", info.Name, err)
+		}
+		shard, ok := parsed.V2()
+		if !ok {
+			return nil, fmt.Errorf("shard %s is not a V2 archive", info.Name)
+		}
+
+		keys, entries := shard.modules.snapshot()
+		if !slices.Equal(keys, info.Specifiers) {
+			return nil, fmt.Errorf("shard %s does not match the manifest", info.Name)
+		}
+		if n == 0 {
+			merged.options = shard.options
+			merged.npmSnapshot = shard.npmSnapshot
+			merged.showReserved = shard.showReserved
+		}
+		for i, specifier := range keys {
+			if _, exists := merged.modules.Get(specifier); exists {
+				return nil, fmt.Errorf("shard %s: %s is also in an earlier shard", info.Name, specifier)
+			}
+			merged.modules.Insert(specifier, entries[i])
+		}
+	}
+	return &EszipUnion{v2: merged}, nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/url"
+)
+
+// sourceMappingURLPrefixes start the comments that link JavaScript to its
+// source map; "//@" is the deprecated form.
+var sourceMappingURLPrefixes = [][]byte{
+	[]byte("//# sourceMappingURL="),
+	[]byte("//@ sourceMappingURL="),
+}
+
+// LinkSourceMap returns a copy of the JavaScript source with a
+// //# sourceMappingURL comment naming mapName, the path of its source map
+// relative to the source, such as "main.js.map", so that debuggers load the
+// map from beside the file. A sourceMappingURL comment already on the last
+// line is replaced rather than followed by a second one.
+func LinkSourceMap(source []byte, mapName string) []byte {
+	body, _, _ := cutSourceMappingURL(source)
+
+	out := make([]byte, 0, len(body)+len(mapName)+32)
+	out = append(out, body...)
+	if len(out) > 0 {
+		out = append(out, '\n')
+	}
+	out = append(out, sourceMappingURLPrefixes[0]...)
+	out = append(out, url.PathEscape(mapName)...)
+	return append(out, '\n')
+}
+
+// SplitInlineSourceMap separates a source map that a transpiler inlined
+// into JavaScript as a base64 data: URL in a sourceMappingURL comment on
+// the last line. It returns the source without the comment and the decoded
+// map, or source unchanged and a nil map if there is no inline map.
+func SplitInlineSourceMap(source []byte) (code, sourceMap []byte) {
+	body, mapURL, ok := cutSourceMappingURL(source)
+	if !ok || !bytes.HasPrefix(mapURL, []byte("data:")) {
+		return source, nil
+	}
+	mediaType, data, ok := bytes.Cut(mapURL[len("data:"):], []byte(","))
+	if !ok || !bytes.HasSuffix(mediaType, []byte(";base64")) {
+		return source, nil
+	}
+	sourceMap, err := base64.StdEncoding.DecodeString(string(data))
+	if err != nil {
+		return source, nil
+	}
+	if len(body) > 0 {
+		body = append(body[:len(body):len(body)], '\n')
+	}
+	return body, sourceMap
+}
+
+// cutSourceMappingURL returns source without trailing whitespace and, if
+// its last line is a sourceMappingURL comment, without that line, along
+// with the URL the comment holds.
+func cutSourceMappingURL(source []byte) (body, mapURL []byte, ok bool) {
+	body = bytes.TrimRight(source, " \t\r\n")
+	last := body[bytes.LastIndexByte(body, '\n')+1:]
+	for _, prefix := range sourceMappingURLPrefixes {
+		if comment := bytes.TrimLeft(last, " \t"); bytes.HasPrefix(comment, prefix) {
+			body = bytes.TrimRight(body[:len(body)-len(last)], " \t\r\n")
+			return body, bytes.TrimSpace(comment[len(prefix):]), true
+		}
+	}
+	return body, nil, false
+}
@@ -0,0 +1,265 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+// Package sourcemap decodes source maps in the version 3 format that
+// transpilers and bundlers emit, as stored in eszip archives beside the
+// modules they describe. Parse checks the JSON fields and decodes every
+// mapping, so a map that Parse accepts can be queried with Lookup to find
+// where a position in generated code came from. Index maps, which hold
+// sections rather than mappings, are not supported.
+package sourcemap
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Version is the source map format version Parse accepts.
+const Version = 3
+
+// Map is a decoded source map. The fields hold the JSON as written;
+// Lookup uses the decoded mappings.
+type Map struct {
+	Version    int      `json:"version"`
+	File       string   `json:"file,omitempty"`
+	SourceRoot string   `json:"sourceRoot,omitempty"`
+	Sources    []string `json:"sources"`
+	// SourcesContent holds the content of each source, if the map embeds
+	// it; entries may be nil.
+	SourcesContent []*string `json:"sourcesContent,omitempty"`
+	Names          []string  `json:"names,omitempty"`
+	Mappings       string    `json:"mappings"`
+
+	// lines holds the segments of each generated line, sorted by column.
+	lines [][]Segment
+}
+
+// Segment maps a column of generated code. Lines and columns are
+// zero-based, as in the mappings encoding. Source and Name are indexes
+// into Map.Sources and Map.Names, or -1 for segments without them.
+type Segment struct {
+	GeneratedColumn int
+	Source          int
+	OriginalLine    int
+	OriginalColumn  int
+	Name            int
+}
+
+// Position is a place in an original source. Line and Column are
+// one-based, as stack traces print them.
+type Position struct {
+	Source string `json:"source"`
+	Line   int    `json:"line"`
+	Column int    `json:"column"`
+	// Name is the original name of the symbol at the position, or "".
+	Name string `json:"name,omitempty"`
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Source, p.Line, p.Column)
+}
+
+// FormatError reports a source map that is not well formed.
+type FormatError struct {
+	// Field is the JSON field at fault.
+	Field string
+	// Offset is the byte offset in the field's value at which the problem
+	// was found, for mappings.
+	Offset int
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	if e.Field == "mappings" {
+		return fmt.Sprintf("sourcemap: mappings at offset %d: %s", e.Offset, e.Reason)
+	}
+	if e.Field != "" {
+		return fmt.Sprintf("sourcemap: %s: %s", e.Field, e.Reason)
+	}
+	return "sourcemap: " + e.Reason
+}
+
+// Parse decodes a version 3 source map. It fails with a *FormatError if
+// data is not a JSON object, the version is not Version, it is an index
+// map, sourcesContent has more entries than sources, or a mapping is
+// malformed or refers to a source or name that is not listed.
+func Parse(data []byte) (*Map, error) {
+	var raw struct {
+		Map
+		Sections json.RawMessage `json:"sections"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, &FormatError{Reason: err.Error()}
+	}
+	m := raw.Map
+	if m.Version != Version {
+		return nil, &FormatError{Field: "version", Reason: fmt.Sprintf("unsupported version %d", m.Version)}
+	}
+	if raw.Sections != nil {
+		return nil, &FormatError{Field: "sections", Reason: "index maps are not supported"}
+	}
+	if len(m.SourcesContent) > len(m.Sources) {
+		return nil, &FormatError{Field: "sourcesContent", Reason: fmt.Sprintf("%d entries for %d sources", len(m.SourcesContent), len(m.Sources))}
+	}
+	lines, err := decodeMappings(m.Mappings, len(m.Sources), len(m.Names))
+	if err != nil {
+		return nil, err
+	}
+	m.lines = lines
+	return &m, nil
+}
+
+// Lines returns the decoded segments of each generated line, sorted by
+// column. The slices must not be modified.
+func (m *Map) Lines() [][]Segment {
+	return m.lines
+}
+
+// Lookup returns the original position of the generated code at line and
+// column, both one-based as stack traces print them: that of the last
+// segment on the line starting at or before column. It reports false if
+// there is no such segment or it maps to no source.
+func (m *Map) Lookup(line, column int) (Position, bool) {
+	if line < 1 || line > len(m.lines) || column < 1 {
+		return Position{}, false
+	}
+	segments := m.lines[line-1]
+	i := sort.Search(len(segments), func(i int) bool { return segments[i].GeneratedColumn > column-1 })
+	if i == 0 {
+		return Position{}, false
+	}
+	s := segments[i-1]
+	if s.Source < 0 {
+		return Position{}, false
+	}
+	p := Position{Source: m.SourcePath(s.Source), Line: s.OriginalLine + 1, Column: s.OriginalColumn + 1}
+	if s.Name >= 0 {
+		p.Name = m.Names[s.Name]
+	}
+	return p, true
+}
+
+// SourcePath returns source i with the map's sourceRoot prefixed.
+func (m *Map) SourcePath(i int) string {
+	source := m.Sources[i]
+	if m.SourceRoot == "" || strings.Contains(source, "://") {
+		return source
+	}
+	if strings.HasSuffix(m.SourceRoot, "/") {
+		return m.SourceRoot + source
+	}
+	return m.SourceRoot + "/" + source
+}
+
+// SourceContent returns the embedded content of source i, if the map has
+// it.
+func (m *Map) SourceContent(i int) (string, bool) {
+	if i < 0 || i >= len(m.SourcesContent) || m.SourcesContent[i] == nil {
+		return "", false
+	}
+	return *m.SourcesContent[i], true
+}
+
+// decodeMappings decodes the mappings field. Every field but the
+// generated column is relative to the previous segment that has it, across
+// lines; the generated column restarts on each line.
+func decodeMappings(mappings string, sources, names int) ([][]Segment, error) {
+	var lines [][]Segment
+	var line []Segment
+	var source, originalLine, originalColumn, name int
+	fail := func(offset int, reason string) error {
+		return &FormatError{Field: "mappings", Offset: offset, Reason: reason}
+	}
+
+	i, column := 0, 0
+	for i <= len(mappings) {
+		if i == len(mappings) || mappings[i] == ';' {
+			sort.SliceStable(line, func(a, b int) bool { return line[a].GeneratedColumn < line[b].GeneratedColumn })
+			lines = append(lines, line)
+			line, column = nil, 0
+			i++
+			continue
+		}
+		if mappings[i] == ',' {
+			i++
+			continue
+		}
+
+		start := i
+		var fields [5]int
+		n := 0
+		for i < len(mappings) && mappings[i] != ',' && mappings[i] != ';' {
+			if n == len(fields) {
+				return nil, fail(start, "segment has more than 5 fields")
+			}
+			v, next, err := decodeVLQ(mappings, i)
+			if err != nil {
+				return nil, fail(i, err.Error())
+			}
+			fields[n] = v
+			n++
+			i = next
+		}
+		if n != 1 && n != 4 && n != 5 {
+			return nil, fail(start, fmt.Sprintf("segment has %d fields, want 1, 4 or 5", n))
+		}
+
+		column += fields[0]
+		if column < 0 {
+			return nil, fail(start, "negative generated column")
+		}
+		s := Segment{GeneratedColumn: column, Source: -1, Name: -1}
+		if n >= 4 {
+			source += fields[1]
+			originalLine += fields[2]
+			originalColumn += fields[3]
+			if source < 0 || source >= sources {
+				return nil, fail(start, fmt.Sprintf("source index %d out of range [0, %d)", source, sources))
+			}
+			if originalLine < 0 || originalColumn < 0 {
+				return nil, fail(start, "negative original position")
+			}
+			s.Source, s.OriginalLine, s.OriginalColumn = source, originalLine, originalColumn
+		}
+		if n == 5 {
+			name += fields[4]
+			if name < 0 || name >= names {
+				return nil, fail(start, fmt.Sprintf("name index %d out of range [0, %d)", name, names))
+			}
+			s.Name = name
+		}
+		line = append(line, s)
+	}
+	return lines, nil
+}
+
+const base64Digits = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// decodeVLQ decodes the base64 VLQ at s[i:] and returns it with the index
+// after it.
+func decodeVLQ(s string, i int) (int, int, error) {
+	var v, shift int
+	for {
+		if i >= len(s) {
+			return 0, i, fmt.Errorf("truncated value")
+		}
+		digit := strings.IndexByte(base64Digits, s[i])
+		if digit < 0 {
+			return 0, i, fmt.Errorf("invalid character %q", s[i])
+		}
+		i++
+		if shift > 30 {
+			return 0, i, fmt.Errorf("value overflows")
+		}
+		v |= (digit & 31) << shift
+		shift += 5
+		if digit&32 == 0 {
+			break
+		}
+	}
+	if v&1 != 0 {
+		return -(v >> 1), i, nil
+	}
+	return v >> 1, i, nil
+}
@@ -0,0 +1,82 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package sourcemap
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	// Line 1: column 0 maps to a.ts 1:1, column 6 to a.ts 1:7 named "x".
+	// Line 2 is empty. Line 3: column 2 maps to b.ts 5:3, column 9 has no
+	// source.
+	data := []byte(`{"version":3,"file":"out.js","sourceRoot":"src","sources":["a.ts","b.ts"],` +
+		`"sourcesContent":["let x = 1;\n"],"names":["x"],"mappings":"AAAA,MAAMA;;ECIJ,O"}`)
+	m, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if len(m.Lines()) != 3 || len(m.Lines()[1]) != 0 {
+		t.Fatalf("Lines = %+v", m.Lines())
+	}
+	if s := m.Lines()[2][0]; s != (Segment{GeneratedColumn: 2, Source: 1, OriginalLine: 4, OriginalColumn: 2, Name: -1}) {
+		t.Errorf("line 3 segment = %+v", s)
+	}
+	if content, ok := m.SourceContent(0); !ok || content != "let x = 1;\n" {
+		t.Errorf("SourceContent(0) = %q, %v", content, ok)
+	}
+	if _, ok := m.SourceContent(1); ok {
+		t.Error("SourceContent(1) reported content")
+	}
+
+	for _, tc := range []struct {
+		line, column int
+		want         Position
+		ok           bool
+	}{
+		{1, 1, Position{Source: "src/a.ts", Line: 1, Column: 1}, true},
+		{1, 6, Position{Source: "src/a.ts", Line: 1, Column: 1}, true},
+		{1, 7, Position{Source: "src/a.ts", Line: 1, Column: 7, Name: "x"}, true},
+		{1, 100, Position{Source: "src/a.ts", Line: 1, Column: 7, Name: "x"}, true},
+		{2, 1, Position{}, false},
+		{3, 1, Position{}, false},
+		{3, 5, Position{Source: "src/b.ts", Line: 5, Column: 3}, true},
+		{3, 10, Position{}, false},
+		{4, 1, Position{}, false},
+		{0, 1, Position{}, false},
+	} {
+		got, ok := m.Lookup(tc.line, tc.column)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("Lookup(%d, %d) = %+v, %v, want %+v, %v", tc.line, tc.column, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name, data, field string
+	}{
+		{"not json", `{`, ""},
+		{"version", `{"version":2,"sources":[],"mappings":""}`, "version"},
+		{"index map", `{"version":3,"sections":[]}`, "sections"},
+		{"sourcesContent", `{"version":3,"sources":[],"sourcesContent":["x"],"mappings":""}`, "sourcesContent"},
+		{"bad character", `{"version":3,"sources":["a"],"mappings":"AA!A"}`, "mappings"},
+		{"truncated value", `{"version":3,"sources":["a"],"mappings":"AAAg"}`, "mappings"},
+		{"field count", `{"version":3,"sources":["a"],"mappings":"AA"}`, "mappings"},
+		{"source index", `{"version":3,"sources":["a"],"mappings":"ACAA"}`, "mappings"},
+		{"name index", `{"version":3,"sources":["a"],"names":[],"mappings":"AAAAA"}`, "mappings"},
+		{"negative column", `{"version":3,"sources":["a"],"mappings":"D"}`, "mappings"},
+		{"negative line", `{"version":3,"sources":["a"],"mappings":"AADA"}`, "mappings"},
+	} {
+		_, err := Parse([]byte(tc.data))
+		var ferr *FormatError
+		if !errors.As(err, &ferr) {
+			t.Errorf("%s: error = %v, want *FormatError", tc.name, err)
+			continue
+		}
+		if ferr.Field != tc.field {
+			t.Errorf("%s: error field = %q, want %q (%v)", tc.name, ferr.Field, tc.field, err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// Summary describes an archive using only header information; building one
+// never waits for or loads module sources.
+//
+// The JSON field names are stable and may be relied on by log pipelines and
+// scripts consuming `eszip info --json`.
+type Summary struct {
+	// Format is "v1" or the V2 revision, e.g. "v2.3".
+	Format string `json:"format"`
+	// Checksum is the checksum algorithm ("none", "sha256", "xxhash3", "blake3").
+	Checksum string `json:"checksum"`
+	// ChecksumSize is the length of each checksum when they are truncated
+	// to fewer bytes than the digest, or 0 for full digests.
+	ChecksumSize int `json:"checksum_size,omitempty"`
+	// Compression is the content compression ("gzip" or "zstd"), or "" if
+	// content is stored uncompressed.
+	Compression string `json:"compression,omitempty"`
+	// Encryption is the content cipher ("aes-gcm"), or "" if content is
+	// stored in the clear.
+	Encryption string `json:"encryption,omitempty"`
+	// Modules counts entries with content, including the import map.
+	Modules int `json:"modules"`
+	// Redirects counts redirect entries.
+	Redirects int `json:"redirects"`
+	// NpmSpecifiers counts npm root requirements (bare npm: specifiers).
+	NpmSpecifiers int `json:"npm_specifiers"`
+	// SourceBytes totals the declared length of every module source.
+	SourceBytes int64 `json:"source_bytes"`
+	// SourceMapBytes totals the declared length of every source map.
+	SourceMapBytes int64 `json:"source_map_bytes"`
+	// ImportMap is the import map specifier, or "" if there is none.
+	ImportMap string `json:"import_map,omitempty"`
+	// HasImportMap reports whether ImportMap is set.
+	HasImportMap bool `json:"has_import_map"`
+	// NpmPackages counts packages in the npm resolution snapshot.
+	NpmPackages int `json:"npm_packages"`
+}
+
+// Summary returns a description of the archive.
+func (e *EszipUnion) Summary() Summary {
+	if e.v1 != nil {
+		return e.v1.Summary()
+	}
+	return e.v2.Summary()
+}
+
+// MarshalJSON encodes the archive's Summary.
+func (e *EszipUnion) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.Summary())
+}
+
+// Summary returns a description of the archive.
+func (e *EszipV1) Summary() Summary {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	s := Summary{
+		Format:   "v1",
+		Checksum: ChecksumNone.String(),
+	}
+	for _, info := range e.parsedModules {
+		switch {
+		case info.isRedirect:
+			s.Redirects++
+		case info.source != nil:
+			s.Modules++
+			if info.source.Transpiled != nil {
+				s.SourceBytes += int64(len(*info.source.Transpiled))
+			} else {
+				s.SourceBytes += int64(len(info.source.Source))
+			}
+		}
+	}
+	return s
+}
+
+// leadingImportMap returns the import map specifier: importMap if it was
+// set by AddImportMap, or, for parsed archives, the first entry if it is a
+// JSONC module, which is where AddImportMap places it.
+func leadingImportMap(importMap string, keys []string, entries []EszipV2Module) string {
+	if importMap != "" || len(entries) == 0 {
+		return importMap
+	}
+	if m, ok := entries[0].(*ModuleData); ok && m.Kind == ModuleKindJsonc {
+		return keys[0]
+	}
+	return ""
+}
+
+// Summary returns a description of the archive. The import map is reported
+// if it was added with AddImportMap, or, for parsed archives, if the first
+// entry is a JSONC module, which is where AddImportMap places it. Reserved
+// entries such as the archive metadata are not counted.
+func (e *EszipV2) Summary() Summary {
+	e.mu.RLock()
+	options := e.options
+	version := e.version
+	importMap := e.importMap
+	snapshot := e.npmSnapshot
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	s := Summary{
+		Format:   version.String(),
+		Checksum: options.Checksum.String(),
+	}
+	if size := options.GetChecksumSize(); size < options.Checksum.DigestSize() {
+		s.ChecksumSize = int(size)
+	}
+	if options.Compression != CompressionNone {
+		s.Compression = options.Compression.String()
+	}
+	if options.Encryption != EncryptionNone {
+		s.Encryption = options.Encryption.String()
+	}
+	for i, entry := range entries {
+		if isReservedSpecifier(keys[i]) {
+			continue
+		}
+		switch m := entry.(type) {
+		case *ModuleData:
+			s.Modules++
+			s.SourceBytes += m.Source.declaredLen()
+			s.SourceMapBytes += m.SourceMap.declaredLen()
+		case *ModuleRedirect:
+			s.Redirects++
+		case *NpmSpecifierEntry:
+			s.NpmSpecifiers++
+		}
+	}
+	if snapshot != nil {
+		s.NpmSpecifiers += len(snapshot.RootPackages)
+		s.NpmPackages = len(snapshot.Packages)
+	}
+	s.ImportMap = leadingImportMap(importMap, keys, entries)
+	s.HasImportMap = s.ImportMap != ""
+	return s
+}
+
+// ModuleSize is the content size of one module as recorded in the archive
+// header.
+type ModuleSize struct {
+	Specifier string
+	Kind      ModuleKind
+	Source    int64
+	SourceMap int64
+	// SourceOffset and SourceMapOffset locate the content within the
+	// sources and source maps sections of a parsed V2 archive. They are -1
+	// when the header records no location: for V1 archives, for modules
+	// added since parsing, and for empty content.
+	SourceOffset    int64
+	SourceMapOffset int64
+}
+
+// ModuleSizes returns the size of every module with content. Like Summary,
+// it never waits for or loads module sources.
+func (e *EszipUnion) ModuleSizes() []ModuleSize {
+	if e.v1 != nil {
+		return e.v1.ModuleSizes()
+	}
+	return e.v2.ModuleSizes()
+}
+
+// ModuleSizes returns the size of every module, sorted by specifier. V1
+// archives carry no source maps.
+func (e *EszipV1) ModuleSizes() []ModuleSize {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	var sizes []ModuleSize
+	for specifier, info := range e.parsedModules {
+		if info.isRedirect || info.source == nil {
+			continue
+		}
+		n := len(info.source.Source)
+		if info.source.Transpiled != nil {
+			n = len(*info.source.Transpiled)
+		}
+		sizes = append(sizes, ModuleSize{
+			Specifier:       specifier,
+			Kind:            ModuleKindJavaScript,
+			Source:          int64(n),
+			SourceOffset:    -1,
+			SourceMapOffset: -1,
+		})
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i].Specifier < sizes[j].Specifier })
+	return sizes
+}
+
+// ModuleSizes returns the size of every module, in archive order.
+func (e *EszipV2) ModuleSizes() []ModuleSize {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	var sizes []ModuleSize
+	for i, entry := range entries {
+		if m, ok := entry.(*ModuleData); ok {
+			sizes = append(sizes, ModuleSize{
+				Specifier:       keys[i],
+				Kind:            m.Kind,
+				Source:          m.Source.declaredLen(),
+				SourceMap:       m.SourceMap.declaredLen(),
+				SourceOffset:    m.Source.recordedOffset(),
+				SourceMapOffset: m.SourceMap.recordedOffset(),
+			})
+		}
+	}
+	return sizes
+}
+
+// ContentSectionSizes returns the encoded size of the sources and source
+// maps sections, including their length prefixes and per-entry checksums.
+// Content that several modules of a parsed archive share is counted once.
+func (e *EszipV2) ContentSectionSizes() (sources, sourceMaps int64) {
+	e.mu.RLock()
+	checksumSize := int64(e.options.GetChecksumSize())
+	_, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	sources, sourceMaps = 4, 4
+	seenSources := make(map[uint32]bool)
+	seenSourceMaps := make(map[uint32]bool)
+	add := func(total *int64, seen map[uint32]bool, slot *SourceSlot) {
+		n := slot.declaredLen()
+		if n == 0 {
+			return
+		}
+		// Parsed slots record where their content lives; built ones are
+		// laid out one after another by IntoBytes.
+		if slot.Length() > 0 {
+			if seen[slot.Offset()] {
+				return
+			}
+			seen[slot.Offset()] = true
+		}
+		*total += n + checksumSize
+	}
+	for _, entry := range entries {
+		if m, ok := entry.(*ModuleData); ok {
+			add(&sources, seenSources, m.Source)
+			add(&sourceMaps, seenSourceMaps, m.SourceMap)
+		}
+	}
+	return sources, sourceMaps
+}
@@ -0,0 +1,88 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"fmt"
+)
+
+// TransformFunc rewrites the source of one module. It returns the new
+// source and whether it differs from the old one; when changed is false the
+// returned source is ignored.
+type TransformFunc func(specifier string, kind ModuleKind, source []byte) (newSource []byte, changed bool, err error)
+
+// TransformOption configures TransformSources.
+type TransformOption func(*transformConfig)
+
+type transformConfig struct {
+	keepSourceMaps bool
+}
+
+// WithPreservedSourceMaps keeps the source maps of transformed modules.
+// By default they are cleared, since a transform invalidates their
+// mappings; keep them only for transforms that preserve line and column
+// positions.
+func WithPreservedSourceMaps() TransformOption {
+	return func(c *transformConfig) {
+		c.keepSourceMaps = true
+	}
+}
+
+// TransformSources applies fn to every module in archive order, waiting on
+// ctx for sources still streaming in, and returns how many modules it
+// changed. Redirects and reserved entries such as the archive metadata are
+// skipped; fn sees every kind of module and picks the ones it handles.
+//
+// Each change is applied on its own, so if fn fails the modules before it
+// keep their new sources and the rest are untouched; the error is returned
+// with the count so far. A module replaced concurrently, for example by
+// AddModule, keeps the newer content.
+func (e *EszipV2) TransformSources(ctx context.Context, fn TransformFunc, opts ...TransformOption) (int, error) {
+	var cfg transformConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+
+	changed := 0
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok || isReservedSpecifier(specifier) {
+			continue
+		}
+		source, err := data.Source.Get(ctx)
+		if err != nil {
+			return changed, err
+		}
+		newSource, ok, err := fn(specifier, data.Kind, source)
+		if err != nil {
+			return changed, fmt.Errorf("transforming %s: %w", specifier, err)
+		}
+		if !ok {
+			continue
+		}
+
+		updated := &ModuleData{
+			Kind:      data.Kind,
+			Source:    NewReadySourceSlot(newSource),
+			SourceMap: NewEmptySourceSlot(),
+			Headers:   data.Headers,
+			Aux:       data.Aux,
+		}
+		if cfg.keepSourceMaps {
+			updated.SourceMap = data.SourceMap
+		}
+
+		e.mu.Lock()
+		if current, ok := e.modules.Get(specifier); ok && current == entries[i] {
+			e.modules.Insert(specifier, updated)
+			changed++
+		}
+		e.mu.Unlock()
+	}
+	return changed, nil
+}
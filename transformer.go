@@ -0,0 +1,271 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+)
+
+// Transformer rewrites a module's code and source map as it leaves the
+// archive, such as when it is extracted, for tools that expect code in
+// another shape. It is given every kind of module and returns the ones it
+// does not handle unchanged. A nil source map means the module has none,
+// or that the transform invalidated it.
+type Transformer interface {
+	Transform(specifier string, kind ModuleKind, code, sourceMap []byte) (newCode, newSourceMap []byte, err error)
+}
+
+// TransformerFunc adapts a function to the Transformer interface.
+type TransformerFunc func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error)
+
+// Transform calls f.
+func (f TransformerFunc) Transform(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+	return f(specifier, kind, code, sourceMap)
+}
+
+// ChainTransformers returns a Transformer that applies transformers in
+// order, each to the output of the one before, stopping at the first
+// error.
+func ChainTransformers(transformers ...Transformer) Transformer {
+	return TransformerFunc(func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+		for _, t := range transformers {
+			var err error
+			if code, sourceMap, err = t.Transform(specifier, kind, code, sourceMap); err != nil {
+				return nil, nil, err
+			}
+		}
+		return code, sourceMap, nil
+	})
+}
+
+// StripSourceMaps returns a Transformer that drops the source maps of
+// JavaScript modules, along with any sourceMappingURL comment ending their
+// code.
+func StripSourceMaps() Transformer {
+	return TransformerFunc(func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+		if kind != ModuleKindJavaScript {
+			return code, sourceMap, nil
+		}
+		if body, _, ok := cutSourceMappingURL(code); ok {
+			code = append(body[:len(body):len(body)], '\n')
+		}
+		return code, nil, nil
+	})
+}
+
+// cjsPrelude and cjsEpilogue wrap a CommonJS module as Node.js does, with
+// require from node:module. The prelude is one line, so the module's
+// source map only needs shifting down a line.
+const (
+	cjsPrelude  = `import { createRequire as __eszipCreateRequire } from "node:module"; const __eszipModule = { exports: {} }; (function (exports, require, module, __filename, __dirname) {` + "\n"
+	cjsEpilogue = "\n}).call(__eszipModule.exports, __eszipModule.exports, __eszipCreateRequire(import.meta.url), __eszipModule, import.meta.filename, import.meta.dirname);\nexport default __eszipModule.exports;\n"
+)
+
+// CommonJSToESM returns a Transformer that wraps CommonJS modules as ES
+// modules whose default export is module.exports, so they can be imported
+// by tools that only load ES modules. require is created with
+// createRequire from node:module, which Node.js and Deno provide.
+//
+// A JavaScript module is taken to be CommonJS if its specifier ends in
+// .cjs, or if it uses require, module or exports and has no import or
+// export statements. Named imports of the wrapped module's properties do
+// not work; import its default export instead. The source map is shifted
+// to match.
+func CommonJSToESM() Transformer {
+	return TransformerFunc(func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+		if kind != ModuleKindJavaScript {
+			return code, sourceMap, nil
+		}
+		s := &importScanner{src: code}
+		s.scan()
+		path, _, _ := strings.Cut(specifier, "?")
+		if !strings.HasSuffix(path, ".cjs") && (s.moduleSyntax || !s.commonJS) {
+			return code, sourceMap, nil
+		}
+
+		body, _, _ := cutSourceMappingURL(code)
+		out := make([]byte, 0, len(cjsPrelude)+len(body)+len(cjsEpilogue))
+		out = append(out, cjsPrelude...)
+		out = append(out, body...)
+		out = append(out, cjsEpilogue...)
+		return out, shiftSourceMap(sourceMap, 1), nil
+	})
+}
+
+// shiftSourceMap returns sourceMap with its generated lines moved down by
+// lines, or nil if it is not a source map with mappings.
+func shiftSourceMap(sourceMap []byte, lines int) []byte {
+	if len(sourceMap) == 0 {
+		return nil
+	}
+	var m map[string]json.RawMessage
+	if json.Unmarshal(sourceMap, &m) != nil {
+		return nil
+	}
+	var mappings string
+	if json.Unmarshal(m["mappings"], &mappings) != nil {
+		return nil
+	}
+	m["mappings"], _ = json.Marshal(strings.Repeat(";", lines) + mappings)
+	shifted, err := json.Marshal(m)
+	if err != nil {
+		return nil
+	}
+	return shifted
+}
+
+// PrettyPrint returns a Transformer that makes minified modules readable.
+// JSON modules are indented. JavaScript gets a line break after each
+// opening brace and statement, and before each closing brace, indented by
+// nesting depth; line breaks already there are kept, so formatted code
+// stays much as it was. The source maps of reformatted JavaScript no
+// longer match it, so they are dropped. JSONC modules, whose comments
+// would be lost, are left as they are.
+func PrettyPrint() Transformer {
+	return TransformerFunc(func(specifier string, kind ModuleKind, code, sourceMap []byte) ([]byte, []byte, error) {
+		switch kind {
+		case ModuleKindJson:
+			var out bytes.Buffer
+			if json.Indent(&out, code, "", "  ") != nil {
+				return code, sourceMap, nil
+			}
+			out.WriteByte('\n')
+			return out.Bytes(), sourceMap, nil
+		case ModuleKindJavaScript:
+			body, _, _ := cutSourceMappingURL(code)
+			pretty := prettyPrintJS(body)
+			if bytes.Equal(bytes.TrimSuffix(pretty, []byte("\n")), body) {
+				return code, sourceMap, nil
+			}
+			return pretty, nil, nil
+		}
+		return code, sourceMap, nil
+	})
+}
+
+// prettyPrintJS breaks lines in src as PrettyPrint describes, telling code
+// from strings, templates, regular expressions and comments as ScanImports
+// does.
+func prettyPrintJS(src []byte) []byte {
+	s := &importScanner{src: src}
+	out := make([]byte, 0, len(src)+len(src)/8)
+	depth := 0
+	// parens counts the parentheses and brackets open in the innermost
+	// block, where a semicolon does not end a statement, as in for (;;).
+	parens := 0
+	var outer []int
+	// breakLine is set when a line break is due before the next token, and
+	// afterBrace when the last token closed a block, after which only a
+	// statement starts a new line.
+	breakLine, afterBrace := false, false
+	newline := func(indent int) {
+		out = bytes.TrimRight(out, " \t")
+		out = append(out, '\n')
+		for range indent {
+			out = append(out, "  "...)
+		}
+	}
+
+	for s.pos < len(src) {
+		start := s.pos
+		if s.skipTrivia() {
+			trivia := src[start:min(s.pos, len(src))]
+			switch {
+			case bytes.IndexByte(trivia, '\n') >= 0:
+				out = append(out, trivia...)
+				breakLine, afterBrace = false, false
+			case !breakLine:
+				out = append(out, trivia...)
+			case bytes.ContainsAny(trivia, "/"):
+				// A comment stays on the line it was on.
+				out = append(out, bytes.TrimRight(trivia, " \t")...)
+			}
+			continue
+		}
+
+		c := src[s.pos]
+		if afterBrace && isIdentStart(c) {
+			switch word := s.src[s.pos:]; {
+			case hasWord(word, "else"), hasWord(word, "catch"), hasWord(word, "finally"), hasWord(word, "while"),
+				hasWord(word, "from"), hasWord(word, "as"), hasWord(word, "in"), hasWord(word, "of"), hasWord(word, "instanceof"):
+			default:
+				breakLine = parens == 0
+			}
+		}
+		afterBrace = false
+		if c == '}' {
+			if breakLine || (len(out) > 0 && out[len(out)-1] != '{' && !endsLine(out)) {
+				newline(max(depth-1, 0))
+			} else if endsLine(out) {
+				out = bytes.TrimRight(out, " \t")
+				for range max(depth-1, 0) {
+					out = append(out, "  "...)
+				}
+			}
+			breakLine = false
+		} else if breakLine {
+			newline(depth)
+			breakLine = false
+		}
+
+		switch {
+		case c == '"' || c == '\'':
+			s.skipString()
+			s.setPrev('"', "")
+		case c == '`':
+			s.skipTemplate()
+			s.setPrev('`', "")
+		case c == '/' && s.regexAllowed():
+			s.skipRegex()
+			s.setPrev('/', "")
+		case isIdentStart(c):
+			s.readWord()
+		default:
+			s.pos++
+			s.setPrev(c, "")
+			switch c {
+			case '{':
+				depth++
+				outer = append(outer, parens)
+				parens = 0
+				breakLine = true
+			case '}':
+				depth = max(depth-1, 0)
+				if len(outer) > 0 {
+					parens = outer[len(outer)-1]
+					outer = outer[:len(outer)-1]
+				}
+				afterBrace = true
+			case '(', '[':
+				parens++
+			case ')', ']':
+				parens = max(parens-1, 0)
+			case ';':
+				breakLine = parens == 0
+			}
+		}
+		out = append(out, src[start:min(s.pos, len(src))]...)
+		if c == '{' && s.pos < len(src) && src[s.pos] == '}' {
+			// An empty block or object stays on one line.
+			breakLine = false
+		}
+	}
+	if len(out) > 0 && out[len(out)-1] != '\n' {
+		out = append(out, '\n')
+	}
+	return out
+}
+
+// hasWord reports whether src starts with the identifier word.
+func hasWord(src []byte, word string) bool {
+	return bytes.HasPrefix(src, []byte(word)) && (len(src) == len(word) || !isIdentPart(src[len(word)]))
+}
+
+// endsLine reports whether out ends with a line break followed only by
+// indentation.
+func endsLine(out []byte) bool {
+	trimmed := bytes.TrimRight(out, " \t")
+	return len(trimmed) > 0 && trimmed[len(trimmed)-1] == '\n'
+}
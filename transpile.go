@@ -0,0 +1,51 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Transpiler turns TypeScript, TSX and JSX into JavaScript that runtimes
+// can execute without a compiler of their own, such as through esbuild or
+// swc bindings. Transpile returns the code and its source map, which may
+// be nil.
+type Transpiler interface {
+	Transpile(specifier string, source []byte) (code, sourceMap []byte, err error)
+}
+
+// TranspilerFunc adapts a function to the Transpiler interface.
+type TranspilerFunc func(specifier string, source []byte) (code, sourceMap []byte, err error)
+
+// Transpile calls f.
+func (f TranspilerFunc) Transpile(specifier string, source []byte) ([]byte, []byte, error) {
+	return f(specifier, source)
+}
+
+// NeedsTranspile reports whether the extension of a path or URL path names
+// TypeScript, TSX or JSX, which ExtensionToModuleKind stores as JavaScript
+// although it is not.
+func NeedsTranspile(name string) bool {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".ts", ".mts", ".cts", ".tsx", ".jsx":
+		return true
+	}
+	return false
+}
+
+// Transpile passes source through t if specifier needs transpiling, as
+// NeedsTranspile reports, and returns it unchanged with no source map
+// otherwise or if t is nil. Modules keep their specifier, extension
+// included, so imports of them still resolve.
+func Transpile(t Transpiler, specifier string, source []byte) (code, sourceMap []byte, err error) {
+	if t == nil || !NeedsTranspile(specifier) {
+		return source, nil, nil
+	}
+	code, sourceMap, err = t.Transpile(specifier, source)
+	if err != nil {
+		return nil, nil, fmt.Errorf("transpiling %s: %w", specifier, err)
+	}
+	return code, sourceMap, nil
+}
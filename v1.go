@@ -3,9 +3,14 @@
 package eszip
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"io"
+	"iter"
 	"net/url"
+	"slices"
 	"sync"
 )
 
@@ -38,14 +43,66 @@ type moduleSourceV1 struct {
 
 // v1ModuleInfoJSON is used for JSON unmarshaling
 type v1ModuleInfoJSON struct {
-	Redirect *string         `json:"Redirect"`
-	Source   *moduleSourceV1 `json:"Source"`
+	Redirect *string         `json:"Redirect,omitempty"`
+	Source   *moduleSourceV1 `json:"Source,omitempty"`
+}
+
+// NewV1 creates an empty V1 archive, for consumers that only read the JSON
+// format.
+func NewV1() *EszipV1 {
+	return &EszipV1{
+		Version:       eszipV1GraphVersion,
+		Modules:       make(map[string]json.RawMessage),
+		parsedModules: make(map[string]*moduleInfoV1),
+	}
+}
+
+// AddModule adds a JavaScript module with the specifiers it imports,
+// replacing any module or redirect at specifier. V1 stores sources as JSON
+// strings, so bytes that are not valid UTF-8 are replaced with U+FFFD.
+// It is safe to call concurrently with other methods.
+func (e *EszipV1) AddModule(specifier string, source []byte, deps []string) {
+	if deps == nil {
+		deps = []string{}
+	}
+	info := &moduleSourceV1{Source: string(source), Deps: slices.Clone(deps)}
+	e.set(specifier, v1ModuleInfoJSON{Source: info}, &moduleInfoV1{source: info})
+}
+
+// AddRedirect adds a redirect from specifier to target, replacing any
+// module or redirect at specifier.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV1) AddRedirect(specifier, target string) {
+	e.set(specifier, v1ModuleInfoJSON{Redirect: &target}, &moduleInfoV1{isRedirect: true, redirect: target})
+}
+
+// set stores a module both as the JSON IntoBytes writes and parsed.
+func (e *EszipV1) set(specifier string, info v1ModuleInfoJSON, parsed *moduleInfoV1) {
+	// Strings and string slices always marshal.
+	raw, _ := json.Marshal(info)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.Modules[specifier] = raw
+	e.parsedModules[specifier] = parsed
 }
 
 // ParseV1 parses a V1 eszip from JSON data
 func ParseV1(data []byte) (*EszipV1, error) {
+	return parseV1Reader(bytes.NewReader(data))
+}
+
+// parseV1Reader decodes a V1 eszip directly from a stream, without first
+// buffering the whole document.
+func parseV1Reader(r io.Reader) (*EszipV1, error) {
+	dec := json.NewDecoder(r)
 	var eszip EszipV1
-	if err := json.Unmarshal(data, &eszip); err != nil {
+	if err := dec.Decode(&eszip); err != nil {
+		return nil, errInvalidV1Json(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = errors.New("unexpected data after top-level value")
+		}
 		return nil, errInvalidV1Json(err)
 	}
 
@@ -105,11 +162,15 @@ func (e *EszipV1) GetModule(specifier string) *Module {
 			continue
 		}
 
-		return &Module{
+		module := &Module{
 			Specifier: current,
 			Kind:      ModuleKindJavaScript,
 			inner:     &v1ModuleInner{eszip: e},
 		}
+		if info.source != nil {
+			module.deps = info.source.Deps
+		}
+		return module
 	}
 }
 
@@ -130,9 +191,30 @@ func (e *EszipV1) Specifiers() []string {
 	return specs
 }
 
-// IntoBytes serializes the V1 eszip to JSON
-func (e *EszipV1) IntoBytes() ([]byte, error) {
-	return json.Marshal(e)
+// IntoBytes serializes the V1 eszip to JSON. Of the write options only
+// WithMaxArchiveSize and WithWriteProgress apply; the others concern the V2
+// format.
+func (e *EszipV1) IntoBytes(opts ...WriteOption) ([]byte, error) {
+	var cfg writeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	e.mu.RLock()
+	data, err := json.Marshal(e)
+	e.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.maxSize > 0 && int64(len(data)) > cfg.maxSize {
+		return nil, newSizeLimitError(int64(len(data)), cfg.maxSize, e.ModuleSizes())
+	}
+	// V1 is a single JSON document, so every module is written at once.
+	if report := cfg.progress.OnModuleWritten; report != nil {
+		for _, specifier := range slices.Sorted(slices.Values(e.Specifiers())) {
+			report(specifier, int64(len(data)), int64(len(data)))
+		}
+	}
+	return data, nil
 }
 
 // v1ModuleInner implements moduleInner for V1
@@ -212,3 +294,16 @@ func (e *EszipV1) Iterate() []struct {
 
 	return result
 }
+
+// All returns an iterator over the modules that Iterate returns, in no
+// particular order.
+func (e *EszipV1) All() iter.Seq2[string, *Module] {
+	return func(yield func(string, *Module) bool) {
+		for _, spec := range e.Specifiers() {
+			module := e.GetModule(spec)
+			if module != nil && !yield(spec, module) {
+				return
+			}
+		}
+	}
+}
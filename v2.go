@@ -4,6 +4,12 @@ package eszip
 
 import (
 	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"iter"
+	"maps"
+	"slices"
 	"sync"
 )
 
@@ -13,6 +19,9 @@ var (
 	MagicV2_1 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '1'}
 	MagicV2_2 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '2'}
 	MagicV2_3 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '3'}
+	MagicV2_4 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '4'}
+	MagicV2_5 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '5'}
+	MagicV2_6 = [8]byte{'E', 'S', 'Z', 'I', 'P', '2', '.', '6'}
 )
 
 // EszipVersion represents the V2 version
@@ -23,10 +32,23 @@ const (
 	VersionV2_1 EszipVersion = 1
 	VersionV2_2 EszipVersion = 2
 	VersionV2_3 EszipVersion = 3
+	// VersionV2_4 adds a section of per-module headers after the npm
+	// section. Deno cannot read it; see AddModuleWithHeaders.
+	VersionV2_4 EszipVersion = 4
+	// VersionV2_5 adds a section of per-module auxiliary data after the
+	// module headers section. Deno cannot read it; see Module.SetAux.
+	VersionV2_5 EszipVersion = 5
+	// VersionV2_6 adds a section of npm package integrity data after the
+	// module aux section. Deno cannot read it; see NpmPackage.Integrity.
+	VersionV2_6 EszipVersion = 6
 )
 
 // LatestVersion is the latest supported version
-const LatestVersion = VersionV2_3
+const LatestVersion = VersionV2_6
+
+// DefaultVersion is the version new archives are written in: the latest
+// that Deno reads.
+const DefaultVersion = VersionV2_3
 
 // VersionFromMagic returns the version from magic bytes
 func VersionFromMagic(magic []byte) (EszipVersion, bool) {
@@ -45,11 +67,38 @@ func VersionFromMagic(magic []byte) (EszipVersion, bool) {
 		return VersionV2_2, true
 	case MagicV2_3:
 		return VersionV2_3, true
+	case MagicV2_4:
+		return VersionV2_4, true
+	case MagicV2_5:
+		return VersionV2_5, true
+	case MagicV2_6:
+		return VersionV2_6, true
 	default:
 		return 0, false
 	}
 }
 
+func (v EszipVersion) String() string {
+	switch v {
+	case VersionV2:
+		return "v2"
+	case VersionV2_1:
+		return "v2.1"
+	case VersionV2_2:
+		return "v2.2"
+	case VersionV2_3:
+		return "v2.3"
+	case VersionV2_4:
+		return "v2.4"
+	case VersionV2_5:
+		return "v2.5"
+	case VersionV2_6:
+		return "v2.6"
+	default:
+		return "unknown"
+	}
+}
+
 // ToMagic returns the magic bytes for the version
 func (v EszipVersion) ToMagic() [8]byte {
 	switch v {
@@ -61,6 +110,12 @@ func (v EszipVersion) ToMagic() [8]byte {
 		return MagicV2_2
 	case VersionV2_3:
 		return MagicV2_3
+	case VersionV2_4:
+		return MagicV2_4
+	case VersionV2_5:
+		return MagicV2_5
+	case VersionV2_6:
+		return MagicV2_6
 	default:
 		return MagicV2_3
 	}
@@ -76,6 +131,23 @@ func (v EszipVersion) SupportsOptions() bool {
 	return v >= VersionV2_2
 }
 
+// SupportsHeaders returns true if the version has a module headers section
+func (v EszipVersion) SupportsHeaders() bool {
+	return v >= VersionV2_4
+}
+
+// SupportsAux returns true if the version has a module auxiliary data
+// section
+func (v EszipVersion) SupportsAux() bool {
+	return v >= VersionV2_5
+}
+
+// SupportsNpmIntegrity returns true if the version has an npm package
+// integrity section
+func (v EszipVersion) SupportsNpmIntegrity() bool {
+	return v >= VersionV2_6
+}
+
 // HeaderFrameKind represents the type of entry in the modules header
 type HeaderFrameKind uint8
 
@@ -89,6 +161,18 @@ const (
 type Options struct {
 	Checksum     ChecksumType
 	ChecksumSize uint8
+	// Compression is applied to each source and source map; checksums
+	// cover the compressed bytes.
+	Compression CompressionType
+	// Encryption is applied to each source and source map after
+	// compression; checksums cover the encrypted bytes. See SetEncryption.
+	Encryption EncryptionType
+
+	// aead seals and opens content when Encryption is set.
+	aead cipher.AEAD
+	// unknown holds the option, value pairs of a parsed options header
+	// that this version does not recognize; see Preserved.
+	unknown []byte
 }
 
 // DefaultOptionsForVersion returns the default options for a version
@@ -112,21 +196,39 @@ func (o Options) GetChecksumSize() uint8 {
 	return o.Checksum.DigestSize()
 }
 
-// EszipV2 represents a V2 eszip archive
+// EszipV2 represents a V2 eszip archive.
+//
+// An EszipV2 is safe for concurrent use: one goroutine may serve GetModule
+// and read sources while others add, replace, rename or remove modules and
+// serialize the archive. Each mutation is applied atomically, and each
+// read sees the archive as it was before or after it, never in between:
+// a redirect is never seen pointing at a module that is mid-rename, and
+// IntoBytes writes the entries as they were when it started. A Module
+// obtained earlier keeps reading from the archive by specifier, so after
+// the module is replaced it returns the new content, and after it is
+// removed or renamed its source is nil.
 type EszipV2 struct {
-	mu          sync.Mutex
+	mu          sync.RWMutex
 	modules     *ModuleMap
 	npmSnapshot *NpmResolutionSnapshot
 	options     Options
 	version     EszipVersion
+	importMap   string
+	// keys provides the key content is encrypted with; see SetEncryption.
+	keys KeyProvider
+	// showReserved makes Specifiers include reserved entries.
+	showReserved bool
+	// trailing holds what followed the source maps section of a parsed
+	// archive; see Preserved.
+	trailing []byte
 }
 
 // NewEszipV2 creates a new empty V2 eszip
 func NewEszipV2() *EszipV2 {
 	return &EszipV2{
 		modules: NewModuleMap(),
-		options: DefaultOptionsForVersion(LatestVersion),
-		version: LatestVersion,
+		options: DefaultOptionsForVersion(DefaultVersion),
+		version: DefaultVersion,
 	}
 }
 
@@ -150,44 +252,53 @@ func (e *EszipV2) GetImportMap(specifier string) *Module {
 }
 
 func (e *EszipV2) getModuleInternal(specifier string, allowJsonc bool) *Module {
-	visited := make(map[string]bool)
-	current := specifier
+	// The whole redirect chain is followed under the read lock, so a
+	// concurrent RenameSpecifier is seen entirely or not at all.
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	current, entry, _, err := e.resolveLocked(specifier)
+	if err != nil {
+		return nil
+	}
+	m, ok := entry.(*ModuleData)
+	if !ok || (m.Kind == ModuleKindJsonc && !allowJsonc) {
+		// NPM specifiers are not regular modules
+		return nil
+	}
+	return &Module{
+		Specifier: current,
+		Kind:      m.Kind,
+		headers:   m.Headers,
+		inner:     &v2ModuleInner{eszip: e},
+	}
+}
 
-	for {
-		if visited[current] {
-			return nil // Cycle detected
-		}
-		visited[current] = true
+// Specifiers returns all module specifiers. Reserved entries such as
+// ArchiveMetadataSpecifier are left out unless the archive was parsed with
+// WithReservedSpecifiers.
+func (e *EszipV2) Specifiers() []string {
+	keys := e.modules.Keys()
+	if e.showReserved {
+		return keys
+	}
+	return slices.DeleteFunc(keys, isReservedSpecifier)
+}
 
-		mod, ok := e.modules.Get(current)
-		if !ok {
-			return nil
-		}
+// PendingSources returns, in archive order, the specifiers of modules whose
+// source or source map is still streaming in. IntoBytes would wait for
+// each of them; see WithSlotWaitTimeout.
+func (e *EszipV2) PendingSources() []string {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
 
-		switch m := mod.(type) {
-		case *ModuleData:
-			if m.Kind == ModuleKindJsonc && !allowJsonc {
-				return nil
-			}
-			return &Module{
-				Specifier: current,
-				Kind:      m.Kind,
-				inner:     &v2ModuleInner{eszip: e},
-			}
-		case *ModuleRedirect:
-			current = m.Target
-		case *NpmSpecifierEntry:
-			// NPM specifiers are not regular modules
-			return nil
-		default:
-			return nil
+	var pending []string
+	for i, specifier := range keys {
+		if m, ok := entries[i].(*ModuleData); ok && (m.Source.State() == SourceSlotPending || m.SourceMap.State() == SourceSlotPending) {
+			pending = append(pending, specifier)
 		}
 	}
-}
-
-// Specifiers returns all module specifiers
-func (e *EszipV2) Specifiers() []string {
-	return e.modules.Keys()
+	return pending
 }
 
 // TakeNpmSnapshot removes and returns the NPM snapshot
@@ -199,7 +310,9 @@ func (e *EszipV2) TakeNpmSnapshot() *NpmResolutionSnapshot {
 	return snapshot
 }
 
-// SetChecksum sets the checksum algorithm
+// SetChecksum sets the checksum algorithm.
+// It is safe to call concurrently with IntoBytes; a serialization that has
+// already started keeps the algorithm it began with.
 func (e *EszipV2) SetChecksum(checksum ChecksumType) {
 	e.mu.Lock()
 	defer e.mu.Unlock()
@@ -207,8 +320,147 @@ func (e *EszipV2) SetChecksum(checksum ChecksumType) {
 	e.options.ChecksumSize = checksum.DigestSize()
 }
 
-// AddModule adds a module to the archive
+// SetChecksumSize truncates every checksum to its first size bytes, which
+// for archives of many tiny modules saves most of the bytes spent on
+// checksums at the cost of weaker corruption detection. Size 0 restores the
+// full digest, as does SetChecksum, so call it after SetChecksum. It fails
+// if size exceeds the digest of the checksum algorithm. Versions before
+// v2.2 cannot record the size and always use full sha256 checksums.
+func (e *EszipV2) SetChecksumSize(size uint8) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	digest := e.options.Checksum.DigestSize()
+	if size > digest {
+		return fmt.Errorf("eszip: checksum size %d exceeds the %d-byte %s digest", size, digest, e.options.Checksum)
+	}
+	if size == 0 {
+		size = digest
+	}
+	e.options.ChecksumSize = size
+	return nil
+}
+
+// ErrVersionTooOld is returned by SetVersion, and by IntoBytes and
+// friends, when the archive uses a feature its format version cannot
+// represent.
+var ErrVersionTooOld = errors.New("eszip: format version too old")
+
+// Preserved is what a parse did not recognize, typically because a newer
+// writer produced the archive, and kept so that writing the archive back
+// does not lose it. The library cannot know what it means, so it is
+// written unchanged even if the modules it may describe have changed.
+type Preserved struct {
+	// Options holds the options header entries of unknown options as
+	// option, value byte pairs, in the order read. They are written after
+	// the known options, at versions that have an options header.
+	Options []byte
+	// Trailing holds the bytes that followed the source maps section, such
+	// as sections added by a newer format. It is only read when the input
+	// size is known, as with ParseBytes, ParseFile and WithInputSize, and
+	// only once the sources have been loaded, so an archive written before
+	// a Parse completes lacks it. ParseV2Lazy and OpenFile do not read it.
+	// It is written after the source maps section.
+	Trailing []byte
+}
+
+// Preserved returns copies of the unrecognized parts of a parsed archive.
+func (e *EszipV2) Preserved() Preserved {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return Preserved{Options: slices.Clone(e.options.unknown), Trailing: slices.Clone(e.trailing)}
+}
+
+// DiscardPreserved drops the unrecognized parts of a parsed archive, so
+// that it is written with only what this version understands.
+// It has the same concurrency guarantees as SetChecksum.
+func (e *EszipV2) DiscardPreserved() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.options.unknown = nil
+	e.trailing = nil
+}
+
+// Version returns the format version the archive is written in:
+// DefaultVersion for new archives, and the version read for parsed ones.
+func (e *EszipV2) Version() EszipVersion {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	return e.version
+}
+
+// SetVersion sets the format version the archive is written in, so it can
+// be read by older consumers. Versions before V2.2 have no options header:
+// their checksums are always SHA-256 and content is never compressed or
+// encrypted, so an archive using the V2.2 default of no checksum switches
+// to SHA-256, and one using another checksum, compression or encryption
+// fails with ErrVersionTooOld. So does an npm snapshot before V2.1, a Wasm module
+// before V2.3, a module with headers before V2.4 and a module with auxiliary
+// data before V2.5. Changes made afterwards are checked when the archive is
+// written. npm package integrity data is optional, so versions before V2.6
+// leave it out rather than fail.
+// It has the same concurrency guarantees as SetChecksum.
+func (e *EszipV2) SetVersion(version EszipVersion) error {
+	if version < VersionV2 || version > LatestVersion {
+		return fmt.Errorf("eszip: unknown format version %d", version)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	options := e.options
+	if !version.SupportsOptions() && options.Checksum == ChecksumNone && options.Compression == CompressionNone && options.Encryption == EncryptionNone {
+		options = DefaultOptionsForVersion(version)
+	}
+	_, entries := e.modules.snapshot()
+	if err := checkVersion(version, options, e.npmSnapshot, entries); err != nil {
+		return err
+	}
+	e.version, e.options = version, options
+	return nil
+}
+
+// checkVersion reports the first feature of an archive that version
+// cannot represent.
+func checkVersion(version EszipVersion, options Options, npmSnapshot *NpmResolutionSnapshot, entries []EszipV2Module) error {
+	if !version.SupportsOptions() {
+		if options.Checksum != ChecksumSha256 || options.GetChecksumSize() != ChecksumSha256.DigestSize() {
+			return fmt.Errorf("%w: %s checksums are always sha256, not %s", ErrVersionTooOld, version, options.Checksum)
+		}
+		if options.Compression != CompressionNone {
+			return fmt.Errorf("%w: %s cannot compress content", ErrVersionTooOld, version)
+		}
+		if options.Encryption != EncryptionNone {
+			return fmt.Errorf("%w: %s cannot encrypt content", ErrVersionTooOld, version)
+		}
+	}
+	if !version.SupportsNpm() && npmSnapshot != nil {
+		return fmt.Errorf("%w: %s has no npm snapshot", ErrVersionTooOld, version)
+	}
+	for _, entry := range entries {
+		switch m := entry.(type) {
+		case *NpmSpecifierEntry:
+			if !version.SupportsNpm() {
+				return fmt.Errorf("%w: %s has no npm specifiers", ErrVersionTooOld, version)
+			}
+		case *ModuleData:
+			if m.Kind == ModuleKindWasm && version < VersionV2_3 {
+				return fmt.Errorf("%w: %s has no wasm modules", ErrVersionTooOld, version)
+			}
+			if len(m.Headers) > 0 && !version.SupportsHeaders() {
+				return fmt.Errorf("%w: %s has no module headers", ErrVersionTooOld, version)
+			}
+			if len(m.Aux) > 0 && !version.SupportsAux() {
+				return fmt.Errorf("%w: %s has no module auxiliary data", ErrVersionTooOld, version)
+			}
+		}
+	}
+	return nil
+}
+
+// AddModule adds a module to the archive.
+// It is safe to call concurrently with other mutations and with IntoBytes;
+// a module added while IntoBytes is running is not included in that output.
 func (e *EszipV2) AddModule(specifier string, kind ModuleKind, source, sourceMap []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.modules.Insert(specifier, &ModuleData{
 		Kind:      kind,
 		Source:    NewReadySourceSlot(source),
@@ -216,8 +468,33 @@ func (e *EszipV2) AddModule(specifier string, kind ModuleKind, source, sourceMap
 	})
 }
 
-// AddImportMap adds an import map at the front of the archive
+// AddModuleWithHeaders adds a module with key/value headers, such as the
+// content-type of the HTTP response it was fetched with. Headers are
+// stored in the module headers section of format v2.4, which Deno cannot
+// read, so an archive at an earlier version is moved to v2.4. Empty or nil
+// headers add the module as AddModule does. The map is copied.
+// It has the same concurrency guarantees as AddModule.
+func (e *EszipV2) AddModuleWithHeaders(specifier string, kind ModuleKind, source, sourceMap []byte, headers map[string]string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	data := &ModuleData{
+		Kind:      kind,
+		Source:    NewReadySourceSlot(source),
+		SourceMap: NewReadySourceSlot(sourceMap),
+	}
+	if len(headers) > 0 {
+		data.Headers = maps.Clone(headers)
+		e.version = max(e.version, VersionV2_4)
+	}
+	e.modules.Insert(specifier, data)
+}
+
+// AddImportMap adds an import map at the front of the archive.
+// It has the same concurrency guarantees as AddModule.
 func (e *EszipV2) AddImportMap(kind ModuleKind, specifier string, source []byte) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.importMap = specifier
 	e.modules.InsertFront(specifier, &ModuleData{
 		Kind:      kind,
 		Source:    NewReadySourceSlot(source),
@@ -225,12 +502,16 @@ func (e *EszipV2) AddImportMap(kind ModuleKind, specifier string, source []byte)
 	})
 }
 
-// AddRedirect adds a redirect entry
+// AddRedirect adds a redirect entry.
+// It has the same concurrency guarantees as AddModule.
 func (e *EszipV2) AddRedirect(specifier, target string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.modules.Insert(specifier, &ModuleRedirect{Target: target})
 }
 
-// AddOpaqueData adds opaque data to the archive
+// AddOpaqueData adds opaque data to the archive.
+// It has the same concurrency guarantees as AddModule.
 func (e *EszipV2) AddOpaqueData(specifier string, data []byte) {
 	e.AddModule(specifier, ModuleKindOpaqueData, data, nil)
 }
@@ -259,6 +540,29 @@ func (e *EszipV2) Iterate() []struct {
 	return result
 }
 
+// All returns an iterator over the modules that Iterate returns, in archive
+// order, looking each one up as it is reached instead of up front. Each
+// specifier is paired with the module it resolves to, so a redirect yields
+// its target. Entries added or removed during iteration may be skipped or
+// seen twice.
+func (e *EszipV2) All() iter.Seq2[string, *Module] {
+	return func(yield func(string, *Module) bool) {
+		for i := 0; ; i++ {
+			specifier, _, ok := e.modules.at(i)
+			if !ok {
+				return
+			}
+			if !e.showReserved && isReservedSpecifier(specifier) {
+				continue
+			}
+			module := e.GetModule(specifier)
+			if module != nil && !yield(specifier, module) {
+				return
+			}
+		}
+	}
+}
+
 // v2ModuleInner implements moduleInner for V2
 type v2ModuleInner struct {
 	eszip *EszipV2
@@ -309,6 +613,7 @@ type Section struct {
 	content  []byte
 	hash     []byte
 	checksum ChecksumType
+	offset   int // byte offset of the content within the archive
 }
 
 // Content returns the section content
@@ -331,7 +636,17 @@ func (s *Section) IsChecksumValid() bool {
 	if s.checksum == ChecksumNone {
 		return true
 	}
-	return s.checksum.Verify(s.content, s.hash)
+	return s.checksum.verifyTruncated(s.content, s.hash)
+}
+
+// mismatch describes the stored and computed hashes of the section.
+func (s *Section) mismatch() *ChecksumMismatch {
+	return &ChecksumMismatch{
+		Algorithm: s.checksum,
+		Stored:    s.hash,
+		Computed:  s.checksum.appendHash(nil, s.content, len(s.hash)),
+		Length:    len(s.content),
+	}
 }
 
 // IntoContent returns and takes ownership of the content
@@ -346,7 +661,10 @@ type NpmPackageIndex struct {
 	Index uint32
 }
 
+// sourceOffsetEntry lists the modules whose source (or source map) starts
+// at a given offset. Several modules may share one entry when their content
+// is stored once.
 type sourceOffsetEntry struct {
-	length    int
-	specifier string
+	length     int
+	specifiers []string
 }
@@ -3,7 +3,6 @@
 package eszip
 
 import (
-	"bufio"
 	"encoding/binary"
 	"fmt"
 	"strings"
@@ -19,6 +18,12 @@ type NpmResolutionSnapshot struct {
 type NpmPackage struct {
 	ID           *NpmPackageID
 	Dependencies map[string]*NpmPackageID // req -> id
+	// Integrity is the Subresource Integrity digest of the package's
+	// tarball, such as "sha512-...", and Tarball the registry URL it was
+	// resolved from. Both are optional. They are written from format v2.6;
+	// earlier versions leave them out. See VerifyTarball.
+	Integrity string
+	Tarball   string
 }
 
 // NpmPackageID represents an NPM package identifier (name@version)
@@ -48,14 +53,16 @@ func ParseNpmPackageID(s string) (*NpmPackageID, error) {
 }
 
 // parseNpmSection parses the NPM section
-func parseNpmSection(br *bufio.Reader, options Options, npmSpecifiers map[string]NpmPackageIndex) (*NpmResolutionSnapshot, error) {
+func parseNpmSection(br *archiveReader, options Options, npmSpecifiers map[string]NpmPackageIndex) (*NpmResolutionSnapshot, error) {
+	start := br.offset
 	section, err := readSection(br, options)
 	if err != nil {
 		return nil, err
 	}
+	br.reportSection("npm", start)
 
-	if !section.IsChecksumValid() {
-		return nil, errInvalidV2NpmSnapshotHash()
+	if !br.checksumValid(section) {
+		return nil, errInvalidV2NpmSnapshotHash(section)
 	}
 
 	content := section.Content()
@@ -142,8 +149,14 @@ func parseNpmModule(content []byte, offset int) (*npmModuleEntry, int, error) {
 	depCount := binary.BigEndian.Uint32(content[offset : offset+4])
 	offset += 4
 
+	// Every dependency needs at least a string length and a package index,
+	// so a count the remaining bytes cannot hold is rejected up front.
+	if uint64(depCount)*8 > uint64(len(content)-offset) {
+		return nil, 0, fmt.Errorf("dependency count %d exceeds remaining %d bytes", depCount, len(content)-offset)
+	}
+
 	// Parse dependencies
-	deps := make(map[string]uint32)
+	deps := make(map[string]uint32, depCount)
 	for i := uint32(0); i < depCount; i++ {
 		// Parse dependency name
 		depName, newOffset, err := parseNpmString(content, offset)
@@ -176,7 +189,7 @@ func parseNpmString(content []byte, offset int) (string, int, error) {
 	length := binary.BigEndian.Uint32(content[offset : offset+4])
 	offset += 4
 
-	if offset+int(length) > len(content) {
+	if uint64(length) > uint64(len(content)-offset) {
 		return "", 0, fmt.Errorf("unexpected end of data")
 	}
 
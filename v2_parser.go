@@ -6,31 +6,41 @@ import (
 	"bufio"
 	"context"
 	"encoding/binary"
+	"fmt"
 	"io"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
 )
 
 // ParseV2 parses a V2 eszip from a reader.
 // Returns the eszip and a completion function that loads sources in background.
-func ParseV2(ctx context.Context, r io.Reader) (*EszipV2, func(context.Context) error, error) {
-	br := bufio.NewReader(r)
+func ParseV2(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipV2, func(context.Context) error, error) {
+	br := newArchiveReader(r, newParseConfig(opts))
 
 	// Read magic bytes
 	magic := make([]byte, 8)
 	if _, err := io.ReadFull(br, magic); err != nil {
 		return nil, nil, errIO(err)
 	}
+	br.reportSection("magic", 0)
 
 	version, ok := VersionFromMagic(magic)
 	if !ok {
 		return nil, nil, errInvalidV2()
 	}
 
-	return parseV2WithVersion(ctx, version, br)
+	eszip, completion, err := parseV2WithVersion(ctx, version, br)
+	if err != nil {
+		return nil, nil, err
+	}
+	return eszip, completion.Complete, nil
 }
 
 // ParseV2Sync parses a V2 eszip completely (blocking)
-func ParseV2Sync(ctx context.Context, r io.Reader) (*EszipV2, error) {
-	eszip, complete, err := ParseV2(ctx, r)
+func ParseV2Sync(ctx context.Context, r io.Reader, opts ...ParseOption) (*EszipV2, error) {
+	eszip, complete, err := ParseV2(ctx, r, opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +52,9 @@ func ParseV2Sync(ctx context.Context, r io.Reader) (*EszipV2, error) {
 	return eszip, nil
 }
 
-func parseV2WithVersion(_ context.Context, version EszipVersion, br *bufio.Reader) (*EszipV2, func(context.Context) error, error) {
+func parseV2WithVersion(ctx context.Context, version EszipVersion, br *archiveReader) (*EszipV2, *Completion, error) {
+	defer br.timePhase("parse_header", time.Now())
+
 	supportsNpm := version.SupportsNpm()
 	supportsOptions := version.SupportsOptions()
 
@@ -50,27 +62,45 @@ func parseV2WithVersion(_ context.Context, version EszipVersion, br *bufio.Reade
 
 	// Parse options header (V2.2+)
 	if supportsOptions {
+		start := br.offset
 		var err error
 		options, err = parseOptionsHeader(br, options)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, inSection(err, "options")
+		}
+		br.reportSection("options", start)
+		if br.policy.RequireChecksum && options.Checksum == ChecksumNone {
+			return nil, nil, errChecksumRequired("the archive was written without checksums")
+		}
+		if options.Encryption != EncryptionNone {
+			if options.aead, err = options.Encryption.newAEAD(ctx, br.keys); err != nil {
+				return nil, nil, err
+			}
 		}
 	}
 
 	// Parse modules header
+	start := br.offset
 	modulesHeader, err := readSection(br, options)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, inSection(err, "modules")
 	}
+	br.reportSection("modules", start)
 
-	if !modulesHeader.IsChecksumValid() {
-		return nil, nil, errInvalidV2HeaderHash()
+	if !br.checksumValid(modulesHeader) {
+		return nil, nil, inSection(errInvalidV2HeaderHash(modulesHeader), "modules")
 	}
 
 	// Parse module entries from header
-	modules, npmSpecifiers, err := parseModulesHeader(modulesHeader.Content(), supportsNpm)
+	modules, npmSpecifiers, err := parseModulesHeader(br, modulesHeader, supportsNpm)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, inSection(err, "modules")
+	}
+
+	if br.origins != nil {
+		if err := br.origins.check(modules.Keys()); err != nil {
+			return nil, nil, err
+		}
 	}
 
 	// Parse NPM section
@@ -78,13 +108,37 @@ func parseV2WithVersion(_ context.Context, version EszipVersion, br *bufio.Reade
 	if supportsNpm {
 		npmSnapshot, err = parseNpmSection(br, options, npmSpecifiers)
 		if err != nil {
-			return nil, nil, err
+			return nil, nil, inSection(err, "npm")
 		}
 	}
 
-	// Build source offset maps
-	sourceOffsets := make(map[int]sourceOffsetEntry)
-	sourceMapOffsets := make(map[int]sourceOffsetEntry)
+	// Parse module headers section (V2.4+)
+	if version.SupportsHeaders() {
+		if err := parseModuleHeadersSection(br, options, modules); err != nil {
+			return nil, nil, inSection(err, "module_headers")
+		}
+	}
+
+	// Parse module aux section (V2.5+)
+	if version.SupportsAux() {
+		if err := parseModuleAuxSection(br, options, modules); err != nil {
+			return nil, nil, inSection(err, "module_aux")
+		}
+	}
+
+	// Parse npm integrity section (V2.6+)
+	if version.SupportsNpmIntegrity() {
+		if err := parseNpmIntegritySection(br, options, npmSnapshot); err != nil {
+			return nil, nil, inSection(err, "npm_integrity")
+		}
+	}
+
+	// Build source offset maps. The sources section starts where the
+	// headers end, so the archive offsets of its content are known.
+	checksumSize := int(options.GetChecksumSize())
+	strict := br.policy.StrictOffsets
+	sources := newSourceLayout(checksumSize, strict, br.offset+4)
+	sourceMaps := newSourceLayout(checksumSize, strict, -1)
 
 	for _, specifier := range modules.Keys() {
 		mod, ok := modules.Get(specifier)
@@ -97,37 +151,132 @@ func parseV2WithVersion(_ context.Context, version EszipVersion, br *bufio.Reade
 			continue
 		}
 
-		if data.Source.State() == SourceSlotPending && data.Source.Length() > 0 {
-			sourceOffsets[int(data.Source.Offset())] = sourceOffsetEntry{
-				length:    int(data.Source.Length()),
-				specifier: specifier,
+		if data.Source.State() == SourceSlotPending {
+			if err := sources.add(data.Source, specifier); err != nil {
+				return nil, nil, inSection(err, "modules")
 			}
 		}
 
-		if data.SourceMap.State() == SourceSlotPending && data.SourceMap.Length() > 0 {
-			sourceMapOffsets[int(data.SourceMap.Offset())] = sourceOffsetEntry{
-				length:    int(data.SourceMap.Length()),
-				specifier: specifier,
+		if data.SourceMap.State() == SourceSlotPending {
+			if err := sourceMaps.add(data.SourceMap, specifier); err != nil {
+				return nil, nil, inSection(err, "modules")
 			}
 		}
 	}
+	if strict {
+		br.contentLengths = [2]int{sources.end, sourceMaps.end}
+	}
+	// Modules dropped when parsing leniently are left out of the archive
+	// once their content is accounted for, so it is read and discarded.
+	if br.faults != nil {
+		for _, specifier := range br.faults.dropped {
+			modules.Remove(specifier)
+		}
+	}
 
 	eszip := &EszipV2{
-		modules:     modules,
-		npmSnapshot: npmSnapshot,
-		options:     options,
-		version:     version,
+		modules:      modules,
+		npmSnapshot:  npmSnapshot,
+		options:      options,
+		version:      version,
+		keys:         br.keys,
+		showReserved: br.showReserved,
+	}
+
+	loader := newSourceLoader(br, eszip, options, sources.offsets, sourceMaps.offsets)
+	return eszip, newCompletion(loader.next, loader.abort), nil
+}
+
+// sourceLayout collects where the modules header places the content of
+// the sources or source maps section.
+type sourceLayout struct {
+	offsets      map[int]sourceOffsetEntry
+	checksumSize int
+	// strict checks the layout as ParseOptions.StrictOffsets describes.
+	strict bool
+	// base is the archive offset of the section's content, or -1 if it is
+	// not yet known.
+	base int64
+	// end is where the content laid out so far ends.
+	end int
+}
+
+func newSourceLayout(checksumSize int, strict bool, base int64) *sourceLayout {
+	return &sourceLayout{offsets: make(map[int]sourceOffsetEntry), checksumSize: checksumSize, strict: strict, base: base}
+}
+
+// add records that slot's content for specifier starts at the slot's
+// offset. Modules may share an offset only if they agree on length. When
+// strict, content not seen before must start where the content before it
+// in header order ends.
+func (l *sourceLayout) add(slot *SourceSlot, specifier string) error {
+	offset, length := int(slot.Offset()), int(slot.Length())
+	if entry, ok := l.offsets[offset]; ok {
+		if entry.length != length {
+			return l.errRange(specifier, offset, length, fmt.Sprintf("%s stores %d bytes at the same offset", entry.specifiers[0], entry.length))
+		}
+		entry.specifiers = append(entry.specifiers, specifier)
+		l.offsets[offset] = entry
+		return nil
 	}
+	if l.strict {
+		switch {
+		case offset < l.end:
+			owner, start := l.owner(offset, offset+length+l.checksumSize)
+			if owner == "" {
+				return l.errRange(specifier, offset, length, fmt.Sprintf("comes before content laid out up to %d", l.end))
+			}
+			return l.errRange(specifier, offset, length, fmt.Sprintf("overlaps %s at %d-%d", owner, start, start+l.offsets[start].length+l.checksumSize))
+		case offset > l.end:
+			return l.errRange(specifier, offset, length, fmt.Sprintf("leaves bytes %d-%d unused", l.end, offset))
+		}
+	}
+	l.offsets[offset] = sourceOffsetEntry{length: length, specifiers: []string{specifier}}
+	l.end = max(l.end, offset+length+l.checksumSize)
+	return nil
+}
 
-	// Return completion function for source loading
-	completeFn := func(ctx context.Context) error {
-		return loadSources(ctx, br, eszip, options, sourceOffsets, sourceMapOffsets)
+// owner returns the first module and offset of the content that overlaps
+// the range from start to end, if any.
+func (l *sourceLayout) owner(start, end int) (string, int) {
+	best := -1
+	for offset, entry := range l.offsets {
+		if offset < end && start < offset+entry.length+l.checksumSize && (best < 0 || offset < best) {
+			best = offset
+		}
+	}
+	if best < 0 {
+		return "", 0
 	}
+	return l.offsets[best].specifiers[0], best
+}
 
-	return eszip, completeFn, nil
+func (l *sourceLayout) errRange(specifier string, offset, length int, msg string) *ParseError {
+	at := 0
+	if l.base >= 0 {
+		at = int(l.base) + offset
+	}
+	return errInvalidV2SourceRange(specifier, offset, length+l.checksumSize, msg, at)
+}
+
+// checkContentLength checks, when parsing with StrictOffsets, that the
+// declared length of a content section is exactly what the modules header
+// lays out in it. at is the archive offset of the length prefix.
+func (r *archiveReader) checkContentLength(sourceMap bool, declared int64, at int64) error {
+	if !r.policy.StrictOffsets {
+		return nil
+	}
+	laidOut := r.contentLengths[0]
+	if sourceMap {
+		laidOut = r.contentLengths[1]
+	}
+	if declared != int64(laidOut) {
+		return errInvalidV2ContentLength(declared, laidOut, int(at))
+	}
+	return nil
 }
 
-func parseOptionsHeader(br *bufio.Reader, defaults Options) (Options, error) {
+func parseOptionsHeader(br *archiveReader, defaults Options) (Options, error) {
 	// Read options without checksum first
 	preOpts := defaults
 	preOpts.Checksum = ChecksumNone
@@ -144,6 +293,7 @@ func parseOptionsHeader(br *bufio.Reader, defaults Options) (Options, error) {
 
 	options := defaults
 	content := optionsHeader.Content()
+	knownChecksum := true
 
 	for i := 0; i < len(content); i += 2 {
 		option := content[i]
@@ -154,16 +304,41 @@ func parseOptionsHeader(br *bufio.Reader, defaults Options) (Options, error) {
 			checksum, ok := ChecksumFromU8(value)
 			if ok {
 				options.Checksum = checksum
+			} else {
+				knownChecksum = false
+				br.warn("unknown_checksum", slog.Int("value", int(value)), slog.Int("offset", optionsHeader.offset+i+1))
 			}
 		case 1: // Checksum size
 			options.ChecksumSize = value
+		case optionCompression:
+			// Content cannot be read with an unknown compression, so unlike
+			// other options this one is not ignored.
+			compression, ok := CompressionFromU8(value)
+			if !ok {
+				return defaults, errInvalidV22OptionsHeader(fmt.Sprintf("unknown compression %d", value))
+			}
+			options.Compression = compression
+		case optionEncryption:
+			encryption, ok := EncryptionFromU8(value)
+			if !ok {
+				return defaults, errInvalidV22OptionsHeader(fmt.Sprintf("unknown encryption %d", value))
+			}
+			options.Encryption = encryption
+		default:
+			// Unknown options are kept, to be written back, for forward
+			// compatibility
+			br.warn("unknown_option", slog.Int("option", int(option)), slog.Int("value", int(value)), slog.Int("offset", optionsHeader.offset+i))
+			options.unknown = append(options.unknown, option, value)
 		}
-		// Unknown options are ignored for forward compatibility
 	}
 
 	if options.GetChecksumSize() == 0 && options.Checksum != ChecksumNone {
 		return defaults, errInvalidV22OptionsHeader("checksum size must be known")
 	}
+	// A checksum can be truncated, but not extended
+	if digest := options.Checksum.DigestSize(); knownChecksum && options.GetChecksumSize() > digest {
+		return defaults, errInvalidV22OptionsHeader(fmt.Sprintf("checksum size %d exceeds the %d-byte %s digest", options.GetChecksumSize(), digest, options.Checksum))
+	}
 
 	// If checksum is enabled, validate the options header hash
 	if options.GetChecksumSize() > 0 {
@@ -173,49 +348,39 @@ func parseOptionsHeader(br *bufio.Reader, defaults Options) (Options, error) {
 			return defaults, errIO(err)
 		}
 
-		if !options.Checksum.Verify(content, hash) {
-			return defaults, errInvalidV22OptionsHeaderHash()
+		if !br.policy.SkipChecksumVerify && !options.Checksum.verifyTruncated(content, hash) {
+			optionsHeader.hash = hash
+			optionsHeader.checksum = options.Checksum
+			return defaults, errInvalidV22OptionsHeaderHash(optionsHeader)
 		}
 	}
 
 	return options, nil
 }
 
-func readSection(br *bufio.Reader, options Options) (*Section, error) {
+func readSection(br *archiveReader, options Options) (*Section, error) {
 	// Read length (4 bytes, big-endian)
 	lengthBytes := make([]byte, 4)
 	if _, err := io.ReadFull(br, lengthBytes); err != nil {
 		return nil, errIO(err)
 	}
 	length := binary.BigEndian.Uint32(lengthBytes)
-
-	// Read content
-	content := make([]byte, length)
-	if _, err := io.ReadFull(br, content); err != nil {
-		return nil, errIO(err)
-	}
-
-	// Read hash
-	checksumSize := options.GetChecksumSize()
-	var hash []byte
-	if checksumSize > 0 {
-		hash = make([]byte, checksumSize)
-		if _, err := io.ReadFull(br, hash); err != nil {
-			return nil, errIO(err)
-		}
+	if err := br.checkSectionSize(int64(length)); err != nil {
+		return nil, err
 	}
 
-	return &Section{
-		content:  content,
-		hash:     hash,
-		checksum: options.Checksum,
-	}, nil
+	return readSectionWithSize(br, options, int(length))
 }
 
-func readSectionWithSize(br *bufio.Reader, options Options, contentLen int) (*Section, error) {
+func readSectionWithSize(br *archiveReader, options Options, contentLen int) (*Section, error) {
+	if err := br.ensureAvailable(int64(contentLen) + int64(options.GetChecksumSize())); err != nil {
+		return nil, err
+	}
+	offset := int(br.offset)
+
 	// Read content
-	content := make([]byte, contentLen)
-	if _, err := io.ReadFull(br, content); err != nil {
+	content, err := br.readN(contentLen)
+	if err != nil {
 		return nil, errIO(err)
 	}
 
@@ -233,33 +398,44 @@ func readSectionWithSize(br *bufio.Reader, options Options, contentLen int) (*Se
 		content:  content,
 		hash:     hash,
 		checksum: options.Checksum,
+		offset:   offset,
 	}, nil
 }
 
-func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[string]NpmPackageIndex, error) {
+func parseModulesHeader(br *archiveReader, header *Section, supportsNpm bool) (*ModuleMap, map[string]NpmPackageIndex, error) {
+	content := header.Content()
 	modules := NewModuleMap()
 	npmSpecifiers := make(map[string]NpmPackageIndex)
 
 	read := 0
+	entries := 0
 
 	for read < len(content) {
+		entries++
+		if limit := br.policy.MaxModules; limit > 0 && entries > limit {
+			return nil, nil, errTooManyModules(limit)
+		}
+
 		// Read specifier length
 		if read+4 > len(content) {
-			return nil, nil, errInvalidV2Header("specifier len")
+			return nil, nil, errInvalidV2Header("specifier len", header.offset+read)
 		}
 		specifierLen := int(binary.BigEndian.Uint32(content[read : read+4]))
 		read += 4
 
 		// Read specifier
 		if read+specifierLen > len(content) {
-			return nil, nil, errInvalidV2Header("specifier")
+			return nil, nil, errInvalidV2Header("specifier", header.offset+read)
 		}
 		specifier := string(content[read : read+specifierLen])
+		if _, dup := modules.Get(specifier); dup {
+			br.warn("duplicate_specifier", slog.String("specifier", specifier), slog.Int("offset", header.offset+read))
+		}
 		read += specifierLen
 
 		// Read entry kind
 		if read+1 > len(content) {
-			return nil, nil, errInvalidV2Header("entry kind")
+			return nil, nil, errInvalidV2Header("entry kind", header.offset+read)
 		}
 		entryKind := content[read]
 		read++
@@ -267,7 +443,7 @@ func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[strin
 		switch entryKind {
 		case 0: // Module
 			if read+17 > len(content) {
-				return nil, nil, errInvalidV2Header("module data")
+				return nil, nil, errInvalidV2Header("module data", header.offset+read)
 			}
 
 			sourceOffset := binary.BigEndian.Uint32(content[read : read+4])
@@ -294,18 +470,25 @@ func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[strin
 			case 4:
 				kind = ModuleKindWasm
 			default:
-				return nil, nil, errInvalidV2ModuleKind(kindByte, read)
+				err := errInvalidV2ModuleKind(specifier, kindByte, header.offset+read-1)
+				if !br.tolerate(err, "modules") {
+					return nil, nil, err
+				}
+				// Kept until the content offsets are known; see
+				// parseV2WithVersion.
+				kind = ModuleKindOpaqueData
+				br.faults.dropped = append(br.faults.dropped, specifier)
 			}
 
 			var source *SourceSlot
-			if sourceOffset == 0 && sourceLen == 0 {
+			if sourceLen == 0 {
 				source = NewEmptySourceSlot()
 			} else {
 				source = NewPendingSourceSlot(sourceOffset, sourceLen)
 			}
 
 			var sourceMap *SourceSlot
-			if sourceMapOffset == 0 && sourceMapLen == 0 {
+			if sourceMapLen == 0 {
 				sourceMap = NewEmptySourceSlot()
 			} else {
 				sourceMap = NewPendingSourceSlot(sourceMapOffset, sourceMapLen)
@@ -319,13 +502,13 @@ func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[strin
 
 		case 1: // Redirect
 			if read+4 > len(content) {
-				return nil, nil, errInvalidV2Header("target len")
+				return nil, nil, errInvalidV2Header("target len", header.offset+read)
 			}
 			targetLen := int(binary.BigEndian.Uint32(content[read : read+4]))
 			read += 4
 
 			if read+targetLen > len(content) {
-				return nil, nil, errInvalidV2Header("target")
+				return nil, nil, errInvalidV2Header("target", header.offset+read)
 			}
 			target := string(content[read : read+targetLen])
 			read += targetLen
@@ -334,11 +517,11 @@ func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[strin
 
 		case 2: // NpmSpecifier
 			if !supportsNpm {
-				return nil, nil, errInvalidV2EntryKind(entryKind, read)
+				return nil, nil, errInvalidV2EntryKind(entryKind, "0-1", header.offset+read-1)
 			}
 
 			if read+4 > len(content) {
-				return nil, nil, errInvalidV2Header("npm package id")
+				return nil, nil, errInvalidV2Header("npm package id", header.offset+read)
 			}
 			pkgID := binary.BigEndian.Uint32(content[read : read+4])
 			read += 4
@@ -346,69 +529,558 @@ func parseModulesHeader(content []byte, supportsNpm bool) (*ModuleMap, map[strin
 			npmSpecifiers[specifier] = NpmPackageIndex{Index: pkgID}
 
 		default:
-			return nil, nil, errInvalidV2EntryKind(entryKind, read)
+			expected := "0-1"
+			if supportsNpm {
+				expected = "0-2"
+			}
+			return nil, nil, errInvalidV2EntryKind(entryKind, expected, header.offset+read-1)
 		}
 	}
 
 	return modules, npmSpecifiers, nil
 }
 
-func loadSources(_ context.Context, br *bufio.Reader, eszip *EszipV2, options Options, sourceOffsets, sourceMapOffsets map[int]sourceOffsetEntry) error {
-	getSlot := func(specifier string, isSourceMap bool) *SourceSlot {
-		mod, ok := eszip.modules.Get(specifier)
-		if !ok {
-			return nil
+// sourceLoader reads the sources and source maps sections one entry at a
+// time, resolving the slots that refer to each entry as it goes.
+type sourceLoader struct {
+	br       *archiveReader
+	eszip    *EszipV2
+	options  Options
+	sections [2]loaderSection
+	current  int // index into sections of the one being read
+	started  time.Time
+	// pool, if set, verifies content while the next entry is read; see
+	// WithConcurrency. instrMu serializes its instrumentation reports.
+	pool    *verifyPool
+	instrMu sync.Mutex
+}
+
+// loaderSection tracks progress through one content section.
+type loaderSection struct {
+	kind      string
+	sourceMap bool
+	offsets   map[int]sourceOffsetEntry
+	begun     bool
+	start     int64 // archive offset of the section's length prefix
+	total     int
+	read      int
+	loaded    map[int]bool
+}
+
+func newSourceLoader(br *archiveReader, eszip *EszipV2, options Options, sourceOffsets, sourceMapOffsets map[int]sourceOffsetEntry) *sourceLoader {
+	l := &sourceLoader{
+		br:      br,
+		eszip:   eszip,
+		options: options,
+		sections: [2]loaderSection{
+			{kind: "sources", offsets: sourceOffsets},
+			{kind: "source_maps", sourceMap: true, offsets: sourceMapOffsets},
+		},
+	}
+	// Without checksums, compression or encryption there is nothing worth
+	// handing off.
+	if br.concurrency > 1 && (options.Checksum != ChecksumNone || options.Compression != CompressionNone || options.Encryption != EncryptionNone) {
+		l.pool = &verifyPool{workers: br.concurrency}
+	}
+	return l
+}
+
+// slotFor returns the source or source map slot of specifier, or nil if it
+// is no longer a module.
+func (l *sourceLoader) slotFor(specifier string, sourceMap bool) *SourceSlot {
+	mod, ok := l.eszip.modules.Get(specifier)
+	if !ok {
+		return nil
+	}
+	data, ok := mod.(*ModuleData)
+	if !ok {
+		return nil
+	}
+	if sourceMap {
+		return data.SourceMap
+	}
+	return data.Source
+}
+
+// next loads one entry and returns the first specifier it resolved. done is
+// true once both sections have been read in full and verified.
+func (l *sourceLoader) next() (string, bool, error) {
+	specifier, done, err := l.step()
+	if l.pool != nil && (done || err != nil) {
+		if poolErr := l.pool.wait(); err == nil && poolErr != nil {
+			return "", false, poolErr
 		}
-		data, ok := mod.(*ModuleData)
-		if !ok {
-			return nil
+	}
+	return specifier, done, err
+}
+
+// step is next without waiting for the pool.
+func (l *sourceLoader) step() (string, bool, error) {
+	if l.started.IsZero() {
+		l.started = time.Now()
+	}
+	for l.current < len(l.sections) {
+		s := &l.sections[l.current]
+		if !s.begun {
+			if err := l.begin(s); err != nil {
+				if l.recover(err, s.start) {
+					return "", true, nil
+				}
+				return "", false, inSection(err, s.kind)
+			}
+		}
+		if s.read < s.total {
+			at := l.br.offset
+			specifier, err := l.loadEntry(s)
+			if err != nil && l.recover(err, at) {
+				return "", true, nil
+			}
+			if err != nil {
+				return "", false, inSection(err, s.kind)
+			}
+			l.br.reportProgress(s.kind)
+			return specifier, false, nil
+		}
+		if err := l.finish(s); err != nil {
+			return "", false, inSection(err, s.kind)
 		}
-		if isSourceMap {
-			return data.SourceMap
+		l.current++
+		if l.current == len(l.sections) {
+			if err := l.readTrailing(); err != nil {
+				return "", false, err
+			}
 		}
-		return data.Source
 	}
+	if l.br.recovery != nil {
+		*l.br.recovery = RecoveryReport{}
+		fillRecoveryReport(l.br.recovery, l.eszip)
+	}
+	return "", true, nil
+}
 
-	if err := loadSection(br, options, sourceOffsets, func(specifier string) *SourceSlot {
-		return getSlot(specifier, false)
-	}); err != nil {
-		return err
+// readTrailing keeps whatever follows the source maps section, such as
+// sections added by a newer writer, so that it is written back. Only input
+// of known size is read to its end; a stream of unknown size is left
+// where the archive ends.
+func (l *sourceLoader) readTrailing() error {
+	n := l.br.remaining
+	if n <= 0 {
+		return nil
+	}
+	if limit := l.br.policy.MaxSectionSize; limit > 0 && n > limit {
+		return errSectionTooLarge(n, limit, int(l.br.offset))
 	}
+	start := l.br.offset
+	trailing := make([]byte, n)
+	if _, err := io.ReadFull(l.br, trailing); err != nil {
+		return errIO(err)
+	}
+	l.br.warn("trailing_data", slog.Int64("offset", start), slog.Int64("length", n))
+	l.br.reportSection("trailing", start)
+	l.eszip.mu.Lock()
+	l.eszip.trailing = trailing
+	l.eszip.mu.Unlock()
+	return nil
+}
 
-	return loadSection(br, options, sourceMapOffsets, func(specifier string) *SourceSlot {
-		return getSlot(specifier, true)
-	})
+// recover handles a failure to read content when parsing WithRecovery. If
+// err means the input ended, the content not yet read is marked not loaded,
+// the report is filled in and recover returns true.
+func (l *sourceLoader) recover(err error, at int64) bool {
+	if l.br.recovery == nil || !isTruncation(err) {
+		return false
+	}
+	l.br.warn("truncated", slog.Int64("offset", at))
+	l.abort()
+	l.current = len(l.sections)
+	*l.br.recovery = RecoveryReport{Truncated: true, TruncatedAt: at}
+	fillRecoveryReport(l.br.recovery, l.eszip)
+	return true
 }
 
-func loadSection(br *bufio.Reader, options Options, offsets map[int]sourceOffsetEntry, slotFor func(string) *SourceSlot) error {
+// begin reads the section's length prefix.
+func (l *sourceLoader) begin(s *loaderSection) error {
+	s.start = l.br.offset
 	lenBytes := make([]byte, 4)
-	if _, err := io.ReadFull(br, lenBytes); err != nil {
+	if _, err := io.ReadFull(l.br, lenBytes); err != nil {
 		return errIO(err)
 	}
-	totalLen := int(binary.BigEndian.Uint32(lenBytes))
+	s.total = int(binary.BigEndian.Uint32(lenBytes))
+	if err := l.br.checkSectionSize(int64(s.total)); err != nil {
+		return err
+	}
+	if err := l.br.checkContentLength(s.sourceMap, int64(s.total), s.start); err != nil {
+		return err
+	}
+	// When recovering, a section longer than the input is read up to
+	// where the input ends.
+	if l.br.recovery == nil {
+		if err := l.br.ensureAvailable(int64(s.total)); err != nil {
+			return err
+		}
+	}
+	s.loaded = make(map[int]bool, len(s.offsets))
+	s.begun = true
+	return nil
+}
 
-	read := 0
-	for read < totalLen {
-		entry, ok := offsets[read]
-		if !ok {
-			return errInvalidV2SourceOffset(read)
+func (l *sourceLoader) loadEntry(s *loaderSection) (string, error) {
+	entry, ok := s.offsets[s.read]
+	if !ok {
+		return "", errInvalidV2SourceOffset(s.read, int(l.br.offset))
+	}
+	if s.read+entry.length+int(l.options.GetChecksumSize()) > s.total {
+		return "", errInvalidV2SourceOffset(s.read, int(l.br.offset))
+	}
+
+	section, err := readSectionWithSize(l.br, l.options, entry.length)
+	if err != nil {
+		return "", err
+	}
+
+	s.loaded[s.read] = true
+	s.read += section.TotalLen()
+
+	if l.pool != nil {
+		sourceMap := s.sourceMap
+		l.pool.submit(func() error { return l.resolve(entry, sourceMap, section) })
+		return entry.specifiers[0], l.pool.failed()
+	}
+	return entry.specifiers[0], l.resolve(entry, s.sourceMap, section)
+}
+
+// resolve verifies and decompresses the content read for entry and makes
+// it the content of the entry's slots.
+func (l *sourceLoader) resolve(entry sourceOffsetEntry, sourceMap bool, section *Section) error {
+	content, perr := l.open(entry, sourceMap, section)
+	if perr != nil {
+		kind := l.sections[0].kind
+		if sourceMap {
+			kind = l.sections[1].kind
+		}
+		if !l.br.tolerate(perr, kind) {
+			return perr
+		}
+		for _, specifier := range entry.specifiers {
+			if slot := l.slotFor(specifier, sourceMap); slot != nil {
+				slot.setNotLoaded()
+			}
+		}
+		return nil
+	}
+	for _, specifier := range entry.specifiers {
+		if l.br.instr != nil {
+			l.instrMu.Lock()
+			l.br.instr.SourceLoaded(specifier, len(content), l.options.Checksum != ChecksumNone && !l.br.policy.SkipChecksumVerify)
+			l.instrMu.Unlock()
+		}
+		if slot := l.slotFor(specifier, sourceMap); slot != nil {
+			slot.SetReady(content)
 		}
+	}
+	return nil
+}
 
-		section, err := readSectionWithSize(br, options, entry.length)
-		if err != nil {
-			return err
+// open verifies, decrypts and decompresses the content read for entry.
+// Encrypted content is bound to one module, so it cannot be shared.
+func (l *sourceLoader) open(entry sourceOffsetEntry, sourceMap bool, section *Section) ([]byte, *ParseError) {
+	if !l.br.checksumValid(section) {
+		return nil, errInvalidV2SourceHash(entry.specifiers[0], section)
+	}
+	if l.options.aead != nil && len(entry.specifiers) > 1 {
+		return nil, errInvalidV2SourceEncryption(entry.specifiers[1], section.offset, fmt.Errorf("content is shared with %s", entry.specifiers[0]))
+	}
+	content, err := l.options.decrypt(section.IntoContent(), entry.specifiers[0], sourceMap)
+	if err != nil {
+		return nil, errInvalidV2SourceEncryption(entry.specifiers[0], section.offset, err)
+	}
+	content, err = l.options.Compression.decompress(content, l.br.policy.decompressLimit())
+	if err != nil {
+		return nil, errInvalidV2SourceCompression(entry.specifiers[0], section.offset, err)
+	}
+	return content, nil
+}
+
+// finish reports a fully read section and checks that every offset the
+// header referenced was present, otherwise its slot would stay pending
+// forever.
+func (l *sourceLoader) finish(s *loaderSection) error {
+	l.br.reportSection(s.kind, s.start)
+	if len(s.loaded) < len(s.offsets) {
+		missing := -1
+		for offset := range s.offsets {
+			if !s.loaded[offset] && (missing < 0 || offset < missing) {
+				missing = offset
+			}
+		}
+		return errInvalidV2SourceOffset(missing, int(s.start)+4+missing)
+	}
+	if l.current == len(l.sections)-1 {
+		if l.pool != nil {
+			if err := l.pool.wait(); err != nil {
+				return err
+			}
+		}
+		l.br.timePhase("load_sources", l.started)
+	}
+	return nil
+}
+
+// abort resolves every slot still waiting on the unread part of the input
+// as not loaded. Content already read is verified first.
+func (l *sourceLoader) abort() {
+	if l.pool != nil {
+		_ = l.pool.wait()
+	}
+	for i := l.current; i < len(l.sections); i++ {
+		s := &l.sections[i]
+		for offset, entry := range s.offsets {
+			if s.loaded[offset] {
+				continue
+			}
+			for _, specifier := range entry.specifiers {
+				if slot := l.slotFor(specifier, s.sourceMap); slot != nil {
+					slot.setNotLoaded()
+				}
+			}
 		}
+	}
+}
+
+// verifyPool runs the checksum verification and decompression of content
+// on worker goroutines, so the loader can read on while they work. The
+// workers start with the first job.
+type verifyPool struct {
+	workers int
+	jobs    chan func() error
+	wg      sync.WaitGroup
+	mu      sync.Mutex
+	err     error
+	closed  bool
+}
 
-		if !section.IsChecksumValid() {
-			return errInvalidV2SourceHash(entry.specifier)
+// submit queues job, blocking while every worker is busy and the queue is
+// full, so content read ahead of verification stays bounded.
+func (p *verifyPool) submit(job func() error) {
+	if p.jobs == nil {
+		p.jobs = make(chan func() error, p.workers)
+		p.wg.Add(p.workers)
+		for range p.workers {
+			go p.work()
 		}
+	}
+	p.jobs <- job
+}
+
+func (p *verifyPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if err := job(); err != nil {
+			p.mu.Lock()
+			if p.err == nil {
+				p.err = err
+			}
+			p.mu.Unlock()
+		}
+	}
+}
+
+// failed returns the first error a job has returned so far.
+func (p *verifyPool) failed() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.err
+}
+
+// wait lets the queued jobs finish, stops the workers and returns the
+// first error a job returned. It may be called more than once.
+func (p *verifyPool) wait() error {
+	p.mu.Lock()
+	if !p.closed && p.jobs != nil {
+		close(p.jobs)
+	}
+	p.closed = true
+	p.mu.Unlock()
+	p.wg.Wait()
+	return p.failed()
+}
+
+// archiveReader is the buffered input of a V2 parse. It counts the bytes
+// consumed and, when the total input size is known, how many remain, so
+// declared section lengths can be checked before allocating for them.
+type archiveReader struct {
+	br        *bufio.Reader
+	offset    int64
+	remaining int64 // -1 when the input size is unknown
+	instr     Instrumentation
+	log       *slog.Logger
+	// showReserved is copied to the parsed archive; see
+	// WithReservedSpecifiers.
+	showReserved bool
+	// origins, if set, is checked against the parsed specifiers; see
+	// WithAllowedOrigins.
+	origins *originPolicy
+	// recovery, if set, makes the source loader salvage truncated input;
+	// see WithRecovery.
+	recovery *RecoveryReport
+	// faults, if set, collects the errors confined to one module instead
+	// of failing; see ParseLenient.
+	faults *faultLog
+	// concurrency is the number of goroutines verifying content; see
+	// WithConcurrency.
+	concurrency int
+	// keys decrypts encrypted content; see WithDecryptionKey.
+	keys KeyProvider
+	// policy holds the limits and checksum policy; see WithParseOptions.
+	policy ParseOptions
+	// progress and inputSize, the total input size or -1, serve
+	// WithProgress.
+	progress  Progress
+	inputSize int64
+	// backing, if set, is the whole input, which readN slices instead of
+	// copying; see WithZeroCopy.
+	backing []byte
+	// contentLengths are the lengths the modules header lays out for the
+	// sources and source maps sections, set when parsing with
+	// StrictOffsets.
+	contentLengths [2]int
+}
+
+func newArchiveReader(r io.Reader, cfg parseConfig) *archiveReader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	ar := &archiveReader{br: br, remaining: cfg.inputSize, instr: cfg.instr, log: cfg.logger, showReserved: cfg.showReserved, origins: cfg.origins, recovery: cfg.recovery, faults: cfg.faults, concurrency: cfg.concurrency, keys: cfg.keys, policy: cfg.policy, progress: cfg.progress, inputSize: cfg.inputSize}
+	if cfg.zeroCopy {
+		ar.backing = cfg.backing
+	}
+	return ar
+}
+
+// warn logs a tolerated anomaly, if a logger was configured.
+func (r *archiveReader) warn(event string, attrs ...slog.Attr) {
+	if r.log != nil {
+		r.log.LogAttrs(context.Background(), slog.LevelWarn, "eszip: "+event, append(attrs, slog.String("event", event))...)
+	}
+}
+
+// timePhase logs how long a parse phase took, if a logger was configured.
+func (r *archiveReader) timePhase(phase string, start time.Time) {
+	if r.log != nil {
+		r.log.LogAttrs(context.Background(), slog.LevelDebug, "eszip: "+phase, slog.String("event", phase), slog.Duration("elapsed", time.Since(start)))
+	}
+}
 
-		read += section.TotalLen()
+// reportSection tells the instrumentation that the bytes from start up to
+// the current offset made up one section of the given kind.
+func (r *archiveReader) reportSection(kind string, start int64) {
+	if r.instr != nil {
+		r.instr.SectionRead(kind, int(r.offset-start))
+	}
+	r.reportProgress(kind)
+}
+
+// reportProgress tells the progress hook that the parse has read up to the
+// current offset, which is in the named section.
+func (r *archiveReader) reportProgress(name string) {
+	if r.progress.OnSectionRead != nil {
+		r.progress.OnSectionRead(name, r.offset, r.inputSize)
+	}
+}
+
+func (r *archiveReader) Read(p []byte) (int, error) {
+	n, err := r.br.Read(p)
+	r.offset += int64(n)
+	if r.remaining >= 0 {
+		r.remaining = max(r.remaining-int64(n), 0)
+	}
+	return n, err
+}
 
-		if slot := slotFor(entry.specifier); slot != nil {
-			slot.SetReady(section.IntoContent())
+// peek returns up to the next n bytes without consuming them. A short
+// result is not an error; only failures other than reaching EOF are.
+func (r *archiveReader) peek(n int) ([]byte, error) {
+	b, err := r.br.Peek(n)
+	if err == io.EOF || err == bufio.ErrBufferFull {
+		err = nil
+	}
+	return b, err
+}
+
+// discard consumes n bytes previously returned by peek.
+func (r *archiveReader) discard(n int) {
+	n, _ = r.br.Discard(n)
+	r.offset += int64(n)
+	if r.remaining >= 0 {
+		r.remaining = max(r.remaining-int64(n), 0)
+	}
+}
+
+// checkSectionSize enforces ParseOptions.MaxSectionSize for a section of
+// length bytes whose length prefix was just read.
+func (r *archiveReader) checkSectionSize(length int64) error {
+	if limit := r.policy.MaxSectionSize; limit > 0 && length > limit {
+		return errSectionTooLarge(length, limit, int(r.offset-4))
+	}
+	return nil
+}
+
+// checksumValid reports whether section's checksum is valid, or true if
+// ParseOptions.SkipChecksumVerify is set.
+func (r *archiveReader) checksumValid(section *Section) bool {
+	return r.policy.SkipChecksumVerify || section.IsChecksumValid()
+}
+
+// sectionChunkSize caps each allocation made while reading a section from
+// an input of unknown size.
+const sectionChunkSize = 1 << 20
+
+// readN reads exactly n bytes. When the input size is unknown and n is
+// large, the buffer grows as data actually arrives rather than being
+// allocated up front, so a bogus length prefix on a short stream fails
+// with io.ErrUnexpectedEOF after allocating roughly what the stream held.
+// With a backing slice, the bytes are returned from it without copying,
+// capped so that appending to them cannot overwrite what follows.
+func (r *archiveReader) readN(n int) ([]byte, error) {
+	if r.backing != nil {
+		end := r.offset + int64(n)
+		if end > int64(len(r.backing)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		buf := r.backing[r.offset:end:end]
+		r.discard(n)
+		return buf, nil
+	}
+	if r.remaining >= 0 || n <= sectionChunkSize {
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
 		}
+		return buf, nil
 	}
 
+	var buf []byte
+	for len(buf) < n {
+		chunk := min(n-len(buf), sectionChunkSize)
+		buf = slices.Grow(buf, chunk)
+		got, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+got]
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+	return buf, nil
+}
+
+// ensureAvailable returns an error if the input is known to hold fewer than
+// n more bytes.
+func (r *archiveReader) ensureAvailable(n int64) error {
+	if r.remaining >= 0 && n > r.remaining {
+		return errInvalidV2SectionLength(n, r.remaining, int(r.offset))
+	}
 	return nil
 }
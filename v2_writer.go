@@ -3,51 +3,129 @@
 package eszip
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
 	"sort"
+	"time"
 )
 
-// IntoBytes serializes the eszip archive to bytes
-func (e *EszipV2) IntoBytes() ([]byte, error) {
-	checksum := e.options.Checksum
-	checksumSize := e.options.GetChecksumSize()
+// IntoBytes serializes the eszip archive to bytes. See WriteToContext. The
+// output buffer is sized for the whole archive before anything is written.
+func (e *EszipV2) IntoBytes(opts ...WriteOption) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := e.WriteToContext(context.Background(), &buf, opts...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
 
-	var result []byte
+// WriteTo writes the serialized archive to w, implementing io.WriterTo.
+func (e *EszipV2) WriteTo(w io.Writer) (int64, error) {
+	return e.WriteToContext(context.Background(), w)
+}
 
-	// Write magic (latest version)
-	magic := LatestVersion.ToMagic()
-	result = append(result, magic[:]...)
+// WriteToContext writes the serialized archive to w and returns the number
+// of bytes written. Unlike IntoBytes it never holds the whole output in
+// memory: only the modules header is built up front, and each source and
+// source map is written from the module that holds it. Sources still
+// streaming in are waited for on ctx, which is also checked between
+// entries while writing.
+//
+// The entry list, options, and npm snapshot are captured under the archive
+// lock before any bytes are written, so serialization may run concurrently
+// with AddModule and friends: entries added after the capture are cleanly
+// left out rather than producing a torn archive. Failures found before
+// writing, such as WithMaxArchiveSize or WithWriteAllowedOrigins
+// violations, leave w untouched.
+func (e *EszipV2) WriteToContext(ctx context.Context, w io.Writer, opts ...WriteOption) (int64, error) {
+	var cfg writeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.logger != nil {
+		defer func(start time.Time) {
+			cfg.logger.LogAttrs(ctx, slog.LevelDebug, "eszip: serialize", slog.String("event", "serialize"), slog.Duration("elapsed", time.Since(start)))
+		}(time.Now())
+	}
 
-	// Build options header
-	optionsHeaderContent := []byte{
-		0, byte(checksum), // Checksum type
-		1, checksumSize, // Checksum size
+	e.mu.RLock()
+	options := e.options
+	version := e.version
+	npmSnapshot := e.npmSnapshot
+	importMap := e.importMap
+	keyProvider := e.keys
+	trailing := e.trailing
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+	if cfg.deterministic {
+		keys, entries = deterministicOrder(leadingImportMap(importMap, keys, entries), keys, entries)
 	}
 
-	// Write options header length
-	optionsHeaderLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(optionsHeaderLenBytes, uint32(len(optionsHeaderContent)))
-	result = append(result, optionsHeaderLenBytes...)
+	if cfg.origins != nil {
+		if err := cfg.origins.check(keys); err != nil {
+			return 0, err
+		}
+	}
+	if err := checkVersion(version, options, npmSnapshot, entries); err != nil {
+		return 0, err
+	}
+	if cfg.checkRedirects {
+		if err := checkRedirects(keys, entries, npmSnapshot.roots()); err != nil {
+			return 0, err
+		}
+	}
+	if options.Encryption != EncryptionNone {
+		var err error
+		if options.aead, err = options.Encryption.newAEAD(ctx, keyProvider); err != nil {
+			return 0, err
+		}
+	}
+	// The estimate counts content as it is in memory; compressed and
+	// encrypted archives are checked against the limit as their content
+	// is laid out.
+	// Deduplicated archives are smaller than estimated, so they are only
+	// checked as they are laid out too.
+	if cfg.maxSize > 0 && options.Compression == CompressionNone && options.Encryption == EncryptionNone && !cfg.dedup {
+		if size := e.EstimatedSize(); size > cfg.maxSize {
+			return 0, e.errTooLarge(size, cfg.maxSize)
+		}
+	}
 
-	// Write options header content
-	result = append(result, optionsHeaderContent...)
+	checksum := options.Checksum
+	checksumSize := int(options.GetChecksumSize())
 
-	// Write options header hash
-	optionsHash := checksum.Hash(optionsHeaderContent)
-	result = append(result, optionsHash...)
+	// Magic and, from V2.2, the options header
+	magic := version.ToMagic()
+	prefixLen := len(magic)
+	var optionsHeader []byte
+	if version.SupportsOptions() {
+		optionsHeader = optionsHeaderContent(options)
+		prefixLen += hashedSectionLen(optionsHeader, checksumSize)
+	}
 
-	// Build modules header, sources, and source maps
-	var modulesHeader []byte
-	var sources []byte
-	var sourceMaps []byte
+	// Build the modules header, collecting the content it refers to. Its
+	// size is known from the entries, so it is allocated once.
+	headerSize := 0
+	for i, specifier := range keys {
+		n, _, _ := entrySize(specifier, entries[i], int64(checksumSize))
+		headerSize += int(n)
+	}
+	modulesHeader := make([]byte, 0, headerSize)
+	// Encrypted content is bound to its module, so it cannot be shared.
+	dedup := cfg.dedup && options.aead == nil
+	sources := newContentSection(len(keys), checksumSize, dedup)
+	sourceMaps := newContentSection(len(keys), checksumSize, dedup)
 
-	keys := e.modules.Keys()
-	for _, specifier := range keys {
-		mod, ok := e.modules.Get(specifier)
-		if !ok {
-			continue
-		}
+	reported := 0
+	for i, specifier := range keys {
+		mod := entries[i]
+		before := len(modulesHeader) + sources.size + sourceMaps.size
 
 		// Write specifier
 		appendString(&modulesHeader, specifier)
@@ -57,42 +135,41 @@ func (e *EszipV2) IntoBytes() ([]byte, error) {
 			// Write module entry
 			modulesHeader = append(modulesHeader, byte(HeaderFrameModule))
 
-			// Get source bytes
-			sourceBytes, err := m.Source.Get(context.Background())
+			sourceBytes, err := cfg.waitSlot(ctx, m.Source, specifier)
 			if err != nil {
-				return nil, err
+				return 0, err
 			}
-			sourceLen := uint32(len(sourceBytes))
-
-			if sourceLen > 0 {
-				sourceOffset := uint32(len(sources))
-				sources = append(sources, sourceBytes...)
-				sources = append(sources, checksum.Hash(sourceBytes)...)
-
-				modulesHeader = appendU32BE(modulesHeader, sourceOffset)
-				modulesHeader = appendU32BE(modulesHeader, sourceLen)
+			if cfg.logger != nil && m.Source.State() == SourceSlotTaken {
+				cfg.logger.LogAttrs(ctx, slog.LevelWarn, "eszip: source_taken", slog.String("event", "source_taken"), slog.String("specifier", specifier))
+			}
+			if header, ok := sources.reuse(modulesHeader, specifier, sourceBytes); ok {
+				modulesHeader = header
 			} else {
-				modulesHeader = appendU32BE(modulesHeader, 0)
-				modulesHeader = appendU32BE(modulesHeader, 0)
+				raw := sourceBytes
+				if sourceBytes, err = options.Compression.compress(sourceBytes); err != nil {
+					return 0, fmt.Errorf("eszip: compressing source of %s: %w", specifier, err)
+				}
+				if sourceBytes, err = options.encrypt(sourceBytes, specifier, false); err != nil {
+					return 0, fmt.Errorf("eszip: encrypting source of %s: %w", specifier, err)
+				}
+				modulesHeader = sources.add(modulesHeader, specifier, raw, sourceBytes)
 			}
 
-			// Get source map bytes
-			sourceMapBytes, err := m.SourceMap.Get(context.Background())
+			sourceMapBytes, err := cfg.waitSlot(ctx, m.SourceMap, specifier)
 			if err != nil {
-				return nil, err
+				return 0, err
 			}
-			sourceMapLen := uint32(len(sourceMapBytes))
-
-			if sourceMapLen > 0 {
-				sourceMapOffset := uint32(len(sourceMaps))
-				sourceMaps = append(sourceMaps, sourceMapBytes...)
-				sourceMaps = append(sourceMaps, checksum.Hash(sourceMapBytes)...)
-
-				modulesHeader = appendU32BE(modulesHeader, sourceMapOffset)
-				modulesHeader = appendU32BE(modulesHeader, sourceMapLen)
+			if header, ok := sourceMaps.reuse(modulesHeader, specifier, sourceMapBytes); ok {
+				modulesHeader = header
 			} else {
-				modulesHeader = appendU32BE(modulesHeader, 0)
-				modulesHeader = appendU32BE(modulesHeader, 0)
+				raw := sourceMapBytes
+				if sourceMapBytes, err = options.Compression.compress(sourceMapBytes); err != nil {
+					return 0, fmt.Errorf("eszip: compressing source map of %s: %w", specifier, err)
+				}
+				if sourceMapBytes, err = options.encrypt(sourceMapBytes, specifier, true); err != nil {
+					return 0, fmt.Errorf("eszip: encrypting source map of %s: %w", specifier, err)
+				}
+				modulesHeader = sourceMaps.add(modulesHeader, specifier, raw, sourceMapBytes)
 			}
 
 			// Write module kind
@@ -108,106 +185,451 @@ func (e *EszipV2) IntoBytes() ([]byte, error) {
 			modulesHeader = append(modulesHeader, byte(HeaderFrameNpmSpecifier))
 			modulesHeader = appendU32BE(modulesHeader, m.PackageID)
 		}
+
+		if cfg.instr != nil {
+			n := len(modulesHeader) + sources.size + sourceMaps.size - before
+			cfg.instr.WriteProgress(n)
+			reported += n
+		}
+		if cfg.maxSize > 0 {
+			if size := int64(prefixLen + len(modulesHeader) + sources.size + sourceMaps.size); size > cfg.maxSize {
+				return 0, e.errTooLarge(size, cfg.maxSize)
+			}
+		}
 	}
 
 	// Add npm snapshot entries if present
-	var npmBytes []byte
-	if e.npmSnapshot != nil {
-		// Sort packages by ID for determinism
-		packages := make([]*NpmPackage, len(e.npmSnapshot.Packages))
-		copy(packages, e.npmSnapshot.Packages)
-		sort.Slice(packages, func(i, j int) bool {
-			return packages[i].ID.String() < packages[j].ID.String()
-		})
+	modulesHeader, npmBytes := appendNpmSnapshot(modulesHeader, npmSnapshot)
+
+	var moduleHeaders, moduleAux, npmIntegrity []byte
+	if version.SupportsHeaders() {
+		moduleHeaders = appendModuleHeaders(nil, keys, entries)
+	}
+	if version.SupportsAux() {
+		moduleAux = appendModuleAux(nil, keys, entries)
+	}
+	if version.SupportsNpmIntegrity() {
+		npmIntegrity = appendNpmIntegrity(nil, npmSnapshot)
+	}
+	headerLen := prefixLen + hashedSectionLen(modulesHeader, checksumSize)
+	if version.SupportsNpm() {
+		headerLen += hashedSectionLen(npmBytes, checksumSize)
+	}
+	if version.SupportsHeaders() {
+		headerLen += hashedSectionLen(moduleHeaders, checksumSize)
+	}
+	if version.SupportsAux() {
+		headerLen += hashedSectionLen(moduleAux, checksumSize)
+	}
+	if version.SupportsNpmIntegrity() {
+		headerLen += hashedSectionLen(npmIntegrity, checksumSize)
+	}
+	header := append(make([]byte, 0, headerLen), magic[:]...)
+	if version.SupportsOptions() {
+		header = appendHashedSection(header, optionsHeader, checksum, checksumSize)
+	}
+	header = appendHashedSection(header, modulesHeader, checksum, checksumSize)
+	if version.SupportsNpm() {
+		header = appendHashedSection(header, npmBytes, checksum, checksumSize)
+	}
+	if version.SupportsHeaders() {
+		header = appendHashedSection(header, moduleHeaders, checksum, checksumSize)
+	}
+	if version.SupportsAux() {
+		header = appendHashedSection(header, moduleAux, checksum, checksumSize)
+	}
+	if version.SupportsNpmIntegrity() {
+		header = appendHashedSection(header, npmIntegrity, checksum, checksumSize)
+	}
+	total := int64(len(header)) + sources.sectionLen() + sourceMaps.sectionLen() + int64(len(trailing))
+	if cfg.maxSize > 0 && total > cfg.maxSize {
+		return 0, e.errTooLarge(total, cfg.maxSize)
+	}
+	if cfg.report != nil {
+		*cfg.report = WriteReport{
+			Size:             total,
+			Modules:          len(keys),
+			SharedSources:    sources.shared,
+			SharedSourceMaps: sourceMaps.shared,
+			SavedBytes:       sources.saved + sourceMaps.saved,
+		}
+		for i, specifier := range keys {
+			if m, ok := entries[i].(*ModuleData); ok && m.minified {
+				if cfg.report.OriginalSizes == nil {
+					cfg.report.OriginalSizes = make(map[string]int64)
+				}
+				cfg.report.OriginalSizes[specifier] = m.originalSize
+			}
+		}
+	}
+
+	// Report the framing, hashes, and npm data not covered per module
+	if cfg.instr != nil {
+		cfg.instr.WriteProgress(int(total) - reported)
+	}
+
+	// An entry is complete once its last content has been written, or with
+	// the header if it has none. Complete entries are reported just before
+	// the next content is written, or at the end, so that the framing
+	// between them is counted and the last report is of the whole archive.
+	remaining := make(map[string]int)
+	var pending []string
+	complete := func(specifier string) {
+		if remaining[specifier]--; remaining[specifier] <= 0 {
+			pending = append(pending, specifier)
+		}
+	}
+	flush := func(written int64) {
+		for _, specifier := range pending {
+			cfg.progress.OnModuleWritten(specifier, written, total)
+		}
+		pending = pending[:0]
+	}
+	reporting := cfg.progress.OnModuleWritten != nil
+	if reporting {
+		for _, section := range []*contentSection{&sources, &sourceMaps} {
+			for _, owners := range section.owners {
+				for _, owner := range owners {
+					remaining[owner]++
+				}
+			}
+		}
+		for _, specifier := range keys {
+			if remaining[specifier] == 0 {
+				pending = append(pending, specifier)
+			}
+		}
+	}
+
+	// Buffers are grown to the whole archive up front rather than as each
+	// entry is written.
+	if buf, ok := w.(*bytes.Buffer); ok {
+		buf.Grow(int(total))
+	}
+	n, err := w.Write(header)
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for _, section := range []*contentSection{&sources, &sourceMaps} {
+		var onEntry func(i int, n int64)
+		if reporting {
+			base := written
+			onEntry = func(i int, n int64) {
+				if i > 0 {
+					for _, owner := range section.owners[i-1] {
+						complete(owner)
+					}
+				}
+				flush(base + n)
+			}
+		}
+		n, err := section.writeTo(ctx, w, checksum, onEntry)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if reporting && len(section.owners) > 0 {
+			for _, owner := range section.owners[len(section.owners)-1] {
+				complete(owner)
+			}
+		}
+	}
+	if len(trailing) > 0 {
+		n, err := w.Write(trailing)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	if reporting {
+		flush(written)
+	}
+	return written, nil
+}
+
+// contentSection collects the entries of the sources or source maps
+// section while the modules header is built, so they can be written
+// afterwards without being copied.
+type contentSection struct {
+	entries      [][]byte
+	offsets      []int      // the offset of each entry in the section
+	owners       [][]string // the specifiers each entry belongs to
+	size         int        // bytes of entries and their hashes
+	checksumSize int
+	hash         []byte // scratch space for the checksum of each entry
+	// dedup, if set, maps the digest of content as given to add, before
+	// compression and encryption, to the entry holding it; see
+	// WithDeduplication. shared counts the modules that reused an entry
+	// and saved the bytes they would otherwise have taken.
+	dedup  map[[sha256.Size]byte]int
+	shared int
+	saved  int64
+}
+
+// newContentSection returns a section with room for n entries.
+func newContentSection(n, checksumSize int, dedup bool) contentSection {
+	s := contentSection{
+		entries:      make([][]byte, 0, n),
+		offsets:      make([]int, 0, n),
+		owners:       make([][]string, 0, n),
+		checksumSize: checksumSize,
+	}
+	if dedup {
+		s.dedup = make(map[[sha256.Size]byte]int)
+	}
+	return s
+}
+
+// add records content, which encodes raw, and appends its offset and
+// length to the modules header. Empty content is not stored and is
+// referenced as offset 0, length 0.
+func (s *contentSection) add(modulesHeader []byte, specifier string, raw, content []byte) []byte {
+	if len(content) == 0 {
+		return appendU32BE(appendU32BE(modulesHeader, 0), 0)
+	}
+	if s.dedup != nil {
+		s.dedup[sha256.Sum256(raw)] = len(s.entries)
+	}
+	modulesHeader = appendU32BE(modulesHeader, uint32(s.size))
+	modulesHeader = appendU32BE(modulesHeader, uint32(len(content)))
+	s.entries = append(s.entries, content)
+	s.offsets = append(s.offsets, s.size)
+	s.owners = append(s.owners, []string{specifier})
+	s.size += len(content) + s.checksumSize
+	return modulesHeader
+}
+
+// reuse appends the offset and length of the entry already holding raw to
+// the modules header, if deduplicating and there is one, and records
+// specifier as one of its owners.
+func (s *contentSection) reuse(modulesHeader []byte, specifier string, raw []byte) ([]byte, bool) {
+	if s.dedup == nil || len(raw) == 0 {
+		return modulesHeader, false
+	}
+	i, ok := s.dedup[sha256.Sum256(raw)]
+	if !ok {
+		return modulesHeader, false
+	}
+	s.owners[i] = append(s.owners[i], specifier)
+	s.shared++
+	s.saved += int64(len(s.entries[i]) + s.checksumSize)
+	modulesHeader = appendU32BE(modulesHeader, uint32(s.offsets[i]))
+	return appendU32BE(modulesHeader, uint32(len(s.entries[i]))), true
+}
 
-		// Build ID to index map
-		idToIndex := make(map[string]uint32)
-		for i, pkg := range packages {
-			idToIndex[pkg.ID.String()] = uint32(i)
+// sectionLen returns the section's serialized length, including its length
+// prefix.
+func (s *contentSection) sectionLen() int64 {
+	return 4 + int64(s.size)
+}
+
+// writeTo writes the section: a 4-byte big-endian length, then each entry
+// followed by its checksum, truncated to checksumSize. If onEntry is not nil, it is called before each
+// entry i with the bytes of the section written so far.
+func (s *contentSection) writeTo(ctx context.Context, w io.Writer, checksum ChecksumType, onEntry func(i int, written int64)) (int64, error) {
+	n, err := w.Write(appendU32BE(nil, uint32(s.size)))
+	written := int64(n)
+	if err != nil {
+		return written, err
+	}
+	for i, content := range s.entries {
+		if err := ctx.Err(); err != nil {
+			return written, err
 		}
+		if onEntry != nil {
+			onEntry(i, written)
+		}
+		n, err := w.Write(content)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+		s.hash = checksum.appendHash(s.hash[:0], content, s.checksumSize)
+		n, err = w.Write(s.hash)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
 
-		// Write root packages to modules header
-		rootPkgs := make([]struct {
+// appendNpmSnapshot appends the npm specifier entries of snapshot to
+// modulesHeader and returns it with the content of the npm section.
+// Packages and requirements are sorted so the encoding is deterministic.
+func appendNpmSnapshot(modulesHeader []byte, npmSnapshot *NpmResolutionSnapshot) ([]byte, []byte) {
+	if npmSnapshot == nil {
+		return modulesHeader, nil
+	}
+	var npmBytes []byte
+	// Sort packages by ID for determinism
+	packages := make([]*NpmPackage, len(npmSnapshot.Packages))
+	copy(packages, npmSnapshot.Packages)
+	sort.Slice(packages, func(i, j int) bool {
+		return packages[i].ID.String() < packages[j].ID.String()
+	})
+
+	// Build ID to index map
+	idToIndex := make(map[string]uint32)
+	for i, pkg := range packages {
+		idToIndex[pkg.ID.String()] = uint32(i)
+	}
+
+	// Write root packages to modules header
+	rootPkgs := make([]struct {
+		req string
+		id  string
+	}, 0, len(npmSnapshot.RootPackages))
+	for req, id := range npmSnapshot.RootPackages {
+		rootPkgs = append(rootPkgs, struct {
 			req string
 			id  string
-		}, 0, len(e.npmSnapshot.RootPackages))
-		for req, id := range e.npmSnapshot.RootPackages {
-			rootPkgs = append(rootPkgs, struct {
+		}{req: req, id: id.String()})
+	}
+	sort.Slice(rootPkgs, func(i, j int) bool {
+		return rootPkgs[i].req < rootPkgs[j].req
+	})
+
+	for _, rp := range rootPkgs {
+		appendString(&modulesHeader, rp.req)
+		modulesHeader = append(modulesHeader, byte(HeaderFrameNpmSpecifier))
+		modulesHeader = appendU32BE(modulesHeader, idToIndex[rp.id])
+	}
+
+	// Write packages to npm bytes
+	for _, pkg := range packages {
+		appendString(&npmBytes, pkg.ID.String())
+
+		// Write dependencies count
+		npmBytes = appendU32BE(npmBytes, uint32(len(pkg.Dependencies)))
+
+		// Sort dependencies for determinism
+		deps := make([]struct {
+			req string
+			id  string
+		}, 0, len(pkg.Dependencies))
+		for req, id := range pkg.Dependencies {
+			deps = append(deps, struct {
 				req string
 				id  string
 			}{req: req, id: id.String()})
 		}
-		sort.Slice(rootPkgs, func(i, j int) bool {
-			return rootPkgs[i].req < rootPkgs[j].req
+		sort.Slice(deps, func(i, j int) bool {
+			return deps[i].req < deps[j].req
 		})
 
-		for _, rp := range rootPkgs {
-			appendString(&modulesHeader, rp.req)
-			modulesHeader = append(modulesHeader, byte(HeaderFrameNpmSpecifier))
-			modulesHeader = appendU32BE(modulesHeader, idToIndex[rp.id])
+		for _, dep := range deps {
+			appendString(&npmBytes, dep.req)
+			npmBytes = appendU32BE(npmBytes, idToIndex[dep.id])
 		}
+	}
 
-		// Write packages to npm bytes
-		for _, pkg := range packages {
-			appendString(&npmBytes, pkg.ID.String())
-
-			// Write dependencies count
-			npmBytes = appendU32BE(npmBytes, uint32(len(pkg.Dependencies)))
+	return modulesHeader, npmBytes
+}
 
-			// Sort dependencies for determinism
-			deps := make([]struct {
-				req string
-				id  string
-			}, 0, len(pkg.Dependencies))
-			for req, id := range pkg.Dependencies {
-				deps = append(deps, struct {
-					req string
-					id  string
-				}{req: req, id: id.String()})
-			}
-			sort.Slice(deps, func(i, j int) bool {
-				return deps[i].req < deps[j].req
-			})
+// WriteOption configures serialization.
+type WriteOption func(*writeConfig)
+
+type writeConfig struct {
+	instr          Instrumentation
+	logger         *slog.Logger
+	origins        *originPolicy
+	maxSize        int64
+	slotWait       time.Duration
+	deterministic  bool
+	progress       Progress
+	dedup          bool
+	report         *WriteReport
+	checkRedirects bool
+}
 
-			for _, dep := range deps {
-				appendString(&npmBytes, dep.req)
-				npmBytes = appendU32BE(npmBytes, idToIndex[dep.id])
-			}
-		}
+// WithWriteInstrumentation reports serialization progress to instr. See
+// Instrumentation.
+func WithWriteInstrumentation(instr Instrumentation) WriteOption {
+	return func(c *writeConfig) {
+		c.instr = instr
 	}
+}
 
-	// Write modules header length
-	modulesHeaderLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(modulesHeaderLenBytes, uint32(len(modulesHeader)))
-	result = append(result, modulesHeaderLenBytes...)
+// WithWriteProgress reports each entry to p.OnModuleWritten once it has been
+// written. See Progress.
+func WithWriteProgress(p Progress) WriteOption {
+	return func(c *writeConfig) {
+		c.progress = p
+	}
+}
 
-	// Write modules header content
-	result = append(result, modulesHeader...)
+// WithDeduplication stores content that several modules carry byte for
+// byte, such as vendored copies of one library, once, with every such
+// module referring to it. Sources and source maps are compared before
+// compression and encryption. Encrypted content is never shared, since it
+// is bound to its module. Archives written this way are smaller but
+// are only read correctly by parsers that allow modules to share content,
+// as this package's do; Deno's do not, so leave it off for archives Deno
+// loads.
+func WithDeduplication() WriteOption {
+	return func(c *writeConfig) {
+		c.dedup = true
+	}
+}
 
-	// Write modules header hash
-	modulesHash := checksum.Hash(modulesHeader)
-	result = append(result, modulesHash...)
+// WriteReport describes an archive IntoBytes and friends produced. See
+// WithWriteReport.
+type WriteReport struct {
+	// Size is the length of the archive in bytes.
+	Size int64
+	// Modules counts the entries written, including redirects.
+	Modules int
+	// SharedSources and SharedSourceMaps count the modules whose source or
+	// source map was stored by an earlier module; see WithDeduplication.
+	SharedSources    int
+	SharedSourceMaps int
+	// SavedBytes is the number of bytes sharing content saved, including
+	// the checksums not written.
+	SavedBytes int64
+	// OriginalSizes maps the specifier of each module written whose
+	// source MinifySources minified to the length of its source before.
+	OriginalSizes map[string]int64
+}
 
-	// Write npm section
-	npmLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(npmLenBytes, uint32(len(npmBytes)))
-	result = append(result, npmLenBytes...)
-	result = append(result, npmBytes...)
-	result = append(result, checksum.Hash(npmBytes)...)
+// WithWriteReport fills in report once the archive has been laid out,
+// before its content is written.
+func WithWriteReport(report *WriteReport) WriteOption {
+	return func(c *writeConfig) {
+		c.report = report
+	}
+}
 
-	// Write sources section
-	sourcesLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(sourcesLenBytes, uint32(len(sources)))
-	result = append(result, sourcesLenBytes...)
-	result = append(result, sources...)
+// optionsHeaderContent encodes the V2.2+ options header. The compression
+// and encryption options are only written when set.
+func optionsHeaderContent(options Options) []byte {
+	content := []byte{
+		0, byte(options.Checksum), // Checksum type
+		1, options.GetChecksumSize(), // Checksum size
+	}
+	if options.Compression != CompressionNone {
+		content = append(content, optionCompression, byte(options.Compression))
+	}
+	if options.Encryption != EncryptionNone {
+		content = append(content, optionEncryption, byte(options.Encryption))
+	}
+	return append(content, options.unknown...)
+}
 
-	// Write source maps section
-	sourceMapsLenBytes := make([]byte, 4)
-	binary.BigEndian.PutUint32(sourceMapsLenBytes, uint32(len(sourceMaps)))
-	result = append(result, sourceMapsLenBytes...)
-	result = append(result, sourceMaps...)
+// hashedSectionLen returns the length of content framed as a section by
+// appendHashedSection.
+func hashedSectionLen(content []byte, checksumSize int) int {
+	return 4 + len(content) + checksumSize
+}
 
-	return result, nil
+// appendHashedSection appends content framed as a section: a 4-byte
+// big-endian length, the content, and the first checksumSize bytes of its
+// checksum.
+func appendHashedSection(buf, content []byte, checksum ChecksumType, checksumSize int) []byte {
+	buf = appendU32BE(buf, uint32(len(content)))
+	buf = append(buf, content...)
+	return checksum.appendHash(buf, content, checksumSize)
 }
 
 func appendString(buf *[]byte, s string) {
@@ -218,3 +640,112 @@ func appendString(buf *[]byte, s string) {
 func appendU32BE(buf []byte, v uint32) []byte {
 	return binary.BigEndian.AppendUint32(buf, v)
 }
+
+// WithWriteLogger reports anomalies tolerated during serialization, such as
+// modules whose source was already taken and is written as empty, as Warn
+// records, and the serialization time as a Debug record.
+func WithWriteLogger(logger *slog.Logger) WriteOption {
+	return func(c *writeConfig) {
+		c.logger = logger
+	}
+}
+
+// WithWriteAllowedOrigins makes IntoBytes fail with an *OriginPolicyError,
+// writing nothing, if the archive names http or https specifiers from hosts
+// not in allowed. Entries are matched as by WithAllowedOrigins.
+func WithWriteAllowedOrigins(allowed ...string) WriteOption {
+	return func(c *writeConfig) {
+		c.origins = newOriginPolicy(allowed)
+	}
+}
+
+// WithMaxArchiveSize makes IntoBytes fail with a *WriteError instead of
+// producing an archive larger than n bytes. EstimatedSize is checked before
+// any serialization work, and the bytes produced are checked as each module
+// is written, so sources that turn out larger than declared are caught too.
+func WithMaxArchiveSize(n int64) WriteOption {
+	return func(c *writeConfig) {
+		c.maxSize = n
+	}
+}
+
+// WithSlotWaitTimeout bounds how long IntoBytes waits for each source or
+// source map still streaming in. If one is not loaded within d, IntoBytes
+// fails with a *WriteError naming its specifier instead of blocking, which
+// it otherwise does for as long as the parse that should fill the slot
+// takes, forever if that parse was abandoned. PendingSources lists the
+// slots that would be waited for.
+func WithSlotWaitTimeout(d time.Duration) WriteOption {
+	return func(c *writeConfig) {
+		c.slotWait = d
+	}
+}
+
+// waitSlot returns the content of slot, waiting at most c.slotWait if that
+// is set.
+func (c *writeConfig) waitSlot(ctx context.Context, slot *SourceSlot, specifier string) ([]byte, error) {
+	if c.slotWait <= 0 {
+		return slot.Get(ctx)
+	}
+	start := time.Now()
+	waitCtx, cancel := context.WithTimeout(ctx, c.slotWait)
+	defer cancel()
+	data, err := slot.Get(waitCtx)
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return nil, &WriteError{Pending: specifier, Waited: time.Since(start)}
+	}
+	return data, err
+}
+
+// WithDeterministicWrite writes entries in a canonical order instead of
+// insertion order, so archives with the same entries, options and npm
+// snapshot serialize to identical bytes however they were built: the
+// import map first, then the archive metadata and entrypoints, modules
+// sorted by specifier, redirects sorted by specifier and npm specifier
+// entries sorted by specifier. This is the order Normalize produces. The
+// archive itself is not reordered. The npm snapshot is always written
+// sorted.
+//
+// The import map is recognised as Summary does, so for parsed archives a
+// JSON (rather than JSONC) import map is sorted with the other modules.
+func WithDeterministicWrite() WriteOption {
+	return func(c *writeConfig) {
+		c.deterministic = true
+	}
+}
+
+// deterministicOrder returns keys and entries in the order described by
+// WithDeterministicWrite.
+func deterministicOrder(importMap string, keys []string, entries []EszipV2Module) ([]string, []EszipV2Module) {
+	rank := func(i int) int {
+		switch entries[i].(type) {
+		case *ModuleData:
+			switch keys[i] {
+			case importMap:
+				return 0
+			case ArchiveMetadataSpecifier, EntrypointsSpecifier:
+				return 1
+			}
+			return 2
+		case *ModuleRedirect:
+			return 3
+		}
+		return 4
+	}
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		if ra, rb := rank(order[a]), rank(order[b]); ra != rb {
+			return ra < rb
+		}
+		return keys[order[a]] < keys[order[b]]
+	})
+	sortedKeys := make([]string, len(keys))
+	sortedEntries := make([]EszipV2Module, len(entries))
+	for i, j := range order {
+		sortedKeys[i], sortedEntries[i] = keys[j], entries[j]
+	}
+	return sortedKeys, sortedEntries
+}
@@ -0,0 +1,132 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/JakeChampion/eszip/wasm"
+)
+
+// ModuleContentError is returned by AddModuleChecked and
+// ValidateModuleContent when content does not match its module kind.
+type ModuleContentError struct {
+	Specifier string
+	Kind      ModuleKind
+	// SourceMap is set when the source map, not the source, is invalid.
+	SourceMap bool
+	Reason    string
+}
+
+func (e *ModuleContentError) Error() string {
+	what := "source"
+	if e.SourceMap {
+		what = "source map"
+	}
+	return fmt.Sprintf("eszip: %s of %s module %s: %s", what, e.Kind, e.Specifier, e.Reason)
+}
+
+// AddModuleChecked adds a module like AddModule after checking that source
+// is valid for kind: UTF-8 for JavaScript, valid JSON for JSON, JSON with
+// comments and trailing commas allowed for JSONC, and a WebAssembly binary
+// with well-formed sections for Wasm, as checked by wasm.Parse. Opaque data
+// is not checked. A non-empty source map must be valid JSON. Invalid
+// content is not added and is reported as a *ModuleContentError.
+func (e *EszipV2) AddModuleChecked(specifier string, kind ModuleKind, source, sourceMap []byte) error {
+	if err := ValidateModuleContent(specifier, kind, source, sourceMap); err != nil {
+		return err
+	}
+	e.AddModule(specifier, kind, source, sourceMap)
+	return nil
+}
+
+// ValidateModuleContent checks content as AddModuleChecked does, without
+// adding it to an archive.
+func ValidateModuleContent(specifier string, kind ModuleKind, source, sourceMap []byte) error {
+	fail := func(reason string) error {
+		return &ModuleContentError{Specifier: specifier, Kind: kind, Reason: reason}
+	}
+	switch kind {
+	case ModuleKindJavaScript:
+		if !utf8.Valid(source) {
+			return fail("not valid UTF-8")
+		}
+	case ModuleKindJson:
+		if !json.Valid(source) {
+			return fail("not valid JSON")
+		}
+	case ModuleKindJsonc:
+		if !json.Valid(stripJSONC(source)) {
+			return fail("not valid JSONC")
+		}
+	case ModuleKindWasm:
+		if _, err := wasm.Parse(source); err != nil {
+			var ferr *wasm.FormatError
+			if errors.As(err, &ferr) {
+				return fail(fmt.Sprintf("%s at offset %d", ferr.Reason, ferr.Offset))
+			}
+			return fail(err.Error())
+		}
+	case ModuleKindOpaqueData:
+	default:
+		return fail("unknown module kind")
+	}
+	if len(sourceMap) > 0 && !json.Valid(sourceMap) {
+		return &ModuleContentError{Specifier: specifier, Kind: kind, SourceMap: true, Reason: "not valid JSON"}
+	}
+	return nil
+}
+
+// stripJSONC returns src with comments replaced by spaces and trailing
+// commas before a closing bracket removed, leaving plain JSON if src was
+// valid JSONC.
+func stripJSONC(src []byte) []byte {
+	out := make([]byte, 0, len(src))
+	// pendingComma is the index in out of a comma that is dropped if the
+	// next significant byte closes an object or array.
+	pendingComma := -1
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case c == '"':
+			start := i
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			out = append(out, src[start:min(i+1, len(src))]...)
+			pendingComma = -1
+		case c == '/' && i+1 < len(src) && src[i+1] == '/':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+			out = append(out, '\n')
+		case c == '/' && i+1 < len(src) && src[i+1] == '*':
+			end := bytes.Index(src[i+2:], []byte("*/"))
+			if end < 0 {
+				// Unterminated; keep it so the result is invalid.
+				return append(out, src[i:]...)
+			}
+			i += end + 3
+			out = append(out, ' ')
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			out = append(out, c)
+		case (c == '}' || c == ']') && pendingComma >= 0:
+			out[pendingComma] = ' '
+			out = append(out, c)
+			pendingComma = -1
+		case c == ',':
+			pendingComma = len(out)
+			out = append(out, c)
+		default:
+			out = append(out, c)
+			pendingComma = -1
+		}
+	}
+	return out
+}
@@ -0,0 +1,370 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// ProblemKind classifies a Problem found by Verify.
+type ProblemKind int
+
+const (
+	// ProblemHeader means the headers or a section length prefix could not
+	// be read. Only VerifyArchive reports it.
+	ProblemHeader ProblemKind = iota
+	// ProblemChecksum means content does not match its checksum.
+	ProblemChecksum
+	// ProblemContent means content could not be read or decompressed, or
+	// was never loaded.
+	ProblemContent
+	// ProblemOffsetRange means the header places content past the end of
+	// its section.
+	ProblemOffsetRange
+	// ProblemOffsetOverlap means the header places content over part of
+	// another module's content.
+	ProblemOffsetOverlap
+	// ProblemRedirectTarget means a redirect points at a specifier that is
+	// not in the archive.
+	ProblemRedirectTarget
+	// ProblemRedirectCycle means following redirects leads back to where
+	// it started.
+	ProblemRedirectCycle
+	// ProblemOrigin means a specifier comes from an origin outside the
+	// allowlist given to VerifyArchive with WithAllowedOrigins.
+	ProblemOrigin
+)
+
+func (k ProblemKind) String() string {
+	switch k {
+	case ProblemHeader:
+		return "header"
+	case ProblemChecksum:
+		return "checksum"
+	case ProblemContent:
+		return "content"
+	case ProblemOffsetRange:
+		return "offset_range"
+	case ProblemOffsetOverlap:
+		return "offset_overlap"
+	case ProblemRedirectTarget:
+		return "redirect_target"
+	case ProblemRedirectCycle:
+		return "redirect_cycle"
+	case ProblemOrigin:
+		return "origin"
+	default:
+		return "unknown"
+	}
+}
+
+// Problem is one defect found by Verify.
+type Problem struct {
+	Kind ProblemKind
+	// Specifier is the module or redirect concerned; it is empty for
+	// ProblemHeader.
+	Specifier string
+	// SourceMap is set if the problem is with the source map rather than
+	// the source.
+	SourceMap bool
+	// Detail describes the problem for humans.
+	Detail string
+}
+
+func (p Problem) String() string {
+	what := p.Specifier
+	if p.SourceMap {
+		what += " (source map)"
+	}
+	if what == "" {
+		return fmt.Sprintf("%s: %s", p.Kind, p.Detail)
+	}
+	return fmt.Sprintf("%s %s: %s", p.Kind, what, p.Detail)
+}
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	// Modules and Redirects count the entries checked.
+	Modules   int
+	Redirects int
+	// Bytes is the source and source map content read and verified.
+	Bytes int64
+	// Problems lists every defect found, in archive order within each
+	// kind of check.
+	Problems []Problem
+}
+
+// OK reports whether no problems were found.
+func (r *VerifyReport) OK() bool {
+	return len(r.Problems) == 0
+}
+
+func (r *VerifyReport) String() string {
+	if r.OK() {
+		return fmt.Sprintf("ok: %d modules, %d redirects, %d bytes verified", r.Modules, r.Redirects, r.Bytes)
+	}
+	lines := make([]string, len(r.Problems))
+	for i, p := range r.Problems {
+		lines[i] = p.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (r *VerifyReport) add(kind ProblemKind, specifier string, sourceMap bool, format string, args ...any) {
+	r.Problems = append(r.Problems, Problem{
+		Kind:      kind,
+		Specifier: specifier,
+		SourceMap: sourceMap,
+		Detail:    fmt.Sprintf(format, args...),
+	})
+}
+
+// Verify checks the whole archive at once instead of leaving defects to
+// fail the read that meets them: it reads every source and source map,
+// which verifies their checksums, checks that the offsets the header
+// recorded do not overlap, and checks that every redirect reaches a
+// module or npm specifier. Content already taken is skipped. Verify waits for sources
+// still streaming in, and returns an error only if ctx is done; defects
+// are listed in the report.
+//
+// Parsing already rejects headers whose own checksums fail and offsets
+// outside their section. Use VerifyArchive to check an archive file
+// without stopping at those.
+func (e *EszipV2) Verify(ctx context.Context) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	if err := e.verify(ctx, report, nil); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// VerifyArchive verifies the V2 archive of size bytes in r, as Verify
+// does, and also reports offsets past the end of their section. A header
+// that cannot be parsed, including one whose checksum fails, is reported
+// as a ProblemHeader; the content checks are then skipped. opts configure
+// the parse, such as WithDecryptionKey for encrypted archives; with
+// WithAllowedOrigins, each specifier from another origin is reported as a
+// ProblemOrigin. It returns an error only if ctx is done.
+func VerifyArchive(ctx context.Context, r io.ReaderAt, size int64, opts ...ParseOption) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	header := func(err error) (*VerifyReport, error) {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, ctxErr
+		}
+		report.add(ProblemHeader, "", false, "%v", err)
+		return report, nil
+	}
+
+	cfg := newParseConfig(append(slices.Clip(opts), WithInputSize(size)))
+	cfg.policy.SkipChecksumVerify = false
+	// Disallowed origins are reported as problems rather than failing the
+	// parse, so the content is still checked.
+	origins := cfg.origins
+	cfg.origins = nil
+	br := newArchiveReader(io.NewSectionReader(r, 0, size), cfg)
+	magic := make([]byte, 8)
+	if _, err := io.ReadFull(br, magic); err != nil {
+		return header(errIO(err))
+	}
+	version, ok := VersionFromMagic(magic)
+	if !ok {
+		return header(errInvalidV2())
+	}
+	e, _, err := parseV2WithVersion(ctx, version, br)
+	if err != nil {
+		return header(err)
+	}
+	if origins != nil {
+		var policyErr *OriginPolicyError
+		if errors.As(origins.check(e.modules.Keys()), &policyErr) {
+			for _, specifier := range policyErr.Specifiers {
+				report.add(ProblemOrigin, specifier, false, "origin is not allowed")
+			}
+		}
+	}
+
+	var sections [2]lazySection
+	sections[0], err = readLazySection(r, br.offset, size)
+	if err != nil {
+		return header(err)
+	}
+	sections[1], err = readLazySection(r, sections[0].start+sections[0].length, size)
+	if err != nil {
+		return header(err)
+	}
+
+	// Content inside its section is read from r when verified; the rest
+	// stays pending and is reported by verify.
+	checksumSize := int64(e.options.GetChecksumSize())
+	keys, entries := e.modules.snapshot()
+	for i, specifier := range keys {
+		data, ok := entries[i].(*ModuleData)
+		if !ok {
+			continue
+		}
+		for j, slot := range []*SourceSlot{data.Source, data.SourceMap} {
+			if slot.State() != SourceSlotPending || !sections[j].contains(slot, checksumSize) {
+				continue
+			}
+			slot.setLazy(&lazyContent{
+				r:         r,
+				offset:    sections[j].start + int64(slot.Offset()),
+				options:   e.options,
+				specifier: specifier,
+				sourceMap: j == 1,
+				maxSize:   cfg.policy.decompressLimit(),
+			})
+		}
+	}
+	if err := e.verify(ctx, report, &sections); err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+// contains reports whether the content of slot, with its checksum, lies
+// within s.
+func (s lazySection) contains(slot *SourceSlot, checksumSize int64) bool {
+	return int64(slot.Offset())+int64(slot.Length())+checksumSize <= s.length
+}
+
+// verify adds e's defects to report. sections, if known, bound the
+// recorded offsets.
+func (e *EszipV2) verify(ctx context.Context, report *VerifyReport, sections *[2]lazySection) error {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	checksumSize := int64(e.options.GetChecksumSize())
+	npmRoots := e.npmSnapshot.roots()
+	e.mu.RUnlock()
+
+	// extent is the recorded place of one source or source map.
+	type extent struct {
+		specifier string
+		start     int64
+		end       int64
+	}
+	var extents [2][]extent
+
+	for i, specifier := range keys {
+		switch entry := entries[i].(type) {
+		case *ModuleData:
+			report.Modules++
+			for j, slot := range []*SourceSlot{entry.Source, entry.SourceMap} {
+				sourceMap := j == 1
+				if offset := slot.recordedOffset(); offset >= 0 {
+					if sections != nil && !sections[j].contains(slot, checksumSize) {
+						report.add(ProblemOffsetRange, specifier, sourceMap,
+							"%d bytes at offset %d run past the end of the %d byte section",
+							int64(slot.Length())+checksumSize, offset, sections[j].length)
+						continue
+					}
+					extents[j] = append(extents[j], extent{specifier, offset, offset + int64(slot.Length()) + checksumSize})
+				}
+				if slot.State() == SourceSlotTaken {
+					continue
+				}
+				content, err := slot.Get(ctx)
+				if err != nil {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						return ctxErr
+					}
+					kind := ProblemContent
+					var pe *ParseError
+					if errors.As(err, &pe) && pe.Type == ErrInvalidV2SourceHash {
+						kind = ProblemChecksum
+					}
+					report.add(kind, specifier, sourceMap, "%v", err)
+					continue
+				}
+				report.Bytes += int64(len(content))
+			}
+		case *ModuleRedirect:
+			report.Redirects++
+		}
+	}
+
+	// Modules may share content, recorded at the same offset with the same
+	// length; anything else that starts before the previous content ends
+	// overlaps it.
+	for j, list := range extents {
+		sort.SliceStable(list, func(a, b int) bool { return list[a].start < list[b].start })
+		var last extent
+		for _, x := range list {
+			switch {
+			case last.specifier == "" || x.start >= last.end:
+				last = x
+			case x.start == last.start && x.end == last.end:
+			default:
+				report.add(ProblemOffsetOverlap, x.specifier, j == 1,
+					"bytes %d-%d overlap %s at %d-%d", x.start, x.end, last.specifier, last.start, last.end)
+				if x.end > last.end {
+					last = x
+				}
+			}
+		}
+	}
+
+	verifyRedirects(report, keys, entries, npmRoots)
+	return nil
+}
+
+// verifyRedirects reports redirects whose target is missing, and each
+// redirect cycle once, under the first of its members in archive order.
+// npmRoots are the root packages of the npm snapshot, which redirects may
+// lead to.
+func verifyRedirects(report *VerifyReport, keys []string, entries []EszipV2Module, npmRoots map[string]*NpmPackageID) {
+	targets := make(map[string]string)
+	present := make(map[string]bool, len(keys)+len(npmRoots))
+	for req := range npmRoots {
+		present[req] = true
+	}
+	for i, specifier := range keys {
+		present[specifier] = true
+		if redirect, ok := entries[i].(*ModuleRedirect); ok {
+			targets[specifier] = redirect.Target
+		}
+	}
+
+	inCycle := make(map[string]bool)
+	for _, specifier := range keys {
+		target, ok := targets[specifier]
+		if !ok {
+			continue
+		}
+		if !present[target] {
+			report.add(ProblemRedirectTarget, specifier, false, "target %q is not in the archive", target)
+			continue
+		}
+		if inCycle[specifier] {
+			continue
+		}
+		// Follow the chain; it ends at a module, or revisits a redirect.
+		seen := map[string]bool{specifier: true}
+		current := target
+		for {
+			next, ok := targets[current]
+			if !ok {
+				break
+			}
+			if seen[current] {
+				if current == specifier {
+					cycle := []string{specifier}
+					for s := target; s != specifier; s = targets[s] {
+						cycle = append(cycle, s)
+						inCycle[s] = true
+					}
+					report.add(ProblemRedirectCycle, specifier, false, "%s -> %s", strings.Join(cycle, " -> "), specifier)
+				}
+				break
+			}
+			seen[current] = true
+			current = next
+		}
+	}
+}
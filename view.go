@@ -0,0 +1,245 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package eszip
+
+import (
+	"context"
+	"errors"
+	"maps"
+)
+
+// ErrReadOnly is returned by the Take methods of modules obtained through
+// an EszipView.
+var ErrReadOnly = errors.New("eszip: archive view is read-only")
+
+// EszipView is a read-only view of a V2 archive, for handing to code that
+// must not change it. It has no mutating methods, its modules refuse
+// TakeSource and TakeSourceMap with ErrReadOnly, and NpmSnapshot returns a
+// copy. It is safe for any number of concurrent readers.
+//
+// The view snapshots the entry list when it is created, and Entries and
+// Manifest list that snapshot: modules added, replaced or removed
+// afterwards by the owner of the archive, including by TransformSources
+// and SetArchiveMetadata, do not show through. Module content is shared,
+// so sources still streaming in become visible as they load, and content
+// the owner takes with TakeSource is gone from the view too.
+type EszipView struct {
+	archive *EszipV2
+}
+
+// ReadOnly returns a read-only view of the archive as it is now.
+func (e *EszipV2) ReadOnly() *EszipView {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	frozen := &EszipV2{
+		modules:      NewModuleMap(),
+		npmSnapshot:  copyNpmSnapshot(e.npmSnapshot),
+		options:      e.options,
+		version:      e.version,
+		importMap:    e.importMap,
+		showReserved: e.showReserved,
+	}
+	e.mu.RUnlock()
+
+	for i, specifier := range keys {
+		frozen.modules.Insert(specifier, entries[i])
+	}
+	return &EszipView{archive: frozen}
+}
+
+// GetModule returns the module for the given specifier, following
+// redirects.
+func (v *EszipView) GetModule(specifier string) *Module {
+	return readOnlyModule(v.archive.GetModule(specifier))
+}
+
+// GetImportMap returns the import map module for the given specifier.
+func (v *EszipView) GetImportMap(specifier string) *Module {
+	return readOnlyModule(v.archive.GetImportMap(specifier))
+}
+
+// Specifiers returns all module specifiers, as EszipV2.Specifiers does.
+func (v *EszipView) Specifiers() []string {
+	return v.archive.Specifiers()
+}
+
+// Iterate returns all modules, as EszipV2.Iterate does.
+func (v *EszipView) Iterate() []struct {
+	Specifier string
+	Module    *Module
+} {
+	entries := v.archive.Iterate()
+	for i := range entries {
+		entries[i].Module = readOnlyModule(entries[i].Module)
+	}
+	return entries
+}
+
+// ViewEntry is one entry of the module map, as EszipView.Entries lists it.
+type ViewEntry struct {
+	Specifier string
+	// Module is the read-only module the entry resolves to, as GetModule
+	// returns it, or nil for npm specifiers and dangling redirects.
+	Module *Module
+	// Redirect is the target of a redirect entry, or "".
+	Redirect string
+	// Npm reports whether the entry is an npm specifier.
+	Npm bool
+}
+
+// Entries returns every entry of the module map in archive order: unlike
+// Iterate, redirects are listed as redirects, with the module they lead
+// to.
+func (v *EszipView) Entries() []ViewEntry {
+	keys, entries := v.archive.visibleEntries()
+	out := make([]ViewEntry, len(keys))
+	for i, specifier := range keys {
+		out[i].Specifier = specifier
+		switch entry := entries[i].(type) {
+		case *ModuleRedirect:
+			out[i].Redirect = entry.Target
+		case *NpmSpecifierEntry:
+			out[i].Npm = true
+			continue
+		}
+		out[i].Module = v.GetModule(specifier)
+	}
+	return out
+}
+
+// ManifestEntry describes one module map entry without its content. The
+// JSON field names are stable, as Summary's are.
+type ManifestEntry struct {
+	Specifier string `json:"specifier"`
+	// Kind is the module kind ("javascript", "json", ...), or "redirect"
+	// or "npm" for entries without content.
+	Kind string `json:"kind"`
+	// Target is the target of a redirect.
+	Target string `json:"target,omitempty"`
+	// SourceBytes and SourceMapBytes are the declared content lengths, as
+	// ModuleSizes reports them.
+	SourceBytes    int64 `json:"source_bytes,omitempty"`
+	SourceMapBytes int64 `json:"source_map_bytes,omitempty"`
+	// Headers is a copy of the module's headers.
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+// Manifest describes every entry of the module map in archive order. Like
+// Summary, it never waits for or loads module sources.
+func (v *EszipView) Manifest() []ManifestEntry {
+	keys, entries := v.archive.visibleEntries()
+	out := make([]ManifestEntry, len(keys))
+	for i, specifier := range keys {
+		out[i].Specifier = specifier
+		switch entry := entries[i].(type) {
+		case *ModuleData:
+			out[i].Kind = entry.Kind.String()
+			out[i].SourceBytes = entry.Source.declaredLen()
+			out[i].SourceMapBytes = entry.SourceMap.declaredLen()
+			out[i].Headers = maps.Clone(entry.Headers)
+		case *ModuleRedirect:
+			out[i].Kind = "redirect"
+			out[i].Target = entry.Target
+		case *NpmSpecifierEntry:
+			out[i].Kind = "npm"
+		}
+	}
+	return out
+}
+
+// visibleEntries returns the module map entries that Specifiers lists.
+func (e *EszipV2) visibleEntries() ([]string, []EszipV2Module) {
+	e.mu.RLock()
+	keys, entries := e.modules.snapshot()
+	e.mu.RUnlock()
+	if e.showReserved {
+		return keys, entries
+	}
+	n := 0
+	for i, specifier := range keys {
+		if !isReservedSpecifier(specifier) {
+			keys[n], entries[n] = specifier, entries[i]
+			n++
+		}
+	}
+	return keys[:n], entries[:n]
+}
+
+// NpmSnapshot returns a copy of the npm resolution snapshot, or nil.
+func (v *EszipView) NpmSnapshot() *NpmResolutionSnapshot {
+	return copyNpmSnapshot(v.archive.npmSnapshot)
+}
+
+// Summary describes the archive, as EszipV2.Summary does.
+func (v *EszipView) Summary() Summary {
+	return v.archive.Summary()
+}
+
+// ArchiveMetadata returns the archive metadata, as
+// EszipV2.ArchiveMetadata does.
+func (v *EszipView) ArchiveMetadata(ctx context.Context) (map[string]string, error) {
+	return v.archive.ArchiveMetadata(ctx)
+}
+
+// Entrypoints returns the recorded entrypoints, as EszipV2.Entrypoints
+// does.
+func (v *EszipView) Entrypoints(ctx context.Context) ([]string, error) {
+	return v.archive.Entrypoints(ctx)
+}
+
+func readOnlyModule(m *Module) *Module {
+	if m != nil {
+		m.inner = readOnlyModuleInner{m.inner}
+	}
+	return m
+}
+
+// readOnlyModuleInner passes reads through and refuses takes.
+type readOnlyModuleInner struct {
+	inner moduleInner
+}
+
+func (r readOnlyModuleInner) getSource(ctx context.Context, specifier string) ([]byte, error) {
+	return r.inner.getSource(ctx, specifier)
+}
+
+func (r readOnlyModuleInner) takeSource(context.Context, string) ([]byte, error) {
+	return nil, ErrReadOnly
+}
+
+func (r readOnlyModuleInner) getSourceMap(ctx context.Context, specifier string) ([]byte, error) {
+	return r.inner.getSourceMap(ctx, specifier)
+}
+
+func (r readOnlyModuleInner) takeSourceMap(context.Context, string) ([]byte, error) {
+	return nil, ErrReadOnly
+}
+
+// copyNpmSnapshot returns a deep copy of snapshot, or nil.
+func copyNpmSnapshot(snapshot *NpmResolutionSnapshot) *NpmResolutionSnapshot {
+	if snapshot == nil {
+		return nil
+	}
+	copyID := func(id *NpmPackageID) *NpmPackageID {
+		if id == nil {
+			return nil
+		}
+		c := *id
+		return &c
+	}
+	out := &NpmResolutionSnapshot{
+		Packages:     make([]*NpmPackage, len(snapshot.Packages)),
+		RootPackages: make(map[string]*NpmPackageID, len(snapshot.RootPackages)),
+	}
+	for i, pkg := range snapshot.Packages {
+		deps := make(map[string]*NpmPackageID, len(pkg.Dependencies))
+		for req, id := range pkg.Dependencies {
+			deps[req] = copyID(id)
+		}
+		out.Packages[i] = &NpmPackage{ID: copyID(pkg.ID), Dependencies: deps, Integrity: pkg.Integrity, Tarball: pkg.Tarball}
+	}
+	for req, id := range snapshot.RootPackages {
+		out.RootPackages[req] = copyID(id)
+	}
+	return out
+}
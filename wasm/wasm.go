@@ -0,0 +1,371 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+// Package wasm reads the structure of WebAssembly binary modules, as stored
+// in eszip archives as Wasm modules, without compiling them. Parse checks
+// the header and the framing of every section and decodes the imports,
+// exports and memories, which is enough to audit what a module needs from
+// and offers to its host. Function bodies and other section contents are
+// not validated.
+package wasm
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Magic starts every WebAssembly binary.
+const Magic = "\x00asm"
+
+// Version is the binary format version Parse accepts.
+const Version = 1
+
+// PageSize is the size in bytes of a WebAssembly memory page.
+const PageSize = 65536
+
+// ExternalKind is the kind of an imported or exported item.
+type ExternalKind uint8
+
+const (
+	KindFunction ExternalKind = 0
+	KindTable    ExternalKind = 1
+	KindMemory   ExternalKind = 2
+	KindGlobal   ExternalKind = 3
+	KindTag      ExternalKind = 4
+)
+
+func (k ExternalKind) String() string {
+	switch k {
+	case KindFunction:
+		return "function"
+	case KindTable:
+		return "table"
+	case KindMemory:
+		return "memory"
+	case KindGlobal:
+		return "global"
+	case KindTag:
+		return "tag"
+	default:
+		return "unknown"
+	}
+}
+
+// MarshalText encodes the kind as its name, so that JSON output reads
+// "function" rather than 0.
+func (k ExternalKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// Import is an item a module requires from its host.
+type Import struct {
+	Module string       `json:"module"`
+	Name   string       `json:"name"`
+	Kind   ExternalKind `json:"kind"`
+}
+
+// Export is an item a module offers to its host. Index is the item's index
+// in the module's space for its kind, where imported items come first.
+type Export struct {
+	Name  string       `json:"name"`
+	Kind  ExternalKind `json:"kind"`
+	Index uint32       `json:"index"`
+}
+
+// Memory describes a linear memory, in pages of PageSize bytes.
+type Memory struct {
+	Min uint64 `json:"min_pages"`
+	// Max is meaningful only if HasMax is set.
+	Max      uint64 `json:"max_pages,omitempty"`
+	HasMax   bool   `json:"has_max"`
+	Shared   bool   `json:"shared,omitempty"`
+	Memory64 bool   `json:"memory64,omitempty"`
+	Imported bool   `json:"imported,omitempty"`
+}
+
+// MinBytes returns the size the memory starts at.
+func (m Memory) MinBytes() uint64 {
+	return m.Min * PageSize
+}
+
+// Info describes a WebAssembly module.
+type Info struct {
+	Imports []Import `json:"imports"`
+	Exports []Export `json:"exports"`
+	// Memories lists imported memories, then defined ones, in index order.
+	Memories []Memory `json:"memories"`
+}
+
+// Exported returns the names of the exports of kind, in module order.
+func (i *Info) Exported(kind ExternalKind) []string {
+	var names []string
+	for _, e := range i.Exports {
+		if e.Kind == kind {
+			names = append(names, e.Name)
+		}
+	}
+	return names
+}
+
+// FormatError reports a module that is not a well-formed WebAssembly
+// binary.
+type FormatError struct {
+	// Offset is the byte offset in the module at which the problem was
+	// found.
+	Offset int
+	Reason string
+}
+
+func (e *FormatError) Error() string {
+	return fmt.Sprintf("wasm: at offset %d: %s", e.Offset, e.Reason)
+}
+
+// Section ids.
+const (
+	sectionCustom = 0
+	sectionImport = 2
+	sectionMemory = 5
+	sectionExport = 7
+	sectionLast   = 13 // tag
+)
+
+// Parse decodes the imports, exports and memories of a WebAssembly binary
+// module. It fails with a *FormatError if data lacks the magic number and
+// Version, or if a section is malformed or overruns the module.
+func Parse(data []byte) (*Info, error) {
+	r := &reader{data: data}
+	if !bytes.HasPrefix(data, []byte(Magic)) {
+		return nil, r.fail("missing the WebAssembly magic number")
+	}
+	if len(data) < 8 {
+		return nil, &FormatError{Offset: len(data), Reason: "missing the version"}
+	}
+	if v := uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24; v != Version {
+		return nil, &FormatError{Offset: 4, Reason: fmt.Sprintf("unsupported version %d", v)}
+	}
+	r.off = 8
+
+	info := &Info{Imports: []Import{}, Exports: []Export{}, Memories: []Memory{}}
+	var seen [sectionLast + 1]bool
+	for r.off < len(data) {
+		start := r.off
+		id := r.byte()
+		size := r.u32()
+		if r.err != nil {
+			return nil, r.err
+		}
+		if id > sectionLast {
+			return nil, &FormatError{Offset: start, Reason: fmt.Sprintf("unknown section id %d", id)}
+		}
+		if id != sectionCustom {
+			if seen[id] {
+				return nil, &FormatError{Offset: start, Reason: fmt.Sprintf("duplicate section id %d", id)}
+			}
+			seen[id] = true
+		}
+		if uint64(size) > uint64(len(data)-r.off) {
+			return nil, &FormatError{Offset: start, Reason: fmt.Sprintf("section id %d of %d bytes overruns the module", id, size)}
+		}
+		section := &reader{data: data[:r.off+int(size)], off: r.off}
+		switch id {
+		case sectionImport:
+			section.imports(info)
+		case sectionMemory:
+			section.memories(info)
+		case sectionExport:
+			section.exports(info)
+		default:
+			section.off = len(section.data)
+		}
+		if section.err != nil {
+			return nil, section.err
+		}
+		if section.off != len(section.data) {
+			return nil, &FormatError{Offset: section.off, Reason: fmt.Sprintf("section id %d has %d unread bytes", id, len(section.data)-section.off)}
+		}
+		r.off = len(section.data)
+	}
+	return info, nil
+}
+
+// reader decodes values from data, recording the first error and returning
+// zero values after it.
+type reader struct {
+	data []byte
+	off  int
+	err  error
+}
+
+func (r *reader) fail(reason string) error {
+	return r.failAt(r.off, reason)
+}
+
+// failAt records an error found in the value starting at off.
+func (r *reader) failAt(off int, reason string) error {
+	if r.err == nil {
+		r.err = &FormatError{Offset: off, Reason: reason}
+	}
+	return r.err
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil {
+		return 0
+	}
+	if r.off >= len(r.data) {
+		r.fail("unexpected end")
+		return 0
+	}
+	b := r.data[r.off]
+	r.off++
+	return b
+}
+
+// uleb reads an unsigned LEB128 value of at most bits bits.
+func (r *reader) uleb(bits uint) uint64 {
+	start := r.off
+	var v uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.byte()
+		if r.err != nil {
+			return 0
+		}
+		// The last byte may hold only the bits that remain, and no
+		// continuation bit.
+		if remaining := bits - shift; remaining < 7 && b >= 1<<remaining {
+			r.failAt(start, "integer too large")
+			return 0
+		}
+		v |= uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return v
+		}
+	}
+}
+
+func (r *reader) u32() uint32 {
+	return uint32(r.uleb(32))
+}
+
+// skipLEB skips a signed or unsigned LEB128 value of at most n bytes.
+func (r *reader) skipLEB(n int) {
+	for i := 0; i < n; i++ {
+		if r.byte()&0x80 == 0 || r.err != nil {
+			return
+		}
+	}
+	r.fail("integer too long")
+}
+
+func (r *reader) name() string {
+	start := r.off
+	n := r.u32()
+	if r.err != nil {
+		return ""
+	}
+	if uint64(n) > uint64(len(r.data)-r.off) {
+		r.failAt(start, "name overruns the section")
+		return ""
+	}
+	name := r.data[r.off : r.off+int(n)]
+	if !utf8.Valid(name) {
+		r.failAt(start, "name is not valid UTF-8")
+		return ""
+	}
+	r.off += int(n)
+	return string(name)
+}
+
+// valType skips a value or reference type, including the typed references
+// of the GC proposal, which carry a heap type.
+func (r *reader) valType() {
+	switch r.byte() {
+	case 0x63, 0x64: // (ref null ht), (ref ht)
+		r.skipLEB(5)
+	}
+}
+
+// limits reads the limits of a memory or table, whose bounds are 64-bit
+// if its flags say so.
+func (r *reader) limits() Memory {
+	start := r.off
+	flags := r.byte()
+	if flags > 0x07 {
+		r.failAt(start, fmt.Sprintf("invalid limits flags %#x", flags))
+		return Memory{}
+	}
+	m := Memory{HasMax: flags&0x01 != 0, Shared: flags&0x02 != 0, Memory64: flags&0x04 != 0}
+	bits := uint(32)
+	if m.Memory64 {
+		bits = 64
+	}
+	m.Min = r.uleb(bits)
+	if m.HasMax {
+		m.Max = r.uleb(bits)
+		if r.err == nil && m.Max < m.Min {
+			r.failAt(start, "maximum is below minimum")
+		}
+	}
+	return m
+}
+
+func (r *reader) count() int {
+	start := r.off
+	n := r.u32()
+	// Every entry takes at least one byte.
+	if r.err == nil && uint64(n) > uint64(len(r.data)-r.off) {
+		r.failAt(start, fmt.Sprintf("count %d overruns the section", n))
+		return 0
+	}
+	return int(n)
+}
+
+func (r *reader) imports(info *Info) {
+	n := r.count()
+	for i := 0; i < n && r.err == nil; i++ {
+		imp := Import{Module: r.name(), Name: r.name()}
+		kindAt := r.off
+		imp.Kind = ExternalKind(r.byte())
+		switch imp.Kind {
+		case KindFunction:
+			r.u32()
+		case KindTable:
+			r.valType()
+			r.limits()
+		case KindMemory:
+			m := r.limits()
+			m.Imported = true
+			info.Memories = append(info.Memories, m)
+		case KindGlobal:
+			r.valType()
+			r.byte()
+		case KindTag:
+			r.byte()
+			r.u32()
+		default:
+			r.failAt(kindAt, fmt.Sprintf("unknown import kind %d", imp.Kind))
+		}
+		info.Imports = append(info.Imports, imp)
+	}
+}
+
+func (r *reader) memories(info *Info) {
+	n := r.count()
+	for i := 0; i < n && r.err == nil; i++ {
+		info.Memories = append(info.Memories, r.limits())
+	}
+}
+
+func (r *reader) exports(info *Info) {
+	n := r.count()
+	for i := 0; i < n && r.err == nil; i++ {
+		exp := Export{Name: r.name()}
+		kindAt := r.off
+		exp.Kind = ExternalKind(r.byte())
+		if exp.Kind > KindTag {
+			r.failAt(kindAt, fmt.Sprintf("unknown export kind %d", exp.Kind))
+		}
+		exp.Index = r.u32()
+		info.Exports = append(info.Exports, exp)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package wasm
+
+import (
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+// module returns a WebAssembly binary with the given sections, each an id
+// followed by its content.
+func module(sections ...[]byte) []byte {
+	data := []byte(Magic + "\x01\x00\x00\x00")
+	for _, s := range sections {
+		data = append(data, s[0], byte(len(s)-1))
+		data = append(data, s[1:]...)
+	}
+	return data
+}
+
+func name(s string) []byte {
+	return append([]byte{byte(len(s))}, s...)
+}
+
+func concat(parts ...[]byte) []byte {
+	return slices.Concat(parts...)
+}
+
+func TestParse(t *testing.T) {
+	imports := concat([]byte{sectionImport, 4},
+		name("env"), name("log"), []byte{0x00, 0x00}, // function, type 0
+		name("env"), name("mem"), []byte{0x02, 0x03, 0x01, 0x80, 0x02}, // shared memory 1..256
+		name("env"), name("table"), []byte{0x01, 0x70, 0x00, 0x01}, // funcref table
+		name("env"), name("g"), []byte{0x03, 0x64, 0x70, 0x00}, // (ref func) global
+	)
+	memories := []byte{sectionMemory, 1, 0x04, 0x02} // memory64 of 2 pages
+	exports := concat([]byte{sectionExport, 3},
+		name("run"), []byte{0x00, 0x01},
+		name("memory"), []byte{0x02, 0x01},
+		name("count"), []byte{0x03, 0x00},
+	)
+	custom := concat([]byte{sectionCustom}, name("name"), []byte{1, 2, 3})
+	types := []byte{1, 1, 0x60, 0x00, 0x00} // type section: () -> ()
+
+	info, err := Parse(module(types, imports, memories, exports, custom))
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := &Info{
+		Imports: []Import{
+			{Module: "env", Name: "log", Kind: KindFunction},
+			{Module: "env", Name: "mem", Kind: KindMemory},
+			{Module: "env", Name: "table", Kind: KindTable},
+			{Module: "env", Name: "g", Kind: KindGlobal},
+		},
+		Exports: []Export{
+			{Name: "run", Kind: KindFunction, Index: 1},
+			{Name: "memory", Kind: KindMemory, Index: 1},
+			{Name: "count", Kind: KindGlobal, Index: 0},
+		},
+		Memories: []Memory{
+			{Min: 1, Max: 256, HasMax: true, Shared: true, Imported: true},
+			{Min: 2, Memory64: true},
+		},
+	}
+	if !reflect.DeepEqual(info, want) {
+		t.Errorf("Parse =\n%+v\nwant\n%+v", info, want)
+	}
+	if got := info.Exported(KindFunction); !slices.Equal(got, []string{"run"}) {
+		t.Errorf("Exported(KindFunction) = %v", got)
+	}
+	if got := info.Memories[1].MinBytes(); got != 2*PageSize {
+		t.Errorf("MinBytes = %d", got)
+	}
+
+	empty, err := Parse(module())
+	if err != nil || len(empty.Imports)+len(empty.Exports)+len(empty.Memories) != 0 {
+		t.Errorf("Parse of an empty module = %+v, %v", empty, err)
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		offset int
+	}{
+		{"html", []byte("<html>"), 0},
+		{"no_version", []byte(Magic), 4},
+		{"version_2", []byte(Magic + "\x02\x00\x00\x00"), 4},
+		{"section_overrun", append(module(), sectionExport, 5, 0), 8},
+		{"unknown_section", module([]byte{14}), 8},
+		{"duplicate_section", module([]byte{sectionMemory, 0}, []byte{sectionMemory, 0}), 11},
+		{"unread_bytes", module([]byte{sectionMemory, 0, 0xff}), 11},
+		{"count_overrun", module([]byte{sectionExport, 9}), 10},
+		{"bad_export_kind", module(concat([]byte{sectionExport, 1}, name("x"), []byte{9, 0})), 13},
+		{"max_below_min", module([]byte{sectionMemory, 1, 0x01, 0x02, 0x01}), 11},
+		{"u32_too_large", module([]byte{sectionMemory, 1, 0x00, 0xff, 0xff, 0xff, 0xff, 0x1f}), 12},
+		{"name_not_utf8", module(concat([]byte{sectionExport, 1, 1, 0xff, 0, 0})), 11},
+		{"truncated_import", module(concat([]byte{sectionImport, 1}, name("env"))), 15},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			info, err := Parse(tt.data)
+			var ferr *FormatError
+			if !errors.As(err, &ferr) {
+				t.Fatalf("Parse = %+v, %v, want a *FormatError", info, err)
+			}
+			if ferr.Offset != tt.offset {
+				t.Errorf("Offset = %d, want %d (%v)", ferr.Offset, tt.offset, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+// Package wasmapi exposes the eszip parser and writer to JavaScript when
+// compiled for GOOS=js GOARCH=wasm. Call Register from a main package and
+// keep the program alive:
+//
+//	func main() {
+//		wasmapi.Register(js.Global().Get("eszip"))
+//		select {}
+//	}
+//
+// Byte arrays cross the boundary as Uint8Array and are always copied, so
+// neither side holds on to the other's memory. Parsed archives live in Go
+// until released with free(handle).
+package wasmapi
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/JakeChampion/eszip"
+)
+
+// registry holds parsed archives by handle between calls from JavaScript.
+type registry struct {
+	mu       sync.Mutex
+	next     int
+	archives map[int]*eszip.EszipUnion
+}
+
+func newRegistry() *registry {
+	return &registry{next: 1, archives: make(map[int]*eszip.EszipUnion)}
+}
+
+// parse fully parses data and returns a handle to the archive.
+func (r *registry) parse(data []byte) (int, error) {
+	archive, err := eszip.ParseBytes(context.Background(), data)
+	if err != nil {
+		return 0, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	handle := r.next
+	r.next++
+	r.archives[handle] = archive
+	return handle, nil
+}
+
+func (r *registry) get(handle int) (*eszip.EszipUnion, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	archive, ok := r.archives[handle]
+	if !ok {
+		return nil, fmt.Errorf("unknown archive handle %d", handle)
+	}
+	return archive, nil
+}
+
+func (r *registry) free(handle int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.archives, handle)
+}
+
+func (r *registry) specifiers(handle int) ([]string, error) {
+	archive, err := r.get(handle)
+	if err != nil {
+		return nil, err
+	}
+	return archive.Specifiers(), nil
+}
+
+// module is what getModule returns to JavaScript.
+type module struct {
+	Kind      string
+	Source    []byte
+	SourceMap []byte
+}
+
+// getModule returns the module for specifier, following redirects, or nil
+// if there is none. Import maps are included.
+func (r *registry) getModule(handle int, specifier string) (*module, error) {
+	archive, err := r.get(handle)
+	if err != nil {
+		return nil, err
+	}
+	m := archive.GetImportMap(specifier)
+	if m == nil {
+		m = archive.GetModule(specifier)
+	}
+	if m == nil {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+	source, err := m.Source(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sourceMap, err := m.SourceMap(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &module{Kind: m.Kind.String(), Source: source, SourceMap: sourceMap}, nil
+}
+
+// entry is one module passed to createArchive.
+type entry struct {
+	Specifier string
+	Kind      string
+	Source    []byte
+	SourceMap []byte
+}
+
+// createArchive builds a V2 archive from entries, in order.
+func createArchive(entries []entry) ([]byte, error) {
+	archive := eszip.NewV2()
+	for _, e := range entries {
+		kind, err := parseKind(e.Kind)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", e.Specifier, err)
+		}
+		archive.AddModule(e.Specifier, kind, e.Source, e.SourceMap)
+	}
+	return archive.IntoBytes()
+}
+
+// parseKind is the inverse of ModuleKind.String. An empty kind means
+// JavaScript.
+func parseKind(name string) (eszip.ModuleKind, error) {
+	for _, kind := range []eszip.ModuleKind{
+		eszip.ModuleKindJavaScript,
+		eszip.ModuleKindJson,
+		eszip.ModuleKindJsonc,
+		eszip.ModuleKindOpaqueData,
+		eszip.ModuleKindWasm,
+	} {
+		if kind.String() == name {
+			return kind, nil
+		}
+	}
+	if name == "" {
+		return eszip.ModuleKindJavaScript, nil
+	}
+	return 0, fmt.Errorf("unknown module kind %q", name)
+}
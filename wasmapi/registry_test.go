@@ -0,0 +1,95 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+package wasmapi
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/JakeChampion/eszip"
+)
+
+func TestCreateParseGetModule(t *testing.T) {
+	data, err := createArchive([]entry{
+		{Specifier: "file:///main.js", Source: []byte("main"), SourceMap: []byte("{}")},
+		{Specifier: "file:///data.json", Kind: "json", Source: []byte("[]")},
+	})
+	if err != nil {
+		t.Fatalf("createArchive failed: %v", err)
+	}
+
+	r := newRegistry()
+	handle, err := r.parse(data)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+
+	specifiers, err := r.specifiers(handle)
+	if err != nil || !slices.Equal(specifiers, []string{"file:///main.js", "file:///data.json"}) {
+		t.Errorf("specifiers = %v, %v", specifiers, err)
+	}
+
+	m, err := r.getModule(handle, "file:///main.js")
+	if err != nil || m == nil {
+		t.Fatalf("getModule = %v, %v", m, err)
+	}
+	if m.Kind != "javascript" || string(m.Source) != "main" || string(m.SourceMap) != "{}" {
+		t.Errorf("module = %+v", m)
+	}
+	if m, _ := r.getModule(handle, "file:///data.json"); m == nil || m.Kind != "json" {
+		t.Errorf("json module = %+v", m)
+	}
+	if m, err := r.getModule(handle, "file:///missing.js"); m != nil || err != nil {
+		t.Errorf("missing module = %+v, %v", m, err)
+	}
+
+	r.free(handle)
+	if _, err := r.specifiers(handle); err == nil {
+		t.Error("expected error for freed handle")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	r := newRegistry()
+	if _, err := r.parse([]byte("garbage!")); err == nil {
+		t.Error("expected error for garbage input")
+	}
+	if _, err := r.getModule(42, "file:///main.js"); err == nil {
+		t.Error("expected error for unknown handle")
+	}
+	if _, err := createArchive([]entry{{Specifier: "file:///a", Kind: "python"}}); err == nil {
+		t.Error("expected error for unknown kind")
+	}
+}
+
+func TestParseKind(t *testing.T) {
+	for _, kind := range []eszip.ModuleKind{
+		eszip.ModuleKindJavaScript,
+		eszip.ModuleKindJson,
+		eszip.ModuleKindJsonc,
+		eszip.ModuleKindOpaqueData,
+		eszip.ModuleKindWasm,
+	} {
+		if got, err := parseKind(kind.String()); err != nil || got != kind {
+			t.Errorf("parseKind(%q) = %v, %v", kind, got, err)
+		}
+	}
+	if got, _ := parseKind(""); got != eszip.ModuleKindJavaScript {
+		t.Errorf("empty kind = %v, want javascript", got)
+	}
+}
+
+func TestGetModuleCopiesNothingShared(t *testing.T) {
+	source := []byte("main")
+	data, err := createArchive([]entry{{Specifier: "file:///main.js", Source: source}})
+	if err != nil {
+		t.Fatalf("createArchive failed: %v", err)
+	}
+	source[0] = 'X'
+	r := newRegistry()
+	handle, _ := r.parse(data)
+	if m, _ := r.getModule(handle, "file:///main.js"); m == nil || !bytes.Equal(m.Source, []byte("main")) {
+		t.Errorf("module = %+v", m)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build js && wasm
+
+package wasmapi
+
+import (
+	"syscall/js"
+)
+
+var archives = newRegistry()
+
+// Register installs the API as functions on target:
+//
+//	parse(bytes: Uint8Array): number
+//	specifiers(handle: number): string[]
+//	getModule(handle: number, specifier: string): {kind, source, sourceMap} | null
+//	createArchive(entries: {specifier, kind?, source, sourceMap?}[]): Uint8Array
+//	free(handle: number): void
+//
+// Failures are returned as Error values rather than thrown.
+func Register(target js.Value) {
+	target.Set("parse", js.FuncOf(func(_ js.Value, args []js.Value) any {
+		handle, err := archives.parse(bytesFromJS(arg(args, 0)))
+		if err != nil {
+			return jsError(err)
+		}
+		return handle
+	}))
+
+	target.Set("specifiers", js.FuncOf(func(_ js.Value, args []js.Value) any {
+		specifiers, err := archives.specifiers(arg(args, 0).Int())
+		if err != nil {
+			return jsError(err)
+		}
+		out := make([]any, len(specifiers))
+		for i, s := range specifiers {
+			out[i] = s
+		}
+		return js.ValueOf(out)
+	}))
+
+	target.Set("getModule", js.FuncOf(func(_ js.Value, args []js.Value) any {
+		m, err := archives.getModule(arg(args, 0).Int(), arg(args, 1).String())
+		if err != nil {
+			return jsError(err)
+		}
+		if m == nil {
+			return js.Null()
+		}
+		return js.ValueOf(map[string]any{
+			"kind":      m.Kind,
+			"source":    bytesToJS(m.Source),
+			"sourceMap": bytesToJS(m.SourceMap),
+		})
+	}))
+
+	target.Set("createArchive", js.FuncOf(func(_ js.Value, args []js.Value) any {
+		list := arg(args, 0)
+		entries := make([]entry, list.Length())
+		for i := range entries {
+			e := list.Index(i)
+			entries[i] = entry{
+				Specifier: e.Get("specifier").String(),
+				Kind:      stringFromJS(e.Get("kind")),
+				Source:    bytesFromJS(e.Get("source")),
+				SourceMap: bytesFromJS(e.Get("sourceMap")),
+			}
+		}
+		data, err := createArchive(entries)
+		if err != nil {
+			return jsError(err)
+		}
+		return bytesToJS(data)
+	}))
+
+	target.Set("free", js.FuncOf(func(_ js.Value, args []js.Value) any {
+		archives.free(arg(args, 0).Int())
+		return js.Undefined()
+	}))
+}
+
+func arg(args []js.Value, i int) js.Value {
+	if i < len(args) {
+		return args[i]
+	}
+	return js.Undefined()
+}
+
+// bytesFromJS copies a Uint8Array into Go memory. undefined and null give
+// nil.
+func bytesFromJS(v js.Value) []byte {
+	if v.IsUndefined() || v.IsNull() {
+		return nil
+	}
+	b := make([]byte, v.Length())
+	js.CopyBytesToGo(b, v)
+	return b
+}
+
+// bytesToJS copies b into a new Uint8Array.
+func bytesToJS(b []byte) js.Value {
+	v := js.Global().Get("Uint8Array").New(len(b))
+	js.CopyBytesToJS(v, b)
+	return v
+}
+
+func stringFromJS(v js.Value) string {
+	if v.Type() != js.TypeString {
+		return ""
+	}
+	return v.String()
+}
+
+func jsError(err error) js.Value {
+	return js.Global().Get("Error").New(err.Error())
+}
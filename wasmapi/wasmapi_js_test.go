@@ -0,0 +1,49 @@
+// Copyright 2018-2024 the Deno authors. All rights reserved. MIT license.
+
+//go:build js && wasm
+
+package wasmapi
+
+import (
+	"syscall/js"
+	"testing"
+)
+
+// Run with: GOOS=js GOARCH=wasm go test -exec="$(go env GOROOT)/lib/wasm/go_js_wasm_exec" ./wasmapi
+func TestRegister(t *testing.T) {
+	api := js.Global().Get("Object").New()
+	Register(api)
+
+	entry := js.Global().Get("Object").New()
+	entry.Set("specifier", "file:///main.js")
+	entry.Set("source", bytesToJS([]byte("main")))
+	entries := js.Global().Get("Array").New(entry)
+
+	data := api.Call("createArchive", entries)
+	if !data.InstanceOf(js.Global().Get("Uint8Array")) {
+		t.Fatalf("createArchive returned %v", data)
+	}
+
+	handle := api.Call("parse", data)
+	if handle.Type() != js.TypeNumber {
+		t.Fatalf("parse returned %v", handle)
+	}
+	defer api.Call("free", handle)
+
+	specifiers := api.Call("specifiers", handle)
+	if specifiers.Length() != 1 || specifiers.Index(0).String() != "file:///main.js" {
+		t.Errorf("specifiers = %v", specifiers)
+	}
+
+	m := api.Call("getModule", handle, "file:///main.js")
+	if m.Get("kind").String() != "javascript" || string(bytesFromJS(m.Get("source"))) != "main" || m.Get("sourceMap").Length() != 0 {
+		t.Errorf("module = %v", m)
+	}
+	if m := api.Call("getModule", handle, "file:///missing.js"); !m.IsNull() {
+		t.Errorf("missing module = %v", m)
+	}
+
+	if err := api.Call("parse", bytesToJS([]byte("garbage!"))); !err.InstanceOf(js.Global().Get("Error")) {
+		t.Errorf("parse of garbage returned %v, want an Error", err)
+	}
+}